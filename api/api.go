@@ -0,0 +1,422 @@
+// Package api is the stable Go API of tbml, for programs that embed it
+// instead of running the tbml command. It covers loading a
+// configuration, listing, querying and allocating instances, launching,
+// stopping and pinning them and deleting them. Operations that can take
+// long, like provisioning an instance, downloading extensions or
+// running the browser, take a context and stop when it is canceled.
+//
+// Launchers coordinate through lock files in the profile path, so they
+// can be used concurrently with each other and with the tbml command.
+package api
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type (
+	CleanPolicy          = internal.CleanPolicy
+	CleanResult          = internal.CleanResult
+	Configuration        = internal.Configuration
+	Deprecation          = internal.Deprecation
+	Filter               = internal.Filter
+	InstanceStats        = internal.InstanceStats
+	Mutation             = internal.Mutation
+	ProfileConfiguration = internal.ProfileConfiguration
+	ProfileInstance      = internal.ProfileInstance
+	UsageTime            = internal.UsageTime
+	Warning              = internal.Warning
+)
+
+var (
+	ErrArchiveCorrupted     = internal.ErrArchiveCorrupted
+	ErrInstanceInUse        = internal.ErrInstanceInUse
+	ErrInterfaceDown        = internal.ErrInterfaceDown
+	ErrInstanceLimit        = internal.ErrInstanceLimit
+	ErrInstanceNotListening = internal.ErrInstanceNotListening
+	ErrInstanceNotRunning   = internal.ErrInstanceNotRunning
+	ErrInvalidConfiguration = internal.ErrInvalidConfiguration
+	ErrInvalidFilter        = internal.ErrInvalidFilter
+	ErrLaunchCooldown       = internal.ErrLaunchCooldown
+	ErrLowDiskSpace         = internal.ErrLowDiskSpace
+	ErrNotArchivable        = internal.ErrNotArchivable
+	ErrReadOnlyManagement   = internal.ErrReadOnlyManagement
+	ErrStorageUnavailable   = internal.ErrStorageUnavailable
+	ErrTorUnreachable       = internal.ErrTorUnreachable
+	ErrURLUnreachable       = internal.ErrURLUnreachable
+)
+
+var ErrUnknownProfile error = errors.New("Profile does not exist")
+
+var ErrClaimReleased error = errors.New("The claim was already released")
+
+var ErrDryRun error = errors.New("Nothing was done, this is a dry run")
+
+// ParseFilter parses a filter expression for Query and
+// CleanPolicy.Where, e.g. `profile == "work" && age > 30d && !pinned`.
+// Instances have the fields age, created, label, profile, topic, size,
+// archived, attached, encrypted, ephemeral, pinned, reserved and
+// running. Invalid expressions fail with ErrInvalidFilter.
+func ParseFilter(expression string) (*Filter, error) {
+	return internal.ParseFilter(expression)
+}
+
+// Launcher manages the profiles and instances of one configuration.
+type Launcher struct {
+	config    Configuration
+	configDir string
+
+	// OnWarning, if set, is called with problems that didn't keep an
+	// operation from completing, like unreadable instances. It may be
+	// called from several goroutines at once.
+	OnWarning func(Warning)
+	// DryRun keeps the operations that launch, stop or change
+	// instances from doing so; they only report what they would do to
+	// OnMutation. Claim and ReserveLabel have nothing to return, so
+	// they fail with ErrDryRun.
+	DryRun bool
+	// OnMutation, if set, is called with every change an operation
+	// makes or, with DryRun, would make.
+	OnMutation func(Mutation)
+}
+
+// Load reads and validates a configuration file. Relative paths in it
+// are resolved against the file's directory.
+func Load(configFile string) (*Launcher, error) {
+	config, configDir, err := internal.ReadConfiguration(configFile, nil)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return &Launcher{config: config, configDir: configDir}, nil
+}
+
+// New creates a launcher for a configuration that was built in code.
+// Relative paths in it are resolved against configDir. Unlike Load,
+// profile inheritance isn't resolved, so every profile must be
+// complete.
+func New(config Configuration, configDir string) (*Launcher, error) {
+	if err := internal.ValidateConfiguration(config, configDir); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return &Launcher{config: config, configDir: configDir}, nil
+}
+
+func (l *Launcher) Configuration() Configuration {
+	return l.config
+}
+
+func (l *Launcher) warnings() *internal.Warnings {
+	return &internal.Warnings{OnWarning: l.OnWarning}
+}
+
+// mutations returns what the operations that manage instances record
+// their changes in.
+func (l *Launcher) mutations() *internal.Mutations {
+	return &internal.Mutations{DryRun: l.DryRun, ReadOnly: l.config.ReadOnlyManagement, OnMutation: l.OnMutation}
+}
+
+// launchMutations is like mutations, but for launching and stopping
+// browsers, which ReadOnlyManagement allows.
+func (l *Launcher) launchMutations() *internal.Mutations {
+	return &internal.Mutations{DryRun: l.DryRun, OnMutation: l.OnMutation}
+}
+
+// Profile returns the profile with the given label, or an error
+// wrapping ErrUnknownProfile.
+func (l *Launcher) Profile(label string) (ProfileConfiguration, error) {
+	profile := internal.FindProfileByLabel(l.config, label)
+	if profile == nil {
+		return ProfileConfiguration{}, uerror.StackTracef("%w: %s", ErrUnknownProfile, label)
+	}
+	return *profile, nil
+}
+
+// Instances returns all instances, including those of profiles that
+// are no longer configured.
+func (l *Launcher) Instances() ([]ProfileInstance, error) {
+	return internal.GetProfileInstances(l.config, l.warnings())
+}
+
+// Query returns the instances that match a filter expression, e.g.
+// `profile == "work" && age > 30d && !pinned`, with the same semantics
+// as "tbml ls --where" and PruneWhere. See ParseFilter for the syntax.
+// Invalid expressions fail with ErrInvalidFilter.
+func (l *Launcher) Query(where string) ([]ProfileInstance, error) {
+	filter, err := ParseFilter(where)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	instances, err := l.Instances()
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return internal.FilterInstances(l.config, instances, filter)
+}
+
+func (l *Launcher) Instance(label string) (ProfileInstance, error) {
+	return internal.GetProfileInstance(l.config, label)
+}
+
+// Stats measures the disk usage and uptime of all instances.
+func (l *Launcher) Stats() ([]InstanceStats, error) {
+	return internal.GetInstanceStats(l.config, l.warnings())
+}
+
+// UsageTime adds up how long the browsers ran between from and to, per
+// profile and topic. A zero from or to leaves that side of the range
+// open.
+func (l *Launcher) UsageTime(from time.Time, to time.Time) ([]UsageTime, error) {
+	return internal.GetUsageTime(l.config, from, to, l.warnings())
+}
+
+// Claim picks the best instance of a profile for a topic, creating one
+// if all are in use, and reserves it until the claim is launched or
+// released. If the profile's instance limit is reached, it waits for
+// a free instance until ctx is done or fails with ErrInstanceLimit,
+// depending on the profile's InstanceLimitPolicy. With DryRun, it
+// fails with ErrDryRun.
+func (l *Launcher) Claim(ctx context.Context, profileLabel string, topic string) (*Claim, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	profile, err := l.Profile(profileLabel)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	var claim *Claim
+	err = l.launchMutations().Apply("Launch the best instance of profile", profile.Label, func() error {
+		instance, release, err := internal.ClaimBestInstance(ctx, l.config, profile, &topic, l.warnings())
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		claim = &Claim{Instance: instance, launcher: l, profile: profile, release: release}
+		return nil
+	})
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if claim == nil {
+		return nil, uerror.StackTracef("%w: Claim an instance of %s", ErrDryRun, profile.Label)
+	}
+	return claim, nil
+}
+
+// ReserveLabel takes the label the next new instance of a profile
+// would get, so the instance can be named before it is launched.
+// Claim doesn't pick the reserved instance; Provision creates it.
+// With DryRun, it fails with ErrDryRun.
+func (l *Launcher) ReserveLabel(profileLabel string) (string, error) {
+	profile, err := l.Profile(profileLabel)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	label := ""
+	err = l.launchMutations().Apply("Reserve a label for profile", profile.Label, func() error {
+		var err error
+		label, err = internal.ReserveInstanceLabel(l.config, profile)
+		return err
+	})
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if label == "" {
+		return "", uerror.StackTracef("%w: Reserve a label for %s", ErrDryRun, profile.Label)
+	}
+	return label, nil
+}
+
+// Provision creates or updates the instance of a profile with the
+// given label, e.g. one reserved with ReserveLabel, without launching
+// the browser.
+func (l *Launcher) Provision(ctx context.Context, profileLabel string, instanceLabel string) error {
+	profile, err := l.Profile(profileLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance, err := internal.GetInstanceToProvision(l.config, profile, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return l.launchMutations().Apply("Provision instance", instance.InstanceLabel, func() error {
+		return internal.ProvisionInstance(ctx, l.config, profile, instance, l.configDir)
+	})
+}
+
+// LaunchOptions configure a launch.
+type LaunchOptions struct {
+	// NoSync keeps the instance's files as they are even if its
+	// profile changed since it was last provisioned.
+	NoSync bool
+	// SessionLimit, if not zero, closes the browser once it ran this
+	// long, after warning the user with a desktop notification.
+	SessionLimit time.Duration
+	// URL is opened instead of the new tab page.
+	URL *url.URL
+}
+
+// LaunchEphemeral launches a throwaway instance of a profile that is
+// wiped when the browser exits. It blocks until then and returns the
+// browser's exit code.
+func (l *Launcher) LaunchEphemeral(ctx context.Context, profileLabel string, topic string, options LaunchOptions) (int, error) {
+	profile, err := l.Profile(profileLabel)
+	if err != nil {
+		return 0, uerror.WithStackTrace(err)
+	}
+	instance, err := internal.NewEphemeralInstance(l.config, profile)
+	if err != nil {
+		return 0, uerror.WithStackTrace(err)
+	}
+	instance.UsageLabel = &topic
+	var exitCode uint
+	err = l.launchMutations().Apply("Launch an ephemeral instance of profile", profile.Label, func() error {
+		exitCode, err = internal.StartInstance(ctx, l.config, profile, instance, l.configDir, options.URL, false, options.NoSync, options.SessionLimit, l.warnings())
+		return err
+	})
+	return int(exitCode), err
+}
+
+// OpenURL opens a URL in a new tab of a running instance. An empty URL
+// opens the new tab page. If the instance's browser isn't running, the
+// error wraps ErrInstanceNotListening.
+func (l *Launcher) OpenURL(instance ProfileInstance, url string) error {
+	return internal.ForwardURLToInstance(l.config, instance, url)
+}
+
+// Sync brings an instance that isn't in use up to date with its
+// profile, downloading extensions if needed.
+func (l *Launcher) Sync(ctx context.Context, instanceLabel string) error {
+	instance, err := l.Instance(instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	profile, err := l.Profile(instance.ProfileLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return l.launchMutations().Apply("Sync instance", instance.InstanceLabel, func() error {
+		return internal.SyncInstance(ctx, l.config, profile, instance, l.configDir)
+	})
+}
+
+// Delete deletes an instance that isn't in use. Like with the tbml
+// command, the deletion can be undone with "tbml undo". It fails with
+// ErrReadOnlyManagement if the configuration sets ReadOnlyManagement.
+func (l *Launcher) Delete(ctx context.Context, instanceLabel string) error {
+	if err := ctx.Err(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance, err := l.Instance(instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.DeleteInstance(l.config, instance, l.mutations())
+}
+
+// Purge deletes an instance that isn't in use for good, freeing its
+// disk space right away. Unlike with Delete, the deletion can't be
+// undone. Like Delete, it fails with ErrReadOnlyManagement if the
+// configuration sets ReadOnlyManagement.
+func (l *Launcher) Purge(ctx context.Context, instanceLabel string) error {
+	if err := ctx.Err(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance, err := l.Instance(instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.PurgeInstance(l.config, instance, l.mutations())
+}
+
+// Stop closes the browser of a running instance, whichever process
+// launched it, and waits until the instance is released or ctx is
+// done. The browser saves its session like when its window is closed.
+// If the browser isn't running, the error wraps ErrInstanceNotRunning.
+func (l *Launcher) Stop(ctx context.Context, instanceLabel string) error {
+	instance, err := l.Instance(instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return l.launchMutations().Apply("Stop instance", instance.InstanceLabel, func() error {
+		return internal.StopInstance(ctx, l.config, instance)
+	})
+}
+
+// Pin pins or unpins an instance, even while it is in use. Pinned
+// instances are kept by Prune and aren't evicted when their profile
+// reaches its MaxInstances. Like Delete, it fails with
+// ErrReadOnlyManagement if the configuration sets ReadOnlyManagement.
+func (l *Launcher) Pin(instanceLabel string, pinned bool) error {
+	instance, err := l.Instance(instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.PinInstance(l.config, instance, pinned, l.mutations())
+}
+
+// Prune deletes the instances that exceed the policy's limits for good,
+// except those that are in use or pinned, and returns what was deleted
+// and why. With dryRun or the launcher's DryRun, it only returns what
+// would be deleted. Like Delete,
+// it fails with ErrReadOnlyManagement if the configuration sets
+// ReadOnlyManagement.
+func (l *Launcher) Prune(ctx context.Context, policy CleanPolicy, dryRun bool) ([]CleanResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	mutations := l.mutations()
+	mutations.DryRun = mutations.DryRun || dryRun
+	return internal.CleanInstances(l.config, policy, mutations, l.warnings())
+}
+
+// Archive compresses the files of an instance that isn't in use to free
+// up disk space. The instance is unarchived when it is launched again.
+// Like Delete, it fails with ErrReadOnlyManagement if the
+// configuration sets ReadOnlyManagement.
+func (l *Launcher) Archive(ctx context.Context, instanceLabel string) error {
+	if err := ctx.Err(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance, err := l.Instance(instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.ArchiveInstance(l.config, instance, l.mutations())
+}
+
+// Claim is an instance reserved by Launcher.Claim. It must be either
+// launched or released.
+type Claim struct {
+	Instance ProfileInstance
+
+	launcher *Launcher
+	profile  ProfileConfiguration
+	release  func() error
+}
+
+// Launch runs the browser in the claimed instance until it exits and
+// returns its exit code. The claim is released afterwards.
+func (c *Claim) Launch(ctx context.Context, options LaunchOptions) (int, error) {
+	if c.release == nil {
+		return 0, uerror.WithStackTrace(ErrClaimReleased)
+	}
+	release := c.release
+	c.release = nil
+	l := c.launcher
+	exitCode, err := internal.StartClaimedInstance(ctx, l.config, c.profile, c.Instance, release, l.configDir, options.URL, false, options.NoSync, options.SessionLimit, l.warnings())
+	return int(exitCode), err
+}
+
+// Release gives up the claim without launching the instance.
+func (c *Claim) Release() error {
+	if c.release == nil {
+		return uerror.WithStackTrace(ErrClaimReleased)
+	}
+	release := c.release
+	c.release = nil
+	return release()
+}
@@ -0,0 +1,241 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"t0ast.cc/tbml/api"
+)
+
+func newTestLauncher(t *testing.T) *api.Launcher {
+	launcher, err := api.New(api.Configuration{
+		ProfilePath: t.TempDir(),
+		Profiles:    []api.ProfileConfiguration{{Label: "test"}},
+	}, t.TempDir())
+	assert.NoError(t, err)
+	return launcher
+}
+
+func TestNewInvalidConfiguration(t *testing.T) {
+	_, err := api.New(api.Configuration{}, t.TempDir())
+	assert.True(t, errors.Is(err, api.ErrInvalidConfiguration))
+}
+
+func TestProfile(t *testing.T) {
+	launcher := newTestLauncher(t)
+
+	testCases := []struct {
+		desc string
+
+		label string
+		err   error
+	}{
+		{
+			desc: "known profile",
+
+			label: "test",
+		},
+		{
+			desc: "unknown profile",
+
+			label: "other",
+			err:   api.ErrUnknownProfile,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			profile, err := launcher.Profile(tC.label)
+			if tC.err != nil {
+				assert.True(t, errors.Is(err, tC.err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.label, profile.Label)
+		})
+	}
+}
+
+func TestClaimLifecycle(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx := context.Background()
+
+	claim, err := launcher.Claim(ctx, "test", "work")
+	assert.NoError(t, err)
+	assert.Equal(t, "test", claim.Instance.ProfileLabel)
+
+	instances, err := launcher.Instances()
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+
+	assert.NoError(t, claim.Release())
+	assert.True(t, errors.Is(claim.Release(), api.ErrClaimReleased))
+	_, err = claim.Launch(ctx, api.LaunchOptions{})
+	assert.True(t, errors.Is(err, api.ErrClaimReleased))
+
+	assert.NoError(t, launcher.Delete(ctx, claim.Instance.InstanceLabel))
+	instances, err = launcher.Instances()
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+}
+
+func TestReserveLabel(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx := context.Background()
+
+	label, err := launcher.ReserveLabel("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-1", label)
+
+	claim, err := launcher.Claim(ctx, "test", "work")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-2", claim.Instance.InstanceLabel)
+	assert.NoError(t, claim.Release())
+
+	assert.NoError(t, launcher.Provision(ctx, "test", label))
+	instance, err := launcher.Instance(label)
+	assert.NoError(t, err)
+	assert.False(t, instance.Reserved)
+}
+
+func TestCanceledContext(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := launcher.Claim(ctx, "test", "work")
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	err = launcher.Delete(ctx, "test-1")
+	assert.True(t, errors.Is(err, context.Canceled))
+	err = launcher.Purge(ctx, "test-1")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestPinAndPrune(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx := context.Background()
+
+	claims := []*api.Claim{}
+	for _, topic := range []string{"work", "news"} {
+		claim, err := launcher.Claim(ctx, "test", topic)
+		assert.NoError(t, err)
+		claims = append(claims, claim)
+	}
+	// Instances can be pinned while they are in use.
+	pinned := claims[0].Instance.InstanceLabel
+	assert.NoError(t, launcher.Pin(pinned, true))
+	for _, claim := range claims {
+		assert.NoError(t, claim.Release())
+	}
+
+	maxInstances := 0
+	policy := api.CleanPolicy{MaxInstancesPerProfile: &maxInstances}
+	results, err := launcher.Prune(ctx, policy, true)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, claims[1].Instance.InstanceLabel, results[0].Instance.InstanceLabel)
+	}
+	instances, err := launcher.Instances()
+	assert.NoError(t, err)
+	assert.Len(t, instances, 2)
+
+	results, err = launcher.Prune(ctx, policy, false)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	instances, err = launcher.Instances()
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, pinned, instances[0].InstanceLabel)
+		assert.True(t, instances[0].Pinned)
+	}
+
+	assert.NoError(t, launcher.Pin(pinned, false))
+	results, err = launcher.Prune(ctx, policy, false)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+func TestDryRun(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx := context.Background()
+
+	claim, err := launcher.Claim(ctx, "test", "work")
+	assert.NoError(t, err)
+	label := claim.Instance.InstanceLabel
+	assert.NoError(t, claim.Release())
+
+	mutations := []string{}
+	launcher.DryRun = true
+	launcher.OnMutation = func(mutation api.Mutation) {
+		mutations = append(mutations, mutation.String())
+	}
+
+	_, err = launcher.Claim(ctx, "test", "news")
+	assert.True(t, errors.Is(err, api.ErrDryRun))
+	_, err = launcher.ReserveLabel("test")
+	assert.True(t, errors.Is(err, api.ErrDryRun))
+	assert.NoError(t, launcher.Pin(label, true))
+	maxInstances := 0
+	results, err := launcher.Prune(ctx, api.CleanPolicy{MaxInstancesPerProfile: &maxInstances}, false)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.NoError(t, launcher.Delete(ctx, label))
+	assert.NoError(t, launcher.Stop(ctx, label))
+
+	assert.Equal(t, []string{
+		"Launch the best instance of profile test",
+		"Reserve a label for profile test",
+		"Pin instance " + label,
+		"Delete instance for good " + label,
+		"Delete instance " + label,
+		"Stop instance " + label,
+	}, mutations)
+	instances, err := launcher.Instances()
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, label, instances[0].InstanceLabel)
+		assert.False(t, instances[0].Pinned)
+	}
+}
+
+func TestStopNotRunning(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx := context.Background()
+
+	claim, err := launcher.Claim(ctx, "test", "work")
+	assert.NoError(t, err)
+	assert.NoError(t, claim.Release())
+	err = launcher.Stop(ctx, claim.Instance.InstanceLabel)
+	assert.True(t, errors.Is(err, api.ErrInstanceNotRunning))
+}
+
+func TestQuery(t *testing.T) {
+	launcher := newTestLauncher(t)
+	ctx := context.Background()
+
+	claim, err := launcher.Claim(ctx, "test", "work")
+	assert.NoError(t, err)
+	assert.NoError(t, claim.Release())
+	assert.NoError(t, launcher.Pin(claim.Instance.InstanceLabel, true))
+
+	instances, err := launcher.Query(`profile == "test" && pinned`)
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, claim.Instance.InstanceLabel, instances[0].InstanceLabel)
+	}
+	instances, err = launcher.Query(`!pinned || age > 1d`)
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+
+	_, err = launcher.Query(`pinned ==`)
+	assert.True(t, errors.Is(err, api.ErrInvalidFilter))
+
+	// Prune policies use the same filters.
+	where, err := api.ParseFilter(`topic == "" && pinned`)
+	assert.NoError(t, err)
+	results, err := launcher.Prune(ctx, api.CleanPolicy{Where: where}, true)
+	assert.NoError(t, err)
+	assert.Empty(t, results, "pinned instances are never pruned")
+}
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type AttachCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance the browser uses"`
+	PID      int    `arg:"" help:"The process ID of the browser" name:"pid"`
+	Topic    string `completion:"topics" help:"The topic the browser is used for" long:"topic" short:"t"`
+}
+
+func (cmd *AttachCmd) Run(ctx CommandContext) error {
+	instance, err := internal.GetProfileInstance(ctx.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	var usageLabel *string
+	if cmd.Topic != "" {
+		usageLabel = &cmd.Topic
+		if err := ctx.Mutations.Apply("Record usage of topic", cmd.Topic, func() error {
+			return internal.RecordTopicUsage(ctx.Config, cmd.Topic)
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to record topic usage: %s", err))
+		}
+	}
+
+	err = ctx.Mutations.Apply("Attach a browser to instance", instance.InstanceLabel, func() error {
+		return internal.AttachInstance(ctx.Config, instance, cmd.PID, usageLabel)
+	})
+	if errors.Is(err, internal.ErrProcessNotRunning) {
+		return ctx.Messages.Errorf("Process %d is not running", cmd.PID)
+	}
+	if errors.Is(err, internal.ErrInstanceInUse) {
+		return ctx.Messages.Errorf("Instance %s is in use", instance.InstanceLabel)
+	}
+	return err
+}
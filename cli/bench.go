@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type BenchCmd struct {
+	Iterations int `default:"20" help:"How often to run each operation"`
+}
+
+func (cmd *BenchCmd) Run(common CommandContext) error {
+	probe, err := internal.ProbeProfilePath(common.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	results, err := internal.RunBenchmarks(common.Config, cmd.Iterations)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(common.Messages.Sprintf("File system: %s, reflinks: %t, overlayfs: %t, free: %s", probe.FileSystem, probe.Reflinks, probe.Overlay, uio.FormatByteSize(probe.FreeBytes)))
+	for _, result := range results {
+		fmt.Printf("%-32s%12s/op\n", result.Name, result.PerIteration())
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type BookmarksCmd struct {
+	Export BookmarksExportCmd `cmd:"" help:"Write the bookmarks of an instance that isn't in use to an HTML or JSON file"`
+	Import BookmarksImportCmd `cmd:"" help:"Add the bookmarks from an HTML or JSON file to an instance that isn't in use"`
+}
+
+type BookmarksExportCmd struct {
+	Format   string `default:"html" enum:"html,json" help:"Write a bookmark file that browsers can import, or JSON"`
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to export the bookmarks of"`
+	Output   string `help:"The file to write the bookmarks to (default: standard output)" short:"o" type:"path"`
+}
+
+func (cmd *BookmarksExportCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	format, err := internal.ParseBookmarkFormat(cmd.Format)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	var output io.Writer = os.Stdout
+	if cmd.Output != "" {
+		file, err := os.Create(cmd.Output)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	if err := internal.ExportBookmarks(common.Config, instance, format, output); err != nil {
+		if cmd.Output != "" {
+			os.Remove(cmd.Output)
+		}
+		return translateDatabaseError(common, instance, err)
+	}
+	return nil
+}
+
+type BookmarksImportCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to add the bookmarks to"`
+	File     string `arg:"" help:"A bookmark file exported by a browser or tbml" type:"existingfile"`
+}
+
+func (cmd *BookmarksImportCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	err = common.Mutations.Apply("Import bookmarks into instance", instance.InstanceLabel, func() error {
+		return internal.ImportBookmarks(common.Config, instance, cmd.File)
+	})
+	if errors.Is(err, internal.ErrNoPlacesDatabase) {
+		return common.Messages.Errorf("Instance %s has no bookmarks yet, launch it once first", instance.InstanceLabel)
+	}
+	return translateDatabaseError(common, instance, err)
+}
+
+// translateDatabaseError explains the errors of commands that access
+// the browser's databases.
+func translateDatabaseError(common CommandContext, instance internal.ProfileInstance, err error) error {
+	if errors.Is(err, internal.ErrSQLiteUnavailable) {
+		return common.Messages.Errorf("Reading the browser's databases needs sqlite3, please install it")
+	}
+	if errors.Is(err, internal.ErrInstanceInUse) {
+		return common.Messages.Errorf("Instance %s is in use", instance.InstanceLabel)
+	}
+	return uerror.WithStackTrace(err)
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type CleanCmd struct {
+	MaxAge   time.Duration `help:"Delete instances that haven't been used for this long (e.g. 720h)"`
+	MaxCount int           `help:"Keep at most this many instances per profile, deleting the least recently used ones"`
+	MaxSize  string        `help:"Delete the least recently used instances until all instances together take up at most this much space (e.g. 10G)"`
+	Where    string        `help:"Delete instances that match a filter expression (e.g. 'age > 30d && !pinned'), instead of those that match PruneWhere"`
+}
+
+func (cmd *CleanCmd) Run(common CommandContext) error {
+	policy := internal.CleanPolicy{}
+	if cmd.MaxAge > 0 {
+		policy.MaxAge = &cmd.MaxAge
+	}
+	if cmd.MaxCount > 0 {
+		policy.MaxInstancesPerProfile = &cmd.MaxCount
+	}
+	if cmd.MaxSize != "" {
+		maxSize, err := uio.ParseByteSize(cmd.MaxSize)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		policy.MaxTotalSize = &maxSize
+	}
+	where, err := getPruneFilter(common, cmd.Where)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	policy.Where = where
+
+	// The results below already say what would be deleted, so the
+	// mutations aren't reported separately.
+	mutations := &internal.Mutations{DryRun: common.Mutations.DryRun, ReadOnly: common.Mutations.ReadOnly}
+	results, err := internal.CleanInstances(common.Config, policy, mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	verb := common.Messages.Sprintf("Deleted")
+	if mutations.DryRun {
+		verb = common.Messages.Sprintf("Would delete")
+	}
+	var total int64
+	for _, result := range results {
+		fmt.Printf("%s %s (%s): %s\n", verb, result.Instance.InstanceLabel, uio.FormatByteSize(result.Size), result.Reason)
+		total += result.Size
+	}
+	fmt.Print(common.Messages.Sprintf("%s %d instances, %s in total\n", verb, len(results), uio.FormatByteSize(total)))
+
+	garbage, err := internal.CollectGarbage(common.Config, mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	categoryNames := map[string]string{
+		internal.GarbageArchiveChunks:  common.Messages.Sprintf("Archive chunks"),
+		internal.GarbageExtensionCache: common.Messages.Sprintf("Extension cache"),
+		internal.GarbageFileCache:      common.Messages.Sprintf("File cache"),
+		internal.GarbageTemporaryFiles: common.Messages.Sprintf("Temporary files"),
+		internal.GarbageUndoBackups:    common.Messages.Sprintf("Expired undo backups"),
+	}
+	for _, result := range garbage {
+		fmt.Print(common.Messages.Sprintf("%s: %s %d files, %s\n", categoryNames[result.Category], verb, result.Files, uio.FormatByteSize(result.Size)))
+	}
+
+	extensionCache, err := internal.GetExtensionCacheStats(common.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(formatExtensionCacheStats(common, extensionCache))
+	return nil
+}
+
+// getPruneFilter parses the --where of "tbml clean" and "tbml ui",
+// falling back to the configured PruneWhere.
+func getPruneFilter(common CommandContext, where string) (*internal.Filter, error) {
+	if where == "" && common.Config.PruneWhere != nil {
+		where = *common.Config.PruneWhere
+	}
+	if where == "" {
+		return nil, nil
+	}
+	return internal.ParseFilter(where)
+}
+
+// formatExtensionCacheStats describes how full the extension cache is,
+// e.g. for "tbml clean" and "tbml status".
+func formatExtensionCacheStats(common CommandContext, stats internal.ExtensionCacheStats) string {
+	summary := common.Messages.Sprintf("Extension cache: %d files, %s (%d pinned, %s)", stats.Files, uio.FormatByteSize(stats.Size), stats.PinnedFiles, uio.FormatByteSize(stats.PinnedSize))
+	if stats.MaxSize != nil {
+		summary += common.Messages.Sprintf(", limit %s", uio.FormatByteSize(*stats.MaxSize))
+	}
+	return summary
+}
@@ -3,77 +3,337 @@ package cli
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/alecthomas/kong"
 	"t0ast.cc/tbml/internal"
 	uerror "t0ast.cc/tbml/util/error"
+	"t0ast.cc/tbml/util/i18n"
 	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
 )
 
 var ErrNoConfig error = errors.New("No config file found")
 
+var configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
 var CLI struct {
-	ConfigPath string `help:"Path of the configuration file to use (default: ~/.config/tbml/config.json, then /etc/tbml/config.json)" name:"config" optional:"" type:"path"`
+	DryRun bool `help:"Report what would be changed instead of changing anything"`
+
+	ConfigPath string `help:"Path of the configuration file or directory to use (default: $TBML_CONFIG, otherwise config.json, .yaml, .yml, .toml or config.d in ~/.config/tbml, then /etc/tbml)" name:"config" optional:"" type:"path"`
+
+	LogFormat string `help:"Write log entries as text or json (default: the configured format or text)" placeholder:"FORMAT"`
+	LogLevel  string `help:"Log entries of this level and above: debug, info, warn or error (default: the configured level or warn)" placeholder:"LEVEL"`
+
+	NoRedact bool `help:"Don't mask URLs, the user's name and SensitiveTopics in the log, errors and debug bundles"`
 
 	Open OpenCmd `cmd:"" default:"1" help:"Open a new tab (default if no arguments are given)"`
 
+	Attach AttachCmd `cmd:"" help:"Mark an instance as used by a browser that was started without tbml"`
+
+	Bench BenchCmd `cmd:"" help:"Time storage operations on the profile path's filesystem" hidden:""`
+
+	Bookmarks BookmarksCmd `cmd:"" help:"Export and import the bookmarks of instances"`
+
+	Config ConfigCmd `cmd:"" help:"Maintain the configuration files"`
+
+	Cookies CookiesCmd `cmd:"" help:"Export the cookies of instances for other programs"`
+
+	Debug DebugCmd `cmd:"" help:"Tools for debugging tbml" hidden:""`
+
+	Desktop DesktopCmd `cmd:"" help:"Manage desktop entries for the profiles"`
+
+	Doctor DoctorCmd `cmd:"" help:"Check the configuration and the profile path's filesystem for settings that slow down launches"`
+
+	EmptyTrash EmptyTrashCmd `cmd:"" help:"Delete the instances in the trash for good, so tbml undo can't restore them"`
+
+	Export ExportCmd `cmd:"" help:"Write an instance's files and metadata to a tar.gz archive"`
+
+	History HistoryCmd `cmd:"" help:"List recently opened tabs, most recent first"`
+
+	Import ImportCmd `cmd:"" help:"Restore an instance from an archive created by export"`
+
 	Ls LsCmd `cmd:"" help:"List profiles, profile instances and topics"`
 
+	Clean CleanCmd `cmd:"" help:"Delete stale instances"`
+
+	Complete CompleteCmd `cmd:"" help:"Print the completions for a partial command line (used by the completion scripts)" hidden:""`
+
+	Completion CompletionCmd `cmd:"" help:"Print a shell completion script, e.g. for ~/.bashrc: source <(tbml completion bash)"`
+
+	Init InitCmd `cmd:"" help:"Create a starter configuration for the installed browser"`
+
+	Instance InstanceCmd `cmd:"" help:"Inspect, rename, move and archive instances"`
+
+	Maintain MaintainCmd `cmd:"" help:"Delete instances that match PruneWhere and archive those that weren't used for ArchiveAfterDays now instead of once a day, e.g. from a timer"`
+
+	MigrateStorage MigrateStorageCmd `cmd:"" help:"Move the files of a profile's instances to another directory, e.g. on a faster or larger disk"`
+
+	MoveTab MoveTabCmd `cmd:"" help:"Close a tab in the instance of one topic and open it in another profile or topic"`
+
+	Pick PickCmd `cmd:"" help:"Search profiles, topics and running instances in the terminal and open the chosen one"`
+
+	Profile ProfileCmd `cmd:"" help:"Share profile definitions as .tbmlprofile bundles"`
+
+	Provision ProvisionCmd `cmd:"" help:"Create or update an instance without launching it and print its path"`
+
+	Rerun RerunCmd `cmd:"" help:"Open a tab from tbml history again"`
+
+	Reap ReapCmd `cmd:"" help:"Release instances whose browser has died and delete dead ephemeral instances"`
+
 	Rm RmCmd `cmd:"" help:"Delete an instance of a profile"`
+
+	Route RouteCmd `cmd:"" help:"Test the configured routes"`
+
+	Schema SchemaCmd `cmd:"" help:"Print and check against the JSON Schemas of the configuration, instance metadata, control socket and JSON output"`
+
+	Seat SeatCmd `cmd:"" help:"Give every seat of a shared machine, e.g. every login, an instance of its own"`
+
+	Status StatusCmd `cmd:"" help:"Show the disk usage, last use and uptime of every instance"`
+
+	Stats StatsCmd `cmd:"" help:"Show how much time was spent per profile and topic"`
+
+	Sync SyncCmd `cmd:"" help:"Apply changes to profiles to their instances that are not in use"`
+
+	Tabs TabsCmd `cmd:"" help:"Search and export the open tabs of all instances"`
+
+	Topics TopicsCmd `cmd:"" help:"Print known topics, most relevant first (for shell completion)" hidden:""`
+
+	Ui UICmd `cmd:"" help:"Show profiles and instances in a terminal console to launch, stop, delete, pin and prune them"`
+
+	Undo UndoCmd `cmd:"" help:"Undo the last deletion or configuration edit"`
+
+	Verify VerifyCmd `cmd:"" help:"Check that an instance's prefs match its profile's configuration and lint its user.js"`
+
+	Version VersionCmd `cmd:"" help:"Print the version and build information"`
 }
 
 type CommandContext struct {
-	Config    internal.Configuration
-	ConfigDir string
-	Context   context.Context
+	Config     internal.Configuration
+	ConfigDir  string
+	ConfigFile string
+	Context    context.Context
+	Messages   *i18n.Printer
+	Model      *kong.Application
+	Mutations  *internal.Mutations
+	Redactor   *internal.Redactor
+	Warnings   *internal.Warnings
 }
 
 func Run(args []string) error {
-	kctx, err := kong.Must(&CLI).Parse(args[1:])
+	// Errors are redacted even if the configuration can't be loaded,
+	// just without its SensitiveTopics.
+	redactor := internal.NewRedactor()
+	if hasFlag(args[1:], "--no-redact") {
+		redactor = nil
+	}
+	return redactor.RedactError(run(args, redactor))
+}
+
+func run(args []string, redactor *internal.Redactor) error {
+	parser := kong.Must(&CLI)
+	args = args[1:]
+
+	msgs := i18n.NewPrinter(messages, i18n.DetectLanguage())
+	completing := isCompleting(args)
+	warnings := &internal.Warnings{
+		OnWarning: func(warning internal.Warning) {
+			if !completing {
+				fmt.Fprintln(os.Stderr, redactor.Redact(msgs.Sprintf("Warning: %s", warning)))
+			}
+		},
+	}
+
+	// The configuration is needed to expand aliases before parsing,
+	// but errors are only reported after parsing so "--help" works
+	// without one.
+	config, configFile, configDir, configErr := loadConfig(findConfigPath(args), warnings)
+	if configErr == nil {
+		expanded, err := expandAlias(parser, config.Aliases, args)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		args = expanded
+	}
+
+	kctx, err := parser.Parse(args)
 	if err != nil {
 		return uerror.WithStackTrace(err)
 	}
 
-	config, configDir, err := loadConfig(CLI.ConfigPath)
-	if err != nil {
+	// The version is also needed to debug a broken configuration,
+	// completion scripts are often set up before the configuration, init
+	// creates it and schemas are used to check it.
+	if configErr != nil && (kctx.Command() == "version" || kctx.Command() == "completion <shell>" || kctx.Command() == "init" || strings.HasPrefix(kctx.Command(), "schema ")) {
+		configErr = nil
+	}
+	// Completion degrades to commands and flags with a broken
+	// configuration. An empty ConfigFile tells it not to use the
+	// configuration.
+	if configErr != nil && completing {
+		config, configFile, configDir, configErr = internal.Configuration{}, "", "", nil
+	}
+	if errors.Is(configErr, ErrNoConfig) {
+		return uerror.WithStackTrace(msgs.Errorf("No config file found"))
+	}
+	if configErr != nil {
+		return uerror.WithStackTrace(configErr)
+	}
+	redactor.SetSensitiveTopics(config.SensitiveTopics)
+	if err := setUpLogging(config, redactor); err != nil {
 		return uerror.WithStackTrace(err)
 	}
 
-	return kctx.Run(CommandContext{
-		Config:    config,
-		ConfigDir: configDir,
-		Context:   context.Background(),
+	err = kctx.Run(CommandContext{
+		Config:     config,
+		ConfigDir:  configDir,
+		ConfigFile: configFile,
+		Context:    context.Background(),
+		Messages:   msgs,
+		Model:      parser.Model,
+		Mutations: &internal.Mutations{
+			DryRun:   CLI.DryRun,
+			ReadOnly: config.ReadOnlyManagement,
+			OnMutation: func(mutation internal.Mutation) {
+				if CLI.DryRun {
+					fmt.Fprintln(os.Stderr, msgs.Sprintf("Dry run: %s", mutation))
+				}
+			},
+		},
+		Redactor: redactor,
+		Warnings: warnings,
 	})
+	if errors.Is(err, internal.ErrReadOnlyManagement) {
+		return uerror.WithStackTrace(msgs.Errorf("Not allowed, the configuration sets ReadOnlyManagement"))
+	}
+	return err
 }
 
-func loadConfig(cliPath string) (internal.Configuration, string, error) {
+// findConfigPath finds the value of the "--config" flag without
+// parsing the whole command line, falling back to $TBML_CONFIG.
+func findConfigPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--config=") {
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return os.Getenv(internal.ConfigEnvVar)
+}
+
+// hasFlag tells whether the boolean flag is given before the end of
+// the options, without parsing the whole command line.
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// expandAlias expands an alias given as the command. Built-in commands
+// always take precedence over aliases.
+func expandAlias(parser *kong.Kong, aliases map[string]string, args []string) ([]string, error) {
+	if len(aliases) == 0 {
+		return args, nil
+	}
+
+	commandIndex := findCommandIndex(args)
+	if commandIndex == -1 {
+		return args, nil
+	}
+	for _, command := range parser.Model.Children {
+		if command.Name == args[commandIndex] {
+			return args, nil
+		}
+	}
+
+	return internal.ExpandAlias(aliases, args, commandIndex)
+}
+
+// findCommandIndex returns the index of the command in args, or -1 if
+// only flags are given.
+func findCommandIndex(args []string) int {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--config" {
+			i++
+			continue
+		}
+		if !strings.HasPrefix(args[i], "-") {
+			return i
+		}
+	}
+	return -1
+}
+
+func loadConfig(cliPath string, warnings *internal.Warnings) (config internal.Configuration, configFile string, configDir string, err error) {
 	if cliPath != "" {
-		return internal.ReadConfiguration(cliPath)
+		config, configDir, err := internal.ReadConfiguration(cliPath, warnings)
+		return config, cliPath, configDir, err
 	}
 
 	home, err := os.UserHomeDir()
 	if err != nil {
-		return internal.Configuration{}, "", uerror.WithStackTrace(err)
+		return internal.Configuration{}, "", "", uerror.WithStackTrace(err)
 	}
-	homeConfigFile := filepath.Join(home, ".config/tbml/config.json")
-	homeConfigFileExists, err := uio.FileExists(homeConfigFile)
-	if err != nil {
-		return internal.Configuration{}, "", uerror.WithStackTrace(err)
-	}
-	if homeConfigFileExists {
-		return internal.ReadConfiguration(homeConfigFile)
+	for _, searchDir := range []string{filepath.Join(home, ".config/tbml"), "/etc/tbml"} {
+		for _, configFileName := range configFileNames {
+			configFile := filepath.Join(searchDir, configFileName)
+			configFileExists, err := uio.FileExists(configFile)
+			if err != nil {
+				return internal.Configuration{}, "", "", uerror.WithStackTrace(err)
+			}
+			if configFileExists {
+				config, configDir, err := internal.ReadConfiguration(configFile, warnings)
+				return config, configFile, configDir, err
+			}
+		}
+		// Without a configuration file, a directory of files can be
+		// used instead.
+		configFile := filepath.Join(searchDir, "config.d")
+		configDirExists, err := uio.DirExists(configFile)
+		if err != nil {
+			return internal.Configuration{}, "", "", uerror.WithStackTrace(err)
+		}
+		if configDirExists {
+			config, configDir, err := internal.ReadConfiguration(configFile, warnings)
+			return config, configFile, configDir, err
+		}
 	}
 
-	etcConfigFile := "/etc/tbml/config.json"
-	etcConfigFileExists, err := uio.FileExists(etcConfigFile)
+	return internal.Configuration{}, "", "", uerror.WithStackTrace(ErrNoConfig)
+}
+
+// setUpLogging sets the default logger according to the configuration
+// and the command line, which takes precedence. Entries are redacted
+// by redactor.
+func setUpLogging(config internal.Configuration, redactor *internal.Redactor) error {
+	level, format, err := internal.GetLogSettings(config)
 	if err != nil {
-		return internal.Configuration{}, "", uerror.WithStackTrace(err)
+		return uerror.WithStackTrace(err)
 	}
-	if etcConfigFileExists {
-		return internal.ReadConfiguration(etcConfigFile)
+	if CLI.LogLevel != "" {
+		if level, err = ulog.ParseLevel(CLI.LogLevel); err != nil {
+			return uerror.WithStackTrace(err)
+		}
 	}
-
-	return internal.Configuration{}, "", uerror.WithStackTrace(ErrNoConfig)
+	if CLI.LogFormat != "" {
+		if format, err = ulog.ParseFormat(CLI.LogFormat); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	ulog.SetDefault(ulog.New(redactor.Writer(os.Stderr), level, format))
+	return nil
 }
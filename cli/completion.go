@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"t0ast.cc/tbml/internal"
+)
+
+// The completion scripts only pass the words typed so far to
+// "tbml complete", so they don't need to be regenerated when commands
+// or flags change.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for tbml
+_tbml() {
+	local candidate
+	COMPREPLY=()
+	while IFS= read -r candidate; do
+		COMPREPLY+=("$(printf '%q' "$candidate")")
+	done < <(tbml complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+}
+complete -o default -F _tbml tbml
+`,
+	"fish": `# fish completion for tbml
+function __tbml_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	set -l candidates (tbml complete -- $words (commandline -ct) 2>/dev/null)
+	if test (count $candidates) -eq 0
+		__fish_complete_path (commandline -ct)
+		return
+	end
+	printf '%s\n' $candidates
+end
+complete -c tbml -f -a '(__tbml_complete)'
+`,
+	"zsh": `#compdef tbml
+# zsh completion for tbml
+_tbml() {
+	local -a candidates
+	candidates=(${(f)"$(tbml complete -- "${(@Q)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#candidates} == 0 )); then
+		_default
+		return
+	fi
+	compadd -Q -a candidates
+}
+compdef _tbml tbml
+`,
+}
+
+type CompletionCmd struct {
+	Shell string `arg:"" enum:"bash,fish,zsh" help:"The shell to print the completion script for: bash, fish or zsh"`
+}
+
+func (cmd *CompletionCmd) Run(common CommandContext) error {
+	fmt.Print(completionScripts[cmd.Shell])
+	return nil
+}
+
+type CompleteCmd struct {
+	Words []string `arg:"" help:"The words typed so far, the last one being completed" optional:""`
+}
+
+func (cmd *CompleteCmd) Run(common CommandContext) error {
+	values := func(kind string) []string {
+		// Without a usable configuration, commands and flags are
+		// still completed.
+		if common.ConfigFile == "" {
+			return nil
+		}
+		switch kind {
+		case "profiles":
+			return internal.GetProfileLabels(common.Config)
+		case "topics", "instances":
+			instances, err := internal.GetProfileInstances(common.Config, common.Warnings)
+			if err != nil {
+				return nil
+			}
+			if kind == "topics" {
+				return internal.GetTopics(instances)
+			}
+			labels := make([]string, len(instances))
+			for i, instance := range instances {
+				labels[i] = instance.InstanceLabel
+			}
+			return labels
+		}
+		return nil
+	}
+	for _, candidate := range completeWords(common.Model, cmd.Words, values) {
+		fmt.Println(candidate)
+	}
+	return nil
+}
+
+// completeWords returns the candidates for the last of words, which
+// are the arguments typed so far. Flags and positional arguments whose
+// field has a `completion:"KIND"` tag are completed with values(KIND),
+// those with an enum with its values.
+func completeWords(app *kong.Application, words []string, values func(kind string) []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	node := app.Node
+	positional := 0
+	var pendingFlag *kong.Flag
+	onlyPositional := false
+	for _, word := range words[:len(words)-1] {
+		switch {
+		case pendingFlag != nil:
+			// bash splits "--topic=work" into "--topic", "=" and "work".
+			if word != "=" {
+				pendingFlag = nil
+			}
+		case onlyPositional:
+			positional++
+		case word == "--":
+			onlyPositional = true
+		case strings.HasPrefix(word, "-") && word != "-":
+			if flag := findCompletionFlag(node, word); flag != nil && !strings.Contains(word, "=") && !flag.IsBool() && !flag.IsCounter() {
+				pendingFlag = flag
+			}
+		default:
+			if child := findCompletionCommand(node, word); child != nil && positional == 0 {
+				node = child
+			} else {
+				positional++
+			}
+		}
+	}
+
+	prefix := words[len(words)-1]
+	if pendingFlag != nil {
+		return filterCompletions(getCompletionValues(pendingFlag.Value, values), prefix)
+	}
+	if !onlyPositional && strings.HasPrefix(prefix, "-") {
+		if i := strings.Index(prefix, "="); i != -1 {
+			flag := findCompletionFlag(node, prefix[:i])
+			if flag == nil {
+				return nil
+			}
+			candidates := filterCompletions(getCompletionValues(flag.Value, values), prefix[i+1:])
+			for j := range candidates {
+				candidates[j] = prefix[:i+1] + candidates[j]
+			}
+			return candidates
+		}
+		names := []string{}
+		for _, flag := range getCompletionFlags(node) {
+			names = append(names, "--"+flag.Name)
+		}
+		return filterCompletions(names, prefix)
+	}
+
+	candidates := []string{}
+	if positional == 0 {
+		for _, child := range node.Children {
+			if child.Type == kong.CommandNode && !child.Hidden {
+				candidates = append(candidates, child.Name)
+			}
+		}
+	}
+	if arg := getCompletionPositional(node, positional); arg != nil {
+		candidates = append(candidates, getCompletionValues(arg, values)...)
+	}
+	return filterCompletions(candidates, prefix)
+}
+
+// getCompletionDefaultCommand returns the command that runs if none of
+// node's commands is given, like "open" for tbml itself.
+func getCompletionDefaultCommand(node *kong.Node) *kong.Node {
+	for _, child := range node.Children {
+		if child.Type == kong.CommandNode && child.Tag.Default != "" {
+			return child
+		}
+	}
+	return nil
+}
+
+// getCompletionFlags returns the visible flags that can be given after
+// node's command, including those of its parents and its default
+// command.
+func getCompletionFlags(node *kong.Node) []*kong.Flag {
+	flags := []*kong.Flag{}
+	nodes := []*kong.Node{}
+	for n := node; n != nil; n = n.Parent {
+		nodes = append(nodes, n)
+	}
+	if defaultCommand := getCompletionDefaultCommand(node); defaultCommand != nil {
+		nodes = append(nodes, defaultCommand)
+	}
+	for _, n := range nodes {
+		for _, flag := range n.Flags {
+			if !flag.Hidden {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return flags
+}
+
+func getCompletionPositional(node *kong.Node, index int) *kong.Value {
+	if len(node.Children) > 0 {
+		if defaultCommand := getCompletionDefaultCommand(node); defaultCommand != nil {
+			node = defaultCommand
+		}
+	}
+	if index < len(node.Positional) {
+		return node.Positional[index]
+	}
+	// A slice takes all remaining arguments.
+	if len(node.Positional) > 0 && node.Positional[len(node.Positional)-1].IsCumulative() {
+		return node.Positional[len(node.Positional)-1]
+	}
+	return nil
+}
+
+func findCompletionCommand(node *kong.Node, word string) *kong.Node {
+	for _, child := range node.Children {
+		if child.Type != kong.CommandNode {
+			continue
+		}
+		if child.Name == word {
+			return child
+		}
+		for _, alias := range child.Aliases {
+			if alias == word {
+				return child
+			}
+		}
+	}
+	return nil
+}
+
+// findCompletionFlag finds the flag a word like "--topic", "-t" or
+// "--topic=work" refers to.
+func findCompletionFlag(node *kong.Node, word string) *kong.Flag {
+	if i := strings.Index(word, "="); i != -1 {
+		word = word[:i]
+	}
+	for _, flag := range getCompletionFlags(node) {
+		if word == "--"+flag.Name || (flag.Short != 0 && word == "-"+string(flag.Short)) {
+			return flag
+		}
+	}
+	return nil
+}
+
+func getCompletionValues(value *kong.Value, values func(kind string) []string) []string {
+	if kind := value.Tag.Get("completion"); kind != "" {
+		return values(kind)
+	}
+	if value.Enum != "" {
+		enum := []string{}
+		for _, option := range strings.Split(value.Enum, ",") {
+			enum = append(enum, strings.TrimSpace(option))
+		}
+		return enum
+	}
+	return nil
+}
+
+func filterCompletions(candidates []string, prefix string) []string {
+	filtered := []string{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
+
+// isCompleting tells whether the command line runs "tbml complete",
+// whose output must not be mixed with warnings or errors.
+func isCompleting(args []string) bool {
+	commandIndex := findCommandIndex(args)
+	return commandIndex != -1 && args[commandIndex] == "complete"
+}
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type ConfigCmd struct {
+	Migrate ConfigMigrateCmd `cmd:"" help:"Replace deprecated settings in the configuration files with the settings that replace them"`
+}
+
+type ConfigMigrateCmd struct{}
+
+func (cmd *ConfigMigrateCmd) Run(common CommandContext) error {
+	migrated, err := internal.MigrateConfiguration(common.Config, common.ConfigFile, common.Mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if common.Mutations.DryRun {
+		return nil
+	}
+	for _, file := range migrated {
+		fmt.Println(common.Messages.Sprintf("Replaced deprecated settings in %s", file))
+	}
+	if len(migrated) == 0 {
+		fmt.Println(common.Messages.Sprintf("No deprecated settings to replace"))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"errors"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type CookiesCmd struct {
+	Export CookiesExportCmd `cmd:"" help:"Write the cookies of an instance to a Netscape cookie file for curl, wget or yt-dlp"`
+}
+
+type CookiesExportCmd struct {
+	Domain   string `help:"Only export the cookies of this domain and its subdomains"`
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to export the cookies of"`
+	Output   string `help:"The file to write the cookies to (default: standard output)" short:"o" type:"path"`
+	Yes      bool   `help:"Don't ask before exporting" short:"y"`
+}
+
+func (cmd *CookiesExportCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	// Checked before asking, so the user isn't asked for nothing.
+	if internal.ProfileIsSensitive(common.Config, instance.ProfileLabel) {
+		return common.Messages.Errorf("The cookies of sensitive profile %s can't be exported", instance.ProfileLabel)
+	}
+
+	// Anyone with the cookies can use the logged-in sessions of the
+	// instance, so this is never done by accident.
+	if !cmd.Yes {
+		ok, err := askYesOrNo(common, common.Messages.Sprintf("Anyone with the cookies can use the sessions of %s. Export? [y/N] ", instance.InstanceLabel))
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if !ok {
+			return common.Messages.Errorf("Not exporting the cookies of instance %s", instance.InstanceLabel)
+		}
+	}
+
+	if cmd.Output == "" {
+		err = internal.ExportCookies(common.Config, instance, cmd.Domain, os.Stdout)
+	} else {
+		err = cmd.exportToFile(common, instance)
+	}
+	if errors.Is(err, internal.ErrSensitiveProfile) {
+		return common.Messages.Errorf("The cookies of sensitive profile %s can't be exported", instance.ProfileLabel)
+	}
+	return translateDatabaseError(common, instance, err)
+}
+
+// exportToFile writes the cookies to the output file, which only the
+// user may read. If the export fails, the file is removed.
+func (cmd *CookiesExportCmd) exportToFile(common CommandContext, instance internal.ProfileInstance) error {
+	file, err := os.OpenFile(cmd.Output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// The mode only applies to new files, an existing one keeps its
+	// own, e.g. readable by everyone.
+	err = file.Chmod(0o600)
+	if err == nil {
+		err = internal.ExportCookies(common.Config, instance, cmd.Domain, file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(cmd.Output)
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type DebugCmd struct {
+	Bundle DebugBundleCmd `cmd:"" help:"Write the configuration with secrets redacted, instance metadata, recent logs and build information to a tar.gz archive for bug reports"`
+
+	Soak SoakCmd `cmd:"" help:"Launch and delete many instances concurrently to check the profile path's filesystem for races"`
+}
+
+type DebugBundleCmd struct {
+	Output  string `help:"The file to write the bundle to (default: tbml-debug-<date>.tar.gz)" short:"o" type:"path"`
+	Preview bool   `help:"Print the redacted configuration and the bundle's files without writing it"`
+	Yes     bool   `help:"Don't ask before writing the bundle" short:"y"`
+}
+
+func (cmd *DebugBundleCmd) Run(common CommandContext) error {
+	bundle, err := internal.CollectDebugBundle(common.Config, common.Redactor, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	// The bundle is meant to be shared, so what was redacted and what
+	// it contains is shown before it is written.
+	for _, field := range bundle.Redacted {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("Redacted: %s", field))
+	}
+	for _, file := range bundle.Files {
+		fmt.Fprintf(os.Stderr, "%-40s%10d B\n", file.Name, len(file.Content))
+	}
+	if cmd.Preview {
+		for _, file := range bundle.Files {
+			if file.Name == "config.json" {
+				fmt.Print(string(file.Content))
+			}
+		}
+		return nil
+	}
+
+	output := cmd.Output
+	if output == "" {
+		output = "tbml-debug-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+	if !cmd.Yes {
+		ok, err := askYesOrNo(common, common.Messages.Sprintf("Check the files above for anything private. Write the bundle to %s? [y/N] ", output))
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if !ok {
+			return common.Messages.Errorf("Not writing the debug bundle")
+		}
+	}
+
+	file, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer file.Close()
+	if err := internal.WriteDebugBundle(bundle, file); err != nil {
+		os.Remove(output)
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(output)
+	return nil
+}
+
+type SoakCmd struct {
+	Concurrency int           `default:"16" help:"How many instances to launch at the same time"`
+	Launches    int           `default:"300" help:"How many launches to run in total"`
+	Lifetime    time.Duration `default:"50ms" help:"How long each fake browser keeps running"`
+}
+
+func (cmd *SoakCmd) Run(common CommandContext) error {
+	result, err := internal.RunSoak(common.Context, common.Config, internal.SoakOptions{
+		Concurrency: cmd.Concurrency,
+		Launches:    cmd.Launches,
+		Lifetime:    cmd.Lifetime,
+	})
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	fmt.Printf("%d launched, %d deleted, %d refused as in use in %s\n", result.Launched, result.Deleted, result.Contended, result.Duration.Round(time.Millisecond))
+	for _, failure := range result.Failures {
+		fmt.Println("FAIL", failure)
+	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("%d failures", len(result.Failures))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"t0ast.cc/tbml/desktop"
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type DesktopCmd struct {
+	Install DesktopInstallCmd `cmd:"" help:"Create desktop entries for the profiles and register tbml as a handler for web links"`
+}
+
+type DesktopInstallCmd struct {
+	SetDefault bool `help:"Make tbml the default handler for http and https links"`
+	Topics     bool `help:"Also create an entry for each known topic"`
+	Uninstall  bool `help:"Remove the desktop entries created by tbml instead"`
+}
+
+func (cmd *DesktopInstallCmd) Run(common CommandContext) error {
+	// Containers may have no home or a read-only one, and no desktop
+	// to integrate with anyway.
+	dataHome, err := desktop.GetDataHome()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("Skipping desktop integration: %s", uerror.Message(err)))
+		return nil
+	}
+	writable, err := uio.IsWritable(dataHome)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !writable {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("Skipping desktop integration, %s is not writable", dataHome))
+		return nil
+	}
+
+	if cmd.Uninstall {
+		return uerror.WithStackTrace(desktop.Uninstall(dataHome, common.Mutations))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	configFile, err := filepath.Abs(common.ConfigFile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	topics := []string{}
+	if cmd.Topics {
+		history, err := internal.GetTopicHistory(common.Config)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		for _, entry := range history {
+			topics = append(topics, entry.Topic)
+		}
+	}
+
+	entries := desktop.GenerateEntries(common.Config, common.ConfigDir, configFile, topics)
+	if err := desktop.Install(dataHome, entries, executable, common.Mutations); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if cmd.SetDefault {
+		if err := desktop.SetDefaultHandler(common.Context, common.Mutations); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if !common.Mutations.DryRun {
+		fmt.Println(common.Messages.Sprintf("Installed %d desktop entries to %s", len(entries), filepath.Join(dataHome, "applications")))
+	}
+	return nil
+}
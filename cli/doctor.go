@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type DoctorCmd struct{}
+
+func (cmd *DoctorCmd) Run(common CommandContext) error {
+	probe, err := internal.ProbeProfilePath(common.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(common.Messages.Sprintf("File system: %s, reflinks: %t, overlayfs: %t, free: %s", probe.FileSystem, probe.Reflinks, probe.Overlay, uio.FormatByteSize(probe.FreeBytes)))
+
+	network, err := internal.DetectNetworkEnvironment()
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	none := common.Messages.Sprintf("none")
+	ssid, vpn, suffixes := network.SSID, strings.Join(network.VPNInterfaces, ", "), strings.Join(network.DNSSuffixes, ", ")
+	for _, value := range []*string{&ssid, &vpn, &suffixes} {
+		if *value == "" {
+			*value = none
+		}
+	}
+	fmt.Println(common.Messages.Sprintf("Wi-Fi network: %s, VPN: %s, DNS suffixes: %s", ssid, vpn, suffixes))
+
+	problems, err := internal.LintPerformance(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if len(problems) == 0 {
+		fmt.Println(common.Messages.Sprintf("No problems found"))
+		return nil
+	}
+	for _, problem := range problems {
+		fmt.Println(problem.Message)
+		fmt.Println("  " + common.Messages.Sprintf("Hint: %s", problem.Hint))
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type EmptyTrashCmd struct{}
+
+func (cmd *EmptyTrashCmd) Run(common CommandContext) error {
+	// The summary below already says what would be deleted, so the
+	// mutations aren't reported separately.
+	mutations := &internal.Mutations{DryRun: common.Mutations.DryRun, ReadOnly: common.Mutations.ReadOnly}
+	deleted, size, err := internal.EmptyTrash(common.Config, mutations)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	verb := common.Messages.Sprintf("Deleted")
+	if mutations.DryRun {
+		verb = common.Messages.Sprintf("Would delete")
+	}
+	fmt.Print(common.Messages.Sprintf("%s %d instances, %s in total\n", verb, len(deleted), uio.FormatByteSize(size)))
+	return nil
+}
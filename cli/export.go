@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"io"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type ExportCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to export"`
+	Output   string `help:"The file to write the archive to (default: standard output)" short:"o" type:"path"`
+}
+
+func (cmd *ExportCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	var output io.Writer = os.Stdout
+	if cmd.Output != "" {
+		file, err := os.Create(cmd.Output)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	if err := internal.ExportInstance(common.Config, instance, output); err != nil {
+		if cmd.Output != "" {
+			os.Remove(cmd.Output)
+		}
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
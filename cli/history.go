@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+	"net/url"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type HistoryCmd struct{}
+
+func (cmd *HistoryCmd) Run(common CommandContext) error {
+	history, err := internal.GetLaunchHistory(common.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		entry := history[i]
+		profile := entry.Profile
+		if entry.Ephemeral {
+			profile = common.Messages.Sprintf("%s (ephemeral)", profile)
+		}
+		urlStr := ""
+		if entry.URL != nil {
+			urlStr = *entry.URL
+		}
+		if entry.MovedFrom != nil {
+			urlStr = common.Messages.Sprintf("%s (moved from %s)", urlStr, *entry.MovedFrom)
+		}
+		fmt.Printf("%3d  %s  %-15s  %-15s  %s\n", len(history)-i, entry.Time.Local().Format("2006-01-02 15:04:05"), profile, entry.Topic, urlStr)
+	}
+	return nil
+}
+
+type RerunCmd struct {
+	N int `arg:"" help:"The number of the launch in tbml history, 1 being the most recent"`
+}
+
+func (cmd *RerunCmd) Run(common CommandContext) error {
+	history, err := internal.GetLaunchHistory(common.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if cmd.N < 1 || cmd.N > len(history) {
+		return common.Messages.Errorf("There is no launch %d in the history", cmd.N)
+	}
+	entry := history[len(history)-cmd.N]
+
+	open := OpenCmd{
+		Ephemeral: entry.Ephemeral,
+		Profile:   entry.Profile,
+		Topic:     entry.Topic,
+	}
+	if entry.URL != nil {
+		if open.URL, err = url.Parse(*entry.URL); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return open.Run(common)
+}
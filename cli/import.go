@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type ImportCmd struct {
+	Archive     string `arg:"" help:"The archive created by \"tbml export\" to import, or - for standard input"`
+	OnCollision string `default:"fail" enum:"fail,suffix,replace" help:"What to do if another instance has the same label: fail, add a suffix to the label or replace the other instance if it isn't in use"`
+}
+
+func (cmd *ImportCmd) Run(common CommandContext) error {
+	var input io.Reader = os.Stdin
+	if cmd.Archive != "-" {
+		file, err := os.Open(cmd.Archive)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	instance, err := internal.ImportInstance(common.Config, input, internal.CollisionPolicy(cmd.OnCollision), common.Mutations)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(common.Messages.Sprintf("Imported instance %s of profile %s", instance.InstanceLabel, instance.ProfileLabel))
+	return nil
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type InitCmd struct {
+	Profile     string `default:"default" help:"The label of the starter profile" long:"profile" short:"p"`
+	ProfilePath string `help:"Where to keep the instances (default: ~/.cache/tbml)" placeholder:"DIR"`
+}
+
+func (cmd *InitCmd) Run(ctx CommandContext) error {
+	configFile := CLI.ConfigPath
+	if configFile == "" {
+		configFile = os.Getenv(internal.ConfigEnvVar)
+	}
+	if configFile == "" {
+		// A configuration in any of the searched places is found
+		// even if it is broken.
+		if ctx.ConfigFile != "" {
+			return ctx.Messages.Errorf("There already is a configuration at %s", ctx.ConfigFile)
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		configFile = filepath.Join(home, ".config/tbml", configFileNames[0])
+	}
+
+	config, err := internal.InitConfiguration(configFile, cmd.ProfilePath, cmd.Profile, ctx.Mutations, ctx.Warnings)
+	if errors.Is(err, internal.ErrConfigurationExists) {
+		return ctx.Messages.Errorf("There already is a configuration at %s", configFile)
+	}
+	if errors.Is(err, internal.ErrNoBrowserFound) {
+		return ctx.Messages.Errorf("Neither torbrowser-launcher nor firefox is installed")
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if ctx.Mutations.DryRun {
+		return nil
+	}
+	fmt.Println(ctx.Messages.Sprintf("Created %s with the profile %s", configFile, cmd.Profile))
+	fmt.Println(ctx.Messages.Sprintf("Instances are kept in %s", config.ProfilePath))
+	return nil
+}
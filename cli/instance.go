@@ -0,0 +1,226 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type InstanceCmd struct {
+	Archive       InstanceArchiveCmd       `cmd:"" help:"Compress the files of an instance that isn't in use to free up disk space until it is launched again"`
+	CheckArchives InstanceCheckArchivesCmd `cmd:"" help:"Check that the archives of all archived instances can be restored"`
+	Diff          InstanceDiffCmd          `cmd:"" help:"Compare two instances of the same profile"`
+	Pin           InstancePinCmd           `cmd:"" help:"Keep an instance from being deleted by tbml clean or evicted at its profile's MaxInstances"`
+	Rename        InstanceRenameCmd        `cmd:"" help:"Give an instance that isn't in use a new label"`
+	Reserve       InstanceReserveCmd       `cmd:"" help:"Reserve the label of the next instance of a profile and print it, to provision the instance later"`
+	SetTopic      InstanceSetTopicCmd      `cmd:"" help:"Move an instance that isn't in use to another topic"`
+	Stop          InstanceStopCmd          `cmd:"" help:"Close the browser of a running instance, saving its session, and wait until it exited"`
+	Unarchive     InstanceUnarchiveCmd     `cmd:"" help:"Restore the files of an archived instance without launching it"`
+	Unpin         InstanceUnpinCmd         `cmd:"" help:"Let tbml clean and MaxInstances delete a pinned instance again"`
+}
+
+type InstanceArchiveCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to archive"`
+}
+
+func (cmd *InstanceArchiveCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.ArchiveInstance(common.Config, instance, common.Mutations)
+}
+
+type InstanceCheckArchivesCmd struct{}
+
+func (cmd *InstanceCheckArchivesCmd) Run(common CommandContext) error {
+	problems, err := internal.CheckArchivedInstances(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if len(problems) == 0 {
+		fmt.Println(common.Messages.Sprintf("All archives are intact"))
+		return nil
+	}
+	damaged := make(map[string]bool)
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", problem.InstanceLabel, problem.Message)
+		damaged[problem.InstanceLabel] = true
+	}
+	return common.Messages.Errorf("%d archives are damaged", len(damaged))
+}
+
+type InstanceUnarchiveCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to unarchive"`
+}
+
+func (cmd *InstanceUnarchiveCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.UnarchiveInstance(common.Config, instance, common.Mutations)
+}
+
+type InstanceDiffCmd struct {
+	A string `arg:"" completion:"instances" help:"The label of the first instance"`
+	B string `arg:"" completion:"instances" help:"The label of the second instance"`
+}
+
+func (cmd *InstanceDiffCmd) Run(common CommandContext) error {
+	a, err := internal.GetProfileInstance(common.Config, cmd.A)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	b, err := internal.GetProfileInstance(common.Config, cmd.B)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	diff, err := internal.DiffInstances(common.Config, a, b)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", a.InstanceLabel, b.InstanceLabel)
+
+	fmt.Fprintf(&sb, "\n%s:\n", common.Messages.Sprintf("Extensions"))
+	if len(diff.ExtensionsOnlyInA) == 0 && len(diff.ExtensionsOnlyInB) == 0 && len(diff.ExtensionVersions) == 0 {
+		fmt.Fprintf(&sb, "  %s\n", common.Messages.Sprintf("<no differences>"))
+	}
+	for _, extensionID := range diff.ExtensionsOnlyInA {
+		fmt.Fprintf(&sb, "- %s\n", extensionID)
+	}
+	for _, extensionID := range diff.ExtensionsOnlyInB {
+		fmt.Fprintf(&sb, "+ %s\n", extensionID)
+	}
+	for _, extension := range diff.ExtensionVersions {
+		fmt.Fprintf(&sb, "- %s %s\n+ %s %s\n", extension.ID, extension.A, extension.ID, extension.B)
+	}
+
+	sb.WriteString("\nPrefs:\n")
+	if len(diff.Prefs) == 0 {
+		fmt.Fprintf(&sb, "  %s\n", common.Messages.Sprintf("<no differences>"))
+	}
+	for _, pref := range diff.Prefs {
+		if pref.A != nil {
+			fmt.Fprintf(&sb, "- %s = %s\n", pref.Name, *pref.A)
+		}
+		if pref.B != nil {
+			fmt.Fprintf(&sb, "+ %s = %s\n", pref.Name, *pref.B)
+		}
+	}
+
+	fmt.Fprintf(&sb, "\n%s:\n", common.Messages.Sprintf("Sizes"))
+	fmt.Fprintf(&sb, "  %-12s%12s%12s\n", "", a.InstanceLabel, b.InstanceLabel)
+	for _, store := range diff.StoreSizes {
+		fmt.Fprintf(&sb, "  %-12s%12s%12s\n", store.Name, uio.FormatByteSize(store.A), uio.FormatByteSize(store.B))
+	}
+
+	fmt.Print(sb.String())
+	return nil
+}
+
+type InstanceRenameCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to rename"`
+	NewLabel string `arg:"" help:"The new label of the instance"`
+}
+
+func (cmd *InstanceRenameCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.RenameInstance(common.Config, instance, cmd.NewLabel, common.Mutations)
+}
+
+type InstanceReserveCmd struct {
+	Profile string `arg:"" completion:"profiles" help:"The profile to reserve an instance label of"`
+}
+
+func (cmd *InstanceReserveCmd) Run(common CommandContext) error {
+	profile := internal.FindProfileByLabel(common.Config, cmd.Profile)
+	if profile == nil {
+		return common.Messages.Errorf("Profile %s does not exist", cmd.Profile)
+	}
+	var label string
+	if err := common.Mutations.Apply("Reserve an instance label of profile", profile.Label, func() error {
+		var err error
+		label, err = internal.ReserveInstanceLabel(common.Config, *profile)
+		return err
+	}); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// Only the label goes to stdout, so scripts can use it directly.
+	if !common.Mutations.DryRun {
+		fmt.Println(label)
+	}
+	return nil
+}
+
+type InstanceSetTopicCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to move"`
+	Topic    string `arg:"" completion:"topics" help:"The new topic of the instance (default: remove its topic)" optional:""`
+}
+
+func (cmd *InstanceSetTopicCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	var topic *string
+	if cmd.Topic != "" {
+		topic = &cmd.Topic
+	}
+	return internal.SetInstanceTopic(common.Config, instance, topic, common.Mutations)
+}
+
+type InstancePinCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to pin"`
+}
+
+func (cmd *InstancePinCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.PinInstance(common.Config, instance, true, common.Mutations)
+}
+
+type InstanceUnpinCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to unpin"`
+}
+
+func (cmd *InstanceUnpinCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return internal.PinInstance(common.Config, instance, false, common.Mutations)
+}
+
+type InstanceStopCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to stop"`
+}
+
+func (cmd *InstanceStopCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// Closing a browser doesn't change any instance, so it is allowed
+	// with ReadOnlyManagement.
+	mutations := &internal.Mutations{DryRun: common.Mutations.DryRun, OnMutation: common.Mutations.OnMutation}
+	err = mutations.Apply("Stop instance", instance.InstanceLabel, func() error {
+		return internal.StopInstance(common.Context, common.Config, instance)
+	})
+	if errors.Is(err, internal.ErrInstanceNotRunning) {
+		return common.Messages.Errorf("Instance %s isn't running", instance.InstanceLabel)
+	}
+	return err
+}
@@ -1,7 +1,9 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -12,10 +14,39 @@ import (
 	uerror "t0ast.cc/tbml/util/error"
 )
 
-type LsCmd struct{}
+type LsCmd struct {
+	JSON  bool   `help:"Print a machine-readable listing" name:"json"`
+	Where string `help:"Only list the instances that match a filter expression (e.g. 'age > 30d && !pinned')"`
+}
 
 func (cmd *LsCmd) Run(common CommandContext) error {
-	instances, err := internal.GetProfileInstances(common.Config)
+	var where *internal.Filter
+	if cmd.Where != "" {
+		parsed, err := internal.ParseFilter(cmd.Where)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		where = parsed
+	}
+
+	if cmd.JSON {
+		listings, err := internal.ListProfiles(common.Config, where, common.Warnings)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(listings); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return nil
+	}
+
+	instances, err := internal.GetProfileInstances(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instances, err = internal.FilterInstances(common.Config, instances, where)
 	if err != nil {
 		return uerror.WithStackTrace(err)
 	}
@@ -39,26 +70,28 @@ func (cmd *LsCmd) Run(common CommandContext) error {
 		sb.WriteString(profile.Label)
 
 		sb.WriteString(" (user.js? ")
-		if profile.UserJSFile == nil {
-			sb.WriteString("NO")
+		if profile.UserJSFile == nil && len(profile.UserJSFiles) == 0 {
+			sb.WriteString(common.Messages.Sprintf("NO"))
 		} else {
-			sb.WriteString("YES")
+			sb.WriteString(common.Messages.Sprintf("YES"))
 		}
 		sb.WriteString("; userChrome.css? ")
 		if profile.UserChromeFile == nil {
-			sb.WriteString("NO")
+			sb.WriteString(common.Messages.Sprintf("NO"))
 		} else {
-			sb.WriteString("YES")
+			sb.WriteString(common.Messages.Sprintf("YES"))
 		}
 
-		if len(profile.ExtensionFiles) > 0 {
+		extensionNames := []string{}
+		for _, extensionFile := range profile.ExtensionFiles {
+			extensionNames = append(extensionNames, filepath.Base(extensionFile))
+		}
+		for _, extension := range profile.Extensions {
+			extensionNames = append(extensionNames, extension.ID)
+		}
+		if len(extensionNames) > 0 {
 			sb.WriteString("; ")
-			for i, extensionFile := range profile.ExtensionFiles {
-				sb.WriteString(filepath.Base(extensionFile))
-				if i < len(profile.ExtensionFiles)-1 {
-					sb.WriteString(", ")
-				}
-			}
+			sb.WriteString(strings.Join(extensionNames, ", "))
 		}
 
 		sb.WriteString(")")
@@ -75,11 +108,11 @@ func (cmd *LsCmd) Run(common CommandContext) error {
 		instances, ok := instancesPerProfile[profile.Label]
 		if ok {
 			sb.WriteString("\n  │   ")
-			writeColumn("Instance", 15)
-			writeColumn("Cur. Topic", 15)
-			writeColumn("Cur. PID", 15)
-			writeColumn("Created", 20)
-			writeColumn("Last used", 20)
+			writeColumn(common.Messages.Sprintf("Instance"), 15)
+			writeColumn(common.Messages.Sprintf("Cur. Topic"), 15)
+			writeColumn(common.Messages.Sprintf("Cur. PID"), 15)
+			writeColumn(common.Messages.Sprintf("Created"), 20)
+			writeColumn(common.Messages.Sprintf("Last used"), 20)
 
 			for i, instance := range instances {
 				sb.WriteString("\n  ")
@@ -89,7 +122,13 @@ func (cmd *LsCmd) Run(common CommandContext) error {
 					sb.WriteString("└")
 				}
 				sb.WriteString("── ")
-				writeColumn(instance.InstanceLabel, 15)
+				if instance.Archived {
+					writeColumn(common.Messages.Sprintf("%s (archived)", instance.InstanceLabel), 15)
+				} else if instance.Pinned {
+					writeColumn(common.Messages.Sprintf("%s (pinned)", instance.InstanceLabel), 15)
+				} else {
+					writeColumn(instance.InstanceLabel, 15)
+				}
 				if instance.UsageLabel == nil {
 					writeColumn("<none>", 15)
 				} else {
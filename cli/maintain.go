@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type MaintainCmd struct{}
+
+func (cmd *MaintainCmd) Run(common CommandContext) error {
+	result, err := internal.RunMaintenance(common.Config, true, common.Mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if common.Mutations.DryRun {
+		return nil
+	}
+	for _, pruned := range result.Pruned {
+		fmt.Println(common.Messages.Sprintf("Deleted instance %s: %s", pruned.Instance.InstanceLabel, pruned.Reason))
+	}
+	for _, instance := range result.Archived {
+		fmt.Println(common.Messages.Sprintf("Archived instance %s", instance.InstanceLabel))
+	}
+	return nil
+}
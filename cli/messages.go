@@ -0,0 +1,165 @@
+package cli
+
+import "t0ast.cc/tbml/util/i18n"
+
+// messages holds the translations of user-facing CLI messages, keyed by
+// the English format string.
+var messages = i18n.Catalog{
+	"de": {
+		"%d instances, %s in total\n":                                      "%d Instanzen, insgesamt %s\n",
+		"%s %d instances, %s in total\n":                                   "%s: %d Instanzen, insgesamt %s\n",
+		"%s (moved from %s)":                                               "%s (verschoben aus %s)",
+		"%d of %d instances failed, provision them again with --instance":  "%d von %d Instanzen sind fehlgeschlagen, bereite sie mit --instance erneut vor",
+		"[%d/%d] Failed to provision instance %s: %s":                      "[%d/%d] Instanz %s konnte nicht vorbereitet werden: %s",
+		"[%d/%d] Provisioned instance %s":                                  "[%d/%d] Instanz %s vorbereitet",
+		"%s: %s %d files, %s\n":                                            "%s: %s: %d Dateien, %s\n",
+		"--for must not be negative":                                       "--for darf nicht negativ sein",
+		"--no-launch can't be combined with --ephemeral, --debug or a URL": "--no-launch kann nicht mit --ephemeral, --debug oder einer URL kombiniert werden",
+		"%s (new topic in profile)":                                        "%s (neues Thema im Profil)",
+		"%s (ephemeral)":                                                   "%s (temporär)",
+		"%s (archived)":                                                    "%s (archiviert)",
+		"%s (pinned)":                                                      "%s (angeheftet)",
+		"%s (closed)":                                                      "%s (geschlossen)",
+		"%s in total\n":                                                    "insgesamt %s\n",
+		"%s (modified)":                                                    "%s (verändert)",
+		"%s (running in %s)":                                               "%s (läuft in %s)",
+		"All %d instances of profile %s are in use":                        "Alle %d Instanzen von Profil %s sind in Benutzung",
+		"Build tags: %s":                                                   "Build-Tags: %s",
+		"Backend":                                                          "Speicherart",
+		"Built with: %s":                                                   "Gebaut mit: %s",
+		"Clone strategies: %s":                                             "Klon-Strategien: %s",
+		"Commit: %s":                                                       "Commit: %s",
+		"Created %s with the profile %s":                                   "%s mit dem Profil %s erstellt",
+		"Cur. PID":                                                         "Akt. PID",
+		"Cur. Topic":                                                       "Akt. Thema",
+		"Created":                                                          "Erstellt",
+		"Deleted":                                                          "Gelöscht",
+		"Deleted dead ephemeral instance %s":                               "Tote temporäre Instanz %s gelöscht",
+		"Disk":                                                             "Festplatte",
+		"Dry run: %s":                                                      "Probelauf: %s",
+		"Archive chunks":                                                   "Archivblöcke",
+		"Extension cache":                                                  "Erweiterungscache",
+		"Extension cache: %d files, %s (%d pinned, %s)":                    "Erweiterungscache: %d Dateien, %s (%d angeheftet, %s)",
+		", limit %s":                                                       ", Grenze %s",
+		"Extensions":                                                       "Erweiterungen",
+		"Failed to run maintenance: %s":                                    "Wartung fehlgeschlagen: %s",
+		"Archived instance %s":                                             "Instanz %s archiviert",
+		"Deleted instance %s: %s":                                          "Instanz %s gelöscht: %s",
+		"Moved instance %s":                                                "Instanz %s verschoben",
+		"No deprecated settings to replace":                                "Keine veralteten Einstellungen zu ersetzen",
+		"Replaced deprecated settings in %s":                               "Veraltete Einstellungen in %s ersetzt",
+		"All archives are intact":                                          "Alle Archive sind intakt",
+		"%d archives are damaged":                                          "%d Archive sind beschädigt",
+		"Instance %s is archived, restoring it takes about %s":               "Instanz %s ist archiviert, die Wiederherstellung dauert etwa %s",
+		"Failed to reap dead instances: %s":                                  "Tote Instanzen konnten nicht aufgeräumt werden: %s",
+		"Failed to record the launch: %s":                                    "Der Start konnte nicht gespeichert werden: %s",
+		"Failed to record topic usage: %s":                                   "Themennutzung konnte nicht gespeichert werden: %s",
+		"Failed to refresh route lists: %s":                                  "Routenlisten konnten nicht aktualisiert werden: %s",
+		"File cache":                                                         "Dateicache",
+		"First paint":                                                        "Erste Darstellung",
+		"Hint: %s":                                                           "Hinweis: %s",
+		"File system: %s, reflinks: %t, overlayfs: %t, free: %s":             "Dateisystem: %s, Reflinks: %t, overlayfs: %t, frei: %s",
+		"Imported instance %s of profile %s":                                 "Instanz %s des Profils %s importiert",
+		"The document matches the %s schema":                                 "Das Dokument entspricht dem Schema %s",
+		"Anyone with the cookies can use the sessions of %s. Export? [y/N] ": "Jeder mit den Cookies kann die Sitzungen von %s benutzen. Exportieren? [j/N] ",
+		"Imported profile %s. Add this to the profiles in your configuration file:": "Profil %s importiert. Füge dies zu den Profilen in deiner Konfigurationsdatei hinzu:",
+		"Installed %d desktop entries to %s":                                        "%d Desktop-Einträge in %s installiert",
+		"Installed profile %s":                                                      "Profil %s installiert",
+		"Instance":                                                                  "Instanz",
+		"Instance %s belongs to another profile":                                    "Instanz %s gehört zu einem anderen Profil",
+		"Seat %s has an instance of another profile":                                "Platz %s hat eine Instanz eines anderen Profils",
+		"Seat %s has no instance":                                                   "Platz %s hat keine Instanz",
+		"Seat %s has no instance yet, use --profile to give it one":                 "Platz %s hat noch keine Instanz, mit --profile bekommt er eine",
+		"Instance %s is in use":                                                     "Instanz %s ist in Benutzung",
+		"Instance %s isn't running":                                                 "Instanz %s läuft nicht",
+		"tbml ui needs a terminal":                                                  "tbml ui braucht ein Terminal",
+		"Instance %s has no bookmarks yet, launch it once first":                    "Instanz %s hat noch keine Lesezeichen, starte sie zuerst einmal",
+		"Instance %s is not running, restarting it":                                 "Instanz %s läuft nicht, sie wird neu gestartet",
+		"Instance metadata schema: %d":                                              "Schema der Instanz-Metadaten: %d",
+		"Instances are kept in %s":                                                  "Instanzen werden in %s gespeichert",
+		"Invalid date %s, expected YYYY-MM-DD":                                      "Ungültiges Datum %s, erwartet wird JJJJ-MM-TT",
+		"Last used":                                                                 "Zuletzt benutzt",
+		"Launches":                                                                  "Starts",
+		"Memory":                                                                    "Speicher",
+		"none":                                                                      "keine",
+		"Neither torbrowser-launcher nor firefox is installed":                      "Weder torbrowser-launcher noch firefox ist installiert",
+		"Wi-Fi network: %s, VPN: %s, DNS suffixes: %s":                              "WLAN: %s, VPN: %s, DNS-Suffixe: %s",
+		"No problems found":                                                         "Keine Probleme gefunden",
+		"No profile given and no display to ask for one, use --profile":             "Kein Profil angegeben und keine Anzeige, um danach zu fragen, verwende --profile",
+		"Not allowed, the configuration sets ReadOnlyManagement":                    "Nicht erlaubt, die Konfiguration setzt ReadOnlyManagement",
+		"No topic given and no display to ask for one, use --topic":                 "Kein Thema angegeben und keine Anzeige, um danach zu fragen, verwende --topic",
+		"Not exporting the cookies of instance %s":                                  "Die Cookies von Instanz %s werden nicht exportiert",
+		"Not installing profile %s":                                                 "Profil %s wird nicht installiert",
+		"Nothing to undo":                                                           "Nichts rückgängig zu machen",
+		"No config file found":                                                      "Keine Konfigurationsdatei gefunden",
+		"No profile selected":                                                       "Kein Profil ausgewählt",
+		"No topic selected":                                                         "Kein Thema ausgewählt",
+		"NO":                                                                        "NEIN",
+		"Prepare":                                                                   "Vorbereitung",
+		"Process %d is not running":                                                 "Prozess %d läuft nicht",
+		"Profile %s has quiet hours until %s, use --ignore-quiet-hours to launch it anyway": "Profil %s hat bis %s Ruhezeit, mit --ignore-quiet-hours wird es trotzdem gestartet",
+		"Reading the browser's databases needs sqlite3, please install it":                  "Zum Lesen der Datenbanken des Browsers wird sqlite3 benötigt, bitte installiere es",
+		"The cookies of sensitive profile %s can't be exported":                             "Die Cookies des sensiblen Profils %s können nicht exportiert werden",
+		"Profile":                   "Profil",
+		"Profile %s does not exist": "Profil %s existiert nicht",
+		"Profile %s of instance %s does not exist":                            "Profil %s der Instanz %s existiert nicht",
+		"Profile %s was launched moments ago":                                 "Profil %s wurde gerade erst gestartet",
+		"Profile %s was launched moments ago, opening the tab in instance %s": "Profil %s wurde gerade erst gestartet, der Tab wird in Instanz %s geöffnet",
+		"Profile bundle format: %d":                                           "Format der Profilbündel: %d",
+		"Provisioned instance %s":                                             "Instanz %s vorbereitet",
+		"Released dead instance %s":                                           "Tote Instanz %s freigegeben",
+		"Restored instance as %s":                                             "Instanz als %s wiederhergestellt",
+		"Sandboxes: %s":                                                       "Sandboxes: %s",
+		"Session restored":                                                    "Sitzung wiederhergestellt",
+		"Sizes":                                                               "Größen",
+		"Skipping desktop integration, %s is not writable":                    "Desktop-Integration übersprungen, %s ist nicht beschreibbar",
+		"Skipping desktop integration: %s":                                    "Desktop-Integration übersprungen: %s",
+		"Skipping instance in use":                                            "Überspringe Instanz in Benutzung",
+		"Synced %s":                                                           "%s abgeglichen",
+		"Temporary files":                                                     "Temporäre Dateien",
+		"Expired undo backups":                                                "Abgelaufene Sicherungen für tbml undo",
+		"Invalid time %q, use e.g. 20:30 or \"2024-05-17 20:30\"":             "Ungültige Zeit %q, verwende z. B. 20:30 oder \"2024-05-17 20:30\"",
+		"No route applies, the URL is opened in the topic that is given or picked": "Keine Route greift, die URL wird im angegebenen oder gewählten Thema geöffnet",
+		"Route %d (priority %d, %s): %s":                                           "Route %d (Priorität %d, %s): %s",
+		"The URL is denied":                                                        "Die URL ist gesperrt",
+		"The URL is denied: %s":                                                    "Die URL ist gesperrt: %s",
+		"The URL is opened in profile %s":                                          "Die URL wird in Profil %s geöffnet",
+		"The URL is opened in topic %s of profile %s":                              "Die URL wird in Thema %s von Profil %s geöffnet",
+		"Profile: %s":      "Profil: %s",
+		"Rewritten to: %s": "Umgeschrieben zu: %s",
+		"Route %d matches": "Route %d passt",
+		"Topic: %s":        "Thema: %s",
+		"Topic: the profile's default topic, otherwise picked": "Thema: das Standardthema des Profils, sonst ausgewählt",
+		"applies":     "greift",
+		"deny":        "sperren",
+		"profile %s":  "Profil %s",
+		"skipped, %s": "übersprungen, %s",
+		"The profile runs this command instead of the default browser: %s": "Das Profil führt statt des Standardbrowsers diesen Befehl aus: %s",
+		"The profile passes these arguments to the browser: %s":            "Das Profil übergibt dem Browser diese Argumente: %s",
+		"The profile runs the browser in a %s sandbox":                     "Das Profil führt den Browser in einer %s-Sandbox aus",
+		"The profile runs the browser in a %s sandbox from the image %s":   "Das Profil führt den Browser in einer %s-Sandbox aus dem Image %s aus",
+		"If %s isn't installed, the browser runs without a sandbox":        "Ist %s nicht installiert, läuft der Browser ohne Sandbox",
+		"The profile sets these environment variables:":                    "Das Profil setzt diese Umgebungsvariablen:",
+		"The profile runs these hooks on this computer:":                   "Das Profil führt diese Hooks auf diesem Computer aus:",
+		"The profile lets extensions start these native messaging hosts:":  "Das Profil lässt Erweiterungen diese Native-Messaging-Hosts starten:",
+		"There already is a configuration at %s":                           "Es gibt bereits eine Konfiguration unter %s",
+		"There is no launch %d in the history":                             "Es gibt keinen Start %d im Verlauf",
+		"Time":                                                             "Zeit",
+		"Not writing the debug bundle":                                     "Debug-Paket wird nicht geschrieben",
+		"Redacted: %s":                                                     "Geschwärzt: %s",
+		"Topic %s is not open":                                             "Thema %s ist nicht geöffnet",
+		"Topic %s has no tabs":                                             "Thema %s hat keine Tabs",
+		"Topic":                                                            "Thema",
+		"Topic or profile":                                                 "Thema oder Profil",
+		"Trust this profile? [y/N] ":                                       "Diesem Profil vertrauen? [j/N] ",
+		"Undid: %s":                                                        "Rückgängig gemacht: %s",
+		"Uptime":                                                           "Laufzeit",
+		"Warning: %s":                                                      "Warnung: %s",
+		"Would delete":                                                     "Würde löschen",
+		"YES":                                                              "JA",
+		"<no differences>":                                                 "<keine Unterschiede>",
+		"Check the files above for anything private. Write the bundle to %s? [y/N] ": "Prüfe die Dateien oben auf Privates. Das Paket nach %s schreiben? [j/N] ",
+		"tbml pick needs a terminal, use tbml open instead":                          "tbml pick braucht ein Terminal, verwende stattdessen tbml open",
+		"y": "j",
+	},
+}
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type MigrateStorageCmd struct {
+	Profile string `arg:"" completion:"profiles" help:"The profile whose instances to move"`
+	NewPath string `arg:"" help:"The directory to move the instances' files to, e.g. on another disk" type:"path"`
+}
+
+func (cmd *MigrateStorageCmd) Run(common CommandContext) error {
+	profile := internal.FindProfileByLabel(common.Config, cmd.Profile)
+	if profile == nil {
+		return common.Messages.Errorf("Profile %s does not exist", cmd.Profile)
+	}
+	moved, err := internal.MigrateStorage(common.Config, *profile, cmd.NewPath, common.Mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if common.Mutations.DryRun {
+		return nil
+	}
+	for _, instance := range moved {
+		fmt.Println(common.Messages.Sprintf("Moved instance %s", instance.InstanceLabel))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"errors"
+	"net/url"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type MoveTabCmd struct {
+	From    string   `completion:"topics" help:"The topic whose instance shows the tab" required:""`
+	Topic   string   `completion:"topics" help:"The topic to open the tab in" long:"topic" short:"t"`
+	Profile string   `completion:"profiles" help:"The profile to use if the topic isn't open yet" long:"profile" short:"p"`
+	URL     *url.URL `arg:"" help:"The URL of the tab" name:"url"`
+}
+
+func (cmd *MoveTabCmd) Run(ctx CommandContext) error {
+	instances, err := internal.GetProfileInstances(ctx.Config, ctx.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	source := internal.FindInstanceByTopic(ctx.Config, instances, cmd.From)
+	if source == nil {
+		return ctx.Messages.Errorf("Topic %s is not open", cmd.From)
+	}
+
+	// The tab is closed first, since opening it may launch a browser
+	// and only return once that has exited.
+	err = ctx.Mutations.Apply("Close a tab in instance", source.InstanceLabel, func() error {
+		return internal.CloseURLInInstance(ctx.Config, *source, cmd.URL.String())
+	})
+	if errors.Is(err, internal.ErrInstanceNotListening) {
+		return ctx.Messages.Errorf("Topic %s is not open", cmd.From)
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	from := *source.UsageLabel
+	open := OpenCmd{
+		Profile:   cmd.Profile,
+		Topic:     cmd.Topic,
+		URL:       cmd.URL,
+		movedFrom: &from,
+	}
+	return open.Run(ctx)
+}
@@ -3,8 +3,11 @@ package cli
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"t0ast.cc/tbml/gui"
 	"t0ast.cc/tbml/internal"
@@ -12,69 +15,328 @@ import (
 )
 
 type OpenCmd struct {
-	Topic   string   `help:"The topic to open the new tab in" long:"topic" short:"t"`
-	Profile string   `help:"The profile to use for opening a new topic; has no effect when not opening a new topic" long:"profile" short:"p"`
-	Debug   bool     `help:"Open a debug shell instead of a browser tab"`
-	URL     *url.URL `arg:"" help:"A URL to load instead of the new tab page" name:"url" optional:""`
+	Topic            string        `completion:"topics" help:"The topic to open the new tab in (default: the profile's default topic, if set, otherwise ask)" long:"topic" short:"t"`
+	Profile          string        `completion:"profiles" help:"The profile to use for opening a new topic; has no effect when not opening a new topic" long:"profile" short:"p"`
+	Debug            bool          `help:"Open a debug shell instead of a browser tab"`
+	Ephemeral        bool          `help:"Use a throwaway instance that is wiped when the browser exits"`
+	IgnoreQuietHours bool          `help:"Launch the profile even during its quiet hours"`
+	For              time.Duration `help:"Close the browser after this long, e.g. 45m, with a warning shortly before (default: the topic's session limit)" placeholder:"DURATION"`
+	NoLaunch         bool          `help:"Only create or update the instance, without launching the browser, e.g. to build instances in CI"`
+	NoSync           bool          `help:"Don't update an existing instance's user.js, userChrome.css and extensions if its profile changed"`
+	TopicFromCwd     bool          `help:"If no topic is given, use the name of the git repository of the working directory" name:"topic-from-cwd"`
+	URL              *url.URL      `arg:"" help:"A URL to load instead of the new tab page" name:"url" optional:""`
+
+	// movedFrom is the topic the tab is moved from by tbml move-tab.
+	movedFrom *string
 }
 
 func (cmd *OpenCmd) Run(ctx CommandContext) error {
-	instances, err := internal.GetProfileInstances(ctx.Config)
+	if cmd.NoLaunch && (cmd.Ephemeral || cmd.Debug || cmd.URL != nil) {
+		return ctx.Messages.Errorf("--no-launch can't be combined with --ephemeral, --debug or a URL")
+	}
+	if cmd.For < 0 {
+		return ctx.Messages.Errorf("--for must not be negative")
+	}
+
+	if _, err := internal.ReapDeadInstances(ctx.Config, ctx.Mutations, ctx.Warnings); err != nil {
+		fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to reap dead instances: %s", err))
+	}
+	if !ctx.Mutations.ReadOnly {
+		if _, err := internal.RunMaintenance(ctx.Config, false, ctx.Mutations, ctx.Warnings); err != nil {
+			fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to run maintenance: %s", err))
+		}
+	}
+
+	instances, err := internal.GetProfileInstances(ctx.Config, ctx.Warnings)
 	if err != nil {
 		return err
 	}
 
+	// Routes that deny a URL apply even if a profile or topic is given.
+	if cmd.URL != nil {
+		if err := internal.RefreshRouteLists(ctx.Context, http.DefaultClient, ctx.Config, false); err != nil {
+			fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to refresh route lists: %s", err))
+		}
+		route, err := internal.RouteURL(ctx.Config, ctx.ConfigDir, cmd.URL, time.Now())
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if route != nil {
+			if cmd.URL, err = internal.RewriteURL(*route, cmd.URL); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+		}
+		if route != nil && cmd.Topic == "" && cmd.Profile == "" {
+			cmd.Profile = route.Profile
+			if route.Topic != nil {
+				cmd.Topic = *route.Topic
+			}
+		}
+	}
+
+	if cmd.Topic == "" {
+		topicContext := internal.TopicContext{}
+		resolvers := []internal.TopicResolver{}
+		if cmd.TopicFromCwd {
+			if topicContext.WorkingDir, err = os.Getwd(); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			resolvers = append(resolvers, internal.ResolveGitRepositoryTopic)
+		}
+		if cmd.Topic, err = internal.ResolveTopic(resolvers, topicContext); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	if cmd.Topic == "" && cmd.Profile != "" {
+		if profile := internal.FindProfileByLabel(ctx.Config, cmd.Profile); profile != nil && profile.DefaultTopic != nil {
+			cmd.Topic = *profile.DefaultTopic
+		}
+	}
+
 	if cmd.Topic == "" {
-		topics := internal.GetTopics(instances)
-		topic, err := gui.Prompt(ctx.Context, topics, "Topic", false)
+		topics, err := internal.GetRankedTopics(ctx.Config, instances)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		topic, err := gui.Prompt(ctx.Context, topics, ctx.Messages.Sprintf("Topic"), false)
+		if errors.Is(err, gui.ErrNoDisplay) {
+			return ctx.Messages.Errorf("No topic given and no display to ask for one, use --topic")
+		}
 		if err != nil {
 			return uerror.WithStackTrace(err)
 		}
 		if topic == nil || len(strings.TrimSpace(*topic)) == 0 {
-			return errors.New("No topic selected")
+			return ctx.Messages.Errorf("No topic selected")
 		}
 		cmd.Topic = *topic
 	}
 
-	topicInstance := internal.FindInstanceByTopic(instances, cmd.Topic)
+	topicInstance := internal.FindInstanceByTopic(ctx.Config, instances, cmd.Topic)
 	if topicInstance != nil {
-		conn, err := internal.ConnectToExternalUnixSocket(ctx.Config, *topicInstance)
-		if err != nil {
-			return uerror.WithStackTrace(err)
+		cmd.Topic = *topicInstance.UsageLabel
+	}
+
+	if err := ctx.Mutations.Apply("Record usage of topic", cmd.Topic, func() error {
+		return internal.RecordTopicUsage(ctx.Config, cmd.Topic)
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to record topic usage: %s", err))
+	}
+
+	if topicInstance != nil && cmd.NoLaunch {
+		profile := internal.FindProfileByLabel(ctx.Config, topicInstance.ProfileLabel)
+		if profile == nil {
+			return ctx.Messages.Errorf("Profile %s does not exist", topicInstance.ProfileLabel)
 		}
+		return cmd.startInstance(ctx, *profile, *topicInstance, instances)
+	}
+
+	if topicInstance != nil {
+		cmd.recordLaunch(ctx, topicInstance.ProfileLabel)
 		urlStr := ""
 		if cmd.URL != nil {
 			urlStr = cmd.URL.String()
 		}
-		if err := internal.SendOpenTabMessage(conn, urlStr); err != nil {
+		err := ctx.Mutations.Apply("Open a tab in instance", topicInstance.InstanceLabel, func() error {
+			return internal.ForwardURLToInstance(ctx.Config, *topicInstance, urlStr)
+		})
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, internal.ErrInstanceNotListening) {
 			return uerror.WithStackTrace(err)
 		}
-		return nil
+		profile := internal.FindProfileByLabel(ctx.Config, topicInstance.ProfileLabel)
+		if profile == nil {
+			return ctx.Messages.Errorf("Profile %s does not exist", topicInstance.ProfileLabel)
+		}
+		// An instance that was just launched may not be listening
+		// yet, so wait for it instead of launching it twice.
+		recent, err := internal.GetRecentLaunch(ctx.Config, *profile)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if recent != nil && recent.InstanceLabel == topicInstance.InstanceLabel {
+			return ctx.Mutations.Apply("Open a tab in instance", topicInstance.InstanceLabel, func() error {
+				return internal.ForwardURLToLaunchingInstance(ctx.Context, ctx.Config, *profile, *topicInstance, urlStr)
+			})
+		}
+		if err := cmd.checkQuietHours(ctx, *profile); err != nil {
+			return err
+		}
+		// The browser of the topic is gone, relaunch its instance
+		// instead of picking a new one.
+		fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Instance %s is not running, restarting it", topicInstance.InstanceLabel))
+		return ctx.Mutations.Apply("Launch instance", topicInstance.InstanceLabel, func() error {
+			return cmd.startInstance(ctx, *profile, *topicInstance, instances)
+		})
 	}
 
 	if cmd.Profile == "" {
-		profileLabels := internal.GetProfileLabels(ctx.Config)
-		profile, err := gui.Prompt(ctx.Context, profileLabels, "Profile", true)
+		profileLabels, err := internal.GetProfileLabelsForNetwork(ctx.Config)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		profile, err := gui.Prompt(ctx.Context, profileLabels, ctx.Messages.Sprintf("Profile"), true)
+		if errors.Is(err, gui.ErrNoDisplay) {
+			return ctx.Messages.Errorf("No profile given and no display to ask for one, use --profile")
+		}
 		if err != nil {
 			return uerror.WithStackTrace(err)
 		}
 		if profile == nil || len(strings.TrimSpace(*profile)) == 0 {
-			return errors.New("No profile selected")
+			return ctx.Messages.Errorf("No profile selected")
 		}
 		cmd.Profile = *profile
 	}
 
 	profile := internal.FindProfileByLabel(ctx.Config, cmd.Profile)
 	if profile == nil {
-		return fmt.Errorf("Profile %s does not exist", cmd.Profile)
+		return ctx.Messages.Errorf("Profile %s does not exist", cmd.Profile)
 	}
+	if err := cmd.checkQuietHours(ctx, *profile); err != nil {
+		return err
+	}
+	cmd.recordLaunch(ctx, profile.Label)
+
+	if cmd.Ephemeral {
+		return ctx.Mutations.Apply("Launch an ephemeral instance of profile", profile.Label, func() error {
+			instance, err := internal.NewEphemeralInstance(ctx.Config, *profile)
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			return cmd.startInstance(ctx, *profile, instance, instances)
+		})
+	}
+
+	return ctx.Mutations.Apply("Launch the best instance of profile", profile.Label, func() error {
+		bestInstance, release, err := internal.ClaimBestInstance(ctx.Context, ctx.Config, *profile, &cmd.Topic, ctx.Warnings)
+		if errors.Is(err, internal.ErrLaunchCooldown) {
+			return cmd.openInRecentLaunch(ctx, *profile)
+		}
+		if errors.Is(err, internal.ErrInstanceLimit) {
+			return ctx.Messages.Errorf("All %d instances of profile %s are in use", *profile.MaxInstances, profile.Label)
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		fmt.Println("Best:", bestInstance.InstanceLabel)
+		cmd.announceUnarchiving(ctx, bestInstance)
+
+		if cmd.NoLaunch {
+			if err := internal.ProvisionClaimedInstance(ctx.Context, ctx.Config, *profile, bestInstance, release, ctx.ConfigDir); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Provisioned instance %s", bestInstance.InstanceLabel))
+			return nil
+		}
+
+		exitCode, err := internal.StartClaimedInstance(ctx.Context, ctx.Config, *profile, bestInstance, release, ctx.ConfigDir, cmd.URL, cmd.Debug, cmd.NoSync, cmd.getSessionLimit(ctx), ctx.Warnings)
+		if err != nil {
+			return uerror.WithExitCode(exitCode, uerror.WithStackTrace(err))
+		}
+		return nil
+	})
+}
+
+// recordLaunch adds the tab to the launch history, so it can be opened
+// again with tbml rerun.
+func (cmd *OpenCmd) recordLaunch(ctx CommandContext, profileLabel string) {
+	if cmd.NoLaunch {
+		return
+	}
+	entry := internal.LaunchHistoryEntry{
+		Ephemeral: cmd.Ephemeral,
+		MovedFrom: cmd.movedFrom,
+		Profile:   profileLabel,
+		Time:      time.Now(),
+		Topic:     cmd.Topic,
+	}
+	if cmd.URL != nil {
+		urlStr := cmd.URL.String()
+		entry.URL = &urlStr
+	}
+	if err := ctx.Mutations.Apply("Record launch of topic", cmd.Topic, func() error {
+		return internal.RecordLaunchHistory(ctx.Config, entry)
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to record the launch: %s", err))
+	}
+}
+
+// checkQuietHours refuses to launch a profile during its quiet hours,
+// unless they are ignored. Provisioning isn't a launch.
+func (cmd *OpenCmd) checkQuietHours(ctx CommandContext, profile internal.ProfileConfiguration) error {
+	if cmd.IgnoreQuietHours || cmd.NoLaunch {
+		return nil
+	}
+	end, err := internal.GetQuietHoursEnd(ctx.Config, profile, time.Now())
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if end != nil {
+		return ctx.Messages.Errorf("Profile %s has quiet hours until %s, use --ignore-quiet-hours to launch it anyway", profile.Label, end.Format("15:04"))
+	}
+	return nil
+}
 
-	bestInstance := internal.GetBestInstance(*profile, instances)
-	fmt.Println("Best:", bestInstance.InstanceLabel)
+// getSessionLimit returns how long the browser may run, zero meaning
+// without limit.
+func (cmd *OpenCmd) getSessionLimit(ctx CommandContext) time.Duration {
+	if cmd.For != 0 {
+		return cmd.For
+	}
+	return internal.GetTopicSessionLimit(ctx.Config, cmd.Topic)
+}
 
-	bestInstance.UsageLabel = &cmd.Topic
+// openInRecentLaunch opens the URL in the instance of the profile that
+// was launched within its cooldown.
+func (cmd *OpenCmd) openInRecentLaunch(ctx CommandContext, profile internal.ProfileConfiguration) error {
+	recent, err := internal.GetRecentLaunch(ctx.Config, profile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if recent == nil {
+		return ctx.Messages.Errorf("Profile %s was launched moments ago", profile.Label)
+	}
+	fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Profile %s was launched moments ago, opening the tab in instance %s", profile.Label, recent.InstanceLabel))
+	urlStr := ""
+	if cmd.URL != nil {
+		urlStr = cmd.URL.String()
+	}
+	return internal.ForwardURLToLaunchingInstance(ctx.Context, ctx.Config, profile, *recent, urlStr)
+}
+
+// announceUnarchiving tells how long it takes to restore an archived
+// instance before it is launched, so a slow launch doesn't come as a
+// surprise.
+func (cmd *OpenCmd) announceUnarchiving(ctx CommandContext, instance internal.ProfileInstance) {
+	if !instance.Archived {
+		return
+	}
+	estimate, err := internal.EstimateUnarchiveTime(ctx.Config, instance)
+	if err != nil {
+		ctx.Warnings.Add(instance.InstanceLabel, "Failed to estimate the time to unarchive: %s", uerror.Message(err))
+		return
+	}
+	if estimate < time.Second {
+		estimate = time.Second
+	}
+	fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Instance %s is archived, restoring it takes about %s", instance.InstanceLabel, estimate.Round(time.Second)))
+}
+
+func (cmd *OpenCmd) startInstance(ctx CommandContext, profile internal.ProfileConfiguration, instance internal.ProfileInstance, instances []internal.ProfileInstance) error {
+	instance.UsageLabel = &cmd.Topic
+	cmd.announceUnarchiving(ctx, instance)
+
+	if cmd.NoLaunch {
+		if err := internal.ProvisionInstance(ctx.Context, ctx.Config, profile, instance, ctx.ConfigDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Provisioned instance %s", instance.InstanceLabel))
+		return nil
+	}
 
-	exitCode, err := internal.StartInstance(ctx.Context, ctx.Config, *profile, bestInstance, instances, ctx.ConfigDir, cmd.URL, cmd.Debug)
+	exitCode, err := internal.StartInstance(ctx.Context, ctx.Config, profile, instance, ctx.ConfigDir, cmd.URL, cmd.Debug, cmd.NoSync, cmd.getSessionLimit(ctx), ctx.Warnings)
 	if err != nil {
 		return uerror.WithExitCode(exitCode, uerror.WithStackTrace(err))
 	}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"t0ast.cc/tbml/gui"
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type PickCmd struct{}
+
+func (cmd *PickCmd) Run(ctx CommandContext) error {
+	instances, err := internal.GetProfileInstances(ctx.Config, ctx.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	topics, err := internal.GetRankedTopics(ctx.Config, instances)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	// Every entry is shown with what it is, so the same name can be a
+	// topic and a profile.
+	topicsByItem := map[string]string{}
+	profilesByItem := map[string]string{}
+	items := []string{}
+	for _, topic := range topics {
+		item := topic
+		if instance := internal.FindInstanceByTopic(ctx.Config, instances, topic); instance != nil && instance.UsagePID != nil {
+			item = ctx.Messages.Sprintf("%s (running in %s)", topic, instance.InstanceLabel)
+		}
+		topicsByItem[item] = topic
+		items = append(items, item)
+	}
+	profileNames, profilesByName := getProfileNames(ctx)
+	for i, name := range profileNames {
+		item := ctx.Messages.Sprintf("%s (new topic in profile)", name)
+		if description := ctx.Config.Profiles[i].Description; description != nil {
+			item += ": " + *description
+		}
+		profilesByItem[item] = profilesByName[name]
+		items = append(items, item)
+	}
+
+	choice, err := cmd.prompt(ctx, items, ctx.Messages.Sprintf("Topic or profile"), true)
+	if err != nil || choice == nil {
+		return err
+	}
+
+	open := OpenCmd{}
+	if topic, ok := topicsByItem[*choice]; ok {
+		open.Topic = topic
+		if internal.FindInstanceByTopic(ctx.Config, instances, topic) == nil {
+			// The topic isn't open anywhere, so it needs a profile.
+			profile, err := cmd.prompt(ctx, profileNames, ctx.Messages.Sprintf("Profile"), true)
+			if err != nil || profile == nil {
+				return err
+			}
+			open.Profile = *profile
+			if label, ok := profilesByName[*profile]; ok {
+				open.Profile = label
+			}
+		}
+	} else {
+		open.Profile = profilesByItem[*choice]
+		if profile := internal.FindProfileByLabel(ctx.Config, open.Profile); profile != nil && profile.DefaultTopic == nil {
+			topic, err := cmd.prompt(ctx, topics, ctx.Messages.Sprintf("Topic"), false)
+			if err != nil || topic == nil {
+				return err
+			}
+			open.Topic = *topic
+		}
+	}
+	return open.Run(ctx)
+}
+
+// getProfileNames returns the display names of the configured profiles
+// in order and the profiles' labels by name. Profiles with the same
+// name are told apart by their labels.
+func getProfileNames(ctx CommandContext) ([]string, map[string]string) {
+	names := make([]string, 0, len(ctx.Config.Profiles))
+	labelsByName := map[string]string{}
+	for _, profile := range ctx.Config.Profiles {
+		name := internal.GetProfileDisplayName(profile, ctx.Messages.Language())
+		if _, taken := labelsByName[name]; taken {
+			name = fmt.Sprintf("%s (%s)", name, profile.Label)
+		}
+		names = append(names, name)
+		labelsByName[name] = profile.Label
+	}
+	return names, labelsByName
+}
+
+// prompt asks in the terminal, returning nil without an error if the
+// user canceled or entered nothing.
+func (cmd *PickCmd) prompt(ctx CommandContext, items []string, prompt string, matchExact bool) (*string, error) {
+	choice, err := gui.PromptTerminal(ctx.Context, items, prompt, matchExact)
+	if errors.Is(err, gui.ErrNoTerminal) {
+		return nil, ctx.Messages.Errorf("tbml pick needs a terminal, use tbml open instead")
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if choice == nil || len(strings.TrimSpace(*choice)) == 0 {
+		return nil, nil
+	}
+	return choice, nil
+}
@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type ProfileCmd struct {
+	Export  ProfileExportCmd  `cmd:"" help:"Write a profile's configuration and files to a .tbmlprofile bundle"`
+	Import  ProfileImportCmd  `cmd:"" help:"Unpack a .tbmlprofile bundle next to the configuration file"`
+	Install ProfileInstallCmd `cmd:"" help:"Download a .tbmlprofile bundle and add it to the configuration file"`
+}
+
+type ProfileExportCmd struct {
+	Profile string `arg:"" completion:"profiles" help:"The label of the profile to export"`
+	Output  string `help:"The file to write the bundle to (default: <profile>.tbmlprofile)" short:"o" type:"path"`
+}
+
+func (cmd *ProfileExportCmd) Run(common CommandContext) error {
+	profile := internal.FindProfileByLabel(common.Config, cmd.Profile)
+	if profile == nil {
+		return common.Messages.Errorf("Profile %s does not exist", cmd.Profile)
+	}
+
+	output := cmd.Output
+	if output == "" {
+		output = profile.Label + internal.ProfileBundleExtension
+	}
+	var writer io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	if err := internal.ExportProfileDefinition(*profile, common.ConfigDir, writer); err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+type ProfileImportCmd struct {
+	Bundle string `arg:"" help:"The .tbmlprofile bundle to import, or - for standard input"`
+}
+
+func (cmd *ProfileImportCmd) Run(common CommandContext) error {
+	var input io.Reader = os.Stdin
+	if cmd.Bundle != "-" {
+		file, err := os.Open(cmd.Bundle)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	profile, err := internal.ImportProfileDefinition(common.Config, common.ConfigDir, input, common.Mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fragment, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Fprintln(os.Stderr, common.Messages.Sprintf("Imported profile %s. Add this to the profiles in your configuration file:", profile.Label))
+	fmt.Println(string(fragment))
+	return nil
+}
+
+type ProfileInstallCmd struct {
+	SHA256 string `help:"The SHA-256 sum of the bundle, as published by its author" name:"sha256" required:""`
+	URL    string `arg:"" help:"The HTTPS URL of the bundle"`
+	Yes    bool   `help:"Trust the profile's browser command, environment, hooks and native messaging hosts without asking" short:"y"`
+}
+
+func (cmd *ProfileInstallCmd) Run(common CommandContext) error {
+	ctx, cancel := context.WithTimeout(common.Context, internal.GetDownloadTimeout(common.Config))
+	defer cancel()
+	bundle, err := internal.DownloadProfileBundle(ctx, http.DefaultClient, cmd.URL, cmd.SHA256)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	profile, err := internal.InspectProfileDefinition(bytes.NewReader(bundle))
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !cmd.Yes && internal.ProfileNeedsTrust(profile) {
+		trusted, err := askToTrustProfile(common, profile)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if !trusted {
+			return common.Messages.Errorf("Not installing profile %s", profile.Label)
+		}
+	}
+
+	profile, err = internal.ImportProfileDefinition(common.Config, common.ConfigDir, bytes.NewReader(bundle), common.Mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	err = internal.AddProfileToConfigFile(common.Config, common.ConfigFile, profile, common.Mutations)
+	if errors.Is(err, internal.ErrUnsupportedConfigFormat) {
+		fragment, err := json.MarshalIndent(profile, "", "  ")
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("Imported profile %s. Add this to the profiles in your configuration file:", profile.Label))
+		fmt.Println(string(fragment))
+		return nil
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(common.Messages.Sprintf("Installed profile %s", profile.Label))
+	return nil
+}
+
+// askToTrustProfile shows what a profile would run and asks the user
+// whether to go ahead.
+func askToTrustProfile(common CommandContext, profile internal.ProfileConfiguration) (bool, error) {
+	if len(profile.BrowserCommand) > 0 {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile runs this command instead of the default browser: %s", strings.Join(profile.BrowserCommand, " ")))
+	}
+	if len(profile.ExtraArgs) > 0 {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile passes these arguments to the browser: %s", strings.Join(profile.ExtraArgs, " ")))
+	}
+	if profile.Sandbox != nil {
+		sandboxType := profile.Sandbox.Type
+		if sandboxType == "" {
+			sandboxType = "firejail"
+		}
+		if profile.Sandbox.Image != "" {
+			fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile runs the browser in a %s sandbox from the image %s", sandboxType, profile.Sandbox.Image))
+		} else {
+			fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile runs the browser in a %s sandbox", sandboxType))
+		}
+		if profile.Sandbox.Optional {
+			fmt.Fprintln(os.Stderr, common.Messages.Sprintf("If %s isn't installed, the browser runs without a sandbox", sandboxType))
+		}
+	}
+	if len(profile.Environment) > 0 {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile sets these environment variables:"))
+		names := []string{}
+		for name := range profile.Environment {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s=%s\n", name, profile.Environment[name])
+		}
+	}
+	if profile.Hooks != nil {
+		hooks := []struct {
+			kind     string
+			commands []string
+		}{
+			{"PreLaunch", profile.Hooks.PreLaunch},
+			{"PostLaunch", profile.Hooks.PostLaunch},
+			{"PostExit", profile.Hooks.PostExit},
+		}
+		if len(profile.Hooks.PreLaunch)+len(profile.Hooks.PostLaunch)+len(profile.Hooks.PostExit) > 0 {
+			fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile runs these hooks on this computer:"))
+		}
+		for _, hook := range hooks {
+			for _, command := range hook.commands {
+				fmt.Fprintf(os.Stderr, "  %s: %s\n", hook.kind, command)
+			}
+		}
+	}
+	if len(profile.NativeMessagingHosts) > 0 {
+		fmt.Fprintln(os.Stderr, common.Messages.Sprintf("The profile lets extensions start these native messaging hosts:"))
+		for _, manifest := range profile.NativeMessagingHosts {
+			fmt.Fprintf(os.Stderr, "  %s\n", manifest)
+		}
+	}
+	return askYesOrNo(common, common.Messages.Sprintf("Trust this profile? [y/N] "))
+}
+
+// askYesOrNo asks the user a question in the terminal. Anything but
+// "y" counts as no, including the end of the input.
+func askYesOrNo(common CommandContext, question string) (bool, error) {
+	fmt.Fprint(os.Stderr, question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, uerror.WithStackTrace(err)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == common.Messages.Sprintf("y"), nil
+}
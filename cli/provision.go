@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type ProvisionCmd struct {
+	Profile     string `arg:"" completion:"profiles" help:"The profile to provision an instance of"`
+	Concurrency int    `default:"4" help:"How many instances to provision at the same time with --count"`
+	Count       int    `help:"Create this many new instances instead, e.g. one for every participant of a workshop" placeholder:"N" xor:"instance"`
+	Instance    string `completion:"instances" help:"The label of the instance to create or update (default: the best instance of the profile)" placeholder:"LABEL" xor:"instance"`
+}
+
+func (cmd *ProvisionCmd) Run(ctx CommandContext) error {
+	profile := internal.FindProfileByLabel(ctx.Config, cmd.Profile)
+	if profile == nil {
+		return ctx.Messages.Errorf("Profile %s does not exist", cmd.Profile)
+	}
+	if cmd.Count > 0 {
+		return cmd.provisionInstances(ctx, *profile)
+	}
+
+	var instance internal.ProfileInstance
+	err := ctx.Mutations.Apply("Provision an instance of profile", profile.Label, func() error {
+		if cmd.Instance != "" {
+			var err error
+			instance, err = internal.GetInstanceToProvision(ctx.Config, *profile, cmd.Instance)
+			if errors.Is(err, internal.ErrInstanceOfOtherProfile) {
+				return ctx.Messages.Errorf("Instance %s belongs to another profile", cmd.Instance)
+			}
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			return internal.ProvisionInstance(ctx.Context, ctx.Config, *profile, instance, ctx.ConfigDir)
+		}
+
+		claimed, release, err := internal.ClaimBestInstance(ctx.Context, ctx.Config, *profile, nil, ctx.Warnings)
+		if errors.Is(err, internal.ErrLaunchCooldown) {
+			return ctx.Messages.Errorf("Profile %s was launched moments ago", profile.Label)
+		}
+		if errors.Is(err, internal.ErrInstanceLimit) {
+			return ctx.Messages.Errorf("All %d instances of profile %s are in use", *profile.MaxInstances, profile.Label)
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		instance = claimed
+		return internal.ProvisionClaimedInstance(ctx.Context, ctx.Config, *profile, instance, release, ctx.ConfigDir)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only the path goes to stdout, so scripts can use it directly.
+	if !ctx.Mutations.DryRun {
+		fmt.Println(internal.GetInstanceDir(ctx.Config, instance))
+	}
+	return nil
+}
+
+// provisionInstances creates --count new instances, reporting each one
+// on stderr as it is ready. Only the paths of the ready instances go
+// to stdout.
+func (cmd *ProvisionCmd) provisionInstances(ctx CommandContext, profile internal.ProfileConfiguration) error {
+	var results []internal.BatchProvisionResult
+	err := ctx.Mutations.Apply(fmt.Sprintf("Provision %d instances of profile", cmd.Count), profile.Label, func() error {
+		var err error
+		results, err = internal.ProvisionInstances(ctx.Context, ctx.Config, profile, cmd.Count, cmd.Concurrency, ctx.ConfigDir, func(done int, result internal.BatchProvisionResult) {
+			if result.Err != nil {
+				fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("[%d/%d] Failed to provision instance %s: %s", done, cmd.Count, result.InstanceLabel, uerror.Message(result.Err)))
+				return
+			}
+			fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("[%d/%d] Provisioned instance %s", done, cmd.Count, result.InstanceLabel))
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			continue
+		}
+		fmt.Println(internal.GetInstanceDir(ctx.Config, internal.ProfileInstance{InstanceLabel: result.InstanceLabel}))
+	}
+	if failed > 0 {
+		return ctx.Messages.Errorf("%d of %d instances failed, provision them again with --instance", failed, len(results))
+	}
+	return nil
+}
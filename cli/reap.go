@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type ReapCmd struct{}
+
+func (cmd *ReapCmd) Run(common CommandContext) error {
+	results, err := internal.ReapDeadInstances(common.Config, common.Mutations, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if common.Mutations.DryRun {
+		return nil
+	}
+	for _, result := range results {
+		if result.Deleted {
+			fmt.Println(common.Messages.Sprintf("Deleted dead ephemeral instance %s", result.Instance.InstanceLabel))
+		} else {
+			fmt.Println(common.Messages.Sprintf("Released dead instance %s", result.Instance.InstanceLabel))
+		}
+	}
+	return nil
+}
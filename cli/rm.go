@@ -6,7 +6,7 @@ import (
 )
 
 type RmCmd struct {
-	Instance string `arg:"" help:"The label of the instance to remove"`
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to remove"`
 }
 
 func (cmd *RmCmd) Run(common CommandContext) error {
@@ -14,5 +14,5 @@ func (cmd *RmCmd) Run(common CommandContext) error {
 	if err != nil {
 		return uerror.WithStackTrace(err)
 	}
-	return internal.DeleteInstance(common.Config, instance)
+	return internal.DeleteInstance(common.Config, instance, common.Mutations)
 }
@@ -0,0 +1,155 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type RouteCmd struct {
+	Explain RouteExplainCmd `cmd:"" help:"Show which routes a URL is tried on, and why they apply or not"`
+	Refresh RouteRefreshCmd `cmd:"" help:"Download the lists of domains routes use again"`
+	Test    RouteTestCmd    `cmd:"" help:"Show the route, profile, topic and rewritten URL a URL is opened with, without launching anything"`
+}
+
+type RouteExplainCmd struct {
+	URL *url.URL `arg:"" help:"The URL to route"`
+	At  string   `help:"Route the URL as if it was opened at this time, e.g. 20:30 or \"2024-05-17 20:30\" (default: now)" placeholder:"TIME"`
+}
+
+func (cmd *RouteExplainCmd) Run(ctx CommandContext) error {
+	now, err := getRouteTime(ctx, cmd.At)
+	if err != nil {
+		return err
+	}
+	explanations, err := explainRoute(ctx, cmd.URL, now)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	for _, explanation := range explanations {
+		route := explanation.Route
+		priority := 0
+		if route.Priority != nil {
+			priority = *route.Priority
+		}
+		status := ctx.Messages.Sprintf("applies")
+		if !explanation.Applies {
+			status = ctx.Messages.Sprintf("skipped, %s", explanation.Reason)
+		}
+		fmt.Println(ctx.Messages.Sprintf("Route %d (priority %d, %s): %s", explanation.Index, priority, describeRoute(ctx, route), status))
+	}
+
+	if len(explanations) == 0 || !explanations[len(explanations)-1].Applies {
+		fmt.Println(ctx.Messages.Sprintf("No route applies, the URL is opened in the topic that is given or picked"))
+		return nil
+	}
+	route := explanations[len(explanations)-1].Route
+	switch {
+	case route.Action != nil && *route.Action == internal.RouteActionDeny && route.Message != nil:
+		fmt.Println(ctx.Messages.Sprintf("The URL is denied: %s", *route.Message))
+	case route.Action != nil && *route.Action == internal.RouteActionDeny:
+		fmt.Println(ctx.Messages.Sprintf("The URL is denied"))
+	case route.Topic != nil:
+		fmt.Println(ctx.Messages.Sprintf("The URL is opened in topic %s of profile %s", *route.Topic, route.Profile))
+	default:
+		fmt.Println(ctx.Messages.Sprintf("The URL is opened in profile %s", route.Profile))
+	}
+	return nil
+}
+
+type RouteTestCmd struct {
+	URL *url.URL `arg:"" help:"The URL to route"`
+	At  string   `help:"Route the URL as if it was opened at this time, e.g. 20:30 or \"2024-05-17 20:30\" (default: now)" placeholder:"TIME"`
+}
+
+func (cmd *RouteTestCmd) Run(ctx CommandContext) error {
+	now, err := getRouteTime(ctx, cmd.At)
+	if err != nil {
+		return err
+	}
+	explanations, err := explainRoute(ctx, cmd.URL, now)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if len(explanations) == 0 || !explanations[len(explanations)-1].Applies {
+		fmt.Println(ctx.Messages.Sprintf("No route applies, the URL is opened in the topic that is given or picked"))
+		return nil
+	}
+	explanation := explanations[len(explanations)-1]
+	route := explanation.Route
+	fmt.Println(ctx.Messages.Sprintf("Route %d matches", explanation.Index))
+
+	if route.Action != nil && *route.Action == internal.RouteActionDeny {
+		if route.Message != nil {
+			fmt.Println(ctx.Messages.Sprintf("The URL is denied: %s", *route.Message))
+		} else {
+			fmt.Println(ctx.Messages.Sprintf("The URL is denied"))
+		}
+		return nil
+	}
+
+	fmt.Println(ctx.Messages.Sprintf("Profile: %s", route.Profile))
+	if route.Topic != nil {
+		fmt.Println(ctx.Messages.Sprintf("Topic: %s", *route.Topic))
+	} else {
+		fmt.Println(ctx.Messages.Sprintf("Topic: the profile's default topic, otherwise picked"))
+	}
+	rewritten, err := internal.RewriteURL(route, cmd.URL)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if rewritten.String() != cmd.URL.String() {
+		fmt.Println(ctx.Messages.Sprintf("Rewritten to: %s", rewritten))
+	}
+	return nil
+}
+
+type RouteRefreshCmd struct{}
+
+func (cmd *RouteRefreshCmd) Run(ctx CommandContext) error {
+	return internal.RefreshRouteLists(ctx.Context, http.DefaultClient, ctx.Config, true)
+}
+
+// explainRoute refreshes the route lists that are due and explains
+// which route applies to a URL, like tbml open does.
+func explainRoute(ctx CommandContext, u *url.URL, now time.Time) ([]internal.RouteExplanation, error) {
+	if err := internal.RefreshRouteLists(ctx.Context, http.DefaultClient, ctx.Config, false); err != nil {
+		fmt.Fprintln(os.Stderr, ctx.Messages.Sprintf("Failed to refresh route lists: %s", err))
+	}
+	return internal.ExplainRoute(ctx.Config, ctx.ConfigDir, u, now)
+}
+
+func describeRoute(ctx CommandContext, route internal.RouteConfiguration) string {
+	if route.Action != nil && *route.Action == internal.RouteActionDeny {
+		return ctx.Messages.Sprintf("deny")
+	}
+	return ctx.Messages.Sprintf("profile %s", route.Profile)
+}
+
+// getRouteTime returns the time given with --at, or now.
+func getRouteTime(ctx CommandContext, at string) (time.Time, error) {
+	now := time.Now()
+	if at == "" {
+		return now, nil
+	}
+	parsed, err := parseRouteTime(at, now)
+	if err != nil {
+		return time.Time{}, ctx.Messages.Errorf("Invalid time %q, use e.g. 20:30 or \"2024-05-17 20:30\"", at)
+	}
+	return parsed, nil
+}
+
+// parseRouteTime parses a time of day, which is taken to be on the day
+// of now, or a date and time, both in the local time zone.
+func parseRouteTime(s string, now time.Time) (time.Time, error) {
+	if clock, err := time.ParseInLocation("15:04", s, now.Location()); err == nil {
+		return time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location()), nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", s, now.Location())
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type SchemaCmd struct {
+	Print    SchemaPrintCmd    `cmd:"" help:"Print the JSON Schema of a format"`
+	Validate SchemaValidateCmd `cmd:"" help:"Check a JSON document against the schema of a format"`
+}
+
+type SchemaPrintCmd struct {
+	Name string `arg:"" enum:"config,control-socket,instance-metadata,ls,stats,stats-boot,status,tabs,version" help:"The format to print the schema of: config, control-socket, instance-metadata, ls, stats, stats-boot, status, tabs or version"`
+}
+
+func (cmd *SchemaPrintCmd) Run(common CommandContext) error {
+	schema, err := internal.GetSchema(cmd.Name)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	_, err = os.Stdout.Write(schema)
+	return uerror.WithStackTrace(err)
+}
+
+type SchemaValidateCmd struct {
+	Name string `arg:"" enum:"config,control-socket,instance-metadata,ls,stats,stats-boot,status,tabs,version" help:"The format of the document: config, control-socket, instance-metadata, ls, stats, stats-boot, status, tabs or version"`
+	File string `arg:"" help:"The JSON document to check, or - for standard input"`
+}
+
+func (cmd *SchemaValidateCmd) Run(common CommandContext) error {
+	var input io.Reader = os.Stdin
+	if cmd.File != "-" {
+		file, err := os.Open(cmd.File)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		input = file
+	}
+	document, err := io.ReadAll(input)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	if err := internal.ValidateWithSchema(cmd.Name, document); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	fmt.Println(common.Messages.Sprintf("The document matches the %s schema", cmd.Name))
+	return nil
+}
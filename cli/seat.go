@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type SeatCmd struct {
+	Launch   SeatLaunchCmd   `cmd:"" help:"Launch the instance of a seat, e.g. a login on a shared machine, giving the seat an instance of its own first if necessary"`
+	Ls       SeatLsCmd       `cmd:"" help:"List the seats and their instances"`
+	Unassign SeatUnassignCmd `cmd:"" help:"Take a seat's instance away from it, so other launches may use the instance"`
+}
+
+type SeatLaunchCmd struct {
+	Seat    string   `arg:"" help:"The seat, e.g. the login name"`
+	URL     *url.URL `arg:"" help:"A URL to load instead of the new tab page" name:"url" optional:""`
+	NoSync  bool     `help:"Don't update the instance's user.js, userChrome.css and extensions if its profile changed"`
+	Profile string   `completion:"profiles" help:"The profile of the seat's instance, needed the first time a seat is launched" long:"profile" short:"p"`
+}
+
+func (cmd *SeatLaunchCmd) Run(ctx CommandContext) error {
+	var profile *internal.ProfileConfiguration
+	if cmd.Profile != "" {
+		profile = internal.FindProfileByLabel(ctx.Config, cmd.Profile)
+		if profile == nil {
+			return ctx.Messages.Errorf("Profile %s does not exist", cmd.Profile)
+		}
+	}
+
+	return ctx.Mutations.Apply("Launch the instance of seat", cmd.Seat, func() error {
+		instance, err := internal.AssignSeat(ctx.Config, cmd.Seat, profile)
+		if errors.Is(err, internal.ErrUnknownSeat) {
+			return ctx.Messages.Errorf("Seat %s has no instance yet, use --profile to give it one", cmd.Seat)
+		}
+		if errors.Is(err, internal.ErrInstanceOfOtherProfile) {
+			return ctx.Messages.Errorf("Seat %s has an instance of another profile", cmd.Seat)
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		instanceProfile := internal.FindProfileByLabel(ctx.Config, instance.ProfileLabel)
+		if instanceProfile == nil {
+			return ctx.Messages.Errorf("Profile %s of instance %s does not exist", instance.ProfileLabel, instance.InstanceLabel)
+		}
+
+		exitCode, err := internal.StartInstance(ctx.Context, ctx.Config, *instanceProfile, instance, ctx.ConfigDir, cmd.URL, false, cmd.NoSync, 0, ctx.Warnings)
+		if errors.Is(err, internal.ErrInstanceInUse) {
+			// The seat's browser is already running, e.g. because the
+			// seat's user clicked twice.
+			urlStr := ""
+			if cmd.URL != nil {
+				urlStr = cmd.URL.String()
+			}
+			return internal.ForwardURLToInstance(ctx.Config, instance, urlStr)
+		}
+		if err != nil {
+			return uerror.WithExitCode(exitCode, uerror.WithStackTrace(err))
+		}
+		return nil
+	})
+}
+
+type SeatLsCmd struct{}
+
+func (cmd *SeatLsCmd) Run(ctx CommandContext) error {
+	assignments, err := internal.GetSeatAssignments(ctx.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, assignment := range assignments {
+		fmt.Printf("%-15s  %-15s  %-15s  %s\n", assignment.Seat, assignment.InstanceLabel, assignment.ProfileLabel, assignment.Assigned.Local().Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+type SeatUnassignCmd struct {
+	Seat string `arg:"" help:"The seat to take the instance away from"`
+}
+
+func (cmd *SeatUnassignCmd) Run(ctx CommandContext) error {
+	err := internal.UnassignSeat(ctx.Config, cmd.Seat, ctx.Mutations)
+	if errors.Is(err, internal.ErrUnknownSeat) {
+		return ctx.Messages.Errorf("Seat %s has no instance", cmd.Seat)
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+const statsDateLayout = "2006-01-02"
+
+type StatsCmd struct {
+	Boot   bool   `help:"Compare how long launches took to start up per instance backend instead"`
+	By     string `default:"both" enum:"both,profile,topic" help:"Add up the time per profile and topic, per profile or per topic"`
+	Format string `default:"text" enum:"text,json,csv" help:"Print a table, JSON or CSV"`
+	Since  string `help:"Count from the start of this day (YYYY-MM-DD, local time)"`
+	Until  string `help:"Count until the end of this day (YYYY-MM-DD, local time)"`
+}
+
+func (cmd *StatsCmd) Run(ctx CommandContext) error {
+	if cmd.Boot {
+		return cmd.runBoot(ctx)
+	}
+
+	var from, to time.Time
+	if cmd.Since != "" {
+		day, err := time.ParseInLocation(statsDateLayout, cmd.Since, time.Local)
+		if err != nil {
+			return ctx.Messages.Errorf("Invalid date %s, expected YYYY-MM-DD", cmd.Since)
+		}
+		from = day
+	}
+	if cmd.Until != "" {
+		day, err := time.ParseInLocation(statsDateLayout, cmd.Until, time.Local)
+		if err != nil {
+			return ctx.Messages.Errorf("Invalid date %s, expected YYYY-MM-DD", cmd.Until)
+		}
+		to = day.AddDate(0, 0, 1)
+	}
+
+	usage, err := internal.GetUsageTime(ctx.Config, from, to, ctx.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	usage = groupUsageTime(usage, cmd.By)
+
+	switch cmd.Format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(usage); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return nil
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		_ = writer.Write([]string{"profile", "topic", "seconds"})
+		for _, entry := range usage {
+			_ = writer.Write([]string{entry.Profile, entry.Topic, strconv.FormatInt(entry.Seconds, 10)})
+		}
+		writer.Flush()
+		return uerror.WithStackTrace(writer.Error())
+	}
+
+	sb := strings.Builder{}
+	writeRow := func(columns ...string) {
+		fmt.Fprintf(&sb, "%-15s  %-25s  %10s\n", columns[0], columns[1], columns[2])
+	}
+	writeRow(
+		ctx.Messages.Sprintf("Profile"),
+		ctx.Messages.Sprintf("Topic"),
+		ctx.Messages.Sprintf("Time"),
+	)
+	var total int64
+	for _, entry := range usage {
+		profile, topic := entry.Profile, entry.Topic
+		if cmd.By == "topic" {
+			profile = "-"
+		}
+		if topic == "" {
+			topic = "<none>"
+			if cmd.By == "profile" {
+				topic = "-"
+			}
+		}
+		writeRow(profile, topic, (time.Duration(entry.Seconds) * time.Second).String())
+		total += entry.Seconds
+	}
+	sb.WriteString(ctx.Messages.Sprintf("%s in total\n", time.Duration(total)*time.Second))
+
+	fmt.Print(sb.String())
+	return nil
+}
+
+// runBoot prints the averaged boot times per backend.
+func (cmd *StatsCmd) runBoot(ctx CommandContext) error {
+	bootTimes, err := internal.GetBootTimes(ctx.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	summaries := internal.SummarizeBootTimes(bootTimes)
+
+	formatMillis := func(millis *int64) string {
+		if millis == nil {
+			return "-"
+		}
+		return (time.Duration(*millis) * time.Millisecond).String()
+	}
+	switch cmd.Format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summaries); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return nil
+	case "csv":
+		formatCSVMillis := func(millis *int64) string {
+			if millis == nil {
+				return ""
+			}
+			return strconv.FormatInt(*millis, 10)
+		}
+		writer := csv.NewWriter(os.Stdout)
+		_ = writer.Write([]string{"backend", "launches", "prepareMillis", "firstPaintMillis", "sessionRestoredMillis"})
+		for _, summary := range summaries {
+			_ = writer.Write([]string{
+				summary.Backend,
+				strconv.Itoa(summary.Launches),
+				strconv.FormatInt(summary.PrepareMillis, 10),
+				formatCSVMillis(summary.FirstPaintMillis),
+				formatCSVMillis(summary.SessionRestoredMillis),
+			})
+		}
+		writer.Flush()
+		return uerror.WithStackTrace(writer.Error())
+	}
+
+	sb := strings.Builder{}
+	writeRow := func(columns ...string) {
+		fmt.Fprintf(&sb, "%-25s  %8s  %10s  %12s  %16s\n", columns[0], columns[1], columns[2], columns[3], columns[4])
+	}
+	writeRow(
+		ctx.Messages.Sprintf("Backend"),
+		ctx.Messages.Sprintf("Launches"),
+		ctx.Messages.Sprintf("Prepare"),
+		ctx.Messages.Sprintf("First paint"),
+		ctx.Messages.Sprintf("Session restored"),
+	)
+	for _, summary := range summaries {
+		prepare := summary.PrepareMillis
+		writeRow(summary.Backend, strconv.Itoa(summary.Launches), formatMillis(&prepare), formatMillis(summary.FirstPaintMillis), formatMillis(summary.SessionRestoredMillis))
+	}
+	fmt.Print(sb.String())
+	return nil
+}
+
+// groupUsageTime adds up the usage per profile or per topic, leaving
+// the other field empty and sorting by the one that is set, or returns
+// it as is for "both".
+func groupUsageTime(usage []internal.UsageTime, by string) []internal.UsageTime {
+	if by == "both" {
+		return usage
+	}
+	grouped := []internal.UsageTime{}
+	indices := map[string]int{}
+	for _, entry := range usage {
+		key := entry.Profile
+		if by == "topic" {
+			key = entry.Topic
+		}
+		i, ok := indices[key]
+		if !ok {
+			i = len(grouped)
+			indices[key] = i
+			grouped = append(grouped, internal.UsageTime{})
+			if by == "topic" {
+				grouped[i].Topic = key
+			} else {
+				grouped[i].Profile = key
+			}
+		}
+		grouped[i].Seconds += entry.Seconds
+	}
+	sort.Slice(grouped, func(i, j int) bool {
+		return grouped[i].Profile+grouped[i].Topic < grouped[j].Profile+grouped[j].Topic
+	})
+	return grouped
+}
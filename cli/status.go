@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type StatusCmd struct {
+	JSON bool   `help:"Print machine-readable statistics" name:"json"`
+	Sort string `default:"label" enum:"label,size,memory,last-used" help:"Sort instances by label, disk usage (largest first), memory usage (largest first) or last use (oldest first)"`
+}
+
+func (cmd *StatusCmd) Run(common CommandContext) error {
+	stats, err := internal.GetInstanceStats(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	switch cmd.Sort {
+	case "size":
+		sort.SliceStable(stats, func(i, j int) bool {
+			return stats[i].DiskUsage > stats[j].DiskUsage
+		})
+	case "memory":
+		sort.SliceStable(stats, func(i, j int) bool {
+			return getMemoryUsage(stats[i]) > getMemoryUsage(stats[j])
+		})
+	case "last-used":
+		sort.SliceStable(stats, func(i, j int) bool {
+			return stats[i].LastUsed.Before(stats[j].LastUsed)
+		})
+	}
+
+	if cmd.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(stats); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return nil
+	}
+
+	sb := strings.Builder{}
+	writeRow := func(columns ...string) {
+		fmt.Fprintf(&sb, "%-15s  %-12s  %-15s  %10s  %10s  %10s  %8s  %-15s  %s\n", columns[0], columns[1], columns[2], columns[3], columns[4], columns[5], columns[6], columns[7], columns[8])
+	}
+	writeRow(
+		common.Messages.Sprintf("Instance"),
+		common.Messages.Sprintf("Profile"),
+		common.Messages.Sprintf("Cur. Topic"),
+		common.Messages.Sprintf("Disk"),
+		common.Messages.Sprintf("Cache"),
+		common.Messages.Sprintf("Memory"),
+		common.Messages.Sprintf("CPU"),
+		common.Messages.Sprintf("Last used"),
+		common.Messages.Sprintf("Uptime"),
+	)
+	var total int64
+	for _, instance := range stats {
+		topic := "<none>"
+		if instance.Topic != nil {
+			topic = *instance.Topic
+		}
+		uptime := "-"
+		if instance.UptimeSeconds != nil {
+			uptime = (time.Duration(*instance.UptimeSeconds) * time.Second).String()
+		}
+		memory, cpu := "-", "-"
+		if instance.MemoryUsage != nil {
+			memory = uio.FormatByteSize(*instance.MemoryUsage)
+		}
+		if instance.CPUSeconds != nil {
+			cpu = (time.Duration(*instance.CPUSeconds) * time.Second).String()
+		}
+		profile := instance.Profile
+		if configured := internal.FindProfileByLabel(common.Config, instance.Profile); configured != nil {
+			profile = internal.GetProfileDisplayName(*configured, common.Messages.Language())
+		}
+		label := instance.Label
+		if instance.Archived {
+			label = common.Messages.Sprintf("%s (archived)", label)
+		}
+		writeRow(label, profile, topic, uio.FormatByteSize(instance.DiskUsage), uio.FormatByteSize(instance.CacheSize), memory, cpu, instance.LastUsed.Local().Format(time.Stamp), uptime)
+		total += instance.DiskUsage
+	}
+	sb.WriteString(common.Messages.Sprintf("%d instances, %s in total\n", len(stats), uio.FormatByteSize(total)))
+	extensionCache, err := internal.GetExtensionCacheStats(common.Config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	sb.WriteString(formatExtensionCacheStats(common, extensionCache) + "\n")
+
+	fmt.Print(sb.String())
+	return nil
+}
+
+// getMemoryUsage returns the memory usage of an instance, which is zero
+// if it isn't running.
+func getMemoryUsage(stats internal.InstanceStats) int64 {
+	if stats.MemoryUsage == nil {
+		return 0
+	}
+	return *stats.MemoryUsage
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type SyncCmd struct {
+	Instances []string `arg:"" completion:"instances" help:"The labels of the instances to sync (default: all)" optional:""`
+}
+
+func (cmd *SyncCmd) Run(common CommandContext) error {
+	instances, err := internal.GetProfileInstances(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if len(cmd.Instances) > 0 {
+		selected := []internal.ProfileInstance{}
+		for _, label := range cmd.Instances {
+			instance, err := internal.GetProfileInstance(common.Config, label)
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			selected = append(selected, instance)
+		}
+		instances = selected
+	}
+
+	for _, instance := range instances {
+		profile := internal.FindProfileByLabel(common.Config, instance.ProfileLabel)
+		if profile == nil || instance.Ephemeral {
+			continue
+		}
+		err := common.Mutations.Apply("Sync instance", instance.InstanceLabel, func() error {
+			return internal.SyncInstance(common.Context, common.Config, *profile, instance, common.ConfigDir)
+		})
+		if errors.Is(err, internal.ErrInstanceInUse) {
+			common.Warnings.Add(instance.InstanceLabel, "%s", common.Messages.Sprintf("Skipping instance in use"))
+			continue
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if !common.Mutations.DryRun {
+			fmt.Println(common.Messages.Sprintf("Synced %s", instance.InstanceLabel))
+		}
+	}
+	return nil
+}
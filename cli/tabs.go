@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type TabsCmd struct {
+	Export TabsExportCmd `cmd:"" help:"Write the tabs of a topic to a Markdown or JSON file, e.g. to hand them to someone else"`
+	List   TabsListCmd   `cmd:"" help:"List the open tabs of all instances, or those open when they were last closed"`
+}
+
+type TabsListCmd struct {
+	JSON  bool     `help:"Print a machine-readable listing" name:"json"`
+	Topic string   `completion:"topics" help:"Only list the tabs of this topic and its subtopics" long:"topic" short:"t"`
+	Query []string `arg:"" help:"Words the title or URL of the tabs must contain" optional:""`
+}
+
+func (cmd *TabsListCmd) Run(common CommandContext) error {
+	tabs, err := internal.GetTabs(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	tabs = internal.FilterTabs(common.Config, tabs, cmd.Topic, strings.Join(cmd.Query, " "))
+
+	if cmd.JSON {
+		return writeTabsJSON(os.Stdout, tabs)
+	}
+
+	for _, tab := range tabs {
+		topic := "<none>"
+		if tab.Topic != nil {
+			topic = *tab.Topic
+		}
+		if !tab.Running {
+			topic = common.Messages.Sprintf("%s (closed)", topic)
+		}
+		fmt.Printf("%-15s  %-12s  %-15s  %s  %s\n", tab.Instance, tab.Profile, topic, tab.Title, tab.URL)
+	}
+	return nil
+}
+
+type TabsExportCmd struct {
+	Format string `default:"markdown" enum:"markdown,json" help:"Write a Markdown list of links or JSON like tabs list --json"`
+	Output string `help:"The file to write the tabs to (default: standard output)" short:"o" type:"path"`
+	Topic  string `arg:"" completion:"topics" help:"The topic whose tabs to export, including its subtopics"`
+}
+
+func (cmd *TabsExportCmd) Run(common CommandContext) error {
+	tabs, err := internal.GetTabs(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	tabs = internal.FilterTabs(common.Config, tabs, cmd.Topic, "")
+	if len(tabs) == 0 {
+		return common.Messages.Errorf("Topic %s has no tabs", cmd.Topic)
+	}
+
+	var output io.Writer = os.Stdout
+	if cmd.Output != "" {
+		file, err := os.Create(cmd.Output)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	if cmd.Format == "json" {
+		err = writeTabsJSON(output, tabs)
+	} else {
+		err = writeTabsMarkdown(output, cmd.Topic, tabs)
+	}
+	if err != nil {
+		if cmd.Output != "" {
+			os.Remove(cmd.Output)
+		}
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+func writeTabsJSON(w io.Writer, tabs []internal.Tab) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return uerror.WithStackTrace(encoder.Encode(tabs))
+}
+
+var (
+	markdownTextEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`, "`", "\\`")
+	markdownURLEscaper  = strings.NewReplacer("(", "%28", ")", "%29", " ", "%20")
+)
+
+// writeTabsMarkdown writes the tabs as a list of links under the topic
+// as a heading.
+func writeTabsMarkdown(w io.Writer, topic string, tabs []internal.Tab) error {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "# %s\n\n", markdownTextEscaper.Replace(topic))
+	for _, tab := range tabs {
+		title := tab.Title
+		if title == "" {
+			title = tab.URL
+		}
+		fmt.Fprintf(&sb, "- [%s](%s)\n", markdownTextEscaper.Replace(title), markdownURLEscaper.Replace(tab.URL))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return uerror.WithStackTrace(err)
+}
@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type TopicsCmd struct {
+	Tree bool `help:"Group hierarchical topics like work/projectX by their levels"`
+}
+
+func (cmd *TopicsCmd) Run(common CommandContext) error {
+	instances, err := internal.GetProfileInstances(common.Config, common.Warnings)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	topics, err := internal.GetRankedTopics(common.Config, instances)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if cmd.Tree {
+		printTopicTree(internal.GroupTopics(topics), 0)
+		return nil
+	}
+	for _, topic := range topics {
+		fmt.Println(topic)
+	}
+	return nil
+}
+
+func printTopicTree(nodes []internal.TopicNode, depth int) {
+	for _, node := range nodes {
+		name := node.Name
+		if len(node.Children) > 0 {
+			name += "/"
+		}
+		fmt.Println(strings.Repeat("  ", depth) + name)
+		printTopicTree(node.Children, depth+1)
+	}
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"errors"
+	"time"
+
+	"t0ast.cc/tbml/api"
+	"t0ast.cc/tbml/gui"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+type UICmd struct {
+	MaxAge   time.Duration `help:"Let pruning delete instances that haven't been used for this long (e.g. 720h)"`
+	MaxCount int           `help:"Let pruning keep at most this many instances per profile, deleting the least recently used ones"`
+	MaxSize  string        `help:"Let pruning delete the least recently used instances until all instances together take up at most this much space (e.g. 10G)"`
+	Where    string        `help:"Let pruning delete instances that match a filter expression (e.g. 'age > 30d && !pinned'), instead of those that match PruneWhere"`
+}
+
+func (cmd *UICmd) Run(common CommandContext) error {
+	launcher, err := api.New(common.Config, common.ConfigDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// The console says what it would have done, so the mutations
+	// aren't printed over it.
+	launcher.DryRun = common.Mutations.DryRun
+
+	where, err := getPruneFilter(common, cmd.Where)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	// Like tbml clean, but without limits there is nothing to prune.
+	var prunePolicy *api.CleanPolicy
+	if cmd.MaxAge > 0 || cmd.MaxCount > 0 || cmd.MaxSize != "" || where != nil {
+		prunePolicy = &api.CleanPolicy{Where: where}
+	}
+	if cmd.MaxAge > 0 {
+		prunePolicy.MaxAge = &cmd.MaxAge
+	}
+	if cmd.MaxCount > 0 {
+		prunePolicy.MaxInstancesPerProfile = &cmd.MaxCount
+	}
+	if cmd.MaxSize != "" {
+		maxSize, err := uio.ParseByteSize(cmd.MaxSize)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		prunePolicy.MaxTotalSize = &maxSize
+	}
+
+	err = gui.RunConsole(common.Context, launcher, prunePolicy)
+	if errors.Is(err, gui.ErrNoTerminal) {
+		return common.Messages.Errorf("tbml ui needs a terminal")
+	}
+	return err
+}
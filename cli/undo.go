@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type UndoCmd struct {
+	List        bool   `help:"List the operations that can be undone, most recent first, instead of undoing one"`
+	OnCollision string `default:"fail" enum:"fail,suffix,replace" help:"What to do if a deleted instance's label was taken since: fail, add a suffix to the label or replace the other instance if it isn't in use"`
+}
+
+func (cmd *UndoCmd) Run(common CommandContext) error {
+	if cmd.List {
+		operations, err := internal.GetOperationLog(common.Config)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		for i := len(operations) - 1; i >= 0; i-- {
+			fmt.Printf("%s  %s\n", operations[i].Time.Format("2006-01-02 15:04:05"), operations[i])
+		}
+		return nil
+	}
+
+	operation, restoredLabel, err := internal.UndoLastOperation(common.Config, internal.CollisionPolicy(cmd.OnCollision), common.Mutations)
+	if errors.Is(err, internal.ErrNothingToUndo) {
+		return common.Messages.Errorf("Nothing to undo")
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !common.Mutations.DryRun {
+		fmt.Println(common.Messages.Sprintf("Undid: %s", operation))
+		if restoredLabel != "" && restoredLabel != operation.Target {
+			fmt.Println(common.Messages.Sprintf("Restored instance as %s", restoredLabel))
+		}
+	}
+	return nil
+}
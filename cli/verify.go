@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type VerifyCmd struct {
+	Instance string `arg:"" completion:"instances" help:"The label of the instance to verify"`
+}
+
+func (cmd *VerifyCmd) Run(common CommandContext) error {
+	instance, err := internal.GetProfileInstance(common.Config, cmd.Instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	profile := internal.FindProfileByLabel(common.Config, instance.ProfileLabel)
+	if profile == nil {
+		return common.Messages.Errorf("Profile %s of instance %s does not exist", instance.ProfileLabel, instance.InstanceLabel)
+	}
+
+	prefWarnings, err := internal.LintInstancePrefs(common.Config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, warning := range prefWarnings {
+		common.Warnings.Add(instance.InstanceLabel, "%s", warning)
+	}
+
+	return internal.VerifyInstance(common.Config, *profile, instance)
+}
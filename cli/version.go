@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+type VersionCmd struct {
+	JSON bool `help:"Print machine-readable build information" name:"json"`
+}
+
+func (cmd *VersionCmd) Run(common CommandContext) error {
+	info := internal.BuildInfo()
+	if cmd.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(info); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return nil
+	}
+
+	commit := info.Commit
+	if info.Modified {
+		commit = common.Messages.Sprintf("%s (modified)", commit)
+	}
+	buildTags := strings.Join(info.BuildTags, ", ")
+	if buildTags == "" {
+		buildTags = "-"
+	}
+	fmt.Println("tbml", info.Version)
+	fmt.Println(common.Messages.Sprintf("Commit: %s", commit))
+	fmt.Println(common.Messages.Sprintf("Built with: %s", info.GoVersion))
+	fmt.Println(common.Messages.Sprintf("Build tags: %s", buildTags))
+	fmt.Println(common.Messages.Sprintf("Sandboxes: %s", strings.Join(info.Sandboxes, ", ")))
+	fmt.Println(common.Messages.Sprintf("Clone strategies: %s", strings.Join(info.CloneStrategies, ", ")))
+	fmt.Println(common.Messages.Sprintf("Instance metadata schema: %d", info.SchemaVersions["instanceMetadata"]))
+	fmt.Println(common.Messages.Sprintf("Profile bundle format: %d", info.SchemaVersions["profileBundle"]))
+	return nil
+}
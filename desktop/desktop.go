@@ -0,0 +1,442 @@
+// Package desktop generates XDG desktop entries for tbml's profiles
+// and topics, so they show up in application launchers and tbml can be
+// chosen as the handler for web links.
+package desktop
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"t0ast.cc/tbml/internal"
+	uerror "t0ast.cc/tbml/util/error"
+	"t0ast.cc/tbml/util/i18n"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const (
+	// HandlerFileName is the entry that opens links according to the
+	// configured routes.
+	HandlerFileName = "tbml.desktop"
+
+	entryFilePrefix = "tbml"
+	// generatedKey marks entries written by tbml, so entries the user
+	// made themselves are never deleted.
+	generatedKey = "X-TBML-Generated"
+)
+
+var urlMimeTypes = []string{"x-scheme-handler/http", "x-scheme-handler/https"}
+
+// messages holds the translations of the generated names and comments,
+// keyed by the English format string. Entries get a localized Name and
+// Comment for every language in here.
+var messages = i18n.Catalog{
+	"de": {
+		"Open links in the profile chosen by the routes": "Links in dem Profil öffnen, das die Routen wählen",
+		"Open links in the %s profile":                   "Links im Profil %s öffnen",
+		"Open links in topic %s":                         "Links im Thema %s öffnen",
+	},
+}
+
+// Entry is a desktop entry that launches tbml.
+type Entry struct {
+	// Args are passed to tbml, followed by the URL to open, if any.
+	Args []string
+	// BuiltinIcon is the name of the bundled icon used if there is no
+	// IconFile, see internal.ReadBuiltinAsset.
+	BuiltinIcon string
+	Comment     string
+	// Comments are the localized comments by language code.
+	Comments map[string]string
+	// FileName is the name of the .desktop file, which is also the
+	// entry's ID.
+	FileName string
+	// IconFile, if set, is copied along with the entry and used as
+	// its icon.
+	IconFile string
+	Name     string
+	// Names are the localized names by language code.
+	Names map[string]string
+}
+
+// localize sets the entry's name and comment in English and every
+// language of the catalog and of the given names. format and args make
+// the name, unless names has one for the language.
+func (e *Entry) localize(names map[string]string, format string, comment string, args ...interface{}) {
+	languages := map[string]bool{}
+	for language := range messages {
+		languages[language] = true
+	}
+	for language := range names {
+		languages[language] = true
+	}
+	name := func(msgs *i18n.Printer) string {
+		if name, ok := names[msgs.Language()]; ok {
+			return name
+		}
+		if name, ok := names["en"]; ok {
+			return name
+		}
+		return msgs.Sprintf(format, args...)
+	}
+	english := i18n.NewPrinter(messages, "en")
+	e.Name = name(english)
+	e.Comment = english.Sprintf(comment, args...)
+	e.Comments = map[string]string{}
+	e.Names = map[string]string{}
+	for language := range languages {
+		if language == "en" {
+			continue
+		}
+		msgs := i18n.NewPrinter(messages, language)
+		if localized := name(msgs); localized != e.Name {
+			e.Names[language] = localized
+		}
+		if localized := msgs.Sprintf(comment, args...); localized != e.Comment {
+			e.Comments[language] = localized
+		}
+	}
+}
+
+// GenerateEntries describes the entries for a configuration: one
+// opening links by the configured routes, one per profile and, if
+// topics are given, one per topic. Relative icon paths are resolved
+// against configDir. Entries without a configured icon get a bundled
+// one.
+func GenerateEntries(config internal.Configuration, configDir string, configFile string, topics []string) []Entry {
+	configArgs := []string{}
+	if configFile != "" {
+		configArgs = []string{"--config", configFile}
+	}
+	handler := Entry{
+		Args:        append(append([]string{}, configArgs...), "open"),
+		BuiltinIcon: internal.DefaultHandlerIcon,
+		FileName:    HandlerFileName,
+	}
+	handler.localize(map[string]string{"en": "tbml"}, "", "Open links in the profile chosen by the routes")
+	entries := []Entry{handler}
+	for _, profile := range config.Profiles {
+		entry := Entry{
+			Args:     append(append([]string{}, configArgs...), "open", "--profile", profile.Label),
+			FileName: fmt.Sprintf("%s-profile-%s.desktop", entryFilePrefix, escapeFileName(profile.Label)),
+		}
+		names := profile.Names
+		if _, ok := names["en"]; !ok && profile.DisplayName != nil {
+			names = map[string]string{"en": *profile.DisplayName}
+			for language, name := range profile.Names {
+				names[language] = name
+			}
+		}
+		entry.localize(names, "tbml (%s)", "Open links in the %s profile", profile.Label)
+		if profile.Description != nil {
+			entry.Comment = *profile.Description
+			entry.Comments = nil
+		}
+		entry.setIcon(internal.GetIconFile(config, configDir, profile, ""), internal.DefaultProfileIcon)
+		entries = append(entries, entry)
+	}
+	for _, topic := range topics {
+		entry := Entry{
+			Args:     append(append([]string{}, configArgs...), "open", "--topic", topic),
+			FileName: fmt.Sprintf("%s-topic-%s.desktop", entryFilePrefix, escapeFileName(topic)),
+		}
+		entry.localize(nil, "tbml: %s", "Open links in topic %s", topic)
+		entry.setIcon(internal.GetIconFile(config, configDir, internal.ProfileConfiguration{}, topic), internal.DefaultTopicIcon)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// setIcon sets the entry's icon to the icon file, which may refer to a
+// bundled icon, or to the bundled defaultIcon if iconFile is empty.
+func (e *Entry) setIcon(iconFile string, defaultIcon string) {
+	if assetName, ok := internal.ParseBuiltinReference(iconFile); ok {
+		e.BuiltinIcon = assetName
+	} else if iconFile != "" {
+		e.IconFile = iconFile
+	} else {
+		e.BuiltinIcon = defaultIcon
+	}
+}
+
+// escapeFileName makes a label usable in a desktop file ID, which may
+// only contain letters, digits, "-", "_" and ".". Other bytes and "_"
+// itself are hex-encoded after a "_", so different labels never end up
+// with the same ID.
+func escapeFileName(label string) string {
+	sb := &strings.Builder{}
+	for _, b := range []byte(label) {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(sb, "_%02x", b)
+		}
+	}
+	return sb.String()
+}
+
+// entryTemplate renders .desktop files. It is bundled with the other
+// assets, see internal.ReadBuiltinAsset.
+var entryTemplate = func() *template.Template {
+	content, err := internal.ReadBuiltinAsset("desktop-entry")
+	if err != nil {
+		panic(err)
+	}
+	return template.Must(template.New("desktop-entry").Parse(string(content)))
+}()
+
+// localizedValue is a value of a localestring key for one language.
+type localizedValue struct {
+	Language string
+	Value    string
+}
+
+// RenderEntry returns the contents of an entry's .desktop file.
+// executable is the path of the tbml binary and iconPath the
+// installed icon, if any.
+func RenderEntry(entry Entry, executable string, iconPath string) string {
+	execArgs := []string{}
+	for _, arg := range append([]string{executable}, entry.Args...) {
+		execArgs = append(execArgs, quoteExecArg(arg))
+	}
+	execArgs = append(execArgs, "%u")
+
+	sb := &strings.Builder{}
+	// The template is bundled and only gets strings, so it can't fail.
+	_ = entryTemplate.Execute(sb, map[string]interface{}{
+		"Comment":      escapeValue(entry.Comment),
+		"Comments":     getLocalizedValues(entry.Comments),
+		"Exec":         escapeValue(strings.Join(execArgs, " ")),
+		"GeneratedKey": generatedKey,
+		"Icon":         escapeValue(iconPath),
+		"MimeTypes":    strings.Join(urlMimeTypes, ";"),
+		"Name":         escapeValue(entry.Name),
+		"Names":        getLocalizedValues(entry.Names),
+	})
+	return sb.String()
+}
+
+// getLocalizedValues returns the escaped values of a localestring key,
+// sorted by language.
+func getLocalizedValues(values map[string]string) []localizedValue {
+	localized := []localizedValue{}
+	for language, value := range values {
+		localized = append(localized, localizedValue{Language: language, Value: escapeValue(value)})
+	}
+	sort.Slice(localized, func(i, j int) bool {
+		return localized[i].Language < localized[j].Language
+	})
+	return localized
+}
+
+// quoteExecArg quotes an argument of the Exec key as the Desktop Entry
+// Specification requires. Field codes are escaped, so the argument is
+// passed literally.
+func quoteExecArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`=") {
+		return arg
+	}
+	sb := &strings.Builder{}
+	sb.WriteByte('"')
+	for _, r := range arg {
+		if strings.ContainsRune("\"`$\\", r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// escapeValue escapes a value of type string or localestring.
+func escapeValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\t", "\\t", "\r", "\\r").Replace(value)
+}
+
+// GetDataHome returns $XDG_DATA_HOME, which defaults to
+// ~/.local/share.
+func GetDataHome() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dataHome) {
+		return dataHome, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return filepath.Join(home, ".local/share"), nil
+}
+
+func getIconsDir(dataHome string) string {
+	return filepath.Join(dataHome, "tbml", "icons")
+}
+
+// Install writes the entries to dataHome/applications and deletes the
+// entries tbml created before that aren't among them anymore, so the
+// installed entries match the configuration. Icons are copied to
+// dataHome/tbml/icons.
+func Install(dataHome string, entries []Entry, executable string, mutations *internal.Mutations) error {
+	applicationsDir := filepath.Join(dataHome, "applications")
+	iconsDir := getIconsDir(dataHome)
+
+	wanted := map[string]bool{}
+	wantedIcons := map[string]bool{}
+	for _, entry := range entries {
+		iconPath := ""
+		if entry.IconFile != "" {
+			iconName := strings.TrimSuffix(entry.FileName, ".desktop") + filepath.Ext(entry.IconFile)
+			iconPath = filepath.Join(iconsDir, iconName)
+			wantedIcons[iconName] = true
+			if err := mutations.Apply("Copy icon to", iconPath, func() error {
+				if err := os.MkdirAll(iconsDir, uio.FileModeURWXGRWXO); err != nil {
+					return err
+				}
+				return uio.CopyFile(entry.IconFile, iconPath)
+			}); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+		} else if entry.BuiltinIcon != "" {
+			iconName := strings.TrimSuffix(entry.FileName, ".desktop") + internal.GetBuiltinAssetExt(entry.BuiltinIcon)
+			iconPath = filepath.Join(iconsDir, iconName)
+			wantedIcons[iconName] = true
+			content, err := internal.ReadBuiltinAsset(entry.BuiltinIcon)
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			if err := mutations.Apply("Write icon", iconPath, func() error {
+				if err := os.MkdirAll(iconsDir, uio.FileModeURWXGRWXO); err != nil {
+					return err
+				}
+				return uio.WriteFileAtomic(iconPath, content, uio.FileModeURWGRWO)
+			}); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+		}
+
+		entryPath := filepath.Join(applicationsDir, entry.FileName)
+		wanted[entry.FileName] = true
+		content := RenderEntry(entry, executable, iconPath)
+		if err := mutations.Apply("Write desktop entry", entryPath, func() error {
+			if err := os.MkdirAll(applicationsDir, uio.FileModeURWXGRWXO); err != nil {
+				return err
+			}
+			return uio.WriteFileAtomic(entryPath, []byte(content), uio.FileModeURWGRWO)
+		}); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	generated, err := findGeneratedEntries(applicationsDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, fileName := range generated {
+		if wanted[fileName] {
+			continue
+		}
+		entryPath := filepath.Join(applicationsDir, fileName)
+		if err := mutations.Apply("Delete desktop entry", entryPath, func() error {
+			return os.Remove(entryPath)
+		}); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	icons, err := os.ReadDir(iconsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return uerror.WithStackTrace(err)
+	}
+	for _, icon := range icons {
+		if wantedIcons[icon.Name()] {
+			continue
+		}
+		iconPath := filepath.Join(iconsDir, icon.Name())
+		if err := mutations.Apply("Delete icon", iconPath, func() error {
+			return os.Remove(iconPath)
+		}); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
+
+// Uninstall deletes all entries and icons tbml created.
+func Uninstall(dataHome string, mutations *internal.Mutations) error {
+	if err := Install(dataHome, nil, "", mutations); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	iconsDir := getIconsDir(dataHome)
+	exists, err := uio.DirExists(iconsDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !exists {
+		return nil
+	}
+	return mutations.Apply("Delete", iconsDir, func() error {
+		return os.Remove(iconsDir)
+	})
+}
+
+// findGeneratedEntries lists the file names of the entries in dir that
+// tbml created.
+func findGeneratedEntries(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	generated := []string{}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !dirEntry.Type().IsRegular() || !strings.HasPrefix(name, entryFilePrefix) || !strings.HasSuffix(name, ".desktop") {
+			continue
+		}
+		isGenerated, err := isGeneratedEntry(filepath.Join(dir, name))
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if isGenerated {
+			generated = append(generated, name)
+		}
+	}
+	sort.Strings(generated)
+	return generated, nil
+}
+
+func isGeneratedEntry(name string) (bool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == generatedKey+"=true" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// SetDefaultHandler makes the routing entry the default handler for
+// http and https links with xdg-mime.
+func SetDefaultHandler(ctx context.Context, mutations *internal.Mutations) error {
+	return mutations.Apply("Set default URL handler to", HandlerFileName, func() error {
+		args := append([]string{"default", HandlerFileName}, urlMimeTypes...)
+		if out, err := exec.CommandContext(ctx, "xdg-mime", args...).CombinedOutput(); err != nil {
+			return uerror.StackTracef("xdg-mime failed: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+}
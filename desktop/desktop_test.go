@@ -0,0 +1,199 @@
+package desktop
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"t0ast.cc/tbml/internal"
+)
+
+func TestQuoteExecArg(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		arg      string
+		expected string
+	}{
+		{
+			desc: "Plain argument",
+
+			arg:      "--profile",
+			expected: "--profile",
+		},
+		{
+			desc: "Space",
+
+			arg:      "my profile",
+			expected: `"my profile"`,
+		},
+		{
+			desc: "Field code",
+
+			arg:      "50%u",
+			expected: "50%%u",
+		},
+		{
+			desc: "Reserved characters",
+
+			arg:      `a"b$c\d`,
+			expected: `"a\"b\$c\\d"`,
+		},
+		{
+			desc: "Empty argument",
+
+			arg:      "",
+			expected: `""`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, quoteExecArg(tc.arg))
+		})
+	}
+}
+
+func TestEscapeFileName(t *testing.T) {
+	assert.Equal(t, "work-1", escapeFileName("work-1"))
+	assert.Equal(t, "my_20profile", escapeFileName("my profile"))
+	assert.NotEqual(t, escapeFileName("a b"), escapeFileName("a_20b"))
+}
+
+func TestRenderEntry(t *testing.T) {
+	entry := Entry{
+		Args:     []string{"open", "--profile", "my profile"},
+		FileName: "tbml-profile-my_20profile.desktop",
+		Name:     "tbml (my profile)",
+	}
+	expected := `[Desktop Entry]
+Type=Application
+Name=tbml (my profile)
+Exec=/usr/bin/tbml open --profile "my profile" %u
+Icon=/icons/my.png
+Terminal=false
+Categories=Network;WebBrowser;
+MimeType=x-scheme-handler/http;x-scheme-handler/https;
+X-TBML-Generated=true
+`
+	assert.Equal(t, expected, RenderEntry(entry, "/usr/bin/tbml", "/icons/my.png"))
+}
+
+func TestGenerateEntriesLocalized(t *testing.T) {
+	config := internal.Configuration{
+		Profiles: []internal.ProfileConfiguration{{
+			Label: "banking",
+			Names: map[string]string{"de": "Banking (isoliert)", "en": "Banking (isolated)"},
+		}},
+	}
+	entries := GenerateEntries(config, "", "", []string{"news"})
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, "Banking (isolated)", entries[1].Name)
+	assert.Equal(t, map[string]string{"de": "Banking (isoliert)"}, entries[1].Names)
+	assert.Equal(t, "Open links in the banking profile", entries[1].Comment)
+	assert.Equal(t, map[string]string{"de": "Links im Profil banking öffnen"}, entries[1].Comments)
+	assert.Contains(t, RenderEntry(entries[1], "/usr/bin/tbml", ""), `Name=Banking (isolated)
+Name[de]=Banking (isoliert)
+Comment=Open links in the banking profile
+Comment[de]=Links im Profil banking öffnen
+`)
+
+	assert.Equal(t, "tbml: news", entries[2].Name)
+	assert.Empty(t, entries[2].Names)
+}
+
+func TestGenerateEntriesDisplayName(t *testing.T) {
+	displayName, description := "Banking", "Only for the bank"
+	config := internal.Configuration{
+		Profiles: []internal.ProfileConfiguration{{
+			Description: &description,
+			DisplayName: &displayName,
+			Label:       "banking",
+			Names:       map[string]string{"de": "Banking (isoliert)"},
+		}},
+	}
+	entries := GenerateEntries(config, "", "", nil)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "Banking", entries[1].Name)
+	assert.Equal(t, map[string]string{"de": "Banking (isoliert)"}, entries[1].Names)
+	assert.Equal(t, "Only for the bank", entries[1].Comment)
+	assert.Empty(t, entries[1].Comments)
+}
+
+func TestGenerateEntriesIcons(t *testing.T) {
+	profileIcon, topicIcon := "work.png", "/icons/news.png"
+	config := internal.Configuration{
+		Profiles: []internal.ProfileConfiguration{{Icon: &profileIcon, Label: "work"}},
+		Topics:   []internal.TopicConfiguration{{Icon: &topicIcon, Topic: "news"}},
+	}
+	entries := GenerateEntries(config, "/etc/tbml", "", []string{"news/local", "sports"})
+	require.Len(t, entries, 4)
+	assert.Equal(t, internal.DefaultHandlerIcon, entries[0].BuiltinIcon)
+	assert.Equal(t, "/etc/tbml/work.png", entries[1].IconFile)
+	assert.Equal(t, "/icons/news.png", entries[2].IconFile)
+	assert.Equal(t, "", entries[3].IconFile)
+	assert.Equal(t, internal.DefaultTopicIcon, entries[3].BuiltinIcon)
+}
+
+func TestInstall(t *testing.T) {
+	configDir := t.TempDir()
+	dataHome := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(configDir, "work.png"), []byte("png"), 0o644))
+
+	icon := "work.png"
+	config := internal.Configuration{
+		Profiles: []internal.ProfileConfiguration{
+			{Icon: &icon, Label: "work"},
+			{Label: "old"},
+		},
+	}
+	applicationsDir := filepath.Join(dataHome, "applications")
+	require.NoError(t, os.MkdirAll(applicationsDir, 0o755))
+	userEntry := filepath.Join(applicationsDir, "tbml-custom.desktop")
+	require.NoError(t, os.WriteFile(userEntry, []byte("[Desktop Entry]\n"), 0o644))
+
+	entries := GenerateEntries(config, configDir, "/etc/tbml/config.json", []string{"news"})
+	require.NoError(t, Install(dataHome, entries, "/usr/bin/tbml", nil))
+	assert.Equal(t, []string{
+		"tbml-custom.desktop",
+		"tbml-profile-old.desktop",
+		"tbml-profile-work.desktop",
+		"tbml-topic-news.desktop",
+		"tbml.desktop",
+	}, listDir(t, applicationsDir))
+	// Entries without an icon get a bundled one.
+	assert.Equal(t, []string{
+		"tbml-profile-old.svg",
+		"tbml-profile-work.png",
+		"tbml-topic-news.svg",
+		"tbml.svg",
+	}, listDir(t, getIconsDir(dataHome)))
+
+	// Removing a profile and the topics deletes their entries.
+	config.Profiles = config.Profiles[:1]
+	entries = GenerateEntries(config, configDir, "/etc/tbml/config.json", nil)
+	require.NoError(t, Install(dataHome, entries, "/usr/bin/tbml", nil))
+	assert.Equal(t, []string{
+		"tbml-custom.desktop",
+		"tbml-profile-work.desktop",
+		"tbml.desktop",
+	}, listDir(t, applicationsDir))
+
+	require.NoError(t, Uninstall(dataHome, nil))
+	assert.Equal(t, []string{"tbml-custom.desktop"}, listDir(t, applicationsDir))
+	assert.NoDirExists(t, getIconsDir(dataHome))
+}
+
+func listDir(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
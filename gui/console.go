@@ -0,0 +1,817 @@
+package gui
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"t0ast.cc/tbml/api"
+	uerror "t0ast.cc/tbml/util/error"
+	"t0ast.cc/tbml/util/i18n"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// consoleMessages holds the translations of the console, keyed by the
+// English format string.
+var consoleMessages = i18n.Catalog{
+	"de": {
+		"%d profiles, %d instances": "%d Profile, %d Instanzen",
+		"%d running":                "%d laufen",
+		"Attached":                  "Angehängt",
+		"Archived":                  "Archiviert",
+		"Closing %d browsers launched from here…": "Schließe %d von hier gestartete Browser…",
+		"Delete instance %s? [y/N]":               "Instanz %s löschen? [j/N]",
+		"Deleted %s, \"tbml undo\" restores it":   "%s gelöscht, \"tbml undo\" stellt sie wieder her",
+		"Idle":                                    "Frei",
+		"l launch  s stop  d delete  p pin  x prune  r refresh  q quit": "l starten  s beenden  d löschen  p anheften  x aufräumen  r aktualisieren  q verlassen",
+		"Last used":                          "Zuletzt benutzt",
+		"Launching %s…":                      "Starte %s…",
+		"Measuring the instances to prune…":  "Ermittle die aufzuräumenden Instanzen…",
+		"No prune policy was given":          "Es wurden keine Regeln zum Aufräumen angegeben",
+		"Nothing to prune":                   "Nichts aufzuräumen",
+		"Pin":                                "Fix",
+		"Pinned %s":                          "%s angeheftet",
+		"Profile / instance":                 "Profil / Instanz",
+		"Prune %d instances (%s): %s? [y/N]": "%d Instanzen aufräumen (%s): %s? [j/N]",
+		"Pruned %d instances, %s in total":   "%d Instanzen aufgeräumt, insgesamt %s",
+		"Would prune %d instances (%s)":      "Würde %d Instanzen aufräumen (%s)",
+		"Quitting closes %d browsers launched from here. Quit? [y/N]": "Beim Verlassen werden %d von hier gestartete Browser geschlossen. Verlassen? [j/N]",
+		"The instances to prune changed, check them again":            "Die aufzuräumenden Instanzen haben sich geändert, prüfe sie erneut",
+		"Reserved":                      "Reserviert",
+		"Running":                       "Läuft",
+		"Select an instance first":      "Wähle zuerst eine Instanz aus",
+		"Size":                          "Größe",
+		"Starting":                      "Startet",
+		"Status":                        "Status",
+		"Stopped %s":                    "%s beendet",
+		"Stopping":                      "Wird beendet",
+		"The browser of %s exited":      "Der Browser von %s wurde beendet",
+		"The browser of %s exited (%d)": "Der Browser von %s wurde beendet (%d)",
+		"Topic":                         "Thema",
+		"Topic for %s: ":                "Thema für %s: ",
+		"Unpinned %s":                   "%s gelöst",
+		"Would delete %s":               "Würde %s löschen",
+		"Would launch %s":               "Würde %s starten",
+		"Would pin %s":                  "Würde %s anheften",
+		"Would stop %s":                 "Würde %s beenden",
+		"Would unpin %s":                "Würde %s lösen",
+		"y":                             "j",
+	},
+}
+
+const (
+	// consoleRefreshInterval is how often the console reads the
+	// instances again, so launches from elsewhere show up.
+	consoleRefreshInterval = 2 * time.Second
+	// consoleMeasureInterval is how often the console measures the
+	// disk usage of the instances, which takes longer.
+	consoleMeasureInterval = 30 * time.Second
+)
+
+type consoleActionKind int
+
+const (
+	consoleLaunch consoleActionKind = iota
+	consoleStop
+	consoleDelete
+	consolePin
+	consoleUnpin
+	consolePreviewPrune
+	consolePrune
+	consoleRefresh
+	consoleQuit
+)
+
+// consoleAction is an operation the user asked for in the console.
+type consoleAction struct {
+	Kind     consoleActionKind
+	Instance string
+	// Instances are the instances the user agreed to prune.
+	Instances []string
+	Profile   string
+	Topic     string
+}
+
+// consoleRow is a line of the console: a profile, or one of its
+// instances if instance is set.
+type consoleRow struct {
+	profile  string
+	instance *api.ProfileInstance
+}
+
+// console is the state of RunConsole, kept apart from the terminal so
+// it can be tested.
+type console struct {
+	msgs *i18n.Printer
+	// profiles are the labels of the configured profiles, in the
+	// order they are configured.
+	profiles  []string
+	instances []api.ProfileInstance
+	sizes     map[string]int64
+	rows      []consoleRow
+	selected  int
+	// busy tells what the console is doing with an instance, e.g.
+	// stopping it.
+	busy map[string]string
+	// launches is how many browsers launched from the console are
+	// still running.
+	launches int
+	// topic is the topic being entered for a launch, nil unless the
+	// user is entering one.
+	topic []rune
+	// launchProfile is the profile the entered topic is launched in.
+	launchProfile string
+	// confirm is the action that waits for the user to answer
+	// confirmPrompt.
+	confirm       *consoleAction
+	confirmPrompt string
+	status        string
+}
+
+func newConsole(profiles []string, msgs *i18n.Printer) *console {
+	c := &console{
+		msgs:     msgs,
+		profiles: profiles,
+		sizes:    map[string]int64{},
+		busy:     map[string]string{},
+	}
+	c.buildRows()
+	return c
+}
+
+// update shows the instances as they are now. The selection stays on
+// the same profile or instance if it still exists.
+func (c *console) update(instances []api.ProfileInstance) {
+	selectedProfile, selectedInstance := "", ""
+	if row := c.selectedRow(); row != nil {
+		selectedProfile = row.profile
+		if row.instance != nil {
+			selectedInstance = row.instance.InstanceLabel
+		}
+	}
+	c.instances = instances
+	c.buildRows()
+	for i, row := range c.rows {
+		if row.profile != selectedProfile {
+			continue
+		}
+		c.selected = i
+		if (row.instance == nil && selectedInstance == "") || (row.instance != nil && row.instance.InstanceLabel == selectedInstance) {
+			break
+		}
+	}
+	if c.selected >= len(c.rows) {
+		c.selected = len(c.rows) - 1
+	}
+	if c.selected < 0 {
+		c.selected = 0
+	}
+}
+
+func (c *console) setSizes(stats []api.InstanceStats) {
+	c.sizes = map[string]int64{}
+	for _, instanceStats := range stats {
+		c.sizes[instanceStats.Label] = instanceStats.DiskUsage
+	}
+}
+
+// buildRows lists the configured profiles followed by the profiles
+// that are no longer configured but still have instances, each with
+// its instances sorted by label.
+func (c *console) buildRows() {
+	perProfile := map[string][]api.ProfileInstance{}
+	for _, instance := range c.instances {
+		perProfile[instance.ProfileLabel] = append(perProfile[instance.ProfileLabel], instance)
+	}
+	profiles := append([]string{}, c.profiles...)
+	unconfigured := []string{}
+	for profile := range perProfile {
+		configured := false
+		for _, label := range c.profiles {
+			configured = configured || label == profile
+		}
+		if !configured {
+			unconfigured = append(unconfigured, profile)
+		}
+	}
+	sort.Strings(unconfigured)
+	profiles = append(profiles, unconfigured...)
+
+	c.rows = []consoleRow{}
+	for _, profile := range profiles {
+		c.rows = append(c.rows, consoleRow{profile: profile})
+		instances := perProfile[profile]
+		sort.Slice(instances, func(i, j int) bool {
+			return instances[i].InstanceLabel < instances[j].InstanceLabel
+		})
+		for i := range instances {
+			c.rows = append(c.rows, consoleRow{profile: profile, instance: &instances[i]})
+		}
+	}
+}
+
+func (c *console) selectedRow() *consoleRow {
+	if c.selected < 0 || c.selected >= len(c.rows) {
+		return nil
+	}
+	return &c.rows[c.selected]
+}
+
+// selectedInstance returns the selected instance, or nil with a hint
+// in the status line if a profile is selected.
+func (c *console) selectedInstance() *api.ProfileInstance {
+	row := c.selectedRow()
+	if row == nil || row.instance == nil {
+		c.status = c.msgs.Sprintf("Select an instance first")
+		return nil
+	}
+	return row.instance
+}
+
+func (c *console) askConfirmation(action consoleAction, prompt string) {
+	c.confirm = &action
+	c.confirmPrompt = prompt
+}
+
+// handleKey applies a key press and returns the action the user asked
+// for, if any. Deleting, pruning and quitting while browsers launched
+// from the console run have to be confirmed first.
+func (c *console) handleKey(key string) *consoleAction {
+	if c.confirm != nil {
+		action := c.confirm
+		c.confirm = nil
+		if answer := strings.ToLower(key); answer == "y" || answer == c.msgs.Sprintf("y") {
+			return action
+		}
+		return nil
+	}
+	if c.topic != nil {
+		return c.handleTopicKey(key)
+	}
+
+	c.status = ""
+	switch key {
+	case "\x1b[A", "\x10", "k":
+		if c.selected > 0 {
+			c.selected--
+		}
+	case "\x1b[B", "\x0e", "j":
+		if c.selected < len(c.rows)-1 {
+			c.selected++
+		}
+	case "l", "\r", "\n":
+		row := c.selectedRow()
+		if row == nil {
+			break
+		}
+		// The topic of the selected instance is suggested, so it can be
+		// opened again with enter.
+		c.launchProfile = row.profile
+		c.topic = []rune{}
+		if row.instance != nil {
+			c.topic = []rune(getConsoleTopic(*row.instance))
+		}
+	case "s":
+		if instance := c.selectedInstance(); instance != nil {
+			return &consoleAction{Kind: consoleStop, Instance: instance.InstanceLabel}
+		}
+	case "d":
+		if instance := c.selectedInstance(); instance != nil {
+			c.askConfirmation(consoleAction{Kind: consoleDelete, Instance: instance.InstanceLabel}, c.msgs.Sprintf("Delete instance %s? [y/N]", instance.InstanceLabel))
+		}
+	case "p":
+		if instance := c.selectedInstance(); instance != nil {
+			kind := consolePin
+			if instance.Pinned {
+				kind = consoleUnpin
+			}
+			return &consoleAction{Kind: kind, Instance: instance.InstanceLabel}
+		}
+	case "x":
+		return &consoleAction{Kind: consolePreviewPrune}
+	case "r":
+		return &consoleAction{Kind: consoleRefresh}
+	case "q", "\x1b", "\x03", "\x04":
+		if c.launches > 0 {
+			c.askConfirmation(consoleAction{Kind: consoleQuit}, c.msgs.Sprintf("Quitting closes %d browsers launched from here. Quit? [y/N]", c.launches))
+			break
+		}
+		return &consoleAction{Kind: consoleQuit}
+	}
+	return nil
+}
+
+func (c *console) handleTopicKey(key string) *consoleAction {
+	switch key {
+	case "\r", "\n":
+		action := &consoleAction{Kind: consoleLaunch, Profile: c.launchProfile, Topic: string(c.topic)}
+		c.topic = nil
+		return action
+	case "\x1b", "\x03", "\x04":
+		c.topic = nil
+	case "\x7f", "\b":
+		if len(c.topic) > 0 {
+			c.topic = c.topic[:len(c.topic)-1]
+		}
+	case "\x15":
+		c.topic = []rune{}
+	default:
+		runes := []rune(key)
+		if len(runes) == 1 && runes[0] >= ' ' {
+			c.topic = append(c.topic, runes[0])
+		}
+	}
+	return nil
+}
+
+// getConsoleTopic returns the topic an instance is used for, or the
+// topic it was last used for if it isn't running.
+func getConsoleTopic(instance api.ProfileInstance) string {
+	if instance.UsageLabel != nil {
+		return *instance.UsageLabel
+	}
+	if len(instance.Sessions) > 0 && instance.Sessions[len(instance.Sessions)-1].Topic != nil {
+		return *instance.Sessions[len(instance.Sessions)-1].Topic
+	}
+	return ""
+}
+
+func (c *console) getStatus(instance api.ProfileInstance) string {
+	switch {
+	case c.busy[instance.InstanceLabel] != "":
+		return c.busy[instance.InstanceLabel]
+	case instance.Attached && instance.UsagePID != nil:
+		return c.msgs.Sprintf("Attached")
+	case instance.UsagePID != nil:
+		return c.msgs.Sprintf("Running")
+	case instance.Reserved:
+		return c.msgs.Sprintf("Reserved")
+	case instance.Archived:
+		return c.msgs.Sprintf("Archived")
+	}
+	return c.msgs.Sprintf("Idle")
+}
+
+// fitColumn pads or cuts s to the width of a column, leaving a space
+// to the next one.
+func fitColumn(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) >= width {
+		runes = append(runes[:width-2], '…')
+	}
+	return string(runes) + strings.Repeat(" ", width-len(runes))
+}
+
+// fitLine pads or cuts a line to the width of the terminal.
+func fitLine(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
+
+func (c *console) formatRow(row consoleRow) string {
+	if row.instance == nil {
+		var size int64
+		running := 0
+		for _, instance := range c.instances {
+			if instance.ProfileLabel == row.profile {
+				size += c.sizes[instance.InstanceLabel]
+				if instance.UsagePID != nil {
+					running++
+				}
+			}
+		}
+		status := ""
+		if running > 0 {
+			status = c.msgs.Sprintf("%d running", running)
+		}
+		return fitColumn(row.profile, 26) + fitColumn("", 22) + fitColumn(status, 14) + fitColumn("", 4) + fitColumn(uio.FormatByteSize(size), 12)
+	}
+
+	instance := *row.instance
+	pinned := ""
+	if instance.Pinned {
+		pinned = "*"
+	}
+	size := ""
+	if measured, ok := c.sizes[instance.InstanceLabel]; ok {
+		size = uio.FormatByteSize(measured)
+	}
+	lastUsed := ""
+	if !instance.LastUsed.IsZero() {
+		lastUsed = instance.LastUsed.Local().Format(time.Stamp)
+	}
+	return fitColumn("  "+instance.InstanceLabel, 26) + fitColumn(getConsoleTopic(instance), 22) + fitColumn(c.getStatus(instance), 14) + fitColumn(pinned, 4) + fitColumn(size, 12) + lastUsed
+}
+
+func (c *console) render(w io.Writer, width int, height int) {
+	fmt.Fprintf(w, "\x1b[H\x1b[2J\x1b[7m%s\x1b[0m\r\n", fitLine(" tbml · "+c.msgs.Sprintf("%d profiles, %d instances", len(c.profiles), len(c.instances)), width))
+	header := fitColumn(c.msgs.Sprintf("Profile / instance"), 26) + fitColumn(c.msgs.Sprintf("Topic"), 22) + fitColumn(c.msgs.Sprintf("Status"), 14) + fitColumn(c.msgs.Sprintf("Pin"), 4) + fitColumn(c.msgs.Sprintf("Size"), 12) + c.msgs.Sprintf("Last used")
+	fmt.Fprintf(w, "\x1b[1m%s\x1b[0m\r\n", fitLine(header, width))
+
+	// The title, header, status line and key help take four lines.
+	shown := height - 4
+	if shown < 1 {
+		shown = 1
+	}
+	start := 0
+	if c.selected >= shown {
+		start = c.selected - shown + 1
+	}
+	for i := start; i < start+shown; i++ {
+		switch {
+		case i >= len(c.rows):
+			fmt.Fprint(w, "\r\n")
+		case i == c.selected:
+			fmt.Fprintf(w, "\x1b[7m%s\x1b[0m\r\n", fitLine(c.formatRow(c.rows[i]), width))
+		case c.rows[i].instance == nil:
+			fmt.Fprintf(w, "\x1b[1m%s\x1b[0m\r\n", fitLine(c.formatRow(c.rows[i]), width))
+		default:
+			fmt.Fprintf(w, "%s\r\n", fitLine(c.formatRow(c.rows[i]), width))
+		}
+	}
+
+	switch {
+	case c.topic != nil:
+		prompt := c.msgs.Sprintf("Topic for %s: ", c.launchProfile)
+		fmt.Fprintf(w, "%s\r\n", fitLine(prompt+string(c.topic), width))
+	case c.confirm != nil:
+		fmt.Fprintf(w, "\x1b[1m%s\x1b[0m\r\n", fitLine(c.confirmPrompt, width))
+	default:
+		fmt.Fprintf(w, "%s\r\n", fitLine(c.status, width))
+	}
+	fmt.Fprintf(w, "\x1b[2m%s\x1b[0m", fitLine(c.msgs.Sprintf("l launch  s stop  d delete  p pin  x prune  r refresh  q quit"), width))
+
+	if c.topic != nil {
+		// Show the cursor behind the topic.
+		prompt := c.msgs.Sprintf("Topic for %s: ", c.launchProfile)
+		fmt.Fprintf(w, "\x1b[%d;%dH\x1b[?25h", height-1, len([]rune(prompt))+len(c.topic)+1)
+	} else {
+		fmt.Fprint(w, "\x1b[?25l")
+	}
+}
+
+// RunConsole shows the profiles and instances of a launcher in the
+// terminal until the user quits, and lets the user launch, stop,
+// delete, pin and prune instances. Pruning deletes what prunePolicy
+// allows, once the user confirmed the list; without a policy, it is
+// disabled. Browsers launched from the console run in this process,
+// so they are closed when the user quits or ctx is done. Warnings are
+// shown in the status line, replacing the launcher's OnWarning. With
+// the launcher's DryRun, nothing is changed and the status line says
+// what would have been. If stdin isn't a terminal, it fails with
+// ErrNoTerminal.
+func RunConsole(ctx context.Context, launcher *api.Launcher, prunePolicy *api.CleanPolicy) error {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer restore()
+
+	out := bufio.NewWriter(os.Stderr)
+	fmt.Fprint(out, "\x1b[?1049h")
+	defer func() {
+		fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+		out.Flush()
+	}()
+
+	profiles := []string{}
+	for _, profile := range launcher.Configuration().Profiles {
+		profiles = append(profiles, profile.Label)
+	}
+	c := newConsole(profiles, i18n.NewPrinter(consoleMessages, i18n.DetectLanguage()))
+
+	// Updates come from the goroutines running the slower operations.
+	// They are dropped once the console is closed.
+	updates := make(chan func(c *console))
+	closed := make(chan struct{})
+	defer close(closed)
+	post := func(update func(c *console)) {
+		select {
+		case updates <- update:
+		case <-closed:
+		}
+	}
+	showError := func(err error) func(c *console) {
+		return func(c *console) {
+			c.status = uerror.Message(err)
+		}
+	}
+	launcher.OnWarning = func(warning api.Warning) {
+		// Warnings may come from the console's own goroutine.
+		go post(func(c *console) {
+			c.status = warning.String()
+		})
+	}
+
+	keys := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			for _, key := range splitKeys(buf[:n]) {
+				select {
+				case keys <- key:
+				case <-closed:
+					return
+				}
+			}
+		}
+	}()
+
+	measuring := false
+	measure := func() {
+		if measuring {
+			return
+		}
+		measuring = true
+		go func() {
+			stats, err := launcher.Stats()
+			post(func(c *console) {
+				measuring = false
+				if err != nil {
+					c.status = uerror.Message(err)
+					return
+				}
+				c.setSizes(stats)
+			})
+		}()
+	}
+	refresh := func() {
+		instances, err := launcher.Instances()
+		if err != nil {
+			c.status = uerror.Message(err)
+			return
+		}
+		c.update(instances)
+	}
+	refresh()
+	measure()
+
+	launchCtx, cancelLaunches := context.WithCancel(ctx)
+	defer cancelLaunches()
+	launches := &sync.WaitGroup{}
+	// closeLaunches closes the browsers launched from the console and
+	// waits for them to exit, keeping the console up to date meanwhile.
+	closeLaunches := func() {
+		cancelLaunches()
+		exited := make(chan struct{})
+		go func() {
+			launches.Wait()
+			close(exited)
+		}()
+		for c.launches > 0 {
+			c.status = c.msgs.Sprintf("Closing %d browsers launched from here…", c.launches)
+			render(out, c)
+			select {
+			case <-exited:
+				return
+			case update := <-updates:
+				update(c)
+			}
+		}
+	}
+
+	refreshTicker := time.NewTicker(consoleRefreshInterval)
+	defer refreshTicker.Stop()
+	measureTicker := time.NewTicker(consoleMeasureInterval)
+	defer measureTicker.Stop()
+	for {
+		if err := render(out, c); err != nil {
+			closeLaunches()
+			return uerror.WithStackTrace(err)
+		}
+		var action *consoleAction
+		select {
+		case <-ctx.Done():
+			closeLaunches()
+			return uerror.WithStackTrace(ctx.Err())
+		case err := <-readErr:
+			closeLaunches()
+			return uerror.WithStackTrace(err)
+		case <-refreshTicker.C:
+			refresh()
+		case <-measureTicker.C:
+			measure()
+		case update := <-updates:
+			update(c)
+			refresh()
+		case key := <-keys:
+			action = c.handleKey(key)
+		}
+		if action == nil {
+			continue
+		}
+
+		switch action.Kind {
+		case consoleLaunch:
+			c.launches++
+			c.status = c.msgs.Sprintf("Launching %s…", action.Profile)
+			launches.Add(1)
+			go func(action consoleAction) {
+				defer launches.Done()
+				defer post(func(c *console) {
+					c.launches--
+				})
+				claim, err := launcher.Claim(launchCtx, action.Profile, action.Topic)
+				if errors.Is(err, api.ErrDryRun) {
+					post(func(c *console) {
+						c.status = c.msgs.Sprintf("Would launch %s", action.Profile)
+					})
+					return
+				}
+				if err != nil {
+					post(showError(err))
+					return
+				}
+				label := claim.Instance.InstanceLabel
+				post(func(c *console) {
+					c.busy[label] = c.msgs.Sprintf("Starting")
+				})
+				// The instance shows as running once its browser is up.
+				time.AfterFunc(consoleRefreshInterval, func() {
+					post(func(c *console) {
+						if c.busy[label] == c.msgs.Sprintf("Starting") {
+							delete(c.busy, label)
+						}
+					})
+				})
+				exitCode, err := claim.Launch(launchCtx, api.LaunchOptions{})
+				switch {
+				case err != nil && !errors.Is(err, context.Canceled):
+					post(showError(err))
+				case exitCode != 0:
+					post(func(c *console) {
+						c.status = c.msgs.Sprintf("The browser of %s exited (%d)", label, exitCode)
+					})
+				default:
+					post(func(c *console) {
+						c.status = c.msgs.Sprintf("The browser of %s exited", label)
+					})
+				}
+			}(*action)
+		case consoleStop:
+			c.busy[action.Instance] = c.msgs.Sprintf("Stopping")
+			go func(label string) {
+				err := launcher.Stop(ctx, label)
+				post(func(c *console) {
+					delete(c.busy, label)
+					switch {
+					case err != nil:
+						c.status = uerror.Message(err)
+					case launcher.DryRun:
+						c.status = c.msgs.Sprintf("Would stop %s", label)
+					default:
+						c.status = c.msgs.Sprintf("Stopped %s", label)
+					}
+				})
+			}(action.Instance)
+		case consoleDelete:
+			if err := launcher.Delete(ctx, action.Instance); err != nil {
+				c.status = uerror.Message(err)
+				break
+			}
+			if launcher.DryRun {
+				c.status = c.msgs.Sprintf("Would delete %s", action.Instance)
+				break
+			}
+			c.status = c.msgs.Sprintf("Deleted %s, \"tbml undo\" restores it", action.Instance)
+			refresh()
+		case consolePin, consoleUnpin:
+			pinned := action.Kind == consolePin
+			if err := launcher.Pin(action.Instance, pinned); err != nil {
+				c.status = uerror.Message(err)
+				break
+			}
+			switch {
+			case launcher.DryRun && pinned:
+				c.status = c.msgs.Sprintf("Would pin %s", action.Instance)
+			case launcher.DryRun:
+				c.status = c.msgs.Sprintf("Would unpin %s", action.Instance)
+			case pinned:
+				c.status = c.msgs.Sprintf("Pinned %s", action.Instance)
+			default:
+				c.status = c.msgs.Sprintf("Unpinned %s", action.Instance)
+			}
+			refresh()
+		case consolePreviewPrune:
+			if prunePolicy == nil {
+				c.status = c.msgs.Sprintf("No prune policy was given")
+				break
+			}
+			c.status = c.msgs.Sprintf("Measuring the instances to prune…")
+			go func() {
+				results, err := launcher.Prune(ctx, *prunePolicy, true)
+				post(func(c *console) {
+					if err != nil {
+						c.status = uerror.Message(err)
+						return
+					}
+					if len(results) == 0 {
+						c.status = c.msgs.Sprintf("Nothing to prune")
+						return
+					}
+					var size int64
+					for _, result := range results {
+						size += result.Size
+					}
+					labels := getPruneLabels(results)
+					c.status = ""
+					c.askConfirmation(consoleAction{Kind: consolePrune, Instances: labels}, c.msgs.Sprintf("Prune %d instances (%s): %s? [y/N]", len(results), uio.FormatByteSize(size), strings.Join(labels, ", ")))
+				})
+			}()
+		case consolePrune:
+			go func(approved []string) {
+				pruned, size, err := pruneApproved(ctx, launcher, *prunePolicy, approved)
+				post(func(c *console) {
+					switch {
+					case errors.Is(err, errPruneChanged):
+						c.status = c.msgs.Sprintf("The instances to prune changed, check them again")
+					case err != nil:
+						c.status = uerror.Message(err)
+					case launcher.DryRun:
+						c.status = c.msgs.Sprintf("Would prune %d instances (%s)", pruned, uio.FormatByteSize(size))
+					default:
+						c.status = c.msgs.Sprintf("Pruned %d instances, %s in total", pruned, uio.FormatByteSize(size))
+					}
+				})
+			}(action.Instances)
+		case consoleRefresh:
+			refresh()
+			measure()
+		case consoleQuit:
+			closeLaunches()
+			return nil
+		}
+	}
+}
+
+// errPruneChanged means that the prune policy selects other instances
+// than the user agreed to prune.
+var errPruneChanged error = errors.New("The instances to prune changed")
+
+func getPruneLabels(results []api.CleanResult) []string {
+	labels := []string{}
+	for _, result := range results {
+		labels = append(labels, result.Instance.InstanceLabel)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// pruneApproved deletes exactly the instances the user agreed to prune.
+// Instances may have been used, pinned or created since they were
+// shown, so nothing is deleted unless the policy still selects the same
+// ones. It returns how many instances were deleted and their size.
+func pruneApproved(ctx context.Context, launcher *api.Launcher, policy api.CleanPolicy, approved []string) (int, int64, error) {
+	results, err := launcher.Prune(ctx, policy, true)
+	if err != nil {
+		return 0, 0, uerror.WithStackTrace(err)
+	}
+	if strings.Join(getPruneLabels(results), "\x00") != strings.Join(approved, "\x00") {
+		return 0, 0, uerror.WithStackTrace(errPruneChanged)
+	}
+	var size int64
+	for i, result := range results {
+		if err := launcher.Purge(ctx, result.Instance.InstanceLabel); err != nil {
+			return i, size, uerror.WithStackTrace(err)
+		}
+		size += result.Size
+	}
+	return len(results), size, nil
+}
+
+// render draws the console to fit the terminal.
+func render(out *bufio.Writer, c *console) error {
+	width, height := getTerminalSize(os.Stdin)
+	c.render(out, width, height)
+	return out.Flush()
+}
+
+// getTerminalSize returns the number of columns and lines of the
+// terminal, or the classic 80 by 24 if it can't be determined.
+func getTerminalSize(terminal *os.File) (width int, height int) {
+	var size struct {
+		Rows, Cols, XPixel, YPixel uint16
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, terminal.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno != 0 || size.Cols == 0 || size.Rows == 0 {
+		return 80, 24
+	}
+	return int(size.Cols), int(size.Rows)
+}
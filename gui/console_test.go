@@ -0,0 +1,233 @@
+package gui
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"t0ast.cc/tbml/api"
+	"t0ast.cc/tbml/util/i18n"
+)
+
+func newConsoleForTest() *console {
+	pid := 1234
+	topic := "mail"
+	c := newConsole([]string{"work", "home"}, nil)
+	c.update([]api.ProfileInstance{
+		{InstanceLabel: "work-2", ProfileLabel: "work"},
+		{InstanceLabel: "work-1", ProfileLabel: "work", UsageLabel: &topic, UsagePID: &pid, Pinned: true},
+		{InstanceLabel: "old-1", ProfileLabel: "old"},
+	})
+	return c
+}
+
+func getConsoleRowsForTest(c *console) []string {
+	rows := []string{}
+	for _, row := range c.rows {
+		if row.instance == nil {
+			rows = append(rows, row.profile)
+		} else {
+			rows = append(rows, "  "+row.instance.InstanceLabel)
+		}
+	}
+	return rows
+}
+
+func TestConsoleRows(t *testing.T) {
+	c := newConsoleForTest()
+	assert.Equal(t, []string{"work", "  work-1", "  work-2", "home", "old", "  old-1"}, getConsoleRowsForTest(c))
+
+	// The selection follows the instance when rows are added before it.
+	c.selected = 2
+	topic := "news"
+	c.update(append(c.instances, api.ProfileInstance{InstanceLabel: "work-0", ProfileLabel: "work", UsageLabel: &topic}))
+	assert.Equal(t, "work-2", c.selectedRow().instance.InstanceLabel)
+
+	// If it is gone, the selection stays with its profile.
+	c.update(c.instances[:1])
+	assert.Equal(t, "work", c.selectedRow().profile)
+}
+
+func TestConsoleKeys(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		keys     []string
+		expected *consoleAction
+		status   string
+	}{
+		{
+			desc: "launch with the topic of the instance",
+
+			keys:     []string{"j", "l", "\r"},
+			expected: &consoleAction{Kind: consoleLaunch, Profile: "work", Topic: "mail"},
+		},
+		{
+			desc: "launch a profile with a new topic",
+
+			keys:     []string{"\r", "n", "e", "w", "x", "\x7f", "s", "\r"},
+			expected: &consoleAction{Kind: consoleLaunch, Profile: "work", Topic: "news"},
+		},
+		{
+			desc: "cancel the launch",
+
+			keys: []string{"l", "\x1b"},
+		},
+		{
+			desc: "stop",
+
+			keys:     []string{"j", "s"},
+			expected: &consoleAction{Kind: consoleStop, Instance: "work-1"},
+		},
+		{
+			desc: "stop needs an instance",
+
+			keys:   []string{"s"},
+			status: "Select an instance first",
+		},
+		{
+			desc: "delete after confirming",
+
+			keys:     []string{"\x1b[B", "\x1b[B", "d", "y"},
+			expected: &consoleAction{Kind: consoleDelete, Instance: "work-2"},
+		},
+		{
+			desc: "delete without confirming",
+
+			keys: []string{"\x1b[B", "d", "n", "y"},
+		},
+		{
+			desc: "unpin a pinned instance",
+
+			keys:     []string{"j", "p"},
+			expected: &consoleAction{Kind: consoleUnpin, Instance: "work-1"},
+		},
+		{
+			desc: "pin",
+
+			keys:     []string{"j", "j", "j", "k", "p"},
+			expected: &consoleAction{Kind: consolePin, Instance: "work-2"},
+		},
+		{
+			desc: "prune",
+
+			keys:     []string{"x"},
+			expected: &consoleAction{Kind: consolePreviewPrune},
+		},
+		{
+			desc: "quit",
+
+			keys:     []string{"q"},
+			expected: &consoleAction{Kind: consoleQuit},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			c := newConsoleForTest()
+			var action *consoleAction
+			for _, key := range tC.keys {
+				if action = c.handleKey(key); action != nil {
+					break
+				}
+			}
+			assert.Equal(t, tC.expected, action)
+			assert.Equal(t, tC.status, c.status)
+		})
+	}
+}
+
+func TestConsoleQuitWithLaunches(t *testing.T) {
+	c := newConsole([]string{"work"}, i18n.NewPrinter(consoleMessages, "de"))
+	c.launches = 2
+	assert.Nil(t, c.handleKey("q"))
+	assert.Contains(t, c.confirmPrompt, "2")
+	assert.Nil(t, c.handleKey("n"))
+	assert.Nil(t, c.handleKey("q"))
+	assert.Equal(t, &consoleAction{Kind: consoleQuit}, c.handleKey("j"))
+}
+
+func TestConsolePruneApproved(t *testing.T) {
+	launcher, err := api.New(api.Configuration{
+		ProfilePath: t.TempDir(),
+		Profiles:    []api.ProfileConfiguration{{Label: "work"}},
+	}, t.TempDir())
+	assert.NoError(t, err)
+	ctx := context.Background()
+	claims := []*api.Claim{}
+	labels := []string{}
+	for _, topic := range []string{"mail", "news"} {
+		claim, err := launcher.Claim(ctx, "work", topic)
+		assert.NoError(t, err)
+		claims = append(claims, claim)
+		labels = append(labels, claim.Instance.InstanceLabel)
+	}
+	for _, claim := range claims {
+		assert.NoError(t, claim.Release())
+	}
+	maxInstances := 0
+	policy := api.CleanPolicy{MaxInstancesPerProfile: &maxInstances}
+
+	// The confirmation carries the instances that were shown.
+	c := newConsole([]string{"work"}, nil)
+	c.askConfirmation(consoleAction{Kind: consolePrune, Instances: labels}, "Prune?")
+	action := c.handleKey("y")
+	if assert.NotNil(t, action) {
+		assert.Equal(t, labels, action.Instances)
+	}
+
+	// Nothing is deleted if the policy selects other instances by now.
+	assert.NoError(t, launcher.Pin(labels[0], true))
+	pruned, _, err := pruneApproved(ctx, launcher, policy, labels)
+	assert.True(t, errors.Is(err, errPruneChanged))
+	assert.Zero(t, pruned)
+	instances, err := launcher.Instances()
+	assert.NoError(t, err)
+	assert.Len(t, instances, 2)
+
+	pruned, _, err = pruneApproved(ctx, launcher, policy, labels[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	instances, err = launcher.Instances()
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, labels[0], instances[0].InstanceLabel)
+	}
+}
+
+func TestConsoleRender(t *testing.T) {
+	c := newConsoleForTest()
+	c.sizes["work-1"] = 3 << 20
+	c.sizes["work-2"] = 1 << 20
+	c.selected = 1
+	buf := &bytes.Buffer{}
+	c.render(buf, 100, 6)
+	lines := strings.Split(buf.String(), "\r\n")
+	if assert.Len(t, lines, 6) {
+		assert.Contains(t, lines[0], "2 profiles, 3 instances")
+		// Only two rows fit, with the selected one among them.
+		assert.Contains(t, lines[2], "work")
+		assert.Contains(t, lines[2], "1 running")
+		assert.Contains(t, lines[2], "4.0 MiB")
+		assert.Contains(t, lines[3], "\x1b[7m  work-1")
+		assert.Contains(t, lines[3], "mail")
+		assert.Contains(t, lines[3], "Running")
+		assert.Contains(t, lines[3], "*")
+		assert.Contains(t, lines[5], "q quit")
+	}
+
+	c.handleKey("l")
+	c.handleKey("x")
+	buf.Reset()
+	c.render(buf, 100, 6)
+	assert.Contains(t, buf.String(), "Topic for work: mailx")
+}
+
+func TestFitColumn(t *testing.T) {
+	assert.Equal(t, "abc   ", fitColumn("abc", 6))
+	assert.Equal(t, "abcd… ", fitColumn("abcdefgh", 6))
+	assert.Equal(t, "äöü…  ", fitLine(fitColumn("äöüßäöü", 5), 6))
+	assert.Equal(t, "abc", fitLine("abcdef", 3))
+}
@@ -0,0 +1,66 @@
+package gui
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// FuzzyFilter returns the items that contain the characters of the
+// query in order, ignoring case, best matches first. Matches score
+// higher the more of their characters are consecutive and the earlier
+// they start; ties keep the order of items. An empty query matches
+// everything.
+func FuzzyFilter(items []string, query string) []string {
+	type match struct {
+		item  string
+		score int
+	}
+	matches := []match{}
+	for _, item := range items {
+		if score, ok := fuzzyScore(item, query); ok {
+			matches = append(matches, match{item, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	filtered := make([]string, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.item
+	}
+	return filtered
+}
+
+func fuzzyScore(item string, query string) (int, bool) {
+	itemRunes := []rune(strings.ToLower(item))
+	score := 0
+	next := 0
+	previous := -2
+	for _, q := range strings.ToLower(query) {
+		if unicode.IsSpace(q) {
+			continue
+		}
+		found := false
+		for ; next < len(itemRunes); next++ {
+			if itemRunes[next] != q {
+				continue
+			}
+			if next == previous+1 {
+				score += 2
+			}
+			if previous == -2 {
+				score -= next
+			}
+			previous = next
+			next++
+			found = true
+			break
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return score, true
+}
@@ -2,13 +2,30 @@ package gui
 
 import (
 	"context"
+	"errors"
+	"os"
 	"os/exec"
 	"strings"
 
 	uerror "t0ast.cc/tbml/util/error"
 )
 
+var ErrNoDisplay error = errors.New("No display to show a prompt on")
+
+// HasDisplay tells whether an X11 or Wayland display is available,
+// which isn't the case in containers and CI jobs.
+func HasDisplay() bool {
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// Prompt asks the user to pick one of the items with rofi. If the user
+// cancels, it returns nil. Without a display, it fails with
+// ErrNoDisplay.
 func Prompt(ctx context.Context, items []string, prompt string, matchExact bool) (*string, error) {
+	if !HasDisplay() {
+		return nil, uerror.WithStackTrace(ErrNoDisplay)
+	}
+
 	rofiArgs := []string{"-dmenu", "-p", prompt}
 	if matchExact {
 		rofiArgs = append(rofiArgs, "-no-custom")
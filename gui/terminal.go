@@ -0,0 +1,178 @@
+package gui
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrNoTerminal error = errors.New("Not running in a terminal")
+
+// maxShownItems is how many matches the terminal picker shows at once.
+const maxShownItems = 15
+
+// picker is the state of PromptTerminal, kept apart from the terminal
+// so it can be tested.
+type picker struct {
+	items      []string
+	matchExact bool
+	query      []rune
+	matches    []string
+	selected   int
+}
+
+func newPicker(items []string, matchExact bool) *picker {
+	p := &picker{items: items, matchExact: matchExact}
+	p.filter()
+	return p
+}
+
+func (p *picker) filter() {
+	p.matches = FuzzyFilter(p.items, string(p.query))
+	p.selected = 0
+}
+
+// handleKey applies a key press. Once the user is done, it returns true
+// and the chosen item, or nil if the user canceled. Without matchExact,
+// the query itself is chosen if nothing matches it.
+func (p *picker) handleKey(key string) (done bool, choice *string) {
+	switch key {
+	case "\r", "\n":
+		if len(p.matches) > 0 {
+			return true, &p.matches[p.selected]
+		}
+		if !p.matchExact && len(p.query) > 0 {
+			query := string(p.query)
+			return true, &query
+		}
+	case "\x1b", "\x03", "\x04":
+		return true, nil
+	case "\x1b[A", "\x10":
+		if p.selected > 0 {
+			p.selected--
+		}
+	case "\x1b[B", "\x0e", "\t":
+		if p.selected < len(p.matches)-1 {
+			p.selected++
+		}
+	case "\x7f", "\b":
+		if len(p.query) > 0 {
+			p.query = p.query[:len(p.query)-1]
+			p.filter()
+		}
+	case "\x15":
+		p.query = nil
+		p.filter()
+	default:
+		runes := []rune(key)
+		if len(runes) == 1 && runes[0] >= ' ' {
+			p.query = append(p.query, runes[0])
+			p.filter()
+		}
+	}
+	return false, nil
+}
+
+func (p *picker) render(w io.Writer, prompt string) {
+	fmt.Fprintf(w, "\x1b[H\x1b[2J%s: %s\r\n", prompt, string(p.query))
+	start := 0
+	if p.selected >= maxShownItems {
+		start = p.selected - maxShownItems + 1
+	}
+	for i := start; i < len(p.matches) && i < start+maxShownItems; i++ {
+		if i == p.selected {
+			fmt.Fprintf(w, "\x1b[7m> %s\x1b[0m\r\n", p.matches[i])
+		} else {
+			fmt.Fprintf(w, "  %s\r\n", p.matches[i])
+		}
+	}
+	// Put the cursor back behind the query.
+	fmt.Fprintf(w, "\x1b[1;%dH", len([]rune(prompt))+3+len(p.query))
+}
+
+// PromptTerminal is Prompt for the terminal: The user narrows down the
+// items by typing, picks one with the arrow keys and confirms it with
+// enter. If the user cancels with escape or Ctrl+C, it returns nil. If
+// stdin isn't a terminal, it fails with ErrNoTerminal.
+func PromptTerminal(ctx context.Context, items []string, prompt string, matchExact bool) (*string, error) {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer restore()
+
+	out := bufio.NewWriter(os.Stderr)
+	// The picker is drawn on the alternate screen, so the terminal's
+	// contents come back afterwards.
+	fmt.Fprint(out, "\x1b[?1049h")
+	defer func() {
+		fmt.Fprint(out, "\x1b[?1049l")
+		out.Flush()
+	}()
+
+	p := newPicker(items, matchExact)
+	in := bufio.NewReader(os.Stdin)
+	buf := make([]byte, 16)
+	for {
+		p.render(out, prompt)
+		if err := out.Flush(); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		n, err := in.Read(buf)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		for _, key := range splitKeys(buf[:n]) {
+			if done, choice := p.handleKey(key); done {
+				return choice, nil
+			}
+		}
+	}
+}
+
+// splitKeys splits what one read from the terminal returned into key
+// presses. Escape sequences and multi-byte characters usually arrive in
+// one read. Anything else is handled character by character.
+func splitKeys(input []byte) []string {
+	keys := []string{string(input)}
+	if len([]rune(keys[0])) > 1 && input[0] != '\x1b' {
+		keys = []string{}
+		for _, r := range string(input) {
+			keys = append(keys, string(r))
+		}
+	}
+	return keys
+}
+
+// makeRaw switches the terminal to raw mode, so key presses can be read
+// one by one without being echoed.
+func makeRaw(terminal *os.File) (restore func(), err error) {
+	var state syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, terminal.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&state))); errno != 0 {
+		return nil, uerror.StackTracef("%w: %s", ErrNoTerminal, errno)
+	}
+	raw := state
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, terminal.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); errno != 0 {
+		return nil, uerror.WithStackTrace(errno)
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, terminal.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&state)))
+	}, nil
+}
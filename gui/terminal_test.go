@@ -0,0 +1,86 @@
+package gui
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzyFilter(t *testing.T) {
+	items := []string{"work", "news", "networking", "Weekend plans"}
+	testCases := []struct {
+		desc string
+
+		query    string
+		expected []string
+	}{
+		{
+			desc: "empty query",
+
+			expected: items,
+		},
+		{
+			desc: "consecutive matches first",
+
+			query:    "new",
+			expected: []string{"news", "networking"},
+		},
+		{
+			desc: "characters in order",
+
+			query:    "wkp",
+			expected: []string{"Weekend plans"},
+		},
+		{
+			desc: "ignores case and spaces",
+
+			query:    "WE PL",
+			expected: []string{"Weekend plans"},
+		},
+		{
+			desc: "no match",
+
+			query:    "xyz",
+			expected: []string{},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, FuzzyFilter(items, tC.query))
+		})
+	}
+}
+
+func TestPicker(t *testing.T) {
+	p := newPicker([]string{"work", "news", "networking"}, true)
+	for _, key := range []string{"n", "e", "t"} {
+		done, _ := p.handleKey(key)
+		assert.False(t, done)
+	}
+	assert.Equal(t, []string{"networking"}, p.matches)
+
+	p.handleKey("\x7f")
+	p.handleKey("\x1b[B")
+	done, choice := p.handleKey("\r")
+	assert.True(t, done)
+	if assert.NotNil(t, choice) {
+		assert.Equal(t, "networking", *choice)
+	}
+
+	// Only exact matches can be chosen with matchExact.
+	p = newPicker([]string{"work"}, true)
+	p.handleKey("x")
+	done, _ = p.handleKey("\r")
+	assert.False(t, done)
+	done, choice = p.handleKey("\x1b")
+	assert.True(t, done)
+	assert.Nil(t, choice)
+
+	p = newPicker([]string{"work"}, false)
+	p.handleKey("x")
+	done, choice = p.handleKey("\r")
+	assert.True(t, done)
+	if assert.NotNil(t, choice) {
+		assert.Equal(t, "x", *choice)
+	}
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrAliasRecursion error = errors.New("Alias recursion")
+
+// maxAliasDepth limits how many aliases may reference each other in a
+// chain, even if there is no cycle.
+const maxAliasDepth = 16
+
+var aliasPlaceholderRE *regexp.Regexp = regexp.MustCompile(`\{(\d+|\*)\}`)
+
+// ExpandAlias expands the alias named by args[aliasIndex], if there is
+// one. Aliases may reference positional arguments given after the
+// alias name as {1}, {2} etc. and all of them as {*}. Arguments that
+// aren't referenced are appended to the expansion. The expansion may
+// itself start with another alias.
+func ExpandAlias(aliases map[string]string, args []string, aliasIndex int) ([]string, error) {
+	seen := make(map[string]bool)
+	for depth := 0; aliasIndex < len(args); depth++ {
+		name := args[aliasIndex]
+		alias, ok := aliases[name]
+		if !ok {
+			return args, nil
+		}
+		if seen[name] || depth >= maxAliasDepth {
+			return nil, fmt.Errorf("%w: %s", ErrAliasRecursion, name)
+		}
+		seen[name] = true
+
+		expansion, err := expandAliasTemplate(name, alias, args[aliasIndex+1:])
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		args = append(append([]string{}, args[:aliasIndex]...), expansion...)
+	}
+	return args, nil
+}
+
+func expandAliasTemplate(name, alias string, aliasArgs []string) ([]string, error) {
+	words, err := splitCommandLine(alias)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid alias %s: %w", name, err)
+	}
+
+	used := make([]bool, len(aliasArgs))
+	expansion := []string{}
+	for _, word := range words {
+		if word == "{*}" {
+			expansion = append(expansion, aliasArgs...)
+			for i := range used {
+				used[i] = true
+			}
+			continue
+		}
+		var templateErr error
+		word = aliasPlaceholderRE.ReplaceAllStringFunc(word, func(placeholder string) string {
+			index := placeholder[1 : len(placeholder)-1]
+			if index == "*" {
+				for i := range used {
+					used[i] = true
+				}
+				return strings.Join(aliasArgs, " ")
+			}
+			n, _ := strconv.Atoi(index)
+			if n < 1 || n > len(aliasArgs) {
+				templateErr = fmt.Errorf("Alias %s needs argument %d but only %d were given", name, n, len(aliasArgs))
+				return placeholder
+			}
+			used[n-1] = true
+			return aliasArgs[n-1]
+		})
+		if templateErr != nil {
+			return nil, templateErr
+		}
+		expansion = append(expansion, word)
+	}
+
+	for i, arg := range aliasArgs {
+		if !used[i] {
+			expansion = append(expansion, arg)
+		}
+	}
+	return expansion, nil
+}
+
+// splitCommandLine splits a command line into words at whitespace,
+// honoring single and double quotes.
+func splitCommandLine(commandLine string) ([]string, error) {
+	words := []string{}
+	current := strings.Builder{}
+	inWord := false
+	var quote rune
+	for _, r := range commandLine {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote in %q", commandLine)
+	}
+	if inWord {
+		words = append(words, current.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,95 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"t0ast.cc/tbml/internal"
+)
+
+func TestExpandAlias(t *testing.T) {
+	aliases := map[string]string{
+		"work":    "open --profile work --topic daily https://board.example",
+		"search":  "open --topic search 'https://search.example/?q={*}'",
+		"topic":   "open --topic {1} --profile {2}",
+		"daily":   "work",
+		"unknown": "ls {3}",
+	}
+
+	testCases := []struct {
+		desc string
+
+		aliasIndex int
+		args       []string
+		expected   []string
+	}{
+		{
+			desc: "No alias",
+
+			args:     []string{"ls"},
+			expected: []string{"ls"},
+		},
+		{
+			desc: "Simple alias",
+
+			args:     []string{"work"},
+			expected: []string{"open", "--profile", "work", "--topic", "daily", "https://board.example"},
+		},
+		{
+			desc: "Unused arguments are appended",
+
+			args:     []string{"work", "--debug"},
+			expected: []string{"open", "--profile", "work", "--topic", "daily", "https://board.example", "--debug"},
+		},
+		{
+			desc: "Positional arguments",
+
+			args:     []string{"topic", "foo", "bar", "https://example.com"},
+			expected: []string{"open", "--topic", "foo", "--profile", "bar", "https://example.com"},
+		},
+		{
+			desc: "All arguments within a word",
+
+			args:     []string{"search", "tor", "browser"},
+			expected: []string{"open", "--topic", "search", "https://search.example/?q=tor browser"},
+		},
+		{
+			desc: "Alias of an alias",
+
+			args:     []string{"daily"},
+			expected: []string{"open", "--profile", "work", "--topic", "daily", "https://board.example"},
+		},
+		{
+			desc: "Global flags before the alias",
+
+			aliasIndex: 2,
+			args:       []string{"--config", "config.json", "work"},
+			expected:   []string{"--config", "config.json", "open", "--profile", "work", "--topic", "daily", "https://board.example"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			actual, err := internal.ExpandAlias(aliases, tC.args, tC.aliasIndex)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expected, actual)
+		})
+	}
+}
+
+func TestExpandAliasMissingArgument(t *testing.T) {
+	_, err := internal.ExpandAlias(map[string]string{
+		"topic": "open --topic {1} --profile {2}",
+	}, []string{"topic", "foo"}, 0)
+	assert.Error(t, err)
+}
+
+func TestExpandAliasRecursion(t *testing.T) {
+	aliases := map[string]string{
+		"a": "b --foo",
+		"b": "c",
+		"c": "a",
+	}
+	_, err := internal.ExpandAlias(aliases, []string{"a"}, 0)
+	assert.ErrorIs(t, err, internal.ErrAliasRecursion)
+}
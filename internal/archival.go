@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrNotArchivable error = errors.New("The instance can't be archived")
+
+const (
+	// archivedInstanceFileName is the name of the manifest listing the
+	// files of an archived instance in its directory in the profile
+	// path. Their content is in the chunk store.
+	archivedInstanceFileName = "instance-archive.json"
+	// legacyArchivedInstanceFileName is the name of the tar.gz archive
+	// instances were archived to before the chunk store existed. Such
+	// archives are still extracted, but no new ones are written.
+	legacyArchivedInstanceFileName = "instance-archive.tar.gz"
+)
+
+func getArchivedInstancePath(config Configuration, instance ProfileInstance) string {
+	return filepath.Join(getInstanceRecordDir(config, instance), archivedInstanceFileName)
+}
+
+func getLegacyArchivedInstancePath(config Configuration, instance ProfileInstance) string {
+	return filepath.Join(getInstanceRecordDir(config, instance), legacyArchivedInstanceFileName)
+}
+
+// ArchiveInstance moves the files of an instance that isn't in use into
+// the chunk store, where files and parts of files that archived
+// instances have in common are only stored once, and deletes them to
+// free up disk space. The instance stays listed and is unarchived the
+// next time it is launched. Encrypted and ephemeral instances can't be
+// archived.
+func ArchiveInstance(config Configuration, instance ProfileInstance, mutations *Mutations) error {
+	switch {
+	case instance.Encrypted:
+		return uerror.StackTracef("%w: %s is encrypted", ErrNotArchivable, instance.InstanceLabel)
+	case instance.Ephemeral:
+		return uerror.StackTracef("%w: %s is ephemeral", ErrNotArchivable, instance.InstanceLabel)
+	case instance.Reserved:
+		return uerror.StackTracef("%w: %s is only reserved", ErrNotArchivable, instance.InstanceLabel)
+	case instance.Archived:
+		return nil
+	}
+	inUse, err := isInstanceInUse(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if inUse {
+		return uerror.StackTracef("%w: %s is currently in use", ErrInstanceInUse, instance.InstanceLabel)
+	}
+	return mutations.Apply("Archive instance", instance.InstanceLabel, func() error {
+		return archiveInstance(config, instance)
+	})
+}
+
+func archiveInstance(config Configuration, instance ProfileInstance) error {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	instanceDir := getInstanceDir(config, instance)
+	archivePath := getArchivedInstancePath(config, instance)
+	if err := writeChunkedArchive(config, instanceDir, archivePath); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	// The metadata is updated before the files are deleted, so an
+	// interrupted archival leaves an instance that still has its
+	// files, which are extracted over again when it is unarchived.
+	instance, err = GetProfileInstance(config, instance.InstanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.Archived = true
+	if err := writeProfileInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	dirEntries, err := os.ReadDir(instanceDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	isRecordDir := instanceDir == getInstanceRecordDir(config, instance)
+	for _, dirEntry := range dirEntries {
+		if isRecordDir && isInstanceRecordFile(dirEntry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(instanceDir, dirEntry.Name())); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	ulog.Default().Info("Archived instance", "instance", instance.InstanceLabel)
+	return nil
+}
+
+// isInstanceRecordFile tells whether an entry of an instance's
+// directory in the profile path belongs to tbml rather than to the
+// browser, so it is kept when the instance is archived.
+func isInstanceRecordFile(name string) bool {
+	switch name {
+	case "profile-instance.json", instanceDataBackupFileName, instanceLockFileName, instanceLogFileName, instanceLogFileName + ".1", archivedInstanceFileName, legacyArchivedInstanceFileName:
+		return true
+	}
+	return isInstanceTempFile(name)
+}
+
+// isInstanceTempFile tells whether an entry of an instance's directory
+// in the profile path is a temporary file of an atomic write to its
+// metadata or archive.
+func isInstanceTempFile(name string) bool {
+	return strings.HasPrefix(name, ".profile-instance.json-") || strings.HasPrefix(name, "."+archivedInstanceFileName+"-") || strings.HasPrefix(name, legacyArchivedInstanceFileName+"-")
+}
+
+// UnarchiveInstance restores the files of an archived instance that
+// isn't in use. Launching an archived instance does this, too.
+func UnarchiveInstance(config Configuration, instance ProfileInstance, mutations *Mutations) error {
+	if !instance.Archived {
+		return nil
+	}
+	return mutations.Apply("Unarchive instance", instance.InstanceLabel, func() error {
+		unlock, err := LockInstance(config, instance)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer unlock()
+		return unarchiveInstance(config, instance)
+	})
+}
+
+// unarchiveInstance restores the files of an instance from its
+// archive, if there is one, and updates the instance's metadata. The
+// archive decides rather than the metadata, so an instance whose
+// archival was interrupted gets its archive cleaned up, too. The
+// instance must be locked by the caller.
+func unarchiveInstance(config Configuration, instance ProfileInstance) error {
+	archivePath := getArchivedInstancePath(config, instance)
+	manifest, err := readArchiveManifest(archivePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		archivePath = getLegacyArchivedInstancePath(config, instance)
+		return unarchiveLegacyInstance(config, instance, archivePath)
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	started := time.Now()
+	if err := restoreChunkedArchive(config, manifest, getInstanceDir(config, instance)); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := recordUnarchiveRate(config, manifest.size(), time.Since(started)); err != nil {
+		ulog.Default().Warn("Failed to record how fast the instance was unarchived", "error", uerror.Message(err))
+	}
+	// The chunks are left for CollectGarbage, since other archived
+	// instances may share them.
+	return finishUnarchiving(config, instance, archivePath)
+}
+
+// unarchiveLegacyInstance extracts an archive written before the chunk
+// store existed, if there is one.
+func unarchiveLegacyInstance(config Configuration, instance ProfileInstance, archivePath string) error {
+	archiveFile, err := os.Open(archivePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer archiveFile.Close()
+	started := time.Now()
+
+	gzipReader, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return uerror.StackTracef("%w: %s", ErrInvalidArchive, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	instanceDir := getInstanceDir(config, instance)
+	var size int64
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return uerror.StackTracef("%w: %s", ErrInvalidArchive, err)
+		}
+		if err := extractArchiveEntry(tarReader, header, instanceDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		size += header.Size
+	}
+	if err := recordUnarchiveRate(config, size, time.Since(started)); err != nil {
+		ulog.Default().Warn("Failed to record how fast the instance was unarchived", "error", uerror.Message(err))
+	}
+	return finishUnarchiving(config, instance, archivePath)
+}
+
+func finishUnarchiving(config Configuration, instance ProfileInstance, archivePath string) error {
+	instance, err := GetProfileInstance(config, instance.InstanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.Archived = false
+	if err := writeProfileInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := os.Remove(archivePath); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	ulog.Default().Info("Unarchived instance", "instance", instance.InstanceLabel)
+	return nil
+}
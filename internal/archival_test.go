@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestArchiveInstance(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	files := map[string]string{
+		filepath.Join(relativeProfilePath, "prefs.js"):      "user_pref(\"a\", 1);",
+		filepath.Join(relativeProfilePath, "places.sqlite"): "places",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(instanceDir, name)), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, name), []byte(content), uio.FileModeURWGRWO))
+	}
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, ArchiveInstance(config, instance, nil), ErrInstanceInUse)
+	assert.NoError(t, unlock())
+
+	assert.NoError(t, ArchiveInstance(config, instance, &Mutations{DryRun: true}))
+	assert.NoFileExists(t, getArchivedInstancePath(config, instance))
+
+	assert.NoError(t, ArchiveInstance(config, instance, nil))
+	assert.FileExists(t, getArchivedInstancePath(config, instance))
+	assert.NoDirExists(t, filepath.Join(instanceDir, relativeProfilePath))
+	archived, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.True(t, archived.Archived)
+	listings, err := ListProfiles(config, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, listings[0].Instances[0].Archived)
+
+	assert.NoError(t, UnarchiveInstance(config, archived, nil))
+	assert.NoFileExists(t, getArchivedInstancePath(config, instance))
+	for name, content := range files {
+		restored, err := os.ReadFile(filepath.Join(instanceDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(restored))
+	}
+	unarchived, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.False(t, unarchived.Archived)
+}
+
+func TestArchiveInstanceNotArchivable(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	instance.Ephemeral = true
+	assert.ErrorIs(t, ArchiveInstance(config, instance, nil), ErrNotArchivable)
+	instance.Ephemeral = false
+	instance.Encrypted = true
+	assert.ErrorIs(t, ArchiveInstance(config, instance, nil), ErrNotArchivable)
+}
@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrInstanceExists error = errors.New("Instance already exists")
+
+var ErrInvalidArchive error = errors.New("Invalid archive")
+
+const (
+	archiveMetadataName = "profile-instance.json"
+	archiveFilesDir     = "files"
+)
+
+// archiveExcludedNames are entries of an instance directory that are
+// left out of archives because they are recreated on every launch or
+// only make sense on the machine they were created on.
+var archiveExcludedNames = map[string]bool{
+	".cache":                                true,
+	"control-socket":                        true,
+	"mothership-connector":                  true,
+	instanceLockFileName:                    true,
+	"profile-instance.json":                 true,
+	instanceDataBackupFileName:              true,
+	archivedInstanceFileName:                true,
+	legacyArchivedInstanceFileName:          true,
+	instanceLogFileName:                     true,
+	instanceLogFileName + ".1":              true,
+	".local/share/torbrowser/gnupg_homedir": true,
+}
+
+// ExportInstance writes a tar.gz archive of an instance's files and
+// metadata to w. The instance is locked while it is exported, so it
+// can't be exported while it is running. Caches, sockets and symlinks
+// are left out. Encrypted instances are exported decrypted.
+func ExportInstance(config Configuration, instance ProfileInstance, w io.Writer) (err error) {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	if err := unarchiveInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.Archived = false
+
+	profile := ProfileConfiguration{Label: instance.ProfileLabel}
+	if configured := FindProfileByLabel(config, instance.ProfileLabel); configured != nil {
+		profile = *configured
+	}
+	unmountEncryptedInstance, err := mountEncryptedInstance(config, profile, instance, nil)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer func() {
+		if unmountErr := unmountEncryptedInstance(); err == nil {
+			err = unmountErr
+		}
+	}()
+	// The metadata is cleaned up for the archive below, so the files'
+	// location is looked up first.
+	instanceDir := getInstanceDir(config, instance)
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	instance.Attached = false
+	instance.BrowserPID = nil
+	instance.ControlPort = nil
+	instance.Directory = nil
+	instance.Encrypted = false
+	instance.Ephemeral = false
+	instance.SOCKSPort = nil
+	instance.UsageLabel = nil
+	instance.UsagePID = nil
+	metadata, err := json.Marshal(instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Mode:     int64(uio.FileModeURWGRWO),
+		ModTime:  instance.LastUsed,
+		Name:     archiveMetadataName,
+		Size:     int64(len(metadata)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if _, err := tarWriter.Write(metadata); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	if err := addInstanceFilesToArchive(tarWriter, instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// addInstanceFilesToArchive adds the files of an instance to the
+// archive's files directory, leaving out archiveExcludedNames,
+// temporary files and everything that isn't a file or directory.
+func addInstanceFilesToArchive(tarWriter *tar.Writer, instanceDir string) error {
+	return walkInstanceFiles(instanceDir, func(filePath string, relativePath string) error {
+		return addFileToArchive(tarWriter, filePath, path.Join(archiveFilesDir, relativePath))
+	})
+}
+
+// walkInstanceFiles calls fn with the directories and regular files of
+// an instance that belong into an archive, along with their
+// slash-separated paths relative to instanceDir.
+func walkInstanceFiles(instanceDir string, fn func(filePath string, relativePath string) error) error {
+	return filepath.WalkDir(instanceDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(instanceDir, filePath)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." {
+			return nil
+		}
+		if archiveExcludedNames[filepath.ToSlash(relativePath)] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() || isInstanceTempFile(relativePath) {
+			return nil
+		}
+		return fn(filePath, filepath.ToSlash(relativePath))
+	})
+}
+
+func addFileToArchive(tarWriter *tar.Writer, filePath, name string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// Owner names don't mean anything on another machine.
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(tarWriter, file, header.Size)
+	return err
+}
+
+// ImportInstance restores an instance from an archive created by
+// ExportInstance. The instance keeps its label unless another instance
+// has it, in which case the policy decides what happens. The instance
+// only shows up once it is completely extracted.
+func ImportInstance(config Configuration, r io.Reader, policy CollisionPolicy, mutations *Mutations) (ProfileInstance, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return ProfileInstance{}, uerror.StackTracef("%w: %s", ErrInvalidArchive, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	header, err := tarReader.Next()
+	if err != nil {
+		return ProfileInstance{}, uerror.StackTracef("%w: %s", ErrInvalidArchive, err)
+	}
+	if header.Name != archiveMetadataName {
+		return ProfileInstance{}, uerror.StackTracef("%w: the archive doesn't start with the instance's metadata", ErrInvalidArchive)
+	}
+	metadata, err := io.ReadAll(io.LimitReader(tarReader, maxInstanceDataSize+1))
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	if len(metadata) > maxInstanceDataSize {
+		return ProfileInstance{}, uerror.StackTracef("%w: the instance's metadata is too large", ErrInvalidArchive)
+	}
+	var instance ProfileInstance
+	if err := json.Unmarshal(metadata, &instance); err != nil {
+		return ProfileInstance{}, uerror.StackTracef("%w: %s", ErrInvalidArchive, err)
+	}
+	if !isValidInstanceLabel(instance.InstanceLabel) {
+		return ProfileInstance{}, uerror.StackTracef("%w: invalid instance label %q", ErrInvalidArchive, instance.InstanceLabel)
+	}
+	instance.Attached = false
+	instance.BrowserPID = nil
+	instance.ControlPort = nil
+	instance.Directory = nil
+	instance.Ephemeral = false
+	instance.SOCKSPort = nil
+	instance.UsageLabel = nil
+	instance.UsagePID = nil
+	if FindProfileByLabel(config, instance.ProfileLabel) == nil {
+		return ProfileInstance{}, uerror.StackTracef("Profile %s of instance %s does not exist", instance.ProfileLabel, instance.InstanceLabel)
+	}
+
+	label, replaced, err := resolveLabelCollision(config, instance.InstanceLabel, policy)
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	instance.InstanceLabel = label
+
+	if err := mutations.Apply("Import instance", instance.InstanceLabel, func() error {
+		if replaced != nil {
+			if err := deleteInstance(config, *replaced); err != nil {
+				return err
+			}
+		}
+		return extractInstanceArchive(config, instance, tarReader)
+	}); err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	return instance, nil
+}
+
+func extractInstanceArchive(config Configuration, instance ProfileInstance, tarReader *tar.Reader) error {
+	if err := os.MkdirAll(config.ProfilePath, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	tmpDir, err := os.MkdirTemp(config.ProfilePath, ".import-*")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return uerror.StackTracef("%w: %s", ErrInvalidArchive, err)
+		}
+		if err := extractArchiveEntry(tarReader, header, tmpDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	instanceDataBytes, err := json.Marshal(instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "profile-instance.json"), instanceDataBytes, uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	recordDir := getInstanceRecordDir(config, instance)
+	if err := os.Rename(tmpDir, recordDir); err != nil {
+		if exists, _ := uio.DirExists(recordDir); exists {
+			return uerror.StackTracef("%w: %s", ErrInstanceExists, instance.InstanceLabel)
+		}
+		return uerror.WithStackTrace(err)
+	}
+	invalidateInstanceCache(config)
+	return nil
+}
+
+// extractArchiveEntry extracts an entry of the archive's files
+// directory to dir. Entries that would end up outside of dir are
+// rejected and entries other than files and directories are skipped.
+func extractArchiveEntry(tarReader *tar.Reader, header *tar.Header, dir string) error {
+	name := path.Clean(header.Name)
+	if !strings.HasPrefix(name, archiveFilesDir+"/") {
+		return fmt.Errorf("%w: unexpected entry %s", ErrInvalidArchive, header.Name)
+	}
+	relativePath := strings.TrimPrefix(name, archiveFilesDir+"/")
+	if path.IsAbs(relativePath) || relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+		return fmt.Errorf("%w: entry %s points outside of the instance", ErrInvalidArchive, header.Name)
+	}
+	target := filepath.Join(dir, filepath.FromSlash(relativePath))
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, uio.FileModeURWXGRWXO)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), uio.FileModeURWXGRWXO); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, tarReader); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(target, header.ModTime, header.ModTime)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestExportImportInstance(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	instance.InstalledExtensions = []string{"foo@t0ast.cc"}
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	files := map[string]string{
+		filepath.Join(relativeProfilePath, "prefs.js"):      "user_pref(\"a\", 1);",
+		filepath.Join(relativeProfilePath, "places.sqlite"): "places",
+		".cache/torbrowser/cache-entry":                     "cached",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(instanceDir, name)), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, name), []byte(content), uio.FileModeURWGRWO))
+	}
+
+	archive := &bytes.Buffer{}
+	assert.NoError(t, ExportInstance(config, instance, archive))
+
+	_, err := ImportInstance(config, bytes.NewReader(archive.Bytes()), CollisionFail, nil)
+	assert.ErrorIs(t, err, ErrInstanceExists)
+
+	assert.NoError(t, DeleteInstance(config, instance, nil))
+	imported, err := ImportInstance(config, bytes.NewReader(archive.Bytes()), CollisionFail, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-1", imported.InstanceLabel)
+	assert.Nil(t, imported.UsageLabel)
+	assert.Equal(t, []string{"foo@t0ast.cc"}, imported.InstalledExtensions)
+
+	stored, err := GetProfileInstance(config, "test-1")
+	assert.NoError(t, err)
+	assert.Equal(t, imported.InstalledExtensions, stored.InstalledExtensions)
+	for _, name := range []string{filepath.Join(relativeProfilePath, "prefs.js"), filepath.Join(relativeProfilePath, "places.sqlite")} {
+		content, err := os.ReadFile(filepath.Join(instanceDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, files[name], string(content))
+	}
+	assert.NoDirExists(t, filepath.Join(instanceDir, ".cache"))
+}
+
+func TestImportInstanceCollision(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectedErr   error
+		expectedLabel string
+		inUse         bool
+		policy        CollisionPolicy
+	}{
+		{
+			desc: "Fail",
+
+			expectedErr: ErrInstanceExists,
+			policy:      CollisionFail,
+		},
+		{
+			desc: "Suffix",
+
+			expectedLabel: "test-1-2",
+			policy:        CollisionSuffix,
+		},
+		{
+			desc: "Replace",
+
+			expectedLabel: "test-1",
+			policy:        CollisionReplace,
+		},
+		{
+			desc: "Replace instance in use",
+
+			expectedErr: ErrInstanceInUse,
+			inUse:       true,
+			policy:      CollisionReplace,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			instance.UsageLabel = nil
+			instance.InstalledExtensions = []string{"exported@t0ast.cc"}
+			assert.NoError(t, writeProfileInstanceForTest(config, instance))
+			archive := &bytes.Buffer{}
+			assert.NoError(t, ExportInstance(config, instance, archive))
+
+			instance.InstalledExtensions = []string{"existing@t0ast.cc"}
+			assert.NoError(t, writeProfileInstanceForTest(config, instance))
+			if tc.inUse {
+				unlock, err := LockInstance(config, instance)
+				assert.NoError(t, err)
+				defer unlock()
+			}
+
+			imported, err := ImportInstance(config, archive, tc.policy, nil)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedLabel, imported.InstanceLabel)
+			stored, err := GetProfileInstance(config, tc.expectedLabel)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"exported@t0ast.cc"}, stored.InstalledExtensions)
+		})
+	}
+}
+
+func TestExportInstanceInUse(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	defer unlock()
+	assert.ErrorIs(t, ExportInstance(config, instance, &bytes.Buffer{}), ErrInstanceInUse)
+}
+
+func TestImportInstanceInvalid(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	testCases := []struct {
+		desc string
+
+		entries  []string
+		metadata ProfileInstance
+	}{
+		{
+			desc: "Unknown profile",
+
+			metadata: ProfileInstance{InstanceLabel: "other-1", ProfileLabel: "other"},
+		},
+		{
+			desc: "Invalid label",
+
+			metadata: ProfileInstance{InstanceLabel: "../test-1", ProfileLabel: "test"},
+		},
+		{
+			desc: "Path traversal",
+
+			entries:  []string{"files/../../evil"},
+			metadata: ProfileInstance{InstanceLabel: "test-1", ProfileLabel: "test"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			archive := &bytes.Buffer{}
+			gzipWriter := gzip.NewWriter(archive)
+			tarWriter := tar.NewWriter(gzipWriter)
+			metadata, err := json.Marshal(tC.metadata)
+			assert.NoError(t, err)
+			assert.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: archiveMetadataName, Mode: 0600, Size: int64(len(metadata))}))
+			_, err = tarWriter.Write(metadata)
+			assert.NoError(t, err)
+			for _, entry := range tC.entries {
+				assert.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: entry, Mode: 0600}))
+			}
+			assert.NoError(t, tarWriter.Close())
+			assert.NoError(t, gzipWriter.Close())
+
+			_, err = ImportInstance(config, archive, CollisionFail, nil)
+			assert.Error(t, err)
+			assert.NoDirExists(t, filepath.Join(config.ProfilePath, "test-1"))
+			assert.NoFileExists(t, filepath.Join(config.ProfilePath, "evil"))
+		})
+	}
+}
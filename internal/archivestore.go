@@ -0,0 +1,429 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrArchiveCorrupted error = errors.New("The archive of the instance is corrupted")
+
+const (
+	// archiveChunksDirName is the directory in the state directory
+	// holding the chunks of all archived instances, named by the SHA-256
+	// sum of their content, so instances with the same files share them.
+	archiveChunksDirName = "archive-chunks"
+
+	// Files are split into chunks where the rolling hash of the last
+	// bytes matches archiveChunkMask, which makes the boundaries depend
+	// on the content rather than the offset. A change in the middle of
+	// a file therefore only changes the chunks around it.
+	minArchiveChunkSize = 512 << 10
+	maxArchiveChunkSize = 8 << 20
+	archiveChunkMask    = 1<<20 - 1
+)
+
+// archiveChunkGear maps bytes to the pseudo-random values the rolling
+// hash is made of. It is generated from a fixed seed, because changing
+// it would stop new archives from sharing chunks with existing ones.
+var archiveChunkGear = func() (gear [256]uint64) {
+	state := uint64(0x7462_6d6c)
+	for i := range gear {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+	return gear
+}()
+
+// instanceArchiveManifest lists the files of an archived instance and
+// the chunks their content is made of.
+type instanceArchiveManifest struct {
+	Entries []instanceArchiveEntry
+}
+
+type instanceArchiveEntry struct {
+	Chunks  []string `json:",omitempty"`
+	Dir     bool     `json:",omitempty"`
+	Mode    fs.FileMode
+	ModTime time.Time
+	// Path is slash-separated and relative to the instance directory.
+	Path string
+	Size int64
+}
+
+// ArchiveProblem is a damaged archive found by CheckArchivedInstances.
+type ArchiveProblem struct {
+	InstanceLabel string
+	Message       string
+}
+
+func getArchiveChunksDir(config Configuration) string {
+	return filepath.Join(getStateDir(config), archiveChunksDirName)
+}
+
+func getArchiveChunkPath(config Configuration, id string) string {
+	return filepath.Join(getArchiveChunksDir(config), id[:2], id)
+}
+
+func isValidArchiveChunkID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == sha256.Size && strings.ToLower(id) == id
+}
+
+// writeChunkedArchive stores the files of an instance in the chunk
+// store and writes a manifest of them to manifestPath. The manifest
+// only shows up once all chunks are stored.
+func writeChunkedArchive(config Configuration, instanceDir string, manifestPath string) error {
+	manifest := instanceArchiveManifest{Entries: []instanceArchiveEntry{}}
+	err := walkInstanceFiles(instanceDir, func(filePath string, relativePath string) error {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		entry := instanceArchiveEntry{
+			Dir:     info.IsDir(),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime().UTC(),
+			Path:    relativePath,
+		}
+		if !info.IsDir() {
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if err := splitIntoArchiveChunks(file, func(chunk []byte) error {
+				id, err := storeArchiveChunk(config, chunk)
+				if err != nil {
+					return err
+				}
+				entry.Chunks = append(entry.Chunks, id)
+				entry.Size += int64(len(chunk))
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(manifestPath, manifestBytes, uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// splitIntoArchiveChunks reads r to the end and calls store with each
+// chunk of its content. The chunk is only valid until store returns.
+func splitIntoArchiveChunks(r io.Reader, store func(chunk []byte) error) error {
+	reader := bufio.NewReaderSize(r, 1<<16)
+	chunk := make([]byte, 0, maxArchiveChunkSize)
+	var hash uint64
+	for {
+		b, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, b)
+		hash = hash<<1 + archiveChunkGear[b]
+		if len(chunk) >= maxArchiveChunkSize || len(chunk) >= minArchiveChunkSize && hash&archiveChunkMask == 0 {
+			if err := store(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+			hash = 0
+		}
+	}
+	if len(chunk) > 0 {
+		return store(chunk)
+	}
+	return nil
+}
+
+// storeArchiveChunk adds a chunk to the chunk store unless it is
+// already there and returns its ID. Chunks that are already there get
+// their modification time bumped, so they aren't collected as garbage
+// before the manifest referring to them is written.
+func storeArchiveChunk(config Configuration, chunk []byte) (id string, err error) {
+	sum := sha256.Sum256(chunk)
+	id = hex.EncodeToString(sum[:])
+	chunkPath := getArchiveChunkPath(config, id)
+	now := time.Now()
+	if err := os.Chtimes(chunkPath, now, now); err == nil {
+		return id, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", uerror.WithStackTrace(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(chunkPath), uio.FileModeURWXGRWXO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	tmpFile, err := os.CreateTemp(getArchiveChunksDir(config), ".chunk-*")
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	gzipWriter := gzip.NewWriter(tmpFile)
+	if _, err := gzipWriter.Write(chunk); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := os.Chmod(tmpFile.Name(), uio.FileModeURWGRWO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := os.Rename(tmpFile.Name(), chunkPath); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return id, nil
+}
+
+// readArchiveChunk reads a chunk from the chunk store and checks that
+// its content still matches its ID.
+func readArchiveChunk(config Configuration, id string) ([]byte, error) {
+	if !isValidArchiveChunkID(id) {
+		return nil, uerror.StackTracef("%w: invalid chunk ID %q", ErrArchiveCorrupted, id)
+	}
+	chunkFile, err := os.Open(getArchiveChunkPath(config, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, uerror.StackTracef("%w: chunk %s is missing", ErrArchiveCorrupted, id)
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer chunkFile.Close()
+	gzipReader, err := gzip.NewReader(chunkFile)
+	if err != nil {
+		return nil, uerror.StackTracef("%w: chunk %s: %s", ErrArchiveCorrupted, id, err)
+	}
+	chunk, err := io.ReadAll(io.LimitReader(gzipReader, maxArchiveChunkSize+1))
+	if err != nil {
+		return nil, uerror.StackTracef("%w: chunk %s: %s", ErrArchiveCorrupted, id, err)
+	}
+	if sum := sha256.Sum256(chunk); hex.EncodeToString(sum[:]) != id {
+		return nil, uerror.StackTracef("%w: chunk %s doesn't match its checksum", ErrArchiveCorrupted, id)
+	}
+	return chunk, nil
+}
+
+func readArchiveManifest(manifestPath string) (instanceArchiveManifest, error) {
+	manifest := instanceArchiveManifest{}
+	manifestBytes, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, uerror.WithStackTrace(err)
+	}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return manifest, uerror.StackTracef("%w: %s", ErrArchiveCorrupted, err)
+	}
+	return manifest, nil
+}
+
+// size is the total size of the files in the manifest.
+func (manifest instanceArchiveManifest) size() int64 {
+	var size int64
+	for _, entry := range manifest.Entries {
+		size += entry.Size
+	}
+	return size
+}
+
+// restoreChunkedArchive restores the files listed in a manifest to
+// instanceDir. Every chunk is checked against its ID while it is read.
+func restoreChunkedArchive(config Configuration, manifest instanceArchiveManifest, instanceDir string) error {
+	for _, entry := range manifest.Entries {
+		relativePath := path.Clean(entry.Path)
+		if path.IsAbs(relativePath) || relativePath == "." || relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+			return uerror.StackTracef("%w: entry %s points outside of the instance", ErrArchiveCorrupted, entry.Path)
+		}
+		target := filepath.Join(instanceDir, filepath.FromSlash(relativePath))
+		if entry.Dir {
+			if err := os.MkdirAll(target, uio.FileModeURWXGRWXO); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			continue
+		}
+		if err := restoreChunkedFile(config, entry, target); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
+
+func restoreChunkedFile(config Configuration, entry instanceArchiveEntry, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), uio.FileModeURWXGRWXO); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, id := range entry.Chunks {
+		chunk, err := readArchiveChunk(config, id)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Write(chunk); err != nil {
+			file.Close()
+			return err
+		}
+		size += int64(len(chunk))
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if size != entry.Size {
+		return fmt.Errorf("%w: %s has %d bytes instead of %d", ErrArchiveCorrupted, entry.Path, size, entry.Size)
+	}
+	return os.Chtimes(target, entry.ModTime, entry.ModTime)
+}
+
+// CheckArchivedInstances reads the archives of all archived instances
+// and reports the ones that couldn't be restored because a chunk is
+// missing or its content doesn't match its checksum anymore. Chunks
+// shared by several instances are only read once.
+func CheckArchivedInstances(config Configuration, warnings *Warnings) ([]ArchiveProblem, error) {
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	checked := make(map[string]error)
+	problems := []ArchiveProblem{}
+	for _, instance := range instances {
+		manifestPath := getArchivedInstancePath(config, instance)
+		if exists, err := uio.FileExists(manifestPath); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		} else if !exists {
+			continue
+		}
+		manifest, err := readArchiveManifest(manifestPath)
+		if err != nil {
+			problems = append(problems, ArchiveProblem{InstanceLabel: instance.InstanceLabel, Message: uerror.Message(err)})
+			continue
+		}
+		for _, entry := range manifest.Entries {
+			for _, id := range entry.Chunks {
+				chunkErr, ok := checked[id]
+				if !ok {
+					_, chunkErr = readArchiveChunk(config, id)
+					checked[id] = chunkErr
+				}
+				if chunkErr != nil {
+					problems = append(problems, ArchiveProblem{
+						InstanceLabel: instance.InstanceLabel,
+						Message:       fmt.Sprintf("%s: %s", entry.Path, uerror.Message(chunkErr)),
+					})
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// findUnreferencedArchiveChunks finds the chunks no archived instance
+// refers to anymore. Chunks that were stored recently are left alone,
+// since the instance they belong to may still be being archived.
+func findUnreferencedArchiveChunks(config Configuration, now time.Time) ([]string, error) {
+	referenced := make(map[string]bool)
+	instanceDirEntries, err := os.ReadDir(config.ProfilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	for _, dirEntry := range instanceDirEntries {
+		if !dirEntry.IsDir() || isReservedProfilePathEntry(dirEntry.Name()) {
+			continue
+		}
+		manifestPath := filepath.Join(config.ProfilePath, dirEntry.Name(), archivedInstanceFileName)
+		manifest, err := readArchiveManifest(manifestPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			// Deleting chunks another manifest might refer to is worse
+			// than keeping some garbage around.
+			return nil, uerror.WithStackTrace(err)
+		}
+		for _, entry := range manifest.Entries {
+			for _, id := range entry.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	unreferenced := []string{}
+	chunksDir := getArchiveChunksDir(config)
+	err = filepath.WalkDir(chunksDir, func(chunkPath string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && chunkPath == chunksDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		// Temporary files are left to findStaleTempFiles.
+		if d.IsDir() || !isValidArchiveChunkID(d.Name()) || referenced[d.Name()] {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) > staleTempFileAge {
+			unreferenced = append(unreferenced, chunkPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	sort.Strings(unreferenced)
+	return unreferenced, nil
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestSplitIntoArchiveChunks(t *testing.T) {
+	content := make([]byte, 6*maxArchiveChunkSize)
+	rand.New(rand.NewSource(1)).Read(content)
+	split := func(content []byte) []string {
+		chunks := []string{}
+		assert.NoError(t, splitIntoArchiveChunks(bytes.NewReader(content), func(chunk []byte) error {
+			assert.LessOrEqual(t, len(chunk), maxArchiveChunkSize)
+			chunks = append(chunks, string(chunk))
+			return nil
+		}))
+		return chunks
+	}
+
+	chunks := split(content)
+	assert.Greater(t, len(chunks), 6)
+	joined := ""
+	for _, chunk := range chunks {
+		joined += chunk
+	}
+	assert.Equal(t, string(content), joined)
+
+	// Inserting bytes only changes the chunk they are inserted into,
+	// the following chunks are found again.
+	changed := append(append(append([]byte{}, content[:len(chunks[0])+10]...), "inserted"...), content[len(chunks[0])+10:]...)
+	changedChunks := split(changed)
+	assert.Equal(t, chunks[0], changedChunks[0])
+	assert.NotEqual(t, chunks[1], changedChunks[1])
+	assert.Equal(t, chunks[2:], changedChunks[2:])
+
+	assert.Empty(t, split(nil))
+}
+
+func TestArchiveChunkStore(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	other := instance
+	other.InstanceLabel = "test-2"
+	otherDir := filepath.Join(config.ProfilePath, other.InstanceLabel)
+	for _, i := range []ProfileInstance{instance, other} {
+		assert.NoError(t, writeProfileInstanceForTest(config, i))
+	}
+	write := func(dir string, name string, content string) {
+		path := filepath.Join(dir, relativeProfilePath, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, []byte(content), uio.FileModeURWGRWO))
+	}
+	write(instanceDir, "places.sqlite", "shared")
+	write(instanceDir, "prefs.js", "user_pref(\"a\", 1);")
+	write(otherDir, "places.sqlite", "shared")
+	write(otherDir, "prefs.js", "user_pref(\"a\", 2);")
+	write(otherDir, "empty", "")
+
+	assert.NoError(t, ArchiveInstance(config, instance, nil))
+	assert.NoError(t, ArchiveInstance(config, other, nil))
+	chunks, err := uio.DirSize(getArchiveChunksDir(config))
+	assert.NoError(t, err)
+	assert.NotZero(t, chunks)
+	manifest, err := readArchiveManifest(getArchivedInstancePath(config, other))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("shared")+len("user_pref(\"a\", 2);")), manifest.size())
+	problems, err := CheckArchivedInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// The shared file is stored once, so damaging its chunk damages
+	// both archives.
+	sharedChunk := getArchiveChunkPath(config, manifestChunk(t, manifest, "places.sqlite"))
+	assert.NoError(t, os.WriteFile(sharedChunk, []byte("damaged"), uio.FileModeURWGRWO))
+	problems, err = CheckArchivedInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, problems, 2)
+	stored, err := GetProfileInstance(config, other.InstanceLabel)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, UnarchiveInstance(config, stored, nil), ErrArchiveCorrupted)
+	stored, err = GetProfileInstance(config, other.InstanceLabel)
+	assert.NoError(t, err)
+	assert.True(t, stored.Archived)
+	assert.FileExists(t, getArchivedInstancePath(config, other))
+
+	// Storing the chunk again, like archiving another instance with
+	// the same file does, repairs it.
+	assert.NoError(t, os.Remove(sharedChunk))
+	_, err = storeArchiveChunk(config, []byte("shared"))
+	assert.NoError(t, err)
+	assert.NoError(t, UnarchiveInstance(config, stored, nil))
+	for name, content := range map[string]string{"places.sqlite": "shared", "prefs.js": "user_pref(\"a\", 2);", "empty": ""} {
+		restored, err := os.ReadFile(filepath.Join(otherDir, relativeProfilePath, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(restored))
+	}
+
+	// Chunks only the unarchived instance used are garbage once they
+	// are old enough, the ones the other archive uses are not.
+	unreferenced, err := findUnreferencedArchiveChunks(config, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, unreferenced)
+	unreferenced, err = findUnreferencedArchiveChunks(config, time.Now().Add(2*staleTempFileAge))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{getArchiveChunkPath(config, manifestChunk(t, manifest, "prefs.js"))}, unreferenced)
+}
+
+func TestUnarchiveLegacyInstance(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instance.Archived = true
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	filesDir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(filesDir, relativeProfilePath), uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(filepath.Join(filesDir, relativeProfilePath, "prefs.js"), []byte("prefs"), uio.FileModeURWGRWO))
+	archive, err := os.Create(getLegacyArchivedInstancePath(config, instance))
+	assert.NoError(t, err)
+	gzipWriter := gzip.NewWriter(archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	assert.NoError(t, addInstanceFilesToArchive(tarWriter, filesDir))
+	assert.NoError(t, tarWriter.Close())
+	assert.NoError(t, gzipWriter.Close())
+	assert.NoError(t, archive.Close())
+
+	assert.NoError(t, UnarchiveInstance(config, instance, nil))
+	restored, err := os.ReadFile(filepath.Join(instanceDir, relativeProfilePath, "prefs.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, "prefs", string(restored))
+	assert.NoFileExists(t, getLegacyArchivedInstancePath(config, instance))
+	stored, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.False(t, stored.Archived)
+}
+
+func manifestChunk(t *testing.T, manifest instanceArchiveManifest, name string) string {
+	for _, entry := range manifest.Entries {
+		if filepath.Base(entry.Path) == name {
+			assert.Len(t, entry.Chunks, 1)
+			return entry.Chunks[0]
+		}
+	}
+	t.Fatalf("%s is not in the manifest", name)
+	return ""
+}
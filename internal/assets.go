@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"embed"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrUnknownBuiltinAsset error = errors.New("Unknown builtin asset")
+
+// builtinPrefix marks a file reference in the configuration as one of
+// the assets bundled with tbml, e.g. "builtin:baseline".
+const builtinPrefix = "builtin:"
+
+//go:embed assets
+var assetFiles embed.FS
+
+// builtinAssets maps the names of the bundled assets to their files in
+// assetFiles.
+var builtinAssets = map[string]string{
+	"baseline":      "baseline.user.js",
+	"desktop-entry": "desktop-entry.desktop",
+	"profile":       "icons/profile.svg",
+	"starter":       "starter.userChrome.css",
+	"tbml":          "icons/tbml.svg",
+	"topic":         "icons/topic.svg",
+}
+
+// GetBuiltinAssetNames returns the names of the bundled assets, sorted.
+func GetBuiltinAssetNames() []string {
+	names := make([]string, 0, len(builtinAssets))
+	for name := range builtinAssets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseBuiltinReference returns the asset name of a "builtin:" file
+// reference. ok is false for other references.
+func ParseBuiltinReference(reference string) (name string, ok bool) {
+	if !strings.HasPrefix(reference, builtinPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(reference, builtinPrefix), true
+}
+
+// ReadBuiltinAsset returns the contents of the bundled asset with the
+// given name.
+func ReadBuiltinAsset(name string) ([]byte, error) {
+	fileName, ok := builtinAssets[name]
+	if !ok {
+		return nil, uerror.StackTracef("%w: %s", ErrUnknownBuiltinAsset, name)
+	}
+	content, err := assetFiles.ReadFile(path.Join("assets", fileName))
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return content, nil
+}
+
+// GetBuiltinAssetExt returns the file name extension of the bundled
+// asset with the given name, e.g. ".svg".
+func GetBuiltinAssetExt(name string) string {
+	return path.Ext(builtinAssets[name])
+}
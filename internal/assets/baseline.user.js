@@ -0,0 +1,31 @@
+// tbml's baseline: settings for a browser that only talks to the sites
+// it is told to and keeps quiet about the rest. Load it with
+// "UserJSFile": "builtin:baseline" and override single prefs with the
+// Prefs of the profile or topic.
+
+// No checks, tours and notes about updates on startup.
+user_pref("browser.aboutwelcome.enabled", false);
+user_pref("browser.shell.checkDefaultBrowser", false);
+user_pref("browser.startup.homepage_override.mstone", "ignore");
+
+// No reports to Mozilla.
+user_pref("app.shield.optoutstudies.enabled", false);
+user_pref("browser.crashReports.unsubmittedCheck.autoSubmit2", false);
+user_pref("datareporting.healthreport.uploadEnabled", false);
+user_pref("datareporting.policy.dataSubmissionEnabled", false);
+user_pref("toolkit.telemetry.enabled", false);
+user_pref("toolkit.telemetry.unified", false);
+
+// No connections to sites that weren't visited.
+user_pref("browser.send_pings", false);
+user_pref("network.dns.disablePrefetch", true);
+user_pref("network.predictor.enabled", false);
+user_pref("network.prefetch-next", false);
+
+// Only encrypted connections, and nothing typed in forms is kept.
+user_pref("browser.formfill.enable", false);
+user_pref("dom.security.https_only_mode", true);
+user_pref("signon.autofillForms", false);
+
+// Lets the profile's userChrome.css, e.g. builtin:starter, take effect.
+user_pref("toolkit.legacyUserProfileCustomizations.stylesheets", true);
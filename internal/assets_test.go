@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBuiltinAsset(t *testing.T) {
+	for _, name := range GetBuiltinAssetNames() {
+		content, err := ReadBuiltinAsset(name)
+		assert.NoError(t, err, name)
+		assert.NotEmpty(t, content, name)
+	}
+	_, err := ReadBuiltinAsset("unknown")
+	assert.ErrorIs(t, err, ErrUnknownBuiltinAsset)
+}
+
+func TestWriteUserJSBuiltin(t *testing.T) {
+	profileDir := t.TempDir()
+	assert.NoError(t, writeUserJS(Configuration{}, []userJSLayer{
+		{Files: []string{"builtin:baseline"}},
+		{Prefs: []userPref{{"dom.security.https_only_mode", false}}},
+	}, "/nonexistent", profileDir))
+
+	userJS, err := os.ReadFile(filepath.Join(profileDir, "user.js"))
+	assert.NoError(t, err)
+	baseline, err := ReadBuiltinAsset("baseline")
+	assert.NoError(t, err)
+	assert.Equal(t, string(baseline)+"user_pref(\"dom.security.https_only_mode\", false);\n", string(userJS))
+
+	checksum, err := hashConfigFile(Configuration{}, "/nonexistent", "builtin:baseline")
+	assert.NoError(t, err)
+	assert.Len(t, checksum, 64)
+}
+
+func TestValidateConfigurationBuiltin(t *testing.T) {
+	profilePath := t.TempDir()
+	config := Configuration{
+		ProfilePath: profilePath,
+		Profiles: []ProfileConfiguration{{
+			Label:          "test",
+			UserChromeFile: strPtr("builtin:starter"),
+			UserJSFile:     strPtr("builtin:nothing"),
+		}},
+	}
+	err := ValidateConfiguration(config, "/nonexistent")
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+	assert.Contains(t, err.Error(), "Profiles.0.UserJSFile")
+	assert.NotContains(t, err.Error(), "Profiles.0.UserChromeFile")
+}
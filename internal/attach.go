@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrProcessNotRunning error = errors.New("Process is not running")
+
+// AttachInstance records that a browser started outside of tbml is
+// using the instance, so the instance counts as in use for the given
+// topic until the process exits. tbml holds no lock for the browser;
+// instead, the process is checked for whether it is still alive.
+func AttachInstance(config Configuration, instance ProfileInstance, pid int, usageLabel *string) error {
+	if pid <= 0 || !isProcessAlive(pid) {
+		return uerror.StackTracef("%w: %d", ErrProcessNotRunning, pid)
+	}
+	unlockInstance, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlockInstance()
+
+	instance, err = GetProfileInstance(config, instance.InstanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.Attached = true
+	instance.LastUsed = time.Now()
+	instance.UsageLabel = usageLabel
+	instance.UsagePID = &pid
+	if err := writeProfileInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	ulog.Default().Info("Attached instance", "instance", instance.InstanceLabel, "pid", pid)
+	return nil
+}
+
+// isAttachedProcessAlive tells whether the instance is attached to a
+// browser started outside of tbml that is still running.
+func isAttachedProcessAlive(instance ProfileInstance) bool {
+	return instance.Attached && instance.UsagePID != nil && isProcessAlive(*instance.UsagePID)
+}
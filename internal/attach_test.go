@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachInstance(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	topic := "news"
+	deadPID := findDeadPID(t)
+	assert.ErrorIs(t, AttachInstance(config, instance, deadPID, &topic), ErrProcessNotRunning)
+
+	ownPID := os.Getpid()
+	assert.NoError(t, AttachInstance(config, instance, ownPID, &topic))
+
+	// The instance counts as in use while the process is alive, even
+	// though nobody holds its lock.
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.True(t, instances[0].Attached)
+		assert.Equal(t, &ownPID, instances[0].UsagePID)
+		assert.Equal(t, &topic, instances[0].UsageLabel)
+	}
+	_, err = LockInstance(config, instance)
+	assert.ErrorIs(t, err, ErrInstanceInUse)
+	assert.ErrorIs(t, AttachInstance(config, instance, ownPID, nil), ErrInstanceInUse)
+	results, err := ReapDeadInstances(config, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	// Once the process is gone, the instance is released like any
+	// other dead instance.
+	attached, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	attached.UsagePID = &deadPID
+	assert.NoError(t, writeProfileInstance(config, attached))
+	results, err = ReapDeadInstances(config, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	released, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.False(t, released.Attached)
+	assert.Nil(t, released.UsagePID)
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, unlock())
+}
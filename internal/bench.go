@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const (
+	syntheticInstanceCount = 100
+	syntheticTreeFiles     = 200
+	syntheticTreeFileSize  = 16 * 1024
+)
+
+// BenchmarkResult is the timing of one operation measured by
+// RunBenchmarks.
+type BenchmarkResult struct {
+	Iterations int
+	Name       string
+	Total      time.Duration
+}
+
+func (r BenchmarkResult) PerIteration() time.Duration {
+	if r.Iterations == 0 {
+		return 0
+	}
+	return r.Total / time.Duration(r.Iterations)
+}
+
+type storageBenchmark struct {
+	name string
+	run  func(i int) error
+}
+
+// RunBenchmarks times instance listing, selection, provisioning,
+// metadata writes and copying a profile tree against synthetic data.
+// The data is created in a scratch directory in the state directory,
+// so the timings reflect the filesystem real instances live on.
+func RunBenchmarks(config Configuration, iterations int) ([]BenchmarkResult, error) {
+	if err := os.MkdirAll(getStateDir(config), uio.FileModeURWXGRWXO); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	scratchDir, err := os.MkdirTemp(getStateDir(config), "bench-*")
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	benchConfig := Configuration{ProfilePath: filepath.Join(scratchDir, "profiles")}
+	if err := createSyntheticInstances(benchConfig, syntheticInstanceCount); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	treeDir := filepath.Join(scratchDir, "tree")
+	if err := createSyntheticTree(treeDir, syntheticTreeFiles, syntheticTreeFileSize); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	instances, err := GetProfileInstances(benchConfig, nil)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	profile := ProfileConfiguration{Label: "bench"}
+
+	benchmarks := []storageBenchmark{
+		{
+			name: fmt.Sprintf("list %d instances", syntheticInstanceCount),
+			run: func(i int) error {
+				_, err := GetProfileInstances(benchConfig, nil)
+				return err
+			},
+		},
+		{
+			name: fmt.Sprintf("select among %d instances", syntheticInstanceCount),
+			run: func(i int) error {
+				GetBestInstance(profile, instances)
+				return nil
+			},
+		},
+		{
+			name: "write metadata",
+			run: func(i int) error {
+				instance := instances[i%len(instances)]
+				instance.LastUsed = time.Now()
+				return writeProfileInstance(benchConfig, instance)
+			},
+		},
+		{
+			name: "provision instance",
+			run: func(i int) error {
+				instanceDir := filepath.Join(scratchDir, fmt.Sprintf("provision-%d", i))
+				if err := ensureFiles(benchConfig, profile, nil, scratchDir, instanceDir); err != nil {
+					return err
+				}
+				return writeProfilePrefs(profile, instanceDir)
+			},
+		},
+	}
+	// Copying is compared to the cheaper ways CloneStrategy offers, so
+	// users can tell which pays off on their file system.
+	for _, strategy := range []uio.CloneStrategy{uio.CloneCopy, uio.CloneReflink, uio.CloneHardlink} {
+		strategy := strategy
+		benchmarks = append(benchmarks, storageBenchmark{
+			name: fmt.Sprintf("%s %d files (%s)", strategy, syntheticTreeFiles, uio.FormatByteSize(syntheticTreeFiles*syntheticTreeFileSize)),
+			run: func(i int) error {
+				return uio.CloneDir(treeDir, filepath.Join(scratchDir, fmt.Sprintf("%s-%d", strategy, i)), strategy)
+			},
+		})
+	}
+
+	results := []BenchmarkResult{}
+	for _, benchmark := range benchmarks {
+		start := time.Now()
+		for i := 0; i < iterations; i++ {
+			if err := benchmark.run(i); err != nil {
+				return nil, uerror.StackTracef("Benchmark %s failed: %w", benchmark.name, err)
+			}
+		}
+		results = append(results, BenchmarkResult{
+			Iterations: iterations,
+			Name:       benchmark.name,
+			Total:      time.Since(start),
+		})
+	}
+	return results, nil
+}
+
+// createSyntheticInstances creates count instances of a profile called
+// "bench" with metadata only.
+func createSyntheticInstances(config Configuration, count int) error {
+	created := time.Now().Add(-time.Duration(count) * time.Hour)
+	for i := 1; i <= count; i++ {
+		instance := ProfileInstance{
+			Created:             created.Add(time.Duration(i) * time.Hour),
+			InstalledExtensions: []string{"foo@t0ast.cc"},
+			InstanceLabel:       fmt.Sprintf("bench-%d", i),
+			LastUsed:            created.Add(time.Duration(i) * time.Hour),
+			ProfileLabel:        "bench",
+		}
+		if err := os.MkdirAll(getInstanceDir(config, instance), uio.FileModeURWXGRWXO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := writeProfileInstance(config, instance); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
+
+// createSyntheticTree creates a directory tree resembling a browser
+// profile: files of the given size spread over a few subdirectories.
+func createSyntheticTree(dir string, files int, fileSize int) error {
+	content := bytes.Repeat([]byte{'x'}, fileSize)
+	for i := 0; i < files; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir-%d", i%10), fmt.Sprintf("file-%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := os.WriteFile(path, content, uio.FileModeURWGRWO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func setUpBenchmarkEnvironment(b *testing.B) (config Configuration, cleanup func()) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "tbml-bench-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	config = Configuration{ProfilePath: filepath.Join(tmpDir, "profiles")}
+	if err := createSyntheticInstances(config, syntheticInstanceCount); err != nil {
+		b.Fatal(err)
+	}
+	return config, func() {
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func BenchmarkGetProfileInstances(b *testing.B) {
+	config, cleanup := setUpBenchmarkEnvironment(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetProfileInstances(config, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBestInstance(b *testing.B) {
+	config, cleanup := setUpBenchmarkEnvironment(b)
+	defer cleanup()
+	instances, err := GetProfileInstances(config, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	profile := ProfileConfiguration{Label: "bench"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GetBestInstance(profile, instances)
+	}
+}
+
+func BenchmarkWriteProfileInstance(b *testing.B) {
+	config, cleanup := setUpBenchmarkEnvironment(b)
+	defer cleanup()
+	instances, err := GetProfileInstances(config, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		instance := instances[i%len(instances)]
+		instance.LastUsed = time.Now()
+		if err := writeProfileInstance(config, instance); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProvisionInstance(b *testing.B) {
+	config, cleanup := setUpBenchmarkEnvironment(b)
+	defer cleanup()
+	profile := ProfileConfiguration{
+		Label:   "bench",
+		Storage: &StorageConfiguration{CacheCapacityKiB: intPtr(51200)},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		instanceDir := filepath.Join(config.ProfilePath, fmt.Sprintf("provision-%d", i))
+		if err := ensureFiles(config, profile, nil, config.ProfilePath, instanceDir); err != nil {
+			b.Fatal(err)
+		}
+		if err := writeProfilePrefs(profile, instanceDir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyProfileTree(b *testing.B) {
+	config, cleanup := setUpBenchmarkEnvironment(b)
+	defer cleanup()
+	treeDir := filepath.Join(config.ProfilePath, "tree")
+	if err := createSyntheticTree(treeDir, syntheticTreeFiles, syntheticTreeFileSize); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(syntheticTreeFiles * syntheticTreeFileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := uio.CopyDir(treeDir, filepath.Join(config.ProfilePath, fmt.Sprintf("copy-%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRunBenchmarks(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	results, err := RunBenchmarks(config, 1)
+	assert.NoError(t, err)
+	assert.Len(t, results, 7)
+
+	entries, err := os.ReadDir(getStateDir(config))
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "scratch directory was not removed")
+}
@@ -0,0 +1,429 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrInvalidBookmarkFormat error = errors.New("Invalid bookmark format")
+
+// BookmarkFormat is a file format for bookmarks.
+type BookmarkFormat string
+
+const (
+	// BookmarkFormatHTML is the Netscape bookmark file format, which
+	// browsers import and export.
+	BookmarkFormatHTML BookmarkFormat = "html"
+	// BookmarkFormatJSON is Bookmarks encoded as JSON.
+	BookmarkFormatJSON BookmarkFormat = "json"
+)
+
+func ParseBookmarkFormat(s string) (BookmarkFormat, error) {
+	switch format := BookmarkFormat(s); format {
+	case BookmarkFormatHTML, BookmarkFormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidBookmarkFormat, s)
+}
+
+type BookmarkType string
+
+const (
+	BookmarkTypeBookmark  BookmarkType = "bookmark"
+	BookmarkTypeFolder    BookmarkType = "folder"
+	BookmarkTypeSeparator BookmarkType = "separator"
+)
+
+// Bookmark is a bookmark, folder or separator. The JSON field names
+// must stay stable, since exported files are imported again.
+type Bookmark struct {
+	// Children are the contents of a folder.
+	Children  []Bookmark   `json:"children,omitempty"`
+	DateAdded time.Time    `json:"dateAdded"`
+	Title     string       `json:"title,omitempty"`
+	Type      BookmarkType `json:"type"`
+	URL       string       `json:"url,omitempty"`
+}
+
+// Bookmarks are the contents of the browser's root folders.
+type Bookmarks struct {
+	Menu    []Bookmark `json:"menu"`
+	Mobile  []Bookmark `json:"mobile"`
+	Toolbar []Bookmark `json:"toolbar"`
+	Unfiled []Bookmark `json:"unfiled"`
+}
+
+// bookmarkRoots are the GUIDs of the browser's root folders.
+var bookmarkRoots = []struct {
+	guid    string
+	folder  func(bookmarks *Bookmarks) *[]Bookmark
+	htmlTag string
+	title   string
+}{
+	{"menu________", func(b *Bookmarks) *[]Bookmark { return &b.Menu }, "", "Bookmarks Menu"},
+	{"toolbar_____", func(b *Bookmarks) *[]Bookmark { return &b.Toolbar }, "PERSONAL_TOOLBAR_FOLDER", "Bookmarks Toolbar"},
+	{"unfiled_____", func(b *Bookmarks) *[]Bookmark { return &b.Unfiled }, "UNFILED_BOOKMARKS_FOLDER", "Other Bookmarks"},
+	{"mobile______", func(b *Bookmarks) *[]Bookmark { return &b.Mobile }, "MOBILE_BOOKMARKS_FOLDER", "Mobile Bookmarks"},
+}
+
+// Types of moz_bookmarks entries.
+const (
+	placesTypeBookmark  = 1
+	placesTypeFolder    = 2
+	placesTypeSeparator = 3
+)
+
+// ExportBookmarks writes the bookmarks of an instance that isn't in
+// use in the given format. Tags and other internal folders of the
+// browser are left out. An instance whose browser never ran has no
+// bookmarks.
+func ExportBookmarks(config Configuration, instance ProfileInstance, format BookmarkFormat, w io.Writer) error {
+	var bookmarks Bookmarks
+	err := withPlacesDatabase(config, instance, func(path string) error {
+		var err error
+		bookmarks, err = readBookmarks(path)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrNoPlacesDatabase) {
+		return uerror.WithStackTrace(err)
+	}
+	return encodeBookmarks(bookmarks, format, w)
+}
+
+// ImportBookmarks adds the bookmarks from an HTML or JSON file, like
+// ExportBookmarks writes them, to an instance that isn't in use. They
+// are added after the existing bookmarks of each root folder, without
+// looking for duplicates. Bookmarks outside of the root folders of an
+// HTML file go to the bookmarks menu. If the instance's browser never
+// ran, the returned error wraps ErrNoPlacesDatabase.
+func ImportBookmarks(config Configuration, instance ProfileInstance, file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	bookmarks, err := decodeBookmarks(content)
+	if err != nil {
+		return uerror.StackTracef("Failed to read %s: %w", file, err)
+	}
+	return withPlacesDatabase(config, instance, func(path string) error {
+		return writeBookmarks(path, bookmarks, time.Now())
+	})
+}
+
+// withPlacesDatabase calls fn with the path of the places database of
+// an instance that isn't in use, see withLockedProfileDir.
+func withPlacesDatabase(config Configuration, instance ProfileInstance, fn func(path string) error) error {
+	return withLockedProfileDir(config, instance, func(profileDir string) error {
+		path, err := getPlacesDatabasePath(profileDir)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return fn(path)
+	})
+}
+
+type placesBookmarkRow struct {
+	DateAdded int64  `json:"dateAdded"`
+	GUID      string `json:"guid"`
+	ID        int64  `json:"id"`
+	Parent    int64  `json:"parent"`
+	Title     string `json:"title"`
+	Type      int    `json:"type"`
+	URL       string `json:"url"`
+}
+
+func readBookmarks(path string) (Bookmarks, error) {
+	var bookmarks Bookmarks
+	rows := []placesBookmarkRow{}
+	err := querySQLite(path, `SELECT b.id, b.guid, b.type, b.parent, b.title, b.dateAdded, p.url
+		FROM moz_bookmarks b LEFT JOIN moz_places p ON p.id = b.fk
+		ORDER BY b.parent, b.position;`, &rows)
+	if err != nil {
+		return bookmarks, uerror.WithStackTrace(err)
+	}
+
+	children := map[int64][]placesBookmarkRow{}
+	for _, row := range rows {
+		children[row.Parent] = append(children[row.Parent], row)
+	}
+	var toBookmarks func(parent int64) []Bookmark
+	toBookmarks = func(parent int64) []Bookmark {
+		list := []Bookmark{}
+		for _, row := range children[parent] {
+			bookmark := Bookmark{
+				DateAdded: time.UnixMicro(row.DateAdded).UTC(),
+				Title:     row.Title,
+			}
+			switch row.Type {
+			case placesTypeBookmark:
+				bookmark.Type = BookmarkTypeBookmark
+				bookmark.URL = row.URL
+			case placesTypeFolder:
+				bookmark.Type = BookmarkTypeFolder
+				bookmark.Children = toBookmarks(row.ID)
+			case placesTypeSeparator:
+				bookmark.Type = BookmarkTypeSeparator
+			default:
+				continue
+			}
+			list = append(list, bookmark)
+		}
+		return list
+	}
+	for _, row := range rows {
+		for _, root := range bookmarkRoots {
+			if row.GUID == root.guid {
+				*root.folder(&bookmarks) = toBookmarks(row.ID)
+			}
+		}
+	}
+	return bookmarks, nil
+}
+
+// writeBookmarks adds bookmarks to a places database. The browser
+// maintains some columns with triggers that only exist while it runs,
+// so they are filled in here.
+func writeBookmarks(path string, bookmarks Bookmarks, now time.Time) error {
+	statements := []string{}
+	var addBookmarks func(parentGUID string, list []Bookmark) error
+	addBookmarks = func(parentGUID string, list []Bookmark) error {
+		for _, bookmark := range list {
+			guid, err := newPlacesGUID()
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			dateAdded := bookmark.DateAdded
+			if dateAdded.IsZero() {
+				dateAdded = now
+			}
+			parent := fmt.Sprintf("(SELECT id FROM moz_bookmarks WHERE guid = %s)", quoteSQL(parentGUID))
+			fk := "NULL"
+			placesType := placesTypeSeparator
+			switch bookmark.Type {
+			case BookmarkTypeBookmark:
+				placeStatements, place, err := ensurePlace(bookmark.URL)
+				if err != nil {
+					return uerror.WithStackTrace(err)
+				}
+				statements = append(statements, placeStatements...)
+				fk, placesType = place, placesTypeBookmark
+			case BookmarkTypeFolder:
+				placesType = placesTypeFolder
+			case BookmarkTypeSeparator:
+			default:
+				return uerror.StackTracef("Unknown bookmark type: %s", bookmark.Type)
+			}
+			statements = append(statements, fmt.Sprintf(`INSERT INTO moz_bookmarks
+				(type, fk, parent, position, title, dateAdded, lastModified, guid, syncStatus, syncChangeCounter)
+				VALUES (%d, %s, %s, (SELECT COUNT(*) FROM moz_bookmarks WHERE parent = %s), %s, %d, %d, %s, 1, 1)`,
+				placesType, fk, parent, parent, quoteSQL(bookmark.Title), dateAdded.UnixMicro(), now.UnixMicro(), quoteSQL(guid)))
+			if placesType == placesTypeBookmark {
+				statements = append(statements, fmt.Sprintf("UPDATE moz_places SET foreign_count = foreign_count + 1 WHERE id = %s", fk))
+			}
+			if placesType == placesTypeFolder {
+				if err := addBookmarks(guid, bookmark.Children); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, root := range bookmarkRoots {
+		if err := addBookmarks(root.guid, *root.folder(&bookmarks)); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+	return execSQLite(path, statements)
+}
+
+// ensurePlace returns the statements that add a URL to moz_places and
+// moz_origins unless it is there already, and the SQL expression for
+// the place's ID.
+func ensurePlace(rawURL string) ([]string, string, error) {
+	guid, err := newPlacesGUID()
+	if err != nil {
+		return nil, "", uerror.WithStackTrace(err)
+	}
+	url := quoteSQL(rawURL)
+	hash := hashPlacesURL(rawURL)
+	prefix, host := getPlacesOrigin(rawURL)
+	origin := fmt.Sprintf("(SELECT id FROM moz_origins WHERE prefix = %s AND host = %s)", quoteSQL(prefix), quoteSQL(host))
+	place := fmt.Sprintf("(SELECT id FROM moz_places WHERE url_hash = %d AND url = %s)", hash, url)
+	return []string{
+		fmt.Sprintf("INSERT OR IGNORE INTO moz_origins (prefix, host, frecency) VALUES (%s, %s, 1)", quoteSQL(prefix), quoteSQL(host)),
+		fmt.Sprintf(`INSERT INTO moz_places (url, url_hash, rev_host, guid, frecency, origin_id)
+			SELECT %s, %d, %s, %s, 1, %s WHERE NOT EXISTS %s`,
+			url, hash, quoteSQL(reversePlacesHost(rawURL)), quoteSQL(guid), origin, place),
+	}, place, nil
+}
+
+func encodeBookmarks(bookmarks Bookmarks, format BookmarkFormat, w io.Writer) error {
+	switch format {
+	case BookmarkFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return uerror.WithStackTrace(encoder.Encode(bookmarks))
+	case BookmarkFormatHTML:
+		return writeBookmarksHTML(bookmarks, w)
+	}
+	return uerror.StackTracef("%w: %s", ErrInvalidBookmarkFormat, format)
+}
+
+// decodeBookmarks reads bookmarks in either format, telling them apart
+// by their first character.
+func decodeBookmarks(content []byte) (Bookmarks, error) {
+	var bookmarks Bookmarks
+	if trimmed := strings.TrimSpace(string(content)); strings.HasPrefix(trimmed, "{") {
+		err := json.Unmarshal(content, &bookmarks)
+		return bookmarks, uerror.WithStackTrace(err)
+	}
+	return readBookmarksHTML(string(content)), nil
+}
+
+func writeBookmarksHTML(bookmarks Bookmarks, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks Menu</H1>
+
+<DL><p>
+`)
+	var writeList func(list []Bookmark, indent string)
+	writeList = func(list []Bookmark, indent string) {
+		for _, bookmark := range list {
+			addDate := bookmark.DateAdded.Unix()
+			switch bookmark.Type {
+			case BookmarkTypeBookmark:
+				fmt.Fprintf(bw, "%s<DT><A HREF=\"%s\" ADD_DATE=\"%d\">%s</A>\n", indent, html.EscapeString(bookmark.URL), addDate, html.EscapeString(bookmark.Title))
+			case BookmarkTypeFolder:
+				fmt.Fprintf(bw, "%s<DT><H3 ADD_DATE=\"%d\">%s</H3>\n%s<DL><p>\n", indent, addDate, html.EscapeString(bookmark.Title), indent)
+				writeList(bookmark.Children, indent+"    ")
+				fmt.Fprintf(bw, "%s</DL><p>\n", indent)
+			case BookmarkTypeSeparator:
+				fmt.Fprintf(bw, "%s<HR>\n", indent)
+			}
+		}
+	}
+	writeList(bookmarks.Menu, "    ")
+	for _, root := range bookmarkRoots[1:] {
+		list := *root.folder(&bookmarks)
+		if len(list) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "    <DT><H3 %s=\"true\">%s</H3>\n    <DL><p>\n", root.htmlTag, root.title)
+		writeList(list, "        ")
+		fmt.Fprint(bw, "    </DL><p>\n")
+	}
+	fmt.Fprint(bw, "</DL>\n")
+	return uerror.WithStackTrace(bw.Flush())
+}
+
+var (
+	htmlTagPattern       = regexp.MustCompile(`(?s)<(/?)([A-Za-z0-9]+)([^>]*)>`)
+	htmlAttributePattern = regexp.MustCompile(`([A-Za-z_]+)\s*=\s*"([^"]*)"`)
+)
+
+// readBookmarksHTML reads a Netscape bookmark file. These are rarely
+// well-formed HTML, so only the tags that make up bookmarks are
+// looked at: folders are H3 headings followed by a DL list, bookmarks
+// are links and separators are HR.
+func readBookmarksHTML(content string) Bookmarks {
+	var bookmarks Bookmarks
+	type folder struct {
+		bookmark *Bookmark
+		list     *[]Bookmark
+	}
+	stack := []folder{{list: &bookmarks.Menu}}
+	var pending *Bookmark
+	var pendingRoot *[]Bookmark
+	// Text is collected between an opening H3 or A tag and the
+	// closing one.
+	var textTarget *Bookmark
+	textStart := 0
+
+	current := func() *[]Bookmark {
+		return stack[len(stack)-1].list
+	}
+	for _, match := range htmlTagPattern.FindAllStringSubmatchIndex(content, -1) {
+		closing := match[3] > match[2]
+		tag := strings.ToUpper(content[match[4]:match[5]])
+		attributes := map[string]string{}
+		for _, attribute := range htmlAttributePattern.FindAllStringSubmatch(content[match[6]:match[7]], -1) {
+			attributes[strings.ToUpper(attribute[1])] = html.UnescapeString(attribute[2])
+		}
+
+		if closing && textTarget != nil && (tag == "H3" || tag == "A") {
+			textTarget.Title = strings.TrimSpace(html.UnescapeString(content[textStart:match[0]]))
+			textTarget = nil
+			continue
+		}
+		switch {
+		case tag == "H3" && !closing:
+			pending = &Bookmark{DateAdded: parseBookmarkDate(attributes["ADD_DATE"]), Type: BookmarkTypeFolder}
+			pendingRoot = nil
+			for _, root := range bookmarkRoots[1:] {
+				if attributes[root.htmlTag] == "true" {
+					pendingRoot = root.folder(&bookmarks)
+				}
+			}
+			textTarget, textStart = pending, match[1]
+		case tag == "A" && !closing:
+			list := current()
+			*list = append(*list, Bookmark{
+				DateAdded: parseBookmarkDate(attributes["ADD_DATE"]),
+				Type:      BookmarkTypeBookmark,
+				URL:       attributes["HREF"],
+			})
+			textTarget, textStart = &(*list)[len(*list)-1], match[1]
+		case tag == "HR" && !closing:
+			list := current()
+			*list = append(*list, Bookmark{Type: BookmarkTypeSeparator})
+		case tag == "DL" && !closing:
+			switch {
+			case pendingRoot != nil:
+				stack = append(stack, folder{list: pendingRoot})
+			case pending != nil:
+				stack = append(stack, folder{bookmark: pending, list: &pending.Children})
+			default:
+				// Lists without a heading, like the outermost one,
+				// belong to the enclosing folder.
+				stack = append(stack, folder{list: current()})
+			}
+			pending, pendingRoot = nil, nil
+		case tag == "DL" && closing:
+			if len(stack) == 1 {
+				continue
+			}
+			closed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if closed.bookmark != nil {
+				list := current()
+				*list = append(*list, *closed.bookmark)
+			}
+		}
+	}
+	return bookmarks
+}
+
+func parseBookmarkDate(s string) time.Time {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
+}
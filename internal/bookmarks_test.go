@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPlacesSchema is the part of the browser's places database that
+// bookmarks use, with the root folders and a tagged bookmark in the
+// menu.
+const testPlacesSchema = `
+CREATE TABLE moz_origins (id INTEGER PRIMARY KEY, prefix TEXT NOT NULL, host TEXT NOT NULL, frecency INTEGER NOT NULL, UNIQUE (prefix, host));
+CREATE TABLE moz_places (id INTEGER PRIMARY KEY, url LONGVARCHAR, title LONGVARCHAR, rev_host LONGVARCHAR, visit_count INTEGER DEFAULT 0, hidden INTEGER DEFAULT 0 NOT NULL, typed INTEGER DEFAULT 0 NOT NULL, frecency INTEGER DEFAULT -1 NOT NULL, last_visit_date INTEGER, guid TEXT, foreign_count INTEGER DEFAULT 0 NOT NULL, url_hash INTEGER DEFAULT 0 NOT NULL, description TEXT, preview_image_url TEXT, origin_id INTEGER REFERENCES moz_origins(id));
+CREATE UNIQUE INDEX moz_places_guid_uniqueindex ON moz_places (guid);
+CREATE TABLE moz_bookmarks (id INTEGER PRIMARY KEY, type INTEGER, fk INTEGER DEFAULT NULL, parent INTEGER, position INTEGER, title LONGVARCHAR, keyword_id INTEGER, folder_type TEXT, dateAdded INTEGER, lastModified INTEGER, guid TEXT, syncStatus INTEGER NOT NULL DEFAULT 0, syncChangeCounter INTEGER NOT NULL DEFAULT 1);
+CREATE UNIQUE INDEX moz_bookmarks_guid_uniqueindex ON moz_bookmarks (guid);
+INSERT INTO moz_bookmarks (id, type, parent, position, title, dateAdded, guid) VALUES
+	(1, 2, 0, 0, '', 0, 'root________'),
+	(2, 2, 1, 0, 'menu', 0, 'menu________'),
+	(3, 2, 1, 1, 'toolbar', 0, 'toolbar_____'),
+	(4, 2, 1, 2, 'tags', 0, 'tags________'),
+	(5, 2, 1, 3, 'unfiled', 0, 'unfiled_____'),
+	(6, 2, 1, 4, 'mobile', 0, 'mobile______'),
+	(7, 2, 4, 0, 'docs', 0, 'tagfolder___');
+INSERT INTO moz_origins (id, prefix, host, frecency) VALUES (1, 'https://', 'example.com', 1);
+INSERT INTO moz_places (id, url, rev_host, guid, foreign_count, url_hash, origin_id) VALUES (1, 'https://example.com/', 'moc.elpmaxe.', 'place1______', 2, %d, 1);
+INSERT INTO moz_bookmarks (type, fk, parent, position, title, dateAdded, guid) VALUES
+	(1, 1, 2, 0, 'Example', 1700000000000000, 'bookmark1___'),
+	(1, 1, 7, 0, NULL, 1700000000000000, 'tag1________');
+`
+
+const testBookmarksHTML = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks Menu</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1700000100">Research</H3>
+    <DL><p>
+        <DT><A HREF="https://example.com/" ADD_DATE="1700000200">Example again</A>
+        <HR>
+        <DT><A HREF="https://example.org/?a=1&amp;b=2" ADD_DATE="1700000300">Tom &amp; Jerry&#39;s</A>
+    </DL><p>
+    <DT><H3 PERSONAL_TOOLBAR_FOLDER="true">Bookmarks Toolbar</H3>
+    <DL><p>
+        <DT><A HREF="https://toolbar.example/">Toolbar</A>
+    </DL><p>
+</DL>
+`
+
+// setUpPlacesForTest creates a places database for the test instance
+// and returns its path. Tests are skipped without sqlite3.
+func setUpPlacesForTest(t *testing.T, instanceDir string) string {
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	assert.NoError(t, os.MkdirAll(profileDir, 0o755))
+	path := filepath.Join(profileDir, placesDatabaseFileName)
+	_, err := runSQLite(path, fmt.Sprintf(testPlacesSchema, hashPlacesURL("https://example.com/")))
+	if errors.Is(err, ErrSQLiteUnavailable) {
+		t.Skip("sqlite3 is needed to create a places database")
+	}
+	assert.NoError(t, err)
+	return path
+}
+
+func TestImportAndExportBookmarks(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	placesPath := setUpPlacesForTest(t, instanceDir)
+
+	htmlFile := filepath.Join(t.TempDir(), "bookmarks.html")
+	assert.NoError(t, os.WriteFile(htmlFile, []byte(testBookmarksHTML), 0o644))
+	assert.NoError(t, ImportBookmarks(config, instance, htmlFile))
+
+	at := func(seconds int64) time.Time {
+		return time.Unix(seconds, 0).UTC()
+	}
+	jsonOutput := &bytes.Buffer{}
+	assert.NoError(t, ExportBookmarks(config, instance, BookmarkFormatJSON, jsonOutput))
+	exported, err := decodeBookmarks(jsonOutput.Bytes())
+	assert.NoError(t, err)
+	// Bookmarks without a date get the time of the import.
+	for _, bookmark := range []*Bookmark{&exported.Toolbar[0], &exported.Menu[1].Children[1]} {
+		assert.False(t, bookmark.DateAdded.IsZero())
+		bookmark.DateAdded = time.Time{}
+	}
+	assert.Equal(t, Bookmarks{
+		Menu: []Bookmark{
+			{DateAdded: at(1700000000), Title: "Example", Type: BookmarkTypeBookmark, URL: "https://example.com/"},
+			{DateAdded: at(1700000100), Title: "Research", Type: BookmarkTypeFolder, Children: []Bookmark{
+				{DateAdded: at(1700000200), Title: "Example again", Type: BookmarkTypeBookmark, URL: "https://example.com/"},
+				{Type: BookmarkTypeSeparator},
+				{DateAdded: at(1700000300), Title: "Tom & Jerry's", Type: BookmarkTypeBookmark, URL: "https://example.org/?a=1&b=2"},
+			}},
+		},
+		Mobile:  []Bookmark{},
+		Toolbar: []Bookmark{{Title: "Toolbar", Type: BookmarkTypeBookmark, URL: "https://toolbar.example/"}},
+		Unfiled: []Bookmark{},
+	}, exported)
+
+	// Known URLs are reused, with the bookmarks counted.
+	places := []struct {
+		ForeignCount int    `json:"foreign_count"`
+		OriginID     *int   `json:"origin_id"`
+		RevHost      string `json:"rev_host"`
+		URL          string `json:"url"`
+		URLHash      uint64 `json:"url_hash"`
+	}{}
+	assert.NoError(t, querySQLite(placesPath, "SELECT url, url_hash, rev_host, foreign_count, origin_id FROM moz_places ORDER BY id;", &places))
+	assert.Len(t, places, 3)
+	assert.Equal(t, 3, places[0].ForeignCount)
+	assert.Equal(t, "https://example.org/?a=1&b=2", places[1].URL)
+	assert.Equal(t, hashPlacesURL(places[1].URL), places[1].URLHash)
+	assert.Equal(t, "gro.elpmaxe.", places[1].RevHost)
+	assert.Equal(t, 1, places[1].ForeignCount)
+	assert.NotNil(t, places[1].OriginID)
+
+	// The HTML export reads back the same, down to the second.
+	htmlOutput := &bytes.Buffer{}
+	assert.NoError(t, ExportBookmarks(config, instance, BookmarkFormatHTML, htmlOutput))
+	reimported, err := decodeBookmarks(htmlOutput.Bytes())
+	assert.NoError(t, err)
+	reimported.Toolbar[0].DateAdded = time.Time{}
+	reimported.Menu[1].Children[1].DateAdded = time.Time{}
+	exported.Mobile, exported.Unfiled = nil, nil
+	assert.Equal(t, exported, reimported)
+}
+
+func TestExportBookmarksWithoutPlaces(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, ExportBookmarks(config, instance, BookmarkFormatJSON, output))
+	assert.JSONEq(t, `{"menu": null, "mobile": null, "toolbar": null, "unfiled": null}`, output.String())
+
+	file := filepath.Join(t.TempDir(), "bookmarks.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"menu": []}`), 0o644))
+	assert.ErrorIs(t, ImportBookmarks(config, instance, file), ErrNoPlacesDatabase)
+}
+
+func TestHashPlacesURL(t *testing.T) {
+	url := "https://example.com/"
+	assert.Equal(t, uint64(hashPlacesString("https")&0xffff)<<32+uint64(hashPlacesString(url)), hashPlacesURL(url))
+	assert.Equal(t, uint64(hashPlacesString("no scheme")), hashPlacesURL("no scheme"))
+}
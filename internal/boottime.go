@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+const (
+	bootTimesFileName     = "boot-times.json"
+	bootTimesLockFileName = "boot-times.lock"
+	// maxBootTimeEntries is how many launches are remembered. Older
+	// ones are dropped.
+	maxBootTimeEntries = 200
+)
+
+// BootTime is how long one launch took to start up. The JSON field
+// names must stay stable, see "tbml stats --boot --format json".
+type BootTime struct {
+	// Backend describes how the instance's files are stored, see
+	// getInstanceBackend.
+	Backend  string `json:"backend"`
+	Instance string `json:"instance"`
+	// PrepareMillis is how long tbml took from the launch until the
+	// browser was started, including syncing and mounting the
+	// instance.
+	PrepareMillis int64  `json:"prepareMillis"`
+	Profile       string `json:"profile"`
+	// FirstPaintMillis and SessionRestoredMillis are Firefox's own
+	// startup markers, in milliseconds since its process started,
+	// from the telemetry ping it saved when it exited. They are nil
+	// if the browser doesn't keep telemetry, like Tor Browser by
+	// default.
+	FirstPaintMillis      *int64 `json:"firstPaintMillis"`
+	SessionRestoredMillis *int64 `json:"sessionRestoredMillis"`
+	// Time is when the launch started, stored in UTC.
+	Time time.Time `json:"time"`
+}
+
+// BootTimeSummary averages the boot times of all launches of a
+// backend. Averages of Firefox's markers only count launches that have
+// them and are nil if none do.
+type BootTimeSummary struct {
+	Backend               string `json:"backend"`
+	FirstPaintMillis      *int64 `json:"firstPaintMillis"`
+	Launches              int    `json:"launches"`
+	PrepareMillis         int64  `json:"prepareMillis"`
+	SessionRestoredMillis *int64 `json:"sessionRestoredMillis"`
+}
+
+// telemetryPing is the part of a Firefox main ping that holds the
+// startup markers.
+type telemetryPing struct {
+	Payload struct {
+		SimpleMeasurements struct {
+			FirstPaint      *int64 `json:"firstPaint"`
+			SessionRestored *int64 `json:"sessionRestored"`
+		} `json:"simpleMeasurements"`
+	} `json:"payload"`
+	Type string `json:"type"`
+}
+
+// getInstanceBackend describes how the instance's files are stored:
+// the configured clone strategy, with the one "auto" picked, and
+// whether the instance is encrypted or ephemeral, e.g.
+// "auto (reflink), encrypted".
+func getInstanceBackend(config Configuration, instance ProfileInstance) string {
+	parts := []string{config.CloneStrategy}
+	if config.CloneStrategy == "" || config.CloneStrategy == cloneStrategyAuto {
+		parts[0] = fmt.Sprintf("%s (%s)", cloneStrategyAuto, getMutableCloneStrategy(config, getInstanceDir(config, instance)))
+	}
+	if instance.Encrypted {
+		parts = append(parts, "encrypted")
+	}
+	if instance.Ephemeral {
+		parts = append(parts, "ephemeral")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readFirefoxStartupMarkers reads the startup markers from the newest
+// main ping the browser saved in the profile since the given time.
+// Firefox only saves pings that it couldn't send, which are all of
+// them if uploads are disabled. Without such a ping, the markers are
+// nil.
+func readFirefoxStartupMarkers(profileDir string, since time.Time) (firstPaint *int64, sessionRestored *int64, err error) {
+	pingsDir := filepath.Join(profileDir, "saved-telemetry-pings")
+	entries, err := os.ReadDir(pingsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, uerror.WithStackTrace(err)
+	}
+
+	var newest time.Time
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(since) || info.ModTime().Before(newest) {
+			continue
+		}
+		pingBytes, err := os.ReadFile(filepath.Join(pingsDir, entry.Name()))
+		if err != nil {
+			return nil, nil, uerror.WithStackTrace(err)
+		}
+		ping := telemetryPing{}
+		if err := json.Unmarshal(pingBytes, &ping); err != nil || ping.Type != "main" {
+			continue
+		}
+		newest = info.ModTime()
+		firstPaint = ping.Payload.SimpleMeasurements.FirstPaint
+		sessionRestored = ping.Payload.SimpleMeasurements.SessionRestored
+	}
+	return firstPaint, sessionRestored, nil
+}
+
+// recordBootTime records how long the launch of an instance took,
+// once its browser exited and saved its telemetry.
+func recordBootTime(config Configuration, instance ProfileInstance, instanceDir string, launched time.Time, browserStarted time.Time) error {
+	firstPaint, sessionRestored, err := readFirefoxStartupMarkers(filepath.Join(instanceDir, relativeProfilePath), browserStarted)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return RecordBootTime(config, BootTime{
+		Backend:               getInstanceBackend(config, instance),
+		FirstPaintMillis:      firstPaint,
+		Instance:              instance.InstanceLabel,
+		PrepareMillis:         browserStarted.Sub(launched).Milliseconds(),
+		Profile:               instance.ProfileLabel,
+		SessionRestoredMillis: sessionRestored,
+		Time:                  launched,
+	})
+}
+
+// RecordBootTime adds a launch to the boot times, dropping the oldest
+// entries if there are too many.
+func RecordBootTime(config Configuration, bootTime BootTime) error {
+	unlock, err := lockStateFile(config, bootTimesLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	bootTimes, err := GetBootTimes(config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	bootTime.Time = bootTime.Time.UTC()
+	bootTimes = append(bootTimes, bootTime)
+	if len(bootTimes) > maxBootTimeEntries {
+		bootTimes = bootTimes[len(bootTimes)-maxBootTimeEntries:]
+	}
+	return writeStateFile(config, bootTimesFileName, bootTimes)
+}
+
+// GetBootTimes returns the recorded boot times, oldest first.
+func GetBootTimes(config Configuration) ([]BootTime, error) {
+	bootTimes := []BootTime{}
+	if err := readStateFile(config, bootTimesFileName, &bootTimes); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return bootTimes, nil
+}
+
+// SummarizeBootTimes averages the boot times per backend, sorted by
+// backend.
+func SummarizeBootTimes(bootTimes []BootTime) []BootTimeSummary {
+	type sums struct {
+		prepare, firstPaint, sessionRestored                  int64
+		launches, firstPaintLaunches, sessionRestoredLaunches int64
+	}
+	sumsByBackend := map[string]*sums{}
+	for _, bootTime := range bootTimes {
+		s, ok := sumsByBackend[bootTime.Backend]
+		if !ok {
+			s = &sums{}
+			sumsByBackend[bootTime.Backend] = s
+		}
+		s.launches++
+		s.prepare += bootTime.PrepareMillis
+		if bootTime.FirstPaintMillis != nil {
+			s.firstPaintLaunches++
+			s.firstPaint += *bootTime.FirstPaintMillis
+		}
+		if bootTime.SessionRestoredMillis != nil {
+			s.sessionRestoredLaunches++
+			s.sessionRestored += *bootTime.SessionRestoredMillis
+		}
+	}
+
+	average := func(sum int64, count int64) *int64 {
+		if count == 0 {
+			return nil
+		}
+		avg := sum / count
+		return &avg
+	}
+	summaries := make([]BootTimeSummary, 0, len(sumsByBackend))
+	for backend, s := range sumsByBackend {
+		summaries = append(summaries, BootTimeSummary{
+			Backend:               backend,
+			FirstPaintMillis:      average(s.firstPaint, s.firstPaintLaunches),
+			Launches:              int(s.launches),
+			PrepareMillis:         s.prepare / s.launches,
+			SessionRestoredMillis: average(s.sessionRestored, s.sessionRestoredLaunches),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Backend < summaries[j].Backend
+	})
+	return summaries
+}
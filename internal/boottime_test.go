@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFirefoxStartupMarkers(t *testing.T) {
+	_, _, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	pingsDir := filepath.Join(profileDir, "saved-telemetry-pings")
+
+	firstPaint, sessionRestored, err := readFirefoxStartupMarkers(profileDir, time.Time{})
+	assert.NoError(t, err)
+	assert.Nil(t, firstPaint)
+	assert.Nil(t, sessionRestored)
+
+	assert.NoError(t, os.MkdirAll(pingsDir, 0o755))
+	launched := time.Now()
+	writePing := func(name string, content string, modTime time.Time) {
+		path := filepath.Join(pingsDir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	writePing("old", `{"type": "main", "payload": {"simpleMeasurements": {"firstPaint": 1, "sessionRestored": 2}}}`, launched.Add(-time.Hour))
+	writePing("new", `{"type": "main", "payload": {"simpleMeasurements": {"firstPaint": 850, "sessionRestored": 1200}}}`, launched.Add(time.Minute))
+	writePing("other", `{"type": "event", "payload": {}}`, launched.Add(2*time.Minute))
+
+	firstPaint, sessionRestored, err = readFirefoxStartupMarkers(profileDir, launched)
+	assert.NoError(t, err)
+	if assert.NotNil(t, firstPaint) && assert.NotNil(t, sessionRestored) {
+		assert.Equal(t, int64(850), *firstPaint)
+		assert.Equal(t, int64(1200), *sessionRestored)
+	}
+}
+
+func TestSummarizeBootTimes(t *testing.T) {
+	millis := func(m int64) *int64 { return &m }
+	summaries := SummarizeBootTimes([]BootTime{
+		{Backend: "reflink", PrepareMillis: 100, FirstPaintMillis: millis(800)},
+		{Backend: "copy", PrepareMillis: 300},
+		{Backend: "reflink", PrepareMillis: 200, FirstPaintMillis: millis(1000), SessionRestoredMillis: millis(1500)},
+	})
+	assert.Equal(t, []BootTimeSummary{
+		{Backend: "copy", Launches: 1, PrepareMillis: 300},
+		{Backend: "reflink", FirstPaintMillis: millis(900), Launches: 2, PrepareMillis: 150, SessionRestoredMillis: millis(1500)},
+	}, summaries)
+}
+
+func TestRecordBootTime(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.CloneStrategy = "reflink"
+	instance.Encrypted = true
+
+	for i := 0; i < maxBootTimeEntries+1; i++ {
+		assert.NoError(t, RecordBootTime(config, BootTime{
+			Backend:       getInstanceBackend(config, instance),
+			PrepareMillis: int64(i),
+		}))
+	}
+	bootTimes, err := GetBootTimes(config)
+	assert.NoError(t, err)
+	assert.Len(t, bootTimes, maxBootTimeEntries)
+	assert.Equal(t, int64(1), bootTimes[0].PrepareMillis)
+	assert.Equal(t, "reflink, encrypted", bootTimes[0].Backend)
+}
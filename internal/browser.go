@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultBrowserCommand is run in the sandbox if a profile doesn't set
+// its own BrowserCommand.
+var defaultBrowserCommand = []string{"torbrowser-launcher"}
+
+// getBrowserArgs returns the command line that is run in the sandbox
+// to start the profile's browser.
+func getBrowserArgs(profile ProfileConfiguration) []string {
+	browserCommand := profile.BrowserCommand
+	if len(browserCommand) == 0 {
+		browserCommand = defaultBrowserCommand
+	}
+	args := make([]string, 0, len(browserCommand)+len(profile.ExtraArgs))
+	args = append(args, browserCommand...)
+	return append(args, profile.ExtraArgs...)
+}
+
+// getBrowserEnvironment returns the profile's Environment as KEY=value
+// pairs, sorted by key.
+func getBrowserEnvironment(profile ProfileConfiguration) []string {
+	env := make([]string, 0, len(profile.Environment))
+	for key, value := range profile.Environment {
+		env = append(env, fmt.Sprint(key, "=", value))
+	}
+	sort.Strings(env)
+	return env
+}
+
+func validateBrowserSettings(profile ProfileConfiguration) error {
+	if len(profile.BrowserCommand) > 0 && profile.BrowserCommand[0] == "" {
+		return errors.New("browserCommand must start with the program to run")
+	}
+	for key := range profile.Environment {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("Invalid environment variable name %q", key)
+		}
+	}
+	return nil
+}
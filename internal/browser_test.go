@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBrowserArgs(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expected []string
+		profile  ProfileConfiguration
+	}{
+		{
+			desc: "Default",
+
+			expected: []string{"torbrowser-launcher"},
+		},
+		{
+			desc: "Extra args only",
+
+			expected: []string{"torbrowser-launcher", "--verbose"},
+			profile: ProfileConfiguration{
+				ExtraArgs: []string{"--verbose"},
+			},
+		},
+		{
+			desc: "Custom command",
+
+			expected: []string{"librewolf", "--no-remote", "--class", "work"},
+			profile: ProfileConfiguration{
+				BrowserCommand: []string{"librewolf", "--no-remote"},
+				ExtraArgs:      []string{"--class", "work"},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, getBrowserArgs(tC.profile))
+		})
+	}
+}
+
+func TestValidateBrowserSettings(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectError bool
+		profile     ProfileConfiguration
+	}{
+		{
+			desc: "Defaults",
+		},
+		{
+			desc: "Valid settings",
+
+			profile: ProfileConfiguration{
+				BrowserCommand: []string{"firefox"},
+				Environment:    map[string]string{"MOZ_ENABLE_WAYLAND": "1"},
+			},
+		},
+		{
+			desc: "Empty program",
+
+			expectError: true,
+			profile: ProfileConfiguration{
+				BrowserCommand: []string{"", "--class", "work"},
+			},
+		},
+		{
+			desc: "Invalid environment variable name",
+
+			expectError: true,
+			profile: ProfileConfiguration{
+				Environment: map[string]string{"A=B": "C"},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := validateBrowserSettings(tC.profile)
+			if tC.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
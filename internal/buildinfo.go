@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// version is set when building a release with
+// -ldflags "-X t0ast.cc/tbml/internal.version=...", see scripts/build.
+var version = ""
+
+// BuildMetadata describes how tbml was built and which formats and
+// backends it supports, so mismatched versions and old state can be
+// diagnosed. The JSON field names must stay stable, see
+// ProfileListing.
+type BuildMetadata struct {
+	BuildTags       []string `json:"buildTags"`
+	CloneStrategies []string `json:"cloneStrategies"`
+	Commit          string   `json:"commit"`
+	GoVersion       string   `json:"goVersion"`
+	// Modified tells whether the working tree had uncommitted changes
+	// when tbml was built.
+	Modified  bool     `json:"modified"`
+	Sandboxes []string `json:"sandboxes"`
+	// SchemaVersions are the versions of the formats tbml writes, by
+	// format.
+	SchemaVersions map[string]int `json:"schemaVersions"`
+	Version        string         `json:"version"`
+}
+
+// BuildInfo returns the metadata of the running build. Version and
+// commit are "unknown" if they weren't recorded, e.g. in tests.
+func BuildInfo() BuildMetadata {
+	info := BuildMetadata{
+		BuildTags:       []string{},
+		CloneStrategies: []string{string(uio.CloneCopy), string(uio.CloneHardlink), string(uio.CloneReflink)},
+		Commit:          "unknown",
+		GoVersion:       runtime.Version(),
+		Sandboxes:       []string{},
+		SchemaVersions: map[string]int{
+			"instanceMetadata": profileInstanceSchemaVersion,
+			"profileBundle":    profileBundleFormatVersion,
+		},
+		Version: version,
+	}
+	for sandboxType := range sandboxBinaries {
+		info.Sandboxes = append(info.Sandboxes, sandboxType)
+	}
+	sort.Strings(info.Sandboxes)
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		if info.Version == "" && buildInfo.Main.Version != "(devel)" {
+			info.Version = buildInfo.Main.Version
+		}
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "-tags":
+				if setting.Value != "" {
+					info.BuildTags = strings.Split(setting.Value, ",")
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			case "vcs.revision":
+				info.Commit = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	return info
+}
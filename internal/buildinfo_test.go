@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	info := BuildInfo()
+	assert.NotEmpty(t, info.Version)
+	assert.NotEmpty(t, info.Commit)
+	assert.NotEmpty(t, info.GoVersion)
+	assert.Equal(t, []string{"bubblewrap", "docker", "firejail", "podman"}, info.Sandboxes)
+	assert.Equal(t, profileInstanceSchemaVersion, info.SchemaVersions["instanceMetadata"])
+	assert.Equal(t, profileBundleFormatVersion, info.SchemaVersions["profileBundle"])
+
+	version = "v1.2.3"
+	defer func() { version = "" }()
+	assert.Equal(t, "v1.2.3", BuildInfo().Version)
+}
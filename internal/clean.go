@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// CleanPolicy describes which instances CleanInstances deletes. Limits
+// that are nil are not enforced. Instances that are in use or pinned
+// are never deleted.
+type CleanPolicy struct {
+	// MaxAge is the maximum time since an instance was last used.
+	MaxAge *time.Duration
+	// MaxInstancesPerProfile is the maximum number of instances kept
+	// per profile. The most recently used ones are kept.
+	MaxInstancesPerProfile *int
+	// MaxTotalSize is the maximum combined disk usage of all
+	// instances in bytes. The least recently used instances are
+	// deleted first.
+	MaxTotalSize *int64
+	// Where deletes the instances that match a filter, see
+	// ParseFilter.
+	Where *Filter
+}
+
+type CleanResult struct {
+	Instance ProfileInstance
+	Reason   string
+	Size     int64
+}
+
+// CleanInstances deletes instances according to the given policy and
+// reports which instances were deleted and why, also if deleting one
+// fails. Cleaning is meant to free disk space, so the instances are
+// deleted for good instead of being moved to the trash. In dry-run
+// mode, nothing is deleted.
+func CleanInstances(config Configuration, policy CleanPolicy, mutations *Mutations, warnings *Warnings) ([]CleanResult, error) {
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	sizes := make(map[string]int64)
+	for _, instance := range instances {
+		size, err := uio.DirSize(getInstanceDir(config, instance))
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		sizes[instance.InstanceLabel] = size
+	}
+
+	results := selectInstancesToClean(instances, sizes, policy, time.Now())
+
+	for i, result := range results {
+		if err := PurgeInstance(config, result.Instance, mutations); err != nil {
+			return results[:i], uerror.WithStackTrace(err)
+		}
+	}
+	return results, nil
+}
+
+// clampToNow treats timestamps from the future, e.g. written before the
+// clock was set back, as if they were from now.
+func clampToNow(t time.Time, now time.Time) time.Time {
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
+func selectInstancesToClean(instances []ProfileInstance, sizes map[string]int64, policy CleanPolicy, now time.Time) []CleanResult {
+	// Most recently used first
+	remaining := append([]ProfileInstance{}, instances...)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		lastUsedI, lastUsedJ := clampToNow(remaining[i].LastUsed, now), clampToNow(remaining[j].LastUsed, now)
+		if !lastUsedI.Equal(lastUsedJ) {
+			return lastUsedI.After(lastUsedJ)
+		}
+		return remaining[i].InstanceLabel < remaining[j].InstanceLabel
+	})
+
+	results := []CleanResult{}
+	clean := func(instance ProfileInstance, reason string) {
+		results = append(results, CleanResult{
+			Instance: instance,
+			Reason:   reason,
+			Size:     sizes[instance.InstanceLabel],
+		})
+	}
+	keep := func(predicate func(instance ProfileInstance) (bool, string)) {
+		kept := []ProfileInstance{}
+		for _, instance := range remaining {
+			ok, reason := predicate(instance)
+			if ok || instance.UsagePID != nil || instance.Pinned {
+				kept = append(kept, instance)
+			} else {
+				clean(instance, reason)
+			}
+		}
+		remaining = kept
+	}
+
+	if policy.MaxAge != nil {
+		keep(func(instance ProfileInstance) (bool, string) {
+			unusedFor := now.Sub(clampToNow(instance.LastUsed, now))
+			return unusedFor <= *policy.MaxAge, fmt.Sprintf("unused for %s (max. %s)", unusedFor.Round(time.Hour), *policy.MaxAge)
+		})
+	}
+
+	if policy.Where != nil {
+		keep(func(instance ProfileInstance) (bool, string) {
+			// The sizes are measured already, so matching can't fail.
+			matches, _ := policy.Where.match(instance, now, func() (int64, error) {
+				return sizes[instance.InstanceLabel], nil
+			})
+			return !matches, fmt.Sprintf("matches %s", policy.Where)
+		})
+	}
+
+	if policy.MaxInstancesPerProfile != nil {
+		countPerProfile := make(map[string]int)
+		keep(func(instance ProfileInstance) (bool, string) {
+			countPerProfile[instance.ProfileLabel]++
+			return countPerProfile[instance.ProfileLabel] <= *policy.MaxInstancesPerProfile, fmt.Sprintf("more than %d instances of profile %s", *policy.MaxInstancesPerProfile, instance.ProfileLabel)
+		})
+	}
+
+	if policy.MaxTotalSize != nil {
+		var totalSize int64
+		for _, instance := range remaining {
+			totalSize += sizes[instance.InstanceLabel]
+		}
+		kept := []ProfileInstance{}
+		for i := len(remaining) - 1; i >= 0; i-- {
+			instance := remaining[i]
+			if totalSize > *policy.MaxTotalSize && instance.UsagePID == nil && !instance.Pinned {
+				clean(instance, fmt.Sprintf("total size of %s exceeds %s", uio.FormatByteSize(totalSize), uio.FormatByteSize(*policy.MaxTotalSize)))
+				totalSize -= sizes[instance.InstanceLabel]
+			} else {
+				kept = append([]ProfileInstance{instance}, kept...)
+			}
+		}
+		remaining = kept
+	}
+
+	return results
+}
+
+const (
+	GarbageArchiveChunks  = "archive chunks"
+	GarbageExtensionCache = "extension cache"
+	GarbageFileCache      = "file cache"
+	GarbageTemporaryFiles = "temporary files"
+	GarbageUndoBackups    = "undo backups"
+)
+
+// profilePathTempDirRE matches the directories tbml prepares in the
+// profile path before moving them into place: ".import-*" for imported
+// instances and ".<label>-*" and ".<label>-migrating-*" for new and
+// migrated ones. MkdirTemp ends their names in a random number.
+var profilePathTempDirRE *regexp.Regexp = regexp.MustCompile(`^\.(?:import|(.+?)(?:-migrating)?)-[0-9]+$`)
+
+// trashedFilesDirRE matches the directories trashInstanceFiles moves
+// files to, which are deleted along with their undo log entries.
+var trashedFilesDirRE *regexp.Regexp = regexp.MustCompile(`-trash-[0-9]+$`)
+
+// isProfilePathTempDir tells whether a hidden entry of the profile path
+// is a directory tbml created temporarily, so everything else, like
+// the state directory or files of the user, is left alone.
+func isProfilePathTempDir(name string) bool {
+	match := profilePathTempDirRE.FindStringSubmatch(name)
+	if match == nil || trashedFilesDirRE.MatchString(name) {
+		return false
+	}
+	return match[1] == "" || isValidInstanceLabel(match[1])
+}
+
+// staleTempFileAge is how old temporary files must be before they are
+// considered left over from a crash rather than still being written.
+const staleTempFileAge = time.Hour
+
+// GarbageResult reports how much space was reclaimed in one category.
+type GarbageResult struct {
+	Category string
+	Files    int
+	Size     int64
+}
+
+// CollectGarbage deletes files that nothing refers to anymore: chunks
+// that no archived instance is made of, downloaded extensions and files
+// that no profile pins and temporary files left behind by interrupted instance creation or metadata
+// writes. It also deletes the backups of operations that can't be
+// undone anymore, like instances that were in the trash for too long.
+// In dry-run mode, nothing is deleted.
+func CollectGarbage(config Configuration, mutations *Mutations, warnings *Warnings) ([]GarbageResult, error) {
+	results := []GarbageResult{}
+	for _, category := range []struct {
+		name   string
+		find   func(Configuration, time.Time) ([]string, error)
+		action string
+	}{
+		{GarbageArchiveChunks, findUnreferencedArchiveChunks, "Delete archive chunk"},
+		{GarbageExtensionCache, findUnusedCachedExtensions, "Delete cached extension"},
+		{GarbageFileCache, findUnusedCachedConfigFiles, "Delete cached file"},
+		{GarbageTemporaryFiles, findStaleTempFiles, "Delete temporary file"},
+	} {
+		paths, err := category.find(config, time.Now())
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		result := GarbageResult{Category: category.name}
+		for _, path := range paths {
+			size, err := uio.DirSize(path)
+			if err != nil {
+				warnings.Add(path, "Skipping: %s", uerror.Message(err))
+				continue
+			}
+			if err := mutations.Apply(category.action, path, func() error {
+				return os.RemoveAll(path)
+			}); err != nil {
+				return nil, uerror.WithStackTrace(err)
+			}
+			result.Files++
+			result.Size += size
+		}
+		results = append(results, result)
+	}
+
+	now := time.Now()
+	expired, size, err := removeOperations(config, mutations, func(operation Operation) bool {
+		return operation.isExpired(now)
+	})
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	results = append(results, GarbageResult{Category: GarbageUndoBackups, Files: len(expired), Size: size})
+	return results, nil
+}
+
+func findUnusedCachedExtensions(config Configuration, now time.Time) ([]string, error) {
+	return findUnpinnedCacheEntries(getExtensionCacheDir(config), getPinnedCachedExtensions(config))
+}
+
+func findUnusedCachedConfigFiles(config Configuration, now time.Time) ([]string, error) {
+	pinned := make(map[string]bool)
+	pin := func(references []string) {
+		for _, reference := range references {
+			if parsed, err := parseConfigFileReference(reference); err == nil && parsed.URL != "" {
+				pinned[getCachedConfigFilePath(config, parsed.SHA256)] = true
+			}
+		}
+	}
+	pin(config.UserJSFiles)
+	for _, topic := range config.Topics {
+		pin(topic.UserJSFiles)
+	}
+	for _, profile := range config.Profiles {
+		if profile.UserJSFile != nil {
+			pin([]string{*profile.UserJSFile})
+		}
+		if profile.UserChromeFile != nil {
+			pin([]string{*profile.UserChromeFile})
+		}
+		pin(profile.UserJSFiles)
+		pin(profile.ExtensionFiles)
+	}
+	return findUnpinnedCacheEntries(filepath.Join(getStateDir(config), "files"), pinned)
+}
+
+func findUnpinnedCacheEntries(cacheDir string, pinned map[string]bool) ([]string, error) {
+	dirEntries, err := os.ReadDir(cacheDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	unused := []string{}
+	for _, dirEntry := range dirEntries {
+		path := filepath.Join(cacheDir, dirEntry.Name())
+		// Temporary files of downloads are left to findStaleTempFiles.
+		if !pinned[path] && !strings.HasPrefix(dirEntry.Name(), ".") {
+			unused = append(unused, path)
+		}
+	}
+	return unused, nil
+}
+
+// findStaleTempFiles finds the hidden directories ensureInstanceRecordDir
+// prepares new instances in, those of imports and storage migrations
+// and the temporary files of atomic writes to instance metadata,
+// instance archives, the archive chunk store and the download caches.
+func findStaleTempFiles(config Configuration, now time.Time) ([]string, error) {
+	stale := []string{}
+	findIn := func(dir string, isTemp func(name string) bool) error {
+		dirEntries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		for _, dirEntry := range dirEntries {
+			if !isTemp(dirEntry.Name()) {
+				continue
+			}
+			info, err := dirEntry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			if now.Sub(info.ModTime()) > staleTempFileAge {
+				stale = append(stale, filepath.Join(dir, dirEntry.Name()))
+			}
+		}
+		return nil
+	}
+
+	if err := findIn(config.ProfilePath, isProfilePathTempDir); err != nil {
+		return nil, err
+	}
+	for _, cacheDir := range []string{archiveChunksDirName, extensionCacheDirName, "files", routeListsDirName, sharedTemplatesDirName, templateManifestsDirName} {
+		if err := findIn(filepath.Join(getStateDir(config), cacheDir), func(name string) bool {
+			return strings.HasPrefix(name, ".")
+		}); err != nil {
+			return nil, err
+		}
+	}
+	dirEntries, err := os.ReadDir(config.ProfilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return stale, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || isReservedProfilePathEntry(dirEntry.Name()) {
+			continue
+		}
+		if err := findIn(filepath.Join(config.ProfilePath, dirEntry.Name()), func(name string) bool {
+			return isInstanceTempFile(name)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestSelectInstancesToClean(t *testing.T) {
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	pid := 1234
+	instances := []ProfileInstance{
+		{InstanceLabel: "a-1", ProfileLabel: "a", LastUsed: now.Add(-1 * time.Hour)},
+		{InstanceLabel: "a-2", ProfileLabel: "a", LastUsed: now.Add(-48 * time.Hour)},
+		{InstanceLabel: "a-3", ProfileLabel: "a", LastUsed: now.Add(-100 * 24 * time.Hour)},
+		{InstanceLabel: "a-4", ProfileLabel: "a", LastUsed: now.Add(-200 * 24 * time.Hour), UsagePID: &pid},
+		{InstanceLabel: "b-1", ProfileLabel: "b", LastUsed: now.Add(-24 * time.Hour)},
+	}
+	sizes := map[string]int64{
+		"a-1": 100,
+		"a-2": 200,
+		"a-3": 300,
+		"a-4": 400,
+		"b-1": 500,
+	}
+	maxAge := 30 * 24 * time.Hour
+	maxCount := 1
+	maxSize := int64(1000)
+	where, err := ParseFilter(`profile == "a" && size >= 200`)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		desc string
+
+		expected []string
+		policy   CleanPolicy
+	}{
+		{
+			desc: "No limits",
+
+			expected: []string{},
+		},
+		{
+			desc: "Max age",
+
+			expected: []string{"a-3"},
+			policy: CleanPolicy{
+				MaxAge: &maxAge,
+			},
+		},
+		{
+			desc: "Max instances per profile",
+
+			expected: []string{"a-2", "a-3"},
+			policy: CleanPolicy{
+				MaxInstancesPerProfile: &maxCount,
+			},
+		},
+		{
+			desc: "Max total size",
+
+			expected: []string{"a-3", "a-2"},
+			policy: CleanPolicy{
+				MaxTotalSize: &maxSize,
+			},
+		},
+		{
+			desc: "Where",
+
+			expected: []string{"a-2", "a-3"},
+			policy: CleanPolicy{
+				Where: where,
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			results := selectInstancesToClean(instances, sizes, tC.policy, now)
+			actual := []string{}
+			for _, result := range results {
+				actual = append(actual, result.Instance.InstanceLabel)
+				assert.Equal(t, sizes[result.Instance.InstanceLabel], result.Size)
+				assert.NotEmpty(t, result.Reason)
+			}
+			assert.Equal(t, tC.expected, actual)
+		})
+	}
+}
+
+func TestSelectInstancesToCleanClockSkew(t *testing.T) {
+	berlin := time.FixedZone("CET", 1*60*60)
+	newYork := time.FixedZone("EDT", -4*60*60)
+	// Shortly after the end of daylight saving time in Europe
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	instances := []ProfileInstance{
+		// 11:30 UTC, written by an older version in local time
+		{InstanceLabel: "a-1", ProfileLabel: "a", LastUsed: time.Date(2021, 11, 1, 12, 30, 0, 0, berlin)},
+		// 10:00 UTC
+		{InstanceLabel: "a-2", ProfileLabel: "a", LastUsed: time.Date(2021, 11, 1, 6, 0, 0, 0, newYork)},
+		// In the future, e.g. because the clock was set back since
+		{InstanceLabel: "a-3", ProfileLabel: "a", LastUsed: now.Add(365 * 24 * time.Hour)},
+	}
+	maxAge := 1 * time.Hour
+	maxCount := 2
+
+	results := selectInstancesToClean(instances, nil, CleanPolicy{MaxAge: &maxAge}, now)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "a-2", results[0].Instance.InstanceLabel)
+
+	// The future timestamp counts as now, so it doesn't shadow a-1.
+	results = selectInstancesToClean(instances, nil, CleanPolicy{MaxInstancesPerProfile: &maxCount}, now)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "a-2", results[0].Instance.InstanceLabel)
+}
+
+func TestParseProfileInstanceFromOlderVersions(t *testing.T) {
+	instance, err := parseProfileInstance("test-1", []byte(`{"Created": "2021-03-27T23:30:00+01:00", "LastUsed": "2021-10-31T02:30:00+02:00", "ProfileLabel": "test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 3, 27, 22, 30, 0, 0, time.UTC), instance.Created)
+	assert.Equal(t, time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC), instance.LastUsed)
+	assert.Equal(t, 0, instance.SchemaVersion)
+
+	instance, err = parseProfileInstance("test-1", []byte(`{"Created": "2021-03-27T23:30:00+01:00", "ProfileLabel": "test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, instance.Created, instance.LastUsed)
+}
+
+func TestCleanInstances(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	for i, lastUsed := range []time.Time{time.Now(), time.Now().Add(-60 * 24 * time.Hour)} {
+		instance := ProfileInstance{
+			InstanceLabel: []string{"test-1", "test-2"}[i],
+			LastUsed:      lastUsed,
+			ProfileLabel:  "test",
+		}
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+	maxAge := 30 * 24 * time.Hour
+
+	mutations := &Mutations{DryRun: true}
+	results, err := CleanInstances(config, CleanPolicy{
+		MaxAge: &maxAge,
+	}, mutations, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "test-2", results[0].Instance.InstanceLabel)
+	assert.Equal(t, []Mutation{{Action: "Delete instance for good", Target: "test-2"}}, mutations.List())
+	assert.DirExists(t, filepath.Join(config.ProfilePath, "test-2"))
+
+	results, err = CleanInstances(config, CleanPolicy{
+		MaxAge: &maxAge,
+	}, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.NoDirExists(t, filepath.Join(config.ProfilePath, "test-2"))
+	assert.DirExists(t, filepath.Join(config.ProfilePath, "test-1"))
+	operations, err := GetOperationLog(config)
+	assert.NoError(t, err)
+	assert.Empty(t, operations, "cleaned instances don't stay in the trash")
+}
+
+func writeProfileInstanceForTest(config Configuration, instance ProfileInstance) error {
+	instanceDir := getInstanceRecordDir(config, instance)
+	if err := os.MkdirAll(instanceDir, uio.FileModeURWXGRWXO); err != nil {
+		return err
+	}
+	return writeProfileInstance(config, instance)
+}
+
+func TestIsProfilePathTempDir(t *testing.T) {
+	for name, expected := range map[string]bool{
+		".import-123":            true,
+		".work-2-123":            true,
+		".work-2-migrating-4567": true,
+		".work-2-trash-123":      false,
+		".tbml":                  false,
+		".import-new":            false,
+		".backup":                false,
+		"work-2":                 false,
+	} {
+		assert.Equal(t, expected, isProfilePathTempDir(name), name)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	url := "https://example.com/foobar.xpi"
+	pinned := ExtensionSource{ID: "foobar@t0ast.cc", SHA256: strings.Repeat("a", 64), URL: &url}
+	unpinned := ExtensionSource{ID: "foobar@t0ast.cc", SHA256: strings.Repeat("b", 64), URL: &url}
+	config.Profiles[0].Extensions = []ExtensionSource{pinned}
+
+	old := time.Now().Add(-2 * staleTempFileAge)
+	write := func(path string, content string, modTime time.Time) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, []byte(content), uio.FileModeURWGRWO))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	write(getCachedExtensionPath(config, pinned), "pinned", time.Now())
+	write(getCachedExtensionPath(config, unpinned), "unpinned", time.Now())
+	pinnedFile := strings.Repeat("c", 64)
+	config.Profiles[0].UserJSFiles = []string{"https://example.com/user.js#sha256=" + pinnedFile}
+	write(getCachedConfigFilePath(config, pinnedFile), "pinned file", time.Now())
+	write(getCachedConfigFilePath(config, strings.Repeat("d", 64)), "unpinned file", time.Now())
+	write(filepath.Join(instanceDir, ".profile-instance.json-123"), "torn", old)
+	write(filepath.Join(instanceDir, ".profile-instance.json-456"), "being written", time.Now())
+	staleCreationDir := filepath.Join(config.ProfilePath, ".test-2-789")
+	write(filepath.Join(staleCreationDir, instanceLockFileName), "", old)
+	assert.NoError(t, os.Chtimes(staleCreationDir, old, old))
+	staleImportDir := filepath.Join(config.ProfilePath, ".import-123")
+	write(filepath.Join(staleImportDir, "x"), "", old)
+	assert.NoError(t, os.Chtimes(staleImportDir, old, old))
+	for _, name := range []string{".backup", ".test-1-trash-123", ".cache-old"} {
+		kept := filepath.Join(config.ProfilePath, name)
+		write(filepath.Join(kept, "places.sqlite"), "", old)
+		assert.NoError(t, os.Chtimes(kept, old, old))
+	}
+	expiredBackupDir, err := newBackupDir(config, "trash", "test-3")
+	assert.NoError(t, err)
+	write(filepath.Join(expiredBackupDir, "test-3", "places.sqlite"), "expired", old)
+	assert.NoError(t, writeStateFile(config, operationLogFileName, []Operation{{
+		Backup: filepath.Join(expiredBackupDir, "test-3"),
+		Kind:   OperationDeleteInstance,
+		Target: "test-3",
+		Time:   time.Now().Add(-maxOperationAge - time.Hour),
+	}}))
+
+	mutations := &Mutations{DryRun: true}
+	results, err := CollectGarbage(config, mutations, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []GarbageResult{
+		{Category: GarbageArchiveChunks},
+		{Category: GarbageExtensionCache, Files: 1, Size: int64(len("unpinned"))},
+		{Category: GarbageFileCache, Files: 1, Size: int64(len("unpinned file"))},
+		{Category: GarbageTemporaryFiles, Files: 3, Size: int64(len("torn"))},
+		{Category: GarbageUndoBackups, Files: 1, Size: int64(len("expired"))},
+	}, results)
+	assert.FileExists(t, getCachedExtensionPath(config, unpinned))
+
+	_, err = CollectGarbage(config, nil, nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, getCachedExtensionPath(config, pinned))
+	assert.NoFileExists(t, getCachedExtensionPath(config, unpinned))
+	assert.FileExists(t, getCachedConfigFilePath(config, pinnedFile))
+	assert.NoFileExists(t, getCachedConfigFilePath(config, strings.Repeat("d", 64)))
+	assert.NoFileExists(t, filepath.Join(instanceDir, ".profile-instance.json-123"))
+	assert.FileExists(t, filepath.Join(instanceDir, ".profile-instance.json-456"))
+	assert.NoDirExists(t, staleCreationDir)
+	assert.NoDirExists(t, staleImportDir)
+	for _, name := range []string{".backup", ".test-1-trash-123", ".cache-old"} {
+		assert.DirExists(t, filepath.Join(config.ProfilePath, name), "only tbml's own temporary directories are deleted")
+	}
+	assert.NoDirExists(t, expiredBackupDir)
+	operations, err := GetOperationLog(config)
+	assert.NoError(t, err)
+	assert.Empty(t, operations)
+	assert.DirExists(t, getStateDir(config))
+	_, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+}
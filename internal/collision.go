@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// CollisionPolicy decides what happens when an instance is restored
+// under a label that another instance already has.
+type CollisionPolicy string
+
+const (
+	// CollisionFail refuses to restore the instance.
+	CollisionFail CollisionPolicy = "fail"
+	// CollisionReplace deletes the other instance first, unless it is
+	// in use. The deletion can be undone like any other.
+	CollisionReplace CollisionPolicy = "replace"
+	// CollisionSuffix restores the instance under the first free label
+	// of the form <label>-2, <label>-3 and so on.
+	CollisionSuffix CollisionPolicy = "suffix"
+)
+
+var ErrInvalidCollisionPolicy error = errors.New("Invalid collision policy")
+
+// resolveLabelCollision returns the label to restore an instance with
+// the given label under. If the policy is CollisionReplace and the
+// label is taken, the instance that has to be deleted first is
+// returned as well. With CollisionFail, a taken label is reported with
+// ErrInstanceExists.
+func resolveLabelCollision(config Configuration, label string, policy CollisionPolicy) (string, *ProfileInstance, error) {
+	taken, err := isInstanceLabelTaken(config, label)
+	if err != nil {
+		return "", nil, uerror.WithStackTrace(err)
+	}
+	if !taken {
+		return label, nil, nil
+	}
+
+	switch policy {
+	case CollisionSuffix:
+		for i := 2; ; i++ {
+			candidate := fmt.Sprintf("%s-%d", label, i)
+			taken, err := isInstanceLabelTaken(config, candidate)
+			if err != nil {
+				return "", nil, uerror.WithStackTrace(err)
+			}
+			if !taken {
+				return candidate, nil, nil
+			}
+		}
+	case CollisionReplace:
+		existing, err := GetProfileInstance(config, label)
+		if err != nil {
+			return "", nil, uerror.WithStackTrace(err)
+		}
+		inUse, err := isInstanceInUse(config, existing)
+		if err != nil {
+			return "", nil, uerror.WithStackTrace(err)
+		}
+		if inUse {
+			return "", nil, uerror.StackTracef("%w: %s is currently in use", ErrInstanceInUse, label)
+		}
+		return label, &existing, nil
+	case CollisionFail, "":
+		return "", nil, uerror.StackTracef("%w: %s", ErrInstanceExists, label)
+	default:
+		return "", nil, uerror.StackTracef("%w: %s", ErrInvalidCollisionPolicy, policy)
+	}
+}
+
+func isInstanceLabelTaken(config Configuration, label string) (bool, error) {
+	_, err := os.Lstat(getInstanceRecordDir(config, ProfileInstance{InstanceLabel: label}))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrInvalidFileReference error = errors.New("Invalid file reference")
+
+const (
+	fileScheme             = "file:"
+	httpsScheme            = "https:"
+	checksumFragmentPrefix = "sha256="
+	maxConfigFileSize      = 64 << 20
+)
+
+// configFileReference is a file the configuration refers to, like a
+// user.js, a userChrome.css or an extension. It is written as one of
+//
+//   - "builtin:<name>", an asset bundled with tbml
+//   - "https://<host>/<path>#sha256=<hex>", a file that is downloaded
+//     once, checked against the pinned SHA-256 sum and kept in a cache
+//     shared by all instances
+//   - "file:<path>" or just "<path>", a local file. Relative paths are
+//     resolved against the configuration directory.
+type configFileReference struct {
+	Asset  string
+	Path   string
+	SHA256 string
+	URL    string
+}
+
+func parseConfigFileReference(reference string) (configFileReference, error) {
+	if assetName, ok := ParseBuiltinReference(reference); ok {
+		return configFileReference{Asset: assetName}, nil
+	}
+	if strings.HasPrefix(reference, fileScheme) {
+		return configFileReference{Path: strings.TrimPrefix(strings.TrimPrefix(reference, fileScheme), "//")}, nil
+	}
+	if strings.HasPrefix(reference, "http:") {
+		return configFileReference{}, fmt.Errorf("%w: %s", ErrInsecureURL, reference)
+	}
+	if !strings.HasPrefix(reference, httpsScheme) {
+		return configFileReference{Path: reference}, nil
+	}
+	parsedURL, err := url.Parse(reference)
+	if err != nil || parsedURL.Host == "" {
+		return configFileReference{}, fmt.Errorf("%w: %s is not a valid URL", ErrInvalidFileReference, reference)
+	}
+	checksum := strings.TrimPrefix(parsedURL.Fragment, checksumFragmentPrefix)
+	if !strings.HasPrefix(parsedURL.Fragment, checksumFragmentPrefix) || !isSHA256Hex(checksum) {
+		return configFileReference{}, fmt.Errorf("%w: %s must end in #sha256= and its hex-encoded SHA-256 sum", ErrInvalidFileReference, reference)
+	}
+	parsedURL.Fragment = ""
+	return configFileReference{SHA256: strings.ToLower(checksum), URL: parsedURL.String()}, nil
+}
+
+// getConfigFileBaseName returns the last element of a file reference's
+// path, e.g. "foo@t0ast.cc.xpi" for
+// "https://example.com/foo@t0ast.cc.xpi#sha256=...".
+func getConfigFileBaseName(reference string) string {
+	if parsed, err := parseConfigFileReference(reference); err == nil && parsed.URL != "" {
+		if parsedURL, err := url.Parse(parsed.URL); err == nil {
+			return filepath.Base(parsedURL.Path)
+		}
+	}
+	return filepath.Base(strings.TrimPrefix(reference, fileScheme))
+}
+
+// isLocalConfigFile tells whether a file reference is a local file, as
+// opposed to a bundled asset or a download.
+func isLocalConfigFile(reference string) bool {
+	parsed, err := parseConfigFileReference(reference)
+	return err == nil && parsed.Path != ""
+}
+
+// getCachedConfigFilePath returns where a downloaded file is kept.
+// Like extensions, files in the cache are named after their checksum.
+func getCachedConfigFilePath(config Configuration, checksum string) string {
+	return filepath.Join(getStateDir(config), "files", strings.ToLower(checksum))
+}
+
+// resolveLocalConfigFile resolves a local file referenced by the
+// configuration against configDir, leaving "builtin:" references
+// alone.
+func resolveLocalConfigFile(configDir string, name string) string {
+	if _, ok := ParseBuiltinReference(name); ok {
+		return name
+	}
+	name = strings.TrimPrefix(strings.TrimPrefix(name, fileScheme), "//")
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(configDir, name)
+}
+
+// resolveConfigFile returns the path of a file referenced by the
+// configuration: local files are resolved against configDir and
+// downloads are found in the cache. "builtin:" references are left
+// alone.
+func resolveConfigFile(config Configuration, configDir string, name string) (string, error) {
+	parsed, err := parseConfigFileReference(name)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if parsed.URL != "" {
+		return getCachedConfigFilePath(config, parsed.SHA256), nil
+	}
+	return resolveLocalConfigFile(configDir, name), nil
+}
+
+// readConfigFile reads a file referenced by the configuration, which
+// may be a bundled asset or a download that fetchConfigFiles put into
+// the cache. Relative paths are resolved against configDir.
+func readConfigFile(config Configuration, configDir string, name string) ([]byte, error) {
+	if assetName, ok := ParseBuiltinReference(name); ok {
+		return ReadBuiltinAsset(assetName)
+	}
+	path, err := resolveConfigFile(config, configDir, name)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return content, nil
+}
+
+// hashConfigFile returns the hex-encoded SHA-256 sum of a file
+// referenced by the configuration, like sha256File. Downloads are
+// represented by their pinned checksum, so they needn't be fetched.
+func hashConfigFile(config Configuration, configDir string, name string) (string, error) {
+	parsed, err := parseConfigFileReference(name)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	switch {
+	case parsed.Asset != "":
+		content, err := ReadBuiltinAsset(parsed.Asset)
+		if err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:]), nil
+	case parsed.URL != "":
+		return parsed.SHA256, nil
+	}
+	return sha256File(resolveLocalConfigFile(configDir, name))
+}
+
+// getProvisionedConfigFiles returns the references to the files an
+// instance of the profile used for topic is provisioned with.
+func getProvisionedConfigFiles(config Configuration, profile ProfileConfiguration, topic *string) []string {
+	files := []string{}
+	for _, layer := range getUserJSLayers(config, profile, topic) {
+		files = append(files, layer.Files...)
+	}
+	if profile.UserChromeFile != nil {
+		files = append(files, *profile.UserChromeFile)
+	}
+	return append(files, profile.ExtensionFiles...)
+}
+
+// fetchConfigFiles downloads the files referenced by HTTPS URLs that
+// aren't cached yet and checks them against their checksums.
+func fetchConfigFiles(ctx context.Context, client *http.Client, config Configuration, references []string) error {
+	for _, reference := range references {
+		parsed, err := parseConfigFileReference(reference)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if parsed.URL == "" {
+			continue
+		}
+		if err := fetchIntoCache(ctx, client, config, parsed.URL, parsed.SHA256, getCachedConfigFilePath(config, parsed.SHA256), maxConfigFileSize); err != nil {
+			return uerror.StackTracef("Failed to fetch %s: %w", parsed.URL, err)
+		}
+	}
+	return nil
+}
+
+// fetchIntoCache downloads a file to cachedPath unless it is there
+// already, checking it against its hex-encoded SHA-256 sum first.
+func fetchIntoCache(ctx context.Context, client *http.Client, config Configuration, fileURL string, expectedSHA256 string, cachedPath string, maxSize int64) error {
+	cached, err := uio.FileExists(cachedPath)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if cached {
+		return nil
+	}
+
+	downloadCtx, cancel := context.WithTimeout(ctx, GetDownloadTimeout(config))
+	content, err := downloadVerified(downloadCtx, client, fileURL, expectedSHA256, maxSize)
+	cancel()
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cachedPath), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(cachedPath, content, uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
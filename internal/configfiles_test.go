@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfigFileReference(t *testing.T) {
+	checksum := strings.Repeat("ab", sha256.Size)
+	tests := []struct {
+		reference string
+		expected  configFileReference
+		err       error
+	}{
+		{"builtin:baseline", configFileReference{Asset: "baseline"}, nil},
+		{"user.js", configFileReference{Path: "user.js"}, nil},
+		{"file:user.js", configFileReference{Path: "user.js"}, nil},
+		{"file:///etc/tbml/user.js", configFileReference{Path: "/etc/tbml/user.js"}, nil},
+		{"https://example.com/user.js#sha256=" + strings.ToUpper(checksum), configFileReference{SHA256: checksum, URL: "https://example.com/user.js"}, nil},
+		{"https://example.com/user.js", configFileReference{}, ErrInvalidFileReference},
+		{"https://example.com/user.js#sha256=abc", configFileReference{}, ErrInvalidFileReference},
+		{"http://example.com/user.js#sha256=" + checksum, configFileReference{}, ErrInsecureURL},
+	}
+	for _, test := range tests {
+		t.Run(test.reference, func(t *testing.T) {
+			reference, err := parseConfigFileReference(test.reference)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, reference)
+		})
+	}
+}
+
+func TestFetchConfigFiles(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	userJS := []byte("user_pref(\"browser.startup.page\", 3);\n")
+	sum := sha256.Sum256(userJS)
+	checksum := hex.EncodeToString(sum[:])
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(userJS)
+	}))
+	defer server.Close()
+
+	configDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "local.js"), []byte("local"), 0o644))
+	reference := server.URL + "/user.js#sha256=" + checksum
+	references := []string{reference, "builtin:baseline", "file:local.js"}
+
+	assert.NoError(t, fetchConfigFiles(context.Background(), server.Client(), config, references))
+	content, err := readConfigFile(config, configDir, reference)
+	assert.NoError(t, err)
+	assert.Equal(t, userJS, content)
+	content, err = readConfigFile(config, configDir, "file:local.js")
+	assert.NoError(t, err)
+	assert.Equal(t, "local", string(content))
+
+	// Cached files aren't downloaded again, and their checksum is the
+	// pinned one.
+	assert.NoError(t, fetchConfigFiles(context.Background(), server.Client(), config, references))
+	assert.Equal(t, 1, requests)
+	hash, err := hashConfigFile(config, configDir, reference)
+	assert.NoError(t, err)
+	assert.Equal(t, checksum, hash)
+
+	wrongReference := server.URL + "/user.js#sha256=" + hex.EncodeToString(make([]byte, sha256.Size))
+	err = fetchConfigFiles(context.Background(), server.Client(), config, []string{wrongReference})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	_, err = readConfigFile(config, configDir, wrongReference)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestGetExtensionIDFromReference(t *testing.T) {
+	assert.Equal(t, "foo@t0ast.cc", getExtensionIDFromPath("extensions/foo@t0ast.cc.xpi"))
+	assert.Equal(t, "foo@t0ast.cc", getExtensionIDFromPath("file:extensions/foo@t0ast.cc.xpi"))
+	assert.Equal(t, "foo@t0ast.cc", getExtensionIDFromPath("https://example.com/foo@t0ast.cc.xpi#sha256="+strings.Repeat("a", 64)))
+}
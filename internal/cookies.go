@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// cookiesDatabaseFileName is the browser's cookie jar in the profile
+// directory.
+const cookiesDatabaseFileName = "cookies.sqlite"
+
+// cookieExpiryMillisecondsThreshold tells expiry times in seconds,
+// which older browser versions store, from those in milliseconds. It
+// is in the year 5138 in seconds and in 1973 in milliseconds.
+const cookieExpiryMillisecondsThreshold = 100_000_000_000
+
+var ErrSensitiveProfile error = errors.New("Profile is sensitive")
+
+type cookieRow struct {
+	Expiry     int64  `json:"expiry"`
+	Host       string `json:"host"`
+	IsHTTPOnly int    `json:"isHttpOnly"`
+	IsSecure   int    `json:"isSecure"`
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Value      string `json:"value"`
+}
+
+// ProfileIsSensitive tells whether the profile with the given label is
+// marked as Sensitive, so the sessions of its instances must not be
+// handed out.
+func ProfileIsSensitive(config Configuration, profileLabel string) bool {
+	profile := FindProfileByLabel(config, profileLabel)
+	return profile != nil && profile.Sensitive != nil && *profile.Sensitive
+}
+
+// ExportCookies writes the cookies of an instance as a Netscape cookie
+// file, which curl, wget and yt-dlp read, so they can act in the same
+// sessions as the browser. Only cookies of the given domain and its
+// subdomains are exported, or all if it is empty. The instance may be
+// in use, since the cookie jar is read from a copy. The cookies of
+// Sensitive profiles are never exported, the returned error wraps
+// ErrSensitiveProfile instead.
+func ExportCookies(config Configuration, instance ProfileInstance, domainFilter string, w io.Writer) error {
+	if ProfileIsSensitive(config, instance.ProfileLabel) {
+		return uerror.StackTracef("%w: %s", ErrSensitiveProfile, instance.ProfileLabel)
+	}
+
+	var rows []cookieRow
+	readCookies := func(profileDir string) error {
+		var err error
+		rows, err = readCookieJar(profileDir)
+		return err
+	}
+	var err error
+	if instance.UsagePID != nil {
+		err = readCookies(filepath.Join(getInstanceDir(config, instance), relativeProfilePath))
+	} else {
+		err = withLockedProfileDir(config, instance, readCookies)
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Netscape HTTP Cookie File")
+	for _, row := range rows {
+		if !cookieMatchesDomain(row.Host, domainFilter) {
+			continue
+		}
+		writeNetscapeCookie(bw, row)
+	}
+	return uerror.WithStackTrace(bw.Flush())
+}
+
+// readCookieJar reads the cookies of a profile from a copy of its
+// cookie jar, since the browser locks the original while it runs. A
+// profile without a cookie jar has no cookies.
+func readCookieJar(profileDir string) ([]cookieRow, error) {
+	tmpDir, err := os.MkdirTemp("", "tbml-cookies-*")
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Recent changes are only in the write-ahead log.
+	for _, suffix := range []string{"", "-wal"} {
+		src := filepath.Join(profileDir, cookiesDatabaseFileName+suffix)
+		err := uio.CloneFile(src, filepath.Join(tmpDir, cookiesDatabaseFileName+suffix), uio.FileModeURWGRWO, uio.CloneCopy)
+		if errors.Is(err, fs.ErrNotExist) {
+			if suffix == "" {
+				return nil, nil
+			}
+			continue
+		}
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	}
+
+	rows := []cookieRow{}
+	err = querySQLite(filepath.Join(tmpDir, cookiesDatabaseFileName), `SELECT host, path, isSecure, isHttpOnly, expiry, name, value
+		FROM moz_cookies ORDER BY host, path, name;`, &rows)
+	return rows, uerror.WithStackTrace(err)
+}
+
+// cookieMatchesDomain tells whether a cookie of the given host, which
+// starts with a dot for cookies of a domain and its subdomains, is
+// sent to the domain or one of its subdomains.
+func cookieMatchesDomain(host string, domain string) bool {
+	if domain == "" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimPrefix(host, "."))
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// writeNetscapeCookie writes a line of a Netscape cookie file: the
+// domain, whether subdomains match, the path, whether the cookie is
+// only sent over HTTPS, its expiry in seconds, name and value. HttpOnly
+// cookies are marked like curl does it.
+func writeNetscapeCookie(w io.Writer, row cookieRow) {
+	formatBool := func(b bool) string {
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	domain := row.Host
+	if row.IsHTTPOnly != 0 {
+		domain = "#HttpOnly_" + domain
+	}
+	expiry := row.Expiry
+	if expiry >= cookieExpiryMillisecondsThreshold {
+		expiry /= 1000
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, formatBool(strings.HasPrefix(row.Host, ".")), row.Path, formatBool(row.IsSecure != 0), expiry, row.Name, row.Value)
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCookiesSchema = `
+CREATE TABLE moz_cookies (id INTEGER PRIMARY KEY, originAttributes TEXT NOT NULL DEFAULT '', name TEXT, value TEXT, host TEXT, path TEXT, expiry INTEGER, lastAccessed INTEGER, creationTime INTEGER, isSecure INTEGER, isHttpOnly INTEGER, inBrowserElement INTEGER DEFAULT 0, sameSite INTEGER DEFAULT 0, rawSameSite INTEGER DEFAULT 0, schemeMap INTEGER DEFAULT 0);
+INSERT INTO moz_cookies (name, value, host, path, expiry, isSecure, isHttpOnly) VALUES
+	('session', 'abc', '.example.com', '/', 1900000000, 1, 1),
+	('pref', 'dark', 'www.example.com', '/settings', 1900000000000, 0, 0),
+	('other', 'x', '.notexample.com', '/', 1900000000, 0, 0);
+`
+
+func TestExportCookies(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	assert.NoError(t, os.MkdirAll(profileDir, 0o755))
+	_, err := runSQLite(filepath.Join(profileDir, cookiesDatabaseFileName), testCookiesSchema)
+	if errors.Is(err, ErrSQLiteUnavailable) {
+		t.Skip("sqlite3 is needed to create a cookie jar")
+	}
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		desc string
+
+		domainFilter string
+		expected     string
+	}{
+		{
+			desc: "All cookies",
+
+			expected: "# Netscape HTTP Cookie File\n" +
+				"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t1900000000\tsession\tabc\n" +
+				".notexample.com\tTRUE\t/\tFALSE\t1900000000\tother\tx\n" +
+				"www.example.com\tFALSE\t/settings\tFALSE\t1900000000\tpref\tdark\n",
+		},
+		{
+			desc: "Domain and subdomains",
+
+			domainFilter: "Example.com",
+			expected: "# Netscape HTTP Cookie File\n" +
+				"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t1900000000\tsession\tabc\n" +
+				"www.example.com\tFALSE\t/settings\tFALSE\t1900000000\tpref\tdark\n",
+		},
+		{
+			desc: "Subdomain",
+
+			domainFilter: "www.example.com",
+			expected: "# Netscape HTTP Cookie File\n" +
+				"www.example.com\tFALSE\t/settings\tFALSE\t1900000000\tpref\tdark\n",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			assert.NoError(t, ExportCookies(config, instance, tC.domainFilter, output))
+			assert.Equal(t, tC.expected, output.String())
+		})
+	}
+
+	// The cookie jar is copied, so the instance may be in use.
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	defer unlock()
+	pid := os.Getpid()
+	instance.UsagePID = &pid
+	assert.NoError(t, ExportCookies(config, instance, "www.example.com", &bytes.Buffer{}))
+
+	assert.False(t, ProfileIsSensitive(config, profile.Label))
+	config.Profiles[0].Sensitive = boolPtr(true)
+	assert.Equal(t, profile.Label, config.Profiles[0].Label)
+	assert.True(t, ProfileIsSensitive(config, profile.Label))
+	assert.ErrorIs(t, ExportCookies(config, instance, "", &bytes.Buffer{}), ErrSensitiveProfile)
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrLaunchCooldown error = errors.New("The profile was launched moments ago")
+
+const recentLaunchesFileName = "recent-launches.json"
+
+// launchRetryInterval is how often ForwardURLToLaunchingInstance tries
+// to reach an instance that isn't listening yet.
+var launchRetryInterval = 100 * time.Millisecond
+
+// recentLaunch is the last launch of a profile, stored per profile
+// label.
+type recentLaunch struct {
+	InstanceLabel string
+	Time          time.Time
+}
+
+func getLaunchCooldown(profile ProfileConfiguration) time.Duration {
+	if profile.LaunchCooldownSeconds == nil || *profile.LaunchCooldownSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(*profile.LaunchCooldownSeconds) * time.Second
+}
+
+// findRecentLaunch returns the last launch of the profile if it
+// happened within the profile's cooldown. Launches recorded in the
+// future, e.g. before the clock was set back, don't count.
+func findRecentLaunch(config Configuration, profile ProfileConfiguration, now time.Time) (*recentLaunch, error) {
+	cooldown := getLaunchCooldown(profile)
+	if cooldown == 0 {
+		return nil, nil
+	}
+	launches := map[string]recentLaunch{}
+	if err := readStateFile(config, recentLaunchesFileName, &launches); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	launch, ok := launches[profile.Label]
+	if !ok || now.Before(launch.Time) || now.Sub(launch.Time) >= cooldown {
+		return nil, nil
+	}
+	return &launch, nil
+}
+
+// recordLaunch remembers that an instance of the profile was launched
+// for the profile's cooldown. The caller must hold the allocation
+// lock.
+func recordLaunch(config Configuration, profile ProfileConfiguration, instanceLabel string, now time.Time) error {
+	if getLaunchCooldown(profile) == 0 {
+		return nil
+	}
+	launches := map[string]recentLaunch{}
+	if err := readStateFile(config, recentLaunchesFileName, &launches); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	launches[profile.Label] = recentLaunch{
+		InstanceLabel: instanceLabel,
+		Time:          now.UTC(),
+	}
+	return writeStateFile(config, recentLaunchesFileName, launches)
+}
+
+// forgetLaunch removes the recorded launch of the profile if it was
+// the given instance, e.g. because the instance was only provisioned.
+func forgetLaunch(config Configuration, profile ProfileConfiguration, instanceLabel string) error {
+	if getLaunchCooldown(profile) == 0 {
+		return nil
+	}
+	unlockAllocation, err := lockStateFile(config, allocationLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlockAllocation()
+
+	launches := map[string]recentLaunch{}
+	if err := readStateFile(config, recentLaunchesFileName, &launches); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	launch, ok := launches[profile.Label]
+	if !ok || launch.InstanceLabel != instanceLabel {
+		return nil
+	}
+	delete(launches, profile.Label)
+	return writeStateFile(config, recentLaunchesFileName, launches)
+}
+
+// GetRecentLaunch returns the instance of the profile that was
+// launched within the profile's cooldown, or nil if there is none.
+func GetRecentLaunch(config Configuration, profile ProfileConfiguration) (*ProfileInstance, error) {
+	launch, err := findRecentLaunch(config, profile, time.Now())
+	if err != nil || launch == nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	instance, err := GetProfileInstance(config, launch.InstanceLabel)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return &instance, nil
+}
+
+// ForwardURLToLaunchingInstance is ForwardURLToInstance for an
+// instance that may still be starting. If the instance was launched
+// within the profile's cooldown but isn't listening yet, it is retried
+// until the browser startup timeout since the launch has passed.
+func ForwardURLToLaunchingInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, url string) error {
+	deadline := time.Now()
+	launch, err := findRecentLaunch(config, profile, deadline)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if launch != nil && launch.InstanceLabel == instance.InstanceLabel {
+		deadline = launch.Time.Add(getBrowserStartupTimeout(config))
+	}
+
+	for {
+		err := ForwardURLToInstance(config, instance, url)
+		if !errors.Is(err, ErrInstanceNotListening) || !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return uerror.WithStackTrace(ctx.Err())
+		case <-time.After(launchRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimBestInstanceCooldown(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	cooldown := 60
+	profile.LaunchCooldownSeconds = &cooldown
+	topic := "news"
+
+	claimed, release, err := ClaimBestInstance(context.Background(), config, profile, &topic, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, release())
+
+	_, _, err = ClaimBestInstance(context.Background(), config, profile, &topic, nil)
+	assert.ErrorIs(t, err, ErrLaunchCooldown)
+	recent, err := GetRecentLaunch(config, profile)
+	assert.NoError(t, err)
+	if assert.NotNil(t, recent) {
+		assert.Equal(t, claimed.InstanceLabel, recent.InstanceLabel)
+	}
+
+	// Once the cooldown is over, instances are claimed again.
+	launch, err := findRecentLaunch(config, profile, time.Now().Add(time.Duration(cooldown)*time.Second))
+	assert.NoError(t, err)
+	assert.Nil(t, launch)
+
+	profile.LaunchCooldownSeconds = nil
+	_, release, err = ClaimBestInstance(context.Background(), config, profile, &topic, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, release())
+}
+
+func TestForwardURLToLaunchingInstance(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	cooldown := 60
+	profile.LaunchCooldownSeconds = &cooldown
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	// Without a recent launch, the instance is only tried once.
+	err := ForwardURLToLaunchingInstance(context.Background(), config, profile, instance, "")
+	assert.ErrorIs(t, err, ErrInstanceNotListening)
+
+	// An instance that was just launched is retried until it listens
+	// or the caller gives up.
+	assert.NoError(t, recordLaunch(config, profile, instance.InstanceLabel, time.Now()))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*launchRetryInterval)
+	defer cancel()
+	err = ForwardURLToLaunchingInstance(ctx, config, profile, instance, "")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestForgetLaunch(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	cooldown := 60
+	profile.LaunchCooldownSeconds = &cooldown
+	assert.NoError(t, recordLaunch(config, profile, instance.InstanceLabel, time.Now()))
+
+	// Only the launch of the given instance is forgotten.
+	assert.NoError(t, forgetLaunch(config, profile, "test-2"))
+	launch, err := findRecentLaunch(config, profile, time.Now())
+	assert.NoError(t, err)
+	assert.NotNil(t, launch)
+
+	assert.NoError(t, forgetLaunch(config, profile, instance.InstanceLabel))
+	launch, err = findRecentLaunch(config, profile, time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, launch)
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// crashBundleDirName is the directory in an instance's directory in
+// the profile path that holds what was collected about the latest
+// crash of its browser.
+const crashBundleDirName = "crash-bundle"
+
+const (
+	crashBundleReportFileName     = "crash-report.txt"
+	crashBundleScreenshotFileName = "screenshot.png"
+)
+
+// screenshotTimeout limits how long taking a screenshot may take.
+const screenshotTimeout = 10 * time.Second
+
+var ErrScreenshotUnavailable error = errors.New("No screenshot tool is installed")
+
+// takeScreenshot is a variable so tests don't need a display.
+var takeScreenshot = takeScreenshotWithTool
+
+func shouldTakeCrashScreenshot(profile ProfileConfiguration) bool {
+	return profile.CrashScreenshot != nil && *profile.CrashScreenshot
+}
+
+// getCrashReportDirs returns the directories Firefox writes crash
+// reports to: minidumps of the profile and pending reports of the
+// crash reporter, which live next to the profile.
+func getCrashReportDirs(profileDir string) []string {
+	return []string{
+		filepath.Join(profileDir, "minidumps"),
+		filepath.Join(filepath.Dir(profileDir), "Crash Reports", "pending"),
+	}
+}
+
+// listCrashReports returns the paths of all crash reports of the
+// profile, sorted.
+func listCrashReports(profileDir string) ([]string, error) {
+	reports := []string{}
+	for _, dir := range getCrashReportDirs(profileDir) {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".dmp") {
+				reports = append(reports, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(reports)
+	return reports, nil
+}
+
+// getNewCrashReports returns the reports that aren't in previous.
+func getNewCrashReports(previous []string, current []string) []string {
+	known := make(map[string]bool, len(previous))
+	for _, report := range previous {
+		known[report] = true
+	}
+	reports := []string{}
+	for _, report := range current {
+		if !known[report] {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// writeCrashBundle replaces the instance's crash bundle with one
+// listing the exit code and the new crash reports and, if the profile
+// sets CrashScreenshot, a screenshot. The bundle is referenced in the
+// instance's metadata. A missing screenshot tool isn't an error, the
+// bundle is just written without a screenshot.
+func writeCrashBundle(ctx context.Context, config Configuration, profile ProfileConfiguration, instanceLabel string, exitCode uint, crashReports []string) (string, error) {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	bundleDir := filepath.Join(getInstanceRecordDir(config, instance), crashBundleDirName)
+	if err := os.RemoveAll(bundleDir); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := os.MkdirAll(bundleDir, uio.FileModeURWXGRWXO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+
+	report := strings.Builder{}
+	fmt.Fprintf(&report, "Exit code: %d\n", exitCode)
+	for _, crashReport := range crashReports {
+		fmt.Fprintf(&report, "Crash report: %s\n", crashReport)
+	}
+	if shouldTakeCrashScreenshot(profile) {
+		screenshotPath := filepath.Join(bundleDir, crashBundleScreenshotFileName)
+		if err := takeScreenshot(ctx, screenshotPath); errors.Is(err, ErrScreenshotUnavailable) {
+			report.WriteString("Screenshot: none, neither grim nor scrot is installed\n")
+		} else if err != nil {
+			fmt.Fprintf(&report, "Screenshot: failed: %s\n", uerror.Message(err))
+		} else {
+			fmt.Fprintf(&report, "Screenshot: %s\n", screenshotPath)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, crashBundleReportFileName), []byte(report.String()), uio.FileModeURWGRWO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+
+	instance.CrashBundle = &bundleDir
+	if err := writeProfileInstance(config, instance); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return bundleDir, nil
+}
+
+// takeScreenshotWithTool saves a screenshot of the whole screen with
+// grim on Wayland, otherwise with scrot.
+func takeScreenshotWithTool(ctx context.Context, path string) error {
+	tools := [][]string{{"scrot", "--overwrite", path}}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([][]string{{"grim", path}}, tools...)
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, screenshotTimeout)
+		defer cancel()
+		if output, err := exec.CommandContext(ctx, tool[0], tool[1:]...).CombinedOutput(); err != nil {
+			return uerror.StackTracef("%s failed: %w: %s", tool[0], err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	return uerror.WithStackTrace(ErrScreenshotUnavailable)
+}
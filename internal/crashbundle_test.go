@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListCrashReports(t *testing.T) {
+	_, _, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+
+	reports, err := listCrashReports(profileDir)
+	assert.NoError(t, err)
+	assert.Empty(t, reports)
+
+	minidump := filepath.Join(profileDir, "minidumps", "a.dmp")
+	pending := filepath.Join(filepath.Dir(profileDir), "Crash Reports", "pending", "b.dmp")
+	for _, path := range []string{minidump, pending, filepath.Join(profileDir, "minidumps", "a.extra")} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, nil, 0o644))
+	}
+	reports, err = listCrashReports(profileDir)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{minidump, pending}, reports)
+
+	assert.Equal(t, []string{pending}, getNewCrashReports([]string{minidump}, reports))
+}
+
+func TestWriteCrashBundle(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	originalTakeScreenshot := takeScreenshot
+	takeScreenshot = func(ctx context.Context, path string) error {
+		return os.WriteFile(path, []byte("png"), 0o644)
+	}
+	defer func() { takeScreenshot = originalTakeScreenshot }()
+
+	profile.CrashScreenshot = boolPtr(true)
+	bundleDir, err := writeCrashBundle(context.Background(), config, profile, instance.InstanceLabel, 11, []string{"/crash/a.dmp"})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(bundleDir, crashBundleScreenshotFileName))
+	report, err := os.ReadFile(filepath.Join(bundleDir, crashBundleReportFileName))
+	assert.NoError(t, err)
+	assert.Contains(t, string(report), "Exit code: 11\n")
+	assert.Contains(t, string(report), "Crash report: /crash/a.dmp\n")
+
+	instance, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	if assert.NotNil(t, instance.CrashBundle) {
+		assert.Equal(t, bundleDir, *instance.CrashBundle)
+	}
+
+	// A later crash replaces the bundle.
+	profile.CrashScreenshot = nil
+	_, err = writeCrashBundle(context.Background(), config, profile, instance.InstanceLabel, 1, nil)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(bundleDir, crashBundleScreenshotFileName))
+}
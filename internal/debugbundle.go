@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// maxDebugBundleLogSize is how much of the end of each instance log is
+// put into a debug bundle.
+const maxDebugBundleLogSize = 64 * 1024
+
+const redactedValue = "<redacted>"
+
+// DebugBundle is what "tbml debug bundle" puts into the archive for a
+// bug report.
+type DebugBundle struct {
+	Files []DebugBundleFile
+	// Redacted lists the settings whose values were replaced before
+	// they were put into the bundle, e.g. "Profiles.0.Environment.TOKEN".
+	Redacted []string
+}
+
+type DebugBundleFile struct {
+	Content []byte
+	Name    string
+}
+
+// CollectDebugBundle gathers the configuration with secrets redacted,
+// the instances' metadata and the ends of their logs, the build
+// information and the results of probing the profile path's storage.
+// Instances and probes that fail are reported as warnings, so a broken
+// setup can still be reported. Finally, all files are redacted by
+// redactor.
+func CollectDebugBundle(config Configuration, redactor *Redactor, warnings *Warnings) (DebugBundle, error) {
+	bundle := DebugBundle{}
+	addJSON := func(name string, v interface{}) error {
+		content, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		bundle.Files = append(bundle.Files, DebugBundleFile{Content: append(content, '\n'), Name: name})
+		return nil
+	}
+
+	redactedConfig, redacted, err := redactConfiguration(config)
+	if err != nil {
+		return DebugBundle{}, uerror.WithStackTrace(err)
+	}
+	bundle.Redacted = redacted
+	if err := addJSON("config.json", redactedConfig); err != nil {
+		return DebugBundle{}, err
+	}
+	if err := addJSON("version.json", BuildInfo()); err != nil {
+		return DebugBundle{}, err
+	}
+	probe, err := ProbeProfilePath(config)
+	if err != nil {
+		warnings.Add(config.ProfilePath, "Failed to probe the storage: %s", uerror.Message(err))
+	} else if err := addJSON("storage.json", probe); err != nil {
+		return DebugBundle{}, err
+	}
+
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return DebugBundle{}, uerror.WithStackTrace(err)
+	}
+	for _, instance := range instances {
+		if err := addJSON("instances/"+instance.InstanceLabel+".json", instance); err != nil {
+			return DebugBundle{}, err
+		}
+		log, err := readLogTail(filepath.Join(getInstanceRecordDir(config, instance), instanceLogFileName), maxDebugBundleLogSize)
+		if err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to read the instance log: %s", uerror.Message(err))
+			continue
+		}
+		if log != nil {
+			bundle.Files = append(bundle.Files, DebugBundleFile{Content: log, Name: "logs/" + instance.InstanceLabel + ".log"})
+		}
+	}
+
+	for i := range bundle.Files {
+		bundle.Files[i].Content = []byte(redactor.Redact(string(bundle.Files[i].Content)))
+	}
+	if len(bundle.Redacted) > 0 {
+		bundle.Files = append(bundle.Files, DebugBundleFile{
+			Content: []byte(strings.Join(bundle.Redacted, "\n") + "\n"),
+			Name:    "redacted.txt",
+		})
+	}
+	return bundle, nil
+}
+
+// WriteDebugBundle writes the bundle's files to w as a tar.gz archive.
+func WriteDebugBundle(bundle DebugBundle, w io.Writer) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	now := time.Now()
+	for _, file := range bundle.Files {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Mode:     int64(uio.FileModeURWGRWO),
+			ModTime:  now,
+			Name:     file.Name,
+			Size:     int64(len(file.Content)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if _, err := tarWriter.Write(file.Content); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// readLogTail returns the last limit bytes of the log file, starting
+// at a full line, or nil if there is no log.
+func readLogTail(name string, limit int64) ([]byte, error) {
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	offset := info.Size() - limit
+	if offset < 0 {
+		offset = 0
+	}
+	content := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(content, offset); err != nil && err != io.EOF {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if offset > 0 {
+		if i := strings.IndexByte(string(content), '\n'); i != -1 {
+			content = content[i+1:]
+		}
+	}
+	return content, nil
+}
+
+// redactConfiguration returns a copy of the configuration without
+// values that commonly hold secrets: hook commands, environment
+// variables, password commands and the credentials and query
+// parameters of URLs. It also returns the paths of the redacted
+// settings.
+func redactConfiguration(config Configuration) (Configuration, []string, error) {
+	// The copy is made through JSON so the original's maps and slices
+	// are left alone.
+	content, err := json.Marshal(config)
+	if err != nil {
+		return Configuration{}, nil, uerror.WithStackTrace(err)
+	}
+	redactedConfig := Configuration{}
+	if err := json.Unmarshal(content, &redactedConfig); err != nil {
+		return Configuration{}, nil, uerror.WithStackTrace(err)
+	}
+
+	redacted := []string{}
+	redactHooks := func(field string, hooks *HooksConfiguration) {
+		if hooks == nil {
+			return
+		}
+		for name, commands := range map[string][]string{
+			"PostExit":   hooks.PostExit,
+			"PostLaunch": hooks.PostLaunch,
+			"PreLaunch":  hooks.PreLaunch,
+		} {
+			for i := range commands {
+				commands[i] = redactedValue
+				redacted = append(redacted, fmt.Sprintf("%s.%s.%d", field, name, i))
+			}
+		}
+	}
+	redactURL := func(field string, rawURL *string) {
+		parsed, err := url.Parse(*rawURL)
+		if err != nil {
+			*rawURL = redactedValue
+			redacted = append(redacted, field)
+			return
+		}
+		if parsed.User == nil && parsed.RawQuery == "" && parsed.Fragment == "" {
+			return
+		}
+		parsed.User = nil
+		parsed.RawQuery = ""
+		parsed.Fragment = ""
+		*rawURL = parsed.String()
+		redacted = append(redacted, field)
+	}
+
+	redactHooks("Hooks", redactedConfig.Hooks)
+	for i := range redactedConfig.Profiles {
+		profile := &redactedConfig.Profiles[i]
+		field := fmt.Sprintf("Profiles.%d", i)
+		for name := range profile.Environment {
+			profile.Environment[name] = redactedValue
+			redacted = append(redacted, field+".Environment."+name)
+		}
+		if profile.Encryption != nil && len(profile.Encryption.PasswordCommand) > 0 {
+			profile.Encryption.PasswordCommand = []string{redactedValue}
+			redacted = append(redacted, field+".Encryption.PasswordCommand")
+		}
+		redactHooks(field+".Hooks", profile.Hooks)
+		if profile.DoH != nil && profile.DoH.ResolverURL != "" {
+			redactURL(field+".DoH.ResolverURL", &profile.DoH.ResolverURL)
+		}
+		for j, extension := range profile.Extensions {
+			if extension.URL != nil {
+				redactURL(fmt.Sprintf("%s.Extensions.%d.URL", field, j), extension.URL)
+			}
+		}
+	}
+	sort.Strings(redacted)
+	return redactedConfig, redacted, nil
+}
@@ -0,0 +1,418 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// Deprecation describes the use of a deprecated setting in a
+// configuration file.
+type Deprecation struct {
+	// Replacement is the path of the setting to use instead, e.g.
+	// "Profiles.0.UserJSFiles".
+	Replacement string
+	// Setting is the path of the deprecated setting as it is written,
+	// e.g. "Profiles.0.UserJSFile".
+	Setting string
+}
+
+// deprecatedSetting is a setting that was replaced by another one. It
+// keeps working, but configurations that use it get a warning, and
+// MigrateConfiguration replaces it.
+type deprecatedSetting struct {
+	// Block is the path of the settings blocks that have the setting,
+	// "*" standing for every element of a list.
+	Block []string
+	Name  string
+	// Replacement is the name of the setting that replaces it in the
+	// same block.
+	Replacement string
+	// migrate returns the value of the replacement that keeps a block
+	// of the configuration working the same without the deprecated
+	// setting, or false if the block doesn't need to change. It is
+	// called for every block, since blocks that don't have the setting
+	// may inherit it.
+	migrate func(config Configuration, block map[string]interface{}) (interface{}, bool)
+}
+
+var deprecatedSettings = []deprecatedSetting{
+	{
+		Block:       []string{"Profiles", "*"},
+		Name:        "UserJSFile",
+		Replacement: "UserJSFiles",
+		migrate:     migrateUserJSFile,
+	},
+}
+
+// migrateUserJSFile moves a profile's UserJSFile to the front of its
+// UserJSFiles. Since the lists aren't merged when profiles inherit
+// them, profiles that set either get the whole list they end up with,
+// inherited files included. Profiles that set neither keep inheriting
+// both, from a base profile that is migrated as well.
+func migrateUserJSFile(config Configuration, block map[string]interface{}) (interface{}, bool) {
+	_, setsFile := block[findConfigKey(block, "UserJSFile")]
+	_, setsFiles := block[findConfigKey(block, "UserJSFiles")]
+	label, _ := block[findConfigKey(block, "Label")].(string)
+	for _, profile := range config.Profiles {
+		if profile.Label != label || profile.UserJSFile == nil || (!setsFile && !setsFiles) {
+			continue
+		}
+		return append([]string{*profile.UserJSFile}, profile.UserJSFiles...), true
+	}
+	return nil, false
+}
+
+// checkDeprecatedSettings calls deprecated for every deprecated setting
+// a generic configuration document uses.
+func checkDeprecatedSettings(generic interface{}, deprecated func(deprecation Deprecation)) {
+	for _, setting := range deprecatedSettings {
+		walkSettingBlocks(generic, setting.Block, nil, func(block map[string]interface{}, path []string) {
+			key := findConfigKey(block, setting.Name)
+			if _, ok := block[key]; !ok {
+				return
+			}
+			prefix := strings.Join(path, ".") + "."
+			deprecated(Deprecation{
+				Replacement: prefix + setting.findReplacementKey(block, key),
+				Setting:     prefix + key,
+			})
+		})
+	}
+}
+
+// findReplacementKey returns the key of the replacement as it is
+// written in a block. If the block doesn't have it, it is written in
+// the same case as the deprecated key, so "userJSFile" becomes
+// "userJSFiles".
+func (setting deprecatedSetting) findReplacementKey(block map[string]interface{}, deprecatedKey string) string {
+	key := findConfigKey(block, setting.Replacement)
+	if _, ok := block[key]; ok || deprecatedKey == "" {
+		return key
+	}
+	replacement := []byte(setting.Replacement)
+	for i := 0; i < len(replacement) && i < len(setting.Name) && i < len(deprecatedKey); i++ {
+		if !strings.EqualFold(string(replacement[i]), string(setting.Name[i])) {
+			break
+		}
+		replacement[i] = deprecatedKey[i]
+	}
+	return string(replacement)
+}
+
+// walkSettingBlocks calls fn for every settings block of a generic
+// configuration document at blockPath with the path of the block as it
+// is written.
+func walkSettingBlocks(generic interface{}, blockPath []string, path []string, fn func(block map[string]interface{}, path []string)) {
+	if len(blockPath) == 0 {
+		if block, ok := generic.(map[string]interface{}); ok {
+			fn(block, path)
+		}
+		return
+	}
+	switch generic := generic.(type) {
+	case []interface{}:
+		if blockPath[0] != "*" {
+			return
+		}
+		for i, element := range generic {
+			walkSettingBlocks(element, blockPath[1:], append(path[:len(path):len(path)], strconv.Itoa(i)), fn)
+		}
+	case map[string]interface{}:
+		key := findConfigKey(generic, blockPath[0])
+		if value, ok := generic[key]; ok {
+			walkSettingBlocks(value, blockPath[1:], append(path[:len(path):len(path)], key), fn)
+		}
+	}
+}
+
+// settingEdit replaces a deprecated setting in a configuration file.
+type settingEdit struct {
+	// Block is the path of the settings block as it is written.
+	Block []string
+	// Remove is the key of the deprecated setting, or "" if the block
+	// only inherits it.
+	Remove string
+	// Key is the key of the replacement. Value replaces its value if
+	// the block sets it already.
+	Key   string
+	Value interface{}
+}
+
+// getDeprecationEdits returns the edits that replace the deprecated
+// settings in a generic configuration document. config is the resolved
+// configuration the document is part of.
+func getDeprecationEdits(config Configuration, generic interface{}) []settingEdit {
+	edits := []settingEdit{}
+	for _, setting := range deprecatedSettings {
+		walkSettingBlocks(generic, setting.Block, nil, func(block map[string]interface{}, path []string) {
+			remove := findConfigKey(block, setting.Name)
+			if _, ok := block[remove]; !ok {
+				remove = ""
+			}
+			value, ok := setting.migrate(config, block)
+			if !ok {
+				// A deprecated setting that is null is just removed.
+				if remove == "" || block[remove] != nil {
+					return
+				}
+				value = nil
+			}
+			edits = append(edits, settingEdit{
+				Block:  path,
+				Remove: remove,
+				Key:    setting.findReplacementKey(block, remove),
+				Value:  value,
+			})
+		})
+	}
+	return edits
+}
+
+// MigrateConfiguration replaces the deprecated settings in the files of
+// a configuration, including the files it includes or, for a
+// configuration directory, all files in it. The replacements keep the
+// configuration working the same. It returns the files that were
+// changed. Comments in YAML files are kept. TOML files can't be edited
+// and are reported as warnings. Each edit can be undone with
+// UndoLastOperation.
+func MigrateConfiguration(config Configuration, configFile string, mutations *Mutations, warnings *Warnings) ([]string, error) {
+	isDir, err := uio.DirExists(configFile)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	var files []string
+	if isDir {
+		files, err = listConfigurationDir(configFile)
+	} else {
+		files, err = getIncludedFiles(configFile, config.Include)
+		files = append([]string{configFile}, files...)
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	migrated := []string{}
+	for _, file := range files {
+		configBytes, err := uio.ReadFileLimited(file, maxConfigurationSize)
+		if err != nil {
+			return migrated, uerror.WithStackTrace(err)
+		}
+		generic, err := unmarshalConfiguration(file, configBytes, &Configuration{})
+		if err != nil {
+			return migrated, uerror.StackTracef("Failed to parse %s: %w", file, err)
+		}
+		edits := getDeprecationEdits(config, generic)
+		if len(edits) == 0 {
+			continue
+		}
+
+		var updated []byte
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".json":
+			updated, err = applyEditsToJSONConfig(generic, edits)
+		case ".yaml", ".yml":
+			updated, err = applyEditsToYAMLConfig(configBytes, edits)
+		default:
+			warnings.Add(file, "%s, replace its deprecated settings by hand", ErrUnsupportedConfigFormat)
+			continue
+		}
+		if err != nil {
+			return migrated, uerror.StackTracef("Failed to update %s: %w", file, err)
+		}
+		// The edits must not break the file.
+		if _, err := decodeConfiguration(file, updated, nil); err != nil {
+			return migrated, uerror.WithStackTrace(err)
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return migrated, uerror.WithStackTrace(err)
+		}
+		if err := mutations.Apply("Replace deprecated settings in", file, func() error {
+			return writeConfigFileWithBackup(config, file, configBytes, updated, info.Mode().Perm())
+		}); err != nil {
+			return migrated, uerror.WithStackTrace(err)
+		}
+		migrated = append(migrated, file)
+	}
+	return migrated, nil
+}
+
+func applyEditsToJSONConfig(generic interface{}, edits []settingEdit) ([]byte, error) {
+	for _, edit := range edits {
+		value := generic
+		for _, key := range edit.Block {
+			switch v := value.(type) {
+			case []interface{}:
+				i, _ := strconv.Atoi(key)
+				value = v[i]
+			case map[string]interface{}:
+				value = v[key]
+			}
+		}
+		block := value.(map[string]interface{})
+		if edit.Remove != "" {
+			delete(block, edit.Remove)
+		}
+		if edit.Value != nil {
+			block[edit.Key] = edit.Value
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// applyEditsToYAMLConfig edits the YAML nodes, so comments are kept. A
+// replacement takes the place of the setting it replaces.
+func applyEditsToYAMLConfig(configBytes []byte, edits []settingEdit) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(configBytes, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, fmt.Errorf("the document is empty")
+	}
+	for _, edit := range edits {
+		node := document.Content[0]
+		for _, key := range edit.Block {
+			node = findYAMLChild(node, key)
+			if node == nil {
+				return nil, fmt.Errorf("%s not found", strings.Join(edit.Block, "."))
+			}
+		}
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s isn't a mapping", strings.Join(edit.Block, "."))
+		}
+
+		var valueNode yaml.Node
+		if err := valueNode.Encode(edit.Value); err != nil {
+			return nil, err
+		}
+		removeAt, keyAt := -1, -1
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			switch node.Content[i].Value {
+			case edit.Remove:
+				removeAt = i
+			case edit.Key:
+				keyAt = i
+			}
+		}
+		switch {
+		case edit.Value == nil:
+			// Only the deprecated setting is removed.
+		case keyAt >= 0:
+			replaceYAMLValue(node, keyAt, &valueNode)
+		case removeAt >= 0:
+			// The setting is renamed, so it keeps its place.
+			node.Content[removeAt].Value = edit.Key
+			replaceYAMLValue(node, removeAt, &valueNode)
+			removeAt = -1
+		default:
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: edit.Key}, &valueNode)
+		}
+		if edit.Remove != "" && removeAt >= 0 {
+			removeYAMLKey(node, removeAt, keyAt)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// replaceYAMLValue replaces the value of the key at keyAt in a mapping
+// node, keeping the comments of the value and of list items that are
+// still there.
+func replaceYAMLValue(node *yaml.Node, keyAt int, value *yaml.Node) {
+	old := node.Content[keyAt+1]
+	value.HeadComment = old.HeadComment
+	value.FootComment = old.FootComment
+	if value.Kind != yaml.ScalarNode && value.Style&yaml.FlowStyle == 0 {
+		// A block list starts on the next line, so the comment stays on
+		// the line of the key.
+		node.Content[keyAt].LineComment = joinYAMLComments(node.Content[keyAt].LineComment, old.LineComment)
+	} else {
+		value.LineComment = old.LineComment
+	}
+	if old.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode {
+		for _, item := range value.Content {
+			for _, oldItem := range old.Content {
+				if oldItem.Kind == yaml.ScalarNode && oldItem.Value == item.Value {
+					item.HeadComment = oldItem.HeadComment
+					item.LineComment = oldItem.LineComment
+					item.FootComment = oldItem.FootComment
+					break
+				}
+			}
+		}
+	}
+	node.Content[keyAt+1] = value
+}
+
+// removeYAMLKey removes the key at removeAt from a mapping node. Its
+// comments move to the key at keepAt, or to the key that follows it if
+// keepAt is -1, so they aren't lost.
+func removeYAMLKey(node *yaml.Node, removeAt int, keepAt int) {
+	key, value := node.Content[removeAt], node.Content[removeAt+1]
+	comments := joinYAMLComments(key.HeadComment, key.LineComment, value.HeadComment, value.LineComment, value.FootComment, key.FootComment)
+	if keepAt < 0 && removeAt+2 < len(node.Content) {
+		keepAt = removeAt + 2
+	}
+	if keepAt >= 0 {
+		node.Content[keepAt].HeadComment = joinYAMLComments(comments, node.Content[keepAt].HeadComment)
+	} else {
+		node.FootComment = joinYAMLComments(node.FootComment, comments)
+	}
+	node.Content = append(node.Content[:removeAt], node.Content[removeAt+2:]...)
+}
+
+func joinYAMLComments(comments ...string) string {
+	nonEmpty := []string{}
+	for _, comment := range comments {
+		if comment != "" {
+			nonEmpty = append(nonEmpty, comment)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
+}
+
+// findYAMLChild returns the value of a key of a mapping node or the
+// element of a sequence node at an index.
+func findYAMLChild(node *yaml.Node, key string) *yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
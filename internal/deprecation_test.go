@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func getEffectiveUserJSFilesForTest(config Configuration) map[string][]string {
+	files := map[string][]string{}
+	for _, profile := range config.Profiles {
+		files[profile.Label] = getUserJSLayers(config, profile, nil)[1].Files
+	}
+	return files
+}
+
+func getDeprecationsForTest(warnings *Warnings) []Deprecation {
+	deprecations := []Deprecation{}
+	for _, warning := range warnings.List() {
+		if warning.Deprecation != nil {
+			deprecations = append(deprecations, *warning.Deprecation)
+		}
+	}
+	return deprecations
+}
+
+func TestDeprecationWarnings(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	assert.NoError(t, os.WriteFile(configFile, []byte(`{
+		"ProfilePath": "profiles",
+		"Profiles": [
+			{"Label": "plain", "UserJSFiles": ["builtin:baseline"]},
+			{"Label": "old", "userJsFile": "builtin:baseline", "userJsFiles": []}
+		]
+	}`), uio.FileModeURWGRWO))
+
+	warnings := &Warnings{}
+	_, _, err := ReadConfiguration(configFile, warnings)
+	assert.NoError(t, err)
+	assert.Equal(t, []Deprecation{{
+		Replacement: "Profiles.1.userJsFiles",
+		Setting:     "Profiles.1.userJsFile",
+	}}, getDeprecationsForTest(warnings))
+	assert.Equal(t, configFile, warnings.List()[0].Source)
+	assert.Contains(t, warnings.List()[0].Message, "Profiles.1.userJsFile is deprecated, use Profiles.1.userJsFiles instead")
+}
+
+func TestMigrateConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.js", "b.js", "c.js"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{}, uio.FileModeURWGRWO))
+	}
+	configFile := filepath.Join(dir, "config.json")
+	files := map[string]string{
+		"config.json": `{
+			"ProfilePath": "profiles",
+			"Include": ["profiles.d/*"],
+			"Profiles": [
+				{"Label": "base", "UserJSFile": "a.js", "UserJSFiles": ["b.js"]},
+				{"Label": "inherits", "Extends": "base"},
+				{"Label": "adds", "Extends": "base", "UserJSFiles": ["c.js"]},
+				{"Label": "replaces", "Extends": "base", "userjsfile": "c.js"},
+				{"Label": "plain", "UserJSFiles": ["c.js"]}
+			]
+		}`,
+		"profiles.d/other.json": `{"Profiles": [{"Label": "other", "UserJSFile": "a.js"}]}`,
+		"profiles.d/kept.toml":  "[[Profiles]]\nLabel = \"kept\"\nUserJSFile = \"a.js\"\n",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), uio.FileModeURWGRWO))
+	}
+	config, _, err := ReadConfiguration(configFile, nil)
+	assert.NoError(t, err)
+	expected := getEffectiveUserJSFilesForTest(config)
+	assert.Equal(t, []string{"a.js", "b.js"}, expected["inherits"])
+	assert.Equal(t, []string{"a.js", "c.js"}, expected["adds"])
+	assert.Equal(t, []string{"c.js", "b.js"}, expected["replaces"])
+
+	migrated, err := MigrateConfiguration(config, configFile, &Mutations{DryRun: true}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, migrated, 2)
+	configBytes, err := os.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(configBytes), `"UserJSFile"`)
+
+	warnings := &Warnings{}
+	migrated, err = MigrateConfiguration(config, configFile, nil, warnings)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{configFile, filepath.Join(dir, "profiles.d", "other.json")}, migrated)
+	if assert.Len(t, warnings.List(), 1) {
+		assert.Equal(t, filepath.Join(dir, "profiles.d", "kept.toml"), warnings.List()[0].Source)
+		assert.Contains(t, warnings.List()[0].Message, "replace its deprecated settings by hand")
+	}
+
+	warnings = &Warnings{}
+	config, _, err = ReadConfiguration(configFile, warnings)
+	assert.NoError(t, err)
+	assert.Equal(t, []Deprecation{{
+		Replacement: "Profiles.0.UserJSFiles",
+		Setting:     "Profiles.0.UserJSFile",
+	}}, getDeprecationsForTest(warnings), "only the TOML file is left")
+	assert.Equal(t, expected, getEffectiveUserJSFilesForTest(config))
+	for _, profile := range config.Profiles {
+		if profile.Label != "kept" {
+			assert.Nil(t, profile.UserJSFile, profile.Label)
+		}
+	}
+
+	// The edit of the last file can be undone.
+	_, _, err = UndoLastOperation(config, CollisionFail, nil)
+	assert.NoError(t, err)
+	otherBytes, err := os.ReadFile(filepath.Join(dir, "profiles.d", "other.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, files["profiles.d/other.json"], string(otherBytes))
+
+	config, _, err = ReadConfiguration(configFile, nil)
+	assert.NoError(t, err)
+	migrated, err = MigrateConfiguration(config, configFile, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "profiles.d", "other.json")}, migrated)
+	config, _, err = ReadConfiguration(configFile, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, getEffectiveUserJSFilesForTest(config))
+}
+
+func TestMigrateConfigurationYAML(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.js"), []byte{}, uio.FileModeURWGRWO))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.js"), []byte{}, uio.FileModeURWGRWO))
+	configFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(configFile, []byte(`# Profiles for work
+ProfilePath: profiles
+Profiles:
+  # The hardened base
+  - Label: base
+    # Hardening first
+    UserJSFile: a.js
+    UserJSFiles:
+      - b.js # overrides
+  - Label: single
+    UserJSFile: a.js # from the old days
+`), uio.FileModeURWGRWO))
+	config, _, err := ReadConfiguration(configFile, nil)
+	assert.NoError(t, err)
+	expected := getEffectiveUserJSFilesForTest(config)
+
+	migrated, err := MigrateConfiguration(config, configFile, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{configFile}, migrated)
+
+	configBytes, err := os.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(configBytes), "# Profiles for work")
+	assert.Contains(t, string(configBytes), "# The hardened base")
+	assert.Contains(t, string(configBytes), "# Hardening first")
+	assert.Contains(t, string(configBytes), "- b.js # overrides")
+	assert.Contains(t, string(configBytes), "UserJSFiles: # from the old days")
+	assert.NotContains(t, string(configBytes), "UserJSFile:")
+
+	warnings := &Warnings{}
+	config, _, err = ReadConfiguration(configFile, warnings)
+	assert.NoError(t, err)
+	assert.Empty(t, getDeprecationsForTest(warnings))
+	assert.Equal(t, expected, getEffectiveUserJSFilesForTest(config))
+}
+
+func TestMigrateConfigurationKeepsKeyCase(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.js"), []byte{}, uio.FileModeURWGRWO))
+	configFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(configFile, []byte("profiles:\n  - label: single\n    userJSFile: a.js\n"), uio.FileModeURWGRWO))
+
+	warnings := &Warnings{}
+	config, _, err := ReadConfiguration(configFile, warnings)
+	assert.NoError(t, err)
+	assert.Equal(t, []Deprecation{{
+		Replacement: "profiles.0.userJSFiles",
+		Setting:     "profiles.0.userJSFile",
+	}}, getDeprecationsForTest(warnings))
+
+	_, err = MigrateConfiguration(config, configFile, nil, nil)
+	assert.NoError(t, err)
+	configBytes, err := os.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "profiles:\n  - label: single\n    userJSFiles:\n      - a.js\n", string(configBytes))
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrDifferentProfiles error = errors.New("Instances belong to different profiles")
+
+// instanceStores are the parts of an instance whose sizes are
+// compared by DiffInstances, relative to the profile directory.
+var instanceStores = []struct {
+	name string
+	path string
+}{
+	{"cache", "../Caches"},
+	{"cookies", "cookies.sqlite"},
+	{"extensions", "extensions"},
+	{"places", "places.sqlite"},
+	{"sessions", "sessionstore-backups"},
+	{"storage", "storage"},
+}
+
+type InstanceDiff struct {
+	A, B              ProfileInstance
+	ExtensionVersions []ExtensionVersionDifference
+	ExtensionsOnlyInA []string
+	ExtensionsOnlyInB []string
+	Prefs             []PrefDifference
+	StoreSizes        []StoreSizes
+}
+
+// ExtensionVersionDifference describes an extension that is installed
+// in different versions in two instances.
+type ExtensionVersionDifference struct {
+	ID   string
+	A, B string
+}
+
+// PrefDifference describes a pref that differs between two instances.
+// Values are JavaScript literals, nil means the pref isn't set.
+type PrefDifference struct {
+	Name string
+	A, B *string
+}
+
+type StoreSizes struct {
+	Name string
+	A, B int64
+}
+
+// DiffInstances compares two instances of the same profile.
+func DiffInstances(config Configuration, a, b ProfileInstance) (InstanceDiff, error) {
+	if a.ProfileLabel != b.ProfileLabel {
+		return InstanceDiff{}, uerror.StackTracef("%w: %s is an instance of %s, %s is an instance of %s", ErrDifferentProfiles, a.InstanceLabel, a.ProfileLabel, b.InstanceLabel, b.ProfileLabel)
+	}
+
+	diff := InstanceDiff{
+		A: a,
+		B: b,
+	}
+
+	versionsA, err := getExtensionVersions(config, a)
+	if err != nil {
+		return InstanceDiff{}, uerror.WithStackTrace(err)
+	}
+	versionsB, err := getExtensionVersions(config, b)
+	if err != nil {
+		return InstanceDiff{}, uerror.WithStackTrace(err)
+	}
+	idsA, idsB := []string{}, []string{}
+	for id := range versionsA {
+		idsA = append(idsA, id)
+	}
+	for id := range versionsB {
+		idsB = append(idsB, id)
+	}
+	diff.ExtensionsOnlyInA = subtractStrings(idsA, idsB)
+	diff.ExtensionsOnlyInB = subtractStrings(idsB, idsA)
+	sort.Strings(idsA)
+	for _, id := range idsA {
+		versionB, ok := versionsB[id]
+		if ok && versionsA[id] != versionB {
+			diff.ExtensionVersions = append(diff.ExtensionVersions, ExtensionVersionDifference{
+				ID: id,
+				A:  versionsA[id],
+				B:  versionB,
+			})
+		}
+	}
+
+	prefsA, err := readEffectivePrefs(getInstanceDir(config, a))
+	if err != nil {
+		return InstanceDiff{}, uerror.WithStackTrace(err)
+	}
+	prefsB, err := readEffectivePrefs(getInstanceDir(config, b))
+	if err != nil {
+		return InstanceDiff{}, uerror.WithStackTrace(err)
+	}
+	diff.Prefs = diffPrefs(prefsA, prefsB)
+
+	for _, store := range instanceStores {
+		sizeA, err := getStoreSize(config, a, store.path)
+		if err != nil {
+			return InstanceDiff{}, uerror.WithStackTrace(err)
+		}
+		sizeB, err := getStoreSize(config, b, store.path)
+		if err != nil {
+			return InstanceDiff{}, uerror.WithStackTrace(err)
+		}
+		diff.StoreSizes = append(diff.StoreSizes, StoreSizes{
+			Name: store.name,
+			A:    sizeA,
+			B:    sizeB,
+		})
+	}
+
+	return diff, nil
+}
+
+// getExtensionVersions maps the IDs of the extensions installed in an
+// instance to their versions. If Firefox hasn't recorded them yet, the
+// extensions installed by tbml are returned with an empty version.
+func getExtensionVersions(config Configuration, instance ProfileInstance) (map[string]string, error) {
+	extensions, err := GetInstanceExtensions(config, instance)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	versions := make(map[string]string)
+	if extensions == nil {
+		for _, id := range instance.InstalledExtensions {
+			versions[id] = ""
+		}
+		return versions, nil
+	}
+	for _, extension := range extensions {
+		versions[extension.ID] = extension.Version
+	}
+	return versions, nil
+}
+
+// readEffectivePrefs reads the prefs of an instance as Firefox would
+// apply them: prefs.js first, then user.js. The values are returned
+// as JavaScript literals.
+func readEffectivePrefs(instanceDir string) (map[string]string, error) {
+	prefs := make(map[string]string)
+	for _, fileName := range []string{"prefs.js", "user.js"} {
+		content, err := os.ReadFile(filepath.Join(instanceDir, relativeProfilePath, fileName))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		for _, pref := range parseUserPrefs(string(content)) {
+			valueJS, err := marshalJS(pref.Value)
+			if err != nil {
+				return nil, uerror.WithStackTrace(err)
+			}
+			prefs[pref.Name] = valueJS
+		}
+	}
+	return prefs, nil
+}
+
+func diffPrefs(a, b map[string]string) []PrefDifference {
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differences := []PrefDifference{}
+	for _, name := range names {
+		valueA, okA := a[name]
+		valueB, okB := b[name]
+		if okA && okB && valueA == valueB {
+			continue
+		}
+		difference := PrefDifference{Name: name}
+		if okA {
+			difference.A = &valueA
+		}
+		if okB {
+			difference.B = &valueB
+		}
+		differences = append(differences, difference)
+	}
+	return differences
+}
+
+func getStoreSize(config Configuration, instance ProfileInstance, storePath string) (int64, error) {
+	size, err := uio.DirSize(filepath.Join(getInstanceDir(config, instance), relativeProfilePath, storePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// subtractStrings returns all strings in a that aren't in b.
+func subtractStrings(a, b []string) []string {
+	inB := make(map[string]bool)
+	for _, str := range b {
+		inB[str] = true
+	}
+	result := []string{}
+	for _, str := range a {
+		if !inB[str] {
+			result = append(result, str)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestDiffInstances(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	a := ProfileInstance{
+		InstalledExtensions: []string{"foo@t0ast.cc", "bar@t0ast.cc"},
+		InstanceLabel:       "test-1",
+		ProfileLabel:        "test",
+	}
+	b := ProfileInstance{
+		InstalledExtensions: []string{"bar@t0ast.cc", "baz@t0ast.cc"},
+		InstanceLabel:       "test-2",
+		ProfileLabel:        "test",
+	}
+
+	writeProfileFile := func(instance ProfileInstance, name, content string) {
+		path := filepath.Join(getInstanceDir(config, instance), relativeProfilePath, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, []byte(content), uio.FileModeURWGRWO))
+	}
+	writeProfileFile(a, "prefs.js", `user_pref("same", 1);`+"\n"+`user_pref("overridden", 1);`+"\n"+`user_pref("only.a", true);`)
+	writeProfileFile(a, "user.js", `user_pref("overridden", 2);`)
+	writeProfileFile(b, "prefs.js", `user_pref("same", 1);`+"\n"+`user_pref("overridden", 1);`+"\n"+`user_pref("only.b", "b");`)
+	writeProfileFile(a, "places.sqlite", "12345")
+	writeProfileFile(b, "places.sqlite", "123")
+
+	diff, err := DiffInstances(config, a, b)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"foo@t0ast.cc"}, diff.ExtensionsOnlyInA)
+	assert.Equal(t, []string{"baz@t0ast.cc"}, diff.ExtensionsOnlyInB)
+	assert.Equal(t, []PrefDifference{
+		{Name: "only.a", A: strPtr("true")},
+		{Name: "only.b", B: strPtr(`"b"`)},
+		{Name: "overridden", A: strPtr("2"), B: strPtr("1")},
+	}, diff.Prefs)
+	assert.Contains(t, diff.StoreSizes, StoreSizes{Name: "places", A: 5, B: 3})
+	assert.Contains(t, diff.StoreSizes, StoreSizes{Name: "storage", A: 0, B: 0})
+}
+
+func TestDiffInstancesExtensionVersions(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	a := ProfileInstance{InstanceLabel: "test-1", ProfileLabel: "test"}
+	b := ProfileInstance{InstanceLabel: "test-2", ProfileLabel: "test"}
+	writeExtensionsJSON(t, getInstanceDir(config, a), `{"addons": [
+		{"id": "foo@t0ast.cc", "version": "1.0", "type": "extension", "location": "app-profile", "active": true},
+		{"id": "bar@t0ast.cc", "version": "2.0", "type": "extension", "location": "app-profile", "active": true}
+	]}`)
+	writeExtensionsJSON(t, getInstanceDir(config, b), `{"addons": [
+		{"id": "foo@t0ast.cc", "version": "1.1", "type": "extension", "location": "app-profile", "active": true}
+	]}`)
+
+	diff, err := DiffInstances(config, a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar@t0ast.cc"}, diff.ExtensionsOnlyInA)
+	assert.Empty(t, diff.ExtensionsOnlyInB)
+	assert.Equal(t, []ExtensionVersionDifference{{ID: "foo@t0ast.cc", A: "1.0", B: "1.1"}}, diff.ExtensionVersions)
+}
+
+func TestDiffInstancesDifferentProfiles(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	_, err := DiffInstances(config, ProfileInstance{ProfileLabel: "a"}, ProfileInstance{ProfileLabel: "b"})
+	assert.ErrorIs(t, err, ErrDifferentProfiles)
+}
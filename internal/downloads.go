@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var downloadDirPrefNames = []string{"browser.download.dir", "browser.download.folderList", "browser.download.useDownloadDir"}
+
+var downloadDirPlaceholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateDownloadDir checks a DownloadDir template without expanding
+// it.
+func validateDownloadDir(template string) error {
+	if !filepath.IsAbs(template) && !strings.HasPrefix(template, "~/") {
+		return fmt.Errorf("The download directory %q is neither absolute nor in the home directory", template)
+	}
+	for _, placeholder := range downloadDirPlaceholderPattern.FindAllString(template, -1) {
+		if placeholder != "{profile}" && placeholder != "{topic}" {
+			return fmt.Errorf("Unknown placeholder %s in the download directory", placeholder)
+		}
+	}
+	return nil
+}
+
+// getDownloadDir expands the profile's DownloadDir for the instance.
+// Instances without a topic use their label instead. If the profile
+// has no DownloadDir, it returns "".
+func getDownloadDir(profile ProfileConfiguration, instance ProfileInstance) (string, error) {
+	if profile.DownloadDir == nil {
+		return "", nil
+	}
+	dir := *profile.DownloadDir
+	if strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", uerror.StackTracef("Failed to expand home directory in download directory: %w", err)
+		}
+		dir = filepath.Join(home, dir[2:])
+	}
+	topic := instance.InstanceLabel
+	if instance.UsageLabel != nil {
+		topic = *instance.UsageLabel
+	}
+	dir = strings.NewReplacer(
+		"{profile}", toPathComponent(profile.Label),
+		"{topic}", toPathComponent(topic),
+	).Replace(dir)
+	return filepath.Clean(dir), nil
+}
+
+// toPathComponent makes a label usable as a single directory name, so
+// a topic like "a/b" or ".." can't point the download directory
+// elsewhere.
+func toPathComponent(label string) string {
+	label = strings.NewReplacer("/", "_", "\x00", "_").Replace(label)
+	if label == "" || label == "." || label == ".." {
+		return "_" + label
+	}
+	return label
+}
+
+// ensureDownloadDir creates the instance's download directory and
+// points the browser at it at the end of the instance's user.js, like
+// writePortSettings. Settings of earlier launches are removed first,
+// so a profile without a DownloadDir goes back to the browser's
+// default.
+func ensureDownloadDir(profile ProfileConfiguration, instance ProfileInstance, instanceDir string) error {
+	dir, err := getDownloadDir(profile, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, uio.FileModeURWXGRWXO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	userJSPath := filepath.Join(instanceDir, relativeProfilePath, "user.js")
+	userJS, err := os.ReadFile(userJSPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return uerror.WithStackTrace(err)
+	}
+	sb := &strings.Builder{}
+	for _, line := range strings.SplitAfter(string(userJS), "\n") {
+		if !isUserPrefLine(line, downloadDirPrefNames) {
+			sb.WriteString(line)
+		}
+	}
+	if dir == "" && sb.Len() == len(userJS) {
+		return nil
+	}
+	if dir != "" {
+		for _, pref := range []userPref{
+			{"browser.download.dir", dir},
+			{"browser.download.folderList", 2},
+			{"browser.download.useDownloadDir", true},
+		} {
+			line, err := formatUserPref(pref)
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			fmt.Fprintln(sb, line)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(userJSPath), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(userJSPath, []byte(sb.String()), uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestGetDownloadDir(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+	topic := "news"
+	escapingTopic := "../secrets"
+	homeTemplate := "~/Downloads/{profile}/{topic}"
+	topicTemplate := "/srv/downloads/{topic}"
+	testCases := []struct {
+		desc string
+
+		template   *string
+		usageLabel *string
+		expected   string
+	}{
+		{
+			desc: "no download directory",
+		},
+		{
+			desc: "profile and topic",
+
+			template:   &homeTemplate,
+			usageLabel: &topic,
+			expected:   "/home/user/Downloads/test/news",
+		},
+		{
+			desc: "no topic",
+
+			template: &topicTemplate,
+			expected: "/srv/downloads/test-1",
+		},
+		{
+			desc: "topic with a slash",
+
+			template:   &topicTemplate,
+			usageLabel: &escapingTopic,
+			expected:   "/srv/downloads/.._secrets",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			profile := ProfileConfiguration{DownloadDir: tC.template, Label: "test"}
+			instance := ProfileInstance{InstanceLabel: "test-1", ProfileLabel: "test", UsageLabel: tC.usageLabel}
+			dir, err := getDownloadDir(profile, instance)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expected, dir)
+		})
+	}
+}
+
+func TestValidateDownloadDir(t *testing.T) {
+	assert.NoError(t, validateDownloadDir("~/Downloads/{profile}/{topic}"))
+	assert.NoError(t, validateDownloadDir("/srv/downloads"))
+	assert.Error(t, validateDownloadDir("Downloads/{topic}"))
+	assert.Error(t, validateDownloadDir("~/Downloads/{instance}"))
+}
+
+func TestEnsureDownloadDir(t *testing.T) {
+	instanceDir := t.TempDir()
+	downloadDir := filepath.Join(t.TempDir(), "downloads", "{topic}")
+	userJSPath := filepath.Join(instanceDir, relativeProfilePath, "user.js")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(userJSPath), uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(userJSPath, []byte("user_pref(\"browser.download.dir\", \"/old\");\nuser_pref(\"a\", 1);\n"), uio.FileModeURWGRWO))
+
+	topic := "news"
+	profile := ProfileConfiguration{DownloadDir: &downloadDir, Label: "test"}
+	instance := ProfileInstance{InstanceLabel: "test-1", ProfileLabel: "test", UsageLabel: &topic}
+	assert.NoError(t, ensureDownloadDir(profile, instance, instanceDir))
+
+	expectedDir := filepath.Join(filepath.Dir(downloadDir), "news")
+	assert.DirExists(t, expectedDir)
+	userJS, err := os.ReadFile(userJSPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "user_pref(\"a\", 1);\n"+
+		"user_pref(\"browser.download.dir\", \""+expectedDir+"\");\n"+
+		"user_pref(\"browser.download.folderList\", 2);\n"+
+		"user_pref(\"browser.download.useDownloadDir\", true);\n", string(userJS))
+
+	// Without a download directory, the settings of earlier launches
+	// are removed.
+	assert.NoError(t, ensureDownloadDir(ProfileConfiguration{Label: "test"}, instance, instanceDir))
+	userJS, err = os.ReadFile(userJSPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "user_pref(\"a\", 1);\n", string(userJS))
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrEncryptionUnavailable error = errors.New("Encryption unavailable")
+
+const encryptionTypeGocryptfs = "gocryptfs"
+
+// encryptionBinaries maps encryption types to the programs that
+// implement them.
+var encryptionBinaries = map[string]string{
+	encryptionTypeGocryptfs: "gocryptfs",
+}
+
+// The encrypted container and the directory it is mounted at live in
+// the instance's directory in the profile path, next to its metadata.
+const (
+	encryptedInstanceCipherDirName = "encrypted"
+	encryptedInstanceMountDirName  = "decrypted"
+)
+
+func getEncryptionConfiguration(profile ProfileConfiguration) EncryptionConfiguration {
+	encryption := EncryptionConfiguration{}
+	if profile.Encryption != nil {
+		encryption = *profile.Encryption
+	}
+	if encryption.Type == "" {
+		encryption.Type = encryptionTypeGocryptfs
+	}
+	return encryption
+}
+
+func validateEncryptionSettings(profile ProfileConfiguration) error {
+	if profile.Encryption == nil {
+		return nil
+	}
+	encryption := getEncryptionConfiguration(profile)
+	if _, ok := encryptionBinaries[encryption.Type]; !ok {
+		return fmt.Errorf("Unknown encryption type %s", encryption.Type)
+	}
+	// The containers of encrypted instances are kept in their directory
+	// in the global profile path.
+	if profile.ProfilePath != nil {
+		return errors.New("Encrypted profiles can't have a ProfilePath of their own")
+	}
+	return nil
+}
+
+// mountEncryptedInstance mounts the container of an encrypted instance
+// at its instance directory, creating the container on first use, and
+// returns the function that unmounts it. The instance must be locked by
+// the caller. Instances that aren't encrypted are left alone. If the
+// encryption's program isn't installed, or there is neither a
+// PasswordCommand nor a terminal to ask for the password in, the
+// returned error wraps ErrEncryptionUnavailable.
+func mountEncryptedInstance(config Configuration, profile ProfileConfiguration, instance ProfileInstance, warnings *Warnings) (unmount func() error, err error) {
+	if !instance.Encrypted {
+		if profile.Encryption != nil && instance.Directory == nil {
+			warnings.Add(instance.InstanceLabel, "The instance was created before encryption was enabled for %s and is not encrypted", profile.Label)
+		}
+		return func() error { return nil }, nil
+	}
+
+	encryption := getEncryptionConfiguration(profile)
+	// Without a terminal, e.g. when launched from a desktop entry,
+	// gocryptfs would wait for a password nobody can enter.
+	if len(encryption.PasswordCommand) == 0 && !stdinIsTerminal() {
+		return nil, uerror.StackTracef("%w: there is no terminal to ask for the password of %s in, set a PasswordCommand", ErrEncryptionUnavailable, instance.InstanceLabel)
+	}
+	binary := encryptionBinaries[encryption.Type]
+	if _, err := exec.LookPath(binary); err != nil {
+		return nil, uerror.StackTracef("%w: %s is not installed", ErrEncryptionUnavailable, binary)
+	}
+
+	recordDir := getInstanceRecordDir(config, instance)
+	cipherDir := filepath.Join(recordDir, encryptedInstanceCipherDirName)
+	mountDir := filepath.Join(recordDir, encryptedInstanceMountDirName)
+	passwordArgs := []string{}
+	for _, arg := range encryption.PasswordCommand {
+		passwordArgs = append(passwordArgs, "-extpass", arg)
+	}
+
+	initialized, err := uio.FileExists(filepath.Join(cipherDir, "gocryptfs.conf"))
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if !initialized {
+		if err := os.MkdirAll(cipherDir, uio.FileModeURWXGRWXO); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if err := runEncryptionCommand(binary, append(append([]string{"-init", "-q"}, passwordArgs...), cipherDir)...); err != nil {
+			return nil, uerror.StackTracef("Failed to create the encrypted container of %s: %w", instance.InstanceLabel, err)
+		}
+		ulog.Default().Info("Created encrypted container", "instance", instance.InstanceLabel)
+	}
+
+	if err := os.MkdirAll(mountDir, uio.FileModeURWXGRWXO); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if err := runEncryptionCommand(binary, append(append([]string{"-q"}, passwordArgs...), cipherDir, mountDir)...); err != nil {
+		return nil, uerror.StackTracef("Failed to mount the encrypted container of %s: %w", instance.InstanceLabel, err)
+	}
+	return func() error {
+		if err := runEncryptionCommand("fusermount", "-u", mountDir); err != nil {
+			return uerror.StackTracef("Failed to unmount the encrypted container of %s: %w", instance.InstanceLabel, err)
+		}
+		return nil
+	}, nil
+}
+
+// stdinIsTerminal tells whether the standard input is a terminal. It
+// is a variable so tests don't depend on how they are run.
+var stdinIsTerminal = func() bool {
+	var state syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&state)))
+	return errno == 0
+}
+
+// runEncryptionCommand runs a program in the terminal, so it can ask
+// for a password.
+func runEncryptionCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
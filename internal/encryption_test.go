@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountEncryptedInstance(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	// Unencrypted instances are left alone, but warned about if their
+	// profile wants encryption.
+	warnings := &Warnings{}
+	unmount, err := mountEncryptedInstance(config, profile, instance, warnings)
+	assert.NoError(t, err)
+	assert.NoError(t, unmount())
+	assert.Empty(t, warnings.List())
+	profile.Encryption = &EncryptionConfiguration{}
+	unmount, err = mountEncryptedInstance(config, profile, instance, warnings)
+	assert.NoError(t, err)
+	assert.NoError(t, unmount())
+	assert.Len(t, warnings.List(), 1)
+
+	// New instances of the profile are encrypted.
+	instance = GetBestInstance(profile, nil)
+	assert.True(t, instance.Encrypted)
+	assert.Equal(t, filepath.Join(config.ProfilePath, instance.InstanceLabel, encryptedInstanceMountDirName), getInstanceDir(config, instance))
+
+	defaultStdinIsTerminal := stdinIsTerminal
+	defer func() { stdinIsTerminal = defaultStdinIsTerminal }()
+	stdinIsTerminal = func() bool { return false }
+	_, err = mountEncryptedInstance(config, profile, instance, nil)
+	assert.ErrorIs(t, err, ErrEncryptionUnavailable)
+	assert.Contains(t, err.Error(), "PasswordCommand")
+
+	profile.Encryption.PasswordCommand = []string{"pass", "show", "tbml"}
+	t.Setenv("PATH", "")
+	_, err = mountEncryptedInstance(config, profile, instance, nil)
+	assert.ErrorIs(t, err, ErrEncryptionUnavailable)
+	assert.Contains(t, err.Error(), "not installed")
+}
+
+func TestValidateEncryptionSettings(t *testing.T) {
+	assert.NoError(t, validateEncryptionSettings(ProfileConfiguration{}))
+	assert.NoError(t, validateEncryptionSettings(ProfileConfiguration{Encryption: &EncryptionConfiguration{}}))
+	assert.NoError(t, validateEncryptionSettings(ProfileConfiguration{Encryption: &EncryptionConfiguration{Type: "gocryptfs"}}))
+	assert.Error(t, validateEncryptionSettings(ProfileConfiguration{Encryption: &EncryptionConfiguration{Type: "fscrypt"}}))
+}
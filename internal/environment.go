@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// Environment variables that override paths of the configuration, so
+// containers and CI jobs can redirect them without editing it. The
+// configuration file itself is chosen with TBML_CONFIG.
+const (
+	ConfigEnvVar        = "TBML_CONFIG"
+	EphemeralPathEnvVar = "TBML_EPHEMERAL_PATH"
+	ProfilePathEnvVar   = "TBML_PROFILE_PATH"
+)
+
+// applyPathEnvironment replaces the paths of the configuration that
+// are set through the environment. Relative paths are resolved against
+// the working directory.
+func applyPathEnvironment(config *Configuration) error {
+	for envVar, path := range map[string]*string{
+		EphemeralPathEnvVar: &config.EphemeralPath,
+		ProfilePathEnvVar:   &config.ProfilePath,
+	} {
+		value := os.Getenv(envVar)
+		if value == "" {
+			continue
+		}
+		absValue, err := filepath.Abs(value)
+		if err != nil {
+			return uerror.StackTracef("Invalid %s: %w", envVar, err)
+		}
+		*path = absValue
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestReadConfigurationPathEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	assert.NoError(t, os.WriteFile(configFile, []byte(`{"ProfilePath": "profiles", "Profiles": [{"Label": "test"}]}`), uio.FileModeURWGRWO))
+
+	t.Setenv(ProfilePathEnvVar, filepath.Join(dir, "ci-profiles"))
+	t.Setenv(EphemeralPathEnvVar, filepath.Join(dir, "ci-ephemeral"))
+	config, _, err := ReadConfiguration(configFile, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "ci-profiles"), config.ProfilePath)
+	assert.Equal(t, filepath.Join(dir, "ci-ephemeral"), config.EphemeralPath)
+}
+
+func TestReadConfigurationNoCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	assert.NoError(t, os.WriteFile(configFile, []byte(`{"Profiles": [{"Label": "test"}]}`), uio.FileModeURWGRWO))
+
+	t.Setenv("HOME", "")
+	t.Setenv("XDG_CACHE_HOME", "")
+	warnings := &Warnings{}
+	config, _, err := ReadConfiguration(configFile, warnings)
+	assert.NoError(t, err)
+	assert.True(t, filepath.IsAbs(config.ProfilePath))
+	assert.Len(t, warnings.List(), 1)
+}
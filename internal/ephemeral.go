@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// NewEphemeralInstance creates a throwaway instance of a profile. Its
+// files live in a fresh directory in the ephemeral path; only its
+// metadata and lock are kept in the profile path. It is never chosen by
+// GetBestInstance and is wiped when the browser exits, or by
+// ReapDeadInstances if that doesn't happen.
+func NewEphemeralInstance(config Configuration, profile ProfileConfiguration) (ProfileInstance, error) {
+	ephemeralPath := getEphemeralPath(config)
+	if err := os.MkdirAll(ephemeralPath, uio.FileModeURWXGRWXO); err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	// MkdirTemp creates the directory accessible to the owner only.
+	directory, err := os.MkdirTemp(ephemeralPath, profile.Label+"-ephemeral-*")
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+
+	return ProfileInstance{
+		Created:       time.Now(),
+		Directory:     &directory,
+		Ephemeral:     true,
+		InstanceLabel: filepath.Base(directory),
+		ProfileLabel:  profile.Label,
+	}, nil
+}
+
+func getEphemeralPath(config Configuration) string {
+	if config.EphemeralPath != "" {
+		return config.EphemeralPath
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "tbml")
+	}
+	return filepath.Join(os.TempDir(), "tbml")
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestNewEphemeralInstance(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.EphemeralPath = filepath.Join(config.ProfilePath, ".ephemeral")
+
+	instance, err := NewEphemeralInstance(config, profile)
+	assert.NoError(t, err)
+	assert.True(t, instance.Ephemeral)
+	assert.True(t, strings.HasPrefix(instance.InstanceLabel, "test-ephemeral-"))
+	assert.Equal(t, filepath.Join(config.EphemeralPath, instance.InstanceLabel), *instance.Directory)
+	assert.Equal(t, *instance.Directory, getInstanceDir(config, instance))
+	assert.DirExists(t, *instance.Directory)
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, writeProfileInstance(config, instance))
+	assert.NoError(t, unlock())
+
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "test-1", GetBestInstance(profile, instances).InstanceLabel)
+
+	assert.NoError(t, DeleteInstance(config, instance, nil))
+	assert.NoDirExists(t, *instance.Directory)
+	assert.NoDirExists(t, getInstanceRecordDir(config, instance))
+}
+
+func TestReapDeadEphemeralInstance(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.EphemeralPath = filepath.Join(config.ProfilePath, ".ephemeral")
+
+	instance, err := NewEphemeralInstance(config, profile)
+	assert.NoError(t, err)
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, writeProfileInstance(config, instance))
+	assert.NoError(t, os.WriteFile(filepath.Join(*instance.Directory, "cookies.sqlite"), []byte{}, uio.FileModeURWGRWO))
+
+	results, err := ReapDeadInstances(config, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	assert.NoError(t, unlock())
+	results, err = ReapDeadInstances(config, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.True(t, results[0].Deleted)
+	assert.NoDirExists(t, *instance.Directory)
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+const (
+	extensionCacheDirName      = "extensions"
+	extensionCacheFileName     = "extension-cache.json"
+	extensionCacheLockFileName = "extension-cache.lock"
+)
+
+// ExtensionCacheStats describes the cache of downloaded extensions
+// shared by all instances.
+type ExtensionCacheStats struct {
+	Files int
+	Size  int64
+	// PinnedFiles and PinnedSize count the cached extensions that a
+	// profile refers to. They are never evicted.
+	PinnedFiles int
+	PinnedSize  int64
+	// MaxSize is the configured ExtensionCacheMaxMiB in bytes, if any.
+	MaxSize *int64
+}
+
+type cachedExtension struct {
+	LastUsed time.Time
+	Path     string
+	Pinned   bool
+	Size     int64
+}
+
+func getExtensionCacheDir(config Configuration) string {
+	return filepath.Join(getStateDir(config), extensionCacheDirName)
+}
+
+// getExtensionCacheMaxSize returns the configured size limit of the
+// extension cache in bytes.
+func getExtensionCacheMaxSize(config Configuration) *int64 {
+	if config.ExtensionCacheMaxMiB == nil {
+		return nil
+	}
+	maxSize := int64(*config.ExtensionCacheMaxMiB) << 20
+	return &maxSize
+}
+
+// getPinnedCachedExtensions returns the paths of the cached extensions
+// that the profiles of the configuration refer to.
+func getPinnedCachedExtensions(config Configuration) map[string]bool {
+	pinned := make(map[string]bool)
+	for _, profile := range config.Profiles {
+		for _, source := range profile.Extensions {
+			pinned[getCachedExtensionPath(config, source)] = true
+		}
+	}
+	return pinned
+}
+
+// GetExtensionCacheStats reports how much space the extension cache
+// takes up and how much of it is pinned by the configuration.
+func GetExtensionCacheStats(config Configuration) (ExtensionCacheStats, error) {
+	extensions, err := listCachedExtensions(config)
+	if err != nil {
+		return ExtensionCacheStats{}, uerror.WithStackTrace(err)
+	}
+	stats := ExtensionCacheStats{MaxSize: getExtensionCacheMaxSize(config)}
+	for _, extension := range extensions {
+		stats.Files++
+		stats.Size += extension.Size
+		if extension.Pinned {
+			stats.PinnedFiles++
+			stats.PinnedSize += extension.Size
+		}
+	}
+	return stats, nil
+}
+
+// listCachedExtensions lists the extension cache, least recently used
+// first. Extensions that were never used since they were downloaded
+// count as used when they were downloaded.
+func listCachedExtensions(config Configuration) ([]cachedExtension, error) {
+	dirEntries, err := os.ReadDir(getExtensionCacheDir(config))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	lastUsed := make(map[string]time.Time)
+	if err := readStateFile(config, extensionCacheFileName, &lastUsed); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	pinned := getPinnedCachedExtensions(config)
+
+	extensions := []cachedExtension{}
+	for _, dirEntry := range dirEntries {
+		// Temporary files of downloads are left to findStaleTempFiles.
+		if strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		extension := cachedExtension{
+			LastUsed: info.ModTime(),
+			Path:     filepath.Join(getExtensionCacheDir(config), dirEntry.Name()),
+			Size:     info.Size(),
+		}
+		if used, ok := lastUsed[dirEntry.Name()]; ok && used.After(extension.LastUsed) {
+			extension.LastUsed = used
+		}
+		extension.Pinned = pinned[extension.Path]
+		extensions = append(extensions, extension)
+	}
+	sort.SliceStable(extensions, func(i, j int) bool {
+		if !extensions[i].LastUsed.Equal(extensions[j].LastUsed) {
+			return extensions[i].LastUsed.Before(extensions[j].LastUsed)
+		}
+		return extensions[i].Path < extensions[j].Path
+	})
+	return extensions, nil
+}
+
+// markExtensionsUsed records that the cached extensions of a profile
+// were used, so they are evicted after those that weren't used for
+// longer. The modification times of the files aren't touched since
+// they are hard-linked into instances, where Firefox would take a
+// changed modification time for an updated extension.
+func markExtensionsUsed(config Configuration, profile ProfileConfiguration, now time.Time) error {
+	if len(profile.Extensions) == 0 {
+		return nil
+	}
+	unlock, err := lockStateFile(config, extensionCacheLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	lastUsed := make(map[string]time.Time)
+	if err := readStateFile(config, extensionCacheFileName, &lastUsed); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, source := range profile.Extensions {
+		lastUsed[filepath.Base(getCachedExtensionPath(config, source))] = now.UTC()
+	}
+	// Forget extensions that were deleted in the meantime.
+	for name := range lastUsed {
+		if _, err := os.Stat(filepath.Join(getExtensionCacheDir(config), name)); errors.Is(err, fs.ErrNotExist) {
+			delete(lastUsed, name)
+		}
+	}
+	return writeStateFile(config, extensionCacheFileName, lastUsed)
+}
+
+// evictCachedExtensions deletes the least recently used extensions
+// that no profile refers to until the extension cache is no larger
+// than ExtensionCacheMaxMiB. The paths of the deleted extensions are
+// returned. Pinned extensions are kept even if they alone exceed the
+// limit.
+func evictCachedExtensions(config Configuration) ([]string, error) {
+	maxSize := getExtensionCacheMaxSize(config)
+	if maxSize == nil {
+		return nil, nil
+	}
+	unlock, err := lockStateFile(config, extensionCacheLockFileName)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	extensions, err := listCachedExtensions(config)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	var size int64
+	for _, extension := range extensions {
+		size += extension.Size
+	}
+	evicted := []string{}
+	for _, extension := range extensions {
+		if size <= *maxSize {
+			break
+		}
+		if extension.Pinned {
+			continue
+		}
+		if err := os.Remove(extension.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return evicted, uerror.StackTracef("Failed to evict cached extension %s: %w", extension.Path, err)
+		}
+		size -= extension.Size
+		evicted = append(evicted, extension.Path)
+	}
+	return evicted, nil
+}
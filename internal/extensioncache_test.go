@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestEvictCachedExtensions(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	url := "https://example.com/foobar.xpi"
+	source := func(checksum string) ExtensionSource {
+		return ExtensionSource{ID: "foobar@t0ast.cc", SHA256: strings.Repeat(checksum, 64), URL: &url}
+	}
+	pinned, recentlyUsed, leastRecentlyUsed := source("a"), source("b"), source("c")
+	config.Profiles[0].Extensions = []ExtensionSource{pinned}
+
+	now := time.Now()
+	for i, extension := range []ExtensionSource{pinned, leastRecentlyUsed, recentlyUsed} {
+		path := getCachedExtensionPath(config, extension)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, make([]byte, 1<<20), uio.FileModeURWGRWO))
+		downloaded := now.Add(-time.Duration(10+i) * time.Hour)
+		assert.NoError(t, os.Chtimes(path, downloaded, downloaded))
+	}
+	// recentlyUsed was downloaded first, but used since.
+	assert.NoError(t, markExtensionsUsed(config, ProfileConfiguration{Extensions: []ExtensionSource{recentlyUsed}}, now))
+
+	evicted, err := evictCachedExtensions(config)
+	assert.NoError(t, err)
+	assert.Empty(t, evicted, "nothing is evicted without a limit")
+
+	maxMiB := 1
+	config.ExtensionCacheMaxMiB = &maxMiB
+	evicted, err = evictCachedExtensions(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{getCachedExtensionPath(config, leastRecentlyUsed), getCachedExtensionPath(config, recentlyUsed)}, evicted)
+	assert.FileExists(t, getCachedExtensionPath(config, pinned))
+
+	stats, err := GetExtensionCacheStats(config)
+	assert.NoError(t, err)
+	maxSize := int64(1 << 20)
+	assert.Equal(t, ExtensionCacheStats{Files: 1, Size: 1 << 20, PinnedFiles: 1, PinnedSize: 1 << 20, MaxSize: &maxSize}, stats)
+
+	// Pinned extensions are kept even if they exceed the limit alone.
+	config.Profiles[0].Extensions = []ExtensionSource{pinned, recentlyUsed}
+	path := getCachedExtensionPath(config, recentlyUsed)
+	assert.NoError(t, os.WriteFile(path, make([]byte, 1<<20), uio.FileModeURWGRWO))
+	evicted, err = evictCachedExtensions(config)
+	assert.NoError(t, err)
+	assert.Empty(t, evicted)
+	assert.FileExists(t, path)
+}
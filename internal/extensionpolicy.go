@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+var ErrExtensionNotAllowed error = errors.New("The extension is not allowed by the profile's ExtensionPolicy")
+
+// isExtensionAllowed tells whether the profile's ExtensionPolicy allows
+// an extension. Without a policy, all extensions are allowed.
+func isExtensionAllowed(profile ProfileConfiguration, extensionID string) bool {
+	policy := profile.ExtensionPolicy
+	if policy == nil {
+		return true
+	}
+	if matchesExtensionPattern(policy.Denied, extensionID) {
+		return false
+	}
+	return len(policy.Allowed) == 0 || matchesExtensionPattern(policy.Allowed, extensionID)
+}
+
+func matchesExtensionPattern(patterns []string, extensionID string) bool {
+	for _, pattern := range patterns {
+		if matches, _ := path.Match(pattern, extensionID); matches {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProfileExtensionsAllowed fails if the profile's own extensions
+// aren't allowed by its ExtensionPolicy.
+func checkProfileExtensionsAllowed(profile ProfileConfiguration) error {
+	for _, extensionID := range getProfileExtensionIDs(profile) {
+		if !isExtensionAllowed(profile, extensionID) {
+			return fmt.Errorf("%w: %s", ErrExtensionNotAllowed, extensionID)
+		}
+	}
+	return nil
+}
+
+func validateExtensionPolicy(profile ProfileConfiguration) error {
+	if profile.ExtensionPolicy == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, profile.ExtensionPolicy.Allowed...), profile.ExtensionPolicy.Denied...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid extension pattern %q: %w", pattern, err)
+		}
+	}
+	return checkProfileExtensionsAllowed(profile)
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsExtensionAllowed(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		policy   *ExtensionPolicyConfiguration
+		allowed  []string
+		rejected []string
+	}{
+		{
+			desc:    "No policy",
+			allowed: []string{"foo@t0ast.cc"},
+		},
+		{
+			desc:     "Allowlist",
+			policy:   &ExtensionPolicyConfiguration{Allowed: []string{"*@t0ast.cc", "uBlock0@raymondhill.net"}},
+			allowed:  []string{"foo@t0ast.cc", "uBlock0@raymondhill.net"},
+			rejected: []string{"foo@example.com"},
+		},
+		{
+			desc:     "Denylist",
+			policy:   &ExtensionPolicyConfiguration{Denied: []string{"*@example.com"}},
+			allowed:  []string{"foo@t0ast.cc"},
+			rejected: []string{"foo@example.com"},
+		},
+		{
+			desc:     "Denied takes precedence",
+			policy:   &ExtensionPolicyConfiguration{Allowed: []string{"*"}, Denied: []string{"bar@t0ast.cc"}},
+			allowed:  []string{"foo@t0ast.cc"},
+			rejected: []string{"bar@t0ast.cc"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			profile := ProfileConfiguration{ExtensionPolicy: tC.policy}
+			for _, extensionID := range tC.allowed {
+				assert.True(t, isExtensionAllowed(profile, extensionID), extensionID)
+			}
+			for _, extensionID := range tC.rejected {
+				assert.False(t, isExtensionAllowed(profile, extensionID), extensionID)
+			}
+		})
+	}
+}
+
+func TestValidateExtensionPolicy(t *testing.T) {
+	profile := ProfileConfiguration{
+		ExtensionFiles:  []string{"extensions/foo@t0ast.cc.xpi"},
+		ExtensionPolicy: &ExtensionPolicyConfiguration{Allowed: []string{"*@t0ast.cc"}},
+	}
+	assert.NoError(t, validateExtensionPolicy(profile))
+
+	profile.ExtensionPolicy.Denied = []string{"foo@t0ast.cc"}
+	assert.ErrorIs(t, validateExtensionPolicy(profile), ErrExtensionNotAllowed)
+
+	profile.ExtensionPolicy.Denied = []string{"["}
+	assert.Error(t, validateExtensionPolicy(profile))
+}
+
+func TestEnsureExtensionsPolicy(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	profile.ExtensionFiles = []string{"/extensions/foo@t0ast.cc.xpi"}
+	profile.ExtensionPolicy = &ExtensionPolicyConfiguration{Denied: []string{"foo@t0ast.cc"}}
+	err := ensureExtensions(config, profile, instance.InstanceLabel, "", instanceDir)
+	assert.ErrorIs(t, err, ErrExtensionNotAllowed)
+}
+
+func TestVerifyInstanceExtensionPolicy(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	profile.ExtensionPolicy = &ExtensionPolicyConfiguration{Allowed: []string{"*@t0ast.cc"}}
+	assert.NoError(t, writeProfilePrefs(profile, instanceDir))
+	writeExtensionsJSON(t, instanceDir, `{"addons": [
+		{"id": "foo@t0ast.cc", "version": "1.0", "type": "extension", "location": "app-profile", "active": true},
+		{"id": "tracker@example.com", "version": "1.0", "type": "extension", "location": "app-profile", "active": true, "defaultLocale": {"name": "Tracker"}}
+	]}`)
+	err := VerifyInstance(config, profile, instance)
+	assert.ErrorIs(t, err, ErrInstanceVerificationFailed)
+	assert.Contains(t, err.Error(), "extension tracker@example.com (Tracker) is not allowed by the ExtensionPolicy")
+	assert.NotContains(t, err.Error(), "foo@t0ast.cc")
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// InstanceExtension describes an extension as Firefox sees it in an
+// instance.
+type InstanceExtension struct {
+	Enabled bool
+	ID      string
+	Name    string
+	Version string
+}
+
+type extensionsJSON struct {
+	Addons []struct {
+		Active        bool
+		AppDisabled   bool
+		DefaultLocale struct {
+			Name string
+		}
+		ID           string
+		Location     string
+		Type         string
+		UserDisabled bool
+		Version      string
+	}
+}
+
+// GetInstanceExtensions reads the extensions installed in an instance
+// from Firefox's extensions.json. Built-in extensions and other add-on
+// types like themes are skipped. If Firefox has never been started in
+// the instance, nil is returned.
+func GetInstanceExtensions(config Configuration, instance ProfileInstance) ([]InstanceExtension, error) {
+	extensionsJSONPath := filepath.Join(getInstanceDir(config, instance), relativeProfilePath, "extensions.json")
+	extensionsJSONBytes, err := os.ReadFile(extensionsJSONPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	var parsed extensionsJSON
+	if err := json.Unmarshal(extensionsJSONBytes, &parsed); err != nil {
+		return nil, uerror.StackTracef("Failed to parse extensions.json of %s: %w", instance.InstanceLabel, err)
+	}
+
+	extensions := []InstanceExtension{}
+	for _, addon := range parsed.Addons {
+		if addon.Type != "extension" || addon.Location != "app-profile" {
+			continue
+		}
+		extensions = append(extensions, InstanceExtension{
+			Enabled: addon.Active && !addon.UserDisabled && !addon.AppDisabled,
+			ID:      addon.ID,
+			Name:    addon.DefaultLocale.Name,
+			Version: addon.Version,
+		})
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		return extensions[i].ID < extensions[j].ID
+	})
+	return extensions, nil
+}
+
+func getProfileExtensionIDs(profile ProfileConfiguration) []string {
+	ids := make([]string, 0, len(profile.ExtensionFiles)+len(profile.Extensions))
+	for _, extensionFilePath := range profile.ExtensionFiles {
+		ids = append(ids, getExtensionIDFromPath(extensionFilePath))
+	}
+	for _, source := range profile.Extensions {
+		ids = append(ids, source.ID)
+	}
+	return ids
+}
+
+func getExtensionIDFromPath(extensionFilePath string) string {
+	return strings.TrimSuffix(getConfigFileBaseName(extensionFilePath), ".xpi")
+}
+
+const (
+	amoDownloadURL   = "https://addons.mozilla.org/firefox/downloads/latest/%s/latest.xpi"
+	maxExtensionSize = 64 << 20
+)
+
+// getExtensionSourceURL returns where an extension is downloaded from.
+func getExtensionSourceURL(source ExtensionSource) string {
+	if source.AMO != nil {
+		return fmt.Sprintf(amoDownloadURL, url.PathEscape(*source.AMO))
+	}
+	return *source.URL
+}
+
+// getCachedExtensionPath returns where a downloaded extension is kept.
+// Files in the cache are named after their checksum, so pinning a new
+// version downloads it again while instances of other profiles keep
+// using the old one.
+func getCachedExtensionPath(config Configuration, source ExtensionSource) string {
+	return filepath.Join(getExtensionCacheDir(config), strings.ToLower(source.SHA256)+".xpi")
+}
+
+// fetchExtensions downloads the extensions of a profile that aren't
+// cached yet and checks them against their checksums. Like config
+// files, each download is cut off after the download timeout.
+func fetchExtensions(ctx context.Context, client *http.Client, config Configuration, profile ProfileConfiguration) error {
+	for _, source := range profile.Extensions {
+		if err := fetchIntoCache(ctx, client, config, getExtensionSourceURL(source), source.SHA256, getCachedExtensionPath(config, source), maxExtensionSize); err != nil {
+			return uerror.StackTracef("Failed to fetch extension %s: %w", source.ID, err)
+		}
+	}
+	return nil
+}
+
+func validateExtensionSources(profile ProfileConfiguration) error {
+	for _, source := range profile.Extensions {
+		switch {
+		case source.ID == "" || source.ID == "." || source.ID == ".." || strings.ContainsAny(source.ID, "/\x00"):
+			return fmt.Errorf("Extension ID %q is invalid", source.ID)
+		case (source.AMO == nil) == (source.URL == nil):
+			return fmt.Errorf("Extension %s must have either an AMO slug or a URL", source.ID)
+		case source.AMO != nil && (*source.AMO == "" || strings.Contains(*source.AMO, "/")):
+			return fmt.Errorf("Extension %s has an invalid AMO slug %q", source.ID, *source.AMO)
+		case !isSHA256Hex(source.SHA256):
+			return fmt.Errorf("Extension %s must have a hex-encoded SHA-256 sum", source.ID)
+		}
+		if source.URL != nil {
+			parsedURL, err := url.Parse(*source.URL)
+			if err != nil || parsedURL.Scheme != "https" {
+				return fmt.Errorf("Extension %s must have an HTTPS URL", source.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func isSHA256Hex(s string) bool {
+	decoded, err := hex.DecodeString(s)
+	return err == nil && len(decoded) == sha256.Size
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+func writeExtensionsJSON(t *testing.T, instanceDir, content string) {
+	path := filepath.Join(instanceDir, relativeProfilePath, "extensions.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(path, []byte(content), uio.FileModeURWGRWO))
+}
+
+func TestGetInstanceExtensions(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	extensions, err := GetInstanceExtensions(config, instance)
+	assert.NoError(t, err)
+	assert.Nil(t, extensions)
+
+	writeExtensionsJSON(t, instanceDir, ustring.TrimIndentation(`
+		{
+			"schemaVersion": 35,
+			"addons": [
+				{"id": "foo@t0ast.cc", "version": "1.2.0", "type": "extension", "location": "app-profile", "active": true, "defaultLocale": {"name": "Foo"}},
+				{"id": "bar@t0ast.cc", "version": "0.1", "type": "extension", "location": "app-profile", "active": false, "userDisabled": true},
+				{"id": "theme@t0ast.cc", "version": "1.0", "type": "theme", "location": "app-profile", "active": true},
+				{"id": "builtin@mozilla.org", "version": "1.0", "type": "extension", "location": "app-builtin", "active": true}
+			]
+		}
+	`))
+
+	extensions, err = GetInstanceExtensions(config, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, []InstanceExtension{
+		{Enabled: false, ID: "bar@t0ast.cc", Version: "0.1"},
+		{Enabled: true, ID: "foo@t0ast.cc", Name: "Foo", Version: "1.2.0"},
+	}, extensions)
+}
+
+func TestVerifyInstanceExtensions(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	profile.ExtensionFiles = []string{"/extensions/foo@t0ast.cc.xpi", "/extensions/bar@t0ast.cc.xpi"}
+	assert.NoError(t, writeProfilePrefs(profile, instanceDir))
+	assert.NoError(t, VerifyInstance(config, profile, instance))
+
+	writeExtensionsJSON(t, instanceDir, `{"addons": [{"id": "foo@t0ast.cc", "version": "1.0", "type": "extension", "location": "app-profile", "active": false, "userDisabled": true}]}`)
+	err := VerifyInstance(config, profile, instance)
+	assert.ErrorIs(t, err, ErrInstanceVerificationFailed)
+	assert.Contains(t, err.Error(), "extension foo@t0ast.cc is disabled")
+	assert.Contains(t, err.Error(), "extension bar@t0ast.cc is not installed")
+}
+
+func TestFetchExtensions(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	xpi := []byte("xpi")
+	checksum := sha256.Sum256(xpi)
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(xpi)
+	}))
+	defer server.Close()
+
+	url := server.URL + "/foobar.xpi"
+	source := ExtensionSource{
+		ID:     "foobar@t0ast.cc",
+		SHA256: hex.EncodeToString(checksum[:]),
+		URL:    &url,
+	}
+	profile := ProfileConfiguration{Label: "test", Extensions: []ExtensionSource{source}}
+
+	assert.NoError(t, fetchExtensions(context.Background(), server.Client(), config, profile))
+	cached, err := os.ReadFile(getCachedExtensionPath(config, source))
+	assert.NoError(t, err)
+	assert.Equal(t, xpi, cached)
+
+	// Cached extensions aren't downloaded again.
+	assert.NoError(t, fetchExtensions(context.Background(), server.Client(), config, profile))
+	assert.Equal(t, 1, requests)
+
+	source.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	profile.Extensions = []ExtensionSource{source}
+	err = fetchExtensions(context.Background(), server.Client(), config, profile)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.NoFileExists(t, getCachedExtensionPath(config, source))
+}
+
+func TestFetchExtensionsTimeout(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	seconds := 1
+	config.Timeouts = &TimeoutsConfiguration{DownloadSeconds: &seconds}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	url := server.URL + "/stalled.xpi"
+	source := ExtensionSource{
+		ID:     "stalled@t0ast.cc",
+		SHA256: hex.EncodeToString(make([]byte, sha256.Size)),
+		URL:    &url,
+	}
+	profile := ProfileConfiguration{Label: "test", Extensions: []ExtensionSource{source}}
+
+	start := time.Now()
+	err := fetchExtensions(context.Background(), server.Client(), config, profile)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.NoFileExists(t, getCachedExtensionPath(config, source))
+}
+
+func TestValidateExtensionSources(t *testing.T) {
+	slug := "ublock-origin"
+	httpsURL := "https://example.com/foobar.xpi"
+	httpURL := "http://example.com/foobar.xpi"
+	checksum := hex.EncodeToString(make([]byte, sha256.Size))
+
+	testCases := []struct {
+		desc string
+
+		source      ExtensionSource
+		expectValid bool
+	}{
+		{
+			desc:        "AMO slug",
+			source:      ExtensionSource{AMO: &slug, ID: "uBlock0@raymondhill.net", SHA256: checksum},
+			expectValid: true,
+		},
+		{
+			desc:        "HTTPS URL",
+			source:      ExtensionSource{ID: "foobar@t0ast.cc", SHA256: checksum, URL: &httpsURL},
+			expectValid: true,
+		},
+		{
+			desc:   "HTTP URL",
+			source: ExtensionSource{ID: "foobar@t0ast.cc", SHA256: checksum, URL: &httpURL},
+		},
+		{
+			desc:   "Both AMO slug and URL",
+			source: ExtensionSource{AMO: &slug, ID: "foobar@t0ast.cc", SHA256: checksum, URL: &httpsURL},
+		},
+		{
+			desc:   "Neither AMO slug nor URL",
+			source: ExtensionSource{ID: "foobar@t0ast.cc", SHA256: checksum},
+		},
+		{
+			desc:   "ID with a slash",
+			source: ExtensionSource{AMO: &slug, ID: "../foobar", SHA256: checksum},
+		},
+		{
+			desc:   "Truncated checksum",
+			source: ExtensionSource{AMO: &slug, ID: "foobar@t0ast.cc", SHA256: checksum[:10]},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := validateExtensionSources(ProfileConfiguration{Extensions: []ExtensionSource{tC.source}})
+			if tC.expectValid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
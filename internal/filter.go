@@ -0,0 +1,539 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrInvalidFilter error = errors.New("Invalid filter")
+
+type filterType int
+
+const (
+	filterBool filterType = iota
+	filterDuration
+	filterNumber
+	filterString
+)
+
+func (t filterType) String() string {
+	return [...]string{"boolean", "duration", "number", "string"}[t]
+}
+
+// filterInput is what a filter is evaluated against. The size of the
+// instance is only measured if the filter needs it.
+type filterInput struct {
+	instance ProfileInstance
+	now      time.Time
+	size     func() (int64, error)
+}
+
+// filterValue holds the result of a filter expression. Durations and
+// numbers are both kept in number, durations in nanoseconds.
+type filterValue struct {
+	boolean bool
+	number  float64
+	str     string
+}
+
+type filterExpr struct {
+	eval func(input filterInput) (filterValue, error)
+	typ  filterType
+}
+
+type filterField struct {
+	typ filterType
+	get func(input filterInput) (filterValue, error)
+}
+
+func boolFilterField(get func(instance ProfileInstance) bool) filterField {
+	return filterField{filterBool, func(input filterInput) (filterValue, error) {
+		return filterValue{boolean: get(input.instance)}, nil
+	}}
+}
+
+func stringFilterField(get func(instance ProfileInstance) string) filterField {
+	return filterField{filterString, func(input filterInput) (filterValue, error) {
+		return filterValue{str: get(input.instance)}, nil
+	}}
+}
+
+var filterFields = map[string]filterField{
+	"age": {filterDuration, func(input filterInput) (filterValue, error) {
+		return filterValue{number: float64(input.now.Sub(clampToNow(input.instance.LastUsed, input.now)))}, nil
+	}},
+	"archived": boolFilterField(func(instance ProfileInstance) bool { return instance.Archived }),
+	"attached": boolFilterField(func(instance ProfileInstance) bool { return instance.Attached }),
+	"created": {filterDuration, func(input filterInput) (filterValue, error) {
+		return filterValue{number: float64(input.now.Sub(clampToNow(input.instance.Created, input.now)))}, nil
+	}},
+	"encrypted": boolFilterField(func(instance ProfileInstance) bool { return instance.Encrypted }),
+	"ephemeral": boolFilterField(func(instance ProfileInstance) bool { return instance.Ephemeral }),
+	"label":     stringFilterField(func(instance ProfileInstance) string { return instance.InstanceLabel }),
+	"pinned":    boolFilterField(func(instance ProfileInstance) bool { return instance.Pinned }),
+	"profile":   stringFilterField(func(instance ProfileInstance) string { return instance.ProfileLabel }),
+	"reserved":  boolFilterField(func(instance ProfileInstance) bool { return instance.Reserved }),
+	"running":   boolFilterField(func(instance ProfileInstance) bool { return instance.UsagePID != nil }),
+	"size": {filterNumber, func(input filterInput) (filterValue, error) {
+		size, err := input.size()
+		return filterValue{number: float64(size)}, err
+	}},
+	"topic": stringFilterField(func(instance ProfileInstance) string {
+		if instance.UsageLabel == nil {
+			return ""
+		}
+		return *instance.UsageLabel
+	}),
+}
+
+// Filter is a parsed filter expression, see ParseFilter.
+type Filter struct {
+	expr   filterExpr
+	source string
+}
+
+// ParseFilter parses an expression that selects instances, e.g.
+// `profile == "work" && age > 30d && !pinned`.
+//
+// The fields of an instance are age (since it was last used), created
+// (the time since it was created), label, profile, topic (the current
+// one, "" if it isn't in use), size (of its files in bytes) and the
+// booleans archived, attached, encrypted, ephemeral, pinned, reserved
+// and running. They are compared with ==, !=, <, <=, > and >= to
+// literals: strings in double quotes, numbers, sizes like 2G or 500MiB,
+// durations like 90m or 1d12h (units s, m, h, d and w) and true or
+// false. Strings also match regular expressions with =~ and !~.
+// Conditions are combined with &&, || and ! and grouped with
+// parentheses.
+func ParseFilter(expression string) (*Filter, error) {
+	p := filterParser{source: expression}
+	if err := p.tokenize(); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if token := p.peek(); token.kind != filterTokenEnd {
+		return nil, uerror.WithStackTrace(p.errorAt(token, "unexpected %s", token))
+	}
+	if expr.typ != filterBool {
+		return nil, uerror.StackTracef("%w: the expression is a %s, not a condition", ErrInvalidFilter, expr.typ)
+	}
+	return &Filter{expr: expr, source: expression}, nil
+}
+
+func (f *Filter) String() string {
+	return f.source
+}
+
+// Match reports whether an instance matches the filter. The files of
+// the instance are only measured if the filter compares its size.
+func (f *Filter) Match(config Configuration, instance ProfileInstance, now time.Time) (bool, error) {
+	return f.match(instance, now, func() (int64, error) {
+		return uio.DirSize(getInstanceDir(config, instance))
+	})
+}
+
+func (f *Filter) match(instance ProfileInstance, now time.Time, size func() (int64, error)) (bool, error) {
+	value, err := f.expr.eval(filterInput{instance: instance, now: now, size: size})
+	if err != nil {
+		return false, uerror.WithStackTrace(err)
+	}
+	return value.boolean, nil
+}
+
+// FilterInstances returns the instances that match a filter, in the
+// same order. A nil filter matches all instances.
+func FilterInstances(config Configuration, instances []ProfileInstance, filter *Filter) ([]ProfileInstance, error) {
+	if filter == nil {
+		return instances, nil
+	}
+	now := time.Now()
+	matched := []ProfileInstance{}
+	for _, instance := range instances {
+		ok, err := filter.Match(config, instance, now)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if ok {
+			matched = append(matched, instance)
+		}
+	}
+	return matched, nil
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEnd filterTokenKind = iota
+	filterTokenIdent
+	filterTokenLiteral
+	filterTokenOperator
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	// pos is the byte offset of the token in the expression.
+	pos  int
+	text string
+}
+
+func (t filterToken) String() string {
+	if t.kind == filterTokenEnd {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// filterOperators are sorted so that longer operators are matched
+// before their prefixes.
+var filterOperators = []string{"!=", "!~", "&&", "<=", "==", "=~", ">=", "||", "!", "(", ")", "<", ">"}
+
+type filterParser struct {
+	source string
+	tokens []filterToken
+	next   int
+}
+
+func (p *filterParser) errorAt(token filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("%w at column %d: %s", ErrInvalidFilter, token.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) tokenize() error {
+	isWordChar := func(r byte) bool {
+		return r == '_' || r == '.' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+	}
+	for i := 0; i < len(p.source); {
+		c := p.source[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(p.source) && p.source[end] != '"'; end++ {
+				if p.source[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(p.source) {
+				return p.errorAt(filterToken{pos: i}, "unterminated string")
+			}
+			p.tokens = append(p.tokens, filterToken{filterTokenLiteral, i, p.source[i : end+1]})
+			i = end + 1
+		case isWordChar(c):
+			end := i
+			for end < len(p.source) && isWordChar(p.source[end]) {
+				end++
+			}
+			kind := filterTokenIdent
+			if '0' <= c && c <= '9' || c == '.' {
+				kind = filterTokenLiteral
+			}
+			p.tokens = append(p.tokens, filterToken{kind, i, p.source[i:end]})
+			i = end
+		default:
+			operator := ""
+			for _, candidate := range filterOperators {
+				if strings.HasPrefix(p.source[i:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				r, _ := utf8.DecodeRuneInString(p.source[i:])
+				return p.errorAt(filterToken{pos: i}, "unexpected %q", string(r))
+			}
+			p.tokens = append(p.tokens, filterToken{filterTokenOperator, i, operator})
+			i += len(operator)
+		}
+	}
+	p.tokens = append(p.tokens, filterToken{kind: filterTokenEnd, pos: len(p.source)})
+	return nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token if it is one of the given operators.
+func (p *filterParser) accept(operators ...string) (filterToken, bool) {
+	token := p.peek()
+	if token.kind != filterTokenOperator {
+		return token, false
+	}
+	for _, operator := range operators {
+		if token.text == operator {
+			p.next++
+			return token, true
+		}
+	}
+	return token, false
+}
+
+func (p *filterParser) expectBool(token filterToken, expr filterExpr) error {
+	if expr.typ != filterBool {
+		return p.errorAt(token, "%s needs conditions, not a %s", token, expr.typ)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	for {
+		token, ok := p.accept("||")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return filterExpr{}, err
+		}
+		if err := p.expectBool(token, left); err != nil {
+			return filterExpr{}, err
+		}
+		if err := p.expectBool(token, right); err != nil {
+			return filterExpr{}, err
+		}
+		left = combineFilterExprs(left, right, true)
+	}
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	for {
+		token, ok := p.accept("&&")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return filterExpr{}, err
+		}
+		if err := p.expectBool(token, left); err != nil {
+			return filterExpr{}, err
+		}
+		if err := p.expectBool(token, right); err != nil {
+			return filterExpr{}, err
+		}
+		left = combineFilterExprs(left, right, false)
+	}
+}
+
+// combineFilterExprs combines two conditions with || if or is set or
+// && otherwise. The right one is only evaluated if it decides the
+// result, so e.g. sizes aren't measured needlessly.
+func combineFilterExprs(left filterExpr, right filterExpr, or bool) filterExpr {
+	return filterExpr{typ: filterBool, eval: func(input filterInput) (filterValue, error) {
+		value, err := left.eval(input)
+		if err != nil || value.boolean == or {
+			return value, err
+		}
+		return right.eval(input)
+	}}
+}
+
+func (p *filterParser) parseNot() (filterExpr, error) {
+	token, ok := p.accept("!")
+	if !ok {
+		return p.parseComparison()
+	}
+	operand, err := p.parseNot()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	if err := p.expectBool(token, operand); err != nil {
+		return filterExpr{}, err
+	}
+	return filterExpr{typ: filterBool, eval: func(input filterInput) (filterValue, error) {
+		value, err := operand.eval(input)
+		return filterValue{boolean: !value.boolean}, err
+	}}, nil
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	token, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "=~", "!~")
+	if !ok {
+		return left, nil
+	}
+	if token.text == "=~" || token.text == "!~" {
+		return p.parseRegexpMatch(token, left)
+	}
+	rightToken := p.peek()
+	right, err := p.parseOperand()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	if left.typ != right.typ {
+		hint := ""
+		if left.typ == filterDuration && right.typ == filterNumber {
+			hint = ", durations need a unit like 30d"
+		}
+		return filterExpr{}, p.errorAt(rightToken, "can't compare a %s to a %s%s", left.typ, right.typ, hint)
+	}
+	ordered := token.text != "==" && token.text != "!="
+	if ordered && left.typ != filterDuration && left.typ != filterNumber {
+		return filterExpr{}, p.errorAt(token, "%s can't compare %ss", token, left.typ)
+	}
+
+	compare := map[string]func(a, b filterValue) bool{
+		"==": func(a, b filterValue) bool { return a == b },
+		"!=": func(a, b filterValue) bool { return a != b },
+		"<":  func(a, b filterValue) bool { return a.number < b.number },
+		"<=": func(a, b filterValue) bool { return a.number <= b.number },
+		">":  func(a, b filterValue) bool { return a.number > b.number },
+		">=": func(a, b filterValue) bool { return a.number >= b.number },
+	}[token.text]
+	return filterExpr{typ: filterBool, eval: func(input filterInput) (filterValue, error) {
+		a, err := left.eval(input)
+		if err != nil {
+			return filterValue{}, err
+		}
+		b, err := right.eval(input)
+		if err != nil {
+			return filterValue{}, err
+		}
+		return filterValue{boolean: compare(a, b)}, nil
+	}}, nil
+}
+
+// parseRegexpMatch parses the pattern of =~ or !~, which must be a
+// string literal so it is compiled only once. Patterns match anywhere
+// in the string unless they are anchored.
+func (p *filterParser) parseRegexpMatch(token filterToken, left filterExpr) (filterExpr, error) {
+	if left.typ != filterString {
+		return filterExpr{}, p.errorAt(token, "%s needs a string, not a %s", token, left.typ)
+	}
+	patternToken := p.peek()
+	pattern, err := p.parseOperand()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	if pattern.typ != filterString || patternToken.kind != filterTokenLiteral {
+		return filterExpr{}, p.errorAt(patternToken, "%s needs a pattern in double quotes", token)
+	}
+	value, _ := pattern.eval(filterInput{})
+	re, err := regexp.Compile(value.str)
+	if err != nil {
+		return filterExpr{}, p.errorAt(patternToken, "%s", err)
+	}
+	negate := token.text == "!~"
+	return filterExpr{typ: filterBool, eval: func(input filterInput) (filterValue, error) {
+		value, err := left.eval(input)
+		if err != nil {
+			return filterValue{}, err
+		}
+		return filterValue{boolean: re.MatchString(value.str) != negate}, nil
+	}}, nil
+}
+
+func (p *filterParser) parseOperand() (filterExpr, error) {
+	token := p.peek()
+	switch token.kind {
+	case filterTokenEnd:
+		return filterExpr{}, p.errorAt(token, "unexpected end of expression")
+	case filterTokenOperator:
+		if token.text != "(" {
+			return filterExpr{}, p.errorAt(token, "unexpected %s", token)
+		}
+		p.next++
+		expr, err := p.parseOr()
+		if err != nil {
+			return filterExpr{}, err
+		}
+		if closing, ok := p.accept(")"); !ok {
+			return filterExpr{}, p.errorAt(closing, "expected \")\" instead of %s", closing)
+		}
+		return expr, nil
+	case filterTokenIdent:
+		p.next++
+		switch token.text {
+		case "true", "false":
+			return constantFilterExpr(filterBool, filterValue{boolean: token.text == "true"}), nil
+		}
+		field, ok := filterFields[token.text]
+		if !ok {
+			names := []string{}
+			for name := range filterFields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return filterExpr{}, p.errorAt(token, "unknown field %s, known fields are %s", token, strings.Join(names, ", "))
+		}
+		return filterExpr{typ: field.typ, eval: field.get}, nil
+	default:
+		p.next++
+		typ, value, err := parseFilterLiteral(token.text)
+		if err != nil {
+			return filterExpr{}, p.errorAt(token, "%s", err)
+		}
+		return constantFilterExpr(typ, value), nil
+	}
+}
+
+func constantFilterExpr(typ filterType, value filterValue) filterExpr {
+	return filterExpr{typ: typ, eval: func(input filterInput) (filterValue, error) {
+		return value, nil
+	}}
+}
+
+// filterDurationUnits are the units of duration literals. Unlike
+// time.ParseDuration, days and weeks are supported, and "m" always
+// means minutes.
+var filterDurationUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+var filterDurationPattern = regexp.MustCompile(`^(?:[0-9]+(?:\.[0-9]+)?[smhdw])+$`)
+var filterDurationPartPattern = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)([smhdw])`)
+
+// parseFilterLiteral parses a string in double quotes, a number, a size
+// in bytes or a duration.
+func parseFilterLiteral(literal string) (filterType, filterValue, error) {
+	if strings.HasPrefix(literal, `"`) {
+		str, err := strconv.Unquote(literal)
+		if err != nil {
+			return 0, filterValue{}, fmt.Errorf("invalid string %s", literal)
+		}
+		return filterString, filterValue{str: str}, nil
+	}
+	if number, err := strconv.ParseFloat(literal, 64); err == nil {
+		return filterNumber, filterValue{number: number}, nil
+	}
+	if filterDurationPattern.MatchString(literal) {
+		var duration float64
+		for _, part := range filterDurationPartPattern.FindAllStringSubmatch(literal, -1) {
+			amount, _ := strconv.ParseFloat(part[1], 64)
+			duration += amount * float64(filterDurationUnits[part[2]])
+		}
+		return filterDuration, filterValue{number: duration}, nil
+	}
+	if size, err := uio.ParseByteSize(literal); err == nil {
+		return filterNumber, filterValue{number: float64(size)}, nil
+	}
+	return 0, filterValue{}, fmt.Errorf("%q is neither a number, a size nor a duration", literal)
+}
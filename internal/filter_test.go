@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestFilter(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	pid := 1234
+	topic := "mail"
+	instance := ProfileInstance{
+		Created:       now.Add(-60 * 24 * time.Hour),
+		InstanceLabel: "work-3",
+		LastUsed:      now.Add(-(36*time.Hour + 30*time.Minute)),
+		Pinned:        true,
+		ProfileLabel:  "work",
+		UsageLabel:    &topic,
+		UsagePID:      &pid,
+	}
+
+	testCases := []struct {
+		expression string
+		expected   bool
+	}{
+		{`profile == "work"`, true},
+		{`profile != "work"`, false},
+		{`label == "work-3" && topic == "mail"`, true},
+		{`age > 36h`, true},
+		{`age > 1d12h30m`, false},
+		{`age >= 1d12h30m`, true},
+		{`age < 1.5d`, false},
+		{`age <= 2d && created > 8w`, true},
+		{`created < 8w4d`, false},
+		{`size > 1M`, true},
+		{`size > 2MiB`, false},
+		{`size == 1572864`, true},
+		{`pinned`, true},
+		{`!pinned`, false},
+		{`!!pinned`, true},
+		{`running && !archived && !attached && !encrypted && !ephemeral && !reserved`, true},
+		{`pinned == true`, true},
+		{`archived != false`, false},
+		{`profile =~ "^wo"`, true},
+		{`label =~ "-[0-9]$" && label !~ "-1"`, true},
+		{`topic == ""`, false},
+		// && binds tighter than ||, and ! applies to whole comparisons.
+		{`archived && pinned || running`, true},
+		{`archived && (pinned || running)`, false},
+		{`!profile == "home" && pinned`, true},
+		{`false || profile == "home" || (running && age > 1d)`, true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.expression, func(t *testing.T) {
+			filter, err := ParseFilter(tC.expression)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tC.expression, filter.String())
+			matches, err := filter.match(instance, now, func() (int64, error) {
+				return 3 << 19, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expected, matches)
+		})
+	}
+
+	topic = ""
+	instance.UsageLabel = nil
+	filter, err := ParseFilter(`topic == ""`)
+	assert.NoError(t, err)
+	matches, err := filter.match(instance, now, nil)
+	assert.NoError(t, err)
+	assert.True(t, matches)
+}
+
+func TestFilterClockSkew(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	instance := ProfileInstance{LastUsed: now.Add(time.Hour)}
+	filter, err := ParseFilter("age < 1s && age >= 0s")
+	assert.NoError(t, err)
+	matches, err := filter.match(instance, now, nil)
+	assert.NoError(t, err)
+	assert.True(t, matches, "timestamps from the future count as now")
+}
+
+func TestFilterOnlyMeasuresSizeIfNeeded(t *testing.T) {
+	measured := 0
+	size := func() (int64, error) {
+		measured++
+		return 0, errors.New("can't measure")
+	}
+	filter, err := ParseFilter(`pinned && size > 1G || profile == "work" || size > 1G`)
+	assert.NoError(t, err)
+
+	matches, err := filter.match(ProfileInstance{ProfileLabel: "work"}, time.Now(), size)
+	assert.NoError(t, err)
+	assert.True(t, matches)
+	assert.Zero(t, measured)
+
+	_, err = filter.match(ProfileInstance{ProfileLabel: "home"}, time.Now(), size)
+	assert.Equal(t, "can't measure", uerror.Message(err))
+	assert.Equal(t, 1, measured)
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	testCases := []struct {
+		expression string
+		expected   string
+	}{
+		{``, "Invalid filter at column 1: unexpected end of expression"},
+		{`age > 30`, "Invalid filter at column 7: can't compare a duration to a number, durations need a unit like 30d"},
+		{`age > 30days`, `Invalid filter at column 7: "30days" is neither a number, a size nor a duration`},
+		{`size > 10g`, `Invalid filter at column 8: "10g" is neither a number, a size nor a duration`},
+		{`profile = "work"`, `Invalid filter at column 9: unexpected "="`},
+		{`profile == "work`, "Invalid filter at column 12: unterminated string"},
+		{`profile == "\q"`, `Invalid filter at column 12: invalid string "\q"`},
+		{`profile == work`, `Invalid filter at column 12: unknown field "work", known fields are age, archived, attached, created, encrypted, ephemeral, label, pinned, profile, reserved, running, size, topic`},
+		{`profile`, "Invalid filter: the expression is a string, not a condition"},
+		{`profile < "work"`, `Invalid filter at column 9: "<" can't compare strings`},
+		{`pinned && age`, `Invalid filter at column 8: "&&" needs conditions, not a duration`},
+		{`!size`, `Invalid filter at column 1: "!" needs conditions, not a number`},
+		{`size =~ "1"`, `Invalid filter at column 6: "=~" needs a string, not a number`},
+		{`label =~ profile`, `Invalid filter at column 10: "=~" needs a pattern in double quotes`},
+		{`label =~ "("`, "Invalid filter at column 10: error parsing regexp: missing closing ): `(`"},
+		{`(pinned || running`, "Invalid filter at column 19: expected \")\" instead of end of expression"},
+		{`pinned running`, `Invalid filter at column 8: unexpected "running"`},
+		{`pinned && )`, `Invalid filter at column 11: unexpected ")"`},
+		{`label == "ä" && ä`, `Invalid filter at column 18: unexpected "ä"`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.expression, func(t *testing.T) {
+			_, err := ParseFilter(tC.expression)
+			assert.ErrorIs(t, err, ErrInvalidFilter)
+			assert.Equal(t, tC.expected, uerror.Message(err))
+		})
+	}
+}
+
+func TestFilterInstances(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	other := instance
+	other.InstanceLabel = "other-1"
+	instances := []ProfileInstance{instance, other}
+	for _, instance := range instances {
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, "places.sqlite"), make([]byte, 2048), uio.FileModeURWGRWO))
+
+	all, err := FilterInstances(config, instances, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, instances, all)
+
+	filter, err := ParseFilter(`label == "other-1" || size >= 2K`)
+	assert.NoError(t, err)
+	matched, err := FilterInstances(config, instances, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, instances, matched)
+
+	filter, err = ParseFilter(`size > 1M`)
+	assert.NoError(t, err)
+	matched, err = FilterInstances(config, instances[:1], filter)
+	assert.NoError(t, err)
+	assert.Empty(t, matched)
+}
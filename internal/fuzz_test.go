@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"testing"
+)
+
+func FuzzParseConfiguration(f *testing.F) {
+	f.Add("config.json", []byte(`{"ProfilePath": "profiles", "Profiles": [{"Label": "a"}, {"Extends": "a", "Label": "b"}]}`))
+	f.Add("config.json", []byte(`{"Profiles": [{"Label": "a", "Storage": {"CacheCapacityKiB": 1}, "Tracking": {"Protection": "strict"}}]}`))
+	f.Add("config.yaml", []byte("profilePath: profiles\nprofiles:\n  - label: a\n    doh:\n      mode: only\n      resolverURL: https://dns.example.com\n"))
+	f.Add("config.yaml", []byte("a: &a [*a]\n"))
+	f.Add("config.toml", []byte("ProfilePath = \"profiles\"\n[[Profiles]]\nLabel = \"a\"\nExtends = \"a\"\n"))
+	f.Add("config.toml", []byte("x = [[[[{a = [1]}]]]]\n"))
+	f.Fuzz(func(t *testing.T, configFile string, configBytes []byte) {
+		// Errors are fine, panics and hangs aren't.
+		_, _ = parseConfiguration(configFile, configBytes, &Warnings{})
+	})
+}
+
+func FuzzParseProfileInstance(f *testing.F) {
+	f.Add([]byte(`{"Created": "2021-10-24T18:12:01.289350236Z", "InstalledExtensions": ["foo@t0ast.cc"], "InstanceLabel": "test-1", "ProfileLabel": "test", "UsageLabel": "news", "UsagePID": 1234}`))
+	f.Add([]byte(`{"Directory": "/tmp/tbml/test-ephemeral-1", "Ephemeral": true, "UsagePID": -1}`))
+	f.Add([]byte(`null`))
+	f.Fuzz(func(t *testing.T, instanceDataBytes []byte) {
+		instance, err := parseProfileInstance("test-1", instanceDataBytes)
+		if err != nil {
+			return
+		}
+		if instance.InstanceLabel != "test-1" {
+			t.Errorf("Instance label %q doesn't match the directory", instance.InstanceLabel)
+		}
+		if instance.UsagePID != nil && *instance.UsagePID <= 0 {
+			t.Errorf("Invalid PID %d was kept", *instance.UsagePID)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+const (
+	launchHistoryFileName     = "launch-history.json"
+	launchHistoryLockFileName = "launch-history.lock"
+	// maxLaunchHistoryEntries is how many launches are remembered. Older
+	// ones are dropped.
+	maxLaunchHistoryEntries = 50
+)
+
+// LaunchHistoryEntry is a tab that was opened, with what is needed to
+// open it again.
+type LaunchHistoryEntry struct {
+	Ephemeral bool
+	// MovedFrom is the topic the tab was moved from with tbml move-tab.
+	MovedFrom *string
+	Profile   string
+	// Time is stored in UTC.
+	Time  time.Time
+	Topic string
+	URL   *string
+}
+
+// RecordLaunchHistory adds a launch to the launch history, dropping the
+// oldest entry if the history is full.
+func RecordLaunchHistory(config Configuration, entry LaunchHistoryEntry) error {
+	unlock, err := lockStateFile(config, launchHistoryLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	history, err := GetLaunchHistory(config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	entry.Time = entry.Time.UTC()
+	history = append(history, entry)
+	if len(history) > maxLaunchHistoryEntries {
+		history = history[len(history)-maxLaunchHistoryEntries:]
+	}
+	return writeStateFile(config, launchHistoryFileName, history)
+}
+
+// GetLaunchHistory returns the recorded launches, oldest first.
+func GetLaunchHistory(config Configuration) ([]LaunchHistoryEntry, error) {
+	history := []LaunchHistoryEntry{}
+	if err := readStateFile(config, launchHistoryFileName, &history); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return history, nil
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordLaunchHistory(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	history, err := GetLaunchHistory(config)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	url := "https://example.com/"
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	for i := 0; i < maxLaunchHistoryEntries+5; i++ {
+		assert.NoError(t, RecordLaunchHistory(config, LaunchHistoryEntry{
+			Profile: "test",
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Topic:   fmt.Sprintf("topic-%d", i),
+			URL:     &url,
+		}))
+	}
+
+	// Only the most recent launches are kept, oldest first.
+	history, err = GetLaunchHistory(config)
+	assert.NoError(t, err)
+	if assert.Len(t, history, maxLaunchHistoryEntries) {
+		assert.Equal(t, "topic-5", history[0].Topic)
+		assert.Equal(t, fmt.Sprintf("topic-%d", maxLaunchHistoryEntries+4), history[len(history)-1].Topic)
+		assert.Equal(t, time.UTC, history[0].Time.Location())
+		assert.True(t, start.Add(5*time.Minute).Equal(history[0].Time))
+		assert.Equal(t, &url, history[0].URL)
+	}
+}
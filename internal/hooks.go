@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrHookFailed error = errors.New("Hook failed")
+
+const (
+	hookPreLaunch  = "pre-launch"
+	hookPostLaunch = "post-launch"
+	hookPostExit   = "post-exit"
+)
+
+// getHooks returns the hooks of one kind that apply to a profile: the
+// global ones first, then the profile's own.
+func getHooks(config Configuration, profile ProfileConfiguration, kind string) []string {
+	hooks := []string{}
+	for _, hooksConfig := range []*HooksConfiguration{config.Hooks, profile.Hooks} {
+		if hooksConfig == nil {
+			continue
+		}
+		switch kind {
+		case hookPreLaunch:
+			hooks = append(hooks, hooksConfig.PreLaunch...)
+		case hookPostLaunch:
+			hooks = append(hooks, hooksConfig.PostLaunch...)
+		case hookPostExit:
+			hooks = append(hooks, hooksConfig.PostExit...)
+		}
+	}
+	return hooks
+}
+
+// getOwnHooks returns the hooks of all kinds that a profile sets
+// itself, e.g. to show them before a profile from a bundle is trusted.
+func getOwnHooks(profile ProfileConfiguration) []string {
+	hooks := []string{}
+	for _, kind := range []string{hookPreLaunch, hookPostLaunch, hookPostExit} {
+		hooks = append(hooks, getHooks(Configuration{}, profile, kind)...)
+	}
+	return hooks
+}
+
+func validateHooks(hooks *HooksConfiguration) error {
+	if hooks == nil {
+		return nil
+	}
+	for _, hook := range append(append(append([]string{}, hooks.PreLaunch...), hooks.PostLaunch...), hooks.PostExit...) {
+		if strings.TrimSpace(hook) == "" {
+			return errors.New("Hooks must not be empty")
+		}
+	}
+	return nil
+}
+
+// getHookEnvironment describes the launch to hooks:
+//
+//   - TBML_HOOK: pre-launch, post-launch or post-exit
+//   - TBML_INSTANCE, TBML_PROFILE: the instance and profile labels
+//   - TBML_TOPIC: the topic the instance is opened for, if any
+//   - TBML_INSTANCE_DIR: the instance's directory, which is the
+//     browser's home directory
+//   - TBML_PROFILE_DIR: the browser's profile directory
+//   - TBML_PID: the browser's process ID (post-launch and post-exit)
+//   - TBML_EXIT_CODE: the browser's exit code (post-exit, if it ran)
+func getHookEnvironment(kind string, instance ProfileInstance, instanceDir string, pid int, exitCode *uint) []string {
+	env := []string{
+		"TBML_HOOK=" + kind,
+		"TBML_INSTANCE=" + instance.InstanceLabel,
+		"TBML_INSTANCE_DIR=" + instanceDir,
+		"TBML_PROFILE=" + instance.ProfileLabel,
+		"TBML_PROFILE_DIR=" + filepath.Join(instanceDir, relativeProfilePath),
+	}
+	if instance.UsageLabel != nil {
+		env = append(env, "TBML_TOPIC="+*instance.UsageLabel)
+	}
+	if pid != 0 {
+		env = append(env, fmt.Sprintf("TBML_PID=%d", pid))
+	}
+	if exitCode != nil {
+		env = append(env, fmt.Sprintf("TBML_EXIT_CODE=%d", *exitCode))
+	}
+	return env
+}
+
+// runHooks runs hooks one after another and stops at the first one
+// that fails. It returns how many succeeded. Their output goes to
+// stderr, so it doesn't mix with tbml's own output.
+func runHooks(ctx context.Context, hooks []string, env []string, timeout time.Duration) (succeeded int, err error) {
+	for _, hook := range hooks {
+		if err := runHook(ctx, hook, env, timeout); err != nil {
+			return succeeded, err
+		}
+		succeeded++
+	}
+	return succeeded, nil
+}
+
+func runHook(ctx context.Context, hook string, env []string, timeout time.Duration) error {
+	ulog.FromContext(ctx).Debug("Running hook", "hook", hook)
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hookCmd := exec.CommandContext(hookCtx, "sh", "-c", hook)
+	hookCmd.Env = append(os.Environ(), env...)
+	hookCmd.Stdout = os.Stderr
+	hookCmd.Stderr = os.Stderr
+	if err := hookCmd.Run(); err != nil {
+		if errors.Is(hookCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return uerror.StackTracef("%w: %s: timed out after %s", ErrHookFailed, hook, timeout)
+		}
+		return uerror.StackTracef("%w: %s: %s", ErrHookFailed, hook, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHooks(t *testing.T) {
+	config := Configuration{
+		Hooks: &HooksConfiguration{PreLaunch: []string{"global"}},
+	}
+	profile := ProfileConfiguration{
+		Hooks: &HooksConfiguration{
+			PostExit:  []string{"profile-exit"},
+			PreLaunch: []string{"profile"},
+		},
+	}
+	assert.Equal(t, []string{"global", "profile"}, getHooks(config, profile, hookPreLaunch))
+	assert.Equal(t, []string{}, getHooks(config, profile, hookPostLaunch))
+	assert.Equal(t, []string{"profile-exit"}, getHooks(config, profile, hookPostExit))
+}
+
+func TestLaunchLifecycleHooks(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		args             []string
+		expectedExitCode uint
+		expectedLog      []string
+		preLaunch        []string
+	}{
+		{
+			desc: "Clean exit",
+
+			args:             []string{"-lifetime", "50ms"},
+			expectedExitCode: 0,
+			expectedLog: []string{
+				"pre-launch test-1 test test-usage",
+				"post-launch test-1 test test-usage pid",
+				"post-exit test-1 test test-usage pid 0",
+			},
+		},
+		{
+			desc: "Crash",
+
+			args:             []string{"-lifetime", "50ms", "-exit-code", "3"},
+			expectedExitCode: 3,
+			expectedLog: []string{
+				"pre-launch test-1 test test-usage",
+				"post-launch test-1 test test-usage pid",
+				"post-exit test-1 test test-usage pid 3",
+			},
+		},
+		{
+			desc: "Failing pre-launch hook",
+
+			args:             []string{"-lifetime", "50ms"},
+			expectedExitCode: genericErrorExitCode,
+			expectedLog: []string{
+				"pre-launch test-1 test test-usage",
+				"post-exit test-1 test test-usage",
+			},
+			preLaunch: []string{"log", "exit 1"},
+		},
+		{
+			desc: "Failing first pre-launch hook",
+
+			args:             []string{"-lifetime", "50ms"},
+			expectedExitCode: genericErrorExitCode,
+			preLaunch:        []string{"exit 1", "log"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			defer useFakeBrowser(t, tC.args...)()
+
+			logFile := filepath.Join(t.TempDir(), "hooks.log")
+			logHook := `echo "$TBML_HOOK $TBML_INSTANCE $TBML_PROFILE $TBML_TOPIC${TBML_PID:+ pid}${TBML_EXIT_CODE:+ $TBML_EXIT_CODE}" >> ` + logFile
+			preLaunch := []string{logHook}
+			if tC.preLaunch != nil {
+				preLaunch = []string{}
+				for _, hook := range tC.preLaunch {
+					if hook == "log" {
+						hook = logHook
+					}
+					preLaunch = append(preLaunch, hook)
+				}
+			}
+			config.Hooks = &HooksConfiguration{PreLaunch: preLaunch}
+			profile.Hooks = &HooksConfiguration{
+				PostExit:   []string{logHook},
+				PostLaunch: []string{logHook},
+			}
+
+			exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+			if tC.expectedExitCode == genericErrorExitCode {
+				assert.ErrorIs(t, err, ErrHookFailed)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tC.expectedExitCode, exitCode)
+
+			if tC.expectedLog == nil {
+				assert.NoFileExists(t, logFile)
+				return
+			}
+			log, err := os.ReadFile(logFile)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedLog, strings.Split(strings.TrimSpace(string(log)), "\n"))
+		})
+	}
+}
+
+func TestRunHooksTimeout(t *testing.T) {
+	succeeded, err := runHooks(context.Background(), []string{"true", "sleep 10"}, nil, 50*time.Millisecond)
+	assert.ErrorIs(t, err, ErrHookFailed)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.Equal(t, 1, succeeded)
+
+	succeeded, err = runHooks(context.Background(), []string{"true"}, nil, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, succeeded)
+}
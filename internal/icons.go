@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// Names of the bundled icons shown for profiles and topics without an
+// Icon, see ReadBuiltinAsset.
+const (
+	DefaultHandlerIcon = "tbml"
+	DefaultProfileIcon = "profile"
+	DefaultTopicIcon   = "topic"
+)
+
+// GetIconFile returns the Icon of the topic or its nearest ancestor
+// topic that has one, else the Icon of the profile, or "" if none of
+// them has one. Relative paths are resolved against configDir;
+// "builtin:" references are returned as they are.
+func GetIconFile(config Configuration, configDir string, profile ProfileConfiguration, topic string) string {
+	icon := profile.Icon
+findTopicIcon:
+	for ; topic != ""; topic = getParentTopic(topic) {
+		for _, topicConfig := range config.Topics {
+			if topicConfig.Topic == topic && topicConfig.Icon != nil {
+				icon = topicConfig.Icon
+				break findTopicIcon
+			}
+		}
+	}
+	if icon == nil {
+		return ""
+	}
+	return resolveLocalConfigFile(configDir, *icon)
+}
+
+// getNotificationIcon returns the icon file shown in notifications
+// about an instance used for the topic. Bundled icons, which are used
+// without a configured one, are written to the state directory.
+func getNotificationIcon(config Configuration, configDir string, profile ProfileConfiguration, topic string) (string, error) {
+	name := DefaultProfileIcon
+	if topic != "" {
+		name = DefaultTopicIcon
+	}
+	if icon := GetIconFile(config, configDir, profile, topic); icon != "" {
+		assetName, ok := ParseBuiltinReference(icon)
+		if !ok {
+			return icon, nil
+		}
+		name = assetName
+	}
+	content, err := ReadBuiltinAsset(name)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	iconFile := filepath.Join(getStateDir(config), "icons", name+GetBuiltinAssetExt(name))
+	existing, err := os.ReadFile(iconFile)
+	if err == nil && bytes.Equal(existing, content) {
+		return iconFile, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(iconFile), uio.FileModeURWXGRWXO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(iconFile, content, uio.FileModeURWGRWO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return iconFile, nil
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNotificationIcon(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.Topics = []TopicConfiguration{{Icon: strPtr("news.png"), Topic: "news"}}
+
+	icon, err := getNotificationIcon(config, "/etc/tbml", profile, "news/local")
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/tbml/news.png", icon)
+
+	profile.Icon = strPtr("/icons/test.png")
+	icon, err = getNotificationIcon(config, "/etc/tbml", profile, "sports")
+	assert.NoError(t, err)
+	assert.Equal(t, "/icons/test.png", icon)
+
+	profile.Icon = nil
+	icon, err = getNotificationIcon(config, "/etc/tbml", profile, "sports")
+	assert.NoError(t, err)
+	content, err := os.ReadFile(icon)
+	assert.NoError(t, err)
+	expected, err := ReadBuiltinAsset(DefaultTopicIcon)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, content)
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrConfigurationConflict error = errors.New("Conflicting configuration")
+
+// configurationFileExtensions are the extensions of the files that are
+// read from a configuration directory.
+var configurationFileExtensions = map[string]bool{".json": true, ".toml": true, ".yaml": true, ".yml": true}
+
+// readConfigurationFragment reads a configuration file without
+// resolving or validating it, so it can be merged with others first.
+func readConfigurationFragment(configFile string, warnings *Warnings) (Configuration, error) {
+	configBytes, err := uio.ReadFileLimited(configFile, maxConfigurationSize)
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	return decodeConfiguration(configFile, configBytes, warnings)
+}
+
+// readConfigurationDir reads all configuration files in a directory,
+// like a config.d directory, in the order of their names and merges
+// them with mergeConfiguration. Hidden files and files with other
+// extensions are skipped.
+func readConfigurationDir(dir string, warnings *Warnings) (Configuration, error) {
+	files, err := listConfigurationDir(dir)
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	config := Configuration{}
+	sources := map[string]string{}
+	for _, file := range files {
+		fragment, err := readConfigurationFragment(file, warnings)
+		if err != nil {
+			return Configuration{}, uerror.WithStackTrace(err)
+		}
+		if len(fragment.Include) > 0 {
+			return Configuration{}, uerror.StackTracef("%s: Files in a configuration directory can't include others", file)
+		}
+		if err := mergeConfiguration(&config, fragment, file, sources); err != nil {
+			return Configuration{}, uerror.WithStackTrace(err)
+		}
+	}
+	return config, nil
+}
+
+// listConfigurationDir returns the configuration files in a directory
+// in the order they are merged in.
+func listConfigurationDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	files := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !configurationFileExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+// includeConfigurationFiles merges the files matched by the Include
+// patterns of a configuration file into its configuration. Patterns
+// are resolved against the file's directory and the files matched by
+// each pattern are merged in the order of their names.
+func includeConfigurationFiles(config Configuration, configFile string, warnings *Warnings) (Configuration, error) {
+	merged := Configuration{}
+	sources := map[string]string{}
+	if err := mergeConfiguration(&merged, config, configFile, sources); err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	merged.Include = config.Include
+
+	files, err := getIncludedFiles(configFile, config.Include)
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	for _, file := range files {
+		fragment, err := readConfigurationFragment(file, warnings)
+		if err != nil {
+			return Configuration{}, uerror.WithStackTrace(err)
+		}
+		if len(fragment.Include) > 0 {
+			return Configuration{}, uerror.StackTracef("%s: Included files can't include others", file)
+		}
+		if err := mergeConfiguration(&merged, fragment, file, sources); err != nil {
+			return Configuration{}, uerror.WithStackTrace(err)
+		}
+	}
+	return merged, nil
+}
+
+// getIncludedFiles returns the files matched by the Include patterns of
+// a configuration file in the order they are merged in.
+func getIncludedFiles(configFile string, patterns []string) ([]string, error) {
+	files := []string{}
+	included := map[string]bool{filepath.Clean(configFile): true}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, uerror.StackTracef("Invalid include pattern %s: %w", pattern, err)
+		}
+		sort.Strings(matches)
+		for _, file := range matches {
+			if included[file] {
+				continue
+			}
+			included[file] = true
+			if isDir, err := uio.DirExists(file); err != nil || isDir {
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// mergeConfiguration adds the settings of a fragment read from file to
+// config. Profiles and routes are appended and aliases added. Profiles
+// and aliases that another file already defined and other settings that
+// another file already set are reported as ErrConfigurationConflict.
+// sources remembers which file defined what.
+func mergeConfiguration(config *Configuration, fragment Configuration, file string, sources map[string]string) error {
+	checkSource := func(key string, what string) error {
+		if source, ok := sources[key]; ok && source != file {
+			return uerror.StackTracef("%w: %s is defined in both %s and %s", ErrConfigurationConflict, what, source, file)
+		}
+		sources[key] = file
+		return nil
+	}
+
+	for _, profile := range fragment.Profiles {
+		if err := checkSource("Profiles."+profile.Label, "Profile "+profile.Label); err != nil {
+			return err
+		}
+	}
+	config.Profiles = append(config.Profiles, fragment.Profiles...)
+	config.Routes = append(config.Routes, fragment.Routes...)
+	for name, alias := range fragment.Aliases {
+		if err := checkSource("Aliases."+name, "Alias "+name); err != nil {
+			return err
+		}
+		if config.Aliases == nil {
+			config.Aliases = map[string]string{}
+		}
+		config.Aliases[name] = alias
+	}
+
+	configValue := reflect.ValueOf(config).Elem()
+	fragmentValue := reflect.ValueOf(fragment)
+	for i := 0; i < configValue.NumField(); i++ {
+		name := configValue.Type().Field(i).Name
+		switch name {
+		case "Aliases", "Include", "Profiles", "Routes":
+			continue
+		}
+		if fragmentValue.Field(i).IsZero() {
+			continue
+		}
+		if err := checkSource(name, name); err != nil {
+			return err
+		}
+		configValue.Field(i).Set(fragmentValue.Field(i))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"t0ast.cc/tbml/internal"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func writeConfigFilesForTest(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, []byte(content), uio.FileModeURWGRWO))
+	}
+}
+
+func getProfileLabels(config internal.Configuration) []string {
+	labels := []string{}
+	for _, profile := range config.Profiles {
+		labels = append(labels, profile.Label)
+	}
+	return labels
+}
+
+func TestReadConfigurationInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFilesForTest(t, dir, map[string]string{
+		"config.json":       `{"ProfilePath": "profiles", "Include": ["profiles.d/*"], "Profiles": [{"Label": "main"}]}`,
+		"profiles.d/b.yaml": "Profiles:\n  - Label: project-b\n    Extends: main\nAliases:\n  b: open --profile project-b\n",
+		"profiles.d/a.json": `{"Profiles": [{"Label": "project-a"}], "Routes": [{"Host": "a.example.com", "Profile": "project-a"}]}`,
+	})
+
+	config, configDir, err := internal.ReadConfiguration(filepath.Join(dir, "config.json"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, configDir)
+	assert.Equal(t, filepath.Join(dir, "profiles"), config.ProfilePath)
+	assert.Equal(t, []string{"main", "project-a", "project-b"}, getProfileLabels(config))
+	assert.Len(t, config.Routes, 1)
+	assert.Equal(t, map[string]string{"b": "open --profile project-b"}, config.Aliases)
+}
+
+func TestReadConfigurationDir(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, "config.d")
+	writeConfigFilesForTest(t, configDir, map[string]string{
+		"00-base.json":    `{"ProfilePath": "profiles"}`,
+		"10-work.yaml":    "Profiles:\n  - Label: work\n",
+		"20-shop.toml":    "[[Profiles]]\nLabel = \"shop\"\n",
+		".hidden.json":    `{"Profiles": [{"Label": "hidden"}]}`,
+		"notes.md":        "# Notes",
+		"disabled/x.json": `{"Profiles": [{"Label": "disabled"}]}`,
+	})
+
+	config, actualConfigDir, err := internal.ReadConfiguration(configDir, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, configDir, actualConfigDir)
+	assert.Equal(t, filepath.Join(configDir, "profiles"), config.ProfilePath)
+	assert.Equal(t, []string{"work", "shop"}, getProfileLabels(config))
+}
+
+func TestReadConfigurationConflict(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		files map[string]string
+	}{
+		{
+			desc: "duplicate profile",
+
+			files: map[string]string{
+				"a.json": `{"ProfilePath": "profiles", "Profiles": [{"Label": "work"}]}`,
+				"b.json": `{"Profiles": [{"Label": "work"}]}`,
+			},
+		},
+		{
+			desc: "duplicate alias",
+
+			files: map[string]string{
+				"a.json": `{"ProfilePath": "profiles", "Aliases": {"w": "open --profile work"}}`,
+				"b.json": `{"Aliases": {"w": "open --profile shop"}}`,
+			},
+		},
+		{
+			desc: "setting set twice",
+
+			files: map[string]string{
+				"a.json": `{"ProfilePath": "profiles"}`,
+				"b.json": `{"ProfilePath": "other"}`,
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfigFilesForTest(t, dir, tC.files)
+
+			_, _, err := internal.ReadConfiguration(dir, nil)
+			assert.ErrorIs(t, err, internal.ErrConfigurationConflict)
+			assert.Contains(t, err.Error(), filepath.Join(dir, "a.json"))
+			assert.Contains(t, err.Error(), filepath.Join(dir, "b.json"))
+		})
+	}
+}
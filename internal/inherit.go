@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrProfileInheritanceCycle error = errors.New("Profile inheritance cycle")
+
+// resolveProfileInheritance fills in the settings each profile inherits
+// through its Extends chain. A setting is inherited if the profile
+// leaves it unset (nil or the zero value); nested blocks like Storage
+// are merged field by field. The label is never inherited.
+func resolveProfileInheritance(profiles []ProfileConfiguration) ([]ProfileConfiguration, error) {
+	profilesByLabel := make(map[string]ProfileConfiguration)
+	for _, profile := range profiles {
+		profilesByLabel[profile.Label] = profile
+	}
+
+	resolved := make([]ProfileConfiguration, 0, len(profiles))
+	for _, profile := range profiles {
+		resolvedProfile, err := resolveProfile(profilesByLabel, profile, []string{profile.Label})
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		resolved = append(resolved, resolvedProfile)
+	}
+	return resolved, nil
+}
+
+func resolveProfile(profilesByLabel map[string]ProfileConfiguration, profile ProfileConfiguration, chain []string) (ProfileConfiguration, error) {
+	if profile.Extends == nil {
+		return profile, nil
+	}
+
+	for _, label := range chain {
+		if label == *profile.Extends {
+			return ProfileConfiguration{}, uerror.StackTracef("%w: %v", ErrProfileInheritanceCycle, append(chain, *profile.Extends))
+		}
+	}
+	base, ok := profilesByLabel[*profile.Extends]
+	if !ok {
+		return ProfileConfiguration{}, uerror.StackTracef("Profile %s extends unknown profile %s", profile.Label, *profile.Extends)
+	}
+	base, err := resolveProfile(profilesByLabel, base, append(chain, base.Label))
+	if err != nil {
+		return ProfileConfiguration{}, uerror.WithStackTrace(err)
+	}
+
+	resolved := profile
+	mergeInherited(reflect.ValueOf(&resolved).Elem(), reflect.ValueOf(base))
+	resolved.Label = profile.Label
+	resolved.Extends = profile.Extends
+	// Names tell profiles apart, so they aren't inherited either.
+	resolved.Description = profile.Description
+	resolved.DisplayName = profile.DisplayName
+	resolved.Names = profile.Names
+	return resolved, nil
+}
+
+// mergeInherited sets each unset field of child to the corresponding
+// field of base, recursing into pointers to structs that both set.
+func mergeInherited(child, base reflect.Value) {
+	for i := 0; i < child.NumField(); i++ {
+		childField, baseField := child.Field(i), base.Field(i)
+		if childField.IsZero() {
+			childField.Set(baseField)
+			continue
+		}
+		if childField.Kind() == reflect.Ptr && childField.Elem().Kind() == reflect.Struct && !baseField.IsNil() {
+			merged := reflect.New(childField.Elem().Type())
+			merged.Elem().Set(childField.Elem())
+			mergeInherited(merged.Elem(), baseField.Elem())
+			childField.Set(merged)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveProfileInheritance(t *testing.T) {
+	profiles := []ProfileConfiguration{
+		{
+			DisplayName:    strPtr("Base"),
+			ExtensionFiles: []string{"ublock.xpi"},
+			Label:          "base",
+			Storage:        &StorageConfiguration{CacheCapacityKiB: intPtr(1024), StorageQuotaKiB: intPtr(2048)},
+			UserJSFile:     strPtr("hardened.js"),
+		},
+		{
+			Extends: strPtr("base"),
+			Label:   "work",
+			Storage: &StorageConfiguration{CacheCapacityKiB: intPtr(4096)},
+		},
+		{
+			ExtensionFiles: []string{},
+			Extends:        strPtr("work"),
+			Label:          "bare",
+			UserJSFile:     strPtr("bare.js"),
+		},
+	}
+
+	resolved, err := resolveProfileInheritance(profiles)
+	assert.NoError(t, err)
+	assert.Equal(t, profiles[0], resolved[0])
+	assert.Equal(t, ProfileConfiguration{
+		ExtensionFiles: []string{"ublock.xpi"},
+		Extends:        strPtr("base"),
+		Label:          "work",
+		Storage:        &StorageConfiguration{CacheCapacityKiB: intPtr(4096), StorageQuotaKiB: intPtr(2048)},
+		UserJSFile:     strPtr("hardened.js"),
+	}, resolved[1])
+	assert.Equal(t, ProfileConfiguration{
+		ExtensionFiles: []string{},
+		Extends:        strPtr("work"),
+		Label:          "bare",
+		Storage:        &StorageConfiguration{CacheCapacityKiB: intPtr(4096), StorageQuotaKiB: intPtr(2048)},
+		UserJSFile:     strPtr("bare.js"),
+	}, resolved[2])
+	assert.Nil(t, profiles[1].Storage.StorageQuotaKiB)
+}
+
+func TestResolveProfileInheritanceErrors(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectedErr error
+		expectedMsg string
+		profiles    []ProfileConfiguration
+	}{
+		{
+			desc:        "cycle",
+			expectedErr: ErrProfileInheritanceCycle,
+			expectedMsg: "[a b c a]",
+			profiles: []ProfileConfiguration{
+				{Label: "a", Extends: strPtr("b")},
+				{Label: "b", Extends: strPtr("c")},
+				{Label: "c", Extends: strPtr("a")},
+			},
+		},
+		{
+			desc:        "self",
+			expectedErr: ErrProfileInheritanceCycle,
+			expectedMsg: "[a a]",
+			profiles: []ProfileConfiguration{
+				{Label: "a", Extends: strPtr("a")},
+			},
+		},
+		{
+			desc:        "unknown base",
+			expectedMsg: "Profile a extends unknown profile b",
+			profiles: []ProfileConfiguration{
+				{Label: "a", Extends: strPtr("b")},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := resolveProfileInheritance(tC.profiles)
+			assert.Error(t, err)
+			if tC.expectedErr != nil {
+				assert.ErrorIs(t, err, tC.expectedErr)
+			}
+			assert.Contains(t, err.Error(), tC.expectedMsg)
+		})
+	}
+}
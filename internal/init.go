@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrConfigurationExists error = errors.New("Configuration exists")
+
+var ErrNoBrowserFound error = errors.New("No browser found")
+
+// detectableBrowsers are the browsers InitConfiguration looks for, in
+// order of preference. Firefox is told to use the directory that
+// torbrowser-launcher would use, so instances are laid out the same.
+var detectableBrowsers = []struct {
+	program string
+	command func(home string) []string
+}{
+	{"torbrowser-launcher", func(home string) []string { return nil }},
+	{"firefox", func(home string) []string {
+		return []string{"firefox", "--no-remote", "--profile", filepath.Join(home, relativeProfilePath)}
+	}},
+}
+
+// detectBrowserCommand returns the BrowserCommand of a profile for the
+// first installed browser of detectableBrowsers. It is nil for
+// torbrowser-launcher, the default.
+func detectBrowserCommand(lookPath func(file string) (string, error), home string) ([]string, error) {
+	for _, browser := range detectableBrowsers {
+		if _, err := lookPath(browser.program); err == nil {
+			return browser.command(home), nil
+		}
+	}
+	return nil, uerror.StackTracef("%w: install torbrowser-launcher or firefox", ErrNoBrowserFound)
+}
+
+// InitConfiguration writes a starter configuration with a single
+// profile for the installed browser to configFile, which must not
+// exist yet, and creates the profile path. An empty profilePath keeps
+// the default. The written configuration is read back and validated,
+// so the returned configuration is what tbml will use.
+func InitConfiguration(configFile string, profilePath string, profileLabel string, mutations *Mutations, warnings *Warnings) (Configuration, error) {
+	exists, err := uio.FileExists(configFile)
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	if exists {
+		return Configuration{}, uerror.StackTracef("%w: %s", ErrConfigurationExists, configFile)
+	}
+	if err := validateProfileLabel(profileLabel); err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	browserCommand, err := detectBrowserCommand(exec.LookPath, home)
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+
+	// The starter configuration only uses bundled files, so it works
+	// without anything else.
+	baseline := builtinPrefix + "baseline"
+	configBytes, err := encodeStarterConfiguration(profilePath, ProfileConfiguration{
+		BrowserCommand: browserCommand,
+		Label:          profileLabel,
+		UserJSFiles:    []string{baseline},
+	})
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+
+	var config Configuration
+	err = mutations.Apply("Create configuration", configFile, func() error {
+		if err := os.MkdirAll(filepath.Dir(configFile), uio.FileModeURWXGRWXO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := uio.WriteFileAtomic(configFile, configBytes, uio.FileModeURWGRWO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		ulog.Default().Info("Created configuration", "file", configFile)
+
+		config, _, err = ReadConfiguration(configFile, warnings)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := os.MkdirAll(config.ProfilePath, uio.FileModeURWXGRWXO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return ValidateConfiguration(config, filepath.Dir(configFile))
+	})
+	if err != nil {
+		return Configuration{}, err
+	}
+	return config, nil
+}
+
+// encodeStarterConfiguration encodes a configuration with a single
+// profile as JSON, leaving out unset settings.
+func encodeStarterConfiguration(profilePath string, profile ProfileConfiguration) ([]byte, error) {
+	profileValue, err := getProfileConfigValue(profile)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	document := map[string]interface{}{
+		"Profiles": []interface{}{profileValue},
+	}
+	if profilePath != "" {
+		document["ProfilePath"] = profilePath
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return buf.Bytes(), nil
+}
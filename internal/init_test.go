@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectBrowserCommand(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectedCommand []string
+		expectedErr     error
+		installed       []string
+	}{
+		{
+			desc: "Tor Browser",
+
+			installed: []string{"firefox", "torbrowser-launcher"},
+		},
+		{
+			desc: "Firefox",
+
+			expectedCommand: []string{"firefox", "--no-remote", "--profile", filepath.Join("/home/user", relativeProfilePath)},
+			installed:       []string{"firefox"},
+		},
+		{
+			desc: "Nothing installed",
+
+			expectedErr: ErrNoBrowserFound,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			lookPath := func(file string) (string, error) {
+				for _, installed := range tC.installed {
+					if file == installed {
+						return "/usr/bin/" + file, nil
+					}
+				}
+				return "", errors.New("not found")
+			}
+			command, err := detectBrowserCommand(lookPath, "/home/user")
+			assert.ErrorIs(t, err, tC.expectedErr)
+			assert.Equal(t, tC.expectedCommand, command)
+		})
+	}
+}
+
+func TestInitConfiguration(t *testing.T) {
+	binDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "torbrowser-launcher"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", binDir)
+	t.Setenv(ProfilePathEnvVar, "")
+
+	configFile := filepath.Join(t.TempDir(), "tbml", "config.json")
+	profilePath := filepath.Join(t.TempDir(), "profiles")
+	config, err := InitConfiguration(configFile, profilePath, "default", nil, &Warnings{})
+	assert.NoError(t, err)
+	assert.Equal(t, profilePath, config.ProfilePath)
+	assert.DirExists(t, profilePath)
+
+	configBytes, err := os.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"ProfilePath": "`+profilePath+`",
+		"Profiles": [{"Label": "default", "UserJSFiles": ["builtin:baseline"]}]
+	}`, string(configBytes))
+
+	_, err = InitConfiguration(configFile, profilePath, "default", nil, &Warnings{})
+	assert.ErrorIs(t, err, ErrConfigurationExists)
+}
+
+func TestInitConfigurationDryRun(t *testing.T) {
+	binDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "firefox"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", binDir)
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	_, err := InitConfiguration(configFile, "", "default", &Mutations{DryRun: true}, &Warnings{})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, configFile)
+}
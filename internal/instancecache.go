@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+const (
+	instanceCacheFileName = "instance-cache.json"
+	// instanceCacheMaxAge is how long a cached listing is used at
+	// most. The cache is meant for commands that run in quick
+	// succession, like a completion followed by a launch.
+	instanceCacheMaxAge = time.Minute
+	// instanceCacheRacyWindow is how recently the profile path or an
+	// instance's metadata may have changed for a listing to be cached.
+	// Changes within the granularity of the file system's timestamps
+	// may leave the modification time as it was, so recent ones can't
+	// be told apart from later ones.
+	instanceCacheRacyWindow = 2 * time.Second
+)
+
+// instanceCache is the listing of the instances in the profile path as
+// it was last read, so repeated invocations don't have to read every
+// instance's metadata again. It is checked against the modification
+// times of the profile path and the metadata files before it is used,
+// and is deleted whenever tbml changes an instance.
+type instanceCache struct {
+	// Build identifies the tbml build that wrote the cache, since
+	// other builds may read metadata differently.
+	Build   string
+	Entries []instanceCacheEntry
+	// ProfilePathModTime changes when instances are created, deleted
+	// or renamed.
+	ProfilePathModTime time.Time
+	Written            time.Time
+}
+
+type instanceCacheEntry struct {
+	Instance        ProfileInstance
+	MetadataModTime time.Time
+	MetadataSize    int64
+}
+
+func getInstanceCacheBuild() string {
+	info := BuildInfo()
+	return info.Version + " " + info.Commit
+}
+
+// readCachedProfileInstances returns the cached listing of the
+// instances, if it is still up to date.
+func readCachedProfileInstances(config Configuration) ([]ProfileInstance, bool) {
+	var cache instanceCache
+	if err := readStateFile(config, instanceCacheFileName, &cache); err != nil {
+		ulog.Default().Debug("Ignoring unreadable instance cache", "error", uerror.Message(err))
+		return nil, false
+	}
+	if cache.Written.IsZero() || cache.Build != getInstanceCacheBuild() {
+		return nil, false
+	}
+	if age := time.Since(cache.Written); age < 0 || age > instanceCacheMaxAge {
+		return nil, false
+	}
+	info, err := os.Stat(config.ProfilePath)
+	if err != nil || !info.ModTime().Equal(cache.ProfilePathModTime) {
+		return nil, false
+	}
+	instances := make([]ProfileInstance, 0, len(cache.Entries))
+	for _, entry := range cache.Entries {
+		info, err := os.Stat(filepath.Join(config.ProfilePath, entry.Instance.InstanceLabel, "profile-instance.json"))
+		if err != nil || !info.ModTime().Equal(entry.MetadataModTime) || info.Size() != entry.MetadataSize {
+			return nil, false
+		}
+		instances = append(instances, entry.Instance)
+	}
+	return instances, true
+}
+
+// writeInstanceCache caches a listing of the instances, unless the
+// profile path or any metadata changed too recently to tell whether
+// the listing is current. Failing to write the cache only makes the
+// next listing slower, so it isn't reported.
+func writeInstanceCache(config Configuration, cache instanceCache) {
+	racy := cache.Written.Add(-instanceCacheRacyWindow)
+	if cache.ProfilePathModTime.After(racy) {
+		return
+	}
+	for _, entry := range cache.Entries {
+		if entry.MetadataModTime.After(racy) {
+			return
+		}
+	}
+	cache.Build = getInstanceCacheBuild()
+	if err := writeStateFile(config, instanceCacheFileName, cache); err != nil {
+		ulog.Default().Debug("Failed to write the instance cache", "error", uerror.Message(err))
+	}
+}
+
+// invalidateInstanceCache deletes the cached listing of the instances.
+// It is called whenever tbml changes an instance, so the next listing
+// doesn't depend on the modification times alone.
+func invalidateInstanceCache(config Configuration) {
+	err := os.Remove(filepath.Join(getStateDir(config), instanceCacheFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ulog.Default().Warn("Failed to invalidate the instance cache", "error", uerror.Message(err))
+	}
+}
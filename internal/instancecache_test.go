@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestInstanceCache(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	assert.NoError(t, os.MkdirAll(getStateDir(config), uio.FileModeURWXGRWXO))
+	cachePath := filepath.Join(getStateDir(config), instanceCacheFileName)
+	metadataPath := filepath.Join(instanceDir, "profile-instance.json")
+	old := time.Now().Add(-time.Hour)
+	age := func() {
+		assert.NoError(t, os.Chtimes(metadataPath, old, old))
+		assert.NoError(t, os.Chtimes(config.ProfilePath, old, old))
+	}
+
+	// Fresh changes might be followed by others that leave the
+	// modification times as they are, so they aren't cached.
+	_, err := readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, cachePath)
+
+	age()
+	_, err = readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, cachePath)
+
+	// A change that keeps the modification time and size is only seen
+	// through the cache, which shows that it is used.
+	metadata, err := os.ReadFile(metadataPath)
+	assert.NoError(t, err)
+	changed := strings.Replace(string(metadata), "test-usage", "test-other", 1)
+	assert.NoError(t, os.WriteFile(metadataPath, []byte(changed), uio.FileModeURWGRWO))
+	age()
+	instances, err := readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "test-usage", *instances[0].UsageLabel)
+
+	// Other changes to the metadata invalidate it.
+	assert.NoError(t, os.Chtimes(metadataPath, time.Now(), time.Now()))
+	instances, err = readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "test-other", *instances[0].UsageLabel)
+
+	// So do new instances and changes made by tbml itself.
+	age()
+	_, err = readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, cachePath)
+	other := ProfileInstance{InstanceLabel: "test-2", ProfileLabel: "test"}
+	assert.NoError(t, writeProfileInstanceForTest(config, other))
+	assert.NoFileExists(t, cachePath)
+	instances, err = readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 2)
+}
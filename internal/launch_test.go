@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var fakeBrowser struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// buildFakeBrowser builds testdata/fakebrowser once per test run and
+// returns the path of the binary.
+func buildFakeBrowser(t *testing.T) string {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool is needed to build the fake browser")
+	}
+	fakeBrowser.once.Do(func() {
+		dir, err := os.MkdirTemp(os.TempDir(), "tbml-fakebrowser-*")
+		if err != nil {
+			fakeBrowser.err = err
+			return
+		}
+		fakeBrowser.path = filepath.Join(dir, "fakebrowser")
+		buildCmd := exec.Command(goTool, "build", "-o", fakeBrowser.path, "./testdata/fakebrowser")
+		buildCmd.Stderr = os.Stderr
+		fakeBrowser.err = buildCmd.Run()
+	})
+	if fakeBrowser.err != nil {
+		t.Fatalf("Failed to build the fake browser: %v", fakeBrowser.err)
+	}
+	return fakeBrowser.path
+}
+
+// useFakeBrowser makes StartInstance launch the fake browser with the
+// given arguments instead of firejail and skip the bind mounts. The
+// returned function restores the real launcher.
+func useFakeBrowser(t *testing.T, args ...string) (restore func()) {
+	fakeBrowserPath := buildFakeBrowser(t)
+	originalNewBrowserCommand, originalSetUpSandboxMounts := newBrowserCommand, setUpSandboxMounts
+	newBrowserCommand = func(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool, warnings *Warnings) (*exec.Cmd, error) {
+		fullArgs := append([]string{"-profile", filepath.Join(instanceDir, relativeProfilePath)}, args...)
+		return exec.CommandContext(ctx, fakeBrowserPath, fullArgs...), nil
+	}
+	setUpSandboxMounts = func(instanceDir string) (func() error, error) {
+		return func() error { return nil }, nil
+	}
+	return func() {
+		newBrowserCommand, setUpSandboxMounts = originalNewBrowserCommand, originalSetUpSandboxMounts
+	}
+}
+
+type launchResult struct {
+	exitCode uint
+	err      error
+}
+
+// waitForFakeBrowser waits until the fake browser has locked the
+// instance's profile and returns its PID.
+func waitForFakeBrowser(t *testing.T, instanceDir string) int {
+	lockLink := filepath.Join(instanceDir, relativeProfilePath, "lock")
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		target, err := os.Readlink(lockLink)
+		if err == nil {
+			pid, err := strconv.Atoi(strings.TrimPrefix(target, "127.0.0.1:+"))
+			assert.NoError(t, err)
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("The fake browser didn't lock the profile in time")
+	return 0
+}
+
+func TestLaunchLifecycle(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		args             []string
+		expectedExitCode uint
+	}{
+		{
+			desc: "Clean exit",
+
+			args:             []string{"-lifetime", "50ms"},
+			expectedExitCode: 0,
+		},
+		{
+			desc: "Exit with error",
+
+			args:             []string{"-lifetime", "50ms", "-exit-code", "3"},
+			expectedExitCode: 3,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			defer useFakeBrowser(t, tC.args...)()
+			topic := instance.UsageLabel
+
+			exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedExitCode, exitCode)
+
+			instance, err = GetProfileInstance(config, instance.InstanceLabel)
+			assert.NoError(t, err)
+			assert.Nil(t, instance.UsagePID)
+			assert.Nil(t, instance.UsageLabel)
+			assert.False(t, instance.Created.IsZero())
+			assert.False(t, instance.LastUsed.Before(instance.Created))
+			if assert.Len(t, instance.Sessions, 1) {
+				assert.NotNil(t, instance.Sessions[0].End)
+				assert.Equal(t, topic, instance.Sessions[0].Topic)
+			}
+			assert.FileExists(t, filepath.Join(instanceDir, relativeProfilePath, "extensions/mothership@tbml.t0ast.cc.xpi"))
+
+			userJS, err := os.ReadFile(filepath.Join(instanceDir, relativeProfilePath, "user.js"))
+			assert.NoError(t, err)
+			assert.Contains(t, string(userJS), "network.proxy.socks_port")
+			assert.NoFileExists(t, filepath.Join(instanceDir, relativeProfilePath, "lock"))
+
+			unlock, err := LockInstance(config, instance)
+			assert.NoError(t, err)
+			assert.NoError(t, unlock())
+		})
+	}
+}
+
+func TestLaunchLifecycleWhileRunning(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	defer useFakeBrowser(t, "-signal-exit-code", "5")()
+
+	done := make(chan launchResult, 1)
+	go func() {
+		exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+		done <- launchResult{exitCode, err}
+	}()
+	pid := waitForFakeBrowser(t, instanceDir)
+
+	running, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	if assert.NotNil(t, running.UsagePID) {
+		assert.Equal(t, os.Getpid(), *running.UsagePID)
+	}
+	assert.Equal(t, instance.UsageLabel, running.UsageLabel)
+
+	_, err = StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+	assert.ErrorIs(t, err, ErrInstanceInUse)
+
+	assert.NoError(t, syscall.Kill(pid, syscall.SIGTERM))
+	select {
+	case result := <-done:
+		assert.NoError(t, result.err)
+		assert.Equal(t, uint(5), result.exitCode)
+	case <-time.After(10 * time.Second):
+		t.Fatal("StartInstance didn't return after the browser exited")
+	}
+
+	stopped, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Nil(t, stopped.UsagePID)
+}
+
+func TestLaunchLifecycleCanceled(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	defer useFakeBrowser(t, "-signal-exit-code", "5")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan launchResult, 1)
+	go func() {
+		exitCode, err := StartInstance(ctx, config, profile, instance, "testdata", nil, false, false, 0, nil)
+		done <- launchResult{exitCode, err}
+	}()
+	waitForFakeBrowser(t, instanceDir)
+
+	cancel()
+	select {
+	case result := <-done:
+		assert.NoError(t, result.err)
+		// The browser is asked to quit rather than killed.
+		assert.Equal(t, uint(5), result.exitCode)
+	case <-time.After(10 * time.Second):
+		t.Fatal("StartInstance didn't return after the context was canceled")
+	}
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, unlock())
+}
+
+func TestLaunchLifecycleSessionLimit(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	defer useFakeBrowser(t, "-signal-exit-code", "5")()
+	notifications := []string{}
+	originalSendNotification := sendNotification
+	sendNotification = func(summary string, body string, icon string) error {
+		notifications = append(notifications, summary)
+		return nil
+	}
+	defer func() { sendNotification = originalSendNotification }()
+
+	exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 2*time.Second, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(5), exitCode)
+	assert.Equal(t, []string{"test-1 closes in 1s"}, notifications)
+}
+
+func TestLaunchLifecycleMaxMemory(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		args             []string
+		expectedExitCode uint
+		policy           *string
+	}{
+		{
+			desc: "Notify",
+
+			args:             []string{"-lifetime", "500ms"},
+			expectedExitCode: 0,
+		},
+		{
+			desc: "Stop",
+
+			args:             []string{"-signal-exit-code", "5"},
+			expectedExitCode: 5,
+			policy:           strPtr("stop"),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			defer useFakeBrowser(t, tC.args...)()
+			originalInterval, originalSendNotification := memoryWatchdogInterval, sendNotification
+			memoryWatchdogInterval = 20 * time.Millisecond
+			notifications := []string{}
+			sendNotification = func(summary string, body string, icon string) error {
+				notifications = append(notifications, summary)
+				return nil
+			}
+			defer func() { memoryWatchdogInterval, sendNotification = originalInterval, originalSendNotification }()
+			profile.MaxMemoryMiB = intPtr(1)
+			profile.MaxMemoryPolicy = tC.policy
+
+			exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedExitCode, exitCode)
+			if assert.Len(t, notifications, 1) {
+				assert.Contains(t, notifications[0], "test-1 uses")
+			}
+		})
+	}
+}
+
+func TestLaunchLifecycleResetOnExit(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	defer useFakeBrowser(t, "-lifetime", "50ms")()
+	profile.ResetOnExit = boolPtr(true)
+	parentLock := filepath.Join(instanceDir, relativeProfilePath, ".parentlock")
+
+	for i := 0; i < 2; i++ {
+		warnings := &Warnings{}
+		exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, warnings)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(0), exitCode)
+		assert.Empty(t, warnings.List())
+
+		assert.NoFileExists(t, parentLock)
+		assert.FileExists(t, filepath.Join(instanceDir, relativeProfilePath, "extensions/mothership@tbml.t0ast.cc.xpi"))
+		assert.FileExists(t, filepath.Join(instanceDir, "profile-instance.json"))
+		reset, err := GetProfileInstance(config, instance.InstanceLabel)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, reset.ProvisionedHash)
+		assert.DirExists(t, getInstanceTemplateDir(config, profile.Label, reset.ProvisionedHash))
+	}
+}
+
+func TestLaunchLifecycleEphemeral(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.EphemeralPath = filepath.Join(config.ProfilePath, ".ephemeral")
+	defer useFakeBrowser(t, "-lifetime", "50ms")()
+
+	instance, err := NewEphemeralInstance(config, profile)
+	assert.NoError(t, err)
+
+	exitCode, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), exitCode)
+	assert.NoDirExists(t, *instance.Directory)
+	assert.NoDirExists(t, getInstanceRecordDir(config, instance))
+}
+
+func TestLaunchLifecycleInstanceLog(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	defer useFakeBrowser(t, "-lifetime", "50ms", "-exit-code", "3")()
+	instanceLog := true
+	jsonFormat := "json"
+	config.Log = &LogConfiguration{Format: &jsonFormat, InstanceLog: &instanceLog}
+
+	_, err := StartInstance(context.Background(), config, profile, instance, "testdata", nil, false, false, 0, nil)
+	assert.NoError(t, err)
+
+	logBytes, err := os.ReadFile(filepath.Join(getInstanceRecordDir(config, instance), instanceLogFileName))
+	assert.NoError(t, err)
+	messages := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(logBytes)), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, instance.InstanceLabel, entry["instance"])
+		messages = append(messages, entry["msg"].(string))
+	}
+	assert.Contains(t, messages, "Syncing instance")
+	assert.Contains(t, messages, "Browser started")
+	assert.Equal(t, "Browser exited", messages[len(messages)-1])
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrInstanceLimit error = errors.New("All instances of the profile are in use")
+
+var ErrInvalidInstanceLimitPolicy error = errors.New("Invalid instance limit policy")
+
+// InstanceLimitPolicy decides what ClaimBestInstance does when all
+// instances of a profile are in use and the profile has as many
+// instances as its MaxInstances allow.
+type InstanceLimitPolicy string
+
+const (
+	// InstanceLimitWait blocks until an instance is free.
+	InstanceLimitWait InstanceLimitPolicy = "wait"
+	// InstanceLimitFail fails with ErrInstanceLimit.
+	InstanceLimitFail InstanceLimitPolicy = "fail"
+	// InstanceLimitEvict moves the least recently used free instances
+	// to the trash while the profile has more instances than allowed,
+	// e.g. after MaxInstances was lowered. If all instances are in use,
+	// it fails like InstanceLimitFail.
+	InstanceLimitEvict InstanceLimitPolicy = "evict"
+)
+
+// instanceLimitRetryInterval is how often ClaimBestInstance checks for
+// a free instance under InstanceLimitWait.
+var instanceLimitRetryInterval = time.Second
+
+func ParseInstanceLimitPolicy(s string) (InstanceLimitPolicy, error) {
+	switch policy := InstanceLimitPolicy(s); policy {
+	case InstanceLimitWait, InstanceLimitFail, InstanceLimitEvict:
+		return policy, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidInstanceLimitPolicy, s)
+}
+
+// getInstanceLimitPolicy returns the profile's policy, defaulting to
+// InstanceLimitWait.
+func getInstanceLimitPolicy(profile ProfileConfiguration) (InstanceLimitPolicy, error) {
+	if profile.InstanceLimitPolicy == nil {
+		return InstanceLimitWait, nil
+	}
+	return ParseInstanceLimitPolicy(*profile.InstanceLimitPolicy)
+}
+
+// isOverInstanceLimit tells whether creating the given instance would
+// exceed the profile's MaxInstances. Ephemeral instances don't count.
+func isOverInstanceLimit(profile ProfileConfiguration, instances []ProfileInstance, instance ProfileInstance) bool {
+	if profile.MaxInstances == nil {
+		return false
+	}
+	count := 0
+	for _, existing := range instances {
+		if existing.InstanceLabel == instance.InstanceLabel {
+			return false
+		}
+		if existing.ProfileLabel == profile.Label && !existing.Ephemeral {
+			count++
+		}
+	}
+	return count >= *profile.MaxInstances
+}
+
+// evictInstances moves the least recently used free instances of the
+// profile to the trash until it has no more than MaxInstances. Pinned
+// instances aren't free. The evictions can be undone like deletions. It
+// returns the remaining instances.
+func evictInstances(config Configuration, profile ProfileConfiguration, instances []ProfileInstance, warnings *Warnings) []ProfileInstance {
+	if profile.MaxInstances == nil {
+		return instances
+	}
+	free := []ProfileInstance{}
+	count := 0
+	for _, instance := range instances {
+		if instance.ProfileLabel != profile.Label || instance.Ephemeral {
+			continue
+		}
+		count++
+		if instance.UsagePID == nil && !instance.Reserved && !instance.Pinned {
+			free = append(free, instance)
+		}
+	}
+	sort.SliceStable(free, func(i, j int) bool {
+		return free[i].LastUsed.Before(free[j].LastUsed)
+	})
+
+	evicted := map[string]bool{}
+	for _, instance := range free {
+		if count <= *profile.MaxInstances {
+			break
+		}
+		if err := deleteInstance(config, instance); err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to evict the instance: %s", uerror.Message(err))
+			continue
+		}
+		ulog.Default().Info("Evicted instance", "instance", instance.InstanceLabel, "profile", profile.Label)
+		evicted[instance.InstanceLabel] = true
+		count--
+	}
+
+	remaining := make([]ProfileInstance, 0, len(instances))
+	for _, instance := range instances {
+		if !evicted[instance.InstanceLabel] {
+			remaining = append(remaining, instance)
+		}
+	}
+	return remaining
+}
+
+// waitForInstanceLimit sleeps before ClaimBestInstance tries again to
+// find a free instance.
+func waitForInstanceLimit(ctx context.Context) error {
+	timer := time.NewTimer(instanceLimitRetryInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return uerror.WithStackTrace(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimBestInstanceLimit(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		policy string
+	}{
+		{
+			desc: "fail",
+
+			policy: string(InstanceLimitFail),
+		},
+		{
+			desc: "evict with all instances in use",
+
+			policy: string(InstanceLimitEvict),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			maxInstances := 1
+			profile.MaxInstances = &maxInstances
+			profile.InstanceLimitPolicy = &tC.policy
+
+			_, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+			assert.NoError(t, err)
+			defer release()
+
+			_, _, err = ClaimBestInstance(context.Background(), config, profile, nil, nil)
+			assert.True(t, errors.Is(err, ErrInstanceLimit))
+		})
+	}
+}
+
+func TestClaimBestInstanceLimitWait(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	maxInstances := 1
+	profile.MaxInstances = &maxInstances
+	defer func(interval time.Duration) { instanceLimitRetryInterval = interval }(instanceLimitRetryInterval)
+	instanceLimitRetryInterval = 10 * time.Millisecond
+
+	first, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = ClaimBestInstance(ctx, config, profile, nil, nil)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	second, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+	assert.NoError(t, err)
+	defer release()
+	assert.Equal(t, first.InstanceLabel, second.InstanceLabel)
+}
+
+func TestClaimBestInstanceEvict(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	maxInstances := 1
+	policy := string(InstanceLimitEvict)
+	profile.MaxInstances = &maxInstances
+	profile.InstanceLimitPolicy = &policy
+
+	now := time.Now().UTC()
+	for i, label := range []string{"test-1", "test-2", "test-3"} {
+		instance.InstanceLabel = label
+		instance.UsageLabel = nil
+		instance.Created = now
+		instance.LastUsed = now.Add(time.Duration(i) * time.Hour)
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+
+	claimed, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+	assert.NoError(t, err)
+	defer release()
+	assert.Equal(t, "test-3", claimed.InstanceLabel)
+
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+}
+
+func TestClaimBestInstanceEvictKeepsPinned(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	maxInstances := 1
+	policy := string(InstanceLimitEvict)
+	profile.MaxInstances = &maxInstances
+	profile.InstanceLimitPolicy = &policy
+
+	now := time.Now().UTC()
+	for i, label := range []string{"test-1", "test-2", "test-3"} {
+		instance.InstanceLabel = label
+		instance.UsageLabel = nil
+		instance.Created = now
+		instance.LastUsed = now.Add(time.Duration(i) * time.Hour)
+		instance.Pinned = label == "test-1"
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+
+	claimed, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+	assert.NoError(t, err)
+	defer release()
+	assert.Equal(t, "test-1", claimed.InstanceLabel)
+
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.True(t, instances[0].Pinned)
+	}
+}
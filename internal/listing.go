@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// ProfileListing is the machine-readable description of a profile and
+// its instances. The JSON field names are part of tbml's interface for
+// scripts and must stay stable.
+type ProfileListing struct {
+	ExtensionFiles []string          `json:"extensionFiles"`
+	Instances      []InstanceListing `json:"instances"`
+	Label          string            `json:"label"`
+	UserChromeFile *string           `json:"userChromeFile"`
+	UserJSFile     *string           `json:"userJSFile"`
+}
+
+// InstanceListing is the machine-readable description of an instance.
+// The JSON field names must stay stable, see ProfileListing.
+type InstanceListing struct {
+	Archived        bool      `json:"archived"`
+	Created         time.Time `json:"created"`
+	Ephemeral       bool      `json:"ephemeral"`
+	Extensions      []string  `json:"extensions"`
+	InUse           bool      `json:"inUse"`
+	Label           string    `json:"label"`
+	LastUsed        time.Time `json:"lastUsed"`
+	Path            string    `json:"path"`
+	PID             *int      `json:"pid"`
+	Pinned          bool      `json:"pinned"`
+	Reserved        bool      `json:"reserved"`
+	TemplateVersion *string   `json:"templateVersion"`
+	Topic           *string   `json:"topic"`
+}
+
+// ListProfiles describes all configured profiles and their instances,
+// sorted by label. Instances of profiles that are no longer configured
+// are left out, as are those that don't match where unless it is nil.
+func ListProfiles(config Configuration, where *Filter, warnings *Warnings) ([]ProfileListing, error) {
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	instances, err = FilterInstances(config, instances, where)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	instancesPerProfile := make(map[string][]InstanceListing)
+	for _, instance := range instances {
+		instancesPerProfile[instance.ProfileLabel] = append(instancesPerProfile[instance.ProfileLabel], newInstanceListing(config, instance))
+	}
+
+	listings := make([]ProfileListing, 0, len(config.Profiles))
+	for _, profile := range config.Profiles {
+		profileInstances := instancesPerProfile[profile.Label]
+		if profileInstances == nil {
+			profileInstances = []InstanceListing{}
+		}
+		sort.Slice(profileInstances, func(i, j int) bool {
+			return profileInstances[i].Label < profileInstances[j].Label
+		})
+		extensionFiles := profile.ExtensionFiles
+		if extensionFiles == nil {
+			extensionFiles = []string{}
+		}
+		listings = append(listings, ProfileListing{
+			ExtensionFiles: extensionFiles,
+			Instances:      profileInstances,
+			Label:          profile.Label,
+			UserChromeFile: profile.UserChromeFile,
+			UserJSFile:     profile.UserJSFile,
+		})
+	}
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i].Label < listings[j].Label
+	})
+	return listings, nil
+}
+
+func newInstanceListing(config Configuration, instance ProfileInstance) InstanceListing {
+	extensions := instance.InstalledExtensions
+	if extensions == nil {
+		extensions = []string{}
+	}
+	var templateVersion *string
+	if len(instance.TemplateVersions) > 0 {
+		templateVersion = &instance.TemplateVersions[len(instance.TemplateVersions)-1].Version
+	}
+	return InstanceListing{
+		Archived:        instance.Archived,
+		Created:         instance.Created,
+		Ephemeral:       instance.Ephemeral,
+		Extensions:      extensions,
+		InUse:           instance.UsagePID != nil,
+		Label:           instance.InstanceLabel,
+		LastUsed:        instance.LastUsed,
+		Path:            getInstanceDir(config, instance),
+		PID:             instance.UsagePID,
+		Pinned:          instance.Pinned,
+		Reserved:        instance.Reserved,
+		TemplateVersion: templateVersion,
+		Topic:           instance.UsageLabel,
+	}
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListProfiles(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	config.Profiles = []ProfileConfiguration{{Label: "work"}, {Label: "test"}}
+	created := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	topic := "news"
+	pid := 1234
+	for _, instance := range []ProfileInstance{
+		{InstanceLabel: "test-2", ProfileLabel: "test", Created: created, LastUsed: created, UsageLabel: &topic, UsagePID: &pid},
+		{InstanceLabel: "test-1", ProfileLabel: "test", Created: created, LastUsed: created, InstalledExtensions: []string{"foo@t0ast.cc"}},
+		{InstanceLabel: "gone-1", ProfileLabel: "gone", Created: created, LastUsed: created},
+	} {
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+
+	listings, err := ListProfiles(config, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, listings, 2)
+	assert.Equal(t, "test", listings[0].Label)
+	assert.Equal(t, "work", listings[1].Label)
+	assert.Empty(t, listings[1].Instances)
+
+	instances := listings[0].Instances
+	assert.Len(t, instances, 2)
+	assert.Equal(t, "test-1", instances[0].Label)
+	assert.False(t, instances[0].InUse)
+	assert.Equal(t, []string{"foo@t0ast.cc"}, instances[0].Extensions)
+	assert.Equal(t, "test-2", instances[1].Label)
+	assert.True(t, instances[1].InUse)
+	assert.Equal(t, &topic, instances[1].Topic)
+	assert.Equal(t, getInstanceDir(config, ProfileInstance{InstanceLabel: "test-2"}), instances[1].Path)
+
+	// Profiles are listed even if none of their instances match.
+	where, err := ParseFilter("running")
+	assert.NoError(t, err)
+	listings, err = ListProfiles(config, where, nil)
+	assert.NoError(t, err)
+	assert.Len(t, listings, 2)
+	if assert.Len(t, listings[0].Instances, 1) {
+		assert.Equal(t, "test-2", listings[0].Instances[0].Label)
+	}
+}
+
+func TestProfileListingJSON(t *testing.T) {
+	created := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	listing := ProfileListing{
+		ExtensionFiles: []string{},
+		Instances: []InstanceListing{{
+			Created:    created,
+			Extensions: []string{},
+			Label:      "test-1",
+			LastUsed:   created,
+			Path:       "/profiles/test-1",
+		}},
+		Label: "test",
+	}
+
+	actual, err := json.Marshal(listing)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"extensionFiles": [],
+		"instances": [{
+			"archived": false,
+			"created": "2021-11-01T12:00:00Z",
+			"ephemeral": false,
+			"extensions": [],
+			"inUse": false,
+			"label": "test-1",
+			"lastUsed": "2021-11-01T12:00:00Z",
+			"path": "/profiles/test-1",
+			"pid": null,
+			"pinned": false,
+			"reserved": false,
+			"templateVersion": null,
+			"topic": null
+		}],
+		"label": "test",
+		"userChromeFile": null,
+		"userJSFile": null
+	}`, string(actual))
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+
+	"t0ast.cc/tbml/util/i18n"
+)
+
+// notificationMessages holds the translations of the notifications
+// shown while a browser runs, keyed by the English format string.
+var notificationMessages = i18n.Catalog{
+	"de": {
+		"%s closes in %s":                      "%s schließt in %s",
+		"%s uses %s of memory":                 "%s belegt %s Arbeitsspeicher",
+		"The browser will be closed.":          "Der Browser wird geschlossen.",
+		"The limit is %s.":                     "Das Limit ist %s.",
+		"The session limit is almost reached.": "Das Sitzungslimit ist fast erreicht.",
+	},
+}
+
+// newNotificationPrinter returns a printer for the notifications in
+// the user's language.
+func newNotificationPrinter() *i18n.Printer {
+	return i18n.NewPrinter(notificationMessages, i18n.DetectLanguage())
+}
+
+// getLocalizedProfileName returns the name the profile has in the
+// given language according to its Names, falling back to English.
+func getLocalizedProfileName(profile ProfileConfiguration, language string) (string, bool) {
+	if name, ok := profile.Names[language]; ok {
+		return name, true
+	}
+	name, ok := profile.Names["en"]
+	return name, ok
+}
+
+// GetProfileDisplayName returns what the profile is called in the given
+// language: its localized name, its DisplayName or else its label.
+func GetProfileDisplayName(profile ProfileConfiguration, language string) string {
+	if name, ok := getLocalizedProfileName(profile, language); ok {
+		return name
+	}
+	if profile.DisplayName != nil {
+		return *profile.DisplayName
+	}
+	return profile.Label
+}
+
+// getNotificationName returns how an instance of the profile is called
+// in notifications: by its label, preceded by the profile's name if it
+// has one.
+func getNotificationName(profile ProfileConfiguration, instanceLabel string, language string) string {
+	if name := GetProfileDisplayName(profile, language); name != profile.Label {
+		return fmt.Sprintf("%s: %s", name, instanceLabel)
+	}
+	return instanceLabel
+}
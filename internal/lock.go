@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+// instanceLockFileName is the name of the file in an instance directory
+// that is locked (flock) while the instance is running. Unlike the
+// stored UsagePID, the lock is released by the kernel when the process
+// dies, so it stays correct across crashes and reboots.
+const instanceLockFileName = "instance.lock"
+
+// LockInstance takes the instance's lock, creating the instance's
+// directory in the profile path if necessary. If the instance is already locked by another
+// process, the returned error wraps ErrInstanceInUse.
+func LockInstance(config Configuration, instance ProfileInstance) (unlock func() error, err error) {
+	recordDir := getInstanceRecordDir(config, instance)
+	if err := ensureInstanceRecordDir(config, instance); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	lockFile, err := os.OpenFile(filepath.Join(recordDir, instanceLockFileName), os.O_CREATE|os.O_RDWR, uio.FileModeURWGRWO)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lockFile.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, uerror.StackTracef("%w: %s is locked by another process", ErrInstanceInUse, instance.InstanceLabel)
+		}
+		return nil, uerror.WithStackTrace(err)
+	}
+	// DeleteInstance moves the directory away while holding the lock,
+	// so the locked file may not be the instance's lock file anymore.
+	lockFileInfo, err := lockFile.Stat()
+	if err != nil {
+		lockFile.Close()
+		return nil, uerror.WithStackTrace(err)
+	}
+	currentFileInfo, err := os.Stat(lockFile.Name())
+	if err != nil || !os.SameFile(lockFileInfo, currentFileInfo) {
+		lockFile.Close()
+		return nil, uerror.StackTracef("%w: %s is being deleted", ErrInstanceInUse, instance.InstanceLabel)
+	}
+	// A browser started outside of tbml doesn't hold the lock. Metadata
+	// that can't be read can't mark the instance as attached either.
+	if stored, err := GetProfileInstance(config, instance.InstanceLabel); err == nil && isAttachedProcessAlive(stored) {
+		lockFile.Close()
+		return nil, uerror.StackTracef("%w: %s is attached to process %d", ErrInstanceInUse, instance.InstanceLabel, *stored.UsagePID)
+	}
+	return func() error {
+		// Closing the file releases the lock.
+		return lockFile.Close()
+	}, nil
+}
+
+// ensureInstanceRecordDir creates the instance's directory in the
+// profile path if it doesn't exist. The directory is prepared with its
+// lock file under a hidden name and then moved into place, so other
+// processes never see it empty.
+func ensureInstanceRecordDir(config Configuration, instance ProfileInstance) error {
+	recordDir := getInstanceRecordDir(config, instance)
+	exists, err := uio.DirExists(recordDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := os.MkdirAll(config.ProfilePath, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	tmpDir, err := os.MkdirTemp(config.ProfilePath, "."+instance.InstanceLabel+"-*")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	lockFile, err := os.OpenFile(filepath.Join(tmpDir, instanceLockFileName), os.O_CREATE|os.O_RDWR, uio.FileModeURWGRWO)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := lockFile.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	if err := os.Rename(tmpDir, recordDir); err != nil {
+		// Another process may have created the directory first.
+		if exists, _ := uio.DirExists(recordDir); exists {
+			return nil
+		}
+		return uerror.WithStackTrace(err)
+	}
+	invalidateInstanceCache(config)
+	return nil
+}
+
+// instanceLockState tells whether an instance is locked. If the
+// instance has no lock file, e.g. because it was last used by an older
+// version of tbml, hasLockFile is false.
+func instanceLockState(config Configuration, instance ProfileInstance) (locked bool, hasLockFile bool, err error) {
+	lockFile, err := os.Open(filepath.Join(getInstanceRecordDir(config, instance), instanceLockFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, uerror.WithStackTrace(err)
+	}
+	defer lockFile.Close()
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return true, true, nil
+	}
+	if err != nil {
+		return false, true, uerror.WithStackTrace(err)
+	}
+	return false, true, nil
+}
+
+// isInstanceInUse checks whether an instance is running. The lock is
+// authoritative, except for attached instances, whose process is
+// checked instead; only instances without a lock file fall back to the
+// stored UsagePID.
+func isInstanceInUse(config Configuration, instance ProfileInstance) (bool, error) {
+	locked, hasLockFile, err := instanceLockState(config, instance)
+	if err != nil {
+		return false, uerror.WithStackTrace(err)
+	}
+	if hasLockFile {
+		return locked || isAttachedProcessAlive(instance), nil
+	}
+	return instance.UsagePID != nil, nil
+}
+
+const allocationLockFileName = "allocation.lock"
+
+// ClaimBestInstance picks an instance of the profile like
+// GetBestInstance, locks it and marks it as in use for the given
+// topic. Claims are serialized with a lock in the state directory and
+// the instance is marked before the next claim can start, so
+// concurrent launches never pick the same instance. The instance is
+// released with the returned function or by StartClaimedInstance.
+// Within the profile's launch cooldown after the last claim, the error
+// wraps ErrLaunchCooldown instead. If the profile's MaxInstances are
+// all in use, its InstanceLimitPolicy decides whether to wait for one
+// until ctx is done or to fail with ErrInstanceLimit.
+func ClaimBestInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, usageLabel *string, warnings *Warnings) (ProfileInstance, func() error, error) {
+	policy, err := getInstanceLimitPolicy(profile)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	waiting := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+		}
+		instance, release, err := claimBestInstance(config, profile, usageLabel, policy, warnings)
+		if !errors.Is(err, ErrInstanceLimit) || policy != InstanceLimitWait {
+			return instance, release, err
+		}
+		if !waiting {
+			ulog.Default().Info("Waiting for a free instance", "profile", profile.Label)
+			waiting = true
+		}
+		if err := waitForInstanceLimit(ctx); err != nil {
+			return ProfileInstance{}, nil, err
+		}
+	}
+}
+
+func claimBestInstance(config Configuration, profile ProfileConfiguration, usageLabel *string, policy InstanceLimitPolicy, warnings *Warnings) (ProfileInstance, func() error, error) {
+	unlockAllocation, err := lockStateFile(config, allocationLockFileName)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	defer unlockAllocation()
+
+	now := time.Now()
+	launch, err := findRecentLaunch(config, profile, now)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	if launch != nil {
+		return ProfileInstance{}, nil, uerror.StackTracef("%w: %s", ErrLaunchCooldown, launch.InstanceLabel)
+	}
+
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	instances, err = markSeatInstancesInUse(config, instances)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	if policy == InstanceLimitEvict {
+		instances = evictInstances(config, profile, instances, warnings)
+	}
+	for {
+		instance := GetBestInstance(profile, instances)
+		if isOverInstanceLimit(profile, instances, instance) {
+			return ProfileInstance{}, nil, uerror.StackTracef("%w: %s has %d", ErrInstanceLimit, profile.Label, *profile.MaxInstances)
+		}
+		unlockInstance, err := LockInstance(config, instance)
+		if errors.Is(err, ErrInstanceInUse) {
+			// The instance is locked by something that doesn't mark
+			// it as in use, like an export, so try the next one.
+			instances = markInstanceInUse(instances, instance)
+			continue
+		}
+		if err != nil {
+			return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+		}
+
+		instance.UsageLabel = usageLabel
+		cleanUpInstanceData, err := writeInstanceData(config, profile, instance)
+		if err != nil {
+			_ = unlockInstance()
+			return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+		}
+		release := func() error {
+			cleanUpErr := cleanUpInstanceData()
+			if err := unlockInstance(); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			return cleanUpErr
+		}
+		claimed, err := GetProfileInstance(config, instance.InstanceLabel)
+		if err != nil {
+			_ = release()
+			return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+		}
+		ulog.Default().Debug("Claimed instance", "instance", claimed.InstanceLabel, "profile", profile.Label)
+		if err := recordLaunch(config, profile, claimed.InstanceLabel, now); err != nil {
+			warnings.Add(claimed.InstanceLabel, "Failed to record the launch for the cooldown: %s", uerror.Message(err))
+		}
+		return claimed, release, nil
+	}
+}
+
+// markInstanceInUse returns instances with the given one marked as in
+// use, adding it if it is new so GetBestInstance picks another label.
+func markInstanceInUse(instances []ProfileInstance, instance ProfileInstance) []ProfileInstance {
+	marked := append([]ProfileInstance{}, instances...)
+	inUse := -1
+	for i := range marked {
+		if marked[i].InstanceLabel == instance.InstanceLabel {
+			marked[i].UsagePID = &inUse
+			return marked
+		}
+	}
+	instance.UsagePID = &inUse
+	return append(marked, instance)
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockInstance(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+
+	_, err = LockInstance(config, instance)
+	assert.ErrorIs(t, err, ErrInstanceInUse)
+
+	assert.NoError(t, unlock())
+
+	unlock, err = LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, unlock())
+}
+
+func TestGetProfileInstancesClearsStalePID(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	pid := 1234
+	instance.UsagePID = &pid
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	// Without a lock file, the stored PID is trusted.
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &pid, instances[0].UsagePID)
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	instances, err = GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &pid, instances[0].UsagePID)
+
+	// The process holding the lock is gone, e.g. after a crash.
+	assert.NoError(t, unlock())
+	instances, err = GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, instances[0].UsagePID)
+	assert.Equal(t, instance.UsageLabel, instances[0].UsageLabel)
+}
+
+func TestDeleteInstanceConsultsLock(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	pid := 1234
+	instance.UsagePID = &pid
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, DeleteInstance(config, instance, nil), ErrInstanceInUse)
+	assert.FileExists(t, filepath.Join(instanceDir, "profile-instance.json"))
+
+	assert.NoError(t, unlock())
+	assert.NoError(t, DeleteInstance(config, instance, nil))
+	assert.NoDirExists(t, instanceDir)
+}
+
+func TestGetProfileInstancesSkipsInstanceBeingCreated(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	defer unlock()
+
+	warnings := &Warnings{}
+	instances, err := GetProfileInstances(config, warnings)
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+	assert.Empty(t, warnings.List())
+}
+
+func TestClaimBestInstanceConcurrently(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	const claims = 16
+	labels := make([]string, claims)
+	releases := make([]func() error, claims)
+	errs := make([]error, claims)
+	wg := sync.WaitGroup{}
+	for i := 0; i < claims; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			usageLabel := fmt.Sprintf("topic-%d", i)
+			instance, release, err := ClaimBestInstance(context.Background(), config, profile, &usageLabel, nil)
+			labels[i], releases[i], errs[i] = instance.InstanceLabel, release, err
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i := 0; i < claims; i++ {
+		assert.NoError(t, errs[i])
+		assert.False(t, seen[labels[i]], "%s was claimed twice", labels[i])
+		seen[labels[i]] = true
+
+		instance, err := GetProfileInstance(config, labels[i])
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("topic-%d", i), *instance.UsageLabel)
+		assert.NotNil(t, instance.UsagePID)
+	}
+
+	for _, release := range releases {
+		assert.NoError(t, release())
+	}
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, claims)
+	for _, instance := range instances {
+		assert.Nil(t, instance.UsageLabel)
+		assert.Nil(t, instance.UsagePID)
+	}
+}
+
+func TestClaimBestInstanceSkipsLockedInstance(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instance.UsageLabel = nil
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	// Locked without being marked as in use, like during an export
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	defer unlock()
+
+	claimed, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+	assert.NoError(t, err)
+	defer release()
+	assert.Equal(t, "test-2", claimed.InstanceLabel)
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+const (
+	instanceLogFileName = "tbml.log"
+	// maxInstanceLogSize is the size at which an instance's log is
+	// moved aside to tbml.log.1, replacing the previous one, when the
+	// instance is launched.
+	maxInstanceLogSize = 1 << 20
+)
+
+// GetLogSettings returns the configured log level and format.
+func GetLogSettings(config Configuration) (ulog.Level, ulog.Format, error) {
+	level, format := ulog.LevelWarn, ulog.FormatText
+	if config.Log == nil {
+		return level, format, nil
+	}
+	var err error
+	if config.Log.Level != nil {
+		if level, err = ulog.ParseLevel(*config.Log.Level); err != nil {
+			return 0, "", uerror.WithStackTrace(err)
+		}
+	}
+	if config.Log.Format != nil {
+		if format, err = ulog.ParseFormat(*config.Log.Format); err != nil {
+			return 0, "", uerror.WithStackTrace(err)
+		}
+	}
+	return level, format, nil
+}
+
+// openInstanceLog returns a logger that writes to the instance's log
+// file in addition to logger, if the configuration enables instance
+// logs. The file gets every entry, so a failed launch can be traced
+// after the fact. The returned function closes the file.
+func openInstanceLog(config Configuration, instance ProfileInstance, logger *ulog.Logger) (*ulog.Logger, func() error, error) {
+	noop := func() error { return nil }
+	if config.Log == nil || config.Log.InstanceLog == nil || !*config.Log.InstanceLog {
+		return logger, noop, nil
+	}
+	_, format, err := GetLogSettings(config)
+	if err != nil {
+		return logger, noop, uerror.WithStackTrace(err)
+	}
+
+	logPath := filepath.Join(getInstanceRecordDir(config, instance), instanceLogFileName)
+	info, err := os.Stat(logPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return logger, noop, uerror.WithStackTrace(err)
+	}
+	if err == nil && info.Size() >= maxInstanceLogSize {
+		if err := os.Rename(logPath, logPath+".1"); err != nil {
+			return logger, noop, uerror.WithStackTrace(err)
+		}
+	}
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, uio.FileModeURWGRWO)
+	if err != nil {
+		return logger, noop, uerror.WithStackTrace(err)
+	}
+	return logger.Tee(file, ulog.LevelDebug, format), file.Close, nil
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+const (
+	maintenanceFileName     = "maintenance.json"
+	maintenanceLockFileName = "maintenance.lock"
+	// maintenanceInterval is how often RunMaintenance does anything
+	// unless it is forced.
+	maintenanceInterval = 24 * time.Hour
+
+	unarchiveRateFileName = "unarchive-rate.json"
+	// defaultUnarchiveRate is how many bytes of files are assumed to be
+	// restored per second before any instance was unarchived.
+	defaultUnarchiveRate = 32 << 20
+)
+
+type maintenanceState struct {
+	LastRun time.Time
+}
+
+type unarchiveRate struct {
+	BytesPerSecond float64
+}
+
+// MaintenanceResult reports what RunMaintenance did.
+type MaintenanceResult struct {
+	Archived []ProfileInstance
+	Pruned   []CleanResult
+}
+
+// RunMaintenance does the periodic upkeep of the instances, which is
+// deleting the instances that match PruneWhere and archiving the
+// instances that weren't used for ArchiveAfterDays. It does nothing if
+// it ran less than a day ago, unless force is set. Instances that can't
+// be archived, e.g. because they were launched in the meantime, and
+// failures to prune are reported as warnings.
+func RunMaintenance(config Configuration, force bool, mutations *Mutations, warnings *Warnings) (MaintenanceResult, error) {
+	result := MaintenanceResult{Archived: []ProfileInstance{}, Pruned: []CleanResult{}}
+	if config.ArchiveAfterDays == nil && config.PruneWhere == nil {
+		return result, nil
+	}
+	unlock, err := lockStateFile(config, maintenanceLockFileName)
+	if err != nil {
+		return result, uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	now := time.Now()
+	state := maintenanceState{}
+	if err := readStateFile(config, maintenanceFileName, &state); err != nil {
+		return result, uerror.WithStackTrace(err)
+	}
+	if !force && now.Sub(clampToNow(state.LastRun, now)) < maintenanceInterval {
+		return result, nil
+	}
+
+	if config.PruneWhere != nil {
+		where, err := ParseFilter(*config.PruneWhere)
+		if err != nil {
+			return result, uerror.WithStackTrace(err)
+		}
+		pruned, err := CleanInstances(config, CleanPolicy{Where: where}, mutations, warnings)
+		if err != nil {
+			warnings.Add("PruneWhere", "Failed to delete instances: %s", uerror.Message(err))
+		}
+		result.Pruned = append(result.Pruned, pruned...)
+	}
+
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return result, uerror.WithStackTrace(err)
+	}
+	for _, instance := range selectInstancesToArchive(config, instances, now) {
+		if err := ArchiveInstance(config, instance, mutations); err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to archive instance: %s", uerror.Message(err))
+			continue
+		}
+		result.Archived = append(result.Archived, instance)
+	}
+
+	if err := mutations.Apply("Record maintenance run", maintenanceFileName, func() error {
+		return writeStateFile(config, maintenanceFileName, maintenanceState{LastRun: now.UTC()})
+	}); err != nil {
+		return result, uerror.WithStackTrace(err)
+	}
+	ulog.Default().Debug("Ran maintenance", "archived", len(result.Archived), "pruned", len(result.Pruned))
+	return result, nil
+}
+
+// selectInstancesToArchive returns the instances that weren't used for
+// ArchiveAfterDays, sorted by label. Instances of profiles that set
+// NoAutoArchive or aren't configured anymore are left alone, as are
+// those that can't be archived.
+func selectInstancesToArchive(config Configuration, instances []ProfileInstance, now time.Time) []ProfileInstance {
+	if config.ArchiveAfterDays == nil {
+		return nil
+	}
+	maxAge := time.Duration(*config.ArchiveAfterDays) * 24 * time.Hour
+	selected := []ProfileInstance{}
+	for _, instance := range instances {
+		profile := FindProfileByLabel(config, instance.ProfileLabel)
+		switch {
+		case profile == nil || (profile.NoAutoArchive != nil && *profile.NoAutoArchive):
+			continue
+		case instance.Archived || instance.Encrypted || instance.Ephemeral || instance.Reserved || instance.UsagePID != nil:
+			continue
+		case now.Sub(clampToNow(instance.LastUsed, now)) <= maxAge:
+			continue
+		}
+		selected = append(selected, instance)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].InstanceLabel < selected[j].InstanceLabel
+	})
+	return selected
+}
+
+// EstimateUnarchiveTime estimates how long unarchiving an instance
+// takes, based on the size of its files and how fast earlier instances
+// were unarchived. It is zero for instances that aren't archived.
+func EstimateUnarchiveTime(config Configuration, instance ProfileInstance) (time.Duration, error) {
+	var size int64
+	manifest, err := readArchiveManifest(getArchivedInstancePath(config, instance))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Archives from before the chunk store are estimated by their
+		// compressed size, which is the best there is without reading
+		// them.
+		info, err := os.Stat(getLegacyArchivedInstancePath(config, instance))
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, uerror.WithStackTrace(err)
+		}
+		size = info.Size()
+	} else if err != nil {
+		return 0, uerror.WithStackTrace(err)
+	} else {
+		size = manifest.size()
+	}
+	rate := unarchiveRate{BytesPerSecond: defaultUnarchiveRate}
+	if err := readStateFile(config, unarchiveRateFileName, &rate); err != nil {
+		return 0, uerror.WithStackTrace(err)
+	}
+	if rate.BytesPerSecond <= 0 {
+		rate.BytesPerSecond = defaultUnarchiveRate
+	}
+	return time.Duration(float64(size) / rate.BytesPerSecond * float64(time.Second)), nil
+}
+
+// recordUnarchiveRate remembers how fast the files of an instance were
+// restored for EstimateUnarchiveTime. Instances that were restored too
+// quickly to measure are ignored.
+func recordUnarchiveRate(config Configuration, restoredSize int64, took time.Duration) error {
+	if restoredSize <= 0 || took < time.Millisecond {
+		return nil
+	}
+	return writeStateFile(config, unarchiveRateFileName, unarchiveRate{
+		BytesPerSecond: float64(restoredSize) / took.Seconds(),
+	})
+}
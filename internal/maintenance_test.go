@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestSelectInstancesToArchive(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	pid := 123
+	config := Configuration{
+		ArchiveAfterDays: intPtr(14),
+		Profiles: []ProfileConfiguration{
+			{Label: "work"},
+			{Label: "banking", NoAutoArchive: boolPtr(true)},
+		},
+	}
+	instances := []ProfileInstance{
+		{InstanceLabel: "work-2", ProfileLabel: "work", LastUsed: now.Add(-15 * 24 * time.Hour)},
+		{InstanceLabel: "work-1", ProfileLabel: "work", LastUsed: now.Add(-30 * 24 * time.Hour)},
+		{InstanceLabel: "work-3", ProfileLabel: "work", LastUsed: now.Add(-13 * 24 * time.Hour)},
+		{InstanceLabel: "work-4", ProfileLabel: "work", LastUsed: now.Add(-30 * 24 * time.Hour), UsagePID: &pid},
+		{InstanceLabel: "work-5", ProfileLabel: "work", LastUsed: now.Add(-30 * 24 * time.Hour), Archived: true},
+		{InstanceLabel: "work-6", ProfileLabel: "work", LastUsed: now.Add(-30 * 24 * time.Hour), Encrypted: true},
+		{InstanceLabel: "banking-1", ProfileLabel: "banking", LastUsed: now.Add(-30 * 24 * time.Hour)},
+		{InstanceLabel: "old-1", ProfileLabel: "old", LastUsed: now.Add(-30 * 24 * time.Hour)},
+	}
+
+	selected := selectInstancesToArchive(config, instances, now)
+	labels := []string{}
+	for _, instance := range selected {
+		labels = append(labels, instance.InstanceLabel)
+	}
+	assert.Equal(t, []string{"work-1", "work-2"}, labels)
+
+	config.ArchiveAfterDays = nil
+	assert.Empty(t, selectInstancesToArchive(config, instances, now))
+}
+
+func TestRunMaintenance(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.ArchiveAfterDays = intPtr(7)
+	instance.LastUsed = time.Now().Add(-8 * 24 * time.Hour)
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	result, err := RunMaintenance(config, false, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, result.Archived, 1)
+	assert.Empty(t, result.Pruned)
+	stored, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.True(t, stored.Archived)
+
+	// Maintenance only runs once a day unless it is forced.
+	assert.NoError(t, UnarchiveInstance(config, stored, nil))
+	result, err = RunMaintenance(config, false, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Archived)
+	result, err = RunMaintenance(config, true, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, result.Archived, 1)
+}
+
+func TestRunMaintenancePrune(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	config.PruneWhere = strPtr(`age > 30d || label == "test-3"`)
+	for i, lastUsed := range []time.Time{time.Now(), time.Now().Add(-60 * 24 * time.Hour), time.Now()} {
+		instance.InstanceLabel = []string{"test-1", "test-2", "test-3"}[i]
+		instance.LastUsed = lastUsed
+		instance.Pinned = i == 2
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+
+	result, err := RunMaintenance(config, false, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Archived)
+	if assert.Len(t, result.Pruned, 1) {
+		assert.Equal(t, "test-2", result.Pruned[0].Instance.InstanceLabel)
+		assert.Equal(t, `matches age > 30d || label == "test-3"`, result.Pruned[0].Reason)
+	}
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 2, "pinned instances are kept")
+}
+
+func TestEstimateUnarchiveTime(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	estimate, err := EstimateUnarchiveTime(config, instance)
+	assert.NoError(t, err)
+	assert.Zero(t, estimate)
+
+	manifest := `{"Entries":[{"Path":"a","Size":33554432},{"Path":"b","Size":33554432}]}`
+	assert.NoError(t, os.WriteFile(getArchivedInstancePath(config, instance), []byte(manifest), uio.FileModeURWGRWO))
+	estimate, err = EstimateUnarchiveTime(config, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, estimate)
+
+	assert.NoError(t, recordUnarchiveRate(config, 16<<20, time.Second))
+	estimate, err = EstimateUnarchiveTime(config, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, 4*time.Second, estimate)
+}
@@ -7,43 +7,299 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
+	"gopkg.in/yaml.v3"
 	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+	ustring "t0ast.cc/tbml/util/string"
+	"t0ast.cc/tbml/util/toml"
 )
 
 var ErrInstanceInUse error = errors.New("Instance in use")
 
-func ReadConfiguration(configFile string) (config Configuration, configDir string, err error) {
-	configBytes, err := os.ReadFile(configFile)
+// instanceDataBackupFileName is the previous version of an instance's
+// profile-instance.json, kept in case the current one gets corrupted.
+const instanceDataBackupFileName = "profile-instance.json.bak"
+
+// profileInstanceSchemaVersion is written to the metadata of every
+// instance. Version 1 introduced UTC timestamps.
+const profileInstanceSchemaVersion = 1
+
+// Limits for files tbml parses, so a corrupted or hostile file can't
+// make it run out of memory.
+const (
+	maxConfigurationSize = 1 << 20
+	maxInstanceDataSize  = 64 << 10
+)
+
+// ReadConfiguration reads and validates a configuration file. Settings
+// that tbml doesn't know about are reported as warnings. The files
+// matched by the configuration's Include patterns are merged into it.
+// configFile may also be a directory, like config.d, in which case all
+// configuration files in it are merged and relative paths are resolved
+// against the directory itself.
+func ReadConfiguration(configFile string, warnings *Warnings) (config Configuration, configDir string, err error) {
+	isDir, err := uio.DirExists(configFile)
 	if err != nil {
 		return Configuration{}, "", uerror.WithStackTrace(err)
 	}
-	if err := json.Unmarshal(configBytes, &config); err != nil {
+	if isDir {
+		configDir = configFile
+		config, err = readConfigurationDir(configFile, warnings)
+	} else {
+		configDir = filepath.Dir(configFile)
+		config, err = readConfigurationFragment(configFile, warnings)
+		if err == nil && len(config.Include) > 0 {
+			config, err = includeConfigurationFiles(config, configFile, warnings)
+		}
+	}
+	if err != nil {
 		return Configuration{}, "", uerror.WithStackTrace(err)
 	}
+	config, err = resolveConfiguration(config, configFile, configDir, warnings)
+	if err != nil {
+		return Configuration{}, "", uerror.WithStackTrace(err)
+	}
+	return config, configDir, nil
+}
+
+// parseConfiguration does everything ReadConfiguration does after
+// reading the file, except following includes. The file name is only
+// used to determine the format and to resolve a relative profile path.
+func parseConfiguration(configFile string, configBytes []byte, warnings *Warnings) (config Configuration, err error) {
+	config, err = decodeConfiguration(configFile, configBytes, warnings)
+	if err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+	return resolveConfiguration(config, configFile, filepath.Dir(configFile), warnings)
+}
+
+// decodeConfiguration parses a configuration file and warns about
+// unknown and deprecated settings.
+func decodeConfiguration(configFile string, configBytes []byte, warnings *Warnings) (config Configuration, err error) {
+	generic, err := unmarshalConfiguration(configFile, configBytes, &config)
+	if err != nil {
+		return Configuration{}, uerror.StackTracef("Failed to parse %s: %w", configFile, err)
+	}
+	checkConfigurationKeys(generic, reflect.TypeOf(config), "", func(key string) {
+		warnings.Add(configFile, "Unknown setting %s", key)
+	})
+	checkDeprecatedSettings(generic, func(deprecation Deprecation) {
+		warnings.addDeprecation(configFile, deprecation)
+	})
+	return config, nil
+}
+
+// resolveConfiguration applies the paths set through the environment,
+// fills in the default profile path, resolves profile inheritance and
+// validates a decoded configuration. Relative paths are resolved
+// against configDir.
+func resolveConfiguration(config Configuration, configFile string, configDir string, warnings *Warnings) (Configuration, error) {
+	if err := applyPathEnvironment(&config); err != nil {
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
 
 	if config.ProfilePath == "" {
 		cache, err := os.UserCacheDir()
 		if err != nil {
-			return Configuration{}, "", uerror.WithStackTrace(err)
+			// Containers and CI jobs often have neither a home nor
+			// XDG_CACHE_HOME.
+			config.ProfilePath = filepath.Join(os.TempDir(), fmt.Sprintf("tbml-%d", os.Getuid()))
+			warnings.Add(configFile, "No cache directory (%s), keeping instances in %s; set ProfilePath or %s to choose another place", uerror.Message(err), config.ProfilePath, ProfilePathEnvVar)
+		} else {
+			config.ProfilePath = filepath.Join(cache, "tbml")
 		}
-		config.ProfilePath = filepath.Join(cache, "tbml")
-	} else if strings.HasPrefix(config.ProfilePath, "~/") {
+	} else {
+		profilePath, err := resolveProfilePath(config.ProfilePath, configDir)
+		if err != nil {
+			return Configuration{}, uerror.WithStackTrace(err)
+		}
+		config.ProfilePath = profilePath
+	}
+
+	var err error
+	config.Profiles, err = resolveProfileInheritance(config.Profiles)
+	if err != nil {
+		return Configuration{}, uerror.StackTracef("Invalid configuration in %s: %w", configFile, err)
+	}
+	for i, profile := range config.Profiles {
+		if profile.ProfilePath == nil {
+			continue
+		}
+		profilePath, err := resolveProfilePath(*profile.ProfilePath, configDir)
+		if err != nil {
+			return Configuration{}, uerror.WithStackTrace(err)
+		}
+		// A profile that names the global profile path keeps its
+		// instances' files in their usual place.
+		if filepath.Clean(profilePath) == filepath.Clean(config.ProfilePath) {
+			config.Profiles[i].ProfilePath = nil
+		} else {
+			config.Profiles[i].ProfilePath = &profilePath
+		}
+	}
+
+	if err := ValidateConfiguration(config, configDir); err != nil {
+		var configErr ConfigurationError
+		if errors.As(err, &configErr) {
+			configErr.File = configFile
+			err = configErr
+		}
+		return Configuration{}, uerror.WithStackTrace(err)
+	}
+
+	return config, nil
+}
+
+// resolveProfilePath expands a leading "~/" of a profile path to the
+// home directory and resolves it against configDir if it is relative.
+func resolveProfilePath(profilePath string, configDir string) (string, error) {
+	if strings.HasPrefix(profilePath, "~/") {
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return Configuration{}, "", uerror.StackTracef("Failed to expand home directory in profile path: %w", err)
+			return "", uerror.StackTracef("Failed to expand home directory in profile path: %w", err)
+		}
+		return filepath.Join(home, profilePath[2:]), nil
+	}
+	if !filepath.IsAbs(profilePath) {
+		return filepath.Join(configDir, profilePath), nil
+	}
+	return profilePath, nil
+}
+
+// unmarshalConfiguration decodes a JSON, YAML or TOML configuration,
+// depending on the file extension. YAML and TOML documents are
+// converted to JSON first so all formats share the same field names
+// and matching rules. The generic form of the document is returned as
+// well.
+func unmarshalConfiguration(configFile string, configBytes []byte, config *Configuration) (interface{}, error) {
+	var generic interface{}
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(configBytes, &generic); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	case ".toml":
+		doc, err := toml.Unmarshal(configBytes)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		generic = doc
+	default:
+		if err := json.Unmarshal(configBytes, config); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(configBytes, &generic); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		return generic, nil
+	}
+
+	configJSON, err := json.Marshal(generic)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if err := json.Unmarshal(configJSON, config); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// checkConfigurationKeys calls unknown for every key of a generic
+// configuration document that doesn't correspond to a field of t.
+// Keys are matched case-insensitively like encoding/json does.
+func checkConfigurationKeys(generic interface{}, t reflect.Type, path string, unknown func(key string)) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := generic.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range object {
+			field, ok := findFieldFold(t, key)
+			if !ok {
+				unknown(path + key)
+				continue
+			}
+			checkConfigurationKeys(value, field.Type, path+key+".", unknown)
+		}
+	case reflect.Slice:
+		array, ok := generic.([]interface{})
+		if !ok {
+			return
+		}
+		for i, value := range array {
+			checkConfigurationKeys(value, t.Elem(), fmt.Sprintf("%s%d.", path, i), unknown)
+		}
+	case reflect.Map:
+		object, ok := generic.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range object {
+			checkConfigurationKeys(value, t.Elem(), path+key+".", unknown)
 		}
-		config.ProfilePath = filepath.Join(home, config.ProfilePath[2:])
-	} else if !filepath.IsAbs(config.ProfilePath) {
-		config.ProfilePath = filepath.Join(filepath.Dir(configFile), config.ProfilePath)
 	}
+}
 
-	return config, filepath.Dir(configFile), nil
+func findFieldFold(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, name) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
 }
 
-func GetProfileInstances(config Configuration) ([]ProfileInstance, error) {
+// GetProfileInstances reads the metadata of all instances. Entries of
+// the profile path that aren't readable instances are skipped with a
+// warning. The UsagePID and BrowserPID of instances whose lock isn't
+// held anymore are cleared, so they can be trusted by callers like
+// GetBestInstance.
+func GetProfileInstances(config Configuration, warnings *Warnings) ([]ProfileInstance, error) {
+	instances, err := readProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	for i, instance := range instances {
+		inUse, err := isInstanceInUse(config, instance)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if !inUse {
+			instances[i].BrowserPID = nil
+			instances[i].UsagePID = nil
+		}
+	}
+	return instances, nil
+}
+
+// readProfileInstances reads the metadata of all instances as it is
+// stored, without checking which instances are actually in use. The
+// listing is cached for the next invocation, see instanceCache.
+func readProfileInstances(config Configuration, warnings *Warnings) ([]ProfileInstance, error) {
+	if instances, ok := readCachedProfileInstances(config); ok {
+		return instances, nil
+	}
+	// The modification times are taken before anything is read, so
+	// changes made while the instances are read invalidate the cache.
+	cache := instanceCache{Written: time.Now()}
+	profilePathInfo, err := os.Stat(config.ProfilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []ProfileInstance{}, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	cache.ProfilePathModTime = profilePathInfo.ModTime()
 	dirEntries, err := os.ReadDir(config.ProfilePath)
 	if errors.Is(err, fs.ErrNotExist) {
 		return []ProfileInstance{}, nil
@@ -51,45 +307,356 @@ func GetProfileInstances(config Configuration) ([]ProfileInstance, error) {
 	if err != nil {
 		return nil, uerror.WithStackTrace(err)
 	}
+	// Listings that skipped or repaired something aren't cached, so
+	// the warnings are repeated and half-created instances are picked
+	// up once they are complete.
+	cacheable := true
 	instances := []ProfileInstance{}
 	for _, dirEntry := range dirEntries {
+		if isReservedProfilePathEntry(dirEntry.Name()) {
+			continue
+		}
 		if !dirEntry.IsDir() {
-			return nil, uerror.StackTracef("Non-directory entry found in %s: %s", config.ProfilePath, dirEntry.Name())
+			warnings.Add(filepath.Join(config.ProfilePath, dirEntry.Name()), "Skipping non-directory entry in profile path")
+			cacheable = false
+			continue
+		}
+		metadataInfo, statErr := os.Stat(filepath.Join(config.ProfilePath, dirEntry.Name(), "profile-instance.json"))
+		instanceData, fromBackup, err := readProfileInstance(config, dirEntry.Name())
+		if errors.Is(err, fs.ErrNotExist) {
+			cacheable = false
+			if isInstanceBeingCreatedOrDeleted(config, dirEntry.Name()) {
+				continue
+			}
+			// The instance may have been deleted and created anew
+			// since its metadata was read.
+			instanceData, fromBackup, err = readProfileInstance(config, dirEntry.Name())
 		}
-		instanceData, err := GetProfileInstance(config, dirEntry.Name())
 		if err != nil {
-			return nil, uerror.WithStackTrace(err)
+			warnings.Add(dirEntry.Name(), "Skipping unreadable instance: %s", uerror.Message(err))
+			cacheable = false
+			continue
+		}
+		if fromBackup {
+			warnings.Add(dirEntry.Name(), "Recovered corrupt instance metadata from its backup")
+			if err := writeProfileInstance(config, instanceData); err != nil {
+				warnings.Add(dirEntry.Name(), "Failed to restore instance metadata: %s", uerror.Message(err))
+			}
+			cacheable = false
+		}
+		if statErr != nil {
+			cacheable = false
+		} else {
+			cache.Entries = append(cache.Entries, instanceCacheEntry{
+				Instance:        instanceData,
+				MetadataModTime: metadataInfo.ModTime(),
+				MetadataSize:    metadataInfo.Size(),
+			})
 		}
 		instances = append(instances, instanceData)
 	}
+	if cacheable {
+		writeInstanceCache(config, cache)
+	}
 	return instances, nil
 }
 
-func GetProfileInstance(config Configuration, instanceLabel string) (ProfileInstance, error) {
-	instanceDataBytes, err := os.ReadFile(filepath.Join(config.ProfilePath, instanceLabel, "profile-instance.json"))
+// isInstanceBeingCreatedOrDeleted tells whether an instance directory
+// without metadata belongs to an instance that is being created, i.e.
+// it only holds the lock file and possibly the metadata that is being
+// written, or whether it has been moved away by DeleteInstance.
+func isInstanceBeingCreatedOrDeleted(config Configuration, instanceLabel string) bool {
+	dirEntries, err := os.ReadDir(filepath.Join(config.ProfilePath, instanceLabel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
 	if err != nil {
-		return ProfileInstance{}, uerror.WithStackTrace(err)
+		return false
+	}
+	hasLockFile := false
+	for _, dirEntry := range dirEntries {
+		if dirEntry.Name() == instanceLockFileName {
+			hasLockFile = true
+		} else if !strings.HasPrefix(dirEntry.Name(), ".profile-instance.json-") {
+			return false
+		}
 	}
+	return hasLockFile
+}
+
+// GetProfileInstance reads an instance's metadata. If the metadata is
+// corrupt, the backup kept by writeProfileInstance is used instead.
+func GetProfileInstance(config Configuration, instanceLabel string) (ProfileInstance, error) {
+	instance, _, err := readProfileInstance(config, instanceLabel)
+	return instance, err
+}
+
+// readProfileInstance is GetProfileInstance, but also tells whether the
+// instance was read from the backup.
+func readProfileInstance(config Configuration, instanceLabel string) (instance ProfileInstance, fromBackup bool, err error) {
+	recordDir := filepath.Join(config.ProfilePath, instanceLabel)
+	instanceDataBytes, err := uio.ReadFileLimited(filepath.Join(recordDir, "profile-instance.json"), maxInstanceDataSize)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ProfileInstance{}, false, uerror.WithStackTrace(err)
+	}
+	if err == nil {
+		instance, err = parseProfileInstance(instanceLabel, instanceDataBytes)
+		if err == nil {
+			return instance, false, nil
+		}
+	}
+
+	backupBytes, backupErr := uio.ReadFileLimited(filepath.Join(recordDir, instanceDataBackupFileName), maxInstanceDataSize)
+	if backupErr != nil {
+		return ProfileInstance{}, false, uerror.WithStackTrace(err)
+	}
+	instance, backupErr = parseProfileInstance(instanceLabel, backupBytes)
+	if backupErr != nil {
+		return ProfileInstance{}, false, uerror.WithStackTrace(err)
+	}
+	return instance, true, nil
+}
+
+// parseProfileInstance decodes an instance's metadata. Values that
+// can't be right are replaced: the directory name is authoritative for
+// the label, and PIDs that can't belong to a process are dropped.
+func parseProfileInstance(instanceLabel string, instanceDataBytes []byte) (ProfileInstance, error) {
 	var instanceData ProfileInstance
 	if err := json.Unmarshal(instanceDataBytes, &instanceData); err != nil {
 		return ProfileInstance{}, uerror.StackTracef("Failed to unmarshal data for profile in %s: %w", instanceLabel, err)
 	}
+	instanceData.InstanceLabel = instanceLabel
+	if instanceData.UsagePID != nil && *instanceData.UsagePID <= 0 {
+		instanceData.UsagePID = nil
+	}
+	if instanceData.BrowserPID != nil && *instanceData.BrowserPID <= 0 {
+		instanceData.BrowserPID = nil
+	}
+	// Older versions stored local times with their offset, so the
+	// instants are right, but they should compare and print alike.
+	instanceData.Created = instanceData.Created.UTC()
+	instanceData.LastUsed = instanceData.LastUsed.UTC()
+	instanceData.Sessions = sessionsInUTC(instanceData.Sessions)
+	if instanceData.LastUsed.IsZero() {
+		instanceData.LastUsed = instanceData.Created
+	}
 	return instanceData, nil
 }
 
-func DeleteInstance(config Configuration, instance ProfileInstance) error {
-	if instance.UsagePID != nil {
-		return fmt.Errorf("%w: %s is currently in use by PID %d (topic: %s)", ErrInstanceInUse, instance.InstanceLabel, *instance.UsagePID, *instance.UsageLabel)
+// writeProfileInstance stores an instance's metadata with RFC 3339
+// timestamps in UTC. Converting to UTC also drops the monotonic clock
+// reading, which is meaningless in other processes.
+func writeProfileInstance(config Configuration, instance ProfileInstance) error {
+	instance.Created = instance.Created.UTC()
+	instance.LastUsed = instance.LastUsed.UTC()
+	instance.Sessions = sessionsInUTC(instance.Sessions)
+	instance.SchemaVersion = profileInstanceSchemaVersion
+	instanceDataBytes, err := json.Marshal(instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
 	}
-	return os.RemoveAll(getInstanceDir(config, instance))
+	recordDir := getInstanceRecordDir(config, instance)
+	instanceDataPath := filepath.Join(recordDir, "profile-instance.json")
+
+	// The current metadata becomes the backup, unless it is corrupt
+	// and the backup is the last good version.
+	previousBytes, err := uio.ReadFileLimited(instanceDataPath, maxInstanceDataSize)
+	if err == nil {
+		if _, err := parseProfileInstance(instance.InstanceLabel, previousBytes); err == nil {
+			if err := uio.WriteFileAtomic(filepath.Join(recordDir, instanceDataBackupFileName), previousBytes, uio.FileModeURWGRWO); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+		}
+	}
+
+	if err := uio.WriteFileAtomic(instanceDataPath, instanceDataBytes, uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	invalidateInstanceCache(config)
+	return nil
 }
 
+// instanceMetadataLockFileName is locked while the metadata of an
+// instance is updated, see updateProfileInstance.
+const instanceMetadataLockFileName = "instance-metadata.lock"
+
+// updateProfileInstance re-reads the metadata of an instance, changes
+// it and writes it back while holding the metadata lock. The metadata
+// of a running instance is changed by its launch and, e.g. when it is
+// pinned, by other processes, none of which can take the instance's
+// lock, so without it concurrent updates would undo each other.
+func updateProfileInstance(config Configuration, instanceLabel string, update func(instance *ProfileInstance)) (ProfileInstance, error) {
+	unlock, err := lockStateFile(config, instanceMetadataLockFileName)
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	update(&instance)
+	if err := writeProfileInstance(config, instance); err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	return instance, nil
+}
+
+// DeleteInstance deletes an instance that isn't in use. The instance is
+// locked while it is deleted and its directory in the profile path is
+// moved to the trash in one step, so concurrent launches either see the
+// instance in use or create it anew. Unless the instance is ephemeral,
+// the deletion can be undone with UndoLastOperation.
+func DeleteInstance(config Configuration, instance ProfileInstance, mutations *Mutations) error {
+	if err := checkInstanceNotInUse(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return mutations.Apply("Delete instance", instance.InstanceLabel, func() error {
+		return deleteInstance(config, instance)
+	})
+}
+
+// PurgeInstance deletes an instance that isn't in use for good, so its
+// disk space is freed and its browsing data doesn't stay behind in the
+// trash. Unlike with DeleteInstance, the deletion can't be undone.
+func PurgeInstance(config Configuration, instance ProfileInstance, mutations *Mutations) error {
+	if err := checkInstanceNotInUse(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return mutations.Apply("Delete instance for good", instance.InstanceLabel, func() error {
+		operation, err := trashInstance(config, instance)
+		if err != nil || operation == nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := operation.removeBackup(); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		ulog.Default().Info("Deleted instance", "instance", instance.InstanceLabel)
+		return nil
+	})
+}
+
+func checkInstanceNotInUse(config Configuration, instance ProfileInstance) error {
+	inUse, err := isInstanceInUse(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if inUse {
+		return fmt.Errorf("%w: %s is currently in use", ErrInstanceInUse, instance.InstanceLabel)
+	}
+	return nil
+}
+
+func deleteInstance(config Configuration, instance ProfileInstance) error {
+	operation, err := trashInstance(config, instance)
+	if err != nil || operation == nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := recordOperation(config, *operation); err != nil {
+		operation.removeBackup()
+		return uerror.WithStackTrace(err)
+	}
+	ulog.Default().Info("Moved instance to the trash", "instance", instance.InstanceLabel, "backup", operation.Backup)
+	return nil
+}
+
+// trashInstance locks an instance and moves it to the trash. The
+// returned operation restores it, but isn't recorded yet. Ephemeral
+// instances are deleted right away and can't be restored.
+func trashInstance(config Configuration, instance ProfileInstance) (*Operation, error) {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	trashedFiles := ""
+	if instance.Directory != nil && instance.Ephemeral {
+		if err := os.RemoveAll(*instance.Directory); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	} else if instance.Directory != nil {
+		exists, err := uio.DirExists(*instance.Directory)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		// Reservations only get their directory once they are
+		// provisioned.
+		if !exists && !instance.Reserved {
+			return nil, uerror.StackTracef("%w: %s doesn't exist", ErrStorageUnavailable, *instance.Directory)
+		}
+		if exists {
+			if trashedFiles, err = trashInstanceFiles(instance); err != nil {
+				return nil, uerror.WithStackTrace(err)
+			}
+		}
+	}
+	untrashFiles := func() {
+		if trashedFiles != "" {
+			os.Rename(trashedFiles, *instance.Directory)
+			os.RemoveAll(filepath.Dir(trashedFiles))
+		}
+	}
+	trashEntry, err := newBackupDir(config, "trash", instance.InstanceLabel)
+	if err != nil {
+		untrashFiles()
+		return nil, uerror.WithStackTrace(err)
+	}
+	trashedRecordDir := filepath.Join(trashEntry, instance.InstanceLabel)
+	if err := os.Rename(getInstanceRecordDir(config, instance), trashedRecordDir); err != nil {
+		os.RemoveAll(trashEntry)
+		untrashFiles()
+		return nil, uerror.WithStackTrace(err)
+	}
+	invalidateInstanceCache(config)
+	// Ephemeral instances are meant to leave nothing behind, so they
+	// can't be restored.
+	if instance.Ephemeral {
+		return nil, os.RemoveAll(trashEntry)
+	}
+	return &Operation{
+		Backup:       trashedRecordDir,
+		Kind:         OperationDeleteInstance,
+		Target:       instance.InstanceLabel,
+		Time:         time.Now(),
+		TrashedFiles: trashedFiles,
+	}, nil
+}
+
+// trashInstanceFiles moves the files of an instance that are kept in a
+// profile's own ProfilePath into a hidden directory next to them,
+// since that is likely another file system than the state directory's.
+func trashInstanceFiles(instance ProfileInstance) (string, error) {
+	trashDir, err := os.MkdirTemp(filepath.Dir(*instance.Directory), "."+instance.InstanceLabel+"-trash-*")
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	trashedFiles := filepath.Join(trashDir, instance.InstanceLabel)
+	if err := os.Rename(*instance.Directory, trashedFiles); err != nil {
+		os.RemoveAll(trashDir)
+		return "", uerror.WithStackTrace(err)
+	}
+	return trashedFiles, nil
+}
+
+// FindProfileByLabel returns the profile with the given label. With
+// NormalizeLabels, a label that only matches after normalization is
+// accepted if no label matches exactly.
 func FindProfileByLabel(config Configuration, profileLabel string) *ProfileConfiguration {
 	for _, profile := range config.Profiles {
 		if profile.Label == profileLabel {
 			return &profile
 		}
 	}
+	if config.NormalizeLabels {
+		normalized := ustring.NormalizeLabel(profileLabel)
+		for _, profile := range config.Profiles {
+			if ustring.NormalizeLabel(profile.Label) == normalized {
+				return &profile
+			}
+		}
+	}
 	return nil
 }
 
@@ -112,46 +679,85 @@ func GetTopics(instances []ProfileInstance) []string {
 	return topics
 }
 
-func FindInstanceByTopic(instances []ProfileInstance, topic string) *ProfileInstance {
+// FindInstanceByTopic returns the instance in use for the given topic.
+// Topics are matched like profile labels in FindProfileByLabel. If no
+// instance is in use for a hierarchical topic like "work/x/review",
+// the one of its nearest ancestor, "work/x" or "work", is returned.
+func FindInstanceByTopic(config Configuration, instances []ProfileInstance, topic string) *ProfileInstance {
+	for ; topic != ""; topic = getParentTopic(topic) {
+		if instance := findInstanceByExactTopic(config, instances, topic); instance != nil {
+			return instance
+		}
+	}
+	return nil
+}
+
+func findInstanceByExactTopic(config Configuration, instances []ProfileInstance, topic string) *ProfileInstance {
 	for _, instance := range instances {
 		if instance.UsageLabel != nil && topic == *instance.UsageLabel {
 			return &instance
 		}
 	}
+	if config.NormalizeLabels {
+		normalized := ustring.NormalizeLabel(topic)
+		for _, instance := range instances {
+			if instance.UsageLabel != nil && ustring.NormalizeLabel(*instance.UsageLabel) == normalized {
+				return &instance
+			}
+		}
+	}
 	return nil
 }
 
+// GetBestInstance returns the oldest instance of the profile that is not
+// in use, or a new one if all are. Ephemeral instances are never
+// reused, and reserved ones are left to whoever reserved them. The
+// instances are expected to come from GetProfileInstances, which
+// clears the PIDs of dead instances.
 func GetBestInstance(profile ProfileConfiguration, instances []ProfileInstance) ProfileInstance {
-	maxInstanceNumberForProfile := 0
 	var oldestFreeInstance *ProfileInstance
 	for _, instance := range instances {
-		if instance.ProfileLabel != profile.Label {
+		if instance.ProfileLabel != profile.Label || instance.Ephemeral {
 			continue
 		}
-
-		profileLabelPrefix := fmt.Sprintf("%s-", instance.ProfileLabel)
-		if strings.HasPrefix(instance.InstanceLabel, profileLabelPrefix) {
-			instanceNumberInLabel, err := strconv.Atoi(strings.TrimPrefix(instance.InstanceLabel, profileLabelPrefix))
-			if err == nil && instanceNumberInLabel > maxInstanceNumberForProfile {
-				maxInstanceNumberForProfile = instanceNumberInLabel
-			}
-		}
-
-		if instance.UsagePID != nil {
+		if instance.UsagePID != nil || instance.Reserved {
 			continue
 		}
-		if oldestFreeInstance == nil || instance.Created.Before(oldestFreeInstance.Created) {
+		if oldestFreeInstance == nil || instance.Created.Before(oldestFreeInstance.Created) ||
+			(instance.Created.Equal(oldestFreeInstance.Created) && instance.InstanceLabel < oldestFreeInstance.InstanceLabel) {
 			_inst := instance // create an unchanging referece to "instance"
 			oldestFreeInstance = &_inst
 		}
 	}
 
 	if oldestFreeInstance == nil {
+		instanceLabel := getNextInstanceLabel(profile, instances)
 		return ProfileInstance{
-			InstanceLabel: fmt.Sprintf("%s-%d", profile.Label, maxInstanceNumberForProfile+1),
+			Directory:     getNewInstanceDirectory(profile, instanceLabel),
+			Encrypted:     profile.Encryption != nil,
+			InstanceLabel: instanceLabel,
 			ProfileLabel:  profile.Label,
 		}
 	} else {
 		return *oldestFreeInstance
 	}
 }
+
+// getNextInstanceLabel returns the label of the next new instance of
+// the profile, e.g. "work-3" after "work-2".
+func getNextInstanceLabel(profile ProfileConfiguration, instances []ProfileInstance) string {
+	maxInstanceNumberForProfile := 0
+	for _, instance := range instances {
+		if instance.ProfileLabel != profile.Label || instance.Ephemeral {
+			continue
+		}
+		profileLabelPrefix := fmt.Sprintf("%s-", instance.ProfileLabel)
+		if strings.HasPrefix(instance.InstanceLabel, profileLabelPrefix) {
+			instanceNumberInLabel, err := strconv.Atoi(strings.TrimPrefix(instance.InstanceLabel, profileLabelPrefix))
+			if err == nil && instanceNumberInLabel > maxInstanceNumberForProfile {
+				maxInstanceNumberForProfile = instanceNumberInLabel
+			}
+		}
+	}
+	return fmt.Sprintf("%s-%d", profile.Label, maxInstanceNumberForProfile+1)
+}
@@ -25,7 +25,7 @@ func getConfigurationFixture() internal.Configuration {
 				},
 				Label:          "test",
 				UserChromeFile: &uc,
-				UserJSFile:     &uj,
+				UserJSFiles:    []string{uj},
 			},
 		},
 	}
@@ -40,7 +40,7 @@ func getConfigurationFixtureWithMoreProfiles() internal.Configuration {
 				},
 				Label:          "test",
 				UserChromeFile: &uc,
-				UserJSFile:     &uj,
+				UserJSFiles:    []string{uj},
 			},
 			{
 				Label: "test-other",
@@ -126,14 +126,32 @@ func TestReadConfiguration(t *testing.T) {
 				expected.ProfilePath = "testdata/tbml/profiles"
 			},
 		},
+		{
+			desc: "YAML",
+
+			configFileName: "config-relative-profile-path.yaml",
+			prepareExpected: func(expected *internal.Configuration) {
+				expected.ProfilePath = "testdata/tbml/profiles"
+			},
+		},
+		{
+			desc: "TOML",
+
+			configFileName: "config-relative-profile-path.toml",
+			prepareExpected: func(expected *internal.Configuration) {
+				expected.ProfilePath = "testdata/tbml/profiles"
+			},
+		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
 			expected := getConfigurationFixture()
 			tC.prepareExpected(&expected)
 
-			config, configDir, err := internal.ReadConfiguration(filepath.Join("testdata", tC.configFileName))
+			warnings := &internal.Warnings{}
+			config, configDir, err := internal.ReadConfiguration(filepath.Join("testdata", tC.configFileName), warnings)
 			assert.NoError(t, err)
+			assert.Empty(t, warnings.List())
 			assert.Equal(t, expected, config)
 			assert.Equal(t, "testdata", configDir)
 		})
@@ -141,15 +159,65 @@ func TestReadConfiguration(t *testing.T) {
 }
 
 func TestReadConfigurationNonexistent(t *testing.T) {
-	_, _, err := internal.ReadConfiguration("testdata/config-nonexistent.json")
+	_, _, err := internal.ReadConfiguration("testdata/config-nonexistent.json", nil)
 	assert.ErrorIs(t, err, fs.ErrNotExist)
 }
 
+func TestReadConfigurationTooLarge(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "tbml-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.json")
+	assert.NoError(t, os.WriteFile(configFile, make([]byte, 2<<20), uio.FileModeURWGRWO))
+
+	_, _, err = internal.ReadConfiguration(configFile, nil)
+	assert.ErrorIs(t, err, uio.ErrFileTooLarge)
+}
+
+func TestReadConfigurationInvalid(t *testing.T) {
+	_, _, err := internal.ReadConfiguration("testdata/config-invalid-tracking.json", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unknown tracking protection level paranoid")
+}
+
+func TestReadConfigurationBrowserCommand(t *testing.T) {
+	warnings := &internal.Warnings{}
+	config, _, err := internal.ReadConfiguration("testdata/config-browser-command.yaml", warnings)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings.List())
+	assert.Equal(t, []string{"librewolf", "--no-remote"}, config.Profiles[0].BrowserCommand)
+	assert.Equal(t, []string{"--class", "work"}, config.Profiles[0].ExtraArgs)
+	assert.Equal(t, map[string]string{"MOZ_ENABLE_WAYLAND": "1"}, config.Profiles[0].Environment)
+}
+
+func TestReadConfigurationUnknownKeys(t *testing.T) {
+	warnings := &internal.Warnings{}
+	_, _, err := internal.ReadConfiguration("testdata/config-unknown-keys.yaml", warnings)
+	assert.NoError(t, err)
+
+	messages := []string{}
+	for _, warning := range warnings.List() {
+		assert.Equal(t, "testdata/config-unknown-keys.yaml", warning.Source)
+		messages = append(messages, warning.Message)
+	}
+	assert.ElementsMatch(t, []string{
+		"Unknown setting colour",
+		"Unknown setting profiles.0.storage.diskQuota",
+		"Unknown setting profiles.0.userJsFiel",
+	}, messages)
+}
+
 func TestGetProfileInstances(t *testing.T) {
-	config := getConfigurationFixture()
-	config.ProfilePath = "testdata/instances/profiles"
+	config, cleanup := setUpProfilesWithAbsolutePath(t)
+	defer cleanup()
+	// Listing instances writes the instance cache, so a relative
+	// profile path points to the copy instead of the test data.
+	workDir, err := os.Getwd()
+	assert.NoError(t, err)
+	config.ProfilePath, err = filepath.Rel(workDir, config.ProfilePath)
+	assert.NoError(t, err)
 
-	actual, err := internal.GetProfileInstances(config)
+	actual, err := internal.GetProfileInstances(config, nil)
 	assert.NoError(t, err)
 
 	expected := getProfileInstancesFixture()
@@ -160,16 +228,38 @@ func TestGetProfileInstancesAbsolute(t *testing.T) {
 	config, cleanup := setUpProfilesWithAbsolutePath(t)
 	defer cleanup()
 
-	actual, err := internal.GetProfileInstances(config)
+	actual, err := internal.GetProfileInstances(config, nil)
 	assert.NoError(t, err)
 
 	expected := getProfileInstancesFixture()
 	assert.Equal(t, expected, actual)
 }
 
+func TestGetProfileInstancesSkipsUnreadable(t *testing.T) {
+	config, cleanup := setUpProfilesWithAbsolutePath(t)
+	defer cleanup()
+
+	assert.NoError(t, os.Mkdir(filepath.Join(config.ProfilePath, "broken"), uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(filepath.Join(config.ProfilePath, "stray-file"), []byte{}, uio.FileModeURWGRWO))
+
+	warnings := &internal.Warnings{}
+	actual, err := internal.GetProfileInstances(config, warnings)
+	assert.NoError(t, err)
+	assert.Equal(t, getProfileInstancesFixture(), actual)
+
+	assert.Len(t, warnings.List(), 2)
+	assert.Equal(t, "broken", warnings.List()[0].Source)
+	assert.Contains(t, warnings.List()[0].Message, "Skipping unreadable instance")
+	assert.Equal(t, filepath.Join(config.ProfilePath, "stray-file"), warnings.List()[1].Source)
+
+	// Warnings may be discarded.
+	_, err = internal.GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+}
+
 func TestGetProfileInstance(t *testing.T) {
-	config := getConfigurationFixture()
-	config.ProfilePath = "testdata/instances/profiles"
+	config, cleanup := setUpProfilesWithAbsolutePath(t)
+	defer cleanup()
 
 	actual, err := internal.GetProfileInstance(config, "test-2")
 	assert.NoError(t, err)
@@ -195,13 +285,13 @@ func TestDeleteInstance(t *testing.T) {
 	config, cleanup := setUpProfilesWithAbsolutePath(t)
 	defer cleanup()
 
-	instancesBefore, err := internal.GetProfileInstances(config)
+	instancesBefore, err := internal.GetProfileInstances(config, nil)
 	assert.NoError(t, err)
 	assert.Len(t, instancesBefore, 2)
 
-	assert.NoError(t, internal.DeleteInstance(config, instancesBefore[0]))
+	assert.NoError(t, internal.DeleteInstance(config, instancesBefore[0], nil))
 
-	instancesAfter, err := internal.GetProfileInstances(config)
+	instancesAfter, err := internal.GetProfileInstances(config, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, instancesBefore[1:], instancesAfter)
 }
@@ -210,14 +300,14 @@ func TestDeleteInstanceInUse(t *testing.T) {
 	config, cleanup := setUpProfilesWithAbsolutePath(t)
 	defer cleanup()
 
-	instancesBefore, err := internal.GetProfileInstances(config)
+	instancesBefore, err := internal.GetProfileInstances(config, nil)
 	assert.NoError(t, err)
 	assert.Len(t, instancesBefore, 2)
 
-	err = internal.DeleteInstance(config, instancesBefore[1])
+	err = internal.DeleteInstance(config, instancesBefore[1], nil)
 	assert.ErrorIs(t, err, internal.ErrInstanceInUse)
 
-	instancesAfter, err := internal.GetProfileInstances(config)
+	instancesAfter, err := internal.GetProfileInstances(config, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, instancesBefore, instancesAfter)
 }
@@ -240,6 +330,16 @@ func TestFindProfileByLabelNonexistent(t *testing.T) {
 	assert.Nil(t, actual)
 }
 
+func TestFindProfileByLabelNormalized(t *testing.T) {
+	config := getConfigurationFixtureWithMoreProfiles()
+	assert.Nil(t, internal.FindProfileByLabel(config, "TEST"))
+
+	config.NormalizeLabels = true
+	actual := internal.FindProfileByLabel(config, "TEST")
+
+	assert.Equal(t, &config.Profiles[0], actual)
+}
+
 func TestGetProfileLabels(t *testing.T) {
 	config := getConfigurationFixtureWithMoreProfiles()
 
@@ -259,8 +359,18 @@ func TestGetTopics(t *testing.T) {
 func TestFindInstanceByTopic(t *testing.T) {
 	instances := getProfileInstancesFixture()
 
-	assert.Nil(t, internal.FindInstanceByTopic(instances, "unused-topic-label"))
-	assert.Equal(t, instances[1], *internal.FindInstanceByTopic(instances, "test-usage"))
+	config := internal.Configuration{}
+
+	assert.Nil(t, internal.FindInstanceByTopic(config, instances, "unused-topic-label"))
+	assert.Equal(t, instances[1], *internal.FindInstanceByTopic(config, instances, "test-usage"))
+	assert.Nil(t, internal.FindInstanceByTopic(config, instances, "Test-Usage"))
+
+	config.NormalizeLabels = true
+	assert.Equal(t, instances[1], *internal.FindInstanceByTopic(config, instances, "Test-Usage"))
+
+	// Subtopics fall back to the nearest ancestor's instance.
+	assert.Equal(t, instances[1], *internal.FindInstanceByTopic(config, instances, "test-usage/review/draft"))
+	assert.Nil(t, internal.FindInstanceByTopic(config, instances, "other/test-usage"))
 }
 
 func TestGetBestInstance(t *testing.T) {
@@ -290,6 +400,27 @@ func TestGetBestInstance(t *testing.T) {
 				ProfileLabel:  "test",
 			}),
 		},
+		{
+			desc: "Choose oldest instance across time zones",
+
+			expectedBestInstance: internal.ProfileInstance{
+				InstanceLabel: "oldest-instance",
+				Created:       time.Date(2021, 11, 1, 12, 0, 0, 0, time.FixedZone("CET", 1*60*60)),
+				ProfileLabel:  "test",
+			},
+			instances: []internal.ProfileInstance{
+				{
+					InstanceLabel: "newer-instance",
+					Created:       time.Date(2021, 11, 1, 11, 30, 0, 0, time.UTC),
+					ProfileLabel:  "test",
+				},
+				{
+					InstanceLabel: "oldest-instance",
+					Created:       time.Date(2021, 11, 1, 12, 0, 0, 0, time.FixedZone("CET", 1*60*60)),
+					ProfileLabel:  "test",
+				},
+			},
+		},
 		{
 			desc: "Create new instance",
 
@@ -330,3 +461,11 @@ func TestGetBestInstance(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfigurationReportsAllProblems(t *testing.T) {
+	_, _, err := internal.ReadConfiguration("testdata/config-invalid-files.json", nil)
+	assert.ErrorIs(t, err, internal.ErrInvalidConfiguration)
+	assert.Contains(t, err.Error(), "testdata/config-invalid-files.json")
+	assert.Contains(t, err.Error(), "Profiles.0.UserJSFile: testdata/missing-user.js does not exist")
+	assert.Contains(t, err.Error(), "Profiles.1.Label: Profile test is already defined in Profiles.0")
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrInvalidMaxMemoryPolicy error = errors.New("Invalid max memory policy")
+
+// MaxMemoryPolicy decides what happens when the browser of an instance
+// uses more memory than its profile's MaxMemoryMiB.
+type MaxMemoryPolicy string
+
+const (
+	// MaxMemoryNotify only notifies the user.
+	MaxMemoryNotify MaxMemoryPolicy = "notify"
+	// MaxMemoryStop notifies the user and closes the browser like the
+	// session limit does, so it can save its session.
+	MaxMemoryStop MaxMemoryPolicy = "stop"
+)
+
+// memoryWatchdogInterval is how often the memory usage is measured. It
+// is a variable so tests can shorten it.
+var memoryWatchdogInterval = 10 * time.Second
+
+func ParseMaxMemoryPolicy(s string) (MaxMemoryPolicy, error) {
+	switch policy := MaxMemoryPolicy(s); policy {
+	case MaxMemoryNotify, MaxMemoryStop:
+		return policy, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidMaxMemoryPolicy, s)
+}
+
+// getMaxMemory returns the profile's memory limit in bytes, or zero if
+// there is none, and its policy, defaulting to MaxMemoryNotify.
+func getMaxMemory(profile ProfileConfiguration) (int64, MaxMemoryPolicy, error) {
+	if profile.MaxMemoryMiB == nil {
+		return 0, "", nil
+	}
+	limit := int64(*profile.MaxMemoryMiB) << 20
+	if profile.MaxMemoryPolicy == nil {
+		return limit, MaxMemoryNotify, nil
+	}
+	policy, err := ParseMaxMemoryPolicy(*profile.MaxMemoryPolicy)
+	return limit, policy, err
+}
+
+// superviseMemory measures the memory usage of the browser with the
+// given PID and its child processes, like status does, every
+// memoryWatchdogInterval. Once it exceeds limit, the user is notified,
+// and with MaxMemoryStop the browser is closed. Notifications are only
+// repeated after the usage dropped below the limit again. A limit of
+// zero doesn't supervise anything. The instance is called name in the
+// notifications, which show icon. The returned function stops the
+// supervision.
+func superviseMemory(ctx context.Context, pid int, profileDir string, limit int64, policy MaxMemoryPolicy, name string, icon string) (stop func()) {
+	if limit <= 0 {
+		return func() {}
+	}
+	logger := ulog.FromContext(ctx)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(memoryWatchdogInterval)
+		defer ticker.Stop()
+		exceeded := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			usage, err := getProcessTreeUsage("/proc", pid)
+			if err != nil {
+				logger.Debug("Failed to measure the browser's memory usage", "error", uerror.Message(err))
+				continue
+			}
+			if usage.memory <= limit {
+				exceeded = false
+				continue
+			}
+			if exceeded {
+				continue
+			}
+			exceeded = true
+
+			logger.Warn("Memory limit exceeded", "usage", usage.memory, "limit", limit, "policy", string(policy))
+			msgs := newNotificationPrinter()
+			summary := msgs.Sprintf("%s uses %s of memory", name, uio.FormatByteSize(usage.memory))
+			body := msgs.Sprintf("The limit is %s.", uio.FormatByteSize(limit))
+			if policy == MaxMemoryStop {
+				body += " " + msgs.Sprintf("The browser will be closed.")
+			}
+			if err := sendNotification(summary, body, icon); err != nil {
+				logger.Warn("Failed to send a notification", "error", uerror.Message(err))
+			}
+			if policy == MaxMemoryStop {
+				stopBrowser(ctx, pid, profileDir, done)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
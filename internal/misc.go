@@ -8,27 +8,543 @@ import (
 const genericErrorExitCode = 1
 
 type Configuration struct {
+	// Aliases maps alias names to the command lines they expand to,
+	// e.g. "work": "open --profile work --topic daily {1}".
+	Aliases map[string]string
+	// ArchiveAfterDays archives instances that weren't used for this
+	// many days, see ArchiveInstance, unless their profile sets
+	// NoAutoArchive. It is checked once a day when a tab is opened and
+	// by "tbml maintain".
+	ArchiveAfterDays *int
+	// CloneStrategy is how files are put into instances: "auto" (the
+	// default) hard-links files that are never changed, like
+	// extensions, and clones others copy-on-write if the instance's
+	// file system supports it, otherwise copies them;
+	// "hardlink" only does the former, "reflink" only the latter and
+	// "copy" neither.
+	CloneStrategy string
+	// EphemeralPath is where the files of ephemeral instances are
+	// created. It defaults to $XDG_RUNTIME_DIR, which usually is a
+	// tmpfs, or the system's temporary directory.
+	EphemeralPath string
+	// ExtensionCacheMaxMiB limits the size of the cache of downloaded
+	// Extensions. When downloading an extension makes the cache
+	// larger, the least recently used extensions that no profile
+	// refers to anymore are deleted.
+	ExtensionCacheMaxMiB *int
+	// Hooks are run for every profile, before the profile's own hooks.
+	Hooks *HooksConfiguration
+	// Include lists glob patterns of further configuration files, e.g.
+	// "profiles.d/*.yaml", relative to the directory of this file.
+	// Their profiles, routes and aliases are added to this file's;
+	// other settings may only be set by one of the files. Relative
+	// paths in included files are resolved against this file's
+	// directory, too.
+	Include []string
+	// KnownSSIDs are glob patterns of the Wi-Fi networks the user
+	// trusts, e.g. the one at home. Other networks count as unknown
+	// for NetworkConditions with UnknownWiFi.
+	KnownSSIDs []string
+	// Log configures what tbml logs about launches and instance
+	// management.
+	Log *LogConfiguration
+	// NormalizeLabels makes profile labels and topics given on the
+	// command line match regardless of case and of how accented
+	// letters are encoded, e.g. by hotkey tools or voice input.
+	NormalizeLabels bool
+	// Prefs are written to the user.js of every instance after the
+	// UserJSFiles, e.g. "browser.startup.page": 3. Profiles and topics
+	// can override them.
+	Prefs       map[string]interface{}
 	ProfilePath string
 	Profiles    []ProfileConfiguration
+	// PruneWhere is a filter expression, see ParseFilter, of instances
+	// to delete, e.g. `age > 90d && !pinned`. Instances that are in use
+	// or pinned are kept regardless. It is applied by "tbml clean" and
+	// once a day along with ArchiveAfterDays.
+	PruneWhere *string
+	// QuietHours are times during which profiles refuse to launch.
+	QuietHours []QuietHoursConfiguration
+	// ReadOnlyManagement disables everything that changes the
+	// instances or the configuration, like deleting, cleaning up or
+	// renaming instances and adding profiles, for kiosks where users
+	// may only launch the browser. See Mutations.ReadOnly.
+	ReadOnlyManagement bool
+	// Routes pick the profile and topic for URLs that are opened
+	// without either. The first matching route is used.
+	Routes []RouteConfiguration
+	// SensitiveTopics are glob patterns like "health/*" of topics that
+	// are masked in the log, error messages and debug bundles, along
+	// with the user's name and URLs. Subtopics of matching topics are
+	// masked, too. The --no-redact flag turns this off.
+	SensitiveTopics []string
+	// Timeouts limit how long tbml waits for external operations.
+	Timeouts *TimeoutsConfiguration
+	// Topics hold settings for the instances used for a topic.
+	Topics []TopicConfiguration
+	// UserJSFiles are written to the user.js of every instance, before
+	// those of the instance's profile.
+	UserJSFiles []string
+}
+
+// TopicConfiguration holds settings for the instances used for a
+// topic. They also apply to the topic's subtopics, e.g. those of
+// "work" to "work/review", and override those of the profile.
+type TopicConfiguration struct {
+	// Icon is an image file shown for the topic's desktop entry and in
+	// notifications about its instances instead of the profile's.
+	Icon  *string
+	Prefs map[string]interface{}
+	// SessionLimitMinutes closes the browser of the topic's instance
+	// after this many minutes, unless a limit is given at launch.
+	SessionLimitMinutes *int
+	Topic               string
+	UserJSFiles         []string
+}
+
+type LogConfiguration struct {
+	// Format is "text" (the default) or "json".
+	Format *string
+	// InstanceLog makes every launch log everything, including debug
+	// entries, to tbml.log in the instance's directory.
+	InstanceLog *bool
+	// Level is "debug", "info", "warn" (the default) or "error".
+	Level *string
+}
+
+// TimeoutsConfiguration limits how long tbml waits for things outside
+// of its control, so a hung hook or server can't block a launch
+// forever. All timeouts are in seconds and must be positive.
+type TimeoutsConfiguration struct {
+	// BrowserStartupSeconds is how long opening a tab in an instance
+	// that was just launched waits for its browser to start listening.
+	// It defaults to 30.
+	BrowserStartupSeconds *int
+	// DownloadSeconds limits each download of an extension or profile
+	// bundle. It defaults to 300.
+	DownloadSeconds *int
+	// HookSeconds limits each hook. It defaults to 60.
+	HookSeconds *int
+}
+
+// QuietHoursConfiguration keeps profiles from being launched during a
+// time of day, e.g. from "22:00" to "07:00". If To is before From, the
+// quiet hours end on the next day.
+type QuietHoursConfiguration struct {
+	// Days are the weekdays the quiet hours start on: "mon", "tue",
+	// "wed", "thu", "fri", "sat" or "sun". They apply every day if
+	// there are none.
+	Days     []string
+	From     string
+	Profiles []string
+	To       string
+}
+
+// RouteConfiguration sends URLs matching a pattern to a profile, or
+// refuses to open them. Exactly one of Host and Regex must be set.
+type RouteConfiguration struct {
+	// Action is "open" (the default), which opens the URL in the
+	// Profile, or "deny", which refuses to open it at all.
+	Action *string
+	// Days, From and To restrict the route to a time of day like
+	// QuietHours do, e.g. from "21:00" to "18:00" for a route that
+	// denies a URL outside of 18:00 to 21:00.
+	Days []string
+	From *string
+	// Host is a glob like "*.example.com" matched against the URL's
+	// host name, ignoring case. "*" matches any number of characters,
+	// including dots.
+	Host *string
+	// List is a list of domains, e.g. a hosts file or a uBlock-style
+	// filter list, that the URL's host or one of the domains it is in
+	// must be on. It is a local file or an HTTPS URL, which is
+	// downloaded again every ListRefreshHours, by default 24.
+	List             *string
+	ListRefreshHours *int
+	// Message is shown when the route denies a URL, e.g. "Social
+	// media is only available after homework".
+	Message *string
+	// Network, if set, restricts the route to a network, e.g. to open
+	// intranet URLs in a profile that is only launched on the
+	// corporate network.
+	Network *NetworkCondition
+	// Priority orders the routes, highest first. Routes with the same
+	// priority, by default 0, are tried in the order they are listed.
+	Priority *int
+	Profile  string
+	// Regex must match the whole URL, e.g.
+	// `https://news\.example\.org/.*`.
+	Regex *string
+	// Rewrite, if set, replaces the URL, with $1 and so on standing
+	// for the groups of the Regex, e.g. to open old.example.com
+	// instead of www.example.com.
+	Rewrite *string
+	To      *string
+	// Topic, if set, is opened instead of asking for one.
+	Topic *string
 }
 
 type ProfileConfiguration struct {
+	// BrowserCommand is the command line run in the sandbox to start
+	// the browser. It defaults to torbrowser-launcher.
+	BrowserCommand []string
+	// CrashScreenshot takes a screenshot with grim or scrot when the
+	// browser crashes and adds it to the instance's crash bundle.
+	CrashScreenshot *bool
+	// DefaultTopic is opened when the profile is given without a
+	// topic, so the profile always opens the same session.
+	DefaultTopic *string
+	// Description tells what the profile is for, e.g. in the comment
+	// of its desktop entry and in "tbml pick".
+	Description *string
+	// DisplayName is shown for the profile in pickers, desktop
+	// entries, notifications and "tbml status" instead of the label,
+	// unless Names has a name for the user's language.
+	DisplayName *string
+	DoH         *DoHConfiguration
+	// DownloadDir is where the browser saves downloads. "{profile}"
+	// and "{topic}" are replaced with the profile's label and the
+	// instance's topic, and a leading "~/" with the home directory,
+	// e.g. "~/Downloads/{profile}/{topic}". The directory is created
+	// at launch. Sandboxes only see ~/Downloads, so it should be
+	// inside of that.
+	DownloadDir *string
+	// Encryption keeps the files of the profile's new instances in an
+	// encrypted container that is only mounted while they are used.
+	// Existing instances stay unencrypted.
+	Encryption *EncryptionConfiguration
+	// Environment holds additional environment variables for the
+	// browser.
+	Environment    map[string]string
 	ExtensionFiles []string
-	Label          string
+	// ExtensionPolicy restricts which extensions the profile's
+	// instances may have, including those the user installs.
+	ExtensionPolicy *ExtensionPolicyConfiguration
+	// Extensions are downloaded into a cache shared by all instances
+	// instead of being kept next to the configuration.
+	Extensions []ExtensionSource
+	// Extends is the label of a profile to inherit unset settings
+	// from.
+	Extends *string
+	// ExtraArgs are appended to the BrowserCommand, e.g. to set the
+	// window class with --class.
+	ExtraArgs         []string
+	FingerprintPreset *string
+	Hooks             *HooksConfiguration
+	// Icon is an image file shown for the profile's desktop entry and
+	// in notifications. A bundled icon is used without one.
+	Icon *string
+	// InstanceLimitPolicy is what happens when all MaxInstances are in
+	// use: "wait" (the default) for one to become free, "fail", or
+	// "evict", which also trashes the least recently used free
+	// instances while there are more than MaxInstances.
+	InstanceLimitPolicy *string
+	Label               string
+	// LaunchCooldownSeconds is how long after launching an instance
+	// of the profile further launches open their URL in that instance
+	// instead, so a bouncing hotkey doesn't start several browsers.
+	LaunchCooldownSeconds *int
+	// MaxInstances limits how many instances of the profile are
+	// created. Ephemeral instances don't count.
+	MaxInstances *int
+	// MaxMemoryMiB caps the memory used by the browser of each of the
+	// profile's instances, measured like in "tbml status" while tbml
+	// waits for the browser to exit. MaxMemoryPolicy is what happens
+	// when it is exceeded: "notify" (the default) the user, or "stop"
+	// the browser gracefully, so it can save its session.
+	MaxMemoryMiB    *int
+	MaxMemoryPolicy *string
+	// Names are what the profile is called in desktop entries and
+	// notifications by language code, e.g. {"de": "Banking
+	// (isoliert)"}, so launchers don't show the label, which is used
+	// in paths and on the command line. "en" is also used for
+	// languages without a name, before the DisplayName.
+	Names map[string]string
+	// NativeMessagingHosts are manifest files of native messaging
+	// hosts, like KeePassXC's, which are installed into the instances
+	// so extensions can talk to the hosts. The hosts' programs have to
+	// be visible in the sandbox.
+	NativeMessagingHosts []string
+	// Network, if set, is the only network the profile's instances
+	// are launched on, e.g. a profile for the intranet that must not
+	// be used elsewhere. The profile isn't offered in the profile
+	// picker on other networks.
+	Network *NetworkCondition
+	// NoAutoArchive keeps the profile's instances from being archived
+	// when they weren't used for ArchiveAfterDays.
+	NoAutoArchive *bool
+	// NoPasswordManager disables saving passwords in the profile's
+	// instances. "tbml verify" and launches report instances that
+	// store credentials anyway.
+	NoPasswordManager *bool
+	// PreferredNetwork lists the profile first in the profile picker
+	// on a network, e.g. a "travel" profile on unknown Wi-Fi networks.
+	PreferredNetwork *NetworkCondition
+	// PreflightChecks must all pass before one of the profile's
+	// instances is launched, e.g. to make sure the VPN is connected.
+	// Unlike PreLaunch hooks, a failing check tells what is wrong.
+	PreflightChecks []PreflightCheck
+	// Prefs are written to the user.js after the UserJSFiles. Settings
+	// like FingerprintPreset still take precedence.
+	Prefs map[string]interface{}
+	// ProfilePath, if set, is where the files of the profile's new
+	// instances are kept instead of the global ProfilePath, e.g. on a
+	// fast disk for daily profiles and on a large one for rarely used
+	// ones. Their metadata and locks stay in the global ProfilePath.
+	// "tbml migrate-storage" moves existing instances.
+	ProfilePath *string
+	// ResetOnExit restores the instances of the profile to the state
+	// they were provisioned in whenever the browser exits, e.g. for
+	// kiosks. Unlike ephemeral instances, they keep their label and
+	// history, and are restored from a template instead of being
+	// provisioned again.
+	ResetOnExit *bool
+	Sandbox     *SandboxConfiguration
+	// Sensitive marks profiles, e.g. for banking, whose sessions must
+	// not be handed to other programs. Their cookies can't be
+	// exported.
+	Sensitive *bool
+	Storage   *StorageConfiguration
+	// Template is a directory with the files of a browser profile that
+	// new instances start out with, e.g. a golden profile on a
+	// read-only network share. Its SHA256SUMS file, as written by
+	// sha256sum, lists the files to use. They are checked against it
+	// and kept in a local cache, so launches only read the SHA256SUMS
+	// and still work while the share is offline. When the template
+	// changes, instances only get the files and prefs that changed,
+	// unless they were changed in the instance, too.
+	Template       *string
+	Tracking       *TrackingConfiguration
 	UserChromeFile *string
-	UserJSFile     *string
+	// UserJSFile is written to the user.js before the UserJSFiles.
+	//
+	// Deprecated: Use UserJSFiles; "tbml config migrate" moves it
+	// there.
+	UserJSFile  *string
+	UserJSFiles []string
+}
+
+// DoHConfiguration configures DNS-over-HTTPS (Firefox calls this
+// "Trusted Recursive Resolver") for a profile.
+type DoHConfiguration struct {
+	// Bootstrap is the IP address used to resolve the resolver's
+	// host name without falling back to regular DNS.
+	Bootstrap *string
+	// Mode is one of "off", "first" (fall back to regular DNS) or
+	// "only".
+	Mode        string
+	ResolverURL string
+}
+
+// EncryptionConfiguration selects how instances are encrypted at rest.
+type EncryptionConfiguration struct {
+	// PasswordCommand prints the container's password, e.g.
+	// ["pass", "show", "tbml"]. Without it, the password is asked for
+	// in the terminal.
+	PasswordCommand []string
+	// Type is "gocryptfs", the only and default type.
+	Type string
+}
+
+// ExtensionSource is an extension that tbml downloads and checks
+// against a pinned checksum. Exactly one of AMO and URL must be set.
+type ExtensionSource struct {
+	// AMO is the slug of an extension on addons.mozilla.org, e.g.
+	// "ublock-origin". The latest version is downloaded, so SHA256 has
+	// to be updated along with the extension.
+	AMO *string
+	// ID is the extension's ID from its manifest, e.g.
+	// "uBlock0@raymondhill.net". Firefox only loads the extension if
+	// the file in the profile is named after it.
+	ID string
+	// SHA256 is the hex-encoded SHA-256 sum of the XPI file.
+	SHA256 string
+	// URL is an HTTPS URL of the XPI file.
+	URL *string
+}
+
+// ExtensionPolicyConfiguration lists the extension IDs a profile's
+// instances may and may not have. Entries are patterns like
+// "*@mozilla.org", matched like in SensitiveTopics. The profile's own
+// extensions must be allowed, too, or provisioning fails. Extensions
+// installed by the user are left alone, but "tbml verify" reports
+// those that aren't allowed.
+type ExtensionPolicyConfiguration struct {
+	// Allowed are the only extensions that are allowed, unless it is
+	// empty.
+	Allowed []string
+	// Denied extensions aren't allowed, even if they are in Allowed.
+	Denied []string
+}
+
+// HooksConfiguration lists shell commands run around a launch. They
+// are run with sh -c outside of the sandbox, with the TBML_*
+// environment variables described in getHookEnvironment.
+type HooksConfiguration struct {
+	// PostExit hooks run after the browser exited, even if it crashed
+	// or the launch failed after a pre-launch hook ran, e.g. because a
+	// later one failed.
+	PostExit []string
+	// PostLaunch hooks run once the browser was started. Failures are
+	// reported as warnings.
+	PostLaunch []string
+	// PreLaunch hooks run before the browser is started. If one of
+	// them fails, the browser isn't launched.
+	PreLaunch []string
+}
+
+// NetworkCondition describes a network the machine can be on, as
+// detected by DetectNetworkEnvironment. All settings that are set must
+// match and at least one must be set.
+type NetworkCondition struct {
+	// DNSSuffix is a search domain the resolver must have, e.g.
+	// "corp.example.com", which DHCP usually sets on corporate
+	// networks.
+	DNSSuffix *string
+	// SSIDs are glob patterns of Wi-Fi networks, one of which the
+	// machine must be on.
+	SSIDs []string
+	// UnknownWiFi requires a Wi-Fi network that doesn't match the
+	// KnownSSIDs of the configuration.
+	UnknownWiFi *bool
+	// VPN requires a VPN to be connected if true, or no VPN if false.
+	// VPNs are detected by their network interfaces, e.g. "tun0" or
+	// "wg0".
+	VPN *bool
+}
+
+// PreflightCheck is a condition that must hold for a launch. Exactly
+// one of the fields must be set.
+type PreflightCheck struct {
+	// FreeDiskMiB is how much space must be free in the profile path.
+	FreeDiskMiB *int
+	// Interface is the name of a network interface that must be up and
+	// have an address, e.g. "wg0" for a WireGuard VPN.
+	Interface *string
+	// Reachable is an HTTP(S) URL that must answer, e.g. an intranet
+	// page that can only be reached through the VPN. Any status
+	// counts.
+	Reachable *string
+	// TorSOCKS is the address of a Tor SOCKS port that must accept
+	// connections, e.g. "127.0.0.1:9050".
+	TorSOCKS *string
+}
+
+// SandboxConfiguration selects the sandbox the browser is launched in.
+type SandboxConfiguration struct {
+	// Image is the container image the browser runs in, for the
+	// "podman" and "docker" types. It must contain the browser
+	// command.
+	Image string
+	// Optional allows launching the browser without a sandbox if the
+	// sandbox's program isn't installed.
+	Optional bool
+	// Type is "firejail" (the default), "bubblewrap", "podman" or
+	// "docker".
+	Type string
+}
+
+// StorageConfiguration limits how much disk space an instance's
+// caches and site data may take up.
+type StorageConfiguration struct {
+	CacheCapacityKiB *int
+	// StorageQuotaKiB limits site data like IndexedDB and the Cache
+	// API across all sites.
+	StorageQuotaKiB *int
+}
+
+// TrackingConfiguration configures cookie handling and Firefox's
+// Enhanced Tracking Protection for a profile.
+type TrackingConfiguration struct {
+	BlockThirdPartyCookies *bool
+	// CookieLifetime is either "persistent" or "session".
+	CookieLifetime *string
+	// Protection is either "standard" or "strict".
+	Protection *string
 }
 
 type ProfileInstance struct {
-	Created             time.Time
+	// Archived instances keep their files compressed in an archive in
+	// their directory in the profile path until they are launched
+	// again, see ArchiveInstance.
+	Archived bool
+	// Attached instances are used by a browser started outside of
+	// tbml, see AttachInstance.
+	Attached bool
+	// BrowserPID is the process of the browser while tbml runs it, so
+	// StopInstance can close it from another process. Attached
+	// instances don't have one, since their UsagePID is the browser.
+	BrowserPID *int
+	// ControlPort and SOCKSPort are the Tor ports allocated to the
+	// instance while it is running.
+	ControlPort *int
+	// CrashBundle is the directory holding the exit code, crash
+	// reports and screenshot of the browser's latest crash.
+	CrashBundle *string
+	// Created and LastUsed are stored in UTC.
+	Created time.Time
+	// Directory, if set, is where the instance's files live instead of
+	// the instance's directory in the profile path.
+	Directory *string
+	// Encrypted instances keep their files in an encrypted container
+	// in their directory in the profile path, which is mounted at the
+	// instance directory only while the instance is used.
+	Encrypted bool
+	// Ephemeral instances are deleted instead of being reused once
+	// they are found not to be running anymore.
+	Ephemeral           bool
 	InstalledExtensions []string
-	InstanceLabel       string
-	LastUsed            time.Time
-	ProfileLabel        string
-	UsageLabel          *string
-	UsagePID            *int
+	// InstalledNativeMessagingHosts are the names of the hosts whose
+	// manifests were installed from the profile's NativeMessagingHosts.
+	InstalledNativeMessagingHosts []string
+	InstanceLabel                 string
+	LastUsed                      time.Time
+	// Pinned instances are kept by CleanInstances and aren't evicted
+	// when their profile reaches its MaxInstances, see PinInstance.
+	Pinned       bool
+	ProfileLabel string
+	// ProvisionedHash identifies the profile settings and files the
+	// instance was last synced with, see getProvisioningHash.
+	ProvisionedHash string
+	// Reserved instances only hold a label taken by
+	// ReserveInstanceLabel. They become real instances once they are
+	// provisioned with that label and aren't reused before.
+	Reserved  bool
+	SOCKSPort *int
+	// SchemaVersion is the version of the metadata format the instance
+	// was last written with. Metadata without it comes from older
+	// versions of tbml, which stored timestamps in local time.
+	SchemaVersion int
+	// Sessions are the latest times the browser ran, oldest first,
+	// see GetUsageTime.
+	Sessions []UsageSession
+	// TemplateVersions are the versions of the profile's Template that
+	// were applied to the instance, oldest first.
+	TemplateVersions []AppliedTemplateVersion `json:",omitempty"`
+	UsageLabel       *string
+	UsagePID         *int
 }
 
+// GetInstanceDir returns the directory holding the instance's files,
+// i.e. the browser profile.
+func GetInstanceDir(config Configuration, instance ProfileInstance) string {
+	return getInstanceDir(config, instance)
+}
+
+// getInstanceDir returns the directory holding the instance's files.
 func getInstanceDir(config Configuration, instance ProfileInstance) string {
+	if instance.Directory != nil {
+		return *instance.Directory
+	}
+	if instance.Encrypted {
+		return filepath.Join(getInstanceRecordDir(config, instance), encryptedInstanceMountDirName)
+	}
+	return getInstanceRecordDir(config, instance)
+}
+
+// getInstanceRecordDir returns the instance's directory in the profile
+// path, which holds its metadata and lock. Unless the instance has its
+// own Directory, its files live there too.
+func getInstanceRecordDir(config Configuration, instance ProfileInstance) string {
 	return filepath.Join(config.ProfilePath, instance.InstanceLabel)
 }
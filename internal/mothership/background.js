@@ -45,6 +45,11 @@ port.onMessage.addListener(async msg => {
 						url,
 					},
 				})
+				break
+			case "close-tab":
+				const tabs = await browser.tabs.query({})
+				await browser.tabs.remove(tabs.filter(tab => tab.url === msg.data.url).map(tab => tab.id))
+				break
 		}
 	}
 })
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrReadOnlyManagement error = errors.New("Management is disabled")
+
+// Mutation describes a change to the instances, the profile path or
+// the configuration, like deleting an instance.
+type Mutation struct {
+	// Action says what is done, e.g. "Delete instance".
+	Action string
+	// Target names what the action is done to, e.g. an instance label
+	// or a file.
+	Target string
+}
+
+func (m Mutation) String() string {
+	return fmt.Sprintf("%s %s", m.Action, m.Target)
+}
+
+// Mutations records the mutations of one or more operations and, in
+// dry-run mode, keeps them from being performed. Functions accepting a
+// *Mutations also accept nil, in which case every mutation is
+// performed without being recorded.
+type Mutations struct {
+	// DryRun makes Apply only record mutations.
+	DryRun bool
+	// ReadOnly makes Apply fail with ErrReadOnlyManagement instead,
+	// see Configuration.ReadOnlyManagement. Cleaning up after a
+	// launch, like wiping an ephemeral instance, is no management and
+	// passes nil.
+	ReadOnly bool
+	// OnMutation, if set, is called for every mutation before it is
+	// performed.
+	OnMutation func(Mutation)
+
+	list []Mutation
+}
+
+// Apply records a mutation and performs it unless in dry-run mode.
+// Checks that could make the mutation fail should be done before, so
+// dry runs report them as well.
+func (m *Mutations) Apply(action string, target string, perform func() error) error {
+	if m == nil {
+		return perform()
+	}
+	if m.ReadOnly {
+		return uerror.StackTracef("%w: %s %s", ErrReadOnlyManagement, action, target)
+	}
+	mutation := Mutation{
+		Action: action,
+		Target: target,
+	}
+	m.list = append(m.list, mutation)
+	if m.OnMutation != nil {
+		m.OnMutation(mutation)
+	}
+	if m.DryRun {
+		return nil
+	}
+	return perform()
+}
+
+func (m *Mutations) List() []Mutation {
+	if m == nil {
+		return nil
+	}
+	return m.list
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutationsApply(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectPerformed bool
+		expectRecorded  bool
+		mutations       *Mutations
+	}{
+		{
+			desc: "Nil",
+
+			expectPerformed: true,
+		},
+		{
+			desc: "Recording",
+
+			expectPerformed: true,
+			expectRecorded:  true,
+			mutations:       &Mutations{},
+		},
+		{
+			desc: "Dry run",
+
+			expectRecorded: true,
+			mutations:      &Mutations{DryRun: true},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			performed := false
+			assert.NoError(t, tC.mutations.Apply("Delete instance", "test-1", func() error {
+				performed = true
+				return nil
+			}))
+			assert.Equal(t, tC.expectPerformed, performed)
+			if tC.expectRecorded {
+				assert.Equal(t, []Mutation{{Action: "Delete instance", Target: "test-1"}}, tC.mutations.List())
+			} else {
+				assert.Empty(t, tC.mutations.List())
+			}
+		})
+	}
+}
+
+func TestDeleteInstanceDryRun(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instance.UsageLabel = nil
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	mutations := &Mutations{DryRun: true}
+	assert.NoError(t, DeleteInstance(config, instance, mutations))
+	assert.Len(t, mutations.List(), 1)
+	assert.DirExists(t, instanceDir)
+}
+
+func TestDeleteInstanceReadOnly(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instance.UsageLabel = nil
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	for _, mutations := range []*Mutations{{ReadOnly: true}, {DryRun: true, ReadOnly: true}} {
+		err := DeleteInstance(config, instance, mutations)
+		assert.ErrorIs(t, err, ErrReadOnlyManagement)
+		assert.Empty(t, mutations.List())
+		assert.DirExists(t, instanceDir)
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+var ErrInvalidNativeMessagingHost error = errors.New("Invalid native messaging host manifest")
+
+// relativeNativeMessagingHostsPath is where Tor Browser looks for the
+// manifests of native messaging hosts, relative to the instance
+// directory.
+const relativeNativeMessagingHostsPath = ".local/share/torbrowser/tbb/x86_64/tor-browser_en-US/Browser/TorBrowser/Data/Browser/.mozilla/native-messaging-hosts"
+
+// maxNativeMessagingHostManifestSize limits how much of a manifest is
+// read. Real manifests are a few hundred bytes.
+const maxNativeMessagingHostManifestSize = 64 * 1024
+
+// nativeMessagingHostNamePattern is what Firefox accepts as the name
+// of a native messaging host.
+var nativeMessagingHostNamePattern = regexp.MustCompile(`^\w+(\.\w+)*$`)
+
+// readNativeMessagingHostName returns the name of the host a manifest
+// describes. Firefox only finds the manifest if its file is named
+// after the host.
+func readNativeMessagingHostName(manifestFile string) (string, error) {
+	// The errors have no stack traces since they end up in validation
+	// messages.
+	manifestBytes, err := uio.ReadFileLimited(manifestFile, maxNativeMessagingHostManifestSize)
+	if err != nil {
+		return "", err
+	}
+	manifest := struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", fmt.Errorf("%w: %s: %s", ErrInvalidNativeMessagingHost, manifestFile, err)
+	}
+	if !nativeMessagingHostNamePattern.MatchString(manifest.Name) {
+		return "", fmt.Errorf("%w: %s: invalid name %q", ErrInvalidNativeMessagingHost, manifestFile, manifest.Name)
+	}
+	if manifest.Name == mothershipNativeConnectorName {
+		return "", fmt.Errorf("%w: %s: %s is reserved for tbml", ErrInvalidNativeMessagingHost, manifestFile, manifest.Name)
+	}
+	return manifest.Name, nil
+}
+
+// ensureNativeMessagingHosts installs the manifests of the profile's
+// native messaging hosts into the instance and removes those of hosts
+// the profile doesn't list anymore, like ensureExtensions.
+func ensureNativeMessagingHosts(config Configuration, profile ProfileConfiguration, instanceLabel, configDir, instanceDir string) error {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	wantedHosts := make(map[string]bool)
+	manifestPathByName := make(map[string]string)
+	for _, name := range instance.InstalledNativeMessagingHosts {
+		wantedHosts[name] = false
+	}
+	for _, manifestPath := range profile.NativeMessagingHosts {
+		if !filepath.IsAbs(manifestPath) {
+			manifestPath = filepath.Join(configDir, manifestPath)
+		}
+		name, err := readNativeMessagingHostName(manifestPath)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		wantedHosts[name] = true
+		manifestPathByName[name] = manifestPath
+	}
+	for name, wanted := range wantedHosts {
+		manifestPathInInstance := filepath.Join(instanceDir, relativeNativeMessagingHostsPath, name+".json")
+		if wanted {
+			if err := cloneIntoInstance(config, manifestPathInInstance, manifestPathByName[name], true); err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			instance.InstalledNativeMessagingHosts = includeExtension(instance.InstalledNativeMessagingHosts, name)
+		} else {
+			if err := os.Remove(manifestPathInInstance); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return uerror.StackTracef("Couldn't delete native messaging host %s: %w", name, err)
+			}
+			instance.InstalledNativeMessagingHosts = excludeExtension(instance.InstalledNativeMessagingHosts, name)
+		}
+	}
+
+	if err := writeProfileInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestReadNativeMessagingHostName(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		manifest     string
+		expectedName string
+		expectError  bool
+	}{
+		{
+			desc: "valid manifest",
+
+			manifest:     `{"name": "org.keepassxc.keepassxc_browser", "type": "stdio"}`,
+			expectedName: "org.keepassxc.keepassxc_browser",
+		},
+		{
+			desc: "no name",
+
+			manifest:    `{"type": "stdio"}`,
+			expectError: true,
+		},
+		{
+			desc: "name with a slash",
+
+			manifest:    `{"name": "../evil"}`,
+			expectError: true,
+		},
+		{
+			desc: "reserved name",
+
+			manifest:    `{"name": "mothership_native_connector"}`,
+			expectError: true,
+		},
+		{
+			desc: "not JSON",
+
+			manifest:    "name = foo",
+			expectError: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			manifestFile := filepath.Join(t.TempDir(), "host.json")
+			assert.NoError(t, os.WriteFile(manifestFile, []byte(tC.manifest), uio.FileModeURWGRWO))
+			name, err := readNativeMessagingHostName(manifestFile)
+			if tC.expectError {
+				assert.ErrorIs(t, err, ErrInvalidNativeMessagingHost)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedName, name)
+		})
+	}
+}
+
+func TestEnsureNativeMessagingHosts(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	configDir := t.TempDir()
+	for _, name := range []string{"org.example.a", "org.example.b"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(configDir, name+".json"), []byte(`{"name": "`+name+`"}`), uio.FileModeURWGRWO))
+	}
+	hostsDir := filepath.Join(instanceDir, relativeNativeMessagingHostsPath)
+	assert.NoError(t, ensureMothershipExtension(instanceDir))
+
+	profile.NativeMessagingHosts = []string{"org.example.a.json", "org.example.b.json"}
+	assert.NoError(t, ensureNativeMessagingHosts(config, profile, instance.InstanceLabel, configDir, instanceDir))
+	assert.FileExists(t, filepath.Join(hostsDir, "org.example.a.json"))
+	assert.FileExists(t, filepath.Join(hostsDir, "org.example.b.json"))
+
+	// Hosts dropped from the profile are removed, but not the
+	// Mothership's.
+	profile.NativeMessagingHosts = []string{"org.example.b.json"}
+	assert.NoError(t, ensureNativeMessagingHosts(config, profile, instance.InstanceLabel, configDir, instanceDir))
+	assert.NoFileExists(t, filepath.Join(hostsDir, "org.example.a.json"))
+	assert.FileExists(t, filepath.Join(hostsDir, "org.example.b.json"))
+	assert.FileExists(t, filepath.Join(hostsDir, mothershipNativeConnectorName+".json"))
+	instanceAfter, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"org.example.b"}, instanceAfter.InstalledNativeMessagingHosts)
+}
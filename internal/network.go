@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrWrongNetwork error = errors.New("The profile can't be launched on this network")
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	// ssidCommandTimeout limits each of the programs asked for the
+	// Wi-Fi network, so a hung NetworkManager doesn't block a launch.
+	ssidCommandTimeout = 2 * time.Second
+)
+
+// vpnInterfacePrefixes are the name prefixes of the network interfaces
+// that VPN clients create: OpenVPN's tun and tap devices, WireGuard,
+// PPP (e.g. for L2TP) and IPsec.
+var vpnInterfacePrefixes = []string{"tun", "tap", "wg", "ppp", "ipsec"}
+
+// NetworkEnvironment is what tbml detected about the network the
+// machine is on, for NetworkConditions.
+type NetworkEnvironment struct {
+	// DNSSuffixes are the search domains of the resolver, e.g.
+	// "corp.example.com" on a corporate network.
+	DNSSuffixes []string
+	// SSID is the Wi-Fi network, or "" if the machine isn't on Wi-Fi
+	// or the network couldn't be detected.
+	SSID string
+	// VPNInterfaces are the VPN interfaces that are up.
+	VPNInterfaces []string
+}
+
+// detectNetworkEnvironment is a variable so the tests can simulate
+// networks.
+var detectNetworkEnvironment = DetectNetworkEnvironment
+
+// DetectNetworkEnvironment finds out which network the machine is on.
+// The Wi-Fi network is asked from iwgetid or NetworkManager, whichever
+// is installed, and is "" without either.
+func DetectNetworkEnvironment() (NetworkEnvironment, error) {
+	env := NetworkEnvironment{}
+	resolvConf, err := os.ReadFile(resolvConfPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return env, uerror.WithStackTrace(err)
+	}
+	env.DNSSuffixes = parseResolvConfSuffixes(resolvConf)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return env, uerror.WithStackTrace(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp != 0 && isVPNInterfaceName(iface.Name) {
+			env.VPNInterfaces = append(env.VPNInterfaces, iface.Name)
+		}
+	}
+
+	env.SSID = detectSSID()
+	return env, nil
+}
+
+// parseResolvConfSuffixes returns the domains of the search and domain
+// lines of a resolv.conf, lower-case and without trailing dots.
+func parseResolvConfSuffixes(resolvConf []byte) []string {
+	suffixes := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(resolvConf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || (fields[0] != "search" && fields[0] != "domain") {
+			continue
+		}
+		for _, suffix := range fields[1:] {
+			if suffix = normalizeDNSSuffix(suffix); suffix != "" {
+				suffixes = append(suffixes, suffix)
+			}
+		}
+	}
+	return suffixes
+}
+
+func normalizeDNSSuffix(suffix string) string {
+	return strings.ToLower(strings.Trim(suffix, "."))
+}
+
+func isVPNInterfaceName(name string) bool {
+	for _, prefix := range vpnInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func detectSSID() string {
+	if output, err := runSSIDCommand("iwgetid", "--raw"); err == nil {
+		if ssid := strings.TrimSpace(output); ssid != "" {
+			return ssid
+		}
+	}
+	if output, err := runSSIDCommand("nmcli", "--terse", "--fields", "active,ssid", "device", "wifi"); err == nil {
+		return parseNmcliSSID(output)
+	}
+	return ""
+}
+
+func runSSIDCommand(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ssidCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	return string(output), err
+}
+
+// parseNmcliSSID finds the active network in the output of "nmcli
+// --terse --fields active,ssid device wifi", which escapes colons in
+// SSIDs with backslashes.
+func parseNmcliSSID(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if ssid := strings.TrimPrefix(line, "yes:"); ssid != line {
+			return strings.ReplaceAll(strings.ReplaceAll(ssid, `\:`, ":"), `\\`, `\`)
+		}
+	}
+	return ""
+}
+
+// matchNetworkCondition tells whether the network environment meets a
+// condition, and why not if it doesn't.
+func matchNetworkCondition(config Configuration, condition NetworkCondition, env NetworkEnvironment) (bool, string) {
+	if len(condition.SSIDs) > 0 {
+		matches := false
+		for _, pattern := range condition.SSIDs {
+			if matched, _ := path.Match(pattern, env.SSID); matched && env.SSID != "" {
+				matches = true
+			}
+		}
+		if !matches {
+			return false, fmt.Sprintf("not on Wi-Fi network %s", strings.Join(condition.SSIDs, ", "))
+		}
+	}
+	if condition.UnknownWiFi != nil && *condition.UnknownWiFi {
+		if env.SSID == "" {
+			return false, "not on Wi-Fi"
+		}
+		for _, pattern := range config.KnownSSIDs {
+			if matched, _ := path.Match(pattern, env.SSID); matched {
+				return false, fmt.Sprintf("on known Wi-Fi network %s", env.SSID)
+			}
+		}
+	}
+	if condition.VPN != nil {
+		if *condition.VPN && len(env.VPNInterfaces) == 0 {
+			return false, "not connected to a VPN"
+		}
+		if !*condition.VPN && len(env.VPNInterfaces) > 0 {
+			return false, fmt.Sprintf("connected to a VPN (%s)", strings.Join(env.VPNInterfaces, ", "))
+		}
+	}
+	if condition.DNSSuffix != nil {
+		wanted := normalizeDNSSuffix(*condition.DNSSuffix)
+		found := false
+		for _, suffix := range env.DNSSuffixes {
+			found = found || suffix == wanted
+		}
+		if !found {
+			return false, fmt.Sprintf("DNS suffix %s not detected", wanted)
+		}
+	}
+	return true, ""
+}
+
+// checkProfileNetwork fails with ErrWrongNetwork if the profile has a
+// Network condition that the network the machine is on doesn't meet.
+func checkProfileNetwork(config Configuration, profile ProfileConfiguration) error {
+	if profile.Network == nil {
+		return nil
+	}
+	env, err := detectNetworkEnvironment()
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if matches, reason := matchNetworkCondition(config, *profile.Network, env); !matches {
+		return uerror.StackTracef("%w: %s is %s", ErrWrongNetwork, profile.Label, reason)
+	}
+	return nil
+}
+
+// GetProfileLabelsForNetwork returns the labels of the profiles that
+// can be launched on the network the machine is on, those whose
+// PreferredNetwork it is first. The network is only detected if a
+// profile has a condition.
+func GetProfileLabelsForNetwork(config Configuration) ([]string, error) {
+	needsNetwork := false
+	for _, profile := range config.Profiles {
+		needsNetwork = needsNetwork || profile.Network != nil || profile.PreferredNetwork != nil
+	}
+	if !needsNetwork {
+		return GetProfileLabels(config), nil
+	}
+	env, err := detectNetworkEnvironment()
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	preferred, others := []string{}, []string{}
+	for _, profile := range config.Profiles {
+		if profile.Network != nil {
+			if matches, _ := matchNetworkCondition(config, *profile.Network, env); !matches {
+				continue
+			}
+		}
+		if profile.PreferredNetwork != nil {
+			if matches, _ := matchNetworkCondition(config, *profile.PreferredNetwork, env); matches {
+				preferred = append(preferred, profile.Label)
+				continue
+			}
+		}
+		others = append(others, profile.Label)
+	}
+	return append(preferred, others...), nil
+}
+
+func validateNetworkCondition(condition *NetworkCondition) error {
+	if condition == nil {
+		return nil
+	}
+	if len(condition.SSIDs) == 0 && condition.UnknownWiFi == nil && condition.VPN == nil && condition.DNSSuffix == nil {
+		return errors.New("The network condition is empty")
+	}
+	for _, pattern := range condition.SSIDs {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("Invalid SSID pattern %q", pattern)
+		}
+	}
+	if len(condition.SSIDs) > 0 && condition.UnknownWiFi != nil && *condition.UnknownWiFi {
+		return errors.New("The network condition can't require both SSIDs and an unknown Wi-Fi network")
+	}
+	if condition.DNSSuffix != nil && normalizeDNSSuffix(*condition.DNSSuffix) == "" {
+		return errors.New("The DNS suffix is empty")
+	}
+	return nil
+}
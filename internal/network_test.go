@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResolvConfSuffixes(t *testing.T) {
+	resolvConf := "# Generated by NetworkManager\nsearch Corp.Example.com. lab.example.com\nnameserver 10.0.0.1\ndomain example.com\nsearch\n"
+	assert.Equal(t, []string{"corp.example.com", "lab.example.com", "example.com"}, parseResolvConfSuffixes([]byte(resolvConf)))
+	assert.Empty(t, parseResolvConfSuffixes(nil))
+}
+
+func TestParseNmcliSSID(t *testing.T) {
+	assert.Equal(t, "Cafe: Guest", parseNmcliSSID("no:Neighbor\nyes:Cafe\\: Guest\nno:\n"))
+	assert.Equal(t, "", parseNmcliSSID("no:Neighbor\n"))
+}
+
+func TestMatchNetworkCondition(t *testing.T) {
+	config := Configuration{KnownSSIDs: []string{"Home*"}}
+	corporate := NetworkEnvironment{DNSSuffixes: []string{"corp.example.com"}, SSID: "CorpNet"}
+	cafe := NetworkEnvironment{SSID: "Cafe", VPNInterfaces: []string{"wg0"}}
+	home := NetworkEnvironment{SSID: "Home 5GHz"}
+	wired := NetworkEnvironment{}
+
+	testCases := []struct {
+		desc string
+
+		condition      NetworkCondition
+		env            NetworkEnvironment
+		expectedReason string
+	}{
+		{desc: "DNS suffix", condition: NetworkCondition{DNSSuffix: strPtr("Corp.Example.com.")}, env: corporate},
+		{desc: "Missing DNS suffix", condition: NetworkCondition{DNSSuffix: strPtr("corp.example.com")}, env: cafe, expectedReason: "DNS suffix corp.example.com not detected"},
+		{desc: "SSID", condition: NetworkCondition{SSIDs: []string{"Corp*"}}, env: corporate},
+		{desc: "Other SSID", condition: NetworkCondition{SSIDs: []string{"Corp*"}}, env: home, expectedReason: "not on Wi-Fi network Corp*"},
+		{desc: "SSID pattern without Wi-Fi", condition: NetworkCondition{SSIDs: []string{"*"}}, env: wired, expectedReason: "not on Wi-Fi network *"},
+		{desc: "Unknown Wi-Fi", condition: NetworkCondition{UnknownWiFi: boolPtr(true)}, env: cafe},
+		{desc: "Known Wi-Fi", condition: NetworkCondition{UnknownWiFi: boolPtr(true)}, env: home, expectedReason: "on known Wi-Fi network Home 5GHz"},
+		{desc: "Unknown Wi-Fi without Wi-Fi", condition: NetworkCondition{UnknownWiFi: boolPtr(true)}, env: wired, expectedReason: "not on Wi-Fi"},
+		{desc: "VPN", condition: NetworkCondition{VPN: boolPtr(true)}, env: cafe},
+		{desc: "No VPN", condition: NetworkCondition{VPN: boolPtr(true)}, env: home, expectedReason: "not connected to a VPN"},
+		{desc: "VPN not wanted", condition: NetworkCondition{VPN: boolPtr(false)}, env: cafe, expectedReason: "connected to a VPN (wg0)"},
+		{desc: "All of the settings", condition: NetworkCondition{UnknownWiFi: boolPtr(true), VPN: boolPtr(false)}, env: cafe, expectedReason: "connected to a VPN (wg0)"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			matches, reason := matchNetworkCondition(config, tC.condition, tC.env)
+			assert.Equal(t, tC.expectedReason == "", matches)
+			assert.Equal(t, tC.expectedReason, reason)
+		})
+	}
+}
+
+func TestNetworkConditions(t *testing.T) {
+	network := NetworkEnvironment{SSID: "Cafe"}
+	detected := 0
+	detectNetworkEnvironment = func() (NetworkEnvironment, error) {
+		detected++
+		return network, nil
+	}
+	defer func() { detectNetworkEnvironment = DetectNetworkEnvironment }()
+
+	everything := "*"
+	corporate := &NetworkCondition{DNSSuffix: strPtr("corp.example.com")}
+	travel := &NetworkCondition{UnknownWiFi: boolPtr(true)}
+	config := Configuration{
+		Profiles: []ProfileConfiguration{
+			{Label: "private"},
+			{Label: "work", Network: corporate},
+			{Label: "travel", PreferredNetwork: travel},
+		},
+		Routes: []RouteConfiguration{
+			{Host: &everything, Network: corporate, Profile: "work"},
+			{Host: &everything, Network: travel, Profile: "travel"},
+			{Host: &everything, Profile: "private"},
+		},
+	}
+
+	labels, err := GetProfileLabelsForNetwork(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"travel", "private"}, labels)
+	assert.ErrorIs(t, runPreflightChecks(context.Background(), config, config.Profiles[1]), ErrWrongNetwork)
+	u, err := url.Parse("https://example.com/")
+	assert.NoError(t, err)
+	explanations, err := ExplainRoute(config, "", u, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "DNS suffix corp.example.com not detected", explanations[0].Reason)
+	assert.Equal(t, "travel", config.Routes[explanations[len(explanations)-1].Index].Profile)
+	assert.Equal(t, 3, detected, "the network is detected once per call")
+
+	network = NetworkEnvironment{DNSSuffixes: []string{"corp.example.com"}}
+	labels, err = GetProfileLabelsForNetwork(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"private", "work", "travel"}, labels)
+	assert.NoError(t, runPreflightChecks(context.Background(), config, config.Profiles[1]))
+	route, err := RouteURL(config, "", u, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "work", route.Profile)
+
+	// Without conditions, nothing is detected.
+	detected = 0
+	_, err = GetProfileLabelsForNetwork(Configuration{Profiles: config.Profiles[:1]})
+	assert.NoError(t, err)
+	_, err = RouteURL(Configuration{Routes: config.Routes[2:]}, "", u, time.Now())
+	assert.NoError(t, err)
+	assert.Zero(t, detected)
+}
+
+func TestValidateNetworkCondition(t *testing.T) {
+	assert.NoError(t, validateNetworkCondition(nil))
+	assert.NoError(t, validateNetworkCondition(&NetworkCondition{SSIDs: []string{"Corp*"}, VPN: boolPtr(false)}))
+	for _, condition := range []NetworkCondition{
+		{},
+		{SSIDs: []string{"["}},
+		{SSIDs: []string{"Corp"}, UnknownWiFi: boolPtr(true)},
+		{DNSSuffix: strPtr(".")},
+	} {
+		assert.Error(t, validateNetworkCondition(&condition))
+	}
+}
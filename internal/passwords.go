@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"path/filepath"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// credentialFileNames are the files Firefox's password manager keeps
+// in a profile: the encrypted logins and the key they're encrypted
+// with.
+var credentialFileNames = []string{"key4.db", "logins.json"}
+
+func hasNoPasswordManager(profile ProfileConfiguration) bool {
+	return profile.NoPasswordManager != nil && *profile.NoPasswordManager
+}
+
+func getPasswordManagerPrefs(profile ProfileConfiguration) []userPref {
+	if !hasNoPasswordManager(profile) {
+		return nil
+	}
+	return []userPref{
+		{"signon.rememberSignons", false},
+	}
+}
+
+// findStoredCredentials returns the names of the password manager's
+// files that exist in the instance.
+func findStoredCredentials(config Configuration, instance ProfileInstance) ([]string, error) {
+	profileDir := filepath.Join(getInstanceDir(config, instance), relativeProfilePath)
+	found := []string{}
+	for _, name := range credentialFileNames {
+		exists, err := uio.FileExists(filepath.Join(profileDir, name))
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if exists {
+			found = append(found, name)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const (
+	// unlimitedInstancesThreshold is how many instances a profile
+	// without MaxInstances may have before they are reported.
+	unlimitedInstancesThreshold = 10
+	// largeTemplateSize is the size from which copying an instance
+	// template on every reset is reported.
+	largeTemplateSize = 256 << 20
+)
+
+// networkFileSystems are file systems where every metadata access is a
+// round trip to a server. FUSE is mostly sshfs and the like.
+var networkFileSystems = map[string]bool{
+	"cifs": true,
+	"fuse": true,
+	"nfs":  true,
+	"smb2": true,
+}
+
+// PerformanceProblem is a setting, or a combination of settings and the
+// file system the profile path is on, that makes launches slower than
+// they need to be. Hint tells how to fix it.
+type PerformanceProblem struct {
+	Hint    string
+	Message string
+}
+
+// LintPerformance checks the configuration against the file system the
+// profile path is on and the instances that exist. Probing the file
+// system creates the state directory.
+func LintPerformance(config Configuration, warnings *Warnings) ([]PerformanceProblem, error) {
+	problems := []PerformanceProblem{}
+	report := func(hint string, format string, args ...interface{}) {
+		problems = append(problems, PerformanceProblem{
+			Hint:    hint,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	probe, err := ProbeProfilePath(config)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	fsType, reflinks := probe.FileSystem, probe.Reflinks
+
+	if networkFileSystems[fsType] {
+		report("Move the ProfilePath to a local disk.",
+			"The profile path is on %s, a network file system, so listing instances reads every instance's metadata over the network", fsType)
+	}
+	if config.CloneStrategy == string(uio.CloneReflink) && !reflinks {
+		report(`Put the ProfilePath on a file system with reflinks, like btrfs or XFS, or set CloneStrategy to "auto" to hard-link extensions.`,
+			"CloneStrategy is reflink, but %s doesn't support reflinks, so every file is copied", fsType)
+	}
+
+	if !reflinks {
+		templateSizes, err := getTemplateSizes(config)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		for _, template := range templateSizes {
+			if template.size < largeTemplateSize {
+				continue
+			}
+			report("Put the ProfilePath on a file system with reflinks, like btrfs or XFS, or make the template smaller, e.g. with a smaller cache.",
+				"Resetting instances of profile %s copies %s from their template because %s doesn't support reflinks", template.profile, uio.FormatByteSize(template.size), fsType)
+		}
+	}
+
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	instanceCounts := map[string]int{}
+	for _, instance := range instances {
+		if !instance.Ephemeral {
+			instanceCounts[instance.ProfileLabel]++
+		}
+	}
+	for _, profile := range config.Profiles {
+		if count := instanceCounts[profile.Label]; profile.MaxInstances == nil && count > unlimitedInstancesThreshold {
+			report(`Set MaxInstances, e.g. with InstanceLimitPolicy "evict", or launch throwaway sessions with --ephemeral.`,
+				"Profile %s has %d instances and no MaxInstances, so listing and picking instances gets slower with every new one", profile.Label, count)
+		}
+	}
+
+	return problems, nil
+}
+
+type templateSize struct {
+	profile string
+	size    int64
+}
+
+// getTemplateSizes returns the size of the instance template of every
+// profile that has one, sorted by profile.
+func getTemplateSizes(config Configuration) ([]templateSize, error) {
+	templatesDir := filepath.Join(getStateDir(config), templatesDirName)
+	entries, err := os.ReadDir(templatesDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	sizes := []templateSize{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		size, err := uio.DirSize(filepath.Join(templatesDir, entry.Name()))
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		sizes = append(sizes, templateSize{profile: entry.Name(), size: size})
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].profile < sizes[j].profile
+	})
+	return sizes, nil
+}
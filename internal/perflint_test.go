@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestLintPerformance(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	problems, err := LintPerformance(config, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	for i := 0; i <= unlimitedInstancesThreshold; i++ {
+		assert.NoError(t, writeProfileInstanceForTest(config, ProfileInstance{
+			InstanceLabel: fmt.Sprintf("test-%d", i),
+			ProfileLabel:  "test",
+		}))
+	}
+	problems, err = LintPerformance(config, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0].Message, "Profile test has 11 instances and no MaxInstances")
+		assert.Contains(t, problems[0].Hint, "MaxInstances")
+	}
+
+	limit := 20
+	config.Profiles[0].MaxInstances = &limit
+	problems, err = LintPerformance(config, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestLintPerformanceReflinks(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, os.MkdirAll(getStateDir(config), uio.FileModeURWXGRWXO))
+	reflinks, err := uio.SupportsReflinks(getStateDir(config))
+	assert.NoError(t, err)
+	if reflinks {
+		t.Skip("the temporary directory supports reflinks")
+	}
+
+	config.CloneStrategy = string(uio.CloneReflink)
+	templateFile := filepath.Join(getInstanceTemplateDir(config, "test", "abc"), "big")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(templateFile), uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(templateFile, nil, uio.FileModeURWGRWO))
+	assert.NoError(t, os.Truncate(templateFile, largeTemplateSize))
+
+	problems, err := LintPerformance(config, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, problems, 2) {
+		assert.Contains(t, problems[0].Message, "CloneStrategy is reflink")
+		assert.Contains(t, problems[1].Message, "Resetting instances of profile test copies 256")
+	}
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+// PinInstance pins or unpins an instance, see ProfileInstance.Pinned.
+// Unlike most changes, it is allowed while the instance is in use.
+func PinInstance(config Configuration, instance ProfileInstance, pinned bool, mutations *Mutations) error {
+	action, done := "Pin instance", "Pinned instance"
+	if !pinned {
+		action, done = "Unpin instance", "Unpinned instance"
+	}
+	return mutations.Apply(action, instance.InstanceLabel, func() error {
+		// The lock may be held by a running browser, so only the
+		// metadata is locked while it is updated.
+		changed := false
+		if _, err := updateProfileInstance(config, instance.InstanceLabel, func(instance *ProfileInstance) {
+			changed = instance.Pinned != pinned
+			instance.Pinned = pinned
+		}); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if changed {
+			ulog.Default().Info(done, "instance", instance.InstanceLabel)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinInstance(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	assert.NoError(t, PinInstance(config, instance, true, &Mutations{DryRun: true}))
+	stored, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.False(t, stored.Pinned)
+
+	// Pinning works while the instance is in use.
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, PinInstance(config, instance, true, nil))
+	assert.NoError(t, unlock())
+	stored, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.True(t, stored.Pinned)
+
+	maxInstances := 0
+	results, err := CleanInstances(config, CleanPolicy{MaxInstancesPerProfile: &maxInstances}, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	assert.NoError(t, PinInstance(config, instance, false, nil))
+	results, err = CleanInstances(config, CleanPolicy{MaxInstancesPerProfile: &maxInstances}, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
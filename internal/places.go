@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// placesDatabaseFileName is the browser's database of bookmarks and
+// history in the profile directory.
+const placesDatabaseFileName = "places.sqlite"
+
+var ErrNoPlacesDatabase error = errors.New("No places database")
+
+// getPlacesDatabasePath returns the path of the profile's places
+// database. If the browser didn't create it yet, the returned error
+// wraps ErrNoPlacesDatabase.
+func getPlacesDatabasePath(profileDir string) (string, error) {
+	path := filepath.Join(profileDir, placesDatabaseFileName)
+	exists, err := uio.FileExists(path)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if !exists {
+		return "", uerror.StackTracef("%w: %s", ErrNoPlacesDatabase, path)
+	}
+	return path, nil
+}
+
+// hashPlacesURL computes the url_hash of a URL like the browser's
+// hash() SQL function, which it uses to look up places: the hash of the
+// first 1500 bytes, with the lower 16 bits of the hash of the scheme
+// above it.
+func hashPlacesURL(rawURL string) uint64 {
+	const maxBytesToHash = 1500
+	hashed := rawURL
+	if len(hashed) > maxBytesToHash {
+		hashed = hashed[:maxBytesToHash]
+	}
+	hash := uint64(hashPlacesString(hashed))
+	head := rawURL
+	if len(head) > 50 {
+		head = head[:50]
+	}
+	if i := strings.Index(head, ":"); i >= 0 {
+		hash += uint64(hashPlacesString(rawURL[:i])&0xffff) << 32
+	}
+	return hash
+}
+
+// hashPlacesString is mozilla::HashString.
+func hashPlacesString(s string) uint32 {
+	const goldenRatio = 0x9e3779b9
+	var hash uint32
+	for i := 0; i < len(s); i++ {
+		hash = goldenRatio * (bits.RotateLeft32(hash, 5) ^ uint32(s[i]))
+	}
+	return hash
+}
+
+// getPlacesOrigin returns the prefix and host by which the browser
+// groups places into origins, e.g. "https://" and "example.com:8080".
+func getPlacesOrigin(rawURL string) (prefix string, host string) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme == "" {
+		return "", ""
+	}
+	prefix = parsed.Scheme + ":"
+	if strings.HasPrefix(rawURL[len(prefix):], "//") {
+		prefix += "//"
+	}
+	return prefix, strings.ToLower(parsed.Host)
+}
+
+// reversePlacesHost returns the rev_host of a place, the URL's host
+// name reversed and followed by a dot, so places of a domain and its
+// subdomains share a prefix. Places without a host have none.
+func reversePlacesHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if parsed.Hostname() == "" {
+		return ""
+	}
+	host := []rune(strings.ToLower(parsed.Hostname()))
+	for i, j := 0, len(host)-1; i < j; i, j = i+1, j-1 {
+		host[i], host[j] = host[j], host[i]
+	}
+	return string(host) + "."
+}
+
+// newPlacesGUID returns a random GUID like the browser assigns to
+// places and bookmarks: 12 characters of URL-safe Base64.
+func newPlacesGUID() (string, error) {
+	random := make([]byte, 9)
+	if _, err := rand.Read(random); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
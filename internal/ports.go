@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+const (
+	// firstSOCKSPort is Tor Browser's default SOCKS port. The control
+	// port of each pair is the SOCKS port + 1 and pairs are spaced
+	// portPairSpacing apart, like Tor Browser's defaults.
+	firstSOCKSPort  = 9150
+	portPairSpacing = 10
+	maxPortPairs    = 100
+
+	portsLockFileName = "ports.lock"
+)
+
+var ErrNoFreePorts error = errors.New("No free SOCKS and control ports")
+
+// isPortFree is a variable so tests don't depend on which ports happen
+// to be in use on the machine.
+var isPortFree = func(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// allocatePorts assigns the instance a SOCKS and control port pair that
+// no other running instance uses and records it in the instance's
+// metadata. Allocations are serialized with a lock in the state
+// directory, so concurrent launches never get the same pair. The
+// instance must be locked by the caller. The returned function
+// releases the ports again.
+func allocatePorts(config Configuration, instance ProfileInstance) (ProfileInstance, func() error, error) {
+	unlock, err := lockStateFile(config, portsLockFileName)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	instances, err := readProfileInstances(config, nil)
+	if err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	usedPorts := map[int]bool{}
+	for _, other := range instances {
+		if other.InstanceLabel == instance.InstanceLabel || other.SOCKSPort == nil || other.ControlPort == nil {
+			continue
+		}
+		inUse, err := isInstanceInUse(config, other)
+		if err != nil {
+			return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+		}
+		if inUse {
+			usedPorts[*other.SOCKSPort] = true
+			usedPorts[*other.ControlPort] = true
+		}
+	}
+
+	socksPort, controlPort := 0, 0
+	for i := 0; i < maxPortPairs; i++ {
+		socks, control := firstSOCKSPort+i*portPairSpacing, firstSOCKSPort+i*portPairSpacing+1
+		if !usedPorts[socks] && !usedPorts[control] && isPortFree(socks) && isPortFree(control) {
+			socksPort, controlPort = socks, control
+			break
+		}
+	}
+	if socksPort == 0 {
+		return ProfileInstance{}, nil, uerror.StackTracef("%w for %s", ErrNoFreePorts, instance.InstanceLabel)
+	}
+
+	if _, err := updateProfileInstance(config, instance.InstanceLabel, func(current *ProfileInstance) {
+		current.ControlPort = &controlPort
+		current.SOCKSPort = &socksPort
+	}); err != nil {
+		return ProfileInstance{}, nil, uerror.WithStackTrace(err)
+	}
+	instance.ControlPort = &controlPort
+	instance.SOCKSPort = &socksPort
+
+	return instance, func() error {
+		_, err := updateProfileInstance(config, instance.InstanceLabel, func(current *ProfileInstance) {
+			current.ControlPort = nil
+			current.SOCKSPort = nil
+		})
+		return err
+	}, nil
+}
+
+// lockStateFile takes an exclusive lock on a file in the state
+// directory, waiting for other processes to release it.
+func lockStateFile(config Configuration, name string) (unlock func() error, err error) {
+	if err := os.MkdirAll(getStateDir(config), uio.FileModeURWXGRWXO); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	lockFile, err := os.OpenFile(filepath.Join(getStateDir(config), name), os.O_CREATE|os.O_RDWR, uio.FileModeURWGRWO)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		return nil, uerror.WithStackTrace(err)
+	}
+	return lockFile.Close, nil
+}
+
+// portPrefNames are the prefs writePortSettings sets.
+var portPrefNames = []string{"network.proxy.socks_port", "extensions.torlauncher.control_port"}
+
+// writePortSettings sets the instance's ports at the end of its
+// user.js. Since user.js is only rewritten when the profile changes,
+// the ports of earlier launches are removed first.
+func writePortSettings(instanceDir string, socksPort int, controlPort int) error {
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	if err := os.MkdirAll(profileDir, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	userJSPath := filepath.Join(profileDir, "user.js")
+	userJS, err := os.ReadFile(userJSPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return uerror.WithStackTrace(err)
+	}
+	sb := &strings.Builder{}
+	for _, line := range strings.SplitAfter(string(userJS), "\n") {
+		if !isUserPrefLine(line, portPrefNames) {
+			sb.WriteString(line)
+		}
+	}
+	fmt.Fprintf(sb, ustring.TrimIndentation(`
+		user_pref("network.proxy.socks_port", %d);
+		user_pref("extensions.torlauncher.control_port", %d);
+	`), socksPort, controlPort)
+
+	if err := uio.WriteFileAtomic(userJSPath, []byte(sb.String()), uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
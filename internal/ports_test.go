@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+func TestAllocatePorts(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		busyPorts           []int
+		expectedControlPort int
+		expectedSOCKSPort   int
+		otherPort           int
+		otherRunning        bool
+	}{
+		{
+			desc: "First pair is free",
+
+			expectedControlPort: 9151,
+			expectedSOCKSPort:   9150,
+		},
+		{
+			desc: "First pair used by a running instance",
+
+			expectedControlPort: 9161,
+			expectedSOCKSPort:   9160,
+			otherPort:           9150,
+			otherRunning:        true,
+		},
+		{
+			desc: "Stale ports of a stopped instance",
+
+			expectedControlPort: 9151,
+			expectedSOCKSPort:   9150,
+			otherPort:           9150,
+		},
+		{
+			desc: "Port used by another program",
+
+			busyPorts:           []int{9151},
+			expectedControlPort: 9161,
+			expectedSOCKSPort:   9160,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			originalIsPortFree := isPortFree
+			defer func() { isPortFree = originalIsPortFree }()
+			isPortFree = func(port int) bool {
+				for _, busyPort := range tC.busyPorts {
+					if port == busyPort {
+						return false
+					}
+				}
+				return true
+			}
+
+			assert.NoError(t, writeProfileInstanceForTest(config, instance))
+			if tC.otherPort != 0 {
+				otherControlPort := tC.otherPort + 1
+				other := ProfileInstance{
+					ControlPort:   &otherControlPort,
+					InstanceLabel: "test-2",
+					ProfileLabel:  "test",
+					SOCKSPort:     &tC.otherPort,
+				}
+				assert.NoError(t, writeProfileInstanceForTest(config, other))
+				if tC.otherRunning {
+					unlock, err := LockInstance(config, other)
+					assert.NoError(t, err)
+					defer unlock()
+				}
+			}
+
+			allocated, release, err := allocatePorts(config, instance)
+			assert.NoError(t, err)
+			if assert.NotNil(t, allocated.SOCKSPort) && assert.NotNil(t, allocated.ControlPort) {
+				assert.Equal(t, tC.expectedSOCKSPort, *allocated.SOCKSPort)
+				assert.Equal(t, tC.expectedControlPort, *allocated.ControlPort)
+			}
+			stored, err := GetProfileInstance(config, instance.InstanceLabel)
+			assert.NoError(t, err)
+			assert.Equal(t, allocated.SOCKSPort, stored.SOCKSPort)
+			assert.Equal(t, allocated.ControlPort, stored.ControlPort)
+
+			assert.NoError(t, release())
+			stored, err = GetProfileInstance(config, instance.InstanceLabel)
+			assert.NoError(t, err)
+			assert.Nil(t, stored.SOCKSPort)
+			assert.Nil(t, stored.ControlPort)
+		})
+	}
+}
+
+func TestAllocatePortsExhausted(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	originalIsPortFree := isPortFree
+	defer func() { isPortFree = originalIsPortFree }()
+	isPortFree = func(port int) bool { return false }
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	_, _, err := allocatePorts(config, instance)
+	assert.ErrorIs(t, err, ErrNoFreePorts)
+}
+
+func TestWritePortSettings(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		existingUserJSContent string
+		expectedUserJSPrefix  string
+	}{
+		{
+			desc: "No user.js file",
+		},
+		{
+			desc: "With existing user.js file",
+
+			existingUserJSContent: ustring.TrimIndentation(`
+				// This is an existing user.js file.
+				user_pref("foo", "bar");
+
+			`),
+		},
+		{
+			desc: "With ports from an earlier launch",
+
+			existingUserJSContent: ustring.TrimIndentation(`
+				user_pref("foo", "bar");
+				user_pref("network.proxy.socks_port", 9150);
+				user_pref("extensions.torlauncher.control_port", 9151);
+			`),
+			expectedUserJSPrefix: "user_pref(\"foo\", \"bar\");\n",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, _, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+
+			userJSPath := filepath.Join(instanceDir, relativeProfilePath, "user.js")
+			if tC.existingUserJSContent != "" {
+				assert.NoError(t, os.MkdirAll(filepath.Dir(userJSPath), uio.FileModeURWXGRWXO))
+				assert.NoError(t, os.WriteFile(userJSPath, []byte(tC.existingUserJSContent), uio.FileModeURWGRWO))
+			}
+
+			assert.NoError(t, writePortSettings(instanceDir, 9160, 9161))
+
+			expectedUserJSPrefix := tC.existingUserJSContent
+			if tC.expectedUserJSPrefix != "" {
+				expectedUserJSPrefix = tC.expectedUserJSPrefix
+			}
+
+			actualUserJS, err := os.ReadFile(userJSPath)
+			assert.NoError(t, err)
+			expectedUserJS := fmt.Sprintf(ustring.TrimIndentation(`
+				%suser_pref("network.proxy.socks_port", 9160);
+				user_pref("extensions.torlauncher.control_port", 9161);
+			`), expectedUserJSPrefix)
+			assert.Equal(t, expectedUserJS, string(actualUserJS))
+		})
+	}
+}
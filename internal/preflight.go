@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var (
+	ErrInterfaceDown  error = errors.New("Network interface is not up")
+	ErrLowDiskSpace   error = errors.New("Not enough free disk space")
+	ErrTorUnreachable error = errors.New("Tor SOCKS proxy is not reachable")
+	ErrURLUnreachable error = errors.New("URL is not reachable")
+)
+
+// preflightTimeout is how long each of the network checks may take.
+const preflightTimeout = 10 * time.Second
+
+// runPreflightChecks checks the profile's Network and runs its
+// pre-flight checks in order. It returns the error of the first one
+// that fails.
+func runPreflightChecks(ctx context.Context, config Configuration, profile ProfileConfiguration) error {
+	if err := checkProfileNetwork(config, profile); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	logger := ulog.FromContext(ctx)
+	for _, check := range profile.PreflightChecks {
+		if err := runPreflightCheck(ctx, config, check); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		logger.Debug("Pre-flight check passed", "check", check.String())
+	}
+	return nil
+}
+
+func runPreflightCheck(ctx context.Context, config Configuration, check PreflightCheck) error {
+	switch {
+	case check.FreeDiskMiB != nil:
+		return checkFreeDiskSpace(config.ProfilePath, int64(*check.FreeDiskMiB)<<20)
+	case check.Interface != nil:
+		return checkInterfaceUp(*check.Interface)
+	case check.Reachable != nil:
+		return checkURLReachable(ctx, http.DefaultClient, *check.Reachable)
+	case check.TorSOCKS != nil:
+		return checkTorSOCKS(ctx, *check.TorSOCKS)
+	}
+	return nil
+}
+
+func checkFreeDiskSpace(path string, required int64) error {
+	free, err := uio.GetFreeSpace(path)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if free < required {
+		return uerror.StackTracef("%w: %s free in %s, %s required", ErrLowDiskSpace, uio.FormatByteSize(free), path, uio.FormatByteSize(required))
+	}
+	return nil
+}
+
+// checkInterfaceUp checks that a network interface, like the one of a
+// VPN, exists, is up and has an address.
+func checkInterfaceUp(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return uerror.StackTracef("%w: %s doesn't exist", ErrInterfaceDown, name)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return uerror.StackTracef("%w: %s is down", ErrInterfaceDown, name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if len(addrs) == 0 {
+		return uerror.StackTracef("%w: %s has no address", ErrInterfaceDown, name)
+	}
+	return nil
+}
+
+// checkURLReachable sends a HEAD request to a URL. Any response counts,
+// even an error status, since the check is about the network.
+func checkURLReachable(ctx context.Context, client *http.Client, rawURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return uerror.StackTracef("%w: %s", ErrURLUnreachable, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkTorSOCKS checks that a SOCKS5 proxy that doesn't require
+// authentication, like Tor's, answers at address.
+func checkTorSOCKS(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return uerror.StackTracef("%w: %s", ErrTorUnreachable, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	// Version 5, one authentication method: none
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return uerror.StackTracef("%w: %s", ErrTorUnreachable, err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return uerror.StackTracef("%w: %s didn't answer the SOCKS handshake: %s", ErrTorUnreachable, address, err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return uerror.StackTracef("%w: %s isn't a SOCKS5 proxy without authentication", ErrTorUnreachable, address)
+	}
+	return nil
+}
+
+// String describes a check for logs.
+func (check PreflightCheck) String() string {
+	switch {
+	case check.FreeDiskMiB != nil:
+		return fmt.Sprintf("free disk space >= %d MiB", *check.FreeDiskMiB)
+	case check.Interface != nil:
+		return "interface " + *check.Interface
+	case check.Reachable != nil:
+		return "reachable " + *check.Reachable
+	case check.TorSOCKS != nil:
+		return "Tor SOCKS " + *check.TorSOCKS
+	}
+	return "empty check"
+}
+
+func validatePreflightChecks(checks []PreflightCheck) error {
+	for i, check := range checks {
+		set := 0
+		for _, isSet := range []bool{check.FreeDiskMiB != nil, check.Interface != nil, check.Reachable != nil, check.TorSOCKS != nil} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("Pre-flight check %d must set exactly one of FreeDiskMiB, Interface, Reachable and TorSOCKS", i)
+		}
+		switch {
+		case check.FreeDiskMiB != nil && *check.FreeDiskMiB < 1:
+			return fmt.Errorf("Pre-flight check %d requires less than 1 MiB of free disk space", i)
+		case check.Interface != nil && strings.TrimSpace(*check.Interface) == "":
+			return fmt.Errorf("Pre-flight check %d has an empty interface name", i)
+		case check.Reachable != nil:
+			parsed, err := url.Parse(*check.Reachable)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("Pre-flight check %d has %q, which is not an HTTP(S) URL", i, *check.Reachable)
+			}
+		case check.TorSOCKS != nil:
+			if _, _, err := net.SplitHostPort(*check.TorSOCKS); err != nil {
+				return fmt.Errorf("Pre-flight check %d has %q, which is not a host and port", i, *check.TorSOCKS)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPreflightChecks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedAddress := closedListener.Addr().String()
+	assert.NoError(t, closedListener.Close())
+	socksAddress := listenForTest(t, []byte{5, 0})
+	passwordSOCKSAddress := listenForTest(t, []byte{5, 2})
+
+	config := Configuration{ProfilePath: t.TempDir()}
+	testCases := []struct {
+		desc string
+
+		check       PreflightCheck
+		expectedErr error
+	}{
+		{desc: "Reachable URL", check: PreflightCheck{Reachable: strPtr(server.URL)}},
+		{desc: "Unreachable URL", check: PreflightCheck{Reachable: strPtr("http://" + closedAddress)}, expectedErr: ErrURLUnreachable},
+		{desc: "Loopback interface", check: PreflightCheck{Interface: strPtr("lo")}},
+		{desc: "Missing interface", check: PreflightCheck{Interface: strPtr("tbml-test0")}, expectedErr: ErrInterfaceDown},
+		{desc: "Enough disk space", check: PreflightCheck{FreeDiskMiB: intPtr(1)}},
+		{desc: "Not enough disk space", check: PreflightCheck{FreeDiskMiB: intPtr(1 << 40)}, expectedErr: ErrLowDiskSpace},
+		{desc: "Tor SOCKS", check: PreflightCheck{TorSOCKS: &socksAddress}},
+		{desc: "SOCKS with authentication", check: PreflightCheck{TorSOCKS: &passwordSOCKSAddress}, expectedErr: ErrTorUnreachable},
+		{desc: "Tor not running", check: PreflightCheck{TorSOCKS: &closedAddress}, expectedErr: ErrTorUnreachable},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			profile := ProfileConfiguration{Label: "test", PreflightChecks: []PreflightCheck{testCase.check}}
+			err := runPreflightChecks(context.Background(), config, profile)
+			if testCase.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+			}
+		})
+	}
+}
+
+func TestValidatePreflightChecks(t *testing.T) {
+	assert.NoError(t, validatePreflightChecks([]PreflightCheck{
+		{Interface: strPtr("wg0")},
+		{Reachable: strPtr("https://intranet.example.com/")},
+		{TorSOCKS: strPtr("127.0.0.1:9050")},
+		{FreeDiskMiB: intPtr(512)},
+	}))
+	for _, check := range []PreflightCheck{
+		{},
+		{Interface: strPtr("wg0"), FreeDiskMiB: intPtr(512)},
+		{Interface: strPtr(" ")},
+		{Reachable: strPtr("intranet.example.com")},
+		{TorSOCKS: strPtr("127.0.0.1")},
+		{FreeDiskMiB: intPtr(0)},
+	} {
+		assert.Error(t, validatePreflightChecks([]PreflightCheck{check}), check.String())
+	}
+}
+
+// listenForTest accepts one connection on a local port, reads the
+// client's greeting and answers with reply.
+func listenForTest(t *testing.T, reply []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		if _, err := conn.Read(greeting); err == nil {
+			_, _ = conn.Write(reply)
+		}
+	}()
+	return listener.Addr().String()
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// removedPrefs maps prefs that Firefox no longer reads to a hint about
+// what to use instead.
+var removedPrefs = map[string]string{
+	"browser.cache.offline.enable":        "the offline cache was removed in Firefox 96",
+	"browser.newtabpage.enhanced":         "removed in Firefox 57",
+	"browser.safebrowsing.enabled":        "use browser.safebrowsing.malware.enabled",
+	"browser.urlbar.autocomplete.enabled": "removed in Firefox 59",
+	"extensions.legacy.enabled":           "legacy extensions aren't supported since Firefox 57",
+	"general.useragent.locale":            "use intl.locale.requested",
+	"security.ssl3.rsa_des_ede3_sha":      "3DES was removed in Firefox 93",
+}
+
+// prefLintRules check the effective prefs of an instance for mistakes
+// that Firefox silently ignores. Each rule returns one message per
+// problem it finds.
+var prefLintRules = []func(prefs map[string]interface{}) []string{
+	lintRemovedPrefs,
+	lintUserAgentOverride,
+	lintLetterboxing,
+	lintDoHResolver,
+}
+
+// LintInstancePrefs checks the user.js of an instance for contradictory
+// or removed prefs and returns a warning for each problem found.
+func LintInstancePrefs(config Configuration, instance ProfileInstance) ([]string, error) {
+	userJSBytes, err := os.ReadFile(filepath.Join(getInstanceDir(config, instance), relativeProfilePath, "user.js"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return lintPrefs(parseUserPrefs(string(userJSBytes))), nil
+}
+
+func lintPrefs(userPrefs []userPref) []string {
+	prefs := make(map[string]interface{})
+	for _, pref := range userPrefs {
+		prefs[pref.Name] = pref.Value
+	}
+	warnings := []string{}
+	for _, rule := range prefLintRules {
+		warnings = append(warnings, rule(prefs)...)
+	}
+	return warnings
+}
+
+func lintRemovedPrefs(prefs map[string]interface{}) []string {
+	warnings := []string{}
+	for name := range prefs {
+		if hint, ok := removedPrefs[name]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s has no effect (%s)", name, hint))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+func lintUserAgentOverride(prefs map[string]interface{}) []string {
+	if _, ok := prefs["general.useragent.override"]; ok && prefs["privacy.resistFingerprinting"] == true {
+		return []string{"general.useragent.override is ignored while privacy.resistFingerprinting is enabled"}
+	}
+	return nil
+}
+
+func lintLetterboxing(prefs map[string]interface{}) []string {
+	if prefs["privacy.resistFingerprinting.letterboxing"] == true && prefs["privacy.resistFingerprinting"] == false {
+		return []string{"privacy.resistFingerprinting.letterboxing has no effect while privacy.resistFingerprinting is disabled"}
+	}
+	return nil
+}
+
+func lintDoHResolver(prefs map[string]interface{}) []string {
+	mode, ok := prefs["network.trr.mode"].(float64)
+	if !ok || (mode != 2 && mode != 3) {
+		return nil
+	}
+	if uri, _ := prefs["network.trr.uri"].(string); uri == "" {
+		return []string{"network.trr.mode enables DNS over HTTPS but network.trr.uri is not set"}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestLintPrefs(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expected []string
+		prefs    []userPref
+	}{
+		{
+			desc:     "clean",
+			expected: []string{},
+			prefs: []userPref{
+				{"privacy.resistFingerprinting", true},
+				{"network.trr.mode", 3.0},
+				{"network.trr.uri", "https://dns.example.com/dns-query"},
+			},
+		},
+		{
+			desc:     "removed prefs",
+			expected: []string{"browser.safebrowsing.enabled has no effect (use browser.safebrowsing.malware.enabled)"},
+			prefs: []userPref{
+				{"browser.safebrowsing.enabled", false},
+			},
+		},
+		{
+			desc:     "user agent override with RFP",
+			expected: []string{"general.useragent.override is ignored while privacy.resistFingerprinting is enabled"},
+			prefs: []userPref{
+				{"general.useragent.override", commonWindowsUserAgent},
+				{"privacy.resistFingerprinting", true},
+			},
+		},
+		{
+			desc:     "user agent override with RFP disabled later",
+			expected: []string{},
+			prefs: []userPref{
+				{"privacy.resistFingerprinting", true},
+				{"general.useragent.override", commonWindowsUserAgent},
+				{"privacy.resistFingerprinting", false},
+			},
+		},
+		{
+			desc:     "letterboxing without RFP",
+			expected: []string{"privacy.resistFingerprinting.letterboxing has no effect while privacy.resistFingerprinting is disabled"},
+			prefs: []userPref{
+				{"privacy.resistFingerprinting", false},
+				{"privacy.resistFingerprinting.letterboxing", true},
+			},
+		},
+		{
+			desc:     "DoH without resolver",
+			expected: []string{"network.trr.mode enables DNS over HTTPS but network.trr.uri is not set"},
+			prefs: []userPref{
+				{"network.trr.mode", 2.0},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, lintPrefs(tC.prefs))
+		})
+	}
+}
+
+func TestLintInstancePrefs(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	warnings, err := LintInstancePrefs(config, instance)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	assert.NoError(t, os.MkdirAll(profileDir, uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(filepath.Join(profileDir, "user.js"), []byte(`user_pref("general.useragent.locale", "de");`), uio.FileModeURWGRWO))
+
+	warnings, err = LintInstancePrefs(config, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"general.useragent.locale has no effect (use intl.locale.requested)"}, warnings)
+}
@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// commonWindowsUserAgent is the user agent string used by the
+// "common-windows" fingerprint preset.
+const commonWindowsUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:115.0) Gecko/20100101 Firefox/115.0"
+
+var ErrInstanceVerificationFailed error = errors.New("Instance verification failed")
+
+var userPrefRE *regexp.Regexp = regexp.MustCompile(`(?m)^\s*user_pref\(\s*("(?:[^"\\]|\\.)*")\s*,\s*(.*?)\s*\)\s*;`)
+
+type userPref struct {
+	Name  string
+	Value interface{}
+}
+
+var fingerprintPresets = map[string][]userPref{
+	// "tor" mirrors the Tor Browser defaults and is mainly useful to
+	// undo changes made by a profile's user.js.
+	"tor": {
+		{"privacy.resistFingerprinting", true},
+		{"privacy.resistFingerprinting.letterboxing", true},
+	},
+	"no-letterboxing": {
+		{"privacy.resistFingerprinting", true},
+		{"privacy.resistFingerprinting.letterboxing", false},
+	},
+	"relaxed": {
+		{"privacy.resistFingerprinting", false},
+		{"privacy.resistFingerprinting.letterboxing", false},
+	},
+	"common-windows": {
+		{"privacy.resistFingerprinting", false},
+		{"privacy.resistFingerprinting.letterboxing", false},
+		{"general.useragent.override", commonWindowsUserAgent},
+	},
+}
+
+var dohModes = map[string]int{
+	"off":   5,
+	"first": 2,
+	"only":  3,
+}
+
+var cookieLifetimePolicies = map[string]int{
+	"persistent": 0,
+	"session":    2,
+}
+
+// GetFingerprintPresetNames returns the names of all available
+// fingerprint presets in alphabetical order.
+func GetFingerprintPresetNames() []string {
+	names := make([]string, 0, len(fingerprintPresets))
+	for name := range fingerprintPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getProfilePrefs(profile ProfileConfiguration) ([]userPref, error) {
+	prefs := []userPref{}
+
+	if profile.FingerprintPreset != nil {
+		presetPrefs, ok := fingerprintPresets[*profile.FingerprintPreset]
+		if !ok {
+			return nil, uerror.StackTracef("Unknown fingerprint preset %s (available: %s)", *profile.FingerprintPreset, strings.Join(GetFingerprintPresetNames(), ", "))
+		}
+		prefs = append(prefs, presetPrefs...)
+	}
+
+	if profile.DoH != nil {
+		dohPrefs, err := getDoHPrefs(*profile.DoH)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		prefs = append(prefs, dohPrefs...)
+	}
+
+	if profile.Storage != nil {
+		storagePrefs, err := getStoragePrefs(*profile.Storage)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		prefs = append(prefs, storagePrefs...)
+	}
+
+	if profile.Tracking != nil {
+		trackingPrefs, err := getTrackingPrefs(*profile.Tracking)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		prefs = append(prefs, trackingPrefs...)
+	}
+
+	prefs = append(prefs, getPasswordManagerPrefs(profile)...)
+
+	return prefs, nil
+}
+
+func getDoHPrefs(doh DoHConfiguration) ([]userPref, error) {
+	mode, ok := dohModes[doh.Mode]
+	if !ok {
+		return nil, uerror.StackTracef("Unknown DoH mode %s (available: off, first, only)", doh.Mode)
+	}
+	prefs := []userPref{
+		{"network.trr.mode", mode},
+	}
+	if mode == dohModes["off"] {
+		return prefs, nil
+	}
+
+	if doh.ResolverURL == "" {
+		return nil, uerror.StackTracef("DoH mode %s requires a resolver URL", doh.Mode)
+	}
+	prefs = append(prefs,
+		userPref{"network.trr.uri", doh.ResolverURL},
+		userPref{"network.trr.custom_uri", doh.ResolverURL},
+	)
+	if doh.Bootstrap != nil {
+		prefs = append(prefs, userPref{"network.trr.bootstrapAddress", *doh.Bootstrap})
+	}
+	return prefs, nil
+}
+
+func writeProfilePrefs(profile ProfileConfiguration, instanceDir string) error {
+	prefs, err := getProfilePrefs(profile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return appendUserPrefs(instanceDir, prefs)
+}
+
+func getStoragePrefs(storage StorageConfiguration) ([]userPref, error) {
+	prefs := []userPref{}
+	if storage.CacheCapacityKiB != nil {
+		if *storage.CacheCapacityKiB < 0 {
+			return nil, uerror.StackTracef("Cache capacity must not be negative")
+		}
+		prefs = append(prefs,
+			userPref{"browser.cache.disk.smart_size.enabled", false},
+			userPref{"browser.cache.disk.capacity", *storage.CacheCapacityKiB},
+		)
+	}
+	if storage.StorageQuotaKiB != nil {
+		if *storage.StorageQuotaKiB < 0 {
+			return nil, uerror.StackTracef("Storage quota must not be negative")
+		}
+		prefs = append(prefs, userPref{"dom.quotaManager.temporaryStorage.fixedLimit", *storage.StorageQuotaKiB})
+	}
+	return prefs, nil
+}
+
+func getTrackingPrefs(tracking TrackingConfiguration) ([]userPref, error) {
+	prefs := []userPref{}
+
+	if tracking.Protection != nil {
+		switch *tracking.Protection {
+		case "standard":
+			prefs = append(prefs, userPref{"browser.contentblocking.category", "standard"})
+		case "strict":
+			prefs = append(prefs,
+				userPref{"browser.contentblocking.category", "strict"},
+				userPref{"privacy.trackingprotection.enabled", true},
+				userPref{"privacy.trackingprotection.socialtracking.enabled", true},
+			)
+		default:
+			return nil, uerror.StackTracef("Unknown tracking protection level %s (available: standard, strict)", *tracking.Protection)
+		}
+	}
+
+	if tracking.CookieLifetime != nil {
+		policy, ok := cookieLifetimePolicies[*tracking.CookieLifetime]
+		if !ok {
+			return nil, uerror.StackTracef("Unknown cookie lifetime %s (available: persistent, session)", *tracking.CookieLifetime)
+		}
+		prefs = append(prefs, userPref{"network.cookie.lifetimePolicy", policy})
+	}
+
+	if tracking.BlockThirdPartyCookies != nil {
+		// 1 rejects all third-party cookies, 5 is Firefox's default
+		// of partitioning them per first party.
+		behavior := 5
+		if *tracking.BlockThirdPartyCookies {
+			behavior = 1
+		}
+		prefs = append(prefs, userPref{"network.cookie.cookieBehavior", behavior})
+	}
+
+	return prefs, nil
+}
+
+// appendUserPrefs appends the given prefs to the user.js file of the
+// instance, creating it if necessary.
+func appendUserPrefs(instanceDir string, prefs []userPref) error {
+	if len(prefs) == 0 {
+		return nil
+	}
+
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	if err := os.MkdirAll(profileDir, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	userJSFile, err := os.OpenFile(filepath.Join(profileDir, "user.js"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, uio.FileModeURWGRWO)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer userJSFile.Close()
+
+	for _, pref := range prefs {
+		line, err := formatUserPref(pref)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if _, err := fmt.Fprintln(userJSFile, line); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	return nil
+}
+
+// isUserPrefLine tells whether a line of a user.js sets one of the
+// given prefs.
+func isUserPrefLine(line string, names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(strings.TrimSpace(line), fmt.Sprintf("user_pref(%q,", name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatUserPref(pref userPref) (string, error) {
+	nameJS, err := marshalJS(pref.Name)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	valueJS, err := marshalJS(pref.Value)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return fmt.Sprintf("user_pref(%s, %s);", nameJS, valueJS), nil
+}
+
+// marshalJS encodes a value as a JavaScript literal. JSON is used for
+// this but, unlike json.Marshal, characters like "&" in URLs are kept
+// as they are.
+func marshalJS(v interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// VerifyInstance checks that the prefs generated from the profile's
+// configuration are in effect in the instance's user.js, that the
+// profile's extensions are installed and enabled, that no others are
+// installed that its ExtensionPolicy doesn't allow and that no
+// credentials are stored if the profile sets NoPasswordManager.
+func VerifyInstance(config Configuration, profile ProfileConfiguration, instance ProfileInstance) error {
+	wantedPrefs, err := getProfilePrefs(profile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	userJSPath := filepath.Join(getInstanceDir(config, instance), relativeProfilePath, "user.js")
+	actualPrefs := make(map[string]string)
+	userJSBytes, err := os.ReadFile(userJSPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return uerror.WithStackTrace(err)
+	}
+	for _, pref := range parseUserPrefs(string(userJSBytes)) {
+		valueJS, err := marshalJS(pref.Value)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		// Later prefs take precedence, just like in Firefox.
+		actualPrefs[pref.Name] = valueJS
+	}
+
+	problems := []string{}
+	for _, pref := range wantedPrefs {
+		wantedJS, err := marshalJS(pref.Value)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		actualJS, ok := actualPrefs[pref.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is not set (want %s)", pref.Name, wantedJS))
+		} else if actualJS != wantedJS {
+			problems = append(problems, fmt.Sprintf("%s is %s (want %s)", pref.Name, actualJS, wantedJS))
+		}
+	}
+	if hasNoPasswordManager(profile) {
+		credentialFiles, err := findStoredCredentials(config, instance)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		for _, name := range credentialFiles {
+			problems = append(problems, fmt.Sprintf("%s exists although the profile sets NoPasswordManager", name))
+		}
+	}
+	extensions, err := GetInstanceExtensions(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// Without extensions.json, the browser hasn't picked up any
+	// extensions yet, so there's nothing to check.
+	if extensions != nil {
+		extensionsByID := make(map[string]InstanceExtension)
+		for _, extension := range extensions {
+			extensionsByID[extension.ID] = extension
+		}
+		for _, extensionID := range getProfileExtensionIDs(profile) {
+			extension, ok := extensionsByID[extensionID]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("extension %s is not installed", extensionID))
+			} else if !extension.Enabled {
+				problems = append(problems, fmt.Sprintf("extension %s is disabled", extensionID))
+			}
+		}
+		// Extensions the user installed are flagged, not removed.
+		for _, extension := range extensions {
+			if !isExtensionAllowed(profile, extension.ID) {
+				problems = append(problems, fmt.Sprintf("extension %s (%s) is not allowed by the ExtensionPolicy", extension.ID, extension.Name))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return uerror.StackTracef("%w: %s: %s", ErrInstanceVerificationFailed, instance.InstanceLabel, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseUserPrefs extracts all user_pref calls from a user.js or
+// prefs.js file. Values that aren't valid JSON literals are skipped.
+func parseUserPrefs(content string) []userPref {
+	prefs := []userPref{}
+	for _, match := range userPrefRE.FindAllStringSubmatch(content, -1) {
+		var name string
+		if err := json.Unmarshal([]byte(match[1]), &name); err != nil {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(match[2]), &value); err != nil {
+			continue
+		}
+		prefs = append(prefs, userPref{name, value})
+	}
+	return prefs
+}
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+func TestWriteProfilePrefs(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		doh            *DoHConfiguration
+		expectedUserJS string
+		preset         *string
+		storage        *StorageConfiguration
+		tracking       *TrackingConfiguration
+	}{
+		{
+			desc: "No preset",
+		},
+		{
+			desc: "Relaxed",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("privacy.resistFingerprinting", false);
+				user_pref("privacy.resistFingerprinting.letterboxing", false);
+
+			`),
+			preset: strPtr("relaxed"),
+		},
+		{
+			desc: "User agent override",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("privacy.resistFingerprinting", false);
+				user_pref("privacy.resistFingerprinting.letterboxing", false);
+				user_pref("general.useragent.override", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:115.0) Gecko/20100101 Firefox/115.0");
+
+			`),
+			preset: strPtr("common-windows"),
+		},
+		{
+			desc: "DoH with bootstrap address",
+
+			doh: &DoHConfiguration{
+				Bootstrap:   strPtr("192.0.2.1"),
+				Mode:        "only",
+				ResolverURL: "https://dns.example/dns-query",
+			},
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("network.trr.mode", 3);
+				user_pref("network.trr.uri", "https://dns.example/dns-query");
+				user_pref("network.trr.custom_uri", "https://dns.example/dns-query");
+				user_pref("network.trr.bootstrapAddress", "192.0.2.1");
+
+			`),
+		},
+		{
+			desc: "DoH off",
+
+			doh: &DoHConfiguration{
+				Mode: "off",
+			},
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("network.trr.mode", 5);
+
+			`),
+		},
+		{
+			desc: "Preset and DoH",
+
+			doh: &DoHConfiguration{
+				Mode:        "first",
+				ResolverURL: "https://dns.example/dns-query",
+			},
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("privacy.resistFingerprinting", true);
+				user_pref("privacy.resistFingerprinting.letterboxing", false);
+				user_pref("network.trr.mode", 2);
+				user_pref("network.trr.uri", "https://dns.example/dns-query");
+				user_pref("network.trr.custom_uri", "https://dns.example/dns-query");
+
+			`),
+			preset: strPtr("no-letterboxing"),
+		},
+		{
+			desc: "Strict tracking protection",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("browser.contentblocking.category", "strict");
+				user_pref("privacy.trackingprotection.enabled", true);
+				user_pref("privacy.trackingprotection.socialtracking.enabled", true);
+				user_pref("network.cookie.lifetimePolicy", 2);
+				user_pref("network.cookie.cookieBehavior", 1);
+
+			`),
+			tracking: &TrackingConfiguration{
+				BlockThirdPartyCookies: boolPtr(true),
+				CookieLifetime:         strPtr("session"),
+				Protection:             strPtr("strict"),
+			},
+		},
+		{
+			desc: "Storage caps",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("browser.cache.disk.smart_size.enabled", false);
+				user_pref("browser.cache.disk.capacity", 51200);
+				user_pref("dom.quotaManager.temporaryStorage.fixedLimit", 102400);
+
+			`),
+			storage: &StorageConfiguration{
+				CacheCapacityKiB: intPtr(51200),
+				StorageQuotaKiB:  intPtr(102400),
+			},
+		},
+		{
+			desc: "Partitioned third-party cookies",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("network.cookie.cookieBehavior", 5);
+
+			`),
+			tracking: &TrackingConfiguration{
+				BlockThirdPartyCookies: boolPtr(false),
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+
+			profile.DoH = tC.doh
+			profile.FingerprintPreset = tC.preset
+			profile.Storage = tC.storage
+			profile.Tracking = tC.tracking
+			assert.NoError(t, writeProfilePrefs(profile, instanceDir))
+
+			userJSPath := filepath.Join(instanceDir, relativeProfilePath, "user.js")
+			if tC.expectedUserJS == "" {
+				assert.NoFileExists(t, userJSPath)
+				return
+			}
+			actualUserJS, err := os.ReadFile(userJSPath)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedUserJS, string(actualUserJS))
+		})
+	}
+}
+
+func TestWriteProfilePrefsUnknownPreset(t *testing.T) {
+	_, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	profile.FingerprintPreset = strPtr("nonexistent")
+	assert.Error(t, writeProfilePrefs(profile, instanceDir))
+}
+
+func TestWriteProfilePrefsInvalidDoH(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		doh DoHConfiguration
+	}{
+		{
+			desc: "Unknown mode",
+
+			doh: DoHConfiguration{
+				Mode:        "sometimes",
+				ResolverURL: "https://dns.example/dns-query",
+			},
+		},
+		{
+			desc: "Missing resolver URL",
+
+			doh: DoHConfiguration{
+				Mode: "only",
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+
+			profile.DoH = &tC.doh
+			assert.Error(t, writeProfilePrefs(profile, instanceDir))
+		})
+	}
+}
+
+func TestVerifyInstance(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	profile.Storage = &StorageConfiguration{
+		CacheCapacityKiB: intPtr(51200),
+	}
+
+	err := VerifyInstance(config, profile, instance)
+	assert.ErrorIs(t, err, ErrInstanceVerificationFailed)
+	assert.Contains(t, err.Error(), "browser.cache.disk.capacity is not set (want 51200)")
+
+	assert.NoError(t, writeProfilePrefs(profile, instanceDir))
+	assert.NoError(t, VerifyInstance(config, profile, instance))
+
+	assert.NoError(t, appendUserPrefs(instanceDir, []userPref{{"browser.cache.disk.capacity", 1024}}))
+	err = VerifyInstance(config, profile, instance)
+	assert.ErrorIs(t, err, ErrInstanceVerificationFailed)
+	assert.Contains(t, err.Error(), "browser.cache.disk.capacity is 1024 (want 51200)")
+}
+
+func TestVerifyInstanceNoPasswordManager(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	profile.NoPasswordManager = boolPtr(true)
+	assert.NoError(t, writeProfilePrefs(profile, instanceDir))
+	assert.NoError(t, VerifyInstance(config, profile, instance))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, relativeProfilePath, "logins.json"), []byte("{}"), 0o644))
+	err := VerifyInstance(config, profile, instance)
+	assert.ErrorIs(t, err, ErrInstanceVerificationFailed)
+	assert.Contains(t, err.Error(), "logins.json exists although the profile sets NoPasswordManager")
+
+	profile.NoPasswordManager = nil
+	assert.NoError(t, VerifyInstance(config, profile, instance))
+}
+
+func TestParseUserPrefs(t *testing.T) {
+	actual := parseUserPrefs(ustring.TrimIndentation(`
+		// A comment
+		user_pref("a.bool", true);
+		  user_pref( "a.number" , 12 ) ;
+		user_pref("a.string", "with \"quotes\"");
+		user_pref("invalid", undefined);
+		// user_pref("commented.out", true);
+	`))
+	assert.Equal(t, []userPref{
+		{"a.bool", true},
+		{"a.number", float64(12)},
+		{"a.string", `with "quotes"`},
+	}, actual)
+}
+
+func TestFormatUserPref(t *testing.T) {
+	actual, err := formatUserPref(userPref{"network.trr.uri", "https://dns.example/query?a=1&b=2"})
+	assert.NoError(t, err)
+	assert.Equal(t, `user_pref("network.trr.uri", "https://dns.example/query?a=1&b=2");`, actual)
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// ProfileBundleExtension is the file name extension of profile
+// bundles.
+const ProfileBundleExtension = ".tbmlprofile"
+
+const (
+	profileBundleFormatVersion = 1
+	profileBundleManifestName  = "manifest.json"
+	maxProfileBundleFileSize   = 64 << 20
+)
+
+var ErrInvalidProfileBundle error = errors.New("Invalid profile bundle")
+
+// profileBundleManifest is the first entry of a profile bundle. The
+// file paths in Profile are relative to the bundle and Checksums holds
+// the hex-encoded SHA-256 sum of every file.
+type profileBundleManifest struct {
+	Checksums     map[string]string
+	FormatVersion int
+	Profile       ProfileConfiguration
+}
+
+// ExportProfileDefinition writes a profile bundle to w: a tar.gz
+// archive holding the profile's configuration and the user.js,
+// userChrome.css, icon and extension files it refers to. Relative
+// paths are resolved against configDir. Inherited settings are
+// included, so the bundle doesn't depend on other profiles.
+func ExportProfileDefinition(profile ProfileConfiguration, configDir string, w io.Writer) error {
+	profile.Extends = nil
+	manifest := profileBundleManifest{
+		Checksums:     map[string]string{},
+		FormatVersion: profileBundleFormatVersion,
+	}
+	sourcePaths := map[string]string{}
+	addFile := func(filePath string, bundlePath string) string {
+		// Bundled assets are part of every tbml and downloads are
+		// pinned, so they aren't copied.
+		if !isLocalConfigFile(filePath) {
+			return filePath
+		}
+		sourcePaths[bundlePath] = resolveLocalConfigFile(configDir, filePath)
+		return bundlePath
+	}
+	if profile.UserJSFile != nil {
+		bundlePath := addFile(*profile.UserJSFile, "user.js")
+		profile.UserJSFile = &bundlePath
+	}
+	userJSFiles := []string{}
+	for _, userJSFile := range profile.UserJSFiles {
+		bundlePath := path.Join("user.js.d", filepath.Base(userJSFile))
+		if _, ok := sourcePaths[bundlePath]; ok {
+			return uerror.StackTracef("Profile %s has more than one user.js file named %s", profile.Label, filepath.Base(userJSFile))
+		}
+		userJSFiles = append(userJSFiles, addFile(userJSFile, bundlePath))
+	}
+	profile.UserJSFiles = userJSFiles
+	if profile.UserChromeFile != nil {
+		bundlePath := addFile(*profile.UserChromeFile, "userChrome.css")
+		profile.UserChromeFile = &bundlePath
+	}
+	if profile.Icon != nil {
+		bundlePath := addFile(*profile.Icon, "icon"+filepath.Ext(*profile.Icon))
+		profile.Icon = &bundlePath
+	}
+	extensionFiles := []string{}
+	for _, extensionFile := range profile.ExtensionFiles {
+		bundlePath := path.Join("extensions", filepath.Base(extensionFile))
+		if _, ok := sourcePaths[bundlePath]; ok {
+			return uerror.StackTracef("Profile %s has more than one extension file named %s", profile.Label, filepath.Base(extensionFile))
+		}
+		extensionFiles = append(extensionFiles, addFile(extensionFile, bundlePath))
+	}
+	profile.ExtensionFiles = extensionFiles
+	nativeMessagingHosts := []string{}
+	for _, manifestFile := range profile.NativeMessagingHosts {
+		bundlePath := path.Join("native-messaging-hosts", filepath.Base(manifestFile))
+		if _, ok := sourcePaths[bundlePath]; ok {
+			return uerror.StackTracef("Profile %s has more than one native messaging host manifest named %s", profile.Label, filepath.Base(manifestFile))
+		}
+		nativeMessagingHosts = append(nativeMessagingHosts, addFile(manifestFile, bundlePath))
+	}
+	profile.NativeMessagingHosts = nativeMessagingHosts
+	manifest.Profile = profile
+
+	for bundlePath, sourcePath := range sourcePaths {
+		checksum, err := sha256File(sourcePath)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		manifest.Checksums[bundlePath] = checksum
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Mode:     int64(uio.FileModeURWGRWO),
+		Name:     profileBundleManifestName,
+		Size:     int64(len(manifestBytes)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if _, err := tarWriter.Write(manifestBytes); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	bundlePaths := []string{}
+	for bundlePath := range sourcePaths {
+		bundlePaths = append(bundlePaths, bundlePath)
+	}
+	sort.Strings(bundlePaths)
+	for _, bundlePath := range bundlePaths {
+		if err := addFileToArchive(tarWriter, sourcePaths[bundlePath], bundlePath); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// ImportProfileDefinition extracts a profile bundle to
+// profiles/<label> in configDir after checking the checksums of its
+// files. It returns the profile's configuration with file paths
+// relative to configDir, ready to be added to the configuration file.
+// Profiles that already exist in config aren't overwritten. Since
+// bundles may come from others, a warning is added if the profile
+// runs its own browser command, hooks or native messaging hosts.
+func ImportProfileDefinition(config Configuration, configDir string, r io.Reader, mutations *Mutations, warnings *Warnings) (ProfileConfiguration, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return ProfileConfiguration{}, uerror.StackTracef("%w: %s", ErrInvalidProfileBundle, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	manifest, err := readProfileBundleManifest(tarReader)
+	if err != nil {
+		return ProfileConfiguration{}, uerror.WithStackTrace(err)
+	}
+
+	profile := manifest.Profile
+	if err := validateProfileLabel(profile.Label); err != nil {
+		return ProfileConfiguration{}, uerror.StackTracef("%w: %s", ErrInvalidProfileBundle, err)
+	}
+	if FindProfileByLabel(config, profile.Label) != nil {
+		return ProfileConfiguration{}, uerror.StackTracef("Profile %s already exists", profile.Label)
+	}
+	if problems := getProfileSettingsProblems(profile); len(problems) > 0 {
+		return ProfileConfiguration{}, uerror.StackTracef("%w: %s", ErrInvalidProfileBundle, problems[0])
+	}
+	if len(profile.BrowserCommand) > 0 {
+		warnings.Add(profile.Label, "The profile runs %q instead of the default browser", strings.Join(profile.BrowserCommand, " "))
+	}
+	if hooks := getOwnHooks(profile); len(hooks) > 0 {
+		warnings.Add(profile.Label, "The profile runs %d hooks on this computer: %q", len(hooks), strings.Join(hooks, "; "))
+	}
+	if len(profile.NativeMessagingHosts) > 0 {
+		warnings.Add(profile.Label, "The profile lets extensions start %d native messaging hosts, check their manifests", len(profile.NativeMessagingHosts))
+	}
+
+	relativeDir := filepath.Join("profiles", profile.Label)
+	targetDir := filepath.Join(configDir, relativeDir)
+	exists, err := uio.DirExists(targetDir)
+	if err != nil {
+		return ProfileConfiguration{}, uerror.WithStackTrace(err)
+	}
+	if exists {
+		return ProfileConfiguration{}, uerror.StackTracef("%s already exists", targetDir)
+	}
+	toConfigPath := func(bundlePath string) (string, error) {
+		if !isLocalConfigFile(bundlePath) {
+			return bundlePath, nil
+		}
+		if _, ok := manifest.Checksums[bundlePath]; !ok {
+			return "", fmt.Errorf("%w: %s is not part of the bundle", ErrInvalidProfileBundle, bundlePath)
+		}
+		return filepath.Join(relativeDir, filepath.FromSlash(bundlePath)), nil
+	}
+	if profile.UserJSFile != nil {
+		configPath, err := toConfigPath(*profile.UserJSFile)
+		if err != nil {
+			return ProfileConfiguration{}, uerror.WithStackTrace(err)
+		}
+		profile.UserJSFile = &configPath
+	}
+	for i, userJSFile := range profile.UserJSFiles {
+		configPath, err := toConfigPath(userJSFile)
+		if err != nil {
+			return ProfileConfiguration{}, uerror.WithStackTrace(err)
+		}
+		profile.UserJSFiles[i] = configPath
+	}
+	if profile.UserChromeFile != nil {
+		configPath, err := toConfigPath(*profile.UserChromeFile)
+		if err != nil {
+			return ProfileConfiguration{}, uerror.WithStackTrace(err)
+		}
+		profile.UserChromeFile = &configPath
+	}
+	if profile.Icon != nil {
+		configPath, err := toConfigPath(*profile.Icon)
+		if err != nil {
+			return ProfileConfiguration{}, uerror.WithStackTrace(err)
+		}
+		profile.Icon = &configPath
+	}
+	for i, extensionFile := range profile.ExtensionFiles {
+		configPath, err := toConfigPath(extensionFile)
+		if err != nil {
+			return ProfileConfiguration{}, uerror.WithStackTrace(err)
+		}
+		profile.ExtensionFiles[i] = configPath
+	}
+	for i, manifestFile := range profile.NativeMessagingHosts {
+		configPath, err := toConfigPath(manifestFile)
+		if err != nil {
+			return ProfileConfiguration{}, uerror.WithStackTrace(err)
+		}
+		profile.NativeMessagingHosts[i] = configPath
+	}
+
+	if err := mutations.Apply("Unpack profile bundle to", targetDir, func() error {
+		return extractProfileBundle(tarReader, manifest, targetDir)
+	}); err != nil {
+		return ProfileConfiguration{}, uerror.WithStackTrace(err)
+	}
+	return profile, nil
+}
+
+// extractProfileBundle extracts the files of a bundle to targetDir.
+// They only show up there once all of them are extracted and checked.
+func extractProfileBundle(tarReader *tar.Reader, manifest profileBundleManifest, targetDir string) error {
+	if err := os.MkdirAll(filepath.Dir(targetDir), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(targetDir), ".import-*")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	extracted := map[string]bool{}
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return uerror.StackTracef("%w: %s", ErrInvalidProfileBundle, err)
+		}
+		if err := extractProfileBundleFile(tarReader, header, manifest.Checksums, tmpDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		extracted[header.Name] = true
+	}
+	for bundlePath := range manifest.Checksums {
+		if !extracted[bundlePath] {
+			return uerror.StackTracef("%w: %s is missing", ErrInvalidProfileBundle, bundlePath)
+		}
+	}
+
+	if err := os.Rename(tmpDir, targetDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// ProfileNeedsTrust reports whether a profile from a bundle can run
+// code of its own on this computer, through its browser command and
+// its arguments, its environment variables, its hooks or the programs
+// its native messaging hosts start, or can loosen the default firejail
+// sandbox, e.g. by running a container image or no sandbox at all.
+// Such profiles should only be installed after the user has seen and
+// trusted what they run.
+func ProfileNeedsTrust(profile ProfileConfiguration) bool {
+	if len(profile.BrowserCommand) > 0 || len(profile.ExtraArgs) > 0 || len(profile.Environment) > 0 || len(getOwnHooks(profile)) > 0 || len(profile.NativeMessagingHosts) > 0 {
+		return true
+	}
+	sandbox := getSandboxConfiguration(profile)
+	return sandbox.Optional || sandbox.Type != sandboxTypeFirejail || sandbox.Image != ""
+}
+
+// InspectProfileDefinition returns the configuration of the profile
+// in a bundle without extracting it, e.g. to ask the user whether to
+// trust it. File paths are relative to the bundle.
+func InspectProfileDefinition(r io.Reader) (ProfileConfiguration, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return ProfileConfiguration{}, uerror.StackTracef("%w: %s", ErrInvalidProfileBundle, err)
+	}
+	manifest, err := readProfileBundleManifest(tar.NewReader(gzipReader))
+	if err != nil {
+		return ProfileConfiguration{}, uerror.WithStackTrace(err)
+	}
+	return manifest.Profile, nil
+}
+
+func readProfileBundleManifest(tarReader *tar.Reader) (profileBundleManifest, error) {
+	header, err := tarReader.Next()
+	if err != nil {
+		return profileBundleManifest{}, fmt.Errorf("%w: %s", ErrInvalidProfileBundle, err)
+	}
+	if header.Name != profileBundleManifestName {
+		return profileBundleManifest{}, fmt.Errorf("%w: the bundle doesn't start with its manifest", ErrInvalidProfileBundle)
+	}
+	manifestBytes, err := io.ReadAll(io.LimitReader(tarReader, maxConfigurationSize+1))
+	if err != nil {
+		return profileBundleManifest{}, err
+	}
+	if len(manifestBytes) > maxConfigurationSize {
+		return profileBundleManifest{}, fmt.Errorf("%w: the manifest is too large", ErrInvalidProfileBundle)
+	}
+	var manifest profileBundleManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return profileBundleManifest{}, fmt.Errorf("%w: %s", ErrInvalidProfileBundle, err)
+	}
+	if manifest.FormatVersion != profileBundleFormatVersion {
+		return profileBundleManifest{}, fmt.Errorf("%w: unsupported format version %d", ErrInvalidProfileBundle, manifest.FormatVersion)
+	}
+	return manifest, nil
+}
+
+// extractProfileBundleFile extracts a file listed in the manifest's
+// checksums to dir, failing if its checksum doesn't match.
+func extractProfileBundleFile(tarReader *tar.Reader, header *tar.Header, checksums map[string]string, dir string) error {
+	expectedChecksum, ok := checksums[header.Name]
+	if !ok || header.Typeflag != tar.TypeReg || path.Clean(header.Name) != header.Name || strings.HasPrefix(header.Name, "../") || path.IsAbs(header.Name) {
+		return fmt.Errorf("%w: unexpected entry %s", ErrInvalidProfileBundle, header.Name)
+	}
+	if header.Size > maxProfileBundleFileSize {
+		return fmt.Errorf("%w: %s is too large", ErrInvalidProfileBundle, header.Name)
+	}
+
+	target := filepath.Join(dir, filepath.FromSlash(header.Name))
+	if err := os.MkdirAll(filepath.Dir(target), uio.FileModeURWXGRWXO); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, uio.FileModeURWGRWO)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(tarReader, maxProfileBundleFileSize)); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expectedChecksum {
+		return fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidProfileBundle, header.Name)
+	}
+	return file.Close()
+}
+
+func sha256File(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
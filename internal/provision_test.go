@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestLockProvisioning(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	const provisions = 8
+	active, maxActive := 0, 0
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < provisions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockProvisioning(config, "test")
+			assert.NoError(t, err)
+			mutex.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+			assert.NoError(t, unlock())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, maxActive)
+
+	// Other profiles aren't held up.
+	unlock, err := lockProvisioning(config, "test")
+	assert.NoError(t, err)
+	defer unlock()
+	unlockOther, err := lockProvisioning(config, "other")
+	assert.NoError(t, err)
+	assert.NoError(t, unlockOther())
+}
+
+func TestProvisionInstance(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	assert.NoError(t, ProvisionInstance(context.Background(), config, profile, instance, ""))
+
+	provisioned, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Nil(t, provisioned.UsagePID)
+	assert.NotEmpty(t, provisioned.ProvisionedHash)
+	assert.FileExists(t, filepath.Join(instanceDir, tblFirejailProfileFileName))
+
+	// The instance is released afterwards.
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, unlock())
+}
+
+func TestGetInstanceToProvision(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instance.Created = time.Now()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	assert.NoError(t, writeProfileInstanceForTest(config, ProfileInstance{InstanceLabel: "other-1", ProfileLabel: "other"}))
+
+	testCases := []struct {
+		desc string
+
+		label       string
+		expectError error
+		expectNew   bool
+	}{
+		{
+			desc: "existing instance",
+
+			label: instance.InstanceLabel,
+		},
+		{
+			desc: "new instance",
+
+			label:     "test-ci",
+			expectNew: true,
+		},
+		{
+			desc: "instance of another profile",
+
+			label:       "other-1",
+			expectError: ErrInstanceOfOtherProfile,
+		},
+		{
+			desc: "label with a slash",
+
+			label:       "../test-1",
+			expectError: ErrInvalidInstanceLabel,
+		},
+		{
+			desc: "reserved label",
+
+			label:       ".trash",
+			expectError: ErrInvalidInstanceLabel,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			got, err := GetInstanceToProvision(config, profile, tC.label)
+			if tC.expectError != nil {
+				assert.ErrorIs(t, err, tC.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.label, got.InstanceLabel)
+			assert.Equal(t, profile.Label, got.ProfileLabel)
+			assert.Equal(t, tC.expectNew, got.Created.IsZero())
+		})
+	}
+}
+
+func TestCloneIntoInstance(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		strategy     string
+		immutable    bool
+		expectLinked bool
+	}{
+		{
+			desc: "auto links immutable files",
+
+			immutable:    true,
+			expectLinked: true,
+		},
+		{
+			desc: "auto doesn't link other files",
+		},
+		{
+			desc: "hardlink doesn't link other files",
+
+			strategy: "hardlink",
+		},
+		{
+			desc: "copy doesn't link immutable files",
+
+			strategy:  "copy",
+			immutable: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			dst := filepath.Join(dir, "instance", "dst")
+			assert.NoError(t, os.WriteFile(src, []byte("content"), uio.FileModeURWGRWO))
+
+			config := Configuration{CloneStrategy: tC.strategy}
+			assert.NoError(t, cloneIntoInstance(config, dst, src, tC.immutable))
+
+			srcInfo, err := os.Stat(src)
+			assert.NoError(t, err)
+			dstInfo, err := os.Stat(dst)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectLinked, os.SameFile(srcInfo, dstInfo))
+		})
+	}
+}
+
+func TestGetMutableCloneStrategy(t *testing.T) {
+	dir := t.TempDir()
+	probe, err := ProbeStorage(dir)
+	assert.NoError(t, err)
+	auto := uio.CloneCopy
+	if probe.Reflinks {
+		auto = uio.CloneReflink
+	}
+
+	assert.Equal(t, auto, getMutableCloneStrategy(Configuration{}, dir))
+	assert.Equal(t, auto, getMutableCloneStrategy(Configuration{CloneStrategy: "auto"}, dir))
+	assert.Equal(t, uio.CloneCopy, getMutableCloneStrategy(Configuration{CloneStrategy: "hardlink"}, dir))
+	assert.Equal(t, uio.CloneReflink, getMutableCloneStrategy(Configuration{CloneStrategy: "reflink"}, dir))
+	// Reflinks fall back to copies where the probe fails.
+	assert.Equal(t, uio.CloneReflink, getMutableCloneStrategy(Configuration{}, filepath.Join(dir, "nonexistent")))
+}
+
+func TestReserveInstanceLabel(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	label, err := ReserveInstanceLabel(config, profile)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-2", label)
+	label, err = ReserveInstanceLabel(config, profile)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-3", label)
+
+	// Reservations aren't handed out as free instances.
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	instances = markInstanceInUse(instances, instance)
+	assert.Equal(t, "test-4", GetBestInstance(profile, instances).InstanceLabel)
+
+	reserved, err := GetInstanceToProvision(config, profile, "test-2")
+	assert.NoError(t, err)
+	assert.True(t, reserved.Reserved)
+	assert.NoError(t, ProvisionInstance(context.Background(), config, profile, reserved, ""))
+	provisioned, err := GetProfileInstance(config, "test-2")
+	assert.NoError(t, err)
+	assert.False(t, provisioned.Reserved)
+	assert.NotEmpty(t, provisioned.ProvisionedHash)
+}
+
+func TestProvisionInstances(t *testing.T) {
+	config, profile, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	progress := []int{}
+	results, err := ProvisionInstances(context.Background(), config, profile, 5, 3, "", func(done int, result BatchProvisionResult) {
+		progress = append(progress, done)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, progress)
+	labels := []string{}
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+		labels = append(labels, result.InstanceLabel)
+		provisioned, err := GetProfileInstance(config, result.InstanceLabel)
+		assert.NoError(t, err)
+		assert.False(t, provisioned.Reserved)
+		assert.NotEmpty(t, provisioned.ProvisionedHash)
+	}
+	assert.Equal(t, []string{"test-2", "test-3", "test-4", "test-5", "test-6"}, labels)
+
+	// Failures are reported per instance, which can be provisioned
+	// again by label.
+	profile.UserJSFile = strPtr("missing.js")
+	results, err = ProvisionInstances(context.Background(), config, profile, 2, 2, t.TempDir(), nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, os.ErrNotExist)
+		failed, err := GetProfileInstance(config, result.InstanceLabel)
+		assert.NoError(t, err)
+		assert.Empty(t, failed.ProvisionedHash)
+	}
+}
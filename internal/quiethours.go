@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+const quietHoursTimeLayout = "15:04"
+
+var quietHoursDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// GetQuietHoursEnd returns the end of the quiet hours the profile is
+// in at the given time, or nil if it isn't in quiet hours. If several
+// overlap, the latest end is returned.
+func GetQuietHoursEnd(config Configuration, profile ProfileConfiguration, now time.Time) (*time.Time, error) {
+	var latestEnd *time.Time
+	for _, quietHours := range config.QuietHours {
+		applies := false
+		for _, label := range quietHours.Profiles {
+			applies = applies || label == profile.Label
+		}
+		if !applies {
+			continue
+		}
+		end, err := getTimeWindowEnd(quietHours, now)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if end != nil && (latestEnd == nil || end.After(*latestEnd)) {
+			latestEnd = end
+		}
+	}
+	return latestEnd, nil
+}
+
+// getTimeWindowEnd returns the end of the time window given by the
+// Days, From and To of quietHours if now is in it, or nil otherwise.
+// Its Profiles are ignored.
+func getTimeWindowEnd(quietHours QuietHoursConfiguration, now time.Time) (*time.Time, error) {
+	from, to, err := parseQuietHours(quietHours)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	var latestEnd *time.Time
+	// Windows that started yesterday may not be over yet.
+	for _, dayOffset := range []int{-1, 0} {
+		at := func(days int, offset time.Duration) time.Time {
+			return time.Date(now.Year(), now.Month(), now.Day()+days, int(offset.Hours()), int(offset.Minutes())%60, 0, 0, now.Location())
+		}
+		start := at(dayOffset, from)
+		if !isQuietHoursDay(quietHours, start.Weekday()) {
+			continue
+		}
+		end := at(dayOffset, to)
+		if to <= from {
+			end = at(dayOffset+1, to)
+		}
+		if !now.Before(start) && now.Before(end) && (latestEnd == nil || end.After(*latestEnd)) {
+			latestEnd = &end
+		}
+	}
+	return latestEnd, nil
+}
+
+// parseQuietHours returns the start and end of quiet hours as offsets
+// from midnight.
+func parseQuietHours(quietHours QuietHoursConfiguration) (from time.Duration, to time.Duration, err error) {
+	parse := func(clock string) (time.Duration, error) {
+		t, err := time.Parse(quietHoursTimeLayout, clock)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid time of day %q, use e.g. 22:00", clock)
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	if from, err = parse(quietHours.From); err != nil {
+		return 0, 0, err
+	}
+	if to, err = parse(quietHours.To); err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+func isQuietHoursDay(quietHours QuietHoursConfiguration, weekday time.Weekday) bool {
+	if len(quietHours.Days) == 0 {
+		return true
+	}
+	for _, day := range quietHours.Days {
+		if d, ok := quietHoursDays[strings.ToLower(day)]; ok && d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func validateQuietHours(quietHours QuietHoursConfiguration) error {
+	if err := validateTimeWindow(quietHours); err != nil {
+		return err
+	}
+	if len(quietHours.Profiles) == 0 {
+		return errors.New("The quiet hours apply to no profile")
+	}
+	return nil
+}
+
+// validateTimeWindow checks the Days, From and To of quietHours.
+func validateTimeWindow(quietHours QuietHoursConfiguration) error {
+	if _, _, err := parseQuietHours(quietHours); err != nil {
+		return err
+	}
+	for _, day := range quietHours.Days {
+		if _, ok := quietHoursDays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("Unknown day %q (available: mon, tue, wed, thu, fri, sat, sun)", day)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetQuietHoursEnd(t *testing.T) {
+	profile := ProfileConfiguration{Label: "social"}
+	config := Configuration{
+		QuietHours: []QuietHoursConfiguration{
+			{
+				From:     "22:00",
+				Profiles: []string{"social", "news"},
+				To:       "07:00",
+			},
+			{
+				Days:     []string{"mon", "Tue", "wed", "thu", "fri"},
+				From:     "09:00",
+				Profiles: []string{"social"},
+				To:       "17:00",
+			},
+			{
+				From:     "12:00",
+				Profiles: []string{"news"},
+				To:       "13:00",
+			},
+		},
+	}
+	// 2024-01-01 is a Monday.
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2024, time.January, day, hour, min, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		desc string
+
+		expectedEnd *time.Time
+		now         time.Time
+	}{
+		{
+			desc: "Before midnight",
+
+			expectedEnd: timePtr(at(2, 7, 0)),
+			now:         at(1, 23, 30),
+		},
+		{
+			desc: "After midnight",
+
+			expectedEnd: timePtr(at(2, 7, 0)),
+			now:         at(2, 6, 59),
+		},
+		{
+			desc: "At the end",
+
+			now: at(2, 7, 0),
+		},
+		{
+			desc: "Weekday",
+
+			expectedEnd: timePtr(at(3, 17, 0)),
+			now:         at(3, 9, 0),
+		},
+		{
+			desc: "Weekend",
+
+			now: at(6, 12, 0),
+		},
+		{
+			desc: "Other profile",
+
+			now: at(6, 12, 30),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			end, err := GetQuietHoursEnd(config, profile, tC.now)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedEnd, end)
+		})
+	}
+}
+
+func TestValidateQuietHours(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectError bool
+		quietHours  QuietHoursConfiguration
+	}{
+		{
+			desc: "Valid",
+
+			quietHours: QuietHoursConfiguration{Days: []string{"sat", "sun"}, From: "22:00", Profiles: []string{"a"}, To: "7:00"},
+		},
+		{
+			desc: "Invalid time",
+
+			expectError: true,
+			quietHours:  QuietHoursConfiguration{From: "10pm", Profiles: []string{"a"}, To: "07:00"},
+		},
+		{
+			desc: "Unknown day",
+
+			expectError: true,
+			quietHours:  QuietHoursConfiguration{Days: []string{"monday"}, From: "22:00", Profiles: []string{"a"}, To: "07:00"},
+		},
+		{
+			desc: "No profiles",
+
+			expectError: true,
+			quietHours:  QuietHoursConfiguration{From: "22:00", To: "07:00"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := validateQuietHours(tC.quietHours)
+			if tC.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"errors"
+	"syscall"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+// ReapResult describes an instance that was found dead by
+// ReapDeadInstances.
+type ReapResult struct {
+	Deleted  bool
+	Instance ProfileInstance
+}
+
+// ReapDeadInstances finds instances that are recorded as in use but
+// whose process is gone, e.g. because the browser or tbml crashed.
+// Their usage is cleared so they can be reused, and ephemeral ones are
+// deleted. Instances that were locked again since, e.g. by a launch,
+// are skipped.
+func ReapDeadInstances(config Configuration, mutations *Mutations, warnings *Warnings) ([]ReapResult, error) {
+	instances, err := readProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	results := []ReapResult{}
+	for _, instance := range instances {
+		dead, err := isInstanceDead(config, instance)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if !dead {
+			continue
+		}
+
+		if instance.Ephemeral {
+			err := DeleteInstance(config, instance, mutations)
+			if errors.Is(err, ErrInstanceInUse) {
+				// It was launched again in the meantime.
+				continue
+			}
+			if err != nil {
+				return nil, uerror.WithStackTrace(err)
+			}
+			results = append(results, ReapResult{Deleted: true, Instance: instance})
+			continue
+		}
+		if instance.UsagePID == nil && instance.UsageLabel == nil {
+			continue
+		}
+		released, err := releaseDeadInstance(config, instance, mutations)
+		if errors.Is(err, ErrInstanceInUse) {
+			continue
+		}
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if released != nil {
+			results = append(results, ReapResult{Instance: *released})
+		}
+	}
+	return results, nil
+}
+
+// releaseDeadInstance clears the usage of an instance found dead. The
+// instance is locked while its metadata is rewritten, so it isn't
+// overwritten by a launch in the meantime; if it can't be locked, the
+// error wraps ErrInstanceInUse. It returns the released instance, or
+// nil if it was released by someone else already.
+func releaseDeadInstance(config Configuration, instance ProfileInstance, mutations *Mutations) (*ProfileInstance, error) {
+	var released *ProfileInstance
+	err := mutations.Apply("Release instance", instance.InstanceLabel, func() error {
+		unlock, err := LockInstance(config, instance)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer unlock()
+
+		stored, err := GetProfileInstance(config, instance.InstanceLabel)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if stored.UsagePID == nil && stored.UsageLabel == nil {
+			return nil
+		}
+		clearInstanceUsage(&stored)
+		if err := writeProfileInstance(config, stored); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		ulog.Default().Info("Released dead instance", "instance", instance.InstanceLabel)
+		released = &stored
+		return nil
+	})
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if mutations != nil && mutations.DryRun {
+		clearInstanceUsage(&instance)
+		return &instance, nil
+	}
+	return released, nil
+}
+
+func clearInstanceUsage(instance *ProfileInstance) {
+	instance.Attached = false
+	instance.BrowserPID = nil
+	instance.ControlPort = nil
+	instance.SOCKSPort = nil
+	instance.UsageLabel = nil
+	instance.UsagePID = nil
+}
+
+// isInstanceDead checks whether an instance isn't running. Unlike
+// isInstanceInUse, instances without a lock file are checked for
+// whether their stored process is still alive.
+func isInstanceDead(config Configuration, instance ProfileInstance) (bool, error) {
+	locked, hasLockFile, err := instanceLockState(config, instance)
+	if err != nil {
+		return false, uerror.WithStackTrace(err)
+	}
+	if hasLockFile {
+		return !locked && !isAttachedProcessAlive(instance), nil
+	}
+	if instance.UsagePID == nil {
+		return true, nil
+	}
+	return !isProcessAlive(*instance.UsagePID), nil
+}
+
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means the process exists but belongs to someone else.
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReapDeadInstances(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	topic := "news"
+	ownPID := os.Getpid()
+	deadPID := findDeadPID(t)
+	running := ProfileInstance{InstanceLabel: "test-1", ProfileLabel: "test", UsageLabel: &topic, UsagePID: &deadPID}
+	crashed := ProfileInstance{InstanceLabel: "test-2", ProfileLabel: "test", UsageLabel: &topic, UsagePID: &deadPID}
+	crashedEphemeral := ProfileInstance{Ephemeral: true, InstanceLabel: "test-3", ProfileLabel: "test", UsageLabel: &topic, UsagePID: &deadPID}
+	legacy := ProfileInstance{InstanceLabel: "test-4", ProfileLabel: "test", UsageLabel: &topic, UsagePID: &ownPID}
+	legacyDead := ProfileInstance{InstanceLabel: "test-5", ProfileLabel: "test", UsageLabel: &topic, UsagePID: &deadPID}
+	for _, instance := range []ProfileInstance{running, crashed, crashedEphemeral, legacy, legacyDead} {
+		assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	}
+	for _, instance := range []ProfileInstance{running, crashed, crashedEphemeral} {
+		unlock, err := LockInstance(config, instance)
+		assert.NoError(t, err)
+		if instance.InstanceLabel == running.InstanceLabel {
+			defer unlock()
+		} else {
+			assert.NoError(t, unlock())
+		}
+	}
+
+	results, err := ReapDeadInstances(config, nil, nil)
+	assert.NoError(t, err)
+	reaped := map[string]bool{}
+	for _, result := range results {
+		reaped[result.Instance.InstanceLabel] = result.Deleted
+	}
+	assert.Equal(t, map[string]bool{"test-2": false, "test-3": true, "test-5": false}, reaped)
+
+	instances, err := readProfileInstances(config, nil)
+	assert.NoError(t, err)
+	instancesByLabel := map[string]ProfileInstance{}
+	for _, instance := range instances {
+		instancesByLabel[instance.InstanceLabel] = instance
+	}
+	assert.NotContains(t, instancesByLabel, "test-3")
+	assert.Nil(t, instancesByLabel["test-2"].UsageLabel)
+	assert.Nil(t, instancesByLabel["test-2"].UsagePID)
+	assert.Nil(t, instancesByLabel["test-5"].UsagePID)
+	assert.Equal(t, &topic, instancesByLabel["test-1"].UsageLabel)
+	assert.Equal(t, &ownPID, instancesByLabel["test-4"].UsagePID)
+
+	results, err = ReapDeadInstances(config, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestReleaseDeadInstance(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	topic := "news"
+	deadPID := findDeadPID(t)
+	instance := ProfileInstance{InstanceLabel: "test-1", ProfileLabel: "test", UsageLabel: &topic, UsagePID: &deadPID}
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	// A launch took the lock after the instance was found dead.
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	released, err := releaseDeadInstance(config, instance, nil)
+	assert.ErrorIs(t, err, ErrInstanceInUse)
+	assert.Nil(t, released)
+	stored, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, &topic, stored.UsageLabel)
+	assert.NoError(t, unlock())
+
+	released, err = releaseDeadInstance(config, instance, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, released) {
+		assert.Nil(t, released.UsagePID)
+	}
+	stored, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Nil(t, stored.UsageLabel)
+
+	// Someone else released it already.
+	released, err = releaseDeadInstance(config, instance, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, released)
+}
+
+// findDeadPID returns a PID that no process is using right now.
+func findDeadPID(t *testing.T) int {
+	for pid := 4194303; pid > 1; pid-- {
+		if !isProcessAlive(pid) {
+			return pid
+		}
+	}
+	t.Fatal("No unused PID found")
+	return 0
+}
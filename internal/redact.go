@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	redactedTopic = "<topic>"
+	redactedURL   = "<url>"
+	redactedUser  = "<user>"
+)
+
+var (
+	redactableURLPattern   = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s"'<>]+`)
+	redactableTopicPattern = regexp.MustCompile(`[^\s"'=,;:()\[\]{}<>]+`)
+)
+
+// Redactor masks private details in text that is shown to others, like
+// log entries, error messages and debug bundles: URLs, the user's home
+// directory and name in paths and topics matching the configuration's
+// SensitiveTopics. A nil Redactor leaves text alone, which is what
+// --no-redact does.
+type Redactor struct {
+	homeDir         string
+	sensitiveTopics []string
+	userPattern     *regexp.Regexp
+}
+
+// NewRedactor creates a Redactor for the current user. Topics are only
+// masked once SetSensitiveTopics was called.
+func NewRedactor() *Redactor {
+	r := &Redactor{}
+	if homeDir, err := os.UserHomeDir(); err == nil && homeDir != "/" {
+		r.homeDir = strings.TrimSuffix(homeDir, "/")
+	}
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		r.userPattern = regexp.MustCompile(`/` + regexp.QuoteMeta(current.Username) + `\b`)
+	}
+	return r
+}
+
+// SetSensitiveTopics sets the patterns of the topics to mask, see
+// Configuration.SensitiveTopics.
+func (r *Redactor) SetSensitiveTopics(patterns []string) {
+	if r == nil {
+		return
+	}
+	r.sensitiveTopics = patterns
+}
+
+func (r *Redactor) Redact(text string) string {
+	if r == nil {
+		return text
+	}
+	text = redactableURLPattern.ReplaceAllString(text, redactedURL)
+	if r.homeDir != "" {
+		text = strings.ReplaceAll(text, r.homeDir, "~")
+	}
+	if r.userPattern != nil {
+		text = r.userPattern.ReplaceAllString(text, "/"+redactedUser)
+	}
+	if len(r.sensitiveTopics) > 0 {
+		text = redactableTopicPattern.ReplaceAllStringFunc(text, func(word string) string {
+			if r.isSensitiveTopic(word) {
+				return redactedTopic
+			}
+			return word
+		})
+	}
+	return text
+}
+
+// isSensitiveTopic tells whether the topic or one of its parent topics
+// matches one of the SensitiveTopics.
+func (r *Redactor) isSensitiveTopic(topic string) bool {
+	for {
+		for _, pattern := range r.sensitiveTopics {
+			if matches, _ := path.Match(pattern, topic); matches {
+				return true
+			}
+		}
+		i := strings.LastIndex(topic, "/")
+		if i <= 0 {
+			return false
+		}
+		topic = topic[:i]
+	}
+}
+
+// RedactError returns an error with the redacted message of err that
+// still unwraps to err, so exit codes and error kinds are kept.
+func (r *Redactor) RedactError(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	return redactedError{message: r.Redact(err.Error()), wrapped: err}
+}
+
+type redactedError struct {
+	message string
+	wrapped error
+}
+
+func (e redactedError) Error() string {
+	return e.message
+}
+
+func (e redactedError) Unwrap() error {
+	return e.wrapped
+}
+
+// Writer returns a writer that redacts what is written to w. Each
+// write is redacted on its own, so entries must be written whole, like
+// the logger does.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return redactingWriter{redactor: r, w: w}
+}
+
+type redactingWriter struct {
+	redactor *Redactor
+	w        io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.redactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+func TestRedact(t *testing.T) {
+	redactor := &Redactor{
+		homeDir:     "/home/alice",
+		userPattern: regexp.MustCompile(`/alice\b`),
+	}
+	redactor.SetSensitiveTopics([]string{"health", "bank*"})
+
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"Home directory", "open /home/alice/.cache/tbml/x: no such file", "open ~/.cache/tbml/x: no such file"},
+		{"User name in other paths", "/run/media/alice/disk and /tmp/alicexyz", "/run/media/<user>/disk and /tmp/alicexyz"},
+		{"URL", `Opening url="https://example.com/?q=secret" in work`, `Opening url="<url>" in work`},
+		{"Topic", "Launching instance=test-1 topic=health", "Launching instance=test-1 topic=<topic>"},
+		{"Subtopic", `{"topic":"health/doctor"}`, `{"topic":"<topic>"}`},
+		{"Topic pattern", "Topic banking is not open", "Topic <topic> is not open"},
+		{"Other topics", "Topic healthy is not open", "Topic healthy is not open"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, redactor.Redact(test.text))
+		})
+	}
+
+	var noRedactor *Redactor
+	assert.Equal(t, "https://example.com", noRedactor.Redact("https://example.com"))
+}
+
+func TestRedactError(t *testing.T) {
+	redactor := &Redactor{homeDir: "/home/alice"}
+	err := uerror.WithExitCode(3, errors.New("/home/alice/config.json is broken"))
+
+	redacted := redactor.RedactError(err)
+	assert.Equal(t, "~/config.json is broken", redacted.Error())
+	assert.ErrorIs(t, redacted, err)
+	exitCode, hasExitCode := uerror.GetExitCode(redacted)
+	assert.True(t, hasExitCode)
+	assert.Equal(t, uint(3), exitCode)
+
+	assert.NoError(t, redactor.RedactError(nil))
+}
+
+func TestRedactorWriter(t *testing.T) {
+	redactor := &Redactor{homeDir: "/home/alice"}
+	buffer := bytes.Buffer{}
+	n, err := redactor.Writer(&buffer).Write([]byte("Read /home/alice/x\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, len("Read /home/alice/x\n"), n)
+	assert.Equal(t, "Read ~/x\n", buffer.String())
+}
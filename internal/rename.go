@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrTopicTaken error = errors.New("Topic belongs to another instance")
+
+// RenameInstance gives an instance that isn't in use a new label. The
+// instance's directory in the profile path is renamed along with it,
+// since the label is the name of that directory.
+func RenameInstance(config Configuration, instance ProfileInstance, newLabel string, mutations *Mutations) error {
+	if !isValidInstanceLabel(newLabel) {
+		return uerror.StackTracef("%w: %q", ErrInvalidInstanceLabel, newLabel)
+	}
+	taken, err := isInstanceLabelTaken(config, newLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if taken {
+		return uerror.StackTracef("%w: %s", ErrInstanceExists, newLabel)
+	}
+	inUse, err := isInstanceInUse(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if inUse {
+		return uerror.StackTracef("%w: %s is currently in use", ErrInstanceInUse, instance.InstanceLabel)
+	}
+	return mutations.Apply("Rename instance", instance.InstanceLabel, func() error {
+		return renameInstance(config, instance, newLabel)
+	})
+}
+
+func renameInstance(config Configuration, instance ProfileInstance, newLabel string) error {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	renamed := instance
+	renamed.InstanceLabel = newLabel
+	// Renaming a directory replaces an empty directory, so the label is
+	// checked again right before.
+	if taken, err := isInstanceLabelTaken(config, newLabel); err != nil || taken {
+		return uerror.StackTracef("%w: %s", ErrInstanceExists, newLabel)
+	}
+	if err := os.Rename(getInstanceRecordDir(config, instance), getInstanceRecordDir(config, renamed)); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	invalidateInstanceCache(config)
+	// Files kept in a profile's own ProfilePath are renamed as well, so
+	// a new instance with the old label doesn't get their directory.
+	if instance.Directory != nil && !instance.Ephemeral && filepath.Base(*instance.Directory) == instance.InstanceLabel {
+		directory := filepath.Join(filepath.Dir(*instance.Directory), newLabel)
+		if err := os.Rename(*instance.Directory, directory); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			os.Rename(getInstanceRecordDir(config, renamed), getInstanceRecordDir(config, instance))
+			return uerror.WithStackTrace(err)
+		}
+		renamed, err = GetProfileInstance(config, newLabel)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		renamed.Directory = &directory
+		if err := writeProfileInstance(config, renamed); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	ulog.Default().Info("Renamed instance", "instance", instance.InstanceLabel, "newLabel", newLabel)
+	return nil
+}
+
+// SetInstanceTopic moves an instance that isn't in use to another
+// topic, or takes its topic away if topic is nil. A topic can only
+// belong to one instance.
+func SetInstanceTopic(config Configuration, instance ProfileInstance, topic *string, mutations *Mutations) error {
+	if topic != nil && strings.TrimSpace(*topic) == "" {
+		topic = nil
+	}
+	if topic != nil {
+		instances, err := readProfileInstances(config, nil)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if other := findInstanceByExactTopic(config, instances, *topic); other != nil && other.InstanceLabel != instance.InstanceLabel {
+			return uerror.StackTracef("%w: %s is used by %s", ErrTopicTaken, *topic, other.InstanceLabel)
+		}
+	}
+	inUse, err := isInstanceInUse(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if inUse {
+		return uerror.StackTracef("%w: %s is currently in use", ErrInstanceInUse, instance.InstanceLabel)
+	}
+	return mutations.Apply("Set topic of instance", instance.InstanceLabel, func() error {
+		unlock, err := LockInstance(config, instance)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		defer unlock()
+
+		instance, err := GetProfileInstance(config, instance.InstanceLabel)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		instance.UsageLabel = topic
+		if err := writeProfileInstance(config, instance); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if topic != nil {
+			ulog.Default().Info("Set topic of instance", "instance", instance.InstanceLabel, "topic", *topic)
+		} else {
+			ulog.Default().Info("Removed topic of instance", "instance", instance.InstanceLabel)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameInstance(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	other := instance
+	other.InstanceLabel = "test-2"
+	assert.NoError(t, writeProfileInstanceForTest(config, other))
+
+	assert.ErrorIs(t, RenameInstance(config, instance, "../escape", nil), ErrInvalidInstanceLabel)
+	assert.ErrorIs(t, RenameInstance(config, instance, ".state", nil), ErrInvalidInstanceLabel)
+	assert.ErrorIs(t, RenameInstance(config, instance, "test-2", nil), ErrInstanceExists)
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, RenameInstance(config, instance, "renamed", nil), ErrInstanceInUse)
+	assert.NoError(t, unlock())
+
+	assert.NoError(t, RenameInstance(config, instance, "renamed", &Mutations{DryRun: true}))
+	_, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+
+	assert.NoError(t, RenameInstance(config, instance, "renamed", nil))
+	_, err = os.Stat(filepath.Join(config.ProfilePath, instance.InstanceLabel))
+	assert.True(t, os.IsNotExist(err))
+	renamed, err := GetProfileInstance(config, "renamed")
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", renamed.InstanceLabel)
+	assert.Equal(t, instance.UsageLabel, renamed.UsageLabel)
+}
+
+func TestSetInstanceTopic(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	otherTopic := "other"
+	other := instance
+	other.InstanceLabel = "test-2"
+	other.UsageLabel = &otherTopic
+	assert.NoError(t, writeProfileInstanceForTest(config, other))
+
+	assert.ErrorIs(t, SetInstanceTopic(config, instance, &otherTopic, nil), ErrTopicTaken)
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	topic := "work/projectX"
+	assert.ErrorIs(t, SetInstanceTopic(config, instance, &topic, nil), ErrInstanceInUse)
+	assert.NoError(t, unlock())
+
+	assert.NoError(t, SetInstanceTopic(config, instance, &topic, nil))
+	moved, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, &topic, moved.UsageLabel)
+	// Setting the topic an instance already has is fine.
+	assert.NoError(t, SetInstanceTopic(config, instance, &topic, nil))
+
+	assert.NoError(t, SetInstanceTopic(config, instance, nil, nil))
+	cleared, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Nil(t, cleared.UsageLabel)
+}
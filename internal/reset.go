@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const templatesDirName = "templates"
+
+// instanceRecordNames are entries of an instance directory that belong
+// to tbml rather than the browser. They are kept when the instance is
+// reset and left out of templates.
+var instanceRecordNames = map[string]bool{
+	"profile-instance.json":    true,
+	crashBundleDirName:         true,
+	instanceDataBackupFileName: true,
+	instanceLockFileName:       true,
+	instanceLogFileName:        true,
+	instanceLogFileName + ".1": true,
+}
+
+func shouldResetOnExit(profile ProfileConfiguration) bool {
+	return profile.ResetOnExit != nil && *profile.ResetOnExit
+}
+
+// getInstanceTemplateDir returns where the pristine files of the
+// profile's instances provisioned with the given hash are kept.
+func getInstanceTemplateDir(config Configuration, profileLabel string, hash string) string {
+	return filepath.Join(getStateDir(config), templatesDirName, profileLabel, hash)
+}
+
+// isPristineInstanceDir tells whether the instance directory holds
+// none of the browser's files, i.e. was just created or reset without
+// a template.
+func isPristineInstanceDir(instanceDir string) (bool, error) {
+	entries, err := os.ReadDir(instanceDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, uerror.WithStackTrace(err)
+	}
+	for _, entry := range entries {
+		if !instanceRecordNames[entry.Name()] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// saveInstanceTemplate keeps a copy of a pristine instance's freshly
+// provisioned files, so resetInstanceFiles doesn't have to provision
+// the instance from scratch. Templates for older provisioning hashes
+// of the profile are removed. It must be called before the browser
+// touches the files.
+func saveInstanceTemplate(config Configuration, profile ProfileConfiguration, instanceLabel string, instanceDir string) error {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if instance.ProvisionedHash == "" {
+		return nil
+	}
+	unlockProvisioning, err := lockProvisioning(config, profile.Label)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlockProvisioning()
+
+	templateDir := getInstanceTemplateDir(config, profile.Label, instance.ProvisionedHash)
+	exists, err := uio.DirExists(templateDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if exists {
+		return nil
+	}
+	profileTemplatesDir := filepath.Dir(templateDir)
+	if err := os.RemoveAll(profileTemplatesDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := os.MkdirAll(profileTemplatesDir, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// The template only appears once it is complete.
+	tmpDir, err := os.MkdirTemp(profileTemplatesDir, ".tmp-*")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := cloneInstanceFiles(config, instanceDir, tmpDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return uerror.WithStackTrace(err)
+	}
+	if err := os.Rename(tmpDir, templateDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// resetInstanceFiles deletes the browser's files from an instance and
+// restores the template it was provisioned from, if there is one.
+// Otherwise the instance is left empty and marked as unprovisioned, so
+// the next launch provisions it from scratch. The instance must be
+// locked by the caller.
+func resetInstanceFiles(config Configuration, profile ProfileConfiguration, instanceLabel string, instanceDir string) error {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	provisionedHash := instance.ProvisionedHash
+	installedExtensions := instance.InstalledExtensions
+	installedNativeMessagingHosts := instance.InstalledNativeMessagingHosts
+
+	// Until the template is restored, the instance counts as
+	// unprovisioned, so a failed reset is repaired by the next sync.
+	instance.ProvisionedHash = ""
+	instance.InstalledExtensions = nil
+	instance.InstalledNativeMessagingHosts = nil
+	if err := writeProfileInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	entries, err := os.ReadDir(instanceDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, entry := range entries {
+		if instanceRecordNames[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(instanceDir, entry.Name())); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if provisionedHash == "" {
+		return nil
+	}
+
+	unlockProvisioning, err := lockProvisioning(config, profile.Label)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlockProvisioning()
+	templateDir := getInstanceTemplateDir(config, profile.Label, provisionedHash)
+	exists, err := uio.DirExists(templateDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !exists {
+		return nil
+	}
+	if err := cloneInstanceFiles(config, templateDir, instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.ProvisionedHash = provisionedHash
+	instance.InstalledExtensions = installedExtensions
+	instance.InstalledNativeMessagingHosts = installedNativeMessagingHosts
+	return writeProfileInstance(config, instance)
+}
+
+// cloneInstanceFiles clones the browser's files from one directory to
+// another with the strategy picked for files the browser changes,
+// leaving out instanceRecordNames. Copies are made by several workers
+// at once.
+func cloneInstanceFiles(config Configuration, srcDir string, dstDir string) error {
+	strategy := getMutableCloneStrategy(config, dstDir)
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, entry := range entries {
+		if instanceRecordNames[entry.Name()] {
+			continue
+		}
+		src, dst := filepath.Join(srcDir, entry.Name()), filepath.Join(dstDir, entry.Name())
+		if entry.IsDir() {
+			err = uio.CloneDirConcurrently(src, dst, strategy, runtime.NumCPU())
+		} else {
+			var info fs.FileInfo
+			info, err = entry.Info()
+			if err == nil {
+				err = uio.CloneFile(src, dst, info.Mode().Perm(), strategy)
+			}
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
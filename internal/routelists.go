@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const (
+	routeListsDirName       = "route-lists"
+	defaultRouteListRefresh = 24 * time.Hour
+)
+
+// errRouteListNotDownloaded means a route's list is an HTTPS URL that
+// RefreshRouteLists hasn't downloaded yet.
+var errRouteListNotDownloaded error = errors.New("The route's list hasn't been downloaded yet")
+
+// hostsFileLocalNames are the names hosts files commonly give the local
+// machine, which aren't domains to route.
+var hostsFileLocalNames = map[string]bool{
+	"0.0.0.0":               true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"local":                 true,
+	"localhost":             true,
+	"localhost.localdomain": true,
+}
+
+// parseDomainList parses a list of domains in the format of a hosts
+// file ("0.0.0.0 example.com"), of a uBlock-style filter list
+// ("||example.com^") or with one domain per line. Comments and filters
+// that don't block a whole domain, e.g. cosmetic filters, exceptions or
+// filters with options, are skipped.
+func parseDomainList(content []byte) map[string]bool {
+	domains := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		names := strings.Fields(line)
+		for i, name := range names {
+			if strings.HasPrefix(name, "#") {
+				names = names[:i]
+				break
+			}
+		}
+		if len(names) == 0 || strings.ContainsAny(strings.Join(names, " "), "#!@[$") {
+			continue
+		}
+		if net.ParseIP(names[0]) != nil {
+			names = names[1:]
+		} else if len(names) > 1 {
+			continue
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, "||") {
+				if !strings.HasSuffix(name, "^") {
+					continue
+				}
+				name = strings.TrimSuffix(strings.TrimPrefix(name, "||"), "^")
+			}
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			if isListDomain(name) && !hostsFileLocalNames[name] {
+				domains[name] = true
+			}
+		}
+	}
+	return domains
+}
+
+func isListDomain(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "-") {
+		return false
+	}
+	for _, char := range name {
+		if !(char >= 'a' && char <= 'z' || char >= '0' && char <= '9' || char == '.' || char == '-' || char == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// domainListContains tells whether a host name or one of the domains
+// it is in is listed.
+func domainListContains(domains map[string]bool, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for host != "" {
+		if domains[host] {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+func isRemoteRouteList(list string) bool {
+	return strings.HasPrefix(list, httpsScheme)
+}
+
+// getCachedRouteListPath returns where the last download of a route
+// list that is an HTTPS URL is kept.
+func getCachedRouteListPath(config Configuration, list string) string {
+	sum := sha256.Sum256([]byte(list))
+	return filepath.Join(getStateDir(config), routeListsDirName, hex.EncodeToString(sum[:]))
+}
+
+func getRouteListRefresh(route RouteConfiguration) time.Duration {
+	if route.ListRefreshHours == nil {
+		return defaultRouteListRefresh
+	}
+	return time.Duration(*route.ListRefreshHours) * time.Hour
+}
+
+// readRouteList reads a route's list: local files are resolved against
+// configDir, HTTPS URLs are read from where RefreshRouteLists put them.
+func readRouteList(config Configuration, configDir string, list string) (map[string]bool, error) {
+	path := resolveLocalConfigFile(configDir, list)
+	if isRemoteRouteList(list) {
+		path = getCachedRouteListPath(config, list)
+	}
+	content, err := uio.ReadFileLimited(path, maxConfigFileSize)
+	if isRemoteRouteList(list) && errors.Is(err, fs.ErrNotExist) {
+		return nil, errRouteListNotDownloaded
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return parseDomainList(content), nil
+}
+
+// RefreshRouteLists downloads the lists of routes that are HTTPS URLs
+// again if the last download is older than the route's
+// ListRefreshHours, or if force is set. Lists that fail to download
+// keep their last download, and the failures are reported after all
+// lists were tried.
+func RefreshRouteLists(ctx context.Context, client *http.Client, config Configuration, force bool) error {
+	seen := map[string]bool{}
+	failed := []string{}
+	var firstErr error
+	for _, route := range config.Routes {
+		if route.List == nil || !isRemoteRouteList(*route.List) || seen[*route.List] {
+			continue
+		}
+		seen[*route.List] = true
+		cachedPath := getCachedRouteListPath(config, *route.List)
+		if !force {
+			info, err := os.Stat(cachedPath)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return uerror.WithStackTrace(err)
+			}
+			if err == nil && time.Since(info.ModTime()) < getRouteListRefresh(route) {
+				continue
+			}
+		}
+
+		downloadCtx, cancel := context.WithTimeout(ctx, GetDownloadTimeout(config))
+		content, err := downloadLimited(downloadCtx, client, *route.List, maxConfigFileSize)
+		cancel()
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(cachedPath), uio.FileModeURWXGRWXO)
+		}
+		if err == nil {
+			err = uio.WriteFileAtomic(cachedPath, content, uio.FileModeURWGRWO)
+		}
+		if err != nil {
+			failed = append(failed, *route.List)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return uerror.StackTracef("Failed to refresh %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+	return nil
+}
+
+func validateRouteList(route RouteConfiguration) error {
+	if route.ListRefreshHours != nil && *route.ListRefreshHours <= 0 {
+		return fmt.Errorf("ListRefreshHours must be positive")
+	}
+	if route.List == nil {
+		return nil
+	}
+	if strings.HasPrefix(*route.List, "http:") {
+		return fmt.Errorf("%w: %s", ErrInsecureURL, *route.List)
+	}
+	if isRemoteRouteList(*route.List) {
+		if parsedURL, err := url.Parse(*route.List); err != nil || parsedURL.Host == "" {
+			return fmt.Errorf("%s is not a valid URL", *route.List)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDomainList(t *testing.T) {
+	domains := parseDomainList([]byte(`# hosts file
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 tracker.example.com ads.example.com # inline comment
+! uBlock-style
+[Adblock Plus 2.0]
+||social.example^
+||third-party.example^$third-party
+@@||allowed.example^
+example.org##.banner
+||example.net/path
+Plain.Example.
+`))
+	assert.Equal(t, map[string]bool{
+		"ads.example.com":     true,
+		"plain.example":       true,
+		"social.example":      true,
+		"tracker.example.com": true,
+	}, domains)
+
+	assert.True(t, domainListContains(domains, "social.example"))
+	assert.True(t, domainListContains(domains, "www.Social.example"))
+	assert.False(t, domainListContains(domains, "example.com"))
+	assert.False(t, domainListContains(domains, "notsocial.example"))
+}
+
+func TestRouteList(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("0.0.0.0 news.example\n"))
+	}))
+	defer server.Close()
+
+	configDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "social.txt"), []byte("||social.example^\n"), 0o644))
+	socialList, newsList := "social.txt", server.URL+"/news.txt"
+	config.Routes = []RouteConfiguration{
+		{List: &socialList, Profile: "social"},
+		{List: &newsList, Profile: "news"},
+	}
+	for _, route := range config.Routes {
+		assert.NoError(t, validateRoute(route))
+	}
+	route := func(rawURL string) *RouteConfiguration {
+		u, err := url.Parse(rawURL)
+		assert.NoError(t, err)
+		route, err := RouteURL(config, configDir, u, time.Now())
+		assert.NoError(t, err)
+		return route
+	}
+
+	if assert.NotNil(t, route("https://www.social.example/")) {
+		assert.Equal(t, "social", route("https://www.social.example/").Profile)
+	}
+	// The remote list isn't downloaded yet.
+	assert.Nil(t, route("https://news.example/"))
+
+	assert.NoError(t, RefreshRouteLists(context.Background(), server.Client(), config, false))
+	if assert.NotNil(t, route("https://news.example/")) {
+		assert.Equal(t, "news", route("https://news.example/").Profile)
+	}
+
+	// Lists are only downloaded again once they are due, or when forced.
+	assert.NoError(t, RefreshRouteLists(context.Background(), server.Client(), config, false))
+	assert.Equal(t, 1, requests)
+	assert.NoError(t, RefreshRouteLists(context.Background(), server.Client(), config, true))
+	assert.Equal(t, 2, requests)
+
+	insecure := "http://example.com/list.txt"
+	assert.ErrorIs(t, validateRoute(RouteConfiguration{List: &insecure}), ErrInsecureURL)
+}
@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrURLDenied error = errors.New("Opening the URL is not allowed")
+
+const (
+	RouteActionDeny = "deny"
+	RouteActionOpen = "open"
+)
+
+// RouteExplanation tells whether a route applies to a URL, and why not
+// if it doesn't.
+type RouteExplanation struct {
+	Applies bool
+	// Index is the route's position in the configuration's Routes.
+	Index int
+	// Reason is why the route doesn't apply, e.g. "outside of
+	// 18:00-21:00".
+	Reason string
+	Route  RouteConfiguration
+}
+
+// ExplainRoute tries the routes on a URL at the given time in the
+// order RouteURL does, up to the first one that applies. Lists that
+// are local files are resolved against configDir.
+func ExplainRoute(config Configuration, configDir string, u *url.URL, now time.Time) ([]RouteExplanation, error) {
+	explanations := []RouteExplanation{}
+	domainLists := map[string]map[string]bool{}
+	// The network is only detected once a route depends on it.
+	var network *NetworkEnvironment
+	for _, i := range getRouteOrder(config.Routes) {
+		route := config.Routes[i]
+		explanation := RouteExplanation{Index: i, Route: route}
+		var matches bool
+		var err error
+		if route.List != nil {
+			domains, ok := domainLists[*route.List]
+			if !ok {
+				domains, err = readRouteList(config, configDir, *route.List)
+				domainLists[*route.List] = domains
+			}
+			matches = domainListContains(domains, u.Hostname())
+		} else {
+			matches, err = routeMatches(route, u)
+		}
+		switch {
+		case errors.Is(err, errRouteListNotDownloaded):
+			explanation.Reason = "its list hasn't been downloaded yet"
+		case err != nil:
+			return nil, uerror.StackTracef("Invalid route %d: %w", i, err)
+		case !matches:
+			explanation.Reason = "the URL doesn't match"
+		case route.From != nil && route.To != nil:
+			window := QuietHoursConfiguration{Days: route.Days, From: *route.From, To: *route.To}
+			end, err := getTimeWindowEnd(window, now)
+			if err != nil {
+				return nil, uerror.StackTracef("Invalid route %d: %w", i, err)
+			}
+			if end == nil {
+				explanation.Reason = fmt.Sprintf("outside of %s-%s", *route.From, *route.To)
+				if len(route.Days) > 0 {
+					explanation.Reason += " on " + strings.Join(route.Days, ", ")
+				}
+			}
+		}
+		if explanation.Reason == "" && route.Network != nil {
+			if network == nil {
+				detected, err := detectNetworkEnvironment()
+				if err != nil {
+					return nil, uerror.WithStackTrace(err)
+				}
+				network = &detected
+			}
+			if matches, reason := matchNetworkCondition(config, *route.Network, *network); !matches {
+				explanation.Reason = reason
+			}
+		}
+		explanation.Applies = explanation.Reason == ""
+		explanations = append(explanations, explanation)
+		if explanation.Applies {
+			break
+		}
+	}
+	return explanations, nil
+}
+
+// RouteURL returns the route that applies to a URL at the given time,
+// or nil if none does. If the route denies the URL, the error wraps
+// ErrURLDenied and includes the route's Message.
+func RouteURL(config Configuration, configDir string, u *url.URL, now time.Time) (*RouteConfiguration, error) {
+	explanations, err := ExplainRoute(config, configDir, u, now)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if len(explanations) == 0 {
+		return nil, nil
+	}
+	last := explanations[len(explanations)-1]
+	if !last.Applies {
+		return nil, nil
+	}
+	route := &config.Routes[last.Index]
+	if isDenyRoute(*route) {
+		if route.Message != nil {
+			return nil, uerror.StackTracef("%w: %s", ErrURLDenied, *route.Message)
+		}
+		return nil, uerror.StackTracef("%w: %s is blocked by route %d", ErrURLDenied, u.Hostname(), last.Index)
+	}
+	return route, nil
+}
+
+// ResolveRoute returns the route that applies to a URL now, like
+// RouteURL, but also returns routes that deny it.
+func ResolveRoute(config Configuration, configDir string, u *url.URL) (*RouteConfiguration, error) {
+	explanations, err := ExplainRoute(config, configDir, u, time.Now())
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if len(explanations) == 0 || !explanations[len(explanations)-1].Applies {
+		return nil, nil
+	}
+	return &config.Routes[explanations[len(explanations)-1].Index], nil
+}
+
+// RewriteURL applies a route's Rewrite to a URL. Without a Rewrite, the
+// URL is returned as is.
+func RewriteURL(route RouteConfiguration, u *url.URL) (*url.URL, error) {
+	if route.Rewrite == nil {
+		return u, nil
+	}
+	re, err := compileRouteRegex(route)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	rewritten, err := url.Parse(re.ReplaceAllString(u.String(), *route.Rewrite))
+	if err != nil {
+		return nil, uerror.StackTracef("The rewritten URL is invalid: %w", err)
+	}
+	return rewritten, nil
+}
+
+// getRouteOrder returns the indices of the routes, highest priority
+// first and in the configured order within a priority.
+func getRouteOrder(routes []RouteConfiguration) []int {
+	order := make([]int, len(routes))
+	for i := range order {
+		order[i] = i
+	}
+	priority := func(route RouteConfiguration) int {
+		if route.Priority == nil {
+			return 0
+		}
+		return *route.Priority
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return priority(routes[order[i]]) > priority(routes[order[j]])
+	})
+	return order
+}
+
+func isDenyRoute(route RouteConfiguration) bool {
+	return route.Action != nil && *route.Action == RouteActionDeny
+}
+
+// TopicContext is what the caller knows about where tbml was started,
+// for TopicResolvers to derive a topic from.
+type TopicContext struct {
+	// WorkingDir is the directory tbml was started in, or "" if it
+	// shouldn't be used.
+	WorkingDir string
+}
+
+// TopicResolver derives a topic from a TopicContext. It returns "" if
+// the context doesn't suggest a topic.
+type TopicResolver func(context TopicContext) (string, error)
+
+// ResolveTopic asks the resolvers in order and returns the first topic
+// one of them finds, or "" if none does.
+func ResolveTopic(resolvers []TopicResolver, context TopicContext) (string, error) {
+	for _, resolver := range resolvers {
+		topic, err := resolver(context)
+		if err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+		if strings.TrimSpace(topic) != "" {
+			return topic, nil
+		}
+	}
+	return "", nil
+}
+
+// ResolveGitRepositoryTopic names the topic after the git repository
+// the working directory is in, i.e. the directory that contains ".git".
+// Worktrees and submodules, whose ".git" is a file, count as their own
+// repository.
+func ResolveGitRepositoryTopic(context TopicContext) (string, error) {
+	if context.WorkingDir == "" {
+		return "", nil
+	}
+	dir, err := filepath.Abs(context.WorkingDir)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	for {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return filepath.Base(dir), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func routeMatches(route RouteConfiguration, u *url.URL) (bool, error) {
+	if route.Host != nil {
+		return path.Match(strings.ToLower(*route.Host), strings.ToLower(u.Hostname()))
+	}
+	re, err := compileRouteRegex(route)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(u.String()), nil
+}
+
+// compileRouteRegex compiles the Regex of a route so that it only
+// matches whole URLs, not e.g. a URL that merely contains the matching
+// one in its query.
+func compileRouteRegex(route RouteConfiguration) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + *route.Regex + ")$")
+}
+
+func validateRoute(route RouteConfiguration) error {
+	patterns := 0
+	for _, pattern := range []*string{route.Host, route.List, route.Regex} {
+		if pattern != nil {
+			patterns++
+		}
+	}
+	switch {
+	case patterns != 1:
+		return fmt.Errorf("The route must have exactly one of a host pattern, a list or a regex")
+	case route.List != nil:
+		if err := validateRouteList(route); err != nil {
+			return err
+		}
+	case route.Host != nil:
+		if _, err := path.Match(*route.Host, ""); err != nil {
+			return fmt.Errorf("Invalid host pattern %q: %w", *route.Host, err)
+		}
+	default:
+		if _, err := regexp.Compile(*route.Regex); err != nil {
+			return fmt.Errorf("Invalid regex %q: %w", *route.Regex, err)
+		}
+	}
+	if route.Topic != nil && strings.TrimSpace(*route.Topic) == "" {
+		return fmt.Errorf("The route's topic is empty")
+	}
+	if route.Rewrite != nil && route.Regex == nil {
+		return fmt.Errorf("The route's Rewrite needs a regex")
+	}
+	if route.Rewrite != nil && isDenyRoute(route) {
+		return fmt.Errorf("A route that denies URLs can't rewrite them")
+	}
+	if route.Action != nil && *route.Action != RouteActionOpen && *route.Action != RouteActionDeny {
+		return fmt.Errorf("Unknown route action %q (available: %s, %s)", *route.Action, RouteActionOpen, RouteActionDeny)
+	}
+	if (route.From == nil) != (route.To == nil) {
+		return fmt.Errorf("The route must have both From and To or neither")
+	}
+	if route.From == nil && len(route.Days) > 0 {
+		return fmt.Errorf("The route has Days but no From and To")
+	}
+	if route.From != nil {
+		if err := validateTimeWindow(QuietHoursConfiguration{Days: route.Days, From: *route.From, To: *route.To}); err != nil {
+			return err
+		}
+	}
+	return validateNetworkCondition(route.Network)
+}
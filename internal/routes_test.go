@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveRoute(t *testing.T) {
+	workHost := "*.example.com"
+	newsRegex := `https://news\.example\.org/.*`
+	everything := "*"
+	newsTopic := "news"
+	config := Configuration{
+		Routes: []RouteConfiguration{
+			{Host: &workHost, Profile: "work"},
+			{Profile: "default", Regex: &newsRegex, Topic: &newsTopic},
+			{Host: &everything, Profile: "default"},
+		},
+	}
+
+	testCases := []struct {
+		desc string
+
+		expectedRoute int
+		url           string
+	}{
+		{
+			desc: "Host glob",
+
+			expectedRoute: 0,
+			url:           "https://git.EXAMPLE.com/repo",
+		},
+		{
+			desc: "Host glob with several subdomains",
+
+			expectedRoute: 0,
+			url:           "https://a.b.example.com:8443/",
+		},
+		{
+			desc: "Regex",
+
+			expectedRoute: 1,
+			url:           "https://news.example.org/today",
+		},
+		{
+			desc: "Regex matching only part of the URL",
+
+			expectedRoute: 2,
+			url:           "https://example.net/?next=https://news.example.org/today",
+		},
+		{
+			desc: "Fallback",
+
+			expectedRoute: 2,
+			url:           "https://example.net/",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			u, err := url.Parse(tC.url)
+			assert.NoError(t, err)
+			route, err := ResolveRoute(config, "", u)
+			assert.NoError(t, err)
+			assert.Equal(t, &config.Routes[tC.expectedRoute], route)
+		})
+	}
+
+	u, err := url.Parse("https://example.net/")
+	assert.NoError(t, err)
+	route, err := ResolveRoute(Configuration{Routes: config.Routes[:2]}, "", u)
+	assert.NoError(t, err)
+	assert.Nil(t, route)
+}
+
+func TestRouteURL(t *testing.T) {
+	social := "*.social.example"
+	deny := RouteActionDeny
+	from, to := "21:00", "18:00"
+	message := "Social media is only available from 18:00 to 21:00"
+	everything := "*"
+	high := 10
+	config := Configuration{
+		Routes: []RouteConfiguration{
+			{Host: &everything, Profile: "default"},
+			{Host: &social, Profile: "restricted"},
+			{Action: &deny, From: &from, Host: &social, Message: &message, Priority: &high, To: &to},
+		},
+	}
+	u, err := url.Parse("https://www.social.example/feed")
+	assert.NoError(t, err)
+	at := func(clock string) time.Time {
+		parsed, err := time.Parse("15:04", clock)
+		assert.NoError(t, err)
+		return time.Date(2024, 5, 17, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+	}
+
+	// In the evening, the deny route doesn't apply, so the routes of
+	// the default priority are tried in the configured order.
+	route, err := RouteURL(config, "", u, at("19:00"))
+	assert.NoError(t, err)
+	assert.Equal(t, &config.Routes[0], route)
+
+	_, err = RouteURL(config, "", u, at("22:00"))
+	assert.ErrorIs(t, err, ErrURLDenied)
+	assert.Contains(t, err.Error(), message)
+
+	explanations, err := ExplainRoute(config, "", u, at("19:00"))
+	assert.NoError(t, err)
+	if assert.Len(t, explanations, 2) {
+		assert.Equal(t, 2, explanations[0].Index)
+		assert.False(t, explanations[0].Applies)
+		assert.Equal(t, "outside of 21:00-18:00", explanations[0].Reason)
+		assert.Equal(t, 0, explanations[1].Index)
+		assert.True(t, explanations[1].Applies)
+	}
+
+	// Raising the priority of the social media route sends it to the
+	// restricted profile.
+	config.Routes[1].Priority = &high
+	route, err = RouteURL(config, "", u, at("19:00"))
+	assert.NoError(t, err)
+	assert.Equal(t, &config.Routes[1], route)
+}
+
+func TestValidateRoute(t *testing.T) {
+	host := "*.social.example"
+	deny := RouteActionDeny
+	block := "block"
+	from, to, badTime := "21:00", "18:00", "25:00"
+
+	assert.NoError(t, validateRoute(RouteConfiguration{Action: &deny, Days: []string{"sat"}, From: &from, Host: &host, To: &to}))
+	assert.Error(t, validateRoute(RouteConfiguration{Action: &block, Host: &host}))
+	assert.Error(t, validateRoute(RouteConfiguration{From: &from, Host: &host}))
+	assert.Error(t, validateRoute(RouteConfiguration{Days: []string{"sat"}, Host: &host}))
+	assert.Error(t, validateRoute(RouteConfiguration{From: &badTime, Host: &host, To: &to}))
+	assert.Error(t, validateRoute(RouteConfiguration{Days: []string{"someday"}, From: &from, Host: &host, To: &to}))
+}
+
+func TestRewriteURL(t *testing.T) {
+	regex := `https://www\.reddit\.com/(.*)`
+	rewrite := "https://old.reddit.com/$1"
+	route := RouteConfiguration{Profile: "social", Regex: &regex, Rewrite: &rewrite}
+	assert.NoError(t, validateRoute(route))
+
+	u, err := url.Parse("https://www.reddit.com/r/golang")
+	assert.NoError(t, err)
+	rewritten, err := RewriteURL(route, u)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://old.reddit.com/r/golang", rewritten.String())
+
+	unchanged, err := RewriteURL(RouteConfiguration{Regex: &regex}, u)
+	assert.NoError(t, err)
+	assert.Equal(t, u, unchanged)
+
+	host := "www.reddit.com"
+	assert.Error(t, validateRoute(RouteConfiguration{Host: &host, Rewrite: &rewrite}))
+}
+
+func TestResolveTopic(t *testing.T) {
+	none := func(context TopicContext) (string, error) { return "", nil }
+	blank := func(context TopicContext) (string, error) { return " ", nil }
+	fixed := func(topic string) TopicResolver {
+		return func(context TopicContext) (string, error) { return topic, nil }
+	}
+
+	testCases := []struct {
+		desc string
+
+		expectedTopic string
+		resolvers     []TopicResolver
+	}{
+		{
+			desc: "No resolvers",
+
+			expectedTopic: "",
+			resolvers:     nil,
+		},
+		{
+			desc: "First topic wins",
+
+			expectedTopic: "a",
+			resolvers:     []TopicResolver{none, fixed("a"), fixed("b")},
+		},
+		{
+			desc: "Blank topics are skipped",
+
+			expectedTopic: "b",
+			resolvers:     []TopicResolver{blank, fixed("b")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			topic, err := ResolveTopic(tc.resolvers, TopicContext{})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedTopic, topic)
+		})
+	}
+}
+
+func TestResolveGitRepositoryTopic(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "projectX/.git"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "projectX/vendor/lib/src"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "projectX/vendor/lib/.git"), []byte("gitdir: ../../.git/modules/lib\n"), 0644))
+
+	testCases := []struct {
+		desc string
+
+		expectedTopic string
+		workingDir    string
+	}{
+		{
+			desc: "Repository root",
+
+			expectedTopic: "projectX",
+			workingDir:    filepath.Join(root, "projectX"),
+		},
+		{
+			desc: "Submodule",
+
+			expectedTopic: "lib",
+			workingDir:    filepath.Join(root, "projectX/vendor/lib/src"),
+		},
+		{
+			desc: "Subdirectory",
+
+			expectedTopic: "projectX",
+			workingDir:    filepath.Join(root, "projectX/vendor"),
+		},
+		{
+			desc: "No working directory",
+
+			expectedTopic: "",
+			workingDir:    "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			topic, err := ResolveGitRepositoryTopic(TopicContext{WorkingDir: tc.workingDir})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedTopic, topic)
+		})
+	}
+}
@@ -18,12 +18,18 @@ import (
 	"time"
 
 	uerror "t0ast.cc/tbml/util/error"
+	"t0ast.cc/tbml/util/i18n"
 	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
 	ustring "t0ast.cc/tbml/util/string"
 )
 
 const tblFirejailProfileFileName = "torbrowser-launcher.profile"
 
+// mothershipNativeConnectorName is the name of the native messaging
+// host the Mothership extension talks to.
+const mothershipNativeConnectorName = "mothership_native_connector"
+
 const relativeProfilePath = ".local/share/torbrowser/tbb/x86_64/tor-browser_en-US/Browser/TorBrowser/Data/Browser/profile.default"
 
 //go:embed torbrowser-launcher.profile
@@ -38,8 +44,105 @@ var mothershipExtensionFiles embed.FS
 //go:embed mothership-connector
 var mothershipConnector []byte
 
-func StartInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, allInstances []ProfileInstance, configDir string, startURL *url.URL, debugShell bool) (exitCode uint, err error) {
+// newBrowserCommand and setUpSandboxMounts are variables so the
+// integration tests can drive the launch lifecycle against a fake
+// browser, without firejail and bindfs.
+var (
+	newBrowserCommand  = newSandboxedBrowserCommand
+	setUpSandboxMounts = setUpBindMounts
+)
+
+// browserRuntime creates the browser command of a launch and sets up
+// the sandbox mounts for it. RunSoak launches with its own runtime, so
+// it doesn't affect other launches in the process.
+type browserRuntime struct {
+	newCommand  func(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool, warnings *Warnings) (*exec.Cmd, error)
+	setUpMounts func(instanceDir string) (func() error, error)
+}
+
+func getDefaultBrowserRuntime() browserRuntime {
+	return browserRuntime{newCommand: newBrowserCommand, setUpMounts: setUpSandboxMounts}
+}
+
+func StartInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, configDir string, startURL *url.URL, debugShell bool, noSync bool, sessionLimit time.Duration, warnings *Warnings) (exitCode uint, err error) {
+	return startInstance(ctx, getDefaultBrowserRuntime(), config, profile, instance, configDir, startURL, debugShell, noSync, sessionLimit, warnings)
+}
+
+func startInstance(ctx context.Context, runtime browserRuntime, config Configuration, profile ProfileConfiguration, instance ProfileInstance, configDir string, startURL *url.URL, debugShell bool, noSync bool, sessionLimit time.Duration, warnings *Warnings) (exitCode uint, err error) {
+	// The command is set up before anything else so a missing sandbox
+	// doesn't leave a half-prepared instance behind. It isn't bound to
+	// ctx, which would kill the browser, see stopBrowserOnCancel.
+	browserCmd, err := runtime.newCommand(context.Background(), profile, getInstanceDir(config, instance), debugShell, warnings)
+	if err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+
+	unlockInstance, err := LockInstance(config, instance)
+	if err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	return startLockedInstance(ctx, runtime, config, profile, instance, browserCmd, unlockInstance, configDir, startURL, noSync, sessionLimit, warnings)
+}
+
+// StartClaimedInstance is StartInstance for an instance claimed with
+// ClaimBestInstance. The instance is released once the browser exited
+// or the launch failed.
+func StartClaimedInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, release func() error, configDir string, startURL *url.URL, debugShell bool, noSync bool, sessionLimit time.Duration, warnings *Warnings) (exitCode uint, err error) {
+	return startClaimedInstance(ctx, getDefaultBrowserRuntime(), config, profile, instance, release, configDir, startURL, debugShell, noSync, sessionLimit, warnings)
+}
+
+func startClaimedInstance(ctx context.Context, runtime browserRuntime, config Configuration, profile ProfileConfiguration, instance ProfileInstance, release func() error, configDir string, startURL *url.URL, debugShell bool, noSync bool, sessionLimit time.Duration, warnings *Warnings) (exitCode uint, err error) {
+	browserCmd, err := runtime.newCommand(context.Background(), profile, getInstanceDir(config, instance), debugShell, warnings)
+	if err != nil {
+		_ = release()
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	return startLockedInstance(ctx, runtime, config, profile, instance, browserCmd, release, configDir, startURL, noSync, sessionLimit, warnings)
+}
+
+func startLockedInstance(ctx context.Context, runtime browserRuntime, config Configuration, profile ProfileConfiguration, instance ProfileInstance, browserCmd *exec.Cmd, unlockInstance func() error, configDir string, startURL *url.URL, noSync bool, sessionLimit time.Duration, warnings *Warnings) (exitCode uint, err error) {
 	instanceDir := getInstanceDir(config, instance)
+	launched := time.Now()
+
+	logger, closeLog, logErr := openInstanceLog(config, instance, ulog.FromContext(ctx).With("instance", instance.InstanceLabel))
+	if logErr != nil {
+		warnings.Add(instance.InstanceLabel, "Failed to open the instance log: %s", uerror.Message(logErr))
+	}
+	defer closeLog()
+	ctx = ulog.NewContext(ctx, logger)
+	logger.Info("Launching instance", "profile", profile.Label, "ephemeral", instance.Ephemeral)
+	defer func() {
+		if err != nil {
+			logger.Error("Launch failed", "error", uerror.Message(err))
+		}
+	}()
+
+	// Ephemeral instances are wiped once the browser exits, but only
+	// if the bind mounts are gone, so nothing outside of the instance
+	// gets deleted.
+	wipeOnExit := instance.Ephemeral
+	defer func() {
+		_ = unlockInstance()
+		if wipeOnExit {
+			logger.Debug("Wiping ephemeral instance")
+			if err := DeleteInstance(config, instance, nil); err != nil {
+				warnings.Add(instance.InstanceLabel, "Failed to wipe ephemeral instance: %s", uerror.Message(err))
+			}
+		}
+	}()
+
+	// The checks run before anything about the instance is changed, so
+	// a failed check leaves it as it was.
+	if err := runPreflightChecks(ctx, config, profile); err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+
+	// Archived instances are unarchived before their metadata is
+	// written below, which would otherwise mark them as archived again.
+	if err := unarchiveInstance(config, instance); err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	instance.Archived = false
 
 	cleanUpInstanceData, err := writeInstanceData(config, profile, instance)
 	if err != nil {
@@ -47,95 +150,331 @@ func StartInstance(ctx context.Context, config Configuration, profile ProfileCon
 	}
 	defer cleanUpInstanceData()
 
-	if err := ensureFiles(profile, configDir, instanceDir); err != nil {
+	unmountEncryptedInstance, err := mountEncryptedInstance(config, profile, instance, warnings)
+	if err != nil {
 		return genericErrorExitCode, uerror.WithStackTrace(err)
 	}
+	defer func() {
+		if err := unmountEncryptedInstance(); err != nil {
+			warnings.Add(instance.InstanceLabel, "%s", uerror.Message(err))
+		}
+	}()
+
+	// Like wiping ephemeral instances, resetting instances is only safe
+	// once the bind mounts are gone.
+	resetOnExit := shouldResetOnExit(profile) && !instance.Ephemeral
+	pristine := false
+	if resetOnExit {
+		if pristine, err = isPristineInstanceDir(instanceDir); err != nil {
+			return genericErrorExitCode, uerror.WithStackTrace(err)
+		}
+	}
+	defer func() {
+		if !resetOnExit {
+			return
+		}
+		logger.Debug("Resetting instance")
+		if err := resetInstanceFiles(config, profile, instance.InstanceLabel, instanceDir); err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to reset instance: %s", uerror.Message(err))
+		}
+	}()
 
-	if err := ensureExtensions(config, profile, instance.InstanceLabel, configDir, instanceDir); err != nil {
+	// The launcher files are restored on every launch since the
+	// browser could change them, the profile's files only if the
+	// profile changed.
+	if err := ensureLauncherFiles(instanceDir); err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	if err := syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, configDir, instanceDir, noSync); err != nil {
 		return genericErrorExitCode, uerror.WithStackTrace(err)
 	}
 
 	if err := ensureMothershipExtension(instanceDir); err != nil {
 		return genericErrorExitCode, uerror.WithStackTrace(err)
 	}
+	if resetOnExit && pristine {
+		if err := saveInstanceTemplate(config, profile, instance.InstanceLabel, instanceDir); err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to save the instance template: %s", uerror.Message(err))
+		}
+	}
 
-	if err := writePortSettings(instanceDir, allInstances); err != nil {
+	instance, releasePorts, err := allocatePorts(config, instance)
+	if err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	logger.Debug("Allocated ports", "socks", *instance.SOCKSPort, "control", *instance.ControlPort)
+	defer func() {
+		if err := releasePorts(); err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to release ports: %s", uerror.Message(err))
+		}
+	}()
+	if err := writePortSettings(instanceDir, *instance.SOCKSPort, *instance.ControlPort); err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	if err := ensureDownloadDir(profile, instance, instanceDir); err != nil {
 		return genericErrorExitCode, uerror.WithStackTrace(err)
 	}
 
+	prefWarnings, err := LintInstancePrefs(config, instance)
+	if err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	for _, warning := range prefWarnings {
+		logger.Debug("Pref lint warning", "warning", warning)
+		warnings.Add(instance.InstanceLabel, "%s", warning)
+	}
+
 	cleanUpExternalUnixSocket, err := setUpExternalUnixSocket(ctx, instanceDir, startURL)
 	if err != nil {
 		return genericErrorExitCode, uerror.WithStackTrace(err)
 	}
 	defer cleanUpExternalUnixSocket()
 
-	cleanUpBindMounts, err := setUpBindMounts(instanceDir)
+	cleanUpBindMounts, err := runtime.setUpMounts(instanceDir)
+	if err != nil {
+		wipeOnExit = false
+		resetOnExit = false
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	logger.Debug("Set up sandbox mounts")
+	defer func() {
+		if err := cleanUpBindMounts(); err != nil {
+			wipeOnExit = false
+			resetOnExit = false
+			warnings.Add(instance.InstanceLabel, "Failed to unmount bind mounts: %s", uerror.Message(err))
+		}
+	}()
+	if err := removeSandboxContainer(profile, instanceDir); err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	defer func() {
+		if err := removeSandboxContainer(profile, instanceDir); err != nil {
+			warnings.Add(instance.InstanceLabel, "%s", uerror.Message(err))
+		}
+	}()
+
+	// Post-exit hooks run whenever a pre-launch hook did, so they can
+	// undo what it set up, even if a later one failed or the launch was
+	// canceled.
+	browserPID := 0
+	var browserExitCode *uint
+	preLaunched, hookErr := runHooks(ctx, getHooks(config, profile, hookPreLaunch), getHookEnvironment(hookPreLaunch, instance, instanceDir, 0, nil), getHookTimeout(config))
+	if hookErr == nil || preLaunched > 0 {
+		defer func() {
+			env := getHookEnvironment(hookPostExit, instance, instanceDir, browserPID, browserExitCode)
+			if _, err := runHooks(context.Background(), getHooks(config, profile, hookPostExit), env, getHookTimeout(config)); err != nil {
+				warnings.Add(instance.InstanceLabel, "%s", uerror.Message(err))
+			}
+		}()
+	}
+	if hookErr != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(hookErr)
+	}
+
+	// Crash reports that are there before the launch belong to
+	// earlier crashes.
+	previousCrashReports, err := listCrashReports(filepath.Join(instanceDir, relativeProfilePath))
+	if err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+
+	maxMemory, maxMemoryPolicy, err := getMaxMemory(profile)
 	if err != nil {
 		return genericErrorExitCode, uerror.WithStackTrace(err)
 	}
-	defer cleanUpBindMounts()
+	stopUpdatingLastUsed := func() error { return nil }
+	finishUsageSession := func() error { return nil }
+	stopSessionLimit := func() {}
+	stopMemoryWatchdog := func() {}
+	stopOnCancel := func() {}
+	var browserStarted time.Time
+	if err := ctx.Err(); err != nil {
+		return genericErrorExitCode, uerror.WithStackTrace(err)
+	}
+	logger.Debug("Starting browser", "command", strings.Join(browserCmd.Args, " "))
+	exitCode, err = runBrowser(browserCmd, func(pid int) {
+		logger.Info("Browser started", "pid", pid)
+		browserPID = pid
+		browserStarted = time.Now()
+		finish, err := startUsageSession(config, instance.InstanceLabel, instance.UsageLabel)
+		if err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to record the session: %s", uerror.Message(err))
+		} else {
+			finishUsageSession = finish
+		}
+		if err := recordBrowserPID(config, instance.InstanceLabel, pid); err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to record the browser's PID: %s", uerror.Message(err))
+		}
+		stopUpdatingLastUsed = updateLastUsedPeriodically(config, instance.InstanceLabel)
+		profileDir := filepath.Join(instanceDir, relativeProfilePath)
+		stopOnCancel = stopBrowserOnCancel(ctx, pid, profileDir)
+		notificationName := getNotificationName(profile, instance.InstanceLabel, i18n.DetectLanguage())
+		topic := ""
+		if instance.UsageLabel != nil {
+			topic = *instance.UsageLabel
+		}
+		notificationIcon, err := getNotificationIcon(config, configDir, profile, topic)
+		if err != nil {
+			logger.Debug("Failed to get the notification icon", "error", uerror.Message(err))
+		}
+		stopSessionLimit = superviseSessionLimit(ctx, pid, profileDir, sessionLimit, notificationName, notificationIcon)
+		stopMemoryWatchdog = superviseMemory(ctx, pid, profileDir, maxMemory, maxMemoryPolicy, notificationName, notificationIcon)
+		env := getHookEnvironment(hookPostLaunch, instance, instanceDir, pid, nil)
+		if _, err := runHooks(ctx, getHooks(config, profile, hookPostLaunch), env, getHookTimeout(config)); err != nil {
+			warnings.Add(instance.InstanceLabel, "%s", uerror.Message(err))
+		}
+	})
+	stopOnCancel()
+	stopSessionLimit()
+	stopMemoryWatchdog()
+	if err := stopUpdatingLastUsed(); err != nil {
+		warnings.Add(instance.InstanceLabel, "Failed to update the last use time: %s", uerror.Message(err))
+	}
+	if err := finishUsageSession(); err != nil {
+		warnings.Add(instance.InstanceLabel, "Failed to record the session: %s", uerror.Message(err))
+	}
+	if err != nil {
+		return exitCode, uerror.WithStackTrace(err)
+	}
+	currentCrashReports, err := listCrashReports(filepath.Join(instanceDir, relativeProfilePath))
+	if err != nil {
+		warnings.Add(instance.InstanceLabel, "Failed to look for crash reports: %s", uerror.Message(err))
+	}
+	if crashReports := getNewCrashReports(previousCrashReports, currentCrashReports); exitCode != 0 || len(crashReports) > 0 {
+		bundleDir, err := writeCrashBundle(context.Background(), config, profile, instance.InstanceLabel, exitCode, crashReports)
+		if err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to write the crash bundle: %s", uerror.Message(err))
+		} else {
+			logger.Warn("Browser crashed", "exitCode", exitCode, "crashBundle", bundleDir)
+		}
+	}
+	logger.Info("Browser exited", "exitCode", exitCode)
+	browserExitCode = &exitCode
+	if err := recordBootTime(config, instance, instanceDir, launched, browserStarted); err != nil {
+		warnings.Add(instance.InstanceLabel, "Failed to record the boot time: %s", uerror.Message(err))
+	}
+	if hasNoPasswordManager(profile) {
+		credentialFiles, err := findStoredCredentials(config, instance)
+		if err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to check for stored credentials: %s", uerror.Message(err))
+		}
+		for _, name := range credentialFiles {
+			warnings.Add(instance.InstanceLabel, "The browser stored credentials in %s although the profile sets NoPasswordManager", name)
+		}
+	}
+	return exitCode, nil
+}
 
-	return runFirejail(ctx, instanceDir, debugShell)
+// ensureLauncherFiles writes torbrowser-launcher's settings, unless
+// they exist, and the Firejail profile.
+func ensureLauncherFiles(instanceDir string) error {
+	tblSettingsPath := filepath.Join(instanceDir, ".config/torbrowser/settings.json")
+	if err := writeIfNotExists(tblSettingsPath, tblDefaultSettings); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	tblFirejailProfilePath := filepath.Join(instanceDir, tblFirejailProfileFileName)
+	if err := ensureExists(tblFirejailProfilePath, tblFirejailProfile); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
 }
 
 func writeInstanceData(config Configuration, profile ProfileConfiguration, instance ProfileInstance) (cleanup func() error, err error) {
-	instanceDir := getInstanceDir(config, instance)
+	recordDir := getInstanceRecordDir(config, instance)
 
-	instanceDataPath := filepath.Join(instanceDir, "profile-instance.json")
+	instanceDataPath := filepath.Join(recordDir, "profile-instance.json")
 
 	instanceExists, err := uio.FileExists(instanceDataPath)
 	if err != nil {
 		return nil, uerror.WithStackTrace(err)
 	}
 	if !instanceExists {
+		if err := os.MkdirAll(recordDir, uio.FileModeURWXGRWXO); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	}
+	// A reservation is created along with its instance.
+	isNew := !instanceExists || instance.Reserved
+	if isNew {
 		instance.Created = time.Now()
-		if err := os.MkdirAll(instanceDir, uio.FileModeURWXGRWXO); err != nil {
+		instance.Reserved = false
+	}
+	if instance.Directory != nil && !instance.Ephemeral {
+		if err := ensureInstanceDirectory(*instance.Directory, isNew); err != nil {
 			return nil, uerror.WithStackTrace(err)
 		}
 	}
 
 	pid := os.Getpid()
+	instance.Attached = false
 	instance.LastUsed = time.Now()
 	instance.UsagePID = &pid
 
-	marshalData := func(instance ProfileInstance) error {
-		instanceDataBytes, err := json.Marshal(instance)
-		if err != nil {
-			return uerror.WithStackTrace(err)
-		}
-		if err := os.WriteFile(instanceDataPath, instanceDataBytes, uio.FileModeURWGRWO); err != nil {
-			return uerror.WithStackTrace(err)
-		}
-		return nil
-	}
-
-	if err := marshalData(instance); err != nil {
+	if err := writeProfileInstance(config, instance); err != nil {
 		return nil, err
 	}
 
 	return func() error {
-		instanceDataBytes, err := os.ReadFile(instanceDataPath)
-		if err != nil {
-			return uerror.WithStackTrace(err)
+		_, err := updateProfileInstance(config, instance.InstanceLabel, func(instance *ProfileInstance) {
+			instance.BrowserPID = nil
+			instance.LastUsed = time.Now()
+			instance.UsageLabel = nil
+			instance.UsagePID = nil
+		})
+		return err
+	}, nil
+}
+
+// lastUsedUpdateInterval is how often LastUsed is updated while the
+// browser runs. It is a variable so tests don't have to wait as long.
+var lastUsedUpdateInterval = 5 * time.Minute
+
+// updateLastUsedPeriodically keeps the LastUsed time of a running
+// instance current, so pruning and choosing the least recently used
+// instance take long sessions into account. The returned function
+// stops the updates and returns the last error, if any.
+func updateLastUsedPeriodically(config Configuration, instanceLabel string) (stop func() error) {
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		ticker := time.NewTicker(lastUsedUpdateInterval)
+		defer ticker.Stop()
+		var lastErr error
+		for {
+			select {
+			case <-done:
+				stopped <- lastErr
+				return
+			case <-ticker.C:
+				lastErr = touchInstance(config, instanceLabel)
+			}
 		}
-		instance = ProfileInstance{}
-		json.Unmarshal(instanceDataBytes, &instance)
+	}()
+	return func() error {
+		close(done)
+		return <-stopped
+	}
+}
 
+func touchInstance(config Configuration, instanceLabel string) error {
+	_, err := updateProfileInstance(config, instanceLabel, func(instance *ProfileInstance) {
 		instance.LastUsed = time.Now()
-		instance.UsageLabel = nil
-		instance.UsagePID = nil
-		return marshalData(instance)
-	}, nil
+	})
+	return err
 }
 
-func ensureFiles(profile ProfileConfiguration, configDir string, instanceDir string) error {
-	tblSettingsPath := filepath.Join(instanceDir, ".config/torbrowser/settings.json")
-	if err := writeIfNotExists(tblSettingsPath, tblDefaultSettings); err != nil {
-		return uerror.WithStackTrace(err)
-	}
+// recordBrowserPID stores the PID of the running browser, see
+// ProfileInstance.BrowserPID.
+func recordBrowserPID(config Configuration, instanceLabel string, pid int) error {
+	_, err := updateProfileInstance(config, instanceLabel, func(instance *ProfileInstance) {
+		instance.BrowserPID = &pid
+	})
+	return err
+}
 
-	tblFirejailProfilePath := filepath.Join(instanceDir, tblFirejailProfileFileName)
-	if err := ensureExists(tblFirejailProfilePath, tblFirejailProfile); err != nil {
+func ensureFiles(config Configuration, profile ProfileConfiguration, topic *string, configDir string, instanceDir string) error {
+	if err := ensureLauncherFiles(instanceDir); err != nil {
 		return uerror.WithStackTrace(err)
 	}
 
@@ -152,29 +491,38 @@ func ensureFiles(profile ProfileConfiguration, configDir string, instanceDir str
 				return uerror.WithStackTrace(err)
 			}
 		}
-	} else {
-		ensureExistsFrom(userChromePath, filepath.Join(configDir, *profile.UserChromeFile))
-	}
-
-	userJSPath := filepath.Join(profileDir, "user.js")
-	if profile.UserJSFile == nil {
-		userJSExists, err := uio.FileExists(userJSPath)
+	} else if assetName, ok := ParseBuiltinReference(*profile.UserChromeFile); ok {
+		content, err := ReadBuiltinAsset(assetName)
 		if err != nil {
 			return uerror.WithStackTrace(err)
 		}
-		if userJSExists {
-			if err := os.Remove(userJSPath); err != nil {
-				return uerror.WithStackTrace(err)
-			}
+		if err := os.MkdirAll(filepath.Dir(userChromePath), uio.FileModeURWXGRWXO); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := uio.WriteFileAtomic(userChromePath, content, uio.FileModeURWGRWO); err != nil {
+			return uerror.WithStackTrace(err)
 		}
 	} else {
-		ensureExistsFrom(userJSPath, filepath.Join(configDir, *profile.UserJSFile))
+		userChromeSrcPath, err := resolveConfigFile(config, configDir, *profile.UserChromeFile)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := cloneIntoInstance(config, userChromePath, userChromeSrcPath, false); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+
+	if err := writeUserJS(config, getUserJSLayers(config, profile, topic), configDir, profileDir); err != nil {
+		return uerror.WithStackTrace(err)
 	}
 
 	return nil
 }
 
 func ensureExtensions(config Configuration, profile ProfileConfiguration, instanceLabel, configDir, instanceDir string) error {
+	if err := checkProfileExtensionsAllowed(profile); err != nil {
+		return uerror.WithStackTrace(err)
+	}
 	instance, err := GetProfileInstance(config, instanceLabel)
 	if err != nil {
 		return uerror.WithStackTrace(err)
@@ -186,18 +534,21 @@ func ensureExtensions(config Configuration, profile ProfileConfiguration, instan
 		wantedExtensions[extensionID] = false
 	}
 	for _, extensionFilePath := range profile.ExtensionFiles {
-		extensionID := strings.TrimSuffix(filepath.Base(extensionFilePath), ".xpi")
+		extensionID := getExtensionIDFromPath(extensionFilePath)
 		wantedExtensions[extensionID] = true
-		extensionPathByID[extensionID] = extensionFilePath
+		extensionPathByID[extensionID], err = resolveConfigFile(config, configDir, extensionFilePath)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	for _, source := range profile.Extensions {
+		wantedExtensions[source.ID] = true
+		extensionPathByID[source.ID] = getCachedExtensionPath(config, source)
 	}
 	for extensionID, wanted := range wantedExtensions {
 		extensionPathInProfile := filepath.Join(instanceDir, relativeProfilePath, "extensions", fmt.Sprint(extensionID, ".xpi"))
 		if wanted {
-			extensionSrcPath := extensionPathByID[extensionID]
-			if !filepath.IsAbs(extensionSrcPath) {
-				extensionSrcPath = filepath.Join(configDir, extensionSrcPath)
-			}
-			if err := ensureExistsFrom(extensionPathInProfile, extensionSrcPath); err != nil {
+			if err := cloneIntoInstance(config, extensionPathInProfile, extensionPathByID[extensionID], true); err != nil {
 				return uerror.WithStackTrace(err)
 			}
 			instance.InstalledExtensions = includeExtension(instance.InstalledExtensions, extensionID)
@@ -209,12 +560,7 @@ func ensureExtensions(config Configuration, profile ProfileConfiguration, instan
 		}
 	}
 
-	instanceDataBytes, err := json.Marshal(instance)
-	if err != nil {
-		return uerror.WithStackTrace(err)
-	}
-	instanceDataPath := filepath.Join(instanceDir, "profile-instance.json")
-	if err := os.WriteFile(instanceDataPath, instanceDataBytes, uio.FileModeURWGRWO); err != nil {
+	if err := writeProfileInstance(config, instance); err != nil {
 		return uerror.WithStackTrace(err)
 	}
 
@@ -252,7 +598,7 @@ func ensureMothershipExtension(instanceDir string) error {
 	}
 
 	nativeManifest := map[string]interface{}{
-		"name":        "mothership_native_connector",
+		"name":        mothershipNativeConnectorName,
 		"description": "Bridge between the Mothership extension and tbml outside the sandbox",
 		"path":        filepath.Join(home, "mothership-connector"),
 		"type":        "stdio",
@@ -264,12 +610,15 @@ func ensureMothershipExtension(instanceDir string) error {
 	if err != nil {
 		return uerror.WithStackTrace(err)
 	}
-	nativeManifestPath := filepath.Join(instanceDir, ".local/share/torbrowser/tbb/x86_64/tor-browser_en-US/Browser/TorBrowser/Data/Browser/.mozilla/native-messaging-hosts/mothership_native_connector.json")
+	nativeManifestPath := filepath.Join(instanceDir, relativeNativeMessagingHostsPath, mothershipNativeConnectorName+".json")
 	if err := ensureExists(nativeManifestPath, nativeManifestBytes); err != nil {
 		return uerror.WithStackTrace(err)
 	}
 
 	extFilePath := filepath.Join(instanceDir, relativeProfilePath, "extensions/mothership@tbml.t0ast.cc.xpi")
+	if err := os.MkdirAll(filepath.Dir(extFilePath), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
 	extFile, err := os.Create(extFilePath)
 	if err != nil {
 		return uerror.WithStackTrace(err)
@@ -347,65 +696,14 @@ func ensureExists(name string, content []byte) error {
 	return nil
 }
 
-func ensureExistsFrom(name, srcFile string) error {
-	src, err := os.Open(srcFile)
-	if err != nil {
-		return uerror.WithStackTrace(err)
-	}
-	if err := os.MkdirAll(filepath.Dir(name), uio.FileModeURWXGRWXO); err != nil {
-		return uerror.WithStackTrace(err)
-	}
-	dst, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, uio.FileModeURWGRWO)
-	if err != nil {
-		return uerror.WithStackTrace(err)
-	}
-	if _, err := io.Copy(dst, src); err != nil {
-		return uerror.WithStackTrace(err)
-	}
-	return nil
-}
-
-func writePortSettings(instanceDir string, allInstances []ProfileInstance) error {
-	// There's no need to compensate for the currently starting
-	// instance in port calculation because "allInstances" is
-	// expected to reflect the state before the instance was marked
-	// as started.
-
-	runningInstances := 0
-	for _, instance := range allInstances {
-		if instance.UsagePID != nil {
-			runningInstances++
-		}
-	}
-	socksPort := 9150 + 10*runningInstances
-	controlPort := 9151 + 10*runningInstances
-
-	profileDir := filepath.Join(instanceDir, relativeProfilePath)
-	if err := os.MkdirAll(profileDir, uio.FileModeURWXGRWXO); err != nil {
-		return uerror.WithStackTrace(err)
-	}
-
-	userJSFile, err := os.OpenFile(filepath.Join(profileDir, "user.js"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, uio.FileModeURWGRWO)
-	if err != nil {
-		return uerror.WithStackTrace(err)
-	}
-	defer userJSFile.Close()
-
-	if _, err := fmt.Fprintf(userJSFile, ustring.TrimIndentation(`
-		user_pref("network.proxy.socks_port", %d);
-		user_pref("extensions.torlauncher.control_port", %d);
-	`), controlPort, socksPort); err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func setUpExternalUnixSocket(ctx context.Context, instanceDir string, startURL *url.URL) (cleanup func() error, err error) {
 	addr, err := resolveExternalUnixSocketAddr(instanceDir)
 	if err != nil {
 		return nil, uerror.WithStackTrace(err)
 	}
+	if err := removeStaleUnixSocket(addr); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
 	listener, err := net.ListenUnix("unix", addr)
 	if err != nil {
 		return nil, uerror.WithStackTrace(err)
@@ -418,7 +716,7 @@ func setUpExternalUnixSocket(ctx context.Context, instanceDir string, startURL *
 	}, nil
 }
 
-func setUpBindMounts(instanceDir string) (cleanup func(), err error) {
+func setUpBindMounts(instanceDir string) (cleanup func() error, err error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return nil, uerror.WithStackTrace(err)
@@ -437,9 +735,13 @@ func setUpBindMounts(instanceDir string) (cleanup func(), err error) {
 		return nil, uerror.WithStackTrace(err)
 	}
 
-	return func() {
-		_ = cleanUpCache()
-		_ = cleanUpGPGHomeDir()
+	return func() error {
+		cacheErr := cleanUpCache()
+		gpgHomeDirErr := cleanUpGPGHomeDir()
+		if cacheErr != nil {
+			return cacheErr
+		}
+		return gpgHomeDirErr
 	}, nil
 }
 
@@ -472,23 +774,18 @@ func bindMount(src string, dst string, commonPath string) (cleanup func() error,
 	}, nil
 }
 
-func runFirejail(ctx context.Context, instanceDir string, debugShell bool) (uint, error) {
-	firejailArgs := []string{
-		"dbus-launch", "firejail", fmt.Sprintf("--private=%s", instanceDir),
-	}
-	if debugShell {
-		firejailArgs = append(firejailArgs, "--noprofile", "fish")
-	} else {
-		firejailArgs = append(firejailArgs, fmt.Sprint("--profile=", filepath.Join(instanceDir, tblFirejailProfileFileName)), "torbrowser-launcher")
-	}
+// runBrowser runs the browser until it exits and returns its exit
+// code. onStarted is called with the browser's PID once it is started.
+func runBrowser(browserCmd *exec.Cmd, onStarted func(pid int)) (uint, error) {
+	browserCmd.Stdin = os.Stdin
+	browserCmd.Stdout = os.Stdout
+	browserCmd.Stderr = os.Stderr
 
-	firejailCmd := exec.CommandContext(ctx, firejailArgs[0], firejailArgs[1:]...)
-	firejailCmd.Env = append(os.Environ(), "XDG_CACHE_HOME=")
-	firejailCmd.Stdin = os.Stdin
-	firejailCmd.Stdout = os.Stdout
-	firejailCmd.Stderr = os.Stderr
-
-	if err := firejailCmd.Run(); err != nil {
+	if err := browserCmd.Start(); err != nil {
+		return 0, uerror.WithStackTrace(err)
+	}
+	onStarted(browserCmd.Process.Pid)
+	if err := browserCmd.Wait(); err != nil {
 		if err, ok := err.(*exec.ExitError); ok {
 			return uint(err.ExitCode()), nil
 		}
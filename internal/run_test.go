@@ -14,7 +14,6 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	uio "t0ast.cc/tbml/util/io"
-	ustring "t0ast.cc/tbml/util/string"
 )
 
 func setUpTestEnvironment(t *testing.T) (config Configuration, profile ProfileConfiguration, instance ProfileInstance, instanceDir string, cleanup func()) {
@@ -65,11 +64,16 @@ func TestWriteInstanceData(t *testing.T) {
 	assert.True(t, time.Now().Add(-10*time.Second).Before(actual.LastUsed))
 	assert.True(t, time.Now().After(actual.LastUsed))
 
+	assert.Equal(t, time.UTC, actual.Created.Location())
+	assert.Equal(t, time.UTC, actual.LastUsed.Location())
+	assert.Equal(t, profileInstanceSchemaVersion, actual.SchemaVersion)
+
 	createdBeforeCleanup := actual.Created
 	lastUsedBeforeCleanup := actual.LastUsed
 
 	actual.Created = instance.Created
 	actual.LastUsed = instance.LastUsed
+	actual.SchemaVersion = instance.SchemaVersion
 	actual.UsagePID = instance.UsagePID
 	assert.Equal(t, instance, actual)
 
@@ -94,10 +98,101 @@ func TestWriteInstanceData(t *testing.T) {
 
 	actual.Created = instance.Created
 	actual.LastUsed = instance.LastUsed
+	actual.SchemaVersion = instance.SchemaVersion
 	actual.UsageLabel = instance.UsageLabel
 	assert.Equal(t, instance, actual)
 }
 
+func TestProfileInstanceBackup(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instanceDataPath := filepath.Join(instanceDir, "profile-instance.json")
+
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	assert.NoFileExists(t, filepath.Join(instanceDir, instanceDataBackupFileName))
+	updated := instance
+	updated.InstalledExtensions = []string{"foo@t0ast.cc"}
+	assert.NoError(t, writeProfileInstance(config, updated))
+	assert.FileExists(t, filepath.Join(instanceDir, instanceDataBackupFileName))
+
+	// A torn write
+	assert.NoError(t, os.WriteFile(instanceDataPath, []byte(`{"ProfileLabel": "te`), uio.FileModeURWGRWO))
+	recovered, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, instance.UsageLabel, recovered.UsageLabel)
+	assert.Empty(t, recovered.InstalledExtensions)
+
+	// Writing over corrupt metadata keeps the last good backup.
+	assert.NoError(t, writeProfileInstance(config, updated))
+	backupBytes, err := os.ReadFile(filepath.Join(instanceDir, instanceDataBackupFileName))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(backupBytes), "foo@t0ast.cc")
+
+	assert.NoError(t, writeProfileInstance(config, updated))
+	assert.NoError(t, os.WriteFile(instanceDataPath, []byte(`{"ProfileLabel": "te`), uio.FileModeURWGRWO))
+
+	warnings := &Warnings{}
+	instances, err := GetProfileInstances(config, warnings)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, []string{"foo@t0ast.cc"}, instances[0].InstalledExtensions)
+	assert.Len(t, warnings.List(), 1)
+	// The metadata was restored, so it is recovered only once.
+	_, fromBackup, err := readProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.False(t, fromBackup)
+
+	assert.NoError(t, os.Remove(filepath.Join(instanceDir, instanceDataBackupFileName)))
+	assert.NoError(t, os.WriteFile(instanceDataPath, []byte(`{"ProfileLabel": "te`), uio.FileModeURWGRWO))
+	_, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.Error(t, err)
+}
+
+func TestUpdateLastUsedPeriodically(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	lastUsed := time.Now().Add(-24 * time.Hour)
+	instance.LastUsed = lastUsed
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	defaultInterval := lastUsedUpdateInterval
+	lastUsedUpdateInterval = 10 * time.Millisecond
+	defer func() { lastUsedUpdateInterval = defaultInterval }()
+
+	stop := updateLastUsedPeriodically(config, instance.InstanceLabel)
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, stop())
+
+	instanceAfter, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.True(t, instanceAfter.LastUsed.After(lastUsed.Add(23*time.Hour)))
+}
+
+func TestUpdateLastUsedKeepsConcurrentUpdates(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	defaultInterval := lastUsedUpdateInterval
+	lastUsedUpdateInterval = time.Millisecond
+	defer func() { lastUsedUpdateInterval = defaultInterval }()
+
+	// Pinning while the browser runs must not be undone by the next
+	// update of LastUsed.
+	stop := updateLastUsedPeriodically(config, instance.InstanceLabel)
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, PinInstance(config, instance, i%2 == 0, nil))
+	}
+	assert.NoError(t, PinInstance(config, instance, true, nil))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, stop())
+
+	stored, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.True(t, stored.Pinned)
+}
+
 func TestEnsureFiles(t *testing.T) {
 	testCases := []struct {
 		desc string
@@ -146,7 +241,7 @@ func TestEnsureFiles(t *testing.T) {
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			_, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			config, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
 			defer cleanUpEnvironment()
 
 			if tC.prepareProfile != nil {
@@ -171,7 +266,7 @@ func TestEnsureFiles(t *testing.T) {
 					assert.NoFileExists(t, filepath.Join(instanceDir, k))
 				}
 
-				assert.NoError(t, ensureFiles(profile, "testdata/ensure-files", instanceDir))
+				assert.NoError(t, ensureFiles(config, profile, nil, "testdata/ensure-files", instanceDir))
 
 				verifyFileContentsFromMap(t)
 			})
@@ -182,7 +277,7 @@ func TestEnsureFiles(t *testing.T) {
 					assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, k), changedContent, uio.FileModeURWGRWO))
 				}
 
-				assert.NoError(t, ensureFiles(profile, "testdata/ensure-files", instanceDir))
+				assert.NoError(t, ensureFiles(config, profile, nil, "testdata/ensure-files", instanceDir))
 
 				if tC.expectChangesAreKept {
 					for k := range tC.expectedFiles {
@@ -330,74 +425,6 @@ func TestEnsureExtensions(t *testing.T) {
 	}
 }
 
-func TestWritePortSettings(t *testing.T) {
-	somePid := 1234
-
-	testCases := []struct {
-		desc string
-
-		existingUserJSContent string
-		expectedControlPort   uint
-		expectedSOCKSPort     uint
-		extraInstances        []ProfileInstance
-	}{
-		{
-			desc: "First port is free",
-
-			expectedControlPort: 9151,
-			expectedSOCKSPort:   9150,
-		},
-		{
-			desc: "Later port",
-
-			expectedControlPort: 9161,
-			expectedSOCKSPort:   9160,
-			extraInstances: []ProfileInstance{
-				{
-					InstanceLabel: "test-2",
-					ProfileLabel:  "test",
-					UsagePID:      &somePid,
-				},
-			},
-		},
-		{
-			desc: "With existing user.js file",
-
-			existingUserJSContent: ustring.TrimIndentation(`
-				// This is an existing user.js file.
-				user_pref("foo", "bar");
-
-			`),
-			expectedControlPort: 9151,
-			expectedSOCKSPort:   9150,
-		},
-	}
-	for _, tC := range testCases {
-		t.Run(tC.desc, func(t *testing.T) {
-			_, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
-			defer cleanUpEnvironment()
-
-			userJSPath := filepath.Join(instanceDir, relativeProfilePath, "user.js")
-			if tC.existingUserJSContent != "" {
-				assert.NoError(t, os.MkdirAll(filepath.Dir(userJSPath), uio.FileModeURWXGRWXO))
-				assert.NoError(t, os.WriteFile(userJSPath, []byte(tC.existingUserJSContent), uio.FileModeURWGRWO))
-			}
-
-			assert.NoError(t, writePortSettings(instanceDir, append(tC.extraInstances, instance)))
-
-			actualUserJS, err := os.ReadFile(userJSPath)
-			assert.NoError(t, err)
-
-			expectedUserJS := fmt.Sprintf(ustring.TrimIndentation(`
-				%suser_pref("network.proxy.socks_port", %d);
-				user_pref("extensions.torlauncher.control_port", %d);
-			`), tC.existingUserJSContent, tC.expectedControlPort, tC.expectedSOCKSPort)
-
-			assert.Equal(t, expectedUserJS, string(actualUserJS))
-		})
-	}
-}
-
 func assertIsBindMount(t *testing.T, mountpoint, dst string) {
 	mountpointCmd := exec.Command("mountpoint", mountpoint)
 	output, err := mountpointCmd.CombinedOutput()
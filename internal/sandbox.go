@@ -0,0 +1,350 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var ErrSandboxUnavailable error = errors.New("Sandbox unavailable")
+
+const (
+	sandboxTypeBubblewrap = "bubblewrap"
+	sandboxTypeDocker     = "docker"
+	sandboxTypeFirejail   = "firejail"
+	sandboxTypePodman     = "podman"
+)
+
+// sandboxBinaries maps sandbox types to the programs that implement
+// them.
+var sandboxBinaries = map[string]string{
+	sandboxTypeBubblewrap: "bwrap",
+	sandboxTypeDocker:     "docker",
+	sandboxTypeFirejail:   "firejail",
+	sandboxTypePodman:     "podman",
+}
+
+// containerRemoveTimeout is how long removing a leftover container may
+// take.
+const containerRemoveTimeout = 30 * time.Second
+
+// bubblewrapSystemPaths are bound read-only into bubblewrap sandboxes
+// if they exist. Besides the programs and libraries, this covers what
+// the browser needs for fonts, TLS and DNS resolution.
+var bubblewrapSystemPaths = []string{
+	"/usr",
+	"/bin",
+	"/sbin",
+	"/lib",
+	"/lib64",
+	"/opt",
+	"/etc/ca-certificates",
+	"/etc/fonts",
+	"/etc/group",
+	"/etc/hosts",
+	"/etc/localtime",
+	"/etc/machine-id",
+	"/etc/nsswitch.conf",
+	"/etc/passwd",
+	"/etc/pki",
+	"/etc/resolv.conf",
+	"/etc/ssl",
+}
+
+func getSandboxConfiguration(profile ProfileConfiguration) SandboxConfiguration {
+	sandbox := SandboxConfiguration{}
+	if profile.Sandbox != nil {
+		sandbox = *profile.Sandbox
+	}
+	if sandbox.Type == "" {
+		sandbox.Type = sandboxTypeFirejail
+	}
+	return sandbox
+}
+
+func validateSandboxSettings(profile ProfileConfiguration) error {
+	sandbox := getSandboxConfiguration(profile)
+	if _, ok := sandboxBinaries[sandbox.Type]; !ok {
+		return fmt.Errorf("Unknown sandbox type %s", sandbox.Type)
+	}
+	if isContainerSandbox(sandbox) && sandbox.Image == "" {
+		return fmt.Errorf("Sandbox type %s needs an image", sandbox.Type)
+	}
+	if !isContainerSandbox(sandbox) && sandbox.Image != "" {
+		return fmt.Errorf("Sandbox type %s doesn't use an image", sandbox.Type)
+	}
+	return nil
+}
+
+func isContainerSandbox(sandbox SandboxConfiguration) bool {
+	return sandbox.Type == sandboxTypePodman || sandbox.Type == sandboxTypeDocker
+}
+
+// newSandboxedBrowserCommand returns the command that starts the
+// profile's browser (or a shell, for debugging) in its sandbox. If
+// the sandbox's program isn't installed, the returned error wraps
+// ErrSandboxUnavailable, unless the sandbox is optional. Then the
+// browser is started without a sandbox and a warning is added.
+func newSandboxedBrowserCommand(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool, warnings *Warnings) (*exec.Cmd, error) {
+	sandbox := getSandboxConfiguration(profile)
+	binary := sandboxBinaries[sandbox.Type]
+	if _, err := exec.LookPath(binary); err != nil {
+		if !sandbox.Optional {
+			return nil, uerror.StackTracef("%w: %s is not installed", ErrSandboxUnavailable, binary)
+		}
+		warnings.Add(profile.Label, "%s is not installed, launching without a sandbox", binary)
+		return newUnsandboxedCommand(ctx, profile, instanceDir, debugShell), nil
+	}
+
+	switch sandbox.Type {
+	case sandboxTypeBubblewrap:
+		return newBubblewrapCommand(ctx, profile, instanceDir, debugShell)
+	case sandboxTypePodman, sandboxTypeDocker:
+		return newContainerCommand(ctx, profile, sandbox, instanceDir, debugShell)
+	default:
+		return newFirejailCommand(ctx, profile, instanceDir, debugShell), nil
+	}
+}
+
+func newFirejailCommand(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool) *exec.Cmd {
+	firejailArgs := []string{
+		"dbus-launch", "firejail", fmt.Sprintf("--private=%s", instanceDir),
+	}
+	if debugShell {
+		firejailArgs = append(firejailArgs, "--noprofile", "fish")
+	} else {
+		firejailArgs = append(firejailArgs, fmt.Sprint("--profile=", filepath.Join(instanceDir, tblFirejailProfileFileName)))
+		firejailArgs = append(firejailArgs, getBrowserArgs(profile)...)
+	}
+
+	firejailCmd := exec.CommandContext(ctx, firejailArgs[0], firejailArgs[1:]...)
+	firejailCmd.Env = append(os.Environ(), "XDG_CACHE_HOME=")
+	firejailCmd.Env = append(firejailCmd.Env, getBrowserEnvironment(profile)...)
+	return firejailCmd
+}
+
+func newBubblewrapCommand(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool) (*exec.Cmd, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	bwrapArgs := getBubblewrapArgs(instanceDir, home, os.Getenv("XDG_RUNTIME_DIR"), os.Getenv("WAYLAND_DISPLAY"), os.Getenv("XAUTHORITY"))
+	if debugShell {
+		bwrapArgs = append(bwrapArgs, "fish")
+	} else {
+		bwrapArgs = append(bwrapArgs, getBrowserArgs(profile)...)
+	}
+
+	bwrapCmd := exec.CommandContext(ctx, "bwrap", bwrapArgs...)
+	bwrapCmd.Env = append(os.Environ(), "XDG_CACHE_HOME=")
+	bwrapCmd.Env = append(bwrapCmd.Env, getBrowserEnvironment(profile)...)
+	return bwrapCmd, nil
+}
+
+// getBubblewrapArgs returns the bwrap options for the default
+// allowlist: The instance directory becomes the home directory, like
+// with firejail's --private, and the downloads directory, the display
+// server sockets and the system files from bubblewrapSystemPaths are
+// bound into the sandbox. The network is shared, everything else is
+// unshared.
+func getBubblewrapArgs(instanceDir, home, runtimeDir, waylandDisplay, xAuthority string) []string {
+	args := []string{
+		"--die-with-parent",
+		"--unshare-all",
+		"--share-net",
+		"--proc", "/proc",
+		"--dev", "/dev",
+		"--dev-bind-try", "/dev/dri", "/dev/dri",
+		"--tmpfs", "/tmp",
+	}
+	for _, path := range bubblewrapSystemPaths {
+		args = append(args, "--ro-bind-try", path, path)
+	}
+	args = append(args,
+		"--bind", instanceDir, home,
+		"--setenv", "HOME", home,
+		"--bind-try", filepath.Join(home, "Downloads"), filepath.Join(home, "Downloads"),
+		"--ro-bind-try", "/tmp/.X11-unix", "/tmp/.X11-unix",
+	)
+	if xAuthority != "" {
+		args = append(args, "--ro-bind-try", xAuthority, xAuthority)
+	}
+	if runtimeDir != "" {
+		args = append(args, "--tmpfs", runtimeDir)
+		if waylandDisplay != "" {
+			waylandSocket := waylandDisplay
+			if !filepath.IsAbs(waylandSocket) {
+				waylandSocket = filepath.Join(runtimeDir, waylandSocket)
+			}
+			args = append(args, "--ro-bind-try", waylandSocket, waylandSocket)
+		}
+	}
+	return args
+}
+
+func newContainerCommand(ctx context.Context, profile ProfileConfiguration, sandbox SandboxConfiguration, instanceDir string, debugShell bool) (*exec.Cmd, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	host := containerHost{
+		Display:        os.Getenv("DISPLAY"),
+		GID:            os.Getgid(),
+		Home:           home,
+		RuntimeDir:     os.Getenv("XDG_RUNTIME_DIR"),
+		UID:            os.Getuid(),
+		WaylandDisplay: os.Getenv("WAYLAND_DISPLAY"),
+		XAuthority:     os.Getenv("XAUTHORITY"),
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	containerArgs := getContainerArgs(profile, sandbox, instanceDir, host, exists, debugShell)
+	containerCmd := exec.CommandContext(ctx, sandboxBinaries[sandbox.Type], containerArgs...)
+	containerCmd.Env = os.Environ()
+	return containerCmd, nil
+}
+
+// containerHost is what getContainerArgs needs to know about the
+// user's session.
+type containerHost struct {
+	Display        string
+	GID            int
+	Home           string
+	RuntimeDir     string
+	UID            int
+	WaylandDisplay string
+	XAuthority     string
+}
+
+// getContainerArgs returns the arguments of "podman run" or "docker
+// run" for the profile's browser: Like with bubblewrap, the instance
+// directory becomes the home directory and the downloads directory and
+// the display server sockets are bound into the container, with the
+// user's UID so the files stay the user's. The host network is used,
+// so the browser reaches Tor on localhost. The container is named
+// after the instance directory, see getContainerName, and removed once
+// the browser exits.
+func getContainerArgs(profile ProfileConfiguration, sandbox SandboxConfiguration, instanceDir string, host containerHost, exists func(path string) bool, debugShell bool) []string {
+	args := []string{
+		"run", "--rm",
+		"--name", getContainerName(instanceDir),
+		"--network", "host",
+		// Firefox's content processes crash with the default 64 MB.
+		"--shm-size", "2g",
+	}
+	if sandbox.Type == sandboxTypePodman {
+		args = append(args, "--userns", "keep-id")
+	} else {
+		args = append(args, "--user", fmt.Sprintf("%d:%d", host.UID, host.GID))
+	}
+	args = append(args,
+		"--volume", instanceDir+":"+host.Home,
+		"--env", "HOME="+host.Home,
+		"--env", "XDG_CACHE_HOME=",
+		"--workdir", host.Home,
+	)
+	if exists("/dev/dri") {
+		args = append(args, "--device", "/dev/dri")
+	}
+	downloadsDir := filepath.Join(host.Home, "Downloads")
+	if exists(downloadsDir) {
+		args = append(args, "--volume", downloadsDir+":"+downloadsDir)
+	}
+	if host.Display != "" && exists("/tmp/.X11-unix") {
+		args = append(args, "--volume", "/tmp/.X11-unix:/tmp/.X11-unix:ro", "--env", "DISPLAY="+host.Display)
+		if host.XAuthority != "" && exists(host.XAuthority) {
+			args = append(args, "--volume", host.XAuthority+":"+host.XAuthority+":ro", "--env", "XAUTHORITY="+host.XAuthority)
+		}
+	}
+	if host.RuntimeDir != "" && host.WaylandDisplay != "" {
+		waylandSocket := host.WaylandDisplay
+		if !filepath.IsAbs(waylandSocket) {
+			waylandSocket = filepath.Join(host.RuntimeDir, waylandSocket)
+		}
+		if exists(waylandSocket) {
+			args = append(args,
+				"--volume", waylandSocket+":"+waylandSocket,
+				"--env", "XDG_RUNTIME_DIR="+host.RuntimeDir,
+				"--env", "WAYLAND_DISPLAY="+host.WaylandDisplay,
+			)
+		}
+	}
+	for _, variable := range getBrowserEnvironment(profile) {
+		args = append(args, "--env", variable)
+	}
+
+	if debugShell {
+		return append(args, "--interactive", "--tty", sandbox.Image, "sh")
+	}
+	args = append(args, sandbox.Image)
+	return append(args, getBrowserArgs(profile)...)
+}
+
+// getContainerName returns the name of the container an instance's
+// browser runs in. It is derived from the instance directory, so a
+// container left over from a crashed launch can be found again.
+func getContainerName(instanceDir string) string {
+	hash := sha256.Sum256([]byte(instanceDir))
+	return "tbml-" + hex.EncodeToString(hash[:])[:12]
+}
+
+// removeSandboxContainer removes the container of the instance's
+// browser if the profile uses a container sandbox and the container
+// exists. It is called before the browser is launched, to clear one
+// left over from a crash, and after the browser exited, since killing
+// the container program, e.g. when the launch is canceled, doesn't
+// stop the container.
+func removeSandboxContainer(profile ProfileConfiguration, instanceDir string) error {
+	sandbox := getSandboxConfiguration(profile)
+	if !isContainerSandbox(sandbox) {
+		return nil
+	}
+	binary := sandboxBinaries[sandbox.Type]
+	if _, err := exec.LookPath(binary); err != nil {
+		// Optional sandboxes fall back to launching without one.
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), containerRemoveTimeout)
+	defer cancel()
+
+	name := getContainerName(instanceDir)
+	output, err := exec.CommandContext(ctx, binary, "ps", "--all", "--quiet", "--filter", "name=^"+name+"$").Output()
+	if err != nil {
+		return uerror.StackTracef("Failed to look for container %s: %w", name, err)
+	}
+	if strings.TrimSpace(string(output)) == "" {
+		return nil
+	}
+	if output, err := exec.CommandContext(ctx, binary, "rm", "--force", name).CombinedOutput(); err != nil {
+		return uerror.StackTracef("Failed to remove container %s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// newUnsandboxedCommand starts the browser directly, with the instance
+// directory as its home directory.
+func newUnsandboxedCommand(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool) *exec.Cmd {
+	args := getBrowserArgs(profile)
+	if debugShell {
+		args = []string{"fish"}
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = instanceDir
+	cmd.Env = append(os.Environ(), fmt.Sprint("HOME=", instanceDir), "XDG_CACHE_HOME=")
+	cmd.Env = append(cmd.Env, getBrowserEnvironment(profile)...)
+	return cmd
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestNewFirejailCommand(t *testing.T) {
+	profile := ProfileConfiguration{
+		BrowserCommand: []string{"firefox"},
+		Environment: map[string]string{
+			"MOZ_ENABLE_WAYLAND": "1",
+			"GTK_THEME":          "Adwaita:dark",
+		},
+		ExtraArgs: []string{"--class", "work"},
+	}
+
+	cmd := newFirejailCommand(context.Background(), profile, "/tmp/instance", false)
+	assert.Equal(t, []string{"dbus-launch", "firejail", "--private=/tmp/instance", "--profile=/tmp/instance/torbrowser-launcher.profile", "firefox", "--class", "work"}, cmd.Args)
+	assert.Equal(t, []string{"XDG_CACHE_HOME=", "GTK_THEME=Adwaita:dark", "MOZ_ENABLE_WAYLAND=1"}, cmd.Env[len(cmd.Env)-3:])
+
+	cmd = newFirejailCommand(context.Background(), profile, "/tmp/instance", true)
+	assert.Equal(t, []string{"dbus-launch", "firejail", "--private=/tmp/instance", "--noprofile", "fish"}, cmd.Args)
+}
+
+func TestGetBubblewrapArgs(t *testing.T) {
+	args := getBubblewrapArgs("/tmp/instance", "/home/user", "/run/user/1000", "wayland-1", "")
+	assert.Subset(t, args, []string{"--unshare-all", "--share-net", "--die-with-parent"})
+	assertArgSequence(t, args, "--bind", "/tmp/instance", "/home/user")
+	assertArgSequence(t, args, "--bind-try", "/home/user/Downloads", "/home/user/Downloads")
+	assertArgSequence(t, args, "--ro-bind-try", "/etc/resolv.conf", "/etc/resolv.conf")
+	assertArgSequence(t, args, "--ro-bind-try", "/tmp/.X11-unix", "/tmp/.X11-unix")
+	assertArgSequence(t, args, "--ro-bind-try", "/run/user/1000/wayland-1", "/run/user/1000/wayland-1")
+
+	args = getBubblewrapArgs("/tmp/instance", "/home/user", "", "", "/home/user/.Xauthority")
+	assertArgSequence(t, args, "--ro-bind-try", "/home/user/.Xauthority", "/home/user/.Xauthority")
+	assert.NotContains(t, args, "/run/user/1000")
+}
+
+func TestGetContainerArgs(t *testing.T) {
+	profile := ProfileConfiguration{
+		BrowserCommand: []string{"firefox"},
+		Environment:    map[string]string{"MOZ_ENABLE_WAYLAND": "1"},
+	}
+	host := containerHost{
+		Display:        ":0",
+		GID:            100,
+		Home:           "/home/user",
+		RuntimeDir:     "/run/user/1000",
+		UID:            1000,
+		WaylandDisplay: "wayland-1",
+	}
+	everythingExists := func(path string) bool { return true }
+
+	args := getContainerArgs(profile, SandboxConfiguration{Type: "podman", Image: "tor-browser"}, "/tmp/instance", host, everythingExists, false)
+	assertArgSequence(t, args, "run", "--rm", "--name", getContainerName("/tmp/instance"))
+	assertArgSequence(t, args, "--network", "host")
+	assertArgSequence(t, args, "--userns", "keep-id")
+	assertArgSequence(t, args, "--volume", "/tmp/instance:/home/user", "--env", "HOME=/home/user")
+	assertArgSequence(t, args, "--volume", "/home/user/Downloads:/home/user/Downloads")
+	assertArgSequence(t, args, "--volume", "/tmp/.X11-unix:/tmp/.X11-unix:ro", "--env", "DISPLAY=:0")
+	assertArgSequence(t, args, "--volume", "/run/user/1000/wayland-1:/run/user/1000/wayland-1")
+	assertArgSequence(t, args, "--env", "MOZ_ENABLE_WAYLAND=1", "tor-browser", "firefox")
+	assert.Equal(t, "firefox", args[len(args)-1])
+
+	nothingExists := func(path string) bool { return false }
+	args = getContainerArgs(profile, SandboxConfiguration{Type: "docker", Image: "tor-browser"}, "/tmp/instance", host, nothingExists, true)
+	assertArgSequence(t, args, "--user", "1000:100")
+	assert.NotContains(t, args, "--device")
+	assert.NotContains(t, args, "DISPLAY=:0")
+	assert.NotContains(t, args, "WAYLAND_DISPLAY=wayland-1")
+	assert.Equal(t, []string{"--interactive", "--tty", "tor-browser", "sh"}, args[len(args)-4:])
+}
+
+func TestGetContainerName(t *testing.T) {
+	assert.Equal(t, getContainerName("/tmp/instance"), getContainerName("/tmp/instance"))
+	assert.NotEqual(t, getContainerName("/tmp/instance"), getContainerName("/tmp/other"))
+	assert.Regexp(t, "^tbml-[0-9a-f]{12}$", getContainerName("/tmp/instance"))
+}
+
+func assertArgSequence(t *testing.T, args []string, sequence ...string) {
+	for i := 0; i+len(sequence) <= len(args); i++ {
+		if assert.ObjectsAreEqual(sequence, args[i:i+len(sequence)]) {
+			return
+		}
+	}
+	t.Errorf("%v doesn't contain %v", args, sequence)
+}
+
+func TestNewSandboxedBrowserCommand(t *testing.T) {
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+
+	testCases := []struct {
+		desc string
+
+		expectedArgs    []string
+		expectedError   error
+		expectedWarning bool
+		installed       []string
+		sandbox         *SandboxConfiguration
+	}{
+		{
+			desc: "Firejail",
+
+			expectedArgs: []string{"dbus-launch", "firejail"},
+			installed:    []string{"firejail"},
+		},
+		{
+			desc: "Bubblewrap",
+
+			expectedArgs: []string{"bwrap", "--die-with-parent"},
+			installed:    []string{"bwrap"},
+			sandbox:      &SandboxConfiguration{Type: "bubblewrap"},
+		},
+		{
+			desc: "Podman",
+
+			expectedArgs: []string{"podman", "run", "--rm", "--name", getContainerName("/tmp/instance")},
+			installed:    []string{"podman"},
+			sandbox:      &SandboxConfiguration{Type: "podman", Image: "tor-browser"},
+		},
+		{
+			desc: "Missing sandbox",
+
+			expectedError: ErrSandboxUnavailable,
+			installed:     []string{"firejail"},
+			sandbox:       &SandboxConfiguration{Type: "bubblewrap"},
+		},
+		{
+			desc: "Missing optional sandbox",
+
+			expectedArgs:    []string{"torbrowser-launcher"},
+			expectedWarning: true,
+			sandbox:         &SandboxConfiguration{Optional: true},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			entries, err := os.ReadDir(binDir)
+			assert.NoError(t, err)
+			for _, entry := range entries {
+				assert.NoError(t, os.Remove(filepath.Join(binDir, entry.Name())))
+			}
+			for _, binary := range tC.installed {
+				assert.NoError(t, os.WriteFile(filepath.Join(binDir, binary), []byte("#!/bin/sh\n"), uio.FileModeURWXGRWXO))
+			}
+
+			warnings := &Warnings{}
+			profile := ProfileConfiguration{Label: "test", Sandbox: tC.sandbox}
+			cmd, err := newSandboxedBrowserCommand(context.Background(), profile, "/tmp/instance", false, warnings)
+			if tC.expectedError != nil {
+				assert.ErrorIs(t, err, tC.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedArgs, cmd.Args[:len(tC.expectedArgs)])
+			assert.Equal(t, tC.expectedWarning, len(warnings.List()) > 0)
+			if tC.expectedWarning {
+				assert.Contains(t, cmd.Env, "HOME=/tmp/instance")
+			}
+		})
+	}
+}
+
+func TestValidateSandboxSettings(t *testing.T) {
+	assert.NoError(t, validateSandboxSettings(ProfileConfiguration{}))
+	assert.NoError(t, validateSandboxSettings(ProfileConfiguration{Sandbox: &SandboxConfiguration{Type: "bubblewrap"}}))
+	assert.NoError(t, validateSandboxSettings(ProfileConfiguration{Sandbox: &SandboxConfiguration{Type: "podman", Image: "tor-browser"}}))
+	assert.Error(t, validateSandboxSettings(ProfileConfiguration{Sandbox: &SandboxConfiguration{Type: "docker"}}))
+	assert.Error(t, validateSandboxSettings(ProfileConfiguration{Sandbox: &SandboxConfiguration{Type: "firejail", Image: "tor-browser"}}))
+	assert.Error(t, validateSandboxSettings(ProfileConfiguration{Sandbox: &SandboxConfiguration{Type: "lxc"}}))
+}
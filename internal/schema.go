@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+var (
+	ErrSchemaViolation error = errors.New("The document doesn't match the schema")
+	ErrUnknownSchema   error = errors.New("Unknown schema")
+)
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaFormat is a JSON format tbml reads or writes.
+type schemaFormat struct {
+	description string
+	// input formats are written by users, so unknown fields are
+	// rejected. Output formats may gain fields, so they aren't, but
+	// the fields they have now are required.
+	input bool
+	value interface{}
+}
+
+// schemaFormats are the formats that schemas are generated for, by the
+// name that tbml schema print takes.
+var schemaFormats = map[string]schemaFormat{
+	"config": {
+		description: "tbml's configuration file (YAML and TOML configurations are converted to JSON first)",
+		input:       true,
+		value:       Configuration{},
+	},
+	"control-socket": {
+		description: "A line sent over an instance's control socket; the mothership connector's first line is its greeting instead",
+		input:       true,
+		value:       socketMsg{},
+	},
+	"instance-metadata": {
+		description: "The profile-instance.json file of an instance",
+		value:       ProfileInstance{},
+	},
+	"ls": {
+		description: "The output of tbml ls --json",
+		value:       []ProfileListing{},
+	},
+	"stats": {
+		description: "The output of tbml stats --format json",
+		value:       []UsageTime{},
+	},
+	"stats-boot": {
+		description: "The output of tbml stats --boot --format json",
+		value:       []BootTimeSummary{},
+	},
+	"status": {
+		description: "The output of tbml status --json",
+		value:       []InstanceStats{},
+	},
+	"tabs": {
+		description: "The output of tbml tabs list --json and tbml tabs export --format json",
+		value:       []Tab{},
+	},
+	"version": {
+		description: "The output of tbml version --json",
+		value:       BuildMetadata{},
+	},
+}
+
+// GetSchemaNames returns the names of the formats there are schemas
+// for, sorted.
+func GetSchemaNames() []string {
+	names := make([]string, 0, len(schemaFormats))
+	for name := range schemaFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetSchema returns the JSON Schema of a format, generated from the Go
+// types that tbml reads or writes it with. The schema only changes
+// when the types do, so it can be checked into other projects.
+func GetSchema(name string) ([]byte, error) {
+	format, ok := schemaFormats[name]
+	if !ok {
+		return nil, uerror.StackTracef("%w: %s", ErrUnknownSchema, name)
+	}
+	generator := schemaGenerator{defs: map[string]interface{}{}, input: format.input}
+	schema := generator.schemaFor(reflect.TypeOf(format.value))
+	if name == "control-socket" {
+		schema = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"const": mothershipGreeting}, schema}}
+	}
+	schema["$schema"] = jsonSchemaDialect
+	schema["title"] = name
+	schema["description"] = format.description
+	if len(generator.defs) > 0 {
+		schema["$defs"] = generator.defs
+	}
+
+	// Maps are marshaled with sorted keys, which makes the schema
+	// deterministic.
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(schema); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+type schemaGenerator struct {
+	defs  map[string]interface{}
+	input bool
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaEnums are the values of the string types that only have a few.
+var schemaEnums = map[reflect.Type][]interface{}{
+	reflect.TypeOf(socketMsgType("")): {socketMsgTypeCloseTab, socketMsgTypeOpenedTab, socketMsgTypeOpenTab},
+}
+
+func (g schemaGenerator) schemaFor(t reflect.Type) map[string]interface{} {
+	if enum, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": enum}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullableSchema(g.schemaFor(t.Elem()))
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes byte slices in base64.
+			return map[string]interface{}{"type": "string"}
+		}
+		schema := map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+		if t.Kind() == reflect.Slice {
+			return nullableSchema(schema)
+		}
+		return schema
+	case reflect.Map:
+		return nullableSchema(map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())})
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		// Named structs are defined once, which also ends recursion.
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = nil
+			g.defs[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	// interface{} holds anything.
+	return map[string]interface{}{}
+}
+
+func (g schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []interface{}{}
+	g.addStructFields(t, properties, &required)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if g.input {
+		schema["additionalProperties"] = false
+	} else if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addStructFields adds the fields of a struct, and those of the structs
+// embedded in it, as encoding/json sees them.
+func (g schemaGenerator) addStructFields(t reflect.Type, properties map[string]interface{}, required *[]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addStructFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schemaFor(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// nullableSchema allows null in addition to what schema allows, since
+// encoding/json writes nil pointers, slices and maps as null.
+func nullableSchema(schema map[string]interface{}) map[string]interface{} {
+	if schemaType, ok := schema["type"].(string); ok {
+		schema["type"] = []interface{}{schemaType, "null"}
+		return schema
+	}
+	return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+}
+
+// ValidateWithSchema checks a JSON document against the schema of a
+// format. Only the keywords that GetSchema generates are supported. If
+// the document doesn't match, the error wraps ErrSchemaViolation and
+// names the first value that doesn't.
+func ValidateWithSchema(name string, document []byte) error {
+	schemaBytes, err := GetSchema(name)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaBytes, &schema); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return uerror.StackTracef("%w: %s", ErrSchemaViolation, err)
+	}
+	defs, _ := schema["$defs"].(map[string]interface{})
+	if problem := validateSchemaValue(schema, defs, value, "$"); problem != "" {
+		return uerror.StackTracef("%w: %s", ErrSchemaViolation, problem)
+	}
+	return nil
+}
+
+// validateSchemaValue returns what is wrong with a value, or "" if it
+// matches the schema.
+func validateSchemaValue(schema map[string]interface{}, defs map[string]interface{}, value interface{}, path string) string {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, _ := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+		if def == nil {
+			return fmt.Sprintf("%s: unknown reference %s", path, ref)
+		}
+		if problem := validateSchemaValue(def, defs, value, path); problem != "" {
+			return problem
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		problems := []string{}
+		for _, alternative := range anyOf {
+			problem := validateSchemaValue(alternative.(map[string]interface{}), defs, value, path)
+			if problem == "" {
+				problems = nil
+				break
+			}
+			problems = append(problems, problem)
+		}
+		if problems != nil {
+			return strings.Join(problems, "; or ")
+		}
+	}
+	if constant, ok := schema["const"]; ok && fmt.Sprint(constant) != fmt.Sprint(value) {
+		return fmt.Sprintf("%s: expected %v", path, constant)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || fmt.Sprint(allowed) == fmt.Sprint(value)
+		}
+		if !found {
+			return fmt.Sprintf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+	if schemaType, ok := schema["type"]; ok {
+		types := []interface{}{schemaType}
+		if list, ok := schemaType.([]interface{}); ok {
+			types = list
+		}
+		matches := false
+		for _, t := range types {
+			matches = matches || isJSONType(value, t.(string))
+		}
+		if !matches {
+			return fmt.Sprintf("%s: expected %v", path, schemaType)
+		}
+	}
+	if format, ok := schema["format"].(string); ok && format == "date-time" {
+		if s, ok := value.(string); ok {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Sprintf("%s: %q is not an RFC 3339 date and time", path, s)
+			}
+		}
+	}
+
+	switch value := value.(type) {
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				if problem := validateSchemaValue(items, defs, item, fmt.Sprintf("%s[%d]", path, i)); problem != "" {
+					return problem
+				}
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := value[name.(string)]; !ok {
+					return fmt.Sprintf("%s: missing %s", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propertyPath := path + "." + key
+			if property, ok := properties[key].(map[string]interface{}); ok {
+				if problem := validateSchemaValue(property, defs, value[key], propertyPath); problem != "" {
+					return problem
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Sprintf("%s: unknown field", propertyPath)
+				}
+			case map[string]interface{}:
+				if problem := validateSchemaValue(additional, defs, value[key], propertyPath); problem != "" {
+					return problem
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func isJSONType(value interface{}, schemaType string) bool {
+	switch value := value.(type) {
+	case nil:
+		return schemaType == "null"
+	case bool:
+		return schemaType == "boolean"
+	case string:
+		return schemaType == "string"
+	case json.Number:
+		if schemaType == "number" {
+			return true
+		}
+		f, err := value.Float64()
+		return schemaType == "integer" && err == nil && f == math.Trunc(f)
+	case []interface{}:
+		return schemaType == "array"
+	case map[string]interface{}:
+		return schemaType == "object"
+	}
+	return false
+}
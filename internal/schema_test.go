@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSchema(t *testing.T) {
+	for _, name := range GetSchemaNames() {
+		schema, err := GetSchema(name)
+		assert.NoError(t, err, name)
+		again, err := GetSchema(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, string(schema), string(again), name)
+
+		var parsed map[string]interface{}
+		assert.NoError(t, json.Unmarshal(schema, &parsed), name)
+		assert.Equal(t, jsonSchemaDialect, parsed["$schema"])
+		assert.Equal(t, name, parsed["title"])
+	}
+
+	_, err := GetSchema("daemon")
+	assert.True(t, errors.Is(err, ErrUnknownSchema))
+}
+
+func TestValidateWithSchema(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	created := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	instance.Created = created
+	instance.LastUsed = created
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	metadata, err := os.ReadFile(filepath.Join(instanceDir, "profile-instance.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWithSchema("instance-metadata", metadata))
+
+	listings, err := ListProfiles(config, nil, nil)
+	assert.NoError(t, err)
+	listingsJSON, err := json.Marshal(listings)
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWithSchema("ls", listingsJSON))
+
+	info, err := json.Marshal(BuildInfo())
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWithSchema("version", info))
+
+	msg, err := json.Marshal(socketMsg{Type: socketMsgTypeOpenTab, URL: "https://example.com"})
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWithSchema("control-socket", msg))
+	greeting, err := json.Marshal(mothershipGreeting)
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWithSchema("control-socket", greeting))
+
+	configJSON, err := json.Marshal(config)
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWithSchema("config", configJSON))
+	assert.NoError(t, ValidateWithSchema("config", []byte(`{"ProfilePath": "~/tbml", "Profiles": [{"Label": "work", "ExtensionFiles": ["ublock.xpi"]}]}`)))
+
+	for document, problem := range map[string]string{
+		`{"Profiles": [{"Label": "work", "ExtensionFile": []}]}`: "$.Profiles[0].ExtensionFile: unknown field",
+		`{"Profiles": [{"Label": 3}]}`:                           "$.Profiles[0].Label: expected string",
+		`{"ProfilePath": "~/tbml",`:                              "unexpected EOF",
+	} {
+		err := ValidateWithSchema("config", []byte(document))
+		assert.True(t, errors.Is(err, ErrSchemaViolation), document)
+		assert.Contains(t, err.Error(), problem, document)
+	}
+
+	err = ValidateWithSchema("control-socket", []byte(`{"type": "close-all", "url": ""}`))
+	assert.True(t, errors.Is(err, ErrSchemaViolation))
+	assert.Contains(t, err.Error(), "$.type: close-all is not one of")
+
+	err = ValidateWithSchema("instance-metadata", []byte(`{"InstanceLabel": "test-1"}`))
+	assert.True(t, errors.Is(err, ErrSchemaViolation))
+	assert.Contains(t, err.Error(), "$: missing")
+
+	err = ValidateWithSchema("ls", []byte(`[{"extensionFiles": [], "instances": [{"created": "yesterday"}], "label": "test", "userChromeFile": null, "userJSFile": null}]`))
+	assert.True(t, errors.Is(err, ErrSchemaViolation))
+}
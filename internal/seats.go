@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrUnknownSeat error = errors.New("The seat has no instance")
+
+var ErrInvalidSeat error = errors.New("Invalid seat")
+
+const seatAssignmentsFileName = "seats.json"
+
+// SeatAssignment is the instance a seat always uses. Seats are the
+// logins or workplaces of a shared machine, e.g. in a classroom, and
+// each gets an instance of its own that no other launch picks.
+type SeatAssignment struct {
+	Assigned      time.Time
+	InstanceLabel string
+	ProfileLabel  string
+	Seat          string
+}
+
+// GetSeatAssignments returns the instances assigned to seats, sorted
+// by seat.
+func GetSeatAssignments(config Configuration) ([]SeatAssignment, error) {
+	assignments, err := readSeatAssignments(config)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	sorted := make([]SeatAssignment, 0, len(assignments))
+	for seat, assignment := range assignments {
+		assignment.Seat = seat
+		sorted = append(sorted, assignment)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Seat < sorted[j].Seat
+	})
+	return sorted, nil
+}
+
+func readSeatAssignments(config Configuration) (map[string]SeatAssignment, error) {
+	assignments := map[string]SeatAssignment{}
+	if err := readStateFile(config, seatAssignmentsFileName, &assignments); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return assignments, nil
+}
+
+// AssignSeat returns the instance assigned to the seat. A seat without
+// an instance, or whose instance was deleted, gets a new instance of
+// the profile, which is reserved like with ReserveInstanceLabel until
+// it is launched. If profile is nil, the seat must have an instance
+// already, otherwise the error wraps ErrUnknownSeat. An instance of
+// another profile than the given one is an error wrapping
+// ErrInstanceOfOtherProfile.
+func AssignSeat(config Configuration, seat string, profile *ProfileConfiguration) (ProfileInstance, error) {
+	if strings.TrimSpace(seat) == "" {
+		return ProfileInstance{}, uerror.StackTracef("%w: %q", ErrInvalidSeat, seat)
+	}
+	unlockAllocation, err := lockStateFile(config, allocationLockFileName)
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	defer unlockAllocation()
+
+	assignments, err := readSeatAssignments(config)
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	if assignment, ok := assignments[seat]; ok {
+		instance, err := GetProfileInstance(config, assignment.InstanceLabel)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			ulog.Default().Info("The instance of the seat is gone, assigning a new one", "seat", seat, "instance", assignment.InstanceLabel)
+		case err != nil:
+			return ProfileInstance{}, uerror.WithStackTrace(err)
+		case profile != nil && instance.ProfileLabel != profile.Label:
+			return ProfileInstance{}, uerror.StackTracef("%w: %s of seat %s belongs to %s", ErrInstanceOfOtherProfile, instance.InstanceLabel, seat, instance.ProfileLabel)
+		default:
+			return instance, nil
+		}
+	}
+	if profile == nil {
+		return ProfileInstance{}, uerror.StackTracef("%w: %s", ErrUnknownSeat, seat)
+	}
+
+	label, err := reserveInstanceLabel(config, *profile)
+	if err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	assignments[seat] = SeatAssignment{
+		Assigned:      time.Now().UTC(),
+		InstanceLabel: label,
+		ProfileLabel:  profile.Label,
+	}
+	if err := writeStateFile(config, seatAssignmentsFileName, assignments); err != nil {
+		return ProfileInstance{}, uerror.WithStackTrace(err)
+	}
+	ulog.Default().Info("Assigned instance to seat", "seat", seat, "instance", label)
+	return GetProfileInstance(config, label)
+}
+
+// UnassignSeat takes the seat's instance away from it. The instance is
+// kept and can be picked by other launches afterwards.
+func UnassignSeat(config Configuration, seat string, mutations *Mutations) error {
+	unlockAllocation, err := lockStateFile(config, allocationLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlockAllocation()
+
+	assignments, err := readSeatAssignments(config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if _, ok := assignments[seat]; !ok {
+		return uerror.StackTracef("%w: %s", ErrUnknownSeat, seat)
+	}
+	return mutations.Apply("Unassign seat", seat, func() error {
+		delete(assignments, seat)
+		return writeStateFile(config, seatAssignmentsFileName, assignments)
+	})
+}
+
+// markSeatInstancesInUse returns instances with those assigned to
+// seats marked as in use, so GetBestInstance doesn't pick them. The
+// caller must hold the allocation lock.
+func markSeatInstancesInUse(config Configuration, instances []ProfileInstance) ([]ProfileInstance, error) {
+	assignments, err := readSeatAssignments(config)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	for _, assignment := range assignments {
+		for _, instance := range instances {
+			if instance.InstanceLabel == assignment.InstanceLabel {
+				instances = markInstanceInUse(instances, instance)
+				break
+			}
+		}
+	}
+	return instances, nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignSeat(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	_, err := AssignSeat(config, "alice", nil)
+	assert.ErrorIs(t, err, ErrUnknownSeat)
+	_, err = AssignSeat(config, " ", &profile)
+	assert.ErrorIs(t, err, ErrInvalidSeat)
+
+	alice, err := AssignSeat(config, "alice", &profile)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", alice.ProfileLabel)
+	assert.True(t, alice.Reserved)
+	bob, err := AssignSeat(config, "bob", &profile)
+	assert.NoError(t, err)
+	assert.NotEqual(t, alice.InstanceLabel, bob.InstanceLabel)
+
+	// Seats keep their instance, with or without a profile.
+	again, err := AssignSeat(config, "alice", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, alice.InstanceLabel, again.InstanceLabel)
+	_, err = AssignSeat(config, "alice", &ProfileConfiguration{Label: "other"})
+	assert.ErrorIs(t, err, ErrInstanceOfOtherProfile)
+
+	assignments, err := GetSeatAssignments(config)
+	assert.NoError(t, err)
+	if assert.Len(t, assignments, 2) {
+		assert.Equal(t, "alice", assignments[0].Seat)
+		assert.Equal(t, alice.InstanceLabel, assignments[0].InstanceLabel)
+		assert.Equal(t, "bob", assignments[1].Seat)
+	}
+
+	// A seat whose instance was deleted gets a new one.
+	assert.NoError(t, os.RemoveAll(filepath.Join(config.ProfilePath, alice.InstanceLabel)))
+	renewed, err := AssignSeat(config, "alice", &profile)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", renewed.ProfileLabel)
+
+	assert.NoError(t, UnassignSeat(config, "bob", nil))
+	assert.ErrorIs(t, UnassignSeat(config, "bob", nil), ErrUnknownSeat)
+	_, err = AssignSeat(config, "bob", nil)
+	assert.ErrorIs(t, err, ErrUnknownSeat)
+}
+
+func TestClaimBestInstanceSkipsSeats(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	seatInstance, err := AssignSeat(config, "alice", &profile)
+	assert.NoError(t, err)
+	// Once launched, the seat's instance isn't reserved anymore, but
+	// other launches must still leave it alone.
+	seatInstance.Reserved = false
+	assert.NoError(t, writeProfileInstanceForTest(config, seatInstance))
+
+	claimed, release, err := ClaimBestInstance(context.Background(), config, profile, nil, nil)
+	assert.NoError(t, err)
+	defer release()
+	assert.NotEqual(t, seatInstance.InstanceLabel, claimed.InstanceLabel)
+}
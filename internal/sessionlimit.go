@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"os/exec"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+const (
+	// sessionLimitWarningLead is how long before the end of a session
+	// the user is warned. Short sessions are warned halfway through.
+	sessionLimitWarningLead = 5 * time.Minute
+	notificationTimeout     = 5 * time.Second
+)
+
+// sendNotification is a variable so tests can capture notifications.
+var sendNotification = sendDesktopNotification
+
+// sendDesktopNotification shows a notification with notify-send, if
+// it is installed. icon is the path of an image file or empty.
+func sendDesktopNotification(summary string, body string, icon string) error {
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+	args := []string{"--app-name=tbml"}
+	if icon != "" {
+		args = append(args, "--icon="+icon)
+	}
+	return exec.CommandContext(ctx, "notify-send", append(args, summary, body)...).Run()
+}
+
+// GetTopicSessionLimit returns the SessionLimitMinutes of the topic or
+// of its nearest ancestor that sets it, or zero if there is none.
+func GetTopicSessionLimit(config Configuration, topic string) time.Duration {
+	for ; topic != ""; topic = getParentTopic(topic) {
+		for _, topicConfig := range config.Topics {
+			if topicConfig.Topic == topic && topicConfig.SessionLimitMinutes != nil {
+				return time.Duration(*topicConfig.SessionLimitMinutes) * time.Minute
+			}
+		}
+	}
+	return 0
+}
+
+// superviseSessionLimit warns the user before the session of the
+// browser with the given PID is over and then closes the browser with
+// stopBrowser. A limit of zero doesn't limit the session. The instance
+// is called name in the notification, which shows icon. The returned
+// function stops the supervision.
+func superviseSessionLimit(ctx context.Context, pid int, profileDir string, limit time.Duration, name string, icon string) (stop func()) {
+	if limit <= 0 {
+		return func() {}
+	}
+	logger := ulog.FromContext(ctx)
+	lead := sessionLimitWarningLead
+	if lead > limit/2 {
+		lead = limit / 2
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		warning := time.NewTimer(limit - lead)
+		defer warning.Stop()
+		select {
+		case <-done:
+			return
+		case <-warning.C:
+		}
+		msgs := newNotificationPrinter()
+		summary := msgs.Sprintf("%s closes in %s", name, lead.Round(time.Second))
+		if err := sendNotification(summary, msgs.Sprintf("The session limit is almost reached."), icon); err != nil {
+			logger.Warn("Failed to send a notification", "error", uerror.Message(err))
+		}
+
+		end := time.NewTimer(lead)
+		defer end.Stop()
+		select {
+		case <-done:
+			return
+		case <-end.C:
+		}
+		logger.Info("Session limit reached, closing the browser", "limit", limit.String())
+		stopBrowser(ctx, pid, profileDir, done)
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTopicSessionLimit(t *testing.T) {
+	thirty, sixty := 30, 60
+	config := Configuration{
+		Topics: []TopicConfiguration{
+			{Topic: "social", SessionLimitMinutes: &thirty},
+			{Topic: "social/news", SessionLimitMinutes: &sixty},
+			{Topic: "social/chat"},
+		},
+	}
+
+	assert.Equal(t, 30*time.Minute, GetTopicSessionLimit(config, "social"))
+	assert.Equal(t, 60*time.Minute, GetTopicSessionLimit(config, "social/news/today"))
+	assert.Equal(t, 30*time.Minute, GetTopicSessionLimit(config, "social/chat"))
+	assert.Equal(t, time.Duration(0), GetTopicSessionLimit(config, "work"))
+}
+
+func TestGetNotificationName(t *testing.T) {
+	profile := ProfileConfiguration{Label: "banking"}
+	assert.Equal(t, "banking-1", getNotificationName(profile, "banking-1", "de"))
+
+	profile.DisplayName = strPtr("Banking")
+	assert.Equal(t, "Banking: banking-1", getNotificationName(profile, "banking-1", "de"))
+
+	profile.Names = map[string]string{"de": "Banking (isoliert)", "en": "Banking (isolated)"}
+	assert.Equal(t, "Banking (isoliert): banking-1", getNotificationName(profile, "banking-1", "de"))
+	assert.Equal(t, "Banking (isolated): banking-1", getNotificationName(profile, "banking-1", "fr"))
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrTemplateIntegrity error = errors.New("The template doesn't match its checksums")
+
+const (
+	// templateChecksumsFileName is the file listing the files of a
+	// shared template, in the format of sha256sum.
+	templateChecksumsFileName = "SHA256SUMS"
+	sharedTemplatesDirName    = "shared-templates"
+	sharedTemplatesFileName   = "shared-templates.json"
+	sharedTemplatesLockName   = "shared-templates.lock"
+)
+
+// templateChecksum is a line of a template's SHA256SUMS.
+type templateChecksum struct {
+	Path   string
+	SHA256 string
+}
+
+// parseTemplateChecksums parses the output of sha256sum. Paths must be
+// relative and stay inside of the template.
+func parseTemplateChecksums(content []byte) ([]templateChecksum, error) {
+	checksums := []templateChecksum{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		sum, path, ok := strings.Cut(text, " ")
+		// sha256sum marks files it read in binary mode with a "*".
+		path = strings.TrimPrefix(strings.TrimLeft(path, " "), "*")
+		if !ok || !isSHA256Hex(sum) || path == "" {
+			return nil, fmt.Errorf("%w: line %d of %s is not a checksum and a path", ErrTemplateIntegrity, line, templateChecksumsFileName)
+		}
+		path = filepath.Clean(path)
+		if filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, "../") {
+			return nil, fmt.Errorf("%w: %s is outside of the template", ErrTemplateIntegrity, path)
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrTemplateIntegrity, path)
+		}
+		seen[path] = true
+		checksums = append(checksums, templateChecksum{Path: path, SHA256: strings.ToLower(sum)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// getCachedTemplateDir returns where the version of a shared template
+// whose SHA256SUMS has the given checksum is kept.
+func getCachedTemplateDir(config Configuration, digest string) string {
+	return filepath.Join(getStateDir(config), sharedTemplatesDirName, digest)
+}
+
+// prepareTemplate makes sure the current version of a shared template,
+// e.g. a golden profile on a read-only network share, is in the local
+// cache and returns the checksum of its SHA256SUMS, which identifies
+// the version. Every file is checked against the SHA256SUMS while it
+// is copied. If the share can't be read or the template doesn't match
+// its checksums, e.g. because an update is being copied to the share,
+// the version that was cached last is used until the next call.
+func prepareTemplate(config Configuration, configDir string, template string) (string, error) {
+	templateDir := resolveLocalConfigFile(configDir, template)
+	unlock, err := lockStateFile(config, sharedTemplatesLockName)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	cachedVersions := map[string]string{}
+	if err := readStateFile(config, sharedTemplatesFileName, &cachedVersions); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	previous := cachedVersions[templateDir]
+
+	digest, err := cacheTemplate(config, templateDir)
+	if err != nil {
+		if previous == "" {
+			return "", uerror.StackTracef("Failed to cache template %s: %w", templateDir, err)
+		}
+		ulog.Default().Warn("Failed to cache the template, using the cached version", "template", templateDir, "version", previous, "error", uerror.Message(err))
+		return previous, nil
+	}
+	if digest == previous {
+		return digest, nil
+	}
+
+	cachedVersions[templateDir] = digest
+	if err := writeStateFile(config, sharedTemplatesFileName, cachedVersions); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	ulog.Default().Info("Cached a new version of the template", "template", templateDir, "version", digest)
+	if previous == "" {
+		return digest, nil
+	}
+	for _, version := range cachedVersions {
+		if version == previous {
+			return digest, nil
+		}
+	}
+	// Instances that have the previous version are updated by
+	// comparing it to the new one, see applyTemplate.
+	if _, err := readTemplateManifest(config, previous); err != nil {
+		ulog.Default().Warn("Failed to describe the previous version of the template", "template", templateDir, "version", previous, "error", uerror.Message(err))
+	}
+	if err := os.RemoveAll(getCachedTemplateDir(config, previous)); err != nil {
+		ulog.Default().Warn("Failed to remove the previous version of the template", "template", templateDir, "version", previous, "error", uerror.Message(err))
+	}
+	return digest, nil
+}
+
+// cacheTemplate copies the files listed in a shared template's
+// SHA256SUMS to the cache, unless that version is cached already. The
+// version only appears in the cache once all files are verified.
+func cacheTemplate(config Configuration, templateDir string) (string, error) {
+	checksumsContent, err := os.ReadFile(filepath.Join(templateDir, templateChecksumsFileName))
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	sum := sha256.Sum256(checksumsContent)
+	digest := hex.EncodeToString(sum[:])
+	cachedDir := getCachedTemplateDir(config, digest)
+	cached, err := uio.DirExists(cachedDir)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	if cached {
+		return digest, nil
+	}
+	checksums, err := parseTemplateChecksums(checksumsContent)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+
+	cacheDir := filepath.Dir(cachedDir)
+	if err := os.MkdirAll(cacheDir, uio.FileModeURWXGRWXO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	tmpDir, err := os.MkdirTemp(cacheDir, ".tmp-*")
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	for _, checksum := range checksums {
+		err := copyVerifiedTemplateFile(filepath.Join(templateDir, checksum.Path), filepath.Join(tmpDir, checksum.Path), checksum.SHA256)
+		if err != nil {
+			_ = os.RemoveAll(tmpDir)
+			return "", uerror.WithStackTrace(err)
+		}
+	}
+	if err := os.Rename(tmpDir, cachedDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return "", uerror.WithStackTrace(err)
+	}
+	if _, err := writeTemplateManifest(config, digest); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return digest, nil
+}
+
+// copyVerifiedTemplateFile copies a regular file, failing if its
+// contents don't have the expected hex-encoded SHA-256 sum.
+func copyVerifiedTemplateFile(src string, dst string, expectedSHA256 string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !info.Mode().IsRegular() {
+		return uerror.StackTracef("%w: %s is not a regular file", ErrTemplateIntegrity, src)
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer srcFile.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer dstFile.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dstFile, hash), srcFile); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expectedSHA256 {
+		return uerror.StackTracef("%w: %s has SHA-256 sum %s, expected %s", ErrTemplateIntegrity, src, actual, expectedSHA256)
+	}
+	return dstFile.Close()
+}
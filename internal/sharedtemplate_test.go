@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// writeTemplateForTest writes files to a template directory along with
+// a SHA256SUMS listing them.
+func writeTemplateForTest(t *testing.T, templateDir string, files map[string]string) {
+	sums := strings.Builder{}
+	for name, content := range files {
+		path := filepath.Join(templateDir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, []byte(content), uio.FileModeURWGRWO))
+		sum := sha256.Sum256([]byte(content))
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(templateDir, templateChecksumsFileName), []byte(sums.String()), uio.FileModeURWGRWO))
+}
+
+func TestParseTemplateChecksums(t *testing.T) {
+	sum := strings.Repeat("ab", sha256.Size)
+	checksums, err := parseTemplateChecksums([]byte(strings.ToUpper(sum) + "  prefs.js\n\n" + sum + " *chrome/userContent.css\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []templateChecksum{
+		{Path: "prefs.js", SHA256: sum},
+		{Path: "chrome/userContent.css", SHA256: sum},
+	}, checksums)
+
+	for _, content := range []string{
+		"prefs.js\n",
+		"abc  prefs.js\n",
+		sum + "  /etc/passwd\n",
+		sum + "  ../prefs.js\n",
+		sum + "  prefs.js\n" + sum + "  ./prefs.js\n",
+	} {
+		_, err := parseTemplateChecksums([]byte(content))
+		assert.ErrorIs(t, err, ErrTemplateIntegrity, content)
+	}
+}
+
+func TestPrepareTemplate(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	templateDir := t.TempDir()
+	writeTemplateForTest(t, templateDir, map[string]string{"prefs.js": "v1", "chrome/userContent.css": "css"})
+
+	v1, err := prepareTemplate(config, "", templateDir)
+	assert.NoError(t, err)
+	cachedDir := getCachedTemplateDir(config, v1)
+	content, err := os.ReadFile(filepath.Join(cachedDir, "prefs.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", string(content))
+	assert.FileExists(t, filepath.Join(cachedDir, "chrome/userContent.css"))
+	assert.NoFileExists(t, filepath.Join(cachedDir, templateChecksumsFileName))
+
+	// A half-copied update is ignored until it matches its checksums.
+	assert.NoError(t, os.WriteFile(filepath.Join(templateDir, "prefs.js"), []byte("v2"), uio.FileModeURWGRWO))
+	assert.NoError(t, os.WriteFile(filepath.Join(templateDir, templateChecksumsFileName), []byte(strings.Repeat("0", 64)+"  prefs.js\n"), uio.FileModeURWGRWO))
+	version, err := prepareTemplate(config, "", templateDir)
+	assert.NoError(t, err)
+	assert.Equal(t, v1, version)
+
+	writeTemplateForTest(t, templateDir, map[string]string{"prefs.js": "v2"})
+	v2, err := prepareTemplate(config, "", templateDir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, v1, v2)
+	assert.NoDirExists(t, cachedDir)
+
+	// The cached version is used while the share is offline.
+	assert.NoError(t, os.RemoveAll(templateDir))
+	version, err = prepareTemplate(config, "", templateDir)
+	assert.NoError(t, err)
+	assert.Equal(t, v2, version)
+
+	_, err = prepareTemplate(config, "", filepath.Join(templateDir, "never-cached"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSyncInstanceSeedsFromTemplate(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	templateDir := t.TempDir()
+	writeTemplateForTest(t, templateDir, map[string]string{"bookmarks.html": "v1"})
+	profile.Template = &templateDir
+
+	ctx := context.Background()
+	assert.NoError(t, syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, "", instanceDir, false))
+	bookmarksPath := filepath.Join(instanceDir, relativeProfilePath, "bookmarks.html")
+	content, err := os.ReadFile(bookmarksPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", string(content))
+
+	// A new version of the template resyncs the instance without
+	// overwriting its files.
+	assert.NoError(t, os.WriteFile(bookmarksPath, []byte("edited"), uio.FileModeURWGRWO))
+	writeTemplateForTest(t, templateDir, map[string]string{"bookmarks.html": "v2"})
+	assert.NoError(t, syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, "", instanceDir, false))
+	content, err = os.ReadFile(bookmarksPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "edited", string(content))
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// SoakOptions configures RunSoak.
+type SoakOptions struct {
+	// Concurrency is the number of launches running at the same time.
+	Concurrency int
+	// Launches is the total number of launches.
+	Launches int
+	// Lifetime is how long each fake browser runs.
+	Lifetime time.Duration
+}
+
+// SoakResult summarizes a soak test. Contended counts launches and
+// deletions that were refused because another worker was using the
+// instance, which is expected. Failures lists everything else that
+// went wrong.
+type SoakResult struct {
+	Contended int
+	Deleted   int
+	Duration  time.Duration
+	Failures  []string
+	Launched  int
+}
+
+type soakRecorder struct {
+	mutex  sync.Mutex
+	result SoakResult
+}
+
+func (r *soakRecorder) record(update func(result *SoakResult)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	update(&r.result)
+}
+
+func (r *soakRecorder) fail(format string, args ...interface{}) {
+	r.record(func(result *SoakResult) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	})
+}
+
+// RunSoak launches, reuses and deletes instances from many goroutines
+// at once to shake out races in locking, instance selection and
+// metadata writes. Instead of the browser, each launch runs sleep for
+// the configured lifetime. Afterwards, the instances are checked for
+// leftover locks, usage markers and unreadable metadata.
+//
+// Like RunBenchmarks, it works in a scratch directory in the state
+// directory, so it exercises the filesystem real instances live on.
+func RunSoak(ctx context.Context, config Configuration, options SoakOptions) (SoakResult, error) {
+	if err := os.MkdirAll(getStateDir(config), uio.FileModeURWXGRWXO); err != nil {
+		return SoakResult{}, uerror.WithStackTrace(err)
+	}
+	scratchDir, err := os.MkdirTemp(getStateDir(config), "soak-*")
+	if err != nil {
+		return SoakResult{}, uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	profile := ProfileConfiguration{Label: "soak"}
+	soakConfig := Configuration{
+		EphemeralPath: filepath.Join(scratchDir, "ephemeral"),
+		ProfilePath:   filepath.Join(scratchDir, "profiles"),
+		Profiles:      []ProfileConfiguration{profile},
+	}
+
+	runtime := browserRuntime{
+		newCommand: func(ctx context.Context, profile ProfileConfiguration, instanceDir string, debugShell bool, warnings *Warnings) (*exec.Cmd, error) {
+			return exec.CommandContext(ctx, "sleep", fmt.Sprintf("%.3f", options.Lifetime.Seconds())), nil
+		},
+		setUpMounts: func(instanceDir string) (func() error, error) {
+			return func() error { return nil }, nil
+		},
+	}
+
+	recorder := &soakRecorder{}
+	launches := make(chan int)
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for launch := range launches {
+				soakLaunch(ctx, runtime, soakConfig, profile, launch, recorder)
+			}
+		}()
+	}
+	for launch := 0; launch < options.Launches && ctx.Err() == nil; launch++ {
+		launches <- launch
+	}
+	close(launches)
+	wg.Wait()
+	recorder.result.Duration = time.Since(start)
+
+	checkSoakInstances(soakConfig, recorder)
+	return recorder.result, nil
+}
+
+// soakLaunch launches one instance. Every fifth launch uses an
+// ephemeral instance and every third reused instance is deleted
+// afterwards.
+func soakLaunch(ctx context.Context, runtime browserRuntime, config Configuration, profile ProfileConfiguration, launch int, recorder *soakRecorder) {
+	warnings := &Warnings{}
+	defer func() {
+		for _, warning := range warnings.List() {
+			recorder.fail("Launch %d: warning: %s", launch, warning)
+		}
+	}()
+
+	usageLabel := fmt.Sprintf("soak-%d", launch)
+	var instance ProfileInstance
+	var exitCode uint
+	var err error
+	if launch%5 == 0 {
+		instance, err = NewEphemeralInstance(config, profile)
+		if err != nil {
+			recorder.fail("Launch %d: failed to create an ephemeral instance: %s", launch, uerror.Message(err))
+			return
+		}
+		instance.UsageLabel = &usageLabel
+		exitCode, err = startInstance(ctx, runtime, config, profile, instance, "", nil, false, false, 0, warnings)
+	} else {
+		var release func() error
+		instance, release, err = ClaimBestInstance(ctx, config, profile, &usageLabel, warnings)
+		if err != nil {
+			recorder.fail("Launch %d: failed to claim an instance: %s", launch, uerror.Message(err))
+			return
+		}
+		exitCode, err = startClaimedInstance(ctx, runtime, config, profile, instance, release, "", nil, false, false, 0, warnings)
+	}
+	if errors.Is(err, ErrInstanceInUse) {
+		recorder.record(func(result *SoakResult) { result.Contended++ })
+		return
+	}
+	if err != nil {
+		recorder.fail("Launch %d of %s: %s", launch, instance.InstanceLabel, uerror.Message(err))
+		return
+	}
+	if exitCode != 0 && ctx.Err() == nil {
+		recorder.fail("Launch %d of %s: the fake browser exited with %d", launch, instance.InstanceLabel, exitCode)
+		return
+	}
+	recorder.record(func(result *SoakResult) { result.Launched++ })
+
+	if instance.Ephemeral || launch%3 != 0 {
+		return
+	}
+	err = DeleteInstance(config, instance, nil)
+	if errors.Is(err, ErrInstanceInUse) {
+		recorder.record(func(result *SoakResult) { result.Contended++ })
+		return
+	}
+	if err != nil {
+		recorder.fail("Deleting %s after launch %d: %s", instance.InstanceLabel, launch, uerror.Message(err))
+		return
+	}
+	recorder.record(func(result *SoakResult) { result.Deleted++ })
+}
+
+// checkSoakInstances checks that no instance is left locked, marked as
+// in use or unreadable, and that all ephemeral instances were wiped.
+func checkSoakInstances(config Configuration, recorder *soakRecorder) {
+	warnings := &Warnings{}
+	instances, err := readProfileInstances(config, warnings)
+	if err != nil {
+		recorder.fail("Failed to list instances: %s", uerror.Message(err))
+		return
+	}
+	for _, warning := range warnings.List() {
+		recorder.fail("Listing instances: %s", warning)
+	}
+	for _, instance := range instances {
+		if instance.Ephemeral {
+			recorder.fail("Ephemeral instance %s wasn't wiped", instance.InstanceLabel)
+		}
+		if instance.UsagePID != nil || instance.UsageLabel != nil {
+			recorder.fail("Instance %s is still marked as in use", instance.InstanceLabel)
+		}
+		locked, _, err := instanceLockState(config, instance)
+		if err != nil {
+			recorder.fail("Failed to check the lock of %s: %s", instance.InstanceLabel, uerror.Message(err))
+		} else if locked {
+			recorder.fail("Instance %s is still locked", instance.InstanceLabel)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunSoak(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	result, err := RunSoak(context.Background(), config, SoakOptions{
+		Concurrency: 8,
+		Launches:    60,
+		Lifetime:    10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Failures)
+	assert.NotZero(t, result.Launched)
+	assert.NotZero(t, result.Deleted)
+	assert.NoDirExists(t, getStateDir(config)+"/soak")
+}
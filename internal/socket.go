@@ -10,10 +10,13 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	uerror "t0ast.cc/tbml/util/error"
 )
 
+var ErrInstanceNotListening error = errors.New("Instance is not listening")
+
 type broadcastChannelOpenEvent struct {
 	connectionID int
 	channel      chan interface{}
@@ -27,6 +30,10 @@ type openTabBroadcast struct {
 	URL string
 }
 
+type closeTabBroadcast struct {
+	URL string
+}
+
 type openedStartURLBroadcast struct{}
 
 type startURLBroadcast struct {
@@ -36,10 +43,22 @@ type startURLBroadcast struct {
 type socketMsgType string
 
 const (
+	socketMsgTypeCloseTab  socketMsgType = "close-tab"
 	socketMsgTypeOpenedTab socketMsgType = "opened-tab"
 	socketMsgTypeOpenTab   socketMsgType = "open-tab"
 )
 
+// mothershipGreeting is the first message of the mothership connector,
+// which tells it apart from tbml invocations that only send messages.
+const mothershipGreeting = "Hello from Mothership! :>"
+
+// socketMsg is a message on an instance's control socket. Each message
+// is a line of JSON.
+type socketMsg struct {
+	Type socketMsgType `json:"type"`
+	URL  string        `json:"url"`
+}
+
 func ListenOnExternalUnixSocket(ctx context.Context, listener *net.UnixListener, startURL *url.URL) {
 	incomingBroadcasts := make(chan interface{})
 	newBroadcastChannels := make(chan broadcastChannelOpenEvent)
@@ -96,8 +115,16 @@ func ListenOnExternalUnixSocket(ctx context.Context, listener *net.UnixListener,
 		}
 		go func() {
 			defer func() {
-				closedBroadcastChannels <- broadcastChannelCloseEvent{
-					connectionID: connectionID,
+				// Broadcasts may still arrive until the broadcaster has
+				// forgotten the connection.
+				for closed := false; !closed; {
+					select {
+					case closedBroadcastChannels <- broadcastChannelCloseEvent{
+						connectionID: connectionID,
+					}:
+						closed = true
+					case <-outgoingBroadcasts:
+					}
 				}
 				close(outgoingBroadcasts)
 			}()
@@ -113,6 +140,19 @@ func handleConnection(ctx context.Context, outgoingBroadcasts, incomingBroadcast
 	isMothershipConnector := false
 	var startURL *url.URL
 
+	// Broadcasts also come back to the connection that sent them, so
+	// they are sent without blocking the event loop. They outlive the
+	// connection, which may close right after sending a message.
+	listenerCtx := ctx
+	sendBroadcast := func(broadcast interface{}) {
+		go func() {
+			select {
+			case outgoingBroadcasts <- broadcast:
+			case <-listenerCtx.Done():
+			}
+		}()
+	}
+
 	ctx, cancelProcessing := context.WithCancel(ctx)
 	incomingMsgs := make(chan interface{})
 	receiveErrs := make(chan error)
@@ -142,6 +182,12 @@ EVENTS:
 						return uerror.WithStackTrace(err)
 					}
 				}
+			case closeTabBroadcast:
+				if isMothershipConnector {
+					if err := SendCloseTabMessage(conn, broadcast.URL); err != nil {
+						return uerror.WithStackTrace(err)
+					}
+				}
 			case openedStartURLBroadcast:
 				startURL = nil
 			case startURLBroadcast:
@@ -152,7 +198,7 @@ EVENTS:
 			}
 
 		case msg := <-incomingMsgs:
-			if msg == "Hello from Mothership! :>" {
+			if msg == mothershipGreeting {
 				isMothershipConnector = true
 				if err := openStartURLIfNecessary(conn, startURL, isMothershipConnector); err != nil {
 					return uerror.WithStackTrace(err)
@@ -161,13 +207,18 @@ EVENTS:
 				switch msg["type"] {
 				case string(socketMsgTypeOpenTab):
 					url, _ := msg["url"].(string)
-					outgoingBroadcasts <- openTabBroadcast{
+					sendBroadcast(openTabBroadcast{
 						URL: url,
-					}
+					})
+				case string(socketMsgTypeCloseTab):
+					url, _ := msg["url"].(string)
+					sendBroadcast(closeTabBroadcast{
+						URL: url,
+					})
 				case string(socketMsgTypeOpenedTab):
 					url, _ := msg["url"].(string)
 					if startURL != nil && url == startURL.String() {
-						outgoingBroadcasts <- openedStartURLBroadcast{}
+						sendBroadcast(openedStartURLBroadcast{})
 					}
 				}
 			}
@@ -207,10 +258,68 @@ func ConnectToExternalUnixSocket(config Configuration, instance ProfileInstance)
 	return conn, nil
 }
 
+// ForwardURLToInstance asks a running instance to open a URL in a new
+// tab. An empty URL opens the new tab page. If nothing listens on the
+// instance's control socket, e.g. because the browser crashed, the
+// returned error wraps ErrInstanceNotListening.
+func ForwardURLToInstance(config Configuration, instance ProfileInstance, url string) error {
+	return sendToInstance(config, instance, func(conn *net.UnixConn) error {
+		return SendOpenTabMessage(conn, url)
+	})
+}
+
+// CloseURLInInstance asks a running instance to close its tabs that
+// show the URL, like ForwardURLToInstance.
+func CloseURLInInstance(config Configuration, instance ProfileInstance, url string) error {
+	return sendToInstance(config, instance, func(conn *net.UnixConn) error {
+		return SendCloseTabMessage(conn, url)
+	})
+}
+
+func sendToInstance(config Configuration, instance ProfileInstance, send func(conn *net.UnixConn) error) error {
+	conn, err := ConnectToExternalUnixSocket(config, instance)
+	if isSocketDead(err) {
+		return uerror.StackTracef("%w: %s", ErrInstanceNotListening, instance.InstanceLabel)
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer conn.Close()
+	return send(conn)
+}
+
+func isSocketDead(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
+
+// removeStaleUnixSocket removes a socket file left behind by a process
+// that didn't shut down cleanly, so a new listener can bind to it.
+func removeStaleUnixSocket(addr *net.UnixAddr) error {
+	conn, err := net.DialUnix("unix", nil, addr)
+	if err == nil {
+		conn.Close()
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	if err := os.Remove(addr.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
 func SendOpenTabMessage(conn *net.UnixConn, url string) error {
-	return sendMessageOverSocket(conn, map[string]interface{}{
-		"type": socketMsgTypeOpenTab,
-		"url":  url,
+	return sendMessageOverSocket(conn, socketMsg{
+		Type: socketMsgTypeOpenTab,
+		URL:  url,
+	})
+}
+
+func SendCloseTabMessage(conn *net.UnixConn, url string) error {
+	return sendMessageOverSocket(conn, socketMsg{
+		Type: socketMsgTypeCloseTab,
+		URL:  url,
 	})
 }
 
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestForwardURLToInstance(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, os.MkdirAll(instanceDir, uio.FileModeURWXGRWXO))
+
+	err := ForwardURLToInstance(config, instance, "https://example.com")
+	assert.ErrorIs(t, err, ErrInstanceNotListening)
+
+	addr, err := resolveExternalUnixSocketAddr(instanceDir)
+	assert.NoError(t, err)
+	listener, err := net.ListenUnix("unix", addr)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan map[string]interface{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		var msg map[string]interface{}
+		line, _ := bufio.NewReader(conn).ReadBytes('\n')
+		_ = json.Unmarshal(line, &msg)
+		received <- msg
+	}()
+
+	assert.NoError(t, ForwardURLToInstance(config, instance, "https://example.com"))
+	assert.Equal(t, map[string]interface{}{
+		"type": string(socketMsgTypeOpenTab),
+		"url":  "https://example.com",
+	}, <-received)
+}
+
+func TestRemoveStaleUnixSocket(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, os.MkdirAll(instanceDir, uio.FileModeURWXGRWXO))
+
+	addr, err := resolveExternalUnixSocketAddr(instanceDir)
+	assert.NoError(t, err)
+	listener, err := net.ListenUnix("unix", addr)
+	assert.NoError(t, err)
+	// Leave the socket file behind like a crashed process would.
+	listener.SetUnlinkOnClose(false)
+	assert.NoError(t, listener.Close())
+
+	err = ForwardURLToInstance(config, instance, "")
+	assert.ErrorIs(t, err, ErrInstanceNotListening)
+
+	assert.NoError(t, removeStaleUnixSocket(addr))
+	listener, err = net.ListenUnix("unix", addr)
+	assert.NoError(t, err)
+	assert.NoError(t, listener.Close())
+}
+
+func TestCloseURLInInstance(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, os.MkdirAll(instanceDir, uio.FileModeURWXGRWXO))
+
+	addr, err := resolveExternalUnixSocketAddr(instanceDir)
+	assert.NoError(t, err)
+	listener, err := net.ListenUnix("unix", addr)
+	assert.NoError(t, err)
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ListenOnExternalUnixSocket(ctx, listener, nil)
+
+	// The message is relayed to the mothership connector, which passes
+	// it on to the browser.
+	mothership, err := ConnectToExternalUnixSocket(config, instance)
+	assert.NoError(t, err)
+	defer mothership.Close()
+	assert.NoError(t, sendMessageOverSocket(mothership, "Hello from Mothership! :>"))
+	// The hello has to be handled before the broadcast arrives.
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, CloseURLInInstance(config, instance, "https://example.com/"))
+	assert.NoError(t, mothership.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := bufio.NewReader(mothership).ReadBytes('\n')
+	assert.NoError(t, err)
+	var msg map[string]interface{}
+	assert.NoError(t, json.Unmarshal(line, &msg))
+	assert.Equal(t, map[string]interface{}{
+		"type": string(socketMsgTypeCloseTab),
+		"url":  "https://example.com/",
+	}, msg)
+}
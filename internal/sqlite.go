@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// sqliteBinary is used to access the browser's databases, like
+// places.sqlite, without linking SQLite into tbml.
+const sqliteBinary = "sqlite3"
+
+var ErrSQLiteUnavailable error = errors.New("SQLite is unavailable")
+
+// withLockedProfileDir locks an instance, so its browser can't use the
+// profile's databases, and calls fn with the profile directory.
+// Encrypted instances are mounted meanwhile.
+func withLockedProfileDir(config Configuration, instance ProfileInstance, fn func(profileDir string) error) (err error) {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	profile := ProfileConfiguration{Label: instance.ProfileLabel}
+	if configured := FindProfileByLabel(config, instance.ProfileLabel); configured != nil {
+		profile = *configured
+	}
+	unmountEncryptedInstance, err := mountEncryptedInstance(config, profile, instance, nil)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer func() {
+		if unmountErr := unmountEncryptedInstance(); err == nil {
+			err = unmountErr
+		}
+	}()
+	return fn(filepath.Join(getInstanceDir(config, instance), relativeProfilePath))
+}
+
+// querySQLite runs an SQL query against one of the browser's databases
+// and decodes the resulting rows, as JSON objects keyed by column
+// name, into result. The browser must not be using the database.
+func querySQLite(path string, query string, result interface{}) error {
+	output, err := runSQLite(path, query, "-json")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// Queries without rows print nothing.
+	if len(bytes.TrimSpace(output)) == 0 {
+		output = []byte("[]")
+	}
+	return uerror.WithStackTrace(json.Unmarshal(output, result))
+}
+
+// execSQLite runs SQL statements against one of the browser's
+// databases in a single transaction. The browser must not be using the
+// database.
+func execSQLite(path string, statements []string) error {
+	script := "BEGIN;\n" + strings.Join(statements, ";\n") + ";\nCOMMIT;\n"
+	_, err := runSQLite(path, script)
+	return uerror.WithStackTrace(err)
+}
+
+func runSQLite(path string, script string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(sqliteBinary); err != nil {
+		return nil, uerror.StackTracef("%w: %s is not installed", ErrSQLiteUnavailable, sqliteBinary)
+	}
+	cmd := exec.Command(sqliteBinary, append(append([]string{"-bail", "-batch"}, args...), path)...)
+	cmd.Stdin = strings.NewReader(script)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, uerror.StackTracef("%s failed: %w: %s", sqliteBinary, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// quoteSQL quotes a string as an SQL literal. The SQLite shell only
+// takes SQL text, so values can't be bound as parameters.
+func quoteSQL(s string) string {
+	// NUL would end the statement early.
+	s = strings.ReplaceAll(s, "\x00", "")
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
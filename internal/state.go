@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// stateDirName is the name of the directory in the profile path that
+// holds tbml's own bookkeeping. Entries in the profile path starting
+// with a dot are never treated as instances.
+const stateDirName = ".tbml"
+
+func getStateDir(config Configuration) string {
+	return filepath.Join(config.ProfilePath, stateDirName)
+}
+
+func isReservedProfilePathEntry(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// isValidInstanceLabel tells whether a label can be used as the name
+// of an instance's directory in the profile path.
+func isValidInstanceLabel(label string) bool {
+	return label != "" && !isReservedProfilePathEntry(label) && !strings.ContainsAny(label, `/\`)
+}
+
+// readStateFile unmarshals the given state file into v. If the file
+// doesn't exist, v is left untouched.
+func readStateFile(config Configuration, name string, v interface{}) error {
+	stateBytes, err := os.ReadFile(filepath.Join(getStateDir(config), name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := json.Unmarshal(stateBytes, v); err != nil {
+		return uerror.StackTracef("Failed to unmarshal state file %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeStateFile(config Configuration, name string, v interface{}) error {
+	stateDir := getStateDir(config)
+	if err := os.MkdirAll(stateDir, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	stateBytes, err := json.Marshal(v)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, name), stateBytes, uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
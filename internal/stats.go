@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// relativeCachePath is where the browser keeps the disk cache of an
+// instance, next to the profile.
+const relativeCachePath = ".local/share/torbrowser/tbb/x86_64/tor-browser_en-US/Browser/TorBrowser/Data/Browser/Caches"
+
+// clockTicksPerSecond is the unit of process start times in /proc,
+// which the kernel fixes at 100 for user space on all architectures.
+const clockTicksPerSecond = 100
+
+// InstanceStats describes an instance's resource usage. The JSON field
+// names must stay stable, see ProfileListing.
+type InstanceStats struct {
+	// Archived instances only take up the space of their archive.
+	Archived bool `json:"archived"`
+	// CPUSeconds and MemoryUsage are summed over the processes of the
+	// instance's browser, if it is running. MemoryUsage is the
+	// proportional set size, so memory shared between the processes
+	// is only counted once.
+	CPUSeconds *float64 `json:"cpuSeconds"`
+	// CacheSize is the part of DiskUsage taken by the browser's disk
+	// cache.
+	CacheSize   int64     `json:"cacheSize"`
+	DiskUsage   int64     `json:"diskUsage"`
+	Ephemeral   bool      `json:"ephemeral"`
+	Label       string    `json:"label"`
+	LastUsed    time.Time `json:"lastUsed"`
+	MemoryUsage *int64    `json:"memoryUsage"`
+	Profile     string    `json:"profile"`
+	Topic       *string   `json:"topic"`
+	// UptimeSeconds is how long the instance's browser has been
+	// running, if it is.
+	UptimeSeconds *int64 `json:"uptimeSeconds"`
+}
+
+// GetInstanceStats measures all instances, sorted by profile and
+// label.
+func GetInstanceStats(config Configuration, warnings *Warnings) ([]InstanceStats, error) {
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	now := time.Now()
+	stats := make([]InstanceStats, 0, len(instances))
+	for _, instance := range instances {
+		instanceDir := getInstanceDir(config, instance)
+		diskUsage, err := uio.DirSize(instanceDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, uerror.WithStackTrace(err)
+		}
+		cacheSize, err := uio.DirSize(filepath.Join(instanceDir, relativeCachePath))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, uerror.WithStackTrace(err)
+		}
+		instanceStats := InstanceStats{
+			Archived:  instance.Archived,
+			CacheSize: cacheSize,
+			DiskUsage: diskUsage,
+			Ephemeral: instance.Ephemeral,
+			Label:     instance.InstanceLabel,
+			LastUsed:  instance.LastUsed,
+			Profile:   instance.ProfileLabel,
+			Topic:     instance.UsageLabel,
+		}
+		if instance.UsagePID != nil {
+			started, err := getProcessStartTime(*instance.UsagePID)
+			if err != nil {
+				warnings.Add(instance.InstanceLabel, "Failed to get the browser's start time: %s", uerror.Message(err))
+			} else {
+				uptime := int64(now.Sub(started) / time.Second)
+				instanceStats.UptimeSeconds = &uptime
+			}
+			usage, err := getProcessTreeUsage("/proc", *instance.UsagePID)
+			if err != nil {
+				warnings.Add(instance.InstanceLabel, "Failed to get the browser's resource usage: %s", uerror.Message(err))
+			} else {
+				cpuSeconds := usage.cpuTime.Seconds()
+				instanceStats.CPUSeconds = &cpuSeconds
+				instanceStats.MemoryUsage = &usage.memory
+			}
+		}
+		stats = append(stats, instanceStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Profile != stats[j].Profile {
+			return stats[i].Profile < stats[j].Profile
+		}
+		return stats[i].Label < stats[j].Label
+	})
+	return stats, nil
+}
+
+// getProcessStartTime reads when a process was started from /proc.
+func getProcessStartTime(pid int) (time.Time, error) {
+	fields, err := readProcessStat("/proc", pid)
+	if err != nil {
+		return time.Time{}, uerror.WithStackTrace(err)
+	}
+	startTicks, err := strconv.ParseInt(fields[procStatStartTime], 10, 64)
+	if err != nil {
+		return time.Time{}, uerror.WithStackTrace(err)
+	}
+	bootTime, err := getBootTime()
+	if err != nil {
+		return time.Time{}, uerror.WithStackTrace(err)
+	}
+	return bootTime.Add(time.Duration(startTicks) * time.Second / clockTicksPerSecond), nil
+}
+
+// Indices of fields in /proc/<pid>/stat as returned by
+// readProcessStat, i.e. the field numbers of proc(5) minus three.
+const (
+	procStatParentPID = 1
+	procStatUserTime  = 11
+	procStatSysTime   = 12
+	procStatStartTime = 19
+	procStatRSS       = 21
+)
+
+// readProcessStat returns the fields of /proc/<pid>/stat after the
+// command name. The command name in parentheses can contain spaces,
+// so the fields are counted from its end.
+func readProcessStat(procDir string, pid int) ([]string, error) {
+	statBytes, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	stat := string(statBytes)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) <= procStatRSS {
+		return nil, uerror.StackTracef("Unexpected format of %s/%d/stat", procDir, pid)
+	}
+	return fields, nil
+}
+
+type processTreeUsage struct {
+	cpuTime time.Duration
+	memory  int64
+}
+
+// getProcessTreeUsage sums the CPU time and memory of a process and
+// all of its descendants, like the sandbox and the browser's content
+// processes below tbml. Processes that exit while they are measured
+// are skipped. The memory is the proportional set size where the
+// kernel provides it and the resident set size otherwise.
+func getProcessTreeUsage(procDir string, rootPID int) (processTreeUsage, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return processTreeUsage{}, uerror.WithStackTrace(err)
+	}
+	stats := map[int][]string{}
+	children := map[int][]int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fields, err := readProcessStat(procDir, pid)
+		if err != nil {
+			continue
+		}
+		parentPID, err := strconv.Atoi(fields[procStatParentPID])
+		if err != nil {
+			continue
+		}
+		stats[pid] = fields
+		children[parentPID] = append(children[parentPID], pid)
+	}
+	if _, ok := stats[rootPID]; !ok {
+		return processTreeUsage{}, uerror.StackTracef("Process %d is not running", rootPID)
+	}
+
+	pageSize := int64(os.Getpagesize())
+	usage := processTreeUsage{}
+	for pending := []int{rootPID}; len(pending) > 0; {
+		pid := pending[0]
+		pending = append(pending[1:], children[pid]...)
+		fields := stats[pid]
+		userTicks, _ := strconv.ParseInt(fields[procStatUserTime], 10, 64)
+		sysTicks, _ := strconv.ParseInt(fields[procStatSysTime], 10, 64)
+		usage.cpuTime += time.Duration(userTicks+sysTicks) * time.Second / clockTicksPerSecond
+		if pss, err := readProportionalSetSize(procDir, pid); err == nil {
+			usage.memory += pss
+		} else {
+			rssPages, _ := strconv.ParseInt(fields[procStatRSS], 10, 64)
+			usage.memory += rssPages * pageSize
+		}
+	}
+	return usage, nil
+}
+
+// readProportionalSetSize reads a process's proportional set size in
+// bytes from /proc/<pid>/smaps_rollup.
+func readProportionalSetSize(procDir string, pid int) (int64, error) {
+	file, err := os.Open(filepath.Join(procDir, strconv.Itoa(pid), "smaps_rollup"))
+	if err != nil {
+		return 0, uerror.WithStackTrace(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "Pss:" && fields[2] == "kB" {
+			kib, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, uerror.WithStackTrace(err)
+			}
+			return kib << 10, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, uerror.WithStackTrace(err)
+	}
+	return 0, uerror.StackTracef("No Pss in %s/%d/smaps_rollup", procDir, pid)
+}
+
+func getBootTime() (time.Time, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, uerror.WithStackTrace(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, uerror.WithStackTrace(err)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, uerror.WithStackTrace(err)
+	}
+	return time.Time{}, uerror.StackTracef("No boot time in /proc/stat")
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestGetInstanceStats(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	pid := os.Getpid()
+	instance.UsagePID = &pid
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	stored, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	files := map[string]int{
+		filepath.Join(relativeProfilePath, "places.sqlite"): 300,
+		filepath.Join(relativeCachePath, "cache2/entry"):    200,
+	}
+	for name, size := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(instanceDir, name)), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, name), make([]byte, size), uio.FileModeURWGRWO))
+	}
+
+	stats, err := GetInstanceStats(config, nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, stats, 1) {
+		return
+	}
+	assert.Equal(t, "test-1", stats[0].Label)
+	assert.Equal(t, "test", stats[0].Profile)
+	assert.Equal(t, instance.UsageLabel, stats[0].Topic)
+	assert.Equal(t, stored.LastUsed, stats[0].LastUsed)
+	assert.Equal(t, int64(200), stats[0].CacheSize)
+	assert.GreaterOrEqual(t, stats[0].DiskUsage, int64(500))
+	if assert.NotNil(t, stats[0].UptimeSeconds) {
+		assert.GreaterOrEqual(t, *stats[0].UptimeSeconds, int64(0))
+		assert.Less(t, *stats[0].UptimeSeconds, int64(time.Hour/time.Second))
+	}
+	if assert.NotNil(t, stats[0].MemoryUsage) {
+		assert.Greater(t, *stats[0].MemoryUsage, int64(0))
+	}
+	assert.NotNil(t, stats[0].CPUSeconds)
+}
+
+func TestGetProcessTreeUsage(t *testing.T) {
+	procDir := t.TempDir()
+	writeProcess := func(pid string, stat string, smapsRollup string) {
+		assert.NoError(t, os.MkdirAll(filepath.Join(procDir, pid), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(filepath.Join(procDir, pid, "stat"), []byte(stat), uio.FileModeURWGRWO))
+		if smapsRollup != "" {
+			assert.NoError(t, os.WriteFile(filepath.Join(procDir, pid, "smaps_rollup"), []byte(smapsRollup), uio.FileModeURWGRWO))
+		}
+	}
+	// Fields: pid (comm) state ppid ... utime stime ... starttime vsize rss
+	statLine := func(pid, comm, ppid, utime, stime, rss string) string {
+		return pid + " (" + comm + ") S " + ppid + " 0 0 0 -1 0 0 0 0 0 " + utime + " " + stime + " 0 0 20 0 1 0 100 0 " + rss + " 0 0 0\n"
+	}
+	writeProcess("10", statLine("10", "tbml", "1", "100", "50", "1000"), "Rss: 4000 kB\nPss: 2000 kB\n")
+	writeProcess("11", statLine("11", "Web Content", "10", "200", "0", "1000"), "Pss: 1000 kB\n")
+	writeProcess("12", statLine("12", "Isolated (x)", "11", "0", "50", "2"), "")
+	writeProcess("20", statLine("20", "other", "1", "1000", "1000", "1000"), "Pss: 9000 kB\n")
+	assert.NoError(t, os.MkdirAll(filepath.Join(procDir, "self"), uio.FileModeURWXGRWXO))
+
+	usage, err := getProcessTreeUsage(procDir, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 4*time.Second, usage.cpuTime)
+	assert.Equal(t, int64(3000<<10)+2*int64(os.Getpagesize()), usage.memory)
+
+	_, err = getProcessTreeUsage(procDir, 30)
+	assert.Error(t, err)
+}
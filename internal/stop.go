@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrInstanceNotRunning error = errors.New("The instance's browser isn't running")
+
+// sessionStoreFileName is where Firefox saves the open windows and tabs
+// when it quits, in the profile directory.
+const sessionStoreFileName = "sessionstore.jsonlz4"
+
+// These are variables so tests can shorten them.
+var (
+	// browserStopGracePeriod is how long the browser gets to exit
+	// after SIGTERM before it may be killed.
+	browserStopGracePeriod = 30 * time.Second
+	// sessionStoreFlushTimeout is how long after SIGTERM the browser
+	// is killed even if it didn't save its session, e.g. because it
+	// hangs or session restore is disabled.
+	sessionStoreFlushTimeout = 2 * time.Minute
+	sessionStorePollInterval = time.Second
+	// instanceReleasePollInterval is how often StopInstance checks
+	// whether the instance was released.
+	instanceReleasePollInterval = 100 * time.Millisecond
+)
+
+// stopBrowser asks the browser with the given PID to quit with SIGTERM,
+// which makes Firefox save its session like when it is closed. The
+// browser is only killed once browserStopGracePeriod passed and it
+// saved its session to profileDir, or sessionStoreFlushTimeout passed,
+// so stopped instances reopen with their tabs. Closing done stops the
+// escalation, e.g. because the browser exited.
+func stopBrowser(ctx context.Context, pid int, profileDir string, done <-chan struct{}) {
+	logger := ulog.FromContext(ctx)
+	requested := time.Now()
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		logger.Warn("Failed to close the browser", "error", uerror.Message(err))
+	}
+
+	grace := time.NewTimer(browserStopGracePeriod)
+	defer grace.Stop()
+	select {
+	case <-done:
+		return
+	case <-grace.C:
+	}
+	deadline := requested.Add(sessionStoreFlushTimeout)
+	if !isSessionStoreFlushed(profileDir, requested) && time.Now().Before(deadline) {
+		logger.Info("Waiting for the browser to save its session")
+		ticker := time.NewTicker(sessionStorePollInterval)
+		defer ticker.Stop()
+		for !isSessionStoreFlushed(profileDir, requested) && time.Now().Before(deadline) {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+	logger.Warn("The browser didn't exit in time, killing it")
+	if process, err := os.FindProcess(pid); err == nil {
+		_ = process.Kill()
+	}
+}
+
+// isSessionStoreFlushed tells whether Firefox saved its session since
+// the given time. Modification times are compared in whole seconds,
+// since not all file systems are more precise.
+func isSessionStoreFlushed(profileDir string, since time.Time) bool {
+	info, err := os.Stat(filepath.Join(profileDir, sessionStoreFileName))
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Before(since.Truncate(time.Second))
+}
+
+// stopBrowserOnCancel stops the browser with stopBrowser once ctx is
+// canceled, instead of killing it right away. The returned function
+// ends the supervision.
+func stopBrowserOnCancel(ctx context.Context, pid int, profileDir string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		ulog.FromContext(ctx).Info("Launch canceled, closing the browser")
+		stopBrowser(ctx, pid, profileDir, done)
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// StopInstance closes the browser of a running instance like
+// stopBrowser, whichever process launched it, and waits until the
+// instance is released or ctx is done. Instances that aren't running,
+// or whose browser was started by a version of tbml that didn't record
+// its PID, fail with ErrInstanceNotRunning.
+func StopInstance(ctx context.Context, config Configuration, instance ProfileInstance) error {
+	instance, err := GetProfileInstance(config, instance.InstanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	dead, err := isInstanceDead(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	pid := instance.BrowserPID
+	if instance.Attached {
+		pid = instance.UsagePID
+	}
+	if dead || pid == nil || !isProcessAlive(*pid) {
+		return uerror.StackTracef("%w: %s", ErrInstanceNotRunning, instance.InstanceLabel)
+	}
+
+	ulog.FromContext(ctx).Info("Stopping instance", "instance", instance.InstanceLabel, "pid", *pid)
+	released := make(chan struct{})
+	var waitErr error
+	go func() {
+		defer close(released)
+		waitErr = waitForInstanceRelease(ctx, config, instance)
+	}()
+	stopBrowser(ctx, *pid, filepath.Join(getInstanceDir(config, instance), relativeProfilePath), released)
+	<-released
+	return waitErr
+}
+
+// waitForInstanceRelease waits until the instance isn't running
+// anymore, see isInstanceDead.
+func waitForInstanceRelease(ctx context.Context, config Configuration, instance ProfileInstance) error {
+	ticker := time.NewTicker(instanceReleasePollInterval)
+	defer ticker.Stop()
+	for {
+		dead, err := isInstanceDead(config, instance)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if dead {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return uerror.WithStackTrace(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
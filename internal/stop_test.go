@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopBrowser(t *testing.T) {
+	originalGracePeriod, originalFlushTimeout, originalPollInterval := browserStopGracePeriod, sessionStoreFlushTimeout, sessionStorePollInterval
+	browserStopGracePeriod, sessionStoreFlushTimeout, sessionStorePollInterval = 100*time.Millisecond, 2*time.Second, 10*time.Millisecond
+	defer func() {
+		browserStopGracePeriod, sessionStoreFlushTimeout, sessionStorePollInterval = originalGracePeriod, originalFlushTimeout, originalPollInterval
+	}()
+
+	testCases := []struct {
+		desc string
+
+		flushSession bool
+		minDuration  time.Duration
+		maxDuration  time.Duration
+	}{
+		{
+			desc: "Killed after the session was saved",
+
+			flushSession: true,
+			minDuration:  browserStopGracePeriod,
+			maxDuration:  sessionStoreFlushTimeout / 2,
+		},
+		{
+			desc: "Killed after the flush timeout",
+
+			flushSession: false,
+			minDuration:  sessionStoreFlushTimeout,
+			maxDuration:  sessionStoreFlushTimeout + time.Second,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			profileDir := t.TempDir()
+			// Ignores SIGTERM like a browser that is busy saving its
+			// session.
+			cmd := exec.Command("sh", "-c", `trap "" TERM; exec sleep 10`)
+			assert.NoError(t, cmd.Start())
+			exited := make(chan struct{})
+			go func() {
+				_ = cmd.Wait()
+				close(exited)
+			}()
+			// Give the shell time to set up the trap.
+			time.Sleep(100 * time.Millisecond)
+
+			start := time.Now()
+			if tC.flushSession {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					_ = os.WriteFile(filepath.Join(profileDir, sessionStoreFileName), []byte{}, 0o644)
+				}()
+			}
+			stopBrowser(context.Background(), cmd.Process.Pid, profileDir, exited)
+			select {
+			case <-exited:
+			case <-time.After(5 * time.Second):
+				t.Fatal("The process wasn't killed")
+			}
+			elapsed := time.Since(start)
+			assert.GreaterOrEqual(t, elapsed, tC.minDuration)
+			assert.Less(t, elapsed, tC.maxDuration)
+		})
+	}
+}
+
+func TestStopBrowserOnCancel(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	assert.NoError(t, cmd.Start())
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := stopBrowserOnCancel(ctx, cmd.Process.Pid, t.TempDir())
+	cancel()
+	select {
+	case err := <-exited:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The process wasn't stopped after the context was canceled")
+	}
+	stop()
+}
+
+func TestStopInstance(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		attached bool
+	}{
+		{
+			desc: "Launched by tbml",
+
+			attached: false,
+		},
+		{
+			desc: "Attached",
+
+			attached: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			assert.NoError(t, writeProfileInstanceForTest(config, instance))
+			assert.ErrorIs(t, StopInstance(context.Background(), config, instance), ErrInstanceNotRunning)
+
+			cmd := exec.Command("sleep", "10")
+			assert.NoError(t, cmd.Start())
+			pid := cmd.Process.Pid
+			var unlock func() error
+			if tC.attached {
+				assert.NoError(t, AttachInstance(config, instance, pid, nil))
+			} else {
+				// The lock is held like by the tbml that launched the
+				// browser, until the browser exits.
+				var err error
+				unlock, err = LockInstance(config, instance)
+				assert.NoError(t, err)
+				assert.NoError(t, recordBrowserPID(config, instance.InstanceLabel, pid))
+			}
+			go func() {
+				_ = cmd.Wait()
+				if unlock != nil {
+					_ = unlock()
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			assert.NoError(t, StopInstance(ctx, config, instance))
+			assert.False(t, isProcessAlive(pid))
+			dead, err := isInstanceDead(config, instance)
+			assert.NoError(t, err)
+			assert.True(t, dead)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// procFilesystemsPath lists the file systems the kernel supports. It is
+// a variable so tests can fake it.
+var procFilesystemsPath = "/proc/filesystems"
+
+// StorageProbe describes what the file system of a directory can do,
+// see ProbeStorage. The JSON field names must stay stable, they are
+// shown in bug reports.
+type StorageProbe struct {
+	// FileSystem is the file system's name, e.g. "btrfs", see
+	// uio.GetFileSystemType.
+	FileSystem string `json:"fileSystem"`
+	// FreeBytes is the space left for unprivileged users.
+	FreeBytes int64 `json:"freeBytes"`
+	// Overlay tells whether the kernel supports overlayfs.
+	Overlay bool `json:"overlay"`
+	// Reflinks tells whether files can be cloned copy-on-write.
+	Reflinks bool `json:"reflinks"`
+	// Tmpfs tells whether the files are only kept in memory.
+	Tmpfs bool `json:"tmpfs"`
+}
+
+// storageProbes caches the probes per device, since probing reflinks
+// writes files.
+var storageProbes = struct {
+	sync.Mutex
+	byDevice map[uint64]StorageProbe
+}{byDevice: map[uint64]StorageProbe{}}
+
+// ProbeStorage finds out what the file system of the given directory
+// can do. Everything but the free space is cached per device for as
+// long as tbml runs. The directory must exist and be writable.
+func ProbeStorage(path string) (StorageProbe, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return StorageProbe{}, uerror.WithStackTrace(err)
+	}
+	if !info.IsDir() {
+		return StorageProbe{}, uerror.StackTracef("%s is not a directory", path)
+	}
+	device := uint64(info.Sys().(*syscall.Stat_t).Dev)
+
+	storageProbes.Lock()
+	defer storageProbes.Unlock()
+	probe, ok := storageProbes.byDevice[device]
+	if !ok {
+		if probe, err = probeStorageCapabilities(path); err != nil {
+			return StorageProbe{}, uerror.WithStackTrace(err)
+		}
+		storageProbes.byDevice[device] = probe
+	}
+	if probe.FreeBytes, err = uio.GetFreeSpace(path); err != nil {
+		return StorageProbe{}, uerror.WithStackTrace(err)
+	}
+	return probe, nil
+}
+
+// ProbeProfilePath probes the storage instances are kept on. The state
+// directory is created for the probe's scratch files.
+func ProbeProfilePath(config Configuration) (StorageProbe, error) {
+	stateDir := getStateDir(config)
+	if err := os.MkdirAll(stateDir, uio.FileModeURWXGRWXO); err != nil {
+		return StorageProbe{}, uerror.WithStackTrace(err)
+	}
+	return ProbeStorage(stateDir)
+}
+
+func probeStorageCapabilities(path string) (StorageProbe, error) {
+	fsType, err := uio.GetFileSystemType(path)
+	if err != nil {
+		return StorageProbe{}, uerror.WithStackTrace(err)
+	}
+	reflinks, err := uio.SupportsReflinks(path)
+	if err != nil {
+		return StorageProbe{}, uerror.WithStackTrace(err)
+	}
+	overlay, err := isFileSystemSupported("overlay")
+	if err != nil {
+		return StorageProbe{}, uerror.WithStackTrace(err)
+	}
+	return StorageProbe{
+		FileSystem: fsType,
+		Overlay:    overlay,
+		Reflinks:   reflinks,
+		Tmpfs:      fsType == "tmpfs",
+	}, nil
+}
+
+// isFileSystemSupported tells whether the kernel supports the given
+// file system. File systems built as modules that aren't loaded yet
+// are missed.
+func isFileSystemSupported(name string) (bool, error) {
+	file, err := os.Open(procFilesystemsPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, uerror.WithStackTrace(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines are "nodev\toverlay" or "\text4".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == name {
+			return true, nil
+		}
+	}
+	return false, uerror.WithStackTrace(scanner.Err())
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	probe, err := ProbeStorage(dir)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, probe.FileSystem)
+	assert.Equal(t, probe.FileSystem == "tmpfs", probe.Tmpfs)
+	assert.Greater(t, probe.FreeBytes, int64(0))
+
+	// Directories on the same device share the cached capabilities.
+	otherDir := filepath.Join(dir, "other")
+	assert.NoError(t, os.Mkdir(otherDir, 0o755))
+	cached, err := ProbeStorage(otherDir)
+	assert.NoError(t, err)
+	cached.FreeBytes = probe.FreeBytes
+	assert.Equal(t, probe, cached)
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0o644))
+	_, err = ProbeStorage(file)
+	assert.Error(t, err)
+}
+
+func TestIsFileSystemSupported(t *testing.T) {
+	originalPath := procFilesystemsPath
+	defer func() { procFilesystemsPath = originalPath }()
+	procFilesystemsPath = filepath.Join(t.TempDir(), "filesystems")
+	assert.NoError(t, os.WriteFile(procFilesystemsPath, []byte("nodev\tsysfs\nnodev\toverlay\n\text4\n"), 0o644))
+
+	for name, expected := range map[string]bool{"overlay": true, "ext4": true, "nodev": false, "btrfs": false} {
+		supported, err := isFileSystemSupported(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, supported, name)
+	}
+}
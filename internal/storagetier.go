@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+var ErrStorageUnavailable error = errors.New("The instance's storage is not available")
+
+// getNewInstanceDirectory returns the Directory of a new instance of the
+// profile: nil, unless the profile has a ProfilePath of its own.
+func getNewInstanceDirectory(profile ProfileConfiguration, instanceLabel string) *string {
+	if profile.ProfilePath == nil {
+		return nil
+	}
+	directory := filepath.Join(*profile.ProfilePath, instanceLabel)
+	return &directory
+}
+
+// ensureInstanceDirectory creates the directory of a new instance that
+// is kept in its profile's own ProfilePath. The directory of an
+// existing instance must exist already; if it doesn't, the disk it is
+// on is likely not mounted, and launching would create an empty
+// instance in its place.
+func ensureInstanceDirectory(directory string, isNew bool) error {
+	if isNew {
+		return os.MkdirAll(directory, uio.FileModeURWXGRWXO)
+	}
+	exists, err := uio.DirExists(directory)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !exists {
+		return uerror.StackTracef("%w: %s doesn't exist", ErrStorageUnavailable, directory)
+	}
+	return nil
+}
+
+// MigrateStorage moves the files of the profile's instances to newPath,
+// e.g. to another disk, and returns the instances that were moved. If
+// newPath is the global profile path, the files are moved back into
+// the instances' directories there. Ephemeral instances are left
+// alone, and encrypted ones stay in the global profile path. No
+// instance is moved if any of them is in use. Each instance's files are
+// copied before its metadata is switched to them and the old ones are
+// deleted, so an interrupted migration leaves every instance intact.
+func MigrateStorage(config Configuration, profile ProfileConfiguration, newPath string, mutations *Mutations, warnings *Warnings) ([]ProfileInstance, error) {
+	newPath, err := filepath.Abs(newPath)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	instances, err := readProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+
+	toMove := []ProfileInstance{}
+	inUse := []string{}
+	for _, instance := range instances {
+		if instance.ProfileLabel != profile.Label || instance.Ephemeral {
+			continue
+		}
+		if instance.Encrypted {
+			warnings.Add(instance.InstanceLabel, "Encrypted instances stay in the profile path")
+			continue
+		}
+		if filepath.Clean(getInstanceDir(config, instance)) == getMigratedInstanceDir(config, instance, newPath) {
+			continue
+		}
+		used, err := isInstanceInUse(config, instance)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if used {
+			inUse = append(inUse, instance.InstanceLabel)
+		}
+		toMove = append(toMove, instance)
+	}
+	if len(inUse) > 0 {
+		return nil, uerror.StackTracef("%w: %v", ErrInstanceInUse, inUse)
+	}
+
+	moved := []ProfileInstance{}
+	for _, instance := range toMove {
+		target := getMigratedInstanceDir(config, instance, newPath)
+		if err := mutations.Apply("Move instance", fmt.Sprintf("%s to %s", instance.InstanceLabel, target), func() error {
+			return migrateInstanceStorage(config, instance, newPath)
+		}); err != nil {
+			return moved, uerror.WithStackTrace(err)
+		}
+		moved = append(moved, instance)
+	}
+
+	configured := config.ProfilePath
+	if profile.ProfilePath != nil {
+		configured = *profile.ProfilePath
+	}
+	if filepath.Clean(configured) != newPath {
+		warnings.Add(profile.Label, "New instances are still created in %s; set the profile's ProfilePath to %s to change that", configured, newPath)
+	}
+	return moved, nil
+}
+
+// getMigratedInstanceDir returns where MigrateStorage puts the files of
+// an instance: its directory in the profile path if newPath is the
+// profile path, otherwise a directory named after it in newPath.
+func getMigratedInstanceDir(config Configuration, instance ProfileInstance, newPath string) string {
+	if newPath == filepath.Clean(config.ProfilePath) {
+		return filepath.Clean(getInstanceRecordDir(config, instance))
+	}
+	return filepath.Join(newPath, instance.InstanceLabel)
+}
+
+func migrateInstanceStorage(config Configuration, instance ProfileInstance, newPath string) error {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+	// The instance may have been launched or moved since it was listed.
+	instance, err = GetProfileInstance(config, instance.InstanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	recordDir := filepath.Clean(getInstanceRecordDir(config, instance))
+	src := filepath.Clean(getInstanceDir(config, instance))
+	dst := getMigratedInstanceDir(config, instance, newPath)
+	if src == dst {
+		return nil
+	}
+	srcExists, err := uio.DirExists(src)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if !srcExists && !instance.Reserved {
+		return uerror.StackTracef("%w: %s doesn't exist", ErrStorageUnavailable, src)
+	}
+	if dst != recordDir {
+		if exists, err := uio.DirExists(dst); err != nil || exists {
+			return uerror.StackTracef("%w: %s already exists", ErrInstanceExists, dst)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	// Everything but tbml's own files is copied next to the target
+	// first, so the target only appears once it is complete.
+	touchesRecordDir := src == recordDir || dst == recordDir
+	isBrowserFile := func(name string) bool {
+		return !touchesRecordDir || !isInstanceRecordFile(name)
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(dst), "."+instance.InstanceLabel+"-migrating-*")
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer os.RemoveAll(staging)
+	if srcExists {
+		if err := checkMigrationSpace(src, staging, isBrowserFile); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := copyInstanceFiles(src, staging, getMutableCloneStrategy(config, staging), isBrowserFile); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if dst == recordDir {
+		if err := moveDirEntries(staging, recordDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	} else if err := os.Rename(staging, dst); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	if dst == recordDir {
+		instance.Directory = nil
+	} else {
+		instance.Directory = &dst
+	}
+	if err := writeProfileInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	if srcExists {
+		if src == recordDir {
+			err = removeDirEntries(src, isBrowserFile)
+		} else {
+			err = os.RemoveAll(src)
+		}
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	ulog.Default().Info("Moved instance", "instance", instance.InstanceLabel, "directory", dst)
+	return nil
+}
+
+// checkMigrationSpace fails with ErrLowDiskSpace if the files of src
+// that are copied don't fit into dst.
+func checkMigrationSpace(src string, dst string, include func(name string) bool) error {
+	dirEntries, err := os.ReadDir(src)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	var size int64
+	for _, dirEntry := range dirEntries {
+		if !include(dirEntry.Name()) {
+			continue
+		}
+		if !dirEntry.IsDir() {
+			info, err := dirEntry.Info()
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			size += info.Size()
+			continue
+		}
+		dirSize, err := uio.DirSize(filepath.Join(src, dirEntry.Name()))
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		size += dirSize
+	}
+	return checkFreeDiskSpace(dst, size)
+}
+
+// copyInstanceFiles copies the included entries of src into dst.
+// Symlinks, like the lock Firefox leaves behind when it crashes, are
+// copied as symlinks.
+func copyInstanceFiles(src string, dst string, strategy uio.CloneStrategy, include func(name string) bool) error {
+	dirEntries, err := os.ReadDir(src)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, dirEntry := range dirEntries {
+		if !include(dirEntry.Name()) {
+			continue
+		}
+		root := filepath.Join(src, dirEntry.Name())
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relativePath, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dst, relativePath)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.IsDir():
+				return os.MkdirAll(target, info.Mode().Perm())
+			case d.Type()&fs.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				return os.Symlink(link, target)
+			case d.Type().IsRegular():
+				return uio.CloneFile(path, target, info.Mode().Perm(), strategy)
+			}
+			// Sockets and pipes only mean something to the running
+			// browser.
+			return nil
+		})
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
+
+// moveDirEntries moves the entries of src into dst, replacing entries
+// of the same name.
+func moveDirEntries(src string, dst string) error {
+	dirEntries, err := os.ReadDir(src)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, dirEntry := range dirEntries {
+		target := filepath.Join(dst, dirEntry.Name())
+		// Leftovers of an interrupted migration are replaced.
+		if err := os.RemoveAll(target); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if err := os.Rename(filepath.Join(src, dirEntry.Name()), target); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
+
+func removeDirEntries(dir string, include func(name string) bool) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	for _, dirEntry := range dirEntries {
+		if !include(dirEntry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, dirEntry.Name())); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	return nil
+}
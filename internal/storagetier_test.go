@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	prefsPath := filepath.Join(relativeProfilePath, "prefs.js")
+	assert.NoError(t, os.MkdirAll(filepath.Join(instanceDir, relativeProfilePath), uio.FileModeURWXGRWXO))
+	assert.NoError(t, os.WriteFile(filepath.Join(instanceDir, prefsPath), []byte("prefs"), uio.FileModeURWGRWO))
+	assert.NoError(t, os.Symlink("127.0.0.1:+1234", filepath.Join(instanceDir, "lock")))
+	newPath := filepath.Join(config.ProfilePath, ".hdd")
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	_, err = MigrateStorage(config, profile, newPath, nil, nil)
+	assert.ErrorIs(t, err, ErrInstanceInUse)
+	assert.NoError(t, unlock())
+	assert.FileExists(t, filepath.Join(instanceDir, prefsPath))
+
+	warnings := &Warnings{}
+	moved, err := MigrateStorage(config, profile, newPath, nil, warnings)
+	assert.NoError(t, err)
+	assert.Len(t, moved, 1)
+	assert.Len(t, warnings.List(), 1)
+	migrated, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(newPath, instance.InstanceLabel), *migrated.Directory)
+	assert.FileExists(t, filepath.Join(*migrated.Directory, prefsPath))
+	link, err := os.Readlink(filepath.Join(*migrated.Directory, "lock"))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:+1234", link)
+	assert.NoDirExists(t, filepath.Join(instanceDir, relativeProfilePath))
+	assert.FileExists(t, filepath.Join(instanceDir, "profile-instance.json"))
+
+	// The files can be moved back into the profile path.
+	moved, err = MigrateStorage(config, profile, config.ProfilePath, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, moved, 1)
+	migrated, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Nil(t, migrated.Directory)
+	assert.FileExists(t, filepath.Join(instanceDir, prefsPath))
+	assert.NoDirExists(t, filepath.Join(newPath, instance.InstanceLabel))
+
+	moved, err = MigrateStorage(config, profile, config.ProfilePath, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, moved)
+}
+
+func TestDeleteInstanceInOwnProfilePath(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	profilePath := filepath.Join(config.ProfilePath, ".hdd")
+	profile.ProfilePath = &profilePath
+
+	instance := GetBestInstance(profile, []ProfileInstance{})
+	assert.Equal(t, filepath.Join(profilePath, instance.InstanceLabel), *instance.Directory)
+	cleanUp, err := writeInstanceData(config, profile, instance)
+	assert.NoError(t, err)
+	assert.NoError(t, cleanUp())
+	assert.DirExists(t, *instance.Directory)
+	assert.NoError(t, os.WriteFile(filepath.Join(*instance.Directory, "prefs.js"), []byte("prefs"), uio.FileModeURWGRWO))
+
+	assert.NoError(t, DeleteInstance(config, instance, nil))
+	assert.NoDirExists(t, *instance.Directory)
+	_, restoredLabel, err := UndoLastOperation(config, CollisionFail, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, instance.InstanceLabel, restoredLabel)
+	assert.FileExists(t, filepath.Join(*instance.Directory, "prefs.js"))
+
+	// A launch doesn't recreate the files if their disk is missing.
+	assert.NoError(t, os.RemoveAll(profilePath))
+	instance, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	_, err = writeInstanceData(config, profile, instance)
+	assert.ErrorIs(t, err, ErrStorageUnavailable)
+}
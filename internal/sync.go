@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+// provisioningInputs are what an instance's user.js, userChrome.css,
+// extensions and native messaging hosts are made from. Files are
+// represented by their SHA-256 sums. Inputs added later are omitted
+// when empty, so existing instances aren't resynced for nothing.
+type provisioningInputs struct {
+	ExtensionFiles       map[string]string
+	Extensions           map[string]string
+	NativeMessagingHosts []string `json:",omitempty"`
+	Prefs                []userPref
+	Template             string `json:",omitempty"`
+	UserChromeFile       string
+	UserJSFile           string
+	// UserJS holds the user.js layers besides the profile's UserJSFile.
+	UserJS []provisioningUserJSLayer `json:",omitempty"`
+}
+
+type provisioningUserJSLayer struct {
+	Files []string
+	Prefs []userPref
+}
+
+// getProvisioningHash returns a hash of everything syncInstance
+// applies to an instance used for topic, so a change to the
+// configuration or the files it references can be detected.
+func getProvisioningHash(config Configuration, profile ProfileConfiguration, topic *string, configDir string) (string, error) {
+	resolve := func(name string) string {
+		if filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(configDir, name)
+	}
+
+	inputs := provisioningInputs{
+		ExtensionFiles: map[string]string{},
+		Extensions:     map[string]string{},
+	}
+	prefs, err := getProfilePrefs(profile)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	inputs.Prefs = prefs
+	if profile.Template != nil {
+		if inputs.Template, err = prepareTemplate(config, configDir, *profile.Template); err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+	}
+	if profile.UserJSFile != nil {
+		if inputs.UserJSFile, err = hashConfigFile(config, configDir, *profile.UserJSFile); err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+	}
+	profileWithoutUserJSFile := profile
+	profileWithoutUserJSFile.UserJSFile = nil
+	for _, layer := range getUserJSLayers(config, profileWithoutUserJSFile, topic) {
+		if len(layer.Files) == 0 && len(layer.Prefs) == 0 {
+			continue
+		}
+		layerInputs := provisioningUserJSLayer{Prefs: layer.Prefs}
+		for _, file := range layer.Files {
+			checksum, err := hashConfigFile(config, configDir, file)
+			if err != nil {
+				return "", uerror.WithStackTrace(err)
+			}
+			layerInputs.Files = append(layerInputs.Files, checksum)
+		}
+		inputs.UserJS = append(inputs.UserJS, layerInputs)
+	}
+	if profile.UserChromeFile != nil {
+		if inputs.UserChromeFile, err = hashConfigFile(config, configDir, *profile.UserChromeFile); err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+	}
+	for _, extensionFile := range profile.ExtensionFiles {
+		checksum, err := hashConfigFile(config, configDir, extensionFile)
+		if err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+		inputs.ExtensionFiles[getExtensionIDFromPath(extensionFile)] = checksum
+	}
+	for _, source := range profile.Extensions {
+		inputs.Extensions[source.ID] = source.SHA256
+	}
+	for _, manifestFile := range profile.NativeMessagingHosts {
+		checksum, err := sha256File(resolve(manifestFile))
+		if err != nil {
+			return "", uerror.WithStackTrace(err)
+		}
+		inputs.NativeMessagingHosts = append(inputs.NativeMessagingHosts, checksum)
+	}
+
+	inputsJSON, err := json.Marshal(inputs)
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	hash := sha256.Sum256(inputsJSON)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// SyncInstance applies the profile's current user.js, userChrome.css,
+// prefs and extensions to an instance that isn't in use, replacing
+// whatever the instance was provisioned with before.
+func SyncInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instance ProfileInstance, configDir string) (err error) {
+	unlock, err := LockInstance(config, instance)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	if err := unarchiveInstance(config, instance); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	unmountEncryptedInstance, err := mountEncryptedInstance(config, profile, instance, nil)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer func() {
+		if unmountErr := unmountEncryptedInstance(); err == nil {
+			err = unmountErr
+		}
+	}()
+
+	if err := syncInstance(ctx, config, profile, instance.InstanceLabel, configDir, getInstanceDir(config, instance)); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
+
+// syncInstanceIfChanged syncs an instance if the profile changed since
+// the instance was last synced. With noSync, instances that were
+// synced before are left as they are. The instance must be locked by
+// the caller.
+func syncInstanceIfChanged(ctx context.Context, config Configuration, profile ProfileConfiguration, instanceLabel string, configDir string, instanceDir string, noSync bool) error {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	logger := ulog.FromContext(ctx)
+	if instance.ProvisionedHash != "" && noSync {
+		logger.Debug("Skipping sync")
+		return nil
+	}
+	hash, err := getProvisioningHash(config, profile, instance.UsageLabel, configDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if instance.ProvisionedHash == hash {
+		logger.Debug("Profile unchanged since the last sync", "hash", hash)
+		return nil
+	}
+	logger.Info("Syncing instance", "previousHash", instance.ProvisionedHash, "hash", hash)
+	return syncInstance(ctx, config, profile, instanceLabel, configDir, instanceDir)
+}
+
+func syncInstance(ctx context.Context, config Configuration, profile ProfileConfiguration, instanceLabel string, configDir string, instanceDir string) error {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	hash, err := getProvisioningHash(config, profile, instance.UsageLabel, configDir)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	unlockProvisioning, err := lockProvisioning(config, profile.Label)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	err = fetchExtensions(ctx, http.DefaultClient, config, profile)
+	if err == nil {
+		err = markExtensionsUsed(config, profile, time.Now())
+	}
+	if err == nil {
+		var evicted []string
+		evicted, err = evictCachedExtensions(config)
+		for _, path := range evicted {
+			ulog.FromContext(ctx).Info("Evicted cached extension", "path", path)
+		}
+	}
+	if err == nil {
+		err = fetchConfigFiles(ctx, http.DefaultClient, config, getProvisionedConfigFiles(config, profile, instance.UsageLabel))
+	}
+	if unlockErr := unlockProvisioning(); err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if profile.Template != nil {
+		if err := applyTemplate(ctx, config, profile, instanceLabel, configDir, instanceDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	if err := ensureFiles(config, profile, instance.UsageLabel, configDir, instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := writeProfilePrefs(profile, instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := ensureExtensions(config, profile, instanceLabel, configDir, instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	if err := ensureNativeMessagingHosts(config, profile, instanceLabel, configDir, instanceDir); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	instance, err = GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.ProvisionedHash = hash
+	return writeProfileInstance(config, instance)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestSyncInstanceIfChanged(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		changeProfile bool
+		expectSync    bool
+		noSync        bool
+	}{
+		{
+			desc: "Unchanged profile",
+		},
+		{
+			desc: "Changed profile",
+
+			changeProfile: true,
+			expectSync:    true,
+		},
+		{
+			desc: "Changed profile with noSync",
+
+			changeProfile: true,
+			noSync:        true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+			configDir := t.TempDir()
+			userJS := "user.js"
+			profile.UserJSFile = &userJS
+			assert.NoError(t, os.WriteFile(filepath.Join(configDir, userJS), []byte("// v1\n"), uio.FileModeURWGRWO))
+
+			ctx := context.Background()
+			assert.NoError(t, syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, configDir, instanceDir, tC.noSync))
+			userJSPath := filepath.Join(instanceDir, relativeProfilePath, "user.js")
+			actual, err := os.ReadFile(userJSPath)
+			assert.NoError(t, err)
+			assert.Equal(t, "// v1\n", string(actual))
+
+			// Changes to the instance's copy are only overwritten by
+			// a sync.
+			assert.NoError(t, os.WriteFile(userJSPath, []byte("// edited\n"), uio.FileModeURWGRWO))
+			if tC.changeProfile {
+				assert.NoError(t, os.WriteFile(filepath.Join(configDir, userJS), []byte("// v2\n"), uio.FileModeURWGRWO))
+			}
+			assert.NoError(t, syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, configDir, instanceDir, tC.noSync))
+
+			actual, err = os.ReadFile(userJSPath)
+			assert.NoError(t, err)
+			if tC.expectSync {
+				assert.Equal(t, "// v2\n", string(actual))
+			} else {
+				assert.Equal(t, "// edited\n", string(actual))
+			}
+		})
+	}
+}
+
+func TestSyncInstance(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	userChrome := "userChrome.css"
+	profile.UserChromeFile = &userChrome
+	assert.NoError(t, SyncInstance(context.Background(), config, profile, instance, "testdata/ensure-files"))
+	assert.FileExists(t, filepath.Join(instanceDir, relativeProfilePath, "chrome/userChrome.css"))
+
+	instanceAfter, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	expectedHash, err := getProvisioningHash(config, profile, instance.UsageLabel, "testdata/ensure-files")
+	assert.NoError(t, err)
+	assert.Equal(t, expectedHash, instanceAfter.ProvisionedHash)
+
+	unlock, err := LockInstance(config, instance)
+	assert.NoError(t, err)
+	defer unlock()
+	assert.ErrorIs(t, SyncInstance(context.Background(), config, profile, instance, "testdata/ensure-files"), ErrInstanceInUse)
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+// sessionStoreFiles are where Firefox saves the open windows and tabs,
+// relative to the profile directory. While it runs, it updates the
+// recovery file every few seconds, and when it quits, it writes
+// sessionStoreFileName.
+var sessionStoreFiles = []string{
+	sessionStoreFileName,
+	filepath.Join("sessionstore-backups", "recovery.jsonlz4"),
+}
+
+// maxSessionStoreSize keeps a corrupt session store from exhausting
+// the memory.
+const maxSessionStoreSize = 256 << 20
+
+// Tab is a tab that is open in an instance, or was when its browser
+// was last closed. The JSON field names must stay stable, since
+// scripts use them.
+type Tab struct {
+	Instance string `json:"instance"`
+	Profile  string `json:"profile"`
+	// Running tells whether the instance's browser is running, i.e.
+	// the tab is likely still open.
+	Running bool   `json:"running"`
+	Title   string `json:"title"`
+	// Topic is the instance's current topic or, if it isn't running,
+	// the topic it was last used for.
+	Topic *string `json:"topic"`
+	URL   string  `json:"url"`
+}
+
+type sessionStore struct {
+	Windows []struct {
+		Tabs []struct {
+			Entries []struct {
+				Title string `json:"title"`
+				URL   string `json:"url"`
+			} `json:"entries"`
+			// Index is the 1-based index of the entry the tab shows.
+			Index int `json:"index"`
+		} `json:"tabs"`
+	} `json:"windows"`
+}
+
+// GetTabs returns the tabs of all instances, sorted by profile and
+// instance label and in the order the browser shows them. Instances
+// whose session store can't be read are skipped with a warning.
+func GetTabs(config Configuration, warnings *Warnings) ([]Tab, error) {
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].ProfileLabel != instances[j].ProfileLabel {
+			return instances[i].ProfileLabel < instances[j].ProfileLabel
+		}
+		return instances[i].InstanceLabel < instances[j].InstanceLabel
+	})
+
+	tabs := []Tab{}
+	for _, instance := range instances {
+		profileDir := filepath.Join(getInstanceDir(config, instance), relativeProfilePath)
+		store, err := readSessionStore(profileDir)
+		if err != nil {
+			warnings.Add(instance.InstanceLabel, "Failed to read the open tabs: %s", uerror.Message(err))
+			continue
+		}
+		topic := getLastTopic(instance)
+		for _, window := range store.Windows {
+			for _, tab := range window.Tabs {
+				if len(tab.Entries) == 0 {
+					continue
+				}
+				index := tab.Index - 1
+				if index < 0 || index >= len(tab.Entries) {
+					index = len(tab.Entries) - 1
+				}
+				entry := tab.Entries[index]
+				tabs = append(tabs, Tab{
+					Instance: instance.InstanceLabel,
+					Profile:  instance.ProfileLabel,
+					Running:  instance.UsagePID != nil,
+					Title:    entry.Title,
+					Topic:    topic,
+					URL:      entry.URL,
+				})
+			}
+		}
+	}
+	return tabs, nil
+}
+
+// readSessionStore reads the most recently written of the
+// sessionStoreFiles in a profile directory. A profile without any has
+// no tabs.
+func readSessionStore(profileDir string) (sessionStore, error) {
+	var store sessionStore
+	newestPath := ""
+	var newestModTime time.Time
+	for _, name := range sessionStoreFiles {
+		path := filepath.Join(profileDir, name)
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return store, uerror.WithStackTrace(err)
+		}
+		if newestPath == "" || info.ModTime().After(newestModTime) {
+			newestPath, newestModTime = path, info.ModTime()
+		}
+	}
+	if newestPath == "" {
+		return store, nil
+	}
+
+	compressed, err := uio.ReadFileLimited(newestPath, maxSessionStoreSize)
+	if err != nil {
+		return store, uerror.WithStackTrace(err)
+	}
+	content, err := uio.DecodeMozLz4(compressed)
+	if err != nil {
+		return store, uerror.WithStackTrace(err)
+	}
+	if err := json.Unmarshal(content, &store); err != nil {
+		return store, uerror.WithStackTrace(err)
+	}
+	return store, nil
+}
+
+// getLastTopic returns the instance's current topic or, if it has
+// none, the topic of its last usage session.
+func getLastTopic(instance ProfileInstance) *string {
+	if instance.UsageLabel != nil {
+		return instance.UsageLabel
+	}
+	if len(instance.Sessions) == 0 {
+		return nil
+	}
+	return instance.Sessions[len(instance.Sessions)-1].Topic
+}
+
+// FilterTabs returns the tabs of the given topic and its subtopics,
+// matched like in FindInstanceByTopic, whose title or URL contains all
+// words of the query, ignoring case. Empty filters match all tabs.
+func FilterTabs(config Configuration, tabs []Tab, topic string, query string) []Tab {
+	words := strings.Fields(strings.ToLower(query))
+	normalize := func(s string) string {
+		if config.NormalizeLabels {
+			return ustring.NormalizeLabel(s)
+		}
+		return s
+	}
+	topic = normalize(topic)
+
+	filtered := []Tab{}
+TABS:
+	for _, tab := range tabs {
+		if topic != "" {
+			if tab.Topic == nil {
+				continue
+			}
+			tabTopic := normalize(*tab.Topic)
+			if tabTopic != topic && !strings.HasPrefix(tabTopic, topic+topicSeparator) {
+				continue
+			}
+		}
+		text := strings.ToLower(tab.Title + " " + tab.URL)
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				continue TABS
+			}
+		}
+		filtered = append(filtered, tab)
+	}
+	return filtered
+}
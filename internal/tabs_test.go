@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSessionStoreForTest writes a mozlz4 file whose LZ4 block
+// consists of a single sequence of literals.
+func writeSessionStoreForTest(t *testing.T, path string, content string, modTime time.Time) {
+	data := append([]byte("mozLz40\x00"), 0, 0, 0, 0, 0xf0)
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(content)))
+	length := len(content) - 15
+	for ; length >= 255; length -= 255 {
+		data = append(data, 255)
+	}
+	data = append(data, byte(length))
+	data = append(data, content...)
+
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestGetTabs(t *testing.T) {
+	config, _, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	instance.Sessions = []UsageSession{
+		{Start: time.Now().Add(-time.Hour).UTC(), End: timePtr(time.Now().UTC()), Topic: strPtr("research")},
+	}
+	instance.UsageLabel = nil
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	writeSessionStoreForTest(t, filepath.Join(profileDir, sessionStoreFileName), `{
+		"windows": [{"tabs": [
+			{"entries": [{"title": "Old", "url": "https://old.example/"}, {"title": "Back", "url": "https://example.com/"}], "index": 2},
+			{"entries": []}
+		]}, {"tabs": [
+			{"entries": [{"title": "Search", "url": "https://search.example/?q=tbml"}], "index": 1}
+		]}],
+		"_closedWindows": [{"tabs": [{"entries": [{"title": "Closed", "url": "https://closed.example/"}], "index": 1}]}]
+	}`, time.Now())
+	// The recovery file is older, e.g. left over from a crash.
+	writeSessionStoreForTest(t, filepath.Join(profileDir, "sessionstore-backups", "recovery.jsonlz4"), `{
+		"windows": [{"tabs": [{"entries": [{"title": "Stale", "url": "https://stale.example/"}], "index": 1}]}]
+	}`, time.Now().Add(-time.Minute))
+
+	tabs, err := GetTabs(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Tab{
+		{Instance: "test-1", Profile: "test", Title: "Back", Topic: strPtr("research"), URL: "https://example.com/"},
+		{Instance: "test-1", Profile: "test", Title: "Search", Topic: strPtr("research"), URL: "https://search.example/?q=tbml"},
+	}, tabs)
+}
+
+func TestFilterTabs(t *testing.T) {
+	tabs := []Tab{
+		{Instance: "a-1", Title: "Go Documentation", Topic: strPtr("work/go"), URL: "https://go.dev/doc/"},
+		{Instance: "a-2", Title: "Weather", Topic: strPtr("Work"), URL: "https://weather.example/"},
+		{Instance: "b-1", Title: "Go Playground", URL: "https://go.dev/play/"},
+	}
+	testCases := []struct {
+		desc string
+
+		expected        []string
+		normalizeLabels bool
+		query           string
+		topic           string
+	}{
+		{
+			desc: "No filter",
+
+			expected: []string{"a-1", "a-2", "b-1"},
+		},
+		{
+			desc: "All words must match",
+
+			expected: []string{"b-1"},
+			query:    "go.dev PLAY",
+		},
+		{
+			desc: "Topic with subtopics",
+
+			expected: []string{"a-1"},
+			topic:    "work",
+		},
+		{
+			desc: "Normalized topic",
+
+			expected:        []string{"a-1", "a-2"},
+			normalizeLabels: true,
+			topic:           "work",
+		},
+		{
+			desc: "Topic and query",
+
+			expected:        []string{"a-2"},
+			normalizeLabels: true,
+			query:           "weather",
+			topic:           "work",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config := Configuration{NormalizeLabels: tC.normalizeLabels}
+			instances := []string{}
+			for _, tab := range FilterTabs(config, tabs, tC.topic, tC.query) {
+				instances = append(instances, tab.Instance)
+			}
+			assert.Equal(t, tC.expected, instances)
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+const (
+	templateManifestsDirName = "template-manifests"
+	templatePrefsFileName    = "prefs.js"
+)
+
+// AppliedTemplateVersion records a version of the profile's Template
+// that was applied to an instance.
+type AppliedTemplateVersion struct {
+	Applied time.Time
+	// Kept are the files and prefs the version changed that the
+	// instance kept, because they were changed in the instance.
+	Kept []string `json:",omitempty"`
+	// Version is the checksum of the template's SHA256SUMS.
+	Version string
+}
+
+// templateManifest describes a cached version of a shared template, so
+// later versions can be compared to it after it was removed from the
+// cache.
+type templateManifest struct {
+	// Files maps the files' paths to their hex-encoded SHA-256 sums.
+	Files map[string]string
+	// Prefs maps the names of the prefs in the template's prefs.js to
+	// their values as JavaScript literals.
+	Prefs map[string]string
+}
+
+func getTemplateManifestPath(config Configuration, digest string) string {
+	return filepath.Join(getStateDir(config), templateManifestsDirName, digest+".json")
+}
+
+// writeTemplateManifest describes the cached version of a template.
+func writeTemplateManifest(config Configuration, digest string) (templateManifest, error) {
+	cachedDir := getCachedTemplateDir(config, digest)
+	manifest := templateManifest{Files: map[string]string{}, Prefs: map[string]string{}}
+	err := filepath.WalkDir(cachedDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relativePath, err := filepath.Rel(cachedDir, path)
+		if err != nil {
+			return err
+		}
+		if manifest.Files[relativePath], err = sha256File(path); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+	if manifest.Prefs, err = readPrefsJSValues(filepath.Join(cachedDir, templatePrefsFileName)); err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+	manifestPath := getTemplateManifestPath(config, digest)
+	if err := os.MkdirAll(filepath.Dir(manifestPath), uio.FileModeURWXGRWXO); err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(manifestPath, manifestBytes, uio.FileModeURWGRWO); err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+	return manifest, nil
+}
+
+// readTemplateManifest returns the description of a template version,
+// writing it first if the version is cached but wasn't described yet.
+// Without either, the error wraps fs.ErrNotExist.
+func readTemplateManifest(config Configuration, digest string) (templateManifest, error) {
+	manifestBytes, err := os.ReadFile(getTemplateManifestPath(config, digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		cached, err := uio.DirExists(getCachedTemplateDir(config, digest))
+		if err != nil {
+			return templateManifest{}, uerror.WithStackTrace(err)
+		}
+		if !cached {
+			return templateManifest{}, uerror.StackTracef("No description of template version %s: %w", digest, fs.ErrNotExist)
+		}
+		return writeTemplateManifest(config, digest)
+	}
+	if err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+	manifest := templateManifest{}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return templateManifest{}, uerror.WithStackTrace(err)
+	}
+	return manifest, nil
+}
+
+// readPrefsJSValues returns the prefs of a prefs.js file by name, with
+// their values as JavaScript literals. A missing file has no prefs.
+func readPrefsJSValues(name string) (map[string]string, error) {
+	values := map[string]string{}
+	content, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	for _, pref := range parseUserPrefs(string(content)) {
+		if values[pref.Name], err = marshalJS(pref.Value); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	}
+	return values, nil
+}
+
+// applyTemplate brings an instance up to the current version of its
+// profile's Template. Unprovisioned instances get a copy of the whole
+// template. Provisioned ones only get what changed since the version
+// they have, i.e. new and changed files and prefs, unless they were
+// changed in the instance too, so the user's state stays as it is.
+// Instances provisioned before the profile had a template only get the
+// files and prefs they don't have. The version is recorded in the
+// instance's TemplateVersions. The instance must be locked by the
+// caller.
+func applyTemplate(ctx context.Context, config Configuration, profile ProfileConfiguration, instanceLabel string, configDir string, instanceDir string) error {
+	digest, err := prepareTemplate(config, configDir, *profile.Template)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	previous := ""
+	if len(instance.TemplateVersions) > 0 {
+		previous = instance.TemplateVersions[len(instance.TemplateVersions)-1].Version
+	}
+	if previous == digest {
+		return nil
+	}
+
+	logger := ulog.FromContext(ctx)
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	applied := AppliedTemplateVersion{Version: digest}
+	if instance.ProvisionedHash == "" {
+		if err := cloneInstanceFiles(config, getCachedTemplateDir(config, digest), profileDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	} else {
+		base := templateManifest{}
+		if previous != "" {
+			if base, err = readTemplateManifest(config, previous); errors.Is(err, fs.ErrNotExist) {
+				logger.Warn("The previous version of the template is unknown, only adding what's missing", "version", previous)
+			} else if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+		}
+		target, err := readTemplateManifest(config, digest)
+		if err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		if applied.Kept, err = applyTemplateDiff(config, base, target, getCachedTemplateDir(config, digest), profileDir); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+	}
+	logger.Info("Applied template", "version", digest, "previousVersion", previous, "kept", applied.Kept)
+
+	instance, err = GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	applied.Applied = time.Now().UTC()
+	instance.TemplateVersions = append(instance.TemplateVersions, applied)
+	return writeProfileInstance(config, instance)
+}
+
+// applyTemplateDiff updates the files and prefs of a profile directory
+// that the target version of a template changed compared to the base
+// version. Files and prefs that differ from the base version in the
+// profile directory are kept and returned.
+func applyTemplateDiff(config Configuration, base templateManifest, target templateManifest, templateDir string, profileDir string) ([]string, error) {
+	kept := []string{}
+	// getChecksum returns the checksum of a file of the profile
+	// directory, or "" if it doesn't exist, like in a manifest.
+	getChecksum := func(path string) (string, error) {
+		checksum, err := sha256File(filepath.Join(profileDir, path))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return checksum, err
+	}
+
+	strategy := getMutableCloneStrategy(config, profileDir)
+	for _, path := range getSortedKeys(target.Files) {
+		if path == templatePrefsFileName || target.Files[path] == base.Files[path] {
+			continue
+		}
+		checksum, err := getChecksum(path)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if checksum != base.Files[path] {
+			kept = append(kept, path)
+			continue
+		}
+		src := filepath.Join(templateDir, path)
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if err := uio.CloneFile(src, filepath.Join(profileDir, path), info.Mode().Perm(), strategy); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	}
+	for _, path := range getSortedKeys(base.Files) {
+		if _, ok := target.Files[path]; ok || path == templatePrefsFileName {
+			continue
+		}
+		checksum, err := getChecksum(path)
+		if err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+		if checksum == "" {
+			continue
+		}
+		if checksum != base.Files[path] {
+			kept = append(kept, path)
+			continue
+		}
+		if err := os.Remove(filepath.Join(profileDir, path)); err != nil {
+			return nil, uerror.WithStackTrace(err)
+		}
+	}
+
+	keptPrefs, err := applyTemplatePrefsDiff(base.Prefs, target.Prefs, filepath.Join(profileDir, templatePrefsFileName))
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return append(kept, keptPrefs...), nil
+}
+
+// applyTemplatePrefsDiff sets the prefs in a prefs.js that the target
+// version of a template changed compared to the base version and
+// removes those it dropped, unless the prefs.js has another value than
+// the base version. The browser must not be running, since it rewrites
+// its prefs.js when it exits. The prefs that were kept are returned as
+// "prefs.js:<name>".
+func applyTemplatePrefsDiff(base map[string]string, target map[string]string, prefsJSPath string) ([]string, error) {
+	actual, err := readPrefsJSValues(prefsJSPath)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	kept := []string{}
+	changed := []string{}
+	lines := []string{}
+	names := getSortedKeys(target)
+	for name := range base {
+		if _, ok := target[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		targetValue, inTarget := target[name]
+		baseValue, inBase := base[name]
+		if inTarget == inBase && targetValue == baseValue {
+			continue
+		}
+		actualValue, inActual := actual[name]
+		if inActual != inBase || actualValue != baseValue {
+			kept = append(kept, templatePrefsFileName+":"+name)
+			continue
+		}
+		changed = append(changed, name)
+		if inTarget {
+			nameJS, err := marshalJS(name)
+			if err != nil {
+				return nil, uerror.WithStackTrace(err)
+			}
+			lines = append(lines, "user_pref("+nameJS+", "+targetValue+");")
+		}
+	}
+	if len(changed) == 0 {
+		return kept, nil
+	}
+
+	content, err := os.ReadFile(prefsJSPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, uerror.WithStackTrace(err)
+	}
+	updated := []string{}
+	if len(content) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			if !isUserPrefLine(line, changed) {
+				updated = append(updated, line)
+			}
+		}
+	}
+	updated = append(updated, lines...)
+	if err := os.MkdirAll(filepath.Dir(prefsJSPath), uio.FileModeURWXGRWXO); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(prefsJSPath, []byte(strings.Join(updated, "\n")+"\n"), uio.FileModeURWGRWO); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return kept, nil
+}
+
+func getSortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
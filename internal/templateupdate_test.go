@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestApplyTemplateUpdate(t *testing.T) {
+	config, profile, instance, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	templateDir := t.TempDir()
+	profile.Template = &templateDir
+	profileDir := filepath.Join(instanceDir, relativeProfilePath)
+	readFile := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(profileDir, name))
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	writeTemplateForTest(t, templateDir, map[string]string{
+		"prefs.js":  "user_pref(\"a\", 1);\nuser_pref(\"b\", 1);\n",
+		"edited":    "v1",
+		"removed":   "v1",
+		"unchanged": "v1",
+		"updated":   "v1",
+	})
+	ctx := context.Background()
+	assert.NoError(t, syncInstanceIfChanged(ctx, config, profile, instance.InstanceLabel, "", instanceDir, false))
+	seeded, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Len(t, seeded.TemplateVersions, 1)
+
+	// The user changes the instance.
+	assert.NoError(t, os.WriteFile(filepath.Join(profileDir, "edited"), []byte("mine"), uio.FileModeURWGRWO))
+	assert.NoError(t, os.WriteFile(filepath.Join(profileDir, "prefs.js"), []byte("user_pref(\"a\", 1);\nuser_pref(\"b\", 2);\nuser_pref(\"mine\", true);\n"), uio.FileModeURWGRWO))
+
+	assert.NoError(t, os.RemoveAll(templateDir))
+	writeTemplateForTest(t, templateDir, map[string]string{
+		"prefs.js":  "user_pref(\"a\", 3);\nuser_pref(\"b\", 3);\nuser_pref(\"c\", \"new\");\n",
+		"added":     "v2",
+		"edited":    "v2",
+		"unchanged": "v1",
+		"updated":   "v2",
+	})
+	assert.NoError(t, SyncInstance(ctx, config, profile, instance, ""))
+
+	assert.Equal(t, "v2", readFile("added"))
+	assert.Equal(t, "mine", readFile("edited"))
+	assert.NoFileExists(t, filepath.Join(profileDir, "removed"))
+	assert.Equal(t, "v1", readFile("unchanged"))
+	assert.Equal(t, "v2", readFile("updated"))
+	prefs, err := readPrefsJSValues(filepath.Join(profileDir, "prefs.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3", "b": "2", "c": `"new"`, "mine": "true"}, prefs)
+
+	updated, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	if assert.Len(t, updated.TemplateVersions, 2) {
+		assert.Equal(t, seeded.TemplateVersions[0], updated.TemplateVersions[0])
+		assert.Equal(t, []string{"edited", "prefs.js:b"}, updated.TemplateVersions[1].Kept)
+		assert.NotEqual(t, seeded.TemplateVersions[0].Version, updated.TemplateVersions[1].Version)
+	}
+
+	// Syncing again without a new version changes nothing.
+	assert.NoError(t, SyncInstance(ctx, config, profile, instance, ""))
+	again, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Len(t, again.TemplateVersions, 2)
+}
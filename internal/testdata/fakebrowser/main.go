@@ -0,0 +1,87 @@
+// Command fakebrowser stands in for the sandboxed browser in the
+// integration tests. It behaves like Firefox as far as tbml can tell:
+// it locks its profile, stays alive until it is told to exit and
+// exits with a configurable code.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+func main() {
+	profileDir := flag.String("profile", "", "The profile directory to lock")
+	exitCode := flag.Int("exit-code", 0, "The exit code after the lifetime is over")
+	lifetime := flag.Duration("lifetime", 0, "How long to stay alive; zero means until a signal arrives")
+	lockedExitCode := flag.Int("locked-exit-code", 1, "The exit code if the profile is already locked")
+	signalExitCode := flag.Int("signal-exit-code", 0, "The exit code after SIGTERM, SIGINT or SIGHUP")
+	flag.Parse()
+
+	if *profileDir == "" {
+		fmt.Fprintln(os.Stderr, "fakebrowser: -profile is required")
+		os.Exit(2)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	unlock, err := lockProfile(*profileDir)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		fmt.Fprintln(os.Stderr, "fakebrowser: the profile is already in use")
+		os.Exit(*lockedExitCode)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fakebrowser:", err)
+		os.Exit(2)
+	}
+
+	var timeout <-chan time.Time
+	if *lifetime > 0 {
+		timeout = time.After(*lifetime)
+	}
+
+	code := *exitCode
+	select {
+	case <-signals:
+		code = *signalExitCode
+	case <-timeout:
+	}
+
+	unlock()
+	os.Exit(code)
+}
+
+// lockProfile locks the profile the way Firefox does on Linux: It takes
+// a lock on .parentlock and points the "lock" symlink at its PID. The
+// symlink is created last, so once it exists the browser is "running".
+func lockProfile(profileDir string) (unlock func(), err error) {
+	if err := os.MkdirAll(profileDir, 0o775); err != nil {
+		return nil, err
+	}
+	parentLock, err := os.OpenFile(filepath.Join(profileDir, ".parentlock"), os.O_CREATE|os.O_RDWR, 0o664)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(parentLock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		parentLock.Close()
+		return nil, err
+	}
+
+	lockLink := filepath.Join(profileDir, "lock")
+	_ = os.Remove(lockLink)
+	if err := os.Symlink(fmt.Sprintf("127.0.0.1:+%d", os.Getpid()), lockLink); err != nil {
+		parentLock.Close()
+		return nil, err
+	}
+
+	return func() {
+		_ = os.Remove(lockLink)
+		parentLock.Close()
+	}, nil
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultBrowserStartupTimeout = 30 * time.Second
+	defaultDownloadTimeout       = 5 * time.Minute
+	defaultHookTimeout           = time.Minute
+)
+
+// getTimeout returns the timeout set in seconds, or the default if it
+// isn't set.
+func getTimeout(seconds *int, defaultTimeout time.Duration) time.Duration {
+	if seconds == nil {
+		return defaultTimeout
+	}
+	return time.Duration(*seconds) * time.Second
+}
+
+func getTimeoutsConfiguration(config Configuration) TimeoutsConfiguration {
+	if config.Timeouts == nil {
+		return TimeoutsConfiguration{}
+	}
+	return *config.Timeouts
+}
+
+// getBrowserStartupTimeout is how long after a launch a browser is
+// waited for to start listening.
+func getBrowserStartupTimeout(config Configuration) time.Duration {
+	return getTimeout(getTimeoutsConfiguration(config).BrowserStartupSeconds, defaultBrowserStartupTimeout)
+}
+
+// GetDownloadTimeout is how long a single download may take.
+func GetDownloadTimeout(config Configuration) time.Duration {
+	return getTimeout(getTimeoutsConfiguration(config).DownloadSeconds, defaultDownloadTimeout)
+}
+
+// getHookTimeout is how long a single hook may run.
+func getHookTimeout(config Configuration) time.Duration {
+	return getTimeout(getTimeoutsConfiguration(config).HookSeconds, defaultHookTimeout)
+}
+
+func validateTimeouts(timeouts TimeoutsConfiguration) error {
+	for _, seconds := range []*int{timeouts.BrowserStartupSeconds, timeouts.DownloadSeconds, timeouts.HookSeconds} {
+		if seconds != nil && *seconds <= 0 {
+			return errors.New("Timeouts must be positive")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTimeouts(t *testing.T) {
+	config := Configuration{}
+	assert.Equal(t, defaultBrowserStartupTimeout, getBrowserStartupTimeout(config))
+	assert.Equal(t, defaultDownloadTimeout, GetDownloadTimeout(config))
+	assert.Equal(t, defaultHookTimeout, getHookTimeout(config))
+
+	hookSeconds := 5
+	config.Timeouts = &TimeoutsConfiguration{HookSeconds: &hookSeconds}
+	assert.Equal(t, 5*time.Second, getHookTimeout(config))
+	assert.Equal(t, defaultDownloadTimeout, GetDownloadTimeout(config))
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	seconds := 10
+	zero := 0
+	assert.NoError(t, validateTimeouts(TimeoutsConfiguration{}))
+	assert.NoError(t, validateTimeouts(TimeoutsConfiguration{DownloadSeconds: &seconds}))
+	assert.Error(t, validateTimeouts(TimeoutsConfiguration{HookSeconds: &zero}))
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+const (
+	topicHistoryFileName     = "topic-history.json"
+	topicHistoryLockFileName = "topic-history.lock"
+)
+
+// topicSeparator separates the levels of hierarchical topics like
+// "work/projectX/review".
+const topicSeparator = "/"
+
+// topicHistoryHalfLife is how long it takes for a topic's usages to
+// lose half of their weight when ranking topics.
+const topicHistoryHalfLife = 7 * 24 * time.Hour
+
+type TopicHistoryEntry struct {
+	Count    int
+	LastUsed time.Time
+	Topic    string
+}
+
+// RecordTopicUsage adds a usage of the given topic to the topic
+// history. With NormalizeLabels, a topic that only differs in case or
+// encoding counts as a usage of the recorded one.
+func RecordTopicUsage(config Configuration, topic string) error {
+	unlock, err := lockStateFile(config, topicHistoryLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	history, err := GetTopicHistory(config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+
+	found := false
+	for i := range history {
+		if history[i].Topic == topic || config.NormalizeLabels && ustring.NormalizeLabel(history[i].Topic) == ustring.NormalizeLabel(topic) {
+			history[i].Count++
+			history[i].LastUsed = time.Now().UTC()
+			found = true
+			break
+		}
+	}
+	if !found {
+		history = append(history, TopicHistoryEntry{
+			Count:    1,
+			LastUsed: time.Now().UTC(),
+			Topic:    topic,
+		})
+	}
+
+	return writeStateFile(config, topicHistoryFileName, history)
+}
+
+func GetTopicHistory(config Configuration) ([]TopicHistoryEntry, error) {
+	history := []TopicHistoryEntry{}
+	if err := readStateFile(config, topicHistoryFileName, &history); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return history, nil
+}
+
+// GetRankedTopics returns the topics of all running instances,
+// followed by the topics from the topic history, ranked by how often
+// and how recently they were used.
+func GetRankedTopics(config Configuration, instances []ProfileInstance) ([]string, error) {
+	history, err := GetTopicHistory(config)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return rankTopics(GetTopics(instances), history, time.Now()), nil
+}
+
+func rankTopics(runningTopics []string, history []TopicHistoryEntry, now time.Time) []string {
+	ranked := make([]string, 0, len(runningTopics)+len(history))
+	seen := make(map[string]bool)
+	for _, topic := range runningTopics {
+		if !seen[topic] {
+			ranked = append(ranked, topic)
+			seen[topic] = true
+		}
+	}
+
+	score := func(entry TopicHistoryEntry) float64 {
+		age := now.Sub(entry.LastUsed)
+		if age < 0 {
+			age = 0
+		}
+		return float64(entry.Count) * math.Exp2(-float64(age)/float64(topicHistoryHalfLife))
+	}
+	history = append([]TopicHistoryEntry{}, history...)
+	sort.SliceStable(history, func(i, j int) bool {
+		return score(history[i]) > score(history[j])
+	})
+
+	for _, entry := range history {
+		if !seen[entry.Topic] {
+			ranked = append(ranked, entry.Topic)
+			seen[entry.Topic] = true
+		}
+	}
+	return ranked
+}
+
+// getParentTopic returns the topic one level above the given one, or
+// "" for a top-level topic.
+func getParentTopic(topic string) string {
+	i := strings.LastIndex(strings.TrimSuffix(topic, topicSeparator), topicSeparator)
+	if i <= 0 {
+		return ""
+	}
+	return topic[:i]
+}
+
+// TopicNode is a level of the topic hierarchy.
+type TopicNode struct {
+	Children []TopicNode
+	// IsTopic is false for levels that only group other topics.
+	IsTopic bool
+	// Name is the last level of Topic.
+	Name  string
+	Topic string
+}
+
+// GroupTopics arranges topics by their levels, keeping the order in
+// which each group first appears, so ranked topics stay ranked.
+func GroupTopics(topics []string) []TopicNode {
+	return groupTopics(topics, "")
+}
+
+func groupTopics(topics []string, prefix string) []TopicNode {
+	nodes := []TopicNode{}
+	nodeIndexes := map[string]int{}
+	children := map[string][]string{}
+	for _, topic := range topics {
+		if !strings.HasPrefix(topic, prefix) || topic == prefix {
+			continue
+		}
+		name := strings.TrimPrefix(topic, prefix)
+		if i := strings.Index(name, topicSeparator); i > 0 {
+			name = name[:i]
+		}
+		i, ok := nodeIndexes[name]
+		if !ok {
+			i = len(nodes)
+			nodeIndexes[name] = i
+			nodes = append(nodes, TopicNode{Name: name, Topic: prefix + name})
+		}
+		if topic == nodes[i].Topic {
+			nodes[i].IsTopic = true
+		} else {
+			children[name] = append(children[name], topic)
+		}
+	}
+	for i := range nodes {
+		nodes[i].Children = groupTopics(children[nodes[i].Name], nodes[i].Topic+topicSeparator)
+	}
+	return nodes
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordTopicUsage(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	history, err := GetTopicHistory(config)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	assert.NoError(t, RecordTopicUsage(config, "foo"))
+	assert.NoError(t, RecordTopicUsage(config, "bar"))
+	assert.NoError(t, RecordTopicUsage(config, "foo"))
+
+	history, err = GetTopicHistory(config)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "foo", history[0].Topic)
+	assert.Equal(t, 2, history[0].Count)
+	assert.Equal(t, "bar", history[1].Topic)
+	assert.Equal(t, 1, history[1].Count)
+
+	instances, err := GetProfileInstances(config, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+}
+
+func TestRecordTopicUsageConcurrently(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, RecordTopicUsage(config, "foo"))
+		}()
+	}
+	wg.Wait()
+
+	history, err := GetTopicHistory(config)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, 10, history[0].Count)
+	}
+}
+
+func TestRankTopics(t *testing.T) {
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		desc string
+
+		expected      []string
+		history       []TopicHistoryEntry
+		runningTopics []string
+	}{
+		{
+			desc: "Running topics first",
+
+			expected: []string{"running", "history"},
+			history: []TopicHistoryEntry{
+				{Count: 100, LastUsed: now, Topic: "history"},
+				{Count: 1, LastUsed: now, Topic: "running"},
+			},
+			runningTopics: []string{"running"},
+		},
+		{
+			desc: "Frequent topics beat recent topics",
+
+			expected: []string{"frequent", "recent"},
+			history: []TopicHistoryEntry{
+				{Count: 1, LastUsed: now, Topic: "recent"},
+				{Count: 20, LastUsed: now.Add(-14 * 24 * time.Hour), Topic: "frequent"},
+			},
+		},
+		{
+			desc: "Old topics fall behind",
+
+			expected: []string{"recent", "old"},
+			history: []TopicHistoryEntry{
+				{Count: 5, LastUsed: now.Add(-365 * 24 * time.Hour), Topic: "old"},
+				{Count: 2, LastUsed: now.Add(-time.Hour), Topic: "recent"},
+			},
+		},
+		{
+			desc: "Usages lose half their weight per half-life",
+
+			expected: []string{"recent", "older"},
+			history: []TopicHistoryEntry{
+				{Count: 7, LastUsed: now.Add(-2 * topicHistoryHalfLife), Topic: "older"},
+				{Count: 2, LastUsed: now, Topic: "recent"},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, rankTopics(tC.runningTopics, tC.history, now))
+		})
+	}
+}
+
+func TestGetParentTopic(t *testing.T) {
+	assert.Equal(t, "work/projectX", getParentTopic("work/projectX/review"))
+	assert.Equal(t, "work", getParentTopic("work/projectX"))
+	assert.Equal(t, "", getParentTopic("work"))
+	assert.Equal(t, "", getParentTopic("/work"))
+}
+
+func TestGroupTopics(t *testing.T) {
+	topics := []string{"work/projectX/review", "news", "work", "work/projectY", "work/projectX/specs"}
+	assert.Equal(t, []TopicNode{
+		{
+			Children: []TopicNode{
+				{
+					Children: []TopicNode{
+						{IsTopic: true, Name: "review", Topic: "work/projectX/review", Children: []TopicNode{}},
+						{IsTopic: true, Name: "specs", Topic: "work/projectX/specs", Children: []TopicNode{}},
+					},
+					Name:  "projectX",
+					Topic: "work/projectX",
+				},
+				{IsTopic: true, Name: "projectY", Topic: "work/projectY", Children: []TopicNode{}},
+			},
+			IsTopic: true,
+			Name:    "work",
+			Topic:   "work",
+		},
+		{IsTopic: true, Name: "news", Topic: "news", Children: []TopicNode{}},
+	}, GroupTopics(topics))
+}
@@ -0,0 +1,373 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+const (
+	operationLogFileName     = "operations.json"
+	operationLogLockFileName = "operations.lock"
+	// maxLoggedOperations is how many operations can be undone. The
+	// backups of older operations are deleted.
+	maxLoggedOperations = 20
+	// maxOperationAge is how long operations can be undone, so deleted
+	// instances don't keep their browsing data on disk indefinitely.
+	// Expired backups are deleted when an operation is recorded and by
+	// CollectGarbage.
+	maxOperationAge = 7 * 24 * time.Hour
+)
+
+const (
+	OperationDeleteInstance = "delete-instance"
+	OperationEditConfig     = "edit-config"
+)
+
+var ErrNothingToUndo error = errors.New("Nothing to undo")
+
+var ErrCannotUndo error = errors.New("The operation can't be undone")
+
+// Operation is an entry of the undo log.
+type Operation struct {
+	// Backup is what the operation can be undone from: the trashed
+	// instance directory or a copy of the configuration file from
+	// before the edit. It is the only entry of its parent directory in
+	// the state directory, which is deleted along with it.
+	Backup string
+	// Checksum is the SHA-256 sum of the configuration file after the
+	// edit, so later edits aren't overwritten by undoing it.
+	Checksum string `json:",omitempty"`
+	// Kind is OperationDeleteInstance or OperationEditConfig.
+	Kind string
+	// Target is the label of the deleted instance or the edited
+	// configuration file.
+	Target string
+	Time   time.Time
+	// TrashedFiles is where the files of a deleted instance that kept
+	// them outside the profile path were moved. It is next to where
+	// they were, so they don't have to be copied between file systems,
+	// and is deleted along with its parent directory like Backup.
+	TrashedFiles string `json:",omitempty"`
+}
+
+func (o Operation) String() string {
+	switch o.Kind {
+	case OperationDeleteInstance:
+		return fmt.Sprintf("Delete instance %s", o.Target)
+	case OperationEditConfig:
+		return fmt.Sprintf("Edit %s", o.Target)
+	default:
+		return fmt.Sprintf("%s %s", o.Kind, o.Target)
+	}
+}
+
+// removeBackup deletes what the operation could be undone from.
+func (o Operation) removeBackup() error {
+	if o.TrashedFiles != "" {
+		if err := os.RemoveAll(filepath.Dir(o.TrashedFiles)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Dir(o.Backup))
+}
+
+// newBackupDir creates a directory to keep the backup of an operation
+// in. The backup should be stored as name in it.
+func newBackupDir(config Configuration, kind string, name string) (string, error) {
+	backupsDir := filepath.Join(getStateDir(config), kind)
+	if err := os.MkdirAll(backupsDir, uio.FileModeURWXGRWXO); err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	dir, err := os.MkdirTemp(backupsDir, name+"-*")
+	if err != nil {
+		return "", uerror.WithStackTrace(err)
+	}
+	return dir, nil
+}
+
+func (o Operation) isExpired(now time.Time) bool {
+	return now.Sub(o.Time) > maxOperationAge
+}
+
+// recordOperation adds an operation to the undo log, dropping the
+// oldest operations and their backups once the log is full or they
+// expired.
+func recordOperation(config Configuration, operation Operation) error {
+	unlock, err := lockStateFile(config, operationLogLockFileName)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	operations, err := readOperationLog(config)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	operations = append(operations, operation)
+	now := time.Now()
+	for len(operations) > maxLoggedOperations || len(operations) > 0 && operations[0].isExpired(now) {
+		if err := operations[0].removeBackup(); err != nil {
+			return uerror.WithStackTrace(err)
+		}
+		operations = operations[1:]
+	}
+	return writeStateFile(config, operationLogFileName, operations)
+}
+
+// EmptyTrash deletes the instances in the trash for good, so they can't
+// be restored by UndoLastOperation anymore. It returns the deletions
+// that were removed from the undo log and the space that was freed.
+func EmptyTrash(config Configuration, mutations *Mutations) ([]Operation, int64, error) {
+	return removeOperations(config, mutations, func(operation Operation) bool {
+		return operation.Kind == OperationDeleteInstance
+	})
+}
+
+// removeOperations deletes the backups of the operations that match
+// remove and drops them from the undo log. It returns the removed
+// operations and the size of their backups. In dry-run mode, it only
+// returns them.
+func removeOperations(config Configuration, mutations *Mutations, remove func(operation Operation) bool) ([]Operation, int64, error) {
+	unlock, err := lockStateFile(config, operationLogLockFileName)
+	if err != nil {
+		return nil, 0, uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	operations, err := readOperationLog(config)
+	if err != nil {
+		return nil, 0, uerror.WithStackTrace(err)
+	}
+	kept := []Operation{}
+	removed := []Operation{}
+	var size int64
+	for _, operation := range operations {
+		if !remove(operation) {
+			kept = append(kept, operation)
+			continue
+		}
+		operationSize, err := operation.backupSize()
+		if err != nil {
+			return nil, 0, uerror.WithStackTrace(err)
+		}
+		if err := mutations.Apply("Delete backup", filepath.Dir(operation.Backup), operation.removeBackup); err != nil {
+			return nil, 0, uerror.WithStackTrace(err)
+		}
+		removed = append(removed, operation)
+		size += operationSize
+	}
+	if len(kept) == len(operations) || mutations != nil && mutations.DryRun {
+		return removed, size, nil
+	}
+	return removed, size, writeStateFile(config, operationLogFileName, kept)
+}
+
+// backupSize returns the disk usage of what the operation could be
+// undone from.
+func (o Operation) backupSize() (int64, error) {
+	size, err := uio.DirSize(filepath.Dir(o.Backup))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	if o.TrashedFiles == "" {
+		return size, nil
+	}
+	filesSize, err := uio.DirSize(filepath.Dir(o.TrashedFiles))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return size + filesSize, nil
+}
+
+// GetOperationLog returns the operations that can be undone, oldest
+// first.
+func GetOperationLog(config Configuration) ([]Operation, error) {
+	operations, err := readOperationLog(config)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return operations, nil
+}
+
+func readOperationLog(config Configuration) ([]Operation, error) {
+	operations := []Operation{}
+	if err := readStateFile(config, operationLogFileName, &operations); err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return operations, nil
+}
+
+// UndoLastOperation reverts the most recent operation in the undo log.
+// A deleted instance is restored, with the policy deciding what happens
+// if an instance with the same label was created since; the label it
+// was restored under is returned. A configuration edit is reverted
+// unless the file was changed again since. If the operation can't be
+// undone, the error wraps ErrCannotUndo and the operation stays in the
+// log.
+func UndoLastOperation(config Configuration, policy CollisionPolicy, mutations *Mutations) (operation Operation, restoredLabel string, err error) {
+	unlock, err := lockStateFile(config, operationLogLockFileName)
+	if err != nil {
+		return Operation{}, "", uerror.WithStackTrace(err)
+	}
+	defer unlock()
+
+	operations, err := readOperationLog(config)
+	if err != nil {
+		return Operation{}, "", uerror.WithStackTrace(err)
+	}
+	if len(operations) == 0 {
+		return Operation{}, "", uerror.WithStackTrace(ErrNothingToUndo)
+	}
+	operation = operations[len(operations)-1]
+
+	// undo returns an operation to add to the log in place of the
+	// undone one, if undoing it deleted something.
+	var undo func() (*Operation, error)
+	switch operation.Kind {
+	case OperationDeleteInstance:
+		undo, restoredLabel, err = prepareUndoDeleteInstance(config, operation, policy)
+	case OperationEditConfig:
+		undo, err = prepareUndoEditConfig(operation)
+	default:
+		err = fmt.Errorf("%w: unknown operation %s", ErrCannotUndo, operation.Kind)
+	}
+	if err != nil {
+		return Operation{}, "", uerror.WithStackTrace(err)
+	}
+
+	if err := mutations.Apply("Undo", operation.String(), func() error {
+		replacement, err := undo()
+		if err != nil {
+			return err
+		}
+		if err := operation.removeBackup(); err != nil {
+			return err
+		}
+		operations = operations[:len(operations)-1]
+		if replacement != nil {
+			operations = append(operations, *replacement)
+		}
+		return writeStateFile(config, operationLogFileName, operations)
+	}); err != nil {
+		return Operation{}, "", uerror.WithStackTrace(err)
+	}
+	return operation, restoredLabel, nil
+}
+
+func prepareUndoDeleteInstance(config Configuration, operation Operation, policy CollisionPolicy) (func() (*Operation, error), string, error) {
+	label, replaced, err := resolveLabelCollision(config, operation.Target, policy)
+	if errors.Is(err, ErrInstanceExists) {
+		return nil, "", fmt.Errorf("%w: there is a new instance %s", ErrCannotUndo, operation.Target)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return func() (*Operation, error) {
+		// The replaced instance's deletion takes the place of the
+		// undone one in the log, so it can be undone in turn. It
+		// can't be recorded the usual way while the log is locked.
+		var replacement *Operation
+		if replaced != nil {
+			var err error
+			if replacement, err = trashInstance(config, *replaced); err != nil {
+				return nil, err
+			}
+		}
+		if err := restoreTrashedInstance(config, operation, label); err != nil {
+			if replacement != nil {
+				restoreTrashedInstance(config, *replacement, replacement.Target)
+				replacement.removeBackup()
+			}
+			return nil, err
+		}
+		return replacement, nil
+	}, label, nil
+}
+
+// restoreTrashedInstance moves a deleted instance back into the profile
+// path under label. Files it kept outside the profile path are moved
+// back next to where they were, into a directory named after label.
+func restoreTrashedInstance(config Configuration, operation Operation, label string) error {
+	recordDir := getInstanceRecordDir(config, ProfileInstance{InstanceLabel: label})
+	if err := os.Rename(operation.Backup, recordDir); err != nil {
+		return err
+	}
+	invalidateInstanceCache(config)
+	if operation.TrashedFiles == "" {
+		return nil
+	}
+	instance, err := GetProfileInstance(config, label)
+	if err != nil {
+		return err
+	}
+	if instance.Directory == nil {
+		return fmt.Errorf("%s has no directory to restore its files to", label)
+	}
+	directory := filepath.Join(filepath.Dir(*instance.Directory), label)
+	if err := os.Rename(operation.TrashedFiles, directory); err != nil {
+		return err
+	}
+	instance.Directory = &directory
+	return writeProfileInstance(config, instance)
+}
+
+func prepareUndoEditConfig(operation Operation) (func() (*Operation, error), error) {
+	checksum, err := sha256File(operation.Target)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != operation.Checksum {
+		return nil, fmt.Errorf("%w: %s was changed since", ErrCannotUndo, operation.Target)
+	}
+	backup, err := uio.ReadFileLimited(operation.Backup, maxConfigurationSize)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(operation.Target)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Operation, error) {
+		return nil, uio.WriteFileAtomic(operation.Target, backup, info.Mode().Perm())
+	}, nil
+}
+
+// writeConfigFileWithBackup replaces a configuration file, keeping a
+// copy of the old one so the edit can be undone.
+func writeConfigFileWithBackup(config Configuration, configFile string, configBytes []byte, updated []byte, perm os.FileMode) error {
+	backupDir, err := newBackupDir(config, "backups", filepath.Base(configFile))
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	backup := filepath.Join(backupDir, filepath.Base(configFile))
+	if err := os.WriteFile(backup, configBytes, uio.FileModeURWGRWO); err != nil {
+		os.RemoveAll(backupDir)
+		return uerror.WithStackTrace(err)
+	}
+	if err := uio.WriteFileAtomic(configFile, updated, perm); err != nil {
+		os.RemoveAll(backupDir)
+		return uerror.WithStackTrace(err)
+	}
+
+	absConfigFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	checksum := sha256.Sum256(updated)
+	return recordOperation(config, Operation{
+		Backup:   backup,
+		Checksum: hex.EncodeToString(checksum[:]),
+		Kind:     OperationEditConfig,
+		Target:   absConfigFile,
+		Time:     time.Now(),
+	})
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestUndoDeleteInstance(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		recreate      bool
+		policy        CollisionPolicy
+		expectedOK    bool
+		expectedLabel string
+		expectedLog   int
+	}{
+		{desc: "restores the instance", policy: CollisionFail, expectedOK: true, expectedLabel: "test-1"},
+		{desc: "refuses if the label was taken again", recreate: true, policy: CollisionFail},
+		{desc: "adds a suffix if the label was taken again", recreate: true, policy: CollisionSuffix, expectedOK: true, expectedLabel: "test-1-2"},
+		{desc: "replaces the new instance", recreate: true, policy: CollisionReplace, expectedOK: true, expectedLabel: "test-1", expectedLog: 1},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			instance.InstalledExtensions = []string{"old@t0ast.cc"}
+			assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+			assert.NoError(t, DeleteInstance(config, instance, nil))
+			_, err := GetProfileInstance(config, instance.InstanceLabel)
+			assert.Error(t, err)
+			if tC.recreate {
+				recreated := instance
+				recreated.InstalledExtensions = []string{"new@t0ast.cc"}
+				assert.NoError(t, writeProfileInstanceForTest(config, recreated))
+			}
+
+			operation, restoredLabel, err := UndoLastOperation(config, tC.policy, nil)
+			if !tC.expectedOK {
+				assert.ErrorIs(t, err, ErrCannotUndo)
+				operations, err := GetOperationLog(config)
+				assert.NoError(t, err)
+				assert.Len(t, operations, 1)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, OperationDeleteInstance, operation.Kind)
+			assert.Equal(t, tC.expectedLabel, restoredLabel)
+			restored, err := GetProfileInstance(config, restoredLabel)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"old@t0ast.cc"}, restored.InstalledExtensions)
+			operations, err := GetOperationLog(config)
+			assert.NoError(t, err)
+			assert.Len(t, operations, tC.expectedLog)
+		})
+	}
+}
+
+func TestUndoEditConfig(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		editAgain  bool
+		expectedOK bool
+	}{
+		{desc: "restores the old file", expectedOK: true},
+		{desc: "refuses if the file was changed again", editAgain: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			assert.NoError(t, os.WriteFile(configFile, []byte("old"), uio.FileModeURWGRWO))
+
+			assert.NoError(t, writeConfigFileWithBackup(config, configFile, []byte("old"), []byte("new"), uio.FileModeURWGRWO))
+			if tC.editAgain {
+				assert.NoError(t, os.WriteFile(configFile, []byte("newer"), uio.FileModeURWGRWO))
+			}
+
+			_, _, err := UndoLastOperation(config, CollisionFail, nil)
+			actual, readErr := os.ReadFile(configFile)
+			assert.NoError(t, readErr)
+			if !tC.expectedOK {
+				assert.ErrorIs(t, err, ErrCannotUndo)
+				assert.Equal(t, "newer", string(actual))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "old", string(actual))
+		})
+	}
+}
+
+func TestUndoDryRun(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	assert.NoError(t, DeleteInstance(config, instance, nil))
+
+	_, _, err := UndoLastOperation(config, CollisionFail, &Mutations{DryRun: true})
+	assert.NoError(t, err)
+
+	_, err = GetProfileInstance(config, instance.InstanceLabel)
+	assert.Error(t, err)
+	operations, err := GetOperationLog(config)
+	assert.NoError(t, err)
+	assert.Len(t, operations, 1)
+}
+
+func TestRecordOperationTrimsLog(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	backupDirs := []string{}
+	for i := 0; i < maxLoggedOperations+2; i++ {
+		backupDir, err := newBackupDir(config, "backups", "config.json")
+		assert.NoError(t, err)
+		backupDirs = append(backupDirs, backupDir)
+		assert.NoError(t, recordOperation(config, Operation{
+			Backup: filepath.Join(backupDir, "config.json"),
+			Kind:   OperationEditConfig,
+			Target: fmt.Sprintf("config-%d.json", i),
+			Time:   time.Now(),
+		}))
+	}
+
+	operations, err := GetOperationLog(config)
+	assert.NoError(t, err)
+	assert.Len(t, operations, maxLoggedOperations)
+	assert.Equal(t, "config-2.json", operations[0].Target)
+	for i, backupDir := range backupDirs {
+		exists, err := uio.DirExists(backupDir)
+		assert.NoError(t, err)
+		assert.Equal(t, i >= 2, exists, backupDir)
+	}
+}
+
+func TestRecordOperationExpiresOldOperations(t *testing.T) {
+	config, _, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	backupDirs := []string{}
+	for i, age := range []time.Duration{maxOperationAge + time.Hour, 0} {
+		backupDir, err := newBackupDir(config, "backups", "config.json")
+		assert.NoError(t, err)
+		backupDirs = append(backupDirs, backupDir)
+		assert.NoError(t, recordOperation(config, Operation{
+			Backup: filepath.Join(backupDir, "config.json"),
+			Kind:   OperationEditConfig,
+			Target: fmt.Sprintf("config-%d.json", i),
+			Time:   time.Now().Add(-age),
+		}))
+	}
+
+	operations, err := GetOperationLog(config)
+	assert.NoError(t, err)
+	if assert.Len(t, operations, 1) {
+		assert.Equal(t, "config-1.json", operations[0].Target)
+	}
+	assert.NoDirExists(t, backupDirs[0])
+	assert.DirExists(t, backupDirs[1])
+}
+
+func TestEmptyTrash(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+	assert.NoError(t, DeleteInstance(config, instance, nil))
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(configFile, []byte("old"), uio.FileModeURWGRWO))
+	assert.NoError(t, writeConfigFileWithBackup(config, configFile, []byte("old"), []byte("new"), uio.FileModeURWGRWO))
+	operations, err := GetOperationLog(config)
+	assert.NoError(t, err)
+	trashed := operations[0].Backup
+
+	deleted, size, err := EmptyTrash(config, &Mutations{DryRun: true})
+	assert.NoError(t, err)
+	assert.Len(t, deleted, 1)
+	assert.Positive(t, size)
+	assert.DirExists(t, trashed)
+
+	deleted, _, err = EmptyTrash(config, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, deleted, 1) {
+		assert.Equal(t, instance.InstanceLabel, deleted[0].Target)
+	}
+	assert.NoDirExists(t, trashed)
+	operations, err = GetOperationLog(config)
+	assert.NoError(t, err)
+	if assert.Len(t, operations, 1) {
+		assert.Equal(t, OperationEditConfig, operations[0].Kind, "config backups aren't in the trash")
+	}
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	uerror "t0ast.cc/tbml/util/error"
+)
+
+// maxUsageSessions is how many sessions are kept in an instance's
+// metadata, so it stays well below maxInstanceDataSize. Older ones are
+// dropped.
+const maxUsageSessions = 200
+
+// UsageSession is a time the browser of an instance ran.
+type UsageSession struct {
+	// End is nil while the browser runs, or if tbml didn't see it
+	// exit. Start and End are stored in UTC.
+	End   *time.Time
+	Start time.Time
+	Topic *string
+}
+
+// UsageTime is the time spent in the browser for a profile and topic.
+// The JSON field names must stay stable.
+type UsageTime struct {
+	Profile string `json:"profile"`
+	Seconds int64  `json:"seconds"`
+	// Topic is empty for sessions without a topic.
+	Topic string `json:"topic"`
+}
+
+// startUsageSession adds an unfinished session to the instance's
+// metadata and returns the function that finishes it. The instance
+// must be locked by the caller.
+func startUsageSession(config Configuration, instanceLabel string, topic *string) (finish func() error, err error) {
+	start := time.Now().UTC()
+	err = updateUsageSessions(config, instanceLabel, func(sessions []UsageSession) []UsageSession {
+		return append(sessions, UsageSession{Start: start, Topic: topic})
+	})
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return func() error {
+		end := time.Now().UTC()
+		return updateUsageSessions(config, instanceLabel, func(sessions []UsageSession) []UsageSession {
+			for i := range sessions {
+				if sessions[i].End == nil && sessions[i].Start.Equal(start) {
+					sessions[i].End = &end
+				}
+			}
+			return sessions
+		})
+	}, nil
+}
+
+// sessionsInUTC returns a copy of the sessions with their times in
+// UTC, so writing them doesn't change the caller's instance.
+func sessionsInUTC(sessions []UsageSession) []UsageSession {
+	if sessions == nil {
+		return nil
+	}
+	converted := make([]UsageSession, len(sessions))
+	for i, session := range sessions {
+		converted[i] = UsageSession{Start: session.Start.UTC(), Topic: session.Topic}
+		if session.End != nil {
+			end := session.End.UTC()
+			converted[i].End = &end
+		}
+	}
+	return converted
+}
+
+func updateUsageSessions(config Configuration, instanceLabel string, update func(sessions []UsageSession) []UsageSession) error {
+	instance, err := GetProfileInstance(config, instanceLabel)
+	if err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	instance.Sessions = update(instance.Sessions)
+	if len(instance.Sessions) > maxUsageSessions {
+		instance.Sessions = instance.Sessions[len(instance.Sessions)-maxUsageSessions:]
+	}
+	return writeProfileInstance(config, instance)
+}
+
+// GetUsageTime adds up the time spent in the browsers of all instances
+// between from and to, per profile and topic, sorted by profile and
+// topic. A zero from or to leaves that side of the range open.
+// Sessions that tbml didn't see end count until now if the instance is
+// still in use, otherwise until it was last used. Sessions of deleted
+// instances, like ephemeral ones, are gone with their metadata.
+func GetUsageTime(config Configuration, from time.Time, to time.Time, warnings *Warnings) ([]UsageTime, error) {
+	instances, err := GetProfileInstances(config, warnings)
+	if err != nil {
+		return nil, uerror.WithStackTrace(err)
+	}
+	return sumUsageTime(instances, from, to, time.Now()), nil
+}
+
+func sumUsageTime(instances []ProfileInstance, from time.Time, to time.Time, now time.Time) []UsageTime {
+	type usageKey struct {
+		profile string
+		topic   string
+	}
+	durations := map[usageKey]time.Duration{}
+	for _, instance := range instances {
+		for _, session := range instance.Sessions {
+			end := instance.LastUsed
+			if session.End != nil {
+				end = *session.End
+			} else if instance.UsagePID != nil {
+				end = now
+			}
+			start := session.Start
+			if !from.IsZero() && start.Before(from) {
+				start = from
+			}
+			if !to.IsZero() && end.After(to) {
+				end = to
+			}
+			if !end.After(start) {
+				continue
+			}
+			key := usageKey{profile: instance.ProfileLabel}
+			if session.Topic != nil {
+				key.topic = *session.Topic
+			}
+			durations[key] += end.Sub(start)
+		}
+	}
+
+	usage := make([]UsageTime, 0, len(durations))
+	for key, duration := range durations {
+		usage = append(usage, UsageTime{
+			Profile: key.profile,
+			Seconds: int64(duration / time.Second),
+			Topic:   key.topic,
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Profile != usage[j].Profile {
+			return usage[i].Profile < usage[j].Profile
+		}
+		return usage[i].Topic < usage[j].Topic
+	})
+	return usage
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSumUsageTime(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 3, 1, hour, 0, 0, 0, time.UTC)
+	}
+	instances := []ProfileInstance{
+		{
+			LastUsed:     at(12),
+			ProfileLabel: "work",
+			Sessions: []UsageSession{
+				{Start: at(8), End: timePtr(at(10)), Topic: strPtr("mail")},
+				{Start: at(11), Topic: strPtr("mail")},
+			},
+		},
+		{
+			LastUsed:     at(9),
+			ProfileLabel: "work",
+			Sessions: []UsageSession{
+				{Start: at(9), End: timePtr(at(10))},
+			},
+		},
+		{
+			ProfileLabel: "social",
+			UsagePID:     intPtr(1),
+			Sessions: []UsageSession{
+				{Start: at(13)},
+			},
+		},
+	}
+	testCases := []struct {
+		desc string
+
+		expected []UsageTime
+		from     time.Time
+		to       time.Time
+	}{
+		{
+			desc: "Whole history",
+
+			expected: []UsageTime{
+				{Profile: "social", Seconds: 2 * 3600},
+				{Profile: "work", Seconds: 3600},
+				{Profile: "work", Seconds: 3 * 3600, Topic: "mail"},
+			},
+		},
+		{
+			desc: "Range cuts sessions",
+
+			expected: []UsageTime{
+				{Profile: "work", Seconds: 3600},
+				{Profile: "work", Seconds: 3600 + 1800, Topic: "mail"},
+			},
+			from: at(9),
+			to:   at(11).Add(30 * time.Minute),
+		},
+		{
+			desc: "Nothing in range",
+
+			expected: []UsageTime{},
+			from:     at(16),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, sumUsageTime(instances, tC.from, tC.to, at(15)))
+		})
+	}
+}
+
+func TestUsageSessionsAreCapped(t *testing.T) {
+	config, _, instance, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+	assert.NoError(t, writeProfileInstanceForTest(config, instance))
+
+	for i := 0; i <= maxUsageSessions; i++ {
+		finish, err := startUsageSession(config, instance.InstanceLabel, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, finish())
+	}
+
+	instance, err := GetProfileInstance(config, instance.InstanceLabel)
+	assert.NoError(t, err)
+	assert.Len(t, instance.Sessions, maxUsageSessions)
+	for _, session := range instance.Sessions {
+		assert.NotNil(t, session.End)
+	}
+}
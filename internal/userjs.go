@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	uerror "t0ast.cc/tbml/util/error"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+// userJSLayer is a level of settings that make up an instance's
+// user.js: its files, followed by its inline prefs.
+type userJSLayer struct {
+	Files []string
+	Prefs []userPref
+}
+
+// getUserJSLayers returns the layers of an instance's user.js in the
+// order they are written: the global settings, the profile's, and
+// those of the topic and its ancestors, outermost first. Since Firefox
+// applies the last value of a pref, later layers take precedence.
+func getUserJSLayers(config Configuration, profile ProfileConfiguration, topic *string) []userJSLayer {
+	profileFiles := profile.UserJSFiles
+	if profile.UserJSFile != nil {
+		profileFiles = append([]string{*profile.UserJSFile}, profileFiles...)
+	}
+	layers := []userJSLayer{
+		{config.UserJSFiles, getSortedPrefs(config.Prefs)},
+		{profileFiles, getSortedPrefs(profile.Prefs)},
+	}
+	if topic == nil {
+		return layers
+	}
+
+	topics := []string{}
+	for t := *topic; t != ""; t = getParentTopic(t) {
+		topics = append([]string{t}, topics...)
+	}
+	for _, t := range topics {
+		for _, topicConfig := range config.Topics {
+			if topicConfig.Topic == t {
+				layers = append(layers, userJSLayer{topicConfig.UserJSFiles, getSortedPrefs(topicConfig.Prefs)})
+			}
+		}
+	}
+	return layers
+}
+
+// getSortedPrefs turns inline prefs into user prefs sorted by name, so
+// the user.js doesn't depend on the order of the map.
+func getSortedPrefs(prefs map[string]interface{}) []userPref {
+	sorted := make([]userPref, 0, len(prefs))
+	for name, value := range prefs {
+		sorted = append(sorted, userPref{name, value})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// writeUserJS replaces the user.js in profileDir with the contents of
+// the layers, or removes it if the layers are empty. Relative file
+// paths are resolved against configDir, and files may be bundled
+// assets like "builtin:baseline" or downloads in the cache.
+func writeUserJS(config Configuration, layers []userJSLayer, configDir string, profileDir string) error {
+	userJSPath := filepath.Join(profileDir, "user.js")
+	buf := bytes.Buffer{}
+	for _, layer := range layers {
+		for _, name := range layer.Files {
+			content, err := readConfigFile(config, configDir, name)
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			buf.Write(content)
+			if len(content) > 0 && content[len(content)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+		}
+		for _, pref := range layer.Prefs {
+			line, err := formatUserPref(pref)
+			if err != nil {
+				return uerror.WithStackTrace(err)
+			}
+			buf.WriteString(line + "\n")
+		}
+	}
+
+	if buf.Len() == 0 {
+		if err := os.Remove(userJSPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return uerror.WithStackTrace(err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(profileDir, uio.FileModeURWXGRWXO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	// The file is replaced rather than written to, in case it is a
+	// clone of a user.js in the configuration.
+	if err := uio.WriteFileAtomic(userJSPath, buf.Bytes(), uio.FileModeURWGRWO); err != nil {
+		return uerror.WithStackTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+func TestWriteUserJSLayers(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		expectedUserJS string
+		topic          *string
+	}{
+		{
+			desc: "Without topic",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("a", "global file");
+				user_pref("a", "global");
+				user_pref("b", "global");
+				user_pref("b", "profile file");
+				user_pref("c", "profile file");
+				user_pref("c", "profile");
+				user_pref("d", "profile");
+
+			`),
+		},
+		{
+			desc: "Topic without settings",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("a", "global file");
+				user_pref("a", "global");
+				user_pref("b", "global");
+				user_pref("b", "profile file");
+				user_pref("c", "profile file");
+				user_pref("c", "profile");
+				user_pref("d", "profile");
+
+			`),
+			topic: strPtr("personal"),
+		},
+		{
+			desc: "Subtopic",
+
+			expectedUserJS: ustring.TrimIndentation(`
+				user_pref("a", "global file");
+				user_pref("a", "global");
+				user_pref("b", "global");
+				user_pref("b", "profile file");
+				user_pref("c", "profile file");
+				user_pref("c", "profile");
+				user_pref("d", "profile");
+				user_pref("d", "topic file");
+				user_pref("e", "topic file");
+				user_pref("e", "topic");
+				user_pref("e", "subtopic");
+
+			`),
+			topic: strPtr("work/review"),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+			defer cleanUpEnvironment()
+
+			configDir := t.TempDir()
+			files := map[string]string{
+				"global.js":  `user_pref("a", "global file");`,
+				"profile.js": "user_pref(\"b\", \"profile file\");\nuser_pref(\"c\", \"profile file\");\n",
+				"topic.js":   "user_pref(\"d\", \"topic file\");\nuser_pref(\"e\", \"topic file\");\n",
+			}
+			for name, content := range files {
+				assert.NoError(t, os.WriteFile(filepath.Join(configDir, name), []byte(content), uio.FileModeURWGRWO))
+			}
+			config.UserJSFiles = []string{"global.js"}
+			config.Prefs = map[string]interface{}{"b": "global", "a": "global"}
+			config.Topics = []TopicConfiguration{
+				{
+					Prefs: map[string]interface{}{"e": "subtopic"},
+					Topic: "work/review",
+				},
+				{
+					Prefs:       map[string]interface{}{"e": "topic"},
+					Topic:       "work",
+					UserJSFiles: []string{"topic.js"},
+				},
+			}
+			profile.UserJSFiles = []string{"profile.js"}
+			profile.Prefs = map[string]interface{}{"d": "profile", "c": "profile"}
+
+			assert.NoError(t, ensureFiles(config, profile, tC.topic, configDir, instanceDir))
+			userJS, err := os.ReadFile(filepath.Join(instanceDir, relativeProfilePath, "user.js"))
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedUserJS, string(userJS))
+		})
+	}
+}
+
+func TestWriteUserJSRemovesEmpty(t *testing.T) {
+	config, profile, _, instanceDir, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	profile.Prefs = map[string]interface{}{"a": 1}
+	assert.NoError(t, ensureFiles(config, profile, nil, "", instanceDir))
+	assert.FileExists(t, filepath.Join(instanceDir, relativeProfilePath, "user.js"))
+
+	profile.Prefs = nil
+	assert.NoError(t, ensureFiles(config, profile, nil, "", instanceDir))
+	assert.NoFileExists(t, filepath.Join(instanceDir, relativeProfilePath, "user.js"))
+}
+
+func TestProvisioningHashDependsOnTopic(t *testing.T) {
+	config, profile, _, _, cleanUpEnvironment := setUpTestEnvironment(t)
+	defer cleanUpEnvironment()
+
+	withoutTopics, err := getProvisioningHash(config, profile, strPtr("work"), "")
+	assert.NoError(t, err)
+	config.Topics = []TopicConfiguration{
+		{
+			Prefs: map[string]interface{}{"a": true},
+			Topic: "work",
+		},
+	}
+	personal, err := getProvisioningHash(config, profile, strPtr("personal"), "")
+	assert.NoError(t, err)
+	work, err := getProvisioningHash(config, profile, strPtr("work"), "")
+	assert.NoError(t, err)
+
+	assert.Equal(t, withoutTopics, personal)
+	assert.NotEqual(t, personal, work)
+}
@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	uerror "t0ast.cc/tbml/util/error"
+	ulog "t0ast.cc/tbml/util/log"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+var ErrInvalidConfiguration error = errors.New("Invalid configuration")
+
+// ConfigurationProblem is a single problem found by
+// ValidateConfiguration. Field is the path of the offending setting in
+// the same form as unknown setting warnings, e.g. "Profiles.0.UserJSFile".
+type ConfigurationProblem struct {
+	Field   string
+	Message string
+}
+
+func (p ConfigurationProblem) String() string {
+	if p.Field == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Field, p.Message)
+}
+
+// ConfigurationError lists every problem of a configuration. It
+// matches ErrInvalidConfiguration with errors.Is.
+type ConfigurationError struct {
+	// File is the configuration file the problems were found in, if
+	// known.
+	File     string
+	Problems []ConfigurationProblem
+}
+
+func (e ConfigurationError) Error() string {
+	sb := strings.Builder{}
+	sb.WriteString(ErrInvalidConfiguration.Error())
+	if e.File != "" {
+		fmt.Fprintf(&sb, " in %s", e.File)
+	}
+	sb.WriteString(":")
+	for _, problem := range e.Problems {
+		fmt.Fprintf(&sb, "\n  %s", problem)
+	}
+	return sb.String()
+}
+
+func (e ConfigurationError) Is(target error) bool {
+	return target == ErrInvalidConfiguration
+}
+
+// ValidateConfiguration checks a loaded configuration for problems that
+// would otherwise only show up at launch time: missing or duplicate
+// profile labels, labels that can't be used as directory names, a
+// profile path that isn't a directory, empty hooks, files referenced
+// by profiles that don't exist and invalid profile settings. Relative
+// file paths are resolved against configDir. All problems are reported
+// at once in a ConfigurationError.
+func ValidateConfiguration(config Configuration, configDir string) error {
+	problems := []ConfigurationProblem{}
+	report := func(field string, format string, args ...interface{}) {
+		problems = append(problems, ConfigurationProblem{
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if config.ProfilePath == "" {
+		report("ProfilePath", "The profile path is empty")
+	} else if info, err := os.Stat(config.ProfilePath); err == nil && !info.IsDir() {
+		report("ProfilePath", "%s is not a directory", config.ProfilePath)
+	}
+
+	if err := validateCloneStrategy(config.CloneStrategy); err != nil {
+		report("CloneStrategy", "%s", err)
+	}
+
+	if config.ArchiveAfterDays != nil && *config.ArchiveAfterDays < 1 {
+		report("ArchiveAfterDays", "Instances must be unused for at least a day to be archived")
+	}
+	if config.PruneWhere != nil {
+		if _, err := ParseFilter(*config.PruneWhere); err != nil {
+			report("PruneWhere", "%s", uerror.Message(err))
+		}
+	}
+	if config.ExtensionCacheMaxMiB != nil && *config.ExtensionCacheMaxMiB < 1 {
+		report("ExtensionCacheMaxMiB", "The extension cache limit is less than 1 MiB")
+	}
+
+	if err := validateHooks(config.Hooks); err != nil {
+		report("Hooks", "%s", err)
+	}
+	if err := validateTimeouts(getTimeoutsConfiguration(config)); err != nil {
+		report("Timeouts", "%s", err)
+	}
+
+	if config.Log != nil && config.Log.Format != nil {
+		if _, err := ulog.ParseFormat(*config.Log.Format); err != nil {
+			report("Log.Format", "%s", err)
+		}
+	}
+	if config.Log != nil && config.Log.Level != nil {
+		if _, err := ulog.ParseLevel(*config.Log.Level); err != nil {
+			report("Log.Level", "%s", err)
+		}
+	}
+
+	checkFile := func(field string, name string) {
+		reference, err := parseConfigFileReference(name)
+		switch {
+		case err != nil:
+			report(field, "%s", err)
+			return
+		case reference.Asset != "":
+			if _, known := builtinAssets[reference.Asset]; !known {
+				report(field, "Unknown builtin asset %s, known are %s", reference.Asset, strings.Join(GetBuiltinAssetNames(), ", "))
+			}
+			return
+		case reference.URL != "":
+			// Downloads are checked against their checksum when they
+			// are fetched.
+			return
+		}
+		name = resolveLocalConfigFile(configDir, name)
+		info, err := os.Stat(name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			report(field, "%s does not exist", name)
+		case err != nil:
+			report(field, "%s", err)
+		case !info.Mode().IsRegular():
+			report(field, "%s is not a regular file", name)
+		}
+	}
+	// Icons are shown without provisioning an instance, so they can't
+	// be downloaded.
+	checkIcon := func(field string, name string) {
+		if reference, err := parseConfigFileReference(name); err == nil && reference.URL != "" {
+			report(field, "Icons must be local files or bundled assets")
+			return
+		}
+		checkFile(field, name)
+	}
+	for i, userJSFile := range config.UserJSFiles {
+		checkFile(fmt.Sprintf("UserJSFiles.%d", i), userJSFile)
+	}
+	for i, topic := range config.Topics {
+		field := fmt.Sprintf("Topics.%d", i)
+		if strings.TrimSpace(topic.Topic) == "" {
+			report(field+".Topic", "The topic is empty")
+		}
+		if topic.SessionLimitMinutes != nil && *topic.SessionLimitMinutes < 1 {
+			report(field+".SessionLimitMinutes", "The session limit is less than a minute")
+		}
+		if topic.Icon != nil {
+			checkIcon(field+".Icon", *topic.Icon)
+		}
+		for j, userJSFile := range topic.UserJSFiles {
+			checkFile(fmt.Sprintf("%s.UserJSFiles.%d", field, j), userJSFile)
+		}
+	}
+
+	for i, pattern := range config.SensitiveTopics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			report(fmt.Sprintf("SensitiveTopics.%d", i), "Invalid topic pattern %q: %s", pattern, err)
+		}
+	}
+
+	for i, pattern := range config.KnownSSIDs {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			report(fmt.Sprintf("KnownSSIDs.%d", i), "Invalid SSID pattern %q", pattern)
+		}
+	}
+
+	labels := map[string]int{}
+	normalizedLabels := map[string]int{}
+	for i, profile := range config.Profiles {
+		field := fmt.Sprintf("Profiles.%d", i)
+		if err := validateProfileLabel(profile.Label); err != nil {
+			report(field+".Label", "%s", err)
+		} else if first, ok := labels[profile.Label]; ok {
+			report(field+".Label", "Profile %s is already defined in Profiles.%d", profile.Label, first)
+		} else if first, ok := normalizedLabels[ustring.NormalizeLabel(profile.Label)]; ok && config.NormalizeLabels {
+			report(field+".Label", "Profile %s only differs from Profiles.%d in case or encoding", profile.Label, first)
+		} else {
+			labels[profile.Label] = i
+			normalizedLabels[ustring.NormalizeLabel(profile.Label)] = i
+		}
+
+		if profile.UserJSFile != nil {
+			checkFile(field+".UserJSFile", *profile.UserJSFile)
+		}
+		for j, userJSFile := range profile.UserJSFiles {
+			checkFile(fmt.Sprintf("%s.UserJSFiles.%d", field, j), userJSFile)
+		}
+		if profile.UserChromeFile != nil {
+			checkFile(field+".UserChromeFile", *profile.UserChromeFile)
+		}
+		if profile.Icon != nil {
+			checkIcon(field+".Icon", *profile.Icon)
+		}
+		// The template may be on a share that isn't mounted yet, so
+		// it is only checked when it is cached.
+		if profile.Template != nil && !isLocalConfigFile(*profile.Template) {
+			report(field+".Template", "Templates must be local directories")
+		}
+		for j, extensionFile := range profile.ExtensionFiles {
+			checkFile(fmt.Sprintf("%s.ExtensionFiles.%d", field, j), extensionFile)
+		}
+		for j, manifestFile := range profile.NativeMessagingHosts {
+			manifestField := fmt.Sprintf("%s.NativeMessagingHosts.%d", field, j)
+			if !filepath.IsAbs(manifestFile) {
+				manifestFile = filepath.Join(configDir, manifestFile)
+			}
+			if _, err := readNativeMessagingHostName(manifestFile); errors.Is(err, fs.ErrNotExist) {
+				report(manifestField, "%s does not exist", manifestFile)
+			} else if err != nil {
+				report(manifestField, "%s", err)
+			}
+		}
+
+		for _, err := range getProfileSettingsProblems(profile) {
+			report(field, "%s", err)
+		}
+	}
+
+	for i, quietHours := range config.QuietHours {
+		field := fmt.Sprintf("QuietHours.%d", i)
+		if err := validateQuietHours(quietHours); err != nil {
+			report(field, "%s", err)
+		}
+		for j, label := range quietHours.Profiles {
+			if _, ok := labels[label]; !ok {
+				report(fmt.Sprintf("%s.Profiles.%d", field, j), "Profile %q does not exist", label)
+			}
+		}
+	}
+
+	for i, route := range config.Routes {
+		field := fmt.Sprintf("Routes.%d", i)
+		if err := validateRoute(route); err != nil {
+			report(field, "%s", err)
+		}
+		// Routes that deny URLs don't need a profile.
+		if _, ok := labels[route.Profile]; !ok && !(isDenyRoute(route) && route.Profile == "") {
+			report(field+".Profile", "Profile %q does not exist", route.Profile)
+		}
+	}
+
+	if len(problems) > 0 {
+		return ConfigurationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateProfileLabel checks that a label can be used in the names of
+// instance directories.
+func validateProfileLabel(label string) error {
+	switch {
+	case label == "":
+		return errors.New("The profile has no label")
+	case strings.ContainsAny(label, "/\\\x00"):
+		return fmt.Errorf("Profile label %q contains a character that can't be used in directory names", label)
+	case isReservedProfilePathEntry(label):
+		return fmt.Errorf("Profile label %q must not start with a dot", label)
+	}
+	return nil
+}
+
+// getProfileSettingsProblems checks the settings of a profile that
+// don't depend on files.
+func getProfileSettingsProblems(profile ProfileConfiguration) []error {
+	problems := []error{}
+	// Generating the prefs checks all pref-related settings, so
+	// errors show up on load instead of at launch time.
+	if _, err := getProfilePrefs(profile); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateBrowserSettings(profile); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateSandboxSettings(profile); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateEncryptionSettings(profile); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateHooks(profile.Hooks); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validatePreflightChecks(profile.PreflightChecks); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateNetworkCondition(profile.Network); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateNetworkCondition(profile.PreferredNetwork); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateExtensionSources(profile); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateExtensionPolicy(profile); err != nil {
+		problems = append(problems, err)
+	}
+	if profile.DefaultTopic != nil && strings.TrimSpace(*profile.DefaultTopic) == "" {
+		problems = append(problems, errors.New("The default topic is empty"))
+	}
+	if profile.DownloadDir != nil {
+		if err := validateDownloadDir(*profile.DownloadDir); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if profile.LaunchCooldownSeconds != nil && *profile.LaunchCooldownSeconds < 0 {
+		problems = append(problems, errors.New("The launch cooldown is negative"))
+	}
+	if profile.MaxInstances != nil && *profile.MaxInstances < 1 {
+		problems = append(problems, errors.New("The instance limit is less than one"))
+	}
+	if profile.InstanceLimitPolicy != nil {
+		if _, err := ParseInstanceLimitPolicy(*profile.InstanceLimitPolicy); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if profile.MaxMemoryMiB != nil && *profile.MaxMemoryMiB < 1 {
+		problems = append(problems, errors.New("The memory limit is less than 1 MiB"))
+	}
+	if _, _, err := getMaxMemory(profile); err != nil {
+		problems = append(problems, err)
+	}
+	return problems
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestValidateConfiguration(t *testing.T) {
+	configDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "user.js"), nil, uio.FileModeURWGRWO))
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "not-a-dir"), nil, uio.FileModeURWGRWO))
+	userJSFile := "user.js"
+	missingFile := "missing.css"
+	unknownSandbox := &SandboxConfiguration{Type: "chroot"}
+	hostPattern := "*.example.com"
+	badRegex := "("
+	emptyTopic := " "
+	badLogLevel := "verbose"
+	negativeCooldown := -1
+	noInstances := 0
+	badLimitPolicy := "lru"
+	badFilter := "age > 30"
+
+	testCases := []struct {
+		desc string
+
+		config           Configuration
+		expectedProblems []ConfigurationProblem
+	}{
+		{
+			desc: "Valid",
+
+			config: Configuration{
+				ProfilePath: filepath.Join(configDir, "profiles"),
+				Profiles: []ProfileConfiguration{
+					{Label: "work", UserJSFile: &userJSFile},
+					{Label: "private"},
+				},
+			},
+		},
+		{
+			desc: "Labels that only differ in case",
+
+			config: Configuration{
+				NormalizeLabels: true,
+				ProfilePath:     filepath.Join(configDir, "profiles"),
+				Profiles: []ProfileConfiguration{
+					{Label: "work"},
+					{Label: "Work"},
+				},
+			},
+			expectedProblems: []ConfigurationProblem{
+				{Field: "Profiles.1.Label", Message: "Profile Work only differs from Profiles.0 in case or encoding"},
+			},
+		},
+		{
+			desc: "Every problem",
+
+			config: Configuration{
+				CloneStrategy: "symlink",
+				Log:           &LogConfiguration{Level: &badLogLevel},
+				ProfilePath:   filepath.Join(configDir, "not-a-dir"),
+				PruneWhere:    &badFilter,
+				Profiles: []ProfileConfiguration{
+					{Label: "work"},
+					{Label: "work", UserChromeFile: &missingFile},
+					{Label: ""},
+					{Label: "a/b", ExtensionFiles: []string{"user.js", "foo.xpi"}},
+					{Label: ".hidden", Sandbox: unknownSandbox},
+					{Label: "mail", DefaultTopic: &emptyTopic},
+					{Label: "news", LaunchCooldownSeconds: &negativeCooldown},
+					{Label: "shop", MaxInstances: &noInstances, InstanceLimitPolicy: &badLimitPolicy},
+					{Label: "video", MaxMemoryMiB: &noInstances, MaxMemoryPolicy: &badLimitPolicy},
+				},
+				Routes: []RouteConfiguration{
+					{Host: &hostPattern, Profile: "work"},
+					{Regex: &badRegex, Profile: "unknown"},
+					{Profile: "work"},
+				},
+			},
+			expectedProblems: []ConfigurationProblem{
+				{Field: "ProfilePath", Message: filepath.Join(configDir, "not-a-dir") + " is not a directory"},
+				{Field: "CloneStrategy", Message: "Invalid clone strategy: symlink"},
+				{Field: "PruneWhere", Message: "Invalid filter at column 7: can't compare a duration to a number, durations need a unit like 30d"},
+				{Field: "Log.Level", Message: "Invalid log level: verbose"},
+				{Field: "Profiles.1.Label", Message: "Profile work is already defined in Profiles.0"},
+				{Field: "Profiles.1.UserChromeFile", Message: filepath.Join(configDir, "missing.css") + " does not exist"},
+				{Field: "Profiles.2.Label", Message: "The profile has no label"},
+				{Field: "Profiles.3.Label", Message: `Profile label "a/b" contains a character that can't be used in directory names`},
+				{Field: "Profiles.3.ExtensionFiles.1", Message: filepath.Join(configDir, "foo.xpi") + " does not exist"},
+				{Field: "Profiles.4.Label", Message: `Profile label ".hidden" must not start with a dot`},
+				{Field: "Profiles.4", Message: "Unknown sandbox type chroot"},
+				{Field: "Profiles.5", Message: "The default topic is empty"},
+				{Field: "Profiles.6", Message: "The launch cooldown is negative"},
+				{Field: "Profiles.7", Message: "The instance limit is less than one"},
+				{Field: "Profiles.7", Message: "Invalid instance limit policy: lru"},
+				{Field: "Profiles.8", Message: "The memory limit is less than 1 MiB"},
+				{Field: "Profiles.8", Message: "Invalid max memory policy: lru"},
+				{Field: "Routes.1", Message: "Invalid regex \"(\": error parsing regexp: missing closing ): `(`"},
+				{Field: "Routes.1.Profile", Message: `Profile "unknown" does not exist`},
+				{Field: "Routes.2", Message: "The route must have exactly one of a host pattern, a list or a regex"},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := ValidateConfiguration(tC.config, configDir)
+			if len(tC.expectedProblems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidConfiguration)
+			configErr, ok := err.(ConfigurationError)
+			if assert.True(t, ok) {
+				assert.Equal(t, tC.expectedProblems, configErr.Problems)
+			}
+		})
+	}
+}
+
+func TestValidateProfileLabel(t *testing.T) {
+	assert.NoError(t, validateProfileLabel("work"))
+	assert.NoError(t, validateProfileLabel("work-2"))
+	for _, label := range []string{"", "a/b", `a\b`, "a\x00b", ".hidden"} {
+		assert.Error(t, validateProfileLabel(label), "%q", label)
+	}
+}
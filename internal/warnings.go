@@ -0,0 +1,66 @@
+package internal
+
+import "fmt"
+
+// Warning describes a problem that didn't keep an operation from
+// completing, like a skipped instance or an unknown config setting.
+type Warning struct {
+	// Deprecation is set for warnings about deprecated settings.
+	Deprecation *Deprecation
+	Message     string
+	// Source names what the warning is about, e.g. a file or an
+	// instance label.
+	Source string
+}
+
+func (w Warning) String() string {
+	if w.Source == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("%s: %s", w.Source, w.Message)
+}
+
+// Warnings collects the warnings of one or more operations. Functions
+// accepting a *Warnings also accept nil, in which case warnings are
+// discarded.
+type Warnings struct {
+	// OnWarning, if set, is called for every warning as it is added,
+	// e.g. to show it right away during a long-running operation.
+	OnWarning func(Warning)
+
+	list []Warning
+}
+
+func (w *Warnings) Add(source string, format string, args ...interface{}) {
+	w.add(Warning{
+		Message: fmt.Sprintf(format, args...),
+		Source:  source,
+	})
+}
+
+// addDeprecation warns about a deprecated setting in a configuration
+// file.
+func (w *Warnings) addDeprecation(configFile string, deprecation Deprecation) {
+	w.add(Warning{
+		Deprecation: &deprecation,
+		Message:     fmt.Sprintf("%s is deprecated, use %s instead (\"tbml config migrate\" replaces it)", deprecation.Setting, deprecation.Replacement),
+		Source:      configFile,
+	})
+}
+
+func (w *Warnings) add(warning Warning) {
+	if w == nil {
+		return
+	}
+	w.list = append(w.list, warning)
+	if w.OnWarning != nil {
+		w.OnWarning(warning)
+	}
+}
+
+func (w *Warnings) List() []Warning {
+	if w == nil {
+		return nil
+	}
+	return w.list
+}
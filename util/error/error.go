@@ -85,6 +85,16 @@ func hasStackTrace(err error) bool {
 	return false
 }
 
+// Message returns the message of an error without the stack trace
+// attached by WithStackTrace, for places where the error is shown to
+// the user but doesn't end the program.
+func Message(err error) string {
+	if err, ok := err.(ErrorWithStackTrace); ok {
+		return err.Wrapped.Error()
+	}
+	return err.Error()
+}
+
 func StackTracef(format string, a ...interface{}) error {
 	return WithStackTrace(fmt.Errorf(format, a...))
 }
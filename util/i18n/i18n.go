@@ -0,0 +1,86 @@
+package i18n
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Catalog maps language codes (e.g. "de") to translations of messages.
+// Messages are keyed by their English format string, so English needs
+// no entry and untranslated messages fall back to English.
+type Catalog map[string]map[string]string
+
+// Printer formats messages in one language.
+type Printer struct {
+	catalog  Catalog
+	language string
+}
+
+func NewPrinter(catalog Catalog, language string) *Printer {
+	return &Printer{
+		catalog:  catalog,
+		language: language,
+	}
+}
+
+// Language returns the language this printer translates to.
+func (p *Printer) Language() string {
+	if p == nil {
+		return "en"
+	}
+	return p.language
+}
+
+// Sprintf translates a format string and formats it like fmt.Sprintf.
+// A nil printer formats the English message.
+func (p *Printer) Sprintf(format string, a ...interface{}) string {
+	if p != nil {
+		if translated, ok := p.catalog[p.language][format]; ok {
+			format = translated
+		}
+	}
+	return fmt.Sprintf(format, a...)
+}
+
+// Errorf is like fmt.Errorf with a translated format string.
+func (p *Printer) Errorf(format string, a ...interface{}) error {
+	if p != nil {
+		if translated, ok := p.catalog[p.language][format]; ok {
+			format = translated
+		}
+	}
+	return fmt.Errorf(format, a...)
+}
+
+// DetectLanguage determines the language for messages from the
+// environment the same way gettext does: LC_ALL, then LC_MESSAGES,
+// then LANG. The result is a language code like "de", or "en" if no
+// locale is set.
+func DetectLanguage() string {
+	return detectLanguage(os.Getenv)
+}
+
+func detectLanguage(getenv func(string) string) string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := getenv(name)
+		if locale == "" {
+			continue
+		}
+		return parseLanguage(locale)
+	}
+	return "en"
+}
+
+// parseLanguage extracts the language from a POSIX locale name like
+// "de_AT.UTF-8@euro".
+func parseLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "_.@"); i >= 0 {
+		locale = locale[:i]
+	}
+	locale = strings.ToLower(locale)
+	if locale == "" || locale == "c" || locale == "posix" {
+		return "en"
+	}
+	return locale
+}
@@ -0,0 +1,87 @@
+package i18n
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testCatalog = Catalog{
+	"de": {
+		"Profile %s does not exist": "Profil %s existiert nicht",
+	},
+}
+
+func TestSprintf(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		args     []interface{}
+		expected string
+		format   string
+		printer  *Printer
+	}{
+		{
+			desc:     "translated",
+			args:     []interface{}{"work"},
+			expected: "Profil work existiert nicht",
+			format:   "Profile %s does not exist",
+			printer:  NewPrinter(testCatalog, "de"),
+		},
+		{
+			desc:     "untranslated message",
+			expected: "No topic selected",
+			format:   "No topic selected",
+			printer:  NewPrinter(testCatalog, "de"),
+		},
+		{
+			desc:     "unknown language",
+			args:     []interface{}{"work"},
+			expected: "Profile work does not exist",
+			format:   "Profile %s does not exist",
+			printer:  NewPrinter(testCatalog, "fr"),
+		},
+		{
+			desc:     "nil printer",
+			args:     []interface{}{"work"},
+			expected: "Profile work does not exist",
+			format:   "Profile %s does not exist",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, tC.printer.Sprintf(tC.format, tC.args...))
+		})
+	}
+}
+
+func TestErrorf(t *testing.T) {
+	cause := errors.New("cause")
+	err := NewPrinter(testCatalog, "de").Errorf("Profile %s does not exist: %w", "work", cause)
+	assert.ErrorIs(t, err, cause)
+}
+
+func TestDetectLanguage(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		env      map[string]string
+		expected string
+	}{
+		{desc: "nothing set", env: map[string]string{}, expected: "en"},
+		{desc: "LANG", env: map[string]string{"LANG": "de_DE.UTF-8"}, expected: "de"},
+		{desc: "LC_MESSAGES over LANG", env: map[string]string{"LANG": "de_DE.UTF-8", "LC_MESSAGES": "fr_FR"}, expected: "fr"},
+		{desc: "LC_ALL over everything", env: map[string]string{"LC_ALL": "nl", "LC_MESSAGES": "fr_FR"}, expected: "nl"},
+		{desc: "C locale", env: map[string]string{"LANG": "C.UTF-8"}, expected: "en"},
+		{desc: "modifier", env: map[string]string{"LANG": "de_AT@euro"}, expected: "de"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			actual := detectLanguage(func(name string) string {
+				return tC.env[name]
+			})
+			assert.Equal(t, tC.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package io
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var ErrInvalidCloneStrategy error = errors.New("Invalid clone strategy")
+
+// CloneStrategy is how CloneFile duplicates a file.
+type CloneStrategy string
+
+const (
+	// CloneCopy copies the file's contents.
+	CloneCopy CloneStrategy = "copy"
+	// CloneReflink makes a copy-on-write clone that shares the
+	// contents with the original until either is changed. This needs
+	// a file system like btrfs or XFS.
+	CloneReflink CloneStrategy = "reflink"
+	// CloneHardlink links the original, so changes to either show up
+	// in both. It must only be used for files that are never changed.
+	CloneHardlink CloneStrategy = "hardlink"
+)
+
+func ParseCloneStrategy(s string) (CloneStrategy, error) {
+	switch strategy := CloneStrategy(s); strategy {
+	case CloneCopy, CloneReflink, CloneHardlink:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidCloneStrategy, s)
+}
+
+// ficlone is the FICLONE ioctl from linux/fs.h.
+const ficlone = 0x40049409
+
+// CloneFile puts a duplicate of src at dst, replacing dst. Unless it
+// is hard-linked, dst gets the permissions perm. Where the strategy
+// isn't supported, e.g. hard links across file systems or reflinks on
+// ext4, hard links fall back to reflinks and reflinks to copies.
+func CloneFile(src, dst string, perm os.FileMode, strategy CloneStrategy) error {
+	if err := os.MkdirAll(filepath.Dir(dst), FileModeURWXGRWXO); err != nil {
+		return err
+	}
+
+	if strategy == CloneHardlink {
+		if srcInfo, err := os.Stat(src); err == nil {
+			if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+				return nil
+			}
+		}
+		if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+		strategy = CloneReflink
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	// A hard link left by an earlier clone must be replaced instead of
+	// written through.
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if strategy == CloneReflink {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dstFile.Fd(), ficlone, srcFile.Fd())
+		if errno == 0 {
+			return dstFile.Close()
+		}
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	return dstFile.Close()
+}
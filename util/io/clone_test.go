@@ -0,0 +1,106 @@
+package io_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestCloneFile(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		strategy   uio.CloneStrategy
+		expectLink bool
+	}{
+		{
+			desc: "copy",
+
+			strategy: uio.CloneCopy,
+		},
+		{
+			desc: "reflink, or copy where unsupported",
+
+			strategy: uio.CloneReflink,
+		},
+		{
+			desc: "hardlink",
+
+			strategy:   uio.CloneHardlink,
+			expectLink: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src.xpi")
+			dst := filepath.Join(dir, "instance", "extensions", "dst.xpi")
+			assert.NoError(t, os.WriteFile(src, []byte("xpi"), uio.FileModeURWGRWO))
+			assert.NoError(t, os.MkdirAll(filepath.Dir(dst), uio.FileModeURWXGRWXO))
+			assert.NoError(t, os.WriteFile(dst, []byte("old"), uio.FileModeURWGRWO))
+
+			// Cloning twice replaces the first clone.
+			assert.NoError(t, uio.CloneFile(src, dst, uio.FileModeURWGRWO, tC.strategy))
+			assert.NoError(t, uio.CloneFile(src, dst, uio.FileModeURWGRWO, tC.strategy))
+
+			content, err := os.ReadFile(dst)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("xpi"), content)
+			srcInfo, err := os.Stat(src)
+			assert.NoError(t, err)
+			dstInfo, err := os.Stat(dst)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectLink, os.SameFile(srcInfo, dstInfo))
+
+			if !tC.expectLink {
+				assert.NoError(t, os.WriteFile(dst, []byte("changed"), uio.FileModeURWGRWO))
+				content, err := os.ReadFile(src)
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("xpi"), content)
+			}
+		})
+	}
+}
+
+func TestParseCloneStrategy(t *testing.T) {
+	strategy, err := uio.ParseCloneStrategy("reflink")
+	assert.NoError(t, err)
+	assert.Equal(t, uio.CloneReflink, strategy)
+
+	_, err = uio.ParseCloneStrategy("symlink")
+	assert.ErrorIs(t, err, uio.ErrInvalidCloneStrategy)
+}
+
+// BenchmarkCloneDir compares the strategies on a tree like a seed
+// profile. Reflinks only beat copies on file systems that support
+// them, like btrfs and XFS; run with TMPDIR on one of those.
+func BenchmarkCloneDir(b *testing.B) {
+	const (
+		files    = 200
+		fileSize = 64 << 10
+	)
+	srcDir := b.TempDir()
+	content := make([]byte, fileSize)
+	for i := 0; i < files; i++ {
+		if err := os.WriteFile(filepath.Join(srcDir, fmt.Sprintf("file-%d", i)), content, uio.FileModeURWGRWO); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, strategy := range []uio.CloneStrategy{uio.CloneCopy, uio.CloneReflink, uio.CloneHardlink} {
+		b.Run(string(strategy), func(b *testing.B) {
+			dstDir := b.TempDir()
+			b.SetBytes(files * fileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := uio.CloneDir(srcDir, filepath.Join(dstDir, fmt.Sprint(i)), strategy); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
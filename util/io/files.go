@@ -2,11 +2,14 @@ package io
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 // FileModeURWGRWO is the bitmask for the Unix permission flags
@@ -17,6 +20,52 @@ var FileModeURWGRWO os.FileMode = 0660
 // `u=rwx,g=rwx,o=`.
 var FileModeURWXGRWXO os.FileMode = 0770
 
+// ErrFileTooLarge is returned by ReadFileLimited for files exceeding
+// the limit.
+var ErrFileTooLarge error = errors.New("File too large")
+
+// ReadFileLimited reads a file like os.ReadFile, but fails with
+// ErrFileTooLarge instead of reading more than limit bytes.
+func ReadFileLimited(name string, limit int64) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrFileTooLarge, name, limit)
+	}
+	return content, nil
+}
+
+// WriteFileAtomic writes a file like os.WriteFile, but through a
+// temporary file that is renamed to name once it is complete, so
+// readers never see a partially written file.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), name)
+}
+
 // DirExists returns if a directory exists at the given path, following symlinks.
 func DirExists(name string) (bool, error) {
 	stat, err := os.Stat(name)
@@ -29,6 +78,30 @@ func DirExists(name string) (bool, error) {
 	return stat.IsDir(), nil
 }
 
+// IsWritable returns if files can be created at the given path, i.e.
+// if the path or, if it doesn't exist yet, its closest existing parent
+// is writable. This is false for read-only mounts, like a home
+// directory in some containers.
+func IsWritable(name string) (bool, error) {
+	for {
+		err := syscall.Access(name, 0x2) // W_OK
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			if errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS) {
+				return false, nil
+			}
+			return false, err
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return false, nil
+		}
+		name = parent
+	}
+}
+
 // FileExists returns if a file exists at the given path, following symlinks.
 func FileExists(name string) (bool, error) {
 	stat, err := os.Stat(name)
@@ -70,6 +143,69 @@ func CopyFile(src, dst string) error {
 // CopyDir copies all files in the `src` directroy into `dst`,
 // preserving permissions.
 func CopyDir(src, dst string) error {
+	return CloneDir(src, dst, CloneCopy)
+}
+
+// CloneDirConcurrently is like CloneDir, but clones up to workers files
+// at once, which pays off for copies. Directories are created before
+// the files in them are cloned.
+func CloneDirConcurrently(src, dst string, strategy CloneStrategy, workers int) error {
+	type cloneJob struct {
+		src, dst string
+		perm     os.FileMode
+	}
+	jobs := make(chan cloneJob)
+	errs := make(chan error, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := CloneFile(job.src, job.dst, job.perm, strategy); err != nil {
+					errs <- err
+					// Drain the remaining jobs so the walk isn't
+					// blocked.
+					for range jobs {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	walkErr := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case err := <-errs:
+			return err
+		default:
+		}
+		dstPath := filepath.Join(dst, strings.TrimPrefix(strings.TrimPrefix(path, src), "/"))
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(dstPath, fileInfo.Mode())
+		}
+		jobs <- cloneJob{src: path, dst: dstPath, perm: fileInfo.Mode().Perm()}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	if walkErr != nil {
+		return walkErr
+	}
+	return <-errs
+}
+
+// CloneDir duplicates all files in the `src` directory into `dst` with
+// CloneFile, preserving permissions.
+func CloneDir(src, dst string, strategy CloneStrategy) error {
 	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -85,26 +221,9 @@ func CopyDir(src, dst string) error {
 			if err := os.MkdirAll(dstPath, fileInfo.Mode()); err != nil {
 				return err
 			}
-		} else if err := copyDirFile(path, dstPath, fileInfo); err != nil {
+		} else if err := CloneFile(path, dstPath, fileInfo.Mode().Perm(), strategy); err != nil {
 			return err
 		}
 		return nil
 	})
 }
-
-func copyDirFile(path, dst string, fileInfo fs.FileInfo) error {
-	srcFile, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileInfo.Mode())
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return err
-	}
-	return nil
-}
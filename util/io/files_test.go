@@ -1,6 +1,7 @@
 package io_test
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -84,3 +85,101 @@ func TestCopyDir(t *testing.T) {
 	dir2 := readTestDir(t, "dir-2")
 	assert.Equal(t, dir1Before, dir2)
 }
+
+func TestCloneDirConcurrently(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "dst")
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(src, fmt.Sprintf("dir-%d", i%3), fmt.Sprintf("file-%d", i))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), uio.FileModeURWXGRWXO))
+		assert.NoError(t, os.WriteFile(path, []byte(path), uio.FileModeURWGRWO))
+	}
+
+	assert.NoError(t, uio.CloneDirConcurrently(src, dst, uio.CloneCopy, 4))
+	for i := 0; i < 20; i++ {
+		rel := filepath.Join(fmt.Sprintf("dir-%d", i%3), fmt.Sprintf("file-%d", i))
+		content, err := os.ReadFile(filepath.Join(dst, rel))
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(src, rel), string(content))
+	}
+
+	assert.Error(t, uio.CloneDirConcurrently(filepath.Join(src, "nonexistent"), dst, uio.CloneCopy, 4))
+}
+
+func TestReadFileLimited(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "tbml-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "file")
+	assert.NoError(t, os.WriteFile(path, []byte("12345"), uio.FileModeURWGRWO))
+
+	content, err := uio.ReadFileLimited(path, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("12345"), content)
+
+	_, err = uio.ReadFileLimited(path, 4)
+	assert.ErrorIs(t, err, uio.ErrFileTooLarge)
+
+	_, err = uio.ReadFileLimited(filepath.Join(tmpDir, "nonexistent"), 5)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "tbml-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "file")
+
+	assert.NoError(t, uio.WriteFileAtomic(path, []byte("first"), uio.FileModeURWGRWO))
+	assert.NoError(t, uio.WriteFileAtomic(path, []byte("second"), uio.FileModeURWGRWO))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), content)
+	stat, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uio.FileModeURWGRWO, stat.Mode().Perm())
+
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestIsWritable(t *testing.T) {
+	dir := t.TempDir()
+	readOnlyDir := filepath.Join(dir, "read-only")
+	assert.NoError(t, os.Mkdir(readOnlyDir, 0555))
+	defer os.Chmod(readOnlyDir, 0755)
+
+	testCases := []struct {
+		desc string
+
+		path     string
+		expected bool
+	}{
+		{
+			desc: "existing directory",
+
+			path:     dir,
+			expected: true,
+		},
+		{
+			desc: "missing directory in writable parent",
+
+			path:     filepath.Join(dir, "a", "b"),
+			expected: true,
+		},
+		{
+			desc: "missing directory in read-only parent",
+
+			path:     filepath.Join(readOnlyDir, "a"),
+			expected: os.Geteuid() == 0,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			writable, err := uio.IsWritable(tC.path)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expected, writable)
+		})
+	}
+}
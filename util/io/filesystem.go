@@ -0,0 +1,71 @@
+package io
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileSystemNames maps the magic numbers statfs reports, from
+// linux/magic.h, to the names used in /proc/filesystems.
+var fileSystemNames = map[int64]string{
+	0x9123683e: "btrfs",
+	0xff534d42: "cifs",
+	0x0000ef53: "ext4",
+	0x65735546: "fuse",
+	0x00006969: "nfs",
+	0x794c7630: "overlay",
+	0xfe534d42: "smb2",
+	0x01021994: "tmpfs",
+	0x58465342: "xfs",
+	0x2fc12fc1: "zfs",
+}
+
+// GetFileSystemType returns the name of the file system the path is
+// on, e.g. "btrfs", or its magic number in hex if it is unknown. ext2
+// and ext3 share ext4's magic number and are reported as "ext4".
+func GetFileSystemType(path string) (string, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", err
+	}
+	magic := int64(stat.Type) & 0xffffffff
+	if name, ok := fileSystemNames[magic]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("0x%x", magic), nil
+}
+
+// SupportsReflinks tells whether files in dir can be cloned
+// copy-on-write, see CloneReflink. It tries so with a scratch file.
+func SupportsReflinks(dir string) (bool, error) {
+	srcFile, err := os.CreateTemp(dir, ".reflink-probe-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(srcFile.Name())
+	defer srcFile.Close()
+	if _, err := srcFile.Write([]byte("reflink probe")); err != nil {
+		return false, err
+	}
+
+	dstFile, err := os.CreateTemp(dir, ".reflink-probe-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(dstFile.Name())
+	defer dstFile.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dstFile.Fd(), ficlone, srcFile.Fd())
+	return errno == 0, nil
+}
+
+// GetFreeSpace returns how many bytes unprivileged users can still
+// write to the file system the path is on.
+func GetFreeSpace(path string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
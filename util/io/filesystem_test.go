@@ -0,0 +1,29 @@
+package io_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestGetFileSystemType(t *testing.T) {
+	fsType, err := uio.GetFileSystemType(os.TempDir())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, fsType)
+
+	_, err = uio.GetFileSystemType("/does/not/exist")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSupportsReflinks(t *testing.T) {
+	dir := t.TempDir()
+	// Whether reflinks work depends on the file system TMPDIR is on,
+	// but the probe must not fail or leave files behind either way.
+	_, err := uio.SupportsReflinks(dir)
+	assert.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,102 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// mozLz4Magic starts the files Firefox compresses with LZ4, like its
+// session store.
+var mozLz4Magic = []byte("mozLz40\x00")
+
+var ErrInvalidMozLz4 error = errors.New("Invalid mozlz4 data")
+
+// lz4MaxExpansion is how many times larger than an LZ4 block its
+// decompressed data can be at most, since a length byte of 255 adds
+// 255 bytes to a match.
+const lz4MaxExpansion = 255
+
+// DecodeMozLz4 decompresses the contents of a mozlz4 file like
+// sessionstore.jsonlz4. They consist of a magic number, the size of
+// the decompressed data as a little-endian uint32 and a single LZ4
+// block. The size is checked against the block before anything is
+// allocated for it, since the browser writes these files.
+func DecodeMozLz4(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, mozLz4Magic) || len(data) < len(mozLz4Magic)+4 {
+		return nil, fmt.Errorf("%w: Missing header", ErrInvalidMozLz4)
+	}
+	size := binary.LittleEndian.Uint32(data[len(mozLz4Magic):])
+	block := data[len(mozLz4Magic)+4:]
+	if uint64(size) > lz4MaxExpansion*uint64(len(block)) {
+		return nil, fmt.Errorf("%w: The announced size of %d bytes is too large for %d compressed bytes", ErrInvalidMozLz4, size, len(block))
+	}
+	return decodeLz4Block(block, int(size))
+}
+
+// decodeLz4Block decompresses an LZ4 block into exactly size bytes.
+// Each sequence of the block is a token, literals and, except for the
+// last sequence, a match that repeats earlier output.
+func decodeLz4Block(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	i := 0
+	readLength := func(length int) (int, error) {
+		if length != 15 {
+			return length, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, fmt.Errorf("%w: Truncated length", ErrInvalidMozLz4)
+			}
+			b := src[i]
+			i++
+			length += int(b)
+			if b != 255 {
+				return length, nil
+			}
+		}
+	}
+
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		literals, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if literals > len(src)-i || literals > size-len(dst) {
+			return nil, fmt.Errorf("%w: Literals out of bounds", ErrInvalidMozLz4)
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, fmt.Errorf("%w: Truncated match offset", ErrInvalidMozLz4)
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		matchLength, err := readLength(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+		matchLength += 4
+		if offset == 0 || offset > len(dst) || matchLength > size-len(dst) {
+			return nil, fmt.Errorf("%w: Match out of bounds", ErrInvalidMozLz4)
+		}
+		// Matches may overlap the output they produce, so they are
+		// copied byte by byte.
+		start := len(dst) - offset
+		for j := 0; j < matchLength; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	if len(dst) != size {
+		return nil, fmt.Errorf("%w: Decompressed to %d bytes instead of %d", ErrInvalidMozLz4, len(dst), size)
+	}
+	return dst, nil
+}
@@ -0,0 +1,90 @@
+package io_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestDecodeMozLz4(t *testing.T) {
+	mozLz4 := func(size byte, block ...byte) []byte {
+		return append([]byte{'m', 'o', 'z', 'L', 'z', '4', '0', 0, size, 0, 0, 0}, block...)
+	}
+	longLiteral := strings.Repeat("x", 20)
+
+	testCases := []struct {
+		desc string
+
+		expected    string
+		expectedErr bool
+		input       []byte
+	}{
+		{
+			desc: "Overlapping match",
+
+			expected: "abcabcabcab!",
+			input:    mozLz4(12, 0x34, 'a', 'b', 'c', 3, 0, 0x10, '!'),
+		},
+		{
+			desc: "Extended literal length",
+
+			expected: longLiteral,
+			input:    mozLz4(20, append([]byte{0xf0, 5}, longLiteral...)...),
+		},
+		{
+			desc: "Extended match length",
+
+			expected: strings.Repeat("a", 25),
+			input:    mozLz4(25, 0x1f, 'a', 1, 0, 4, 0x10, 'a'),
+		},
+		{
+			desc: "Missing header",
+
+			expectedErr: true,
+			input:       []byte{0x10, 'a'},
+		},
+		{
+			desc: "Truncated header",
+
+			expectedErr: true,
+			input:       []byte{'m', 'o', 'z', 'L', 'z', '4', '0', 0, 12, 0},
+		},
+		{
+			desc: "Oversized header",
+
+			expectedErr: true,
+			input:       []byte{'m', 'o', 'z', 'L', 'z', '4', '0', 0, 0xff, 0xff, 0xff, 0xff, 0x10, 'a'},
+		},
+		{
+			desc: "Smaller than announced",
+
+			expectedErr: true,
+			input:       mozLz4(12, 0x30, 'a', 'b', 'c'),
+		},
+		{
+			desc: "Match before the start",
+
+			expectedErr: true,
+			input:       mozLz4(12, 0x14, 'a', 3, 0, 0x10, '!'),
+		},
+		{
+			desc: "Larger than announced",
+
+			expectedErr: true,
+			input:       mozLz4(2, 0x30, 'a', 'b', 'c'),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			actual, err := uio.DecodeMozLz4(tC.input)
+			if tC.expectedErr {
+				assert.ErrorIs(t, err, uio.ErrInvalidMozLz4)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expected, string(actual))
+		})
+	}
+}
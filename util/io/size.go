@@ -0,0 +1,75 @@
+package io
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// DirSize returns the combined size of all regular files in a
+// directory tree. Symlinks are not followed.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// ParseByteSize parses sizes like "512", "20M" or "1.5GiB". All
+// units are binary, i.e. "1K" and "1KiB" are both 1024 bytes.
+func ParseByteSize(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	factor := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size: %s", str)
+	}
+	return int64(value * float64(factor)), nil
+}
+
+// FormatByteSize formats a size in a human-readable way using binary
+// units.
+func FormatByteSize(size int64) string {
+	for _, unit := range byteSizeUnits[:4] {
+		if size >= unit.factor {
+			return fmt.Sprintf("%.1f %s", float64(size)/float64(unit.factor), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", size)
+}
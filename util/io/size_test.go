@@ -0,0 +1,45 @@
+package io_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	uio "t0ast.cc/tbml/util/io"
+)
+
+func TestDirSize(t *testing.T) {
+	size, err := uio.DirSize("testdata/dir-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(18), size)
+}
+
+func TestParseByteSize(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+	}{
+		{"512", 512},
+		{"512B", 512},
+		{"20M", 20 << 20},
+		{"1.5GiB", 3 << 29},
+		{" 2 K ", 2048},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.input, func(t *testing.T) {
+			actual, err := uio.ParseByteSize(tC.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expected, actual)
+		})
+	}
+
+	_, err := uio.ParseByteSize("lots")
+	assert.Error(t, err)
+	_, err = uio.ParseByteSize("-1G")
+	assert.Error(t, err)
+}
+
+func TestFormatByteSize(t *testing.T) {
+	assert.Equal(t, "512 B", uio.FormatByteSize(512))
+	assert.Equal(t, "2.0 KiB", uio.FormatByteSize(2048))
+	assert.Equal(t, "1.5 GiB", uio.FormatByteSize(3<<29))
+}
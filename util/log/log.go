@@ -0,0 +1,244 @@
+// Package log writes leveled log entries as human-readable lines or as
+// JSON objects, one per line.
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatText Format = "text"
+)
+
+var ErrInvalidLevel error = errors.New("Invalid log level")
+
+var ErrInvalidFormat error = errors.New("Invalid log format")
+
+// ParseLevel parses the name of a level, ignoring case.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrInvalidLevel, name)
+}
+
+// ParseFormat parses the name of a format, ignoring case.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatJSON, FormatText:
+		return format, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidFormat, name)
+	}
+}
+
+type sink struct {
+	format Format
+	level  Level
+	mutex  *sync.Mutex
+	w      io.Writer
+}
+
+// Logger writes entries to one or more writers, each with its own
+// level and format. A nil Logger discards everything.
+type Logger struct {
+	fields []interface{}
+	sinks  []sink
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// New creates a logger that writes entries of the given level and
+// above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		sinks: []sink{{format: format, level: level, mutex: &sync.Mutex{}, w: w}},
+		now:   time.Now,
+	}
+}
+
+// Tee returns a logger that writes to w in addition to the writers of
+// l.
+func (l *Logger) Tee(w io.Writer, level Level, format Format) *Logger {
+	teed := New(w, level, format)
+	if l != nil {
+		teed.fields = l.fields
+		teed.sinks = append(append([]sink{}, l.sinks...), teed.sinks...)
+		teed.now = l.now
+	}
+	return teed
+}
+
+// With returns a logger that adds the given key-value pairs to every
+// entry.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	return &Logger{
+		fields: append(append([]interface{}{}, l.fields...), keyvals...),
+		sinks:  l.sinks,
+		now:    l.now,
+	}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if l == nil {
+		return
+	}
+	now := l.now().UTC()
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	for _, sink := range l.sinks {
+		if level < sink.level {
+			continue
+		}
+		var line []byte
+		if sink.format == FormatJSON {
+			line = formatJSON(now, level, msg, fields)
+		} else {
+			line = formatText(now, level, msg, fields)
+		}
+		sink.mutex.Lock()
+		// Logging must never make an operation fail, so write errors
+		// are ignored.
+		_, _ = sink.w.Write(line)
+		sink.mutex.Unlock()
+	}
+}
+
+func formatText(now time.Time, level Level, msg string, fields []interface{}) []byte {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%s %-5s %s", now.Format(time.RFC3339), strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		text := fmt.Sprint(value)
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		fmt.Fprintf(sb, " %s=%s", key, text)
+	}
+	sb.WriteByte('\n')
+	return []byte(sb.String())
+}
+
+func formatJSON(now time.Time, level Level, msg string, fields []interface{}) []byte {
+	// The keys are written in order, which a map wouldn't do.
+	buf := &strings.Builder{}
+	writeField := func(key string, value interface{}) {
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		keyBytes, _ := json.Marshal(key)
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			valueBytes, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(keyBytes)
+		buf.WriteByte(':')
+		buf.Write(valueBytes)
+	}
+	writeField("time", now.Format(time.RFC3339Nano))
+	writeField("level", level.String())
+	writeField("msg", msg)
+	for i := 0; i < len(fields); i += 2 {
+		writeField(fieldAt(fields, i))
+	}
+	return []byte("{" + buf.String() + "}\n")
+}
+
+// fieldAt returns the key-value pair starting at index i. Errors are
+// logged by their message.
+func fieldAt(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 >= len(fields) {
+		return key, nil
+	}
+	value := fields[i+1]
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	return key, value
+}
+
+var (
+	defaultLogger      = New(os.Stderr, LevelWarn, FormatText)
+	defaultLoggerMutex sync.Mutex
+)
+
+// Default returns the logger set with SetDefault. Unless that was
+// called, warnings and errors are written to standard error.
+func Default() *Logger {
+	defaultLoggerMutex.Lock()
+	defer defaultLoggerMutex.Unlock()
+	return defaultLogger
+}
+
+func SetDefault(logger *Logger) {
+	defaultLoggerMutex.Lock()
+	defer defaultLoggerMutex.Unlock()
+	defaultLogger = logger
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that carries a logger.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx or, if there is none,
+// the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return logger
+	}
+	return Default()
+}
@@ -0,0 +1,75 @@
+package log_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ulog "t0ast.cc/tbml/util/log"
+)
+
+func TestTextFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := ulog.New(buf, ulog.LevelInfo, ulog.FormatText).With("instance", "work-1")
+
+	logger.Debug("Hidden")
+	logger.Info("Starting browser", "pid", 42, "url", "https://example.com/?a=b c")
+	logger.Error("Launch failed", "error", errors.New("no sandbox"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	for i, line := range lines {
+		// Drop the timestamp.
+		lines[i] = line[strings.Index(line, " ")+1:]
+	}
+	assert.Equal(t, []string{
+		`INFO  Starting browser instance=work-1 pid=42 url="https://example.com/?a=b c"`,
+		`ERROR Launch failed instance=work-1 error="no sandbox"`,
+	}, lines)
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := ulog.New(buf, ulog.LevelDebug, ulog.FormatJSON)
+
+	logger.With("instance", "work-1").Debug("Synced", "changed", true)
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.NotEmpty(t, entry["time"])
+	delete(entry, "time")
+	assert.Equal(t, map[string]interface{}{
+		"changed":  true,
+		"instance": "work-1",
+		"level":    "debug",
+		"msg":      "Synced",
+	}, entry)
+}
+
+func TestTee(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	file := &bytes.Buffer{}
+	logger := ulog.New(stderr, ulog.LevelWarn, ulog.FormatText).Tee(file, ulog.LevelDebug, ulog.FormatJSON)
+
+	logger.Debug("Details")
+	logger.Warn("Problem")
+
+	assert.Equal(t, 1, strings.Count(stderr.String(), "\n"))
+	assert.Equal(t, 2, strings.Count(file.String(), "\n"))
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *ulog.Logger
+	logger.With("a", 1).Error("Discarded")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ulog.ParseLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, ulog.LevelWarn, level)
+	_, err = ulog.ParseLevel("verbose")
+	assert.ErrorIs(t, err, ulog.ErrInvalidLevel)
+}
@@ -0,0 +1,43 @@
+package string_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ustring "t0ast.cc/tbml/util/string"
+)
+
+func TestNormalizeLabel(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		a string
+		b string
+	}{
+		{
+			desc: "Case",
+
+			a: "Work",
+			b: "wORK",
+		},
+		{
+			desc: "Combining mark",
+
+			a: "caf\u00e9",
+			b: "Cafe\u0301",
+		},
+		{
+			desc: "Several combining marks",
+
+			a: "Vi\u1ec7t",
+			b: "vie\u0323\u0302t",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, ustring.NormalizeLabel(tC.a), ustring.NormalizeLabel(tC.b))
+		})
+	}
+
+	assert.NotEqual(t, ustring.NormalizeLabel("cafe"), ustring.NormalizeLabel("caf\u00e9"))
+}
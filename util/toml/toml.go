@@ -0,0 +1,650 @@
+// Package toml implements a decoder for the subset of TOML that is
+// useful for configuration files.
+//
+// Tables, arrays of tables, inline tables, dotted keys, all string
+// kinds, integers, finite floats, booleans and arrays are supported.
+// Dates and times are returned as strings in the format they were
+// written in.
+package toml
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var dateTimeRE *regexp.Regexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}|^\d{2}:\d{2}`)
+
+// SyntaxError is returned for malformed documents.
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (e SyntaxError) Error() string {
+	return fmt.Sprintf("TOML syntax error on line %d: %s", e.Line, e.Message)
+}
+
+// maxNesting limits how deeply arrays and inline tables may be nested,
+// so the recursive parser can't exhaust the stack.
+const maxNesting = 64
+
+// tableKind records how a table was defined, which decides whether it
+// may be extended later on.
+type tableKind int
+
+const (
+	// implicitTable was created as the parent of a table header and
+	// may still be defined by a header of its own.
+	implicitTable tableKind = iota
+	headerTable
+	dottedTable
+	// inlineTable is complete once its closing brace is read.
+	inlineTable
+)
+
+type parser struct {
+	input string
+	pos   int
+	line  int
+	depth int
+
+	root    map[string]interface{}
+	current map[string]interface{}
+	// kinds is keyed by table identity rather than path so each
+	// element of an array of tables is tracked separately.
+	kinds map[uintptr]tableKind
+}
+
+// Unmarshal decodes a TOML document. Tables are returned as
+// map[string]interface{}, arrays and arrays of tables as
+// []interface{}.
+func Unmarshal(data []byte) (map[string]interface{}, error) {
+	if !utf8.Valid(data) {
+		return nil, SyntaxError{Line: 1, Message: "Document is not valid UTF-8"}
+	}
+	root := make(map[string]interface{})
+	p := parser{
+		input:   string(data),
+		line:    1,
+		root:    root,
+		current: root,
+		kinds:   make(map[uintptr]tableKind),
+	}
+	p.setKind(root, headerTable)
+	if err := p.parseDocument(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return SyntaxError{Line: p.line, Message: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *parser) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(p.input[p.pos:], prefix)
+}
+
+func (p *parser) advance(n int) {
+	for i := 0; i < n && !p.eof(); i++ {
+		if p.input[p.pos] == '\n' {
+			p.line++
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) skipWhitespace() {
+	for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+		p.advance(1)
+	}
+}
+
+func (p *parser) skipComment() {
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.advance(1)
+		}
+	}
+}
+
+// skipBlank skips whitespace, comments and newlines.
+func (p *parser) skipBlank() {
+	for {
+		p.skipWhitespace()
+		p.skipComment()
+		if p.hasPrefix("\r\n") {
+			p.advance(2)
+		} else if p.peek() == '\n' {
+			p.advance(1)
+		} else {
+			return
+		}
+	}
+}
+
+func (p *parser) expectLineEnd() error {
+	p.skipWhitespace()
+	p.skipComment()
+	if p.eof() {
+		return nil
+	}
+	if p.hasPrefix("\r\n") {
+		p.advance(2)
+		return nil
+	}
+	if p.peek() == '\n' {
+		p.advance(1)
+		return nil
+	}
+	return p.errorf("Expected end of line but got %q", p.peek())
+}
+
+func (p *parser) parseDocument() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		var err error
+		if p.hasPrefix("[[") {
+			err = p.parseArrayTableHeader()
+		} else if p.peek() == '[' {
+			err = p.parseTableHeader()
+		} else {
+			err = p.parseKeyValue(p.current)
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.expectLineEnd(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) parseTableHeader() error {
+	p.advance(1)
+	p.skipWhitespace()
+	key, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipWhitespace()
+	if p.peek() != ']' {
+		return p.errorf("Expected ] after table name")
+	}
+	p.advance(1)
+
+	parent, err := p.navigate(p.root, key[:len(key)-1], false)
+	if err != nil {
+		return err
+	}
+	last := key[len(key)-1]
+	path := strings.Join(key, ".")
+	switch existing := parent[last].(type) {
+	case nil:
+		table := make(map[string]interface{})
+		p.setKind(table, headerTable)
+		parent[last] = table
+		p.current = table
+	case map[string]interface{}:
+		switch p.kind(existing) {
+		case headerTable:
+			return p.errorf("Table %s is defined twice", path)
+		case dottedTable:
+			return p.errorf("Table %s is already defined by dotted keys", path)
+		case inlineTable:
+			return p.errorf("Table %s is already defined as an inline table", path)
+		}
+		p.setKind(existing, headerTable)
+		p.current = existing
+	default:
+		return p.errorf("%s is not a table", path)
+	}
+	return nil
+}
+
+func (p *parser) parseArrayTableHeader() error {
+	p.advance(2)
+	p.skipWhitespace()
+	key, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipWhitespace()
+	if !p.hasPrefix("]]") {
+		return p.errorf("Expected ]] after array of tables name")
+	}
+	p.advance(2)
+
+	parent, err := p.navigate(p.root, key[:len(key)-1], false)
+	if err != nil {
+		return err
+	}
+	last := key[len(key)-1]
+	table := make(map[string]interface{})
+	p.setKind(table, headerTable)
+	switch existing := parent[last].(type) {
+	case nil:
+		parent[last] = []interface{}{table}
+	case []interface{}:
+		if !p.isArrayOfTables(existing) {
+			return p.errorf("%s is not an array of tables", strings.Join(key, "."))
+		}
+		parent[last] = append(existing, table)
+	default:
+		return p.errorf("%s is not an array of tables", strings.Join(key, "."))
+	}
+	p.current = table
+	return nil
+}
+
+// navigate walks down the given key path starting at table, creating
+// tables as necessary. Arrays of tables resolve to their last element.
+// Dotted keys may only extend tables that were created by dotted keys.
+func (p *parser) navigate(table map[string]interface{}, key []string, dotted bool) (map[string]interface{}, error) {
+	for i, part := range key {
+		path := strings.Join(key[:i+1], ".")
+		switch next := table[part].(type) {
+		case nil:
+			created := make(map[string]interface{})
+			if dotted {
+				p.setKind(created, dottedTable)
+			}
+			table[part] = created
+			table = created
+		case map[string]interface{}:
+			kind := p.kind(next)
+			if kind == inlineTable {
+				return nil, p.errorf("%s is an inline table and can't be extended", path)
+			}
+			if dotted && kind != dottedTable {
+				return nil, p.errorf("%s is already defined as a table and can't be extended by dotted keys", path)
+			}
+			table = next
+		case []interface{}:
+			if dotted || !p.isArrayOfTables(next) {
+				return nil, p.errorf("%s is not a table", path)
+			}
+			table = next[len(next)-1].(map[string]interface{})
+		default:
+			return nil, p.errorf("%s is not a table", path)
+		}
+	}
+	return table, nil
+}
+
+// isArrayOfTables tells arrays of tables apart from array values, which
+// can't be extended.
+func (p *parser) isArrayOfTables(array []interface{}) bool {
+	if len(array) == 0 {
+		return false
+	}
+	last, ok := array[len(array)-1].(map[string]interface{})
+	return ok && p.kind(last) != inlineTable
+}
+
+func (p *parser) kind(table map[string]interface{}) tableKind {
+	return p.kinds[reflect.ValueOf(table).Pointer()]
+}
+
+func (p *parser) setKind(table map[string]interface{}, kind tableKind) {
+	p.kinds[reflect.ValueOf(table).Pointer()] = kind
+}
+
+func (p *parser) parseKeyValue(table map[string]interface{}) error {
+	key, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipWhitespace()
+	if p.peek() != '=' {
+		return p.errorf("Expected = after key %s", strings.Join(key, "."))
+	}
+	p.advance(1)
+	p.skipWhitespace()
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	parent, err := p.navigate(table, key[:len(key)-1], true)
+	if err != nil {
+		return err
+	}
+	last := key[len(key)-1]
+	if _, exists := parent[last]; exists {
+		return p.errorf("Key %s is defined twice", strings.Join(key, "."))
+	}
+	parent[last] = value
+	return nil
+}
+
+func (p *parser) parseKey() ([]string, error) {
+	key := []string{}
+	for {
+		p.skipWhitespace()
+		var part string
+		var err error
+		switch p.peek() {
+		case '"':
+			part, err = p.parseBasicString()
+		case '\'':
+			part, err = p.parseLiteralString()
+		default:
+			start := p.pos
+			for c := p.peek(); isBareKeyChar(c); c = p.peek() {
+				p.advance(1)
+			}
+			part = p.input[start:p.pos]
+			if part == "" {
+				return nil, p.errorf("Expected a key")
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = append(key, part)
+
+		p.skipWhitespace()
+		if p.peek() != '.' {
+			return key, nil
+		}
+		p.advance(1)
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	switch {
+	case p.hasPrefix(`"""`):
+		return p.parseMultiLineBasicString()
+	case p.hasPrefix("'''"):
+		return p.parseMultiLineLiteralString()
+	case p.peek() == '"':
+		return p.parseBasicString()
+	case p.peek() == '\'':
+		return p.parseLiteralString()
+	case p.peek() == '[':
+		return p.parseArray()
+	case p.peek() == '{':
+		return p.parseInlineTable()
+	case p.hasPrefix("true"):
+		p.advance(4)
+		return true, nil
+	case p.hasPrefix("false"):
+		p.advance(5)
+		return false, nil
+	}
+
+	start := p.pos
+	for c := p.peek(); isBareKeyChar(c) || c == '+' || c == '.' || c == ':'; c = p.peek() {
+		p.advance(1)
+	}
+	// Date-times may be separated by a space instead of a "T".
+	if p.peek() == ' ' && dateTimeRE.MatchString(p.input[start:p.pos]) && p.pos+1 < len(p.input) && p.input[p.pos+1] >= '0' && p.input[p.pos+1] <= '9' {
+		p.advance(1)
+		for c := p.peek(); isBareKeyChar(c) || c == '+' || c == '.' || c == ':'; c = p.peek() {
+			p.advance(1)
+		}
+	}
+	token := p.input[start:p.pos]
+	if token == "" {
+		return nil, p.errorf("Expected a value")
+	}
+	return p.parseScalar(token)
+}
+
+func (p *parser) parseScalar(token string) (interface{}, error) {
+	if dateTimeRE.MatchString(token) {
+		return token, nil
+	}
+
+	clean := strings.ReplaceAll(token, "_", "")
+	for prefix, base := range map[string]int{"0x": 16, "0o": 8, "0b": 2} {
+		if strings.HasPrefix(clean, prefix) {
+			i, err := strconv.ParseInt(clean[2:], base, 64)
+			if err != nil {
+				return nil, p.errorf("Invalid integer %s", token)
+			}
+			return i, nil
+		}
+	}
+	if i, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil {
+		// Configuration values have no use for them and they would
+		// slip through comparisons unnoticed.
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, p.errorf("Infinity and NaN are not supported")
+		}
+		return f, nil
+	}
+	return nil, p.errorf("Invalid value %s", token)
+}
+
+func (p *parser) parseArray() (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	p.advance(1)
+	array := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.advance(1)
+			return array, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.advance(1)
+		case ']':
+		default:
+			return nil, p.errorf("Expected , or ] in array")
+		}
+	}
+}
+
+func (p *parser) parseInlineTable() (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	p.advance(1)
+	table := make(map[string]interface{})
+	defer p.setKind(table, inlineTable)
+	p.skipWhitespace()
+	if p.peek() == '}' {
+		p.advance(1)
+		return table, nil
+	}
+	for {
+		p.skipWhitespace()
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipWhitespace()
+		switch p.peek() {
+		case ',':
+			p.advance(1)
+		case '}':
+			p.advance(1)
+			return table, nil
+		default:
+			return nil, p.errorf("Expected , or } in inline table")
+		}
+	}
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxNesting {
+		return p.errorf("Values nested more than %d levels deep", maxNesting)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) parseLiteralString() (string, error) {
+	p.advance(1)
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' {
+		if p.peek() == '\n' {
+			return "", p.errorf("Unterminated string")
+		}
+		p.advance(1)
+	}
+	if p.eof() {
+		return "", p.errorf("Unterminated string")
+	}
+	str := p.input[start:p.pos]
+	p.advance(1)
+	return str, nil
+}
+
+func (p *parser) parseMultiLineLiteralString() (string, error) {
+	p.advance(3)
+	p.skipInitialNewline()
+	end := strings.Index(p.input[p.pos:], "'''")
+	if end == -1 {
+		return "", p.errorf("Unterminated string")
+	}
+	str := p.input[p.pos : p.pos+end]
+	p.advance(end + 3)
+	return str, nil
+}
+
+func (p *parser) skipInitialNewline() {
+	if p.hasPrefix("\r\n") {
+		p.advance(2)
+	} else if p.peek() == '\n' {
+		p.advance(1)
+	}
+}
+
+func (p *parser) parseBasicString() (string, error) {
+	p.advance(1)
+	sb := strings.Builder{}
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("Unterminated string")
+		}
+		c := p.peek()
+		if c == '"' {
+			p.advance(1)
+			return sb.String(), nil
+		}
+		if c == '\\' {
+			if err := p.parseEscape(&sb); err != nil {
+				return "", err
+			}
+			continue
+		}
+		sb.WriteByte(c)
+		p.advance(1)
+	}
+}
+
+func (p *parser) parseMultiLineBasicString() (string, error) {
+	p.advance(3)
+	p.skipInitialNewline()
+	sb := strings.Builder{}
+	for {
+		if p.eof() {
+			return "", p.errorf("Unterminated string")
+		}
+		if p.hasPrefix(`"""`) {
+			p.advance(3)
+			return sb.String(), nil
+		}
+		c := p.peek()
+		if c == '\\' {
+			// A backslash at the end of a line trims all following
+			// whitespace.
+			rest := strings.TrimLeft(p.input[p.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				p.advance(1)
+				for c := p.peek(); c == ' ' || c == '\t' || c == '\n' || c == '\r'; c = p.peek() {
+					p.advance(1)
+				}
+				continue
+			}
+			if err := p.parseEscape(&sb); err != nil {
+				return "", err
+			}
+			continue
+		}
+		sb.WriteByte(c)
+		p.advance(1)
+	}
+}
+
+func (p *parser) parseEscape(sb *strings.Builder) error {
+	p.advance(1)
+	c := p.peek()
+	p.advance(1)
+	switch c {
+	case 'b':
+		sb.WriteByte('\b')
+	case 't':
+		sb.WriteByte('\t')
+	case 'n':
+		sb.WriteByte('\n')
+	case 'f':
+		sb.WriteByte('\f')
+	case 'r':
+		sb.WriteByte('\r')
+	case '"':
+		sb.WriteByte('"')
+	case '\\':
+		sb.WriteByte('\\')
+	case 'u', 'U':
+		length := 4
+		if c == 'U' {
+			length = 8
+		}
+		if p.pos+length > len(p.input) {
+			return p.errorf("Invalid unicode escape")
+		}
+		codePoint, err := strconv.ParseUint(p.input[p.pos:p.pos+length], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(codePoint)) {
+			return p.errorf("Invalid unicode escape")
+		}
+		sb.WriteRune(rune(codePoint))
+		p.advance(length)
+	default:
+		return p.errorf("Invalid escape sequence \\%c", c)
+	}
+	return nil
+}
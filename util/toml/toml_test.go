@@ -0,0 +1,220 @@
+package toml_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	ustring "t0ast.cc/tbml/util/string"
+	"t0ast.cc/tbml/util/toml"
+)
+
+func TestUnmarshal(t *testing.T) {
+	actual, err := toml.Unmarshal([]byte(ustring.TrimIndentation(`
+		# A comment
+		title = "TOML \"test\"" # Trailing comment
+		literal = 'C:\Users'
+		multiline = """
+		Roses are red
+		Violets are \
+		  blue"""
+		multilineLiteral = '''
+		No \escapes'''
+		integer = 1_000
+		hex = 0xff
+		negative = -5
+		float = 3.5
+		bool = true
+		date = 1979-05-27T07:32:00Z
+		array = [
+			1,
+			2, # Comment in array
+		]
+		nested = [[1, 2], ["a"]]
+		inline = { a = 1, b.c = "d" }
+		dotted.key = "value"
+		"quoted key" = 1
+
+		[table]
+		key = "value"
+
+		[table.sub]
+		key = "sub value"
+
+		[[items]]
+		name = "first"
+
+		[items.details]
+		size = 1
+
+		[[items]]
+		name = "second"
+
+		[items.details]
+		size = 2
+	`)))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"title":            `TOML "test"`,
+		"literal":          `C:\Users`,
+		"multiline":        "Roses are red\nViolets are blue",
+		"multilineLiteral": `No \escapes`,
+		"integer":          int64(1000),
+		"hex":              int64(255),
+		"negative":         int64(-5),
+		"float":            3.5,
+		"bool":             true,
+		"date":             "1979-05-27T07:32:00Z",
+		"array":            []interface{}{int64(1), int64(2)},
+		"nested":           []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{"a"}},
+		"inline": map[string]interface{}{
+			"a": int64(1),
+			"b": map[string]interface{}{
+				"c": "d",
+			},
+		},
+		"dotted": map[string]interface{}{
+			"key": "value",
+		},
+		"quoted key": int64(1),
+		"table": map[string]interface{}{
+			"key": "value",
+			"sub": map[string]interface{}{
+				"key": "sub value",
+			},
+		},
+		"items": []interface{}{
+			map[string]interface{}{
+				"name": "first",
+				"details": map[string]interface{}{
+					"size": int64(1),
+				},
+			},
+			map[string]interface{}{
+				"name": "second",
+				"details": map[string]interface{}{
+					"size": int64(2),
+				},
+			},
+		},
+	}, actual)
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	testCases := []struct {
+		desc string
+
+		input string
+		line  int
+	}{
+		{
+			desc: "Duplicate key",
+
+			input: "a = 1\na = 2",
+			line:  2,
+		},
+		{
+			desc: "Duplicate table",
+
+			input: "[a]\n[a]",
+			line:  2,
+		},
+		{
+			desc: "Unterminated string",
+
+			input: "a = \"foo\nb = 1",
+			line:  1,
+		},
+		{
+			desc: "Missing value",
+
+			input: "a =",
+			line:  1,
+		},
+		{
+			desc: "Too deeply nested",
+
+			input: "a = " + strings.Repeat("[", 100) + strings.Repeat("]", 100),
+			line:  1,
+		},
+		{
+			desc: "Garbage after value",
+
+			input: "a = 1 2",
+			line:  1,
+		},
+		{
+			desc: "Key redefined as table",
+
+			input: "a = 1\n[a.b]",
+			line:  2,
+		},
+		{
+			desc: "Inline table redefined as table",
+
+			input: "a = { b = 1 }\n[a]",
+			line:  2,
+		},
+		{
+			desc: "Inline table extended by table",
+
+			input: "a = { b = 1 }\n[a.c]",
+			line:  2,
+		},
+		{
+			desc: "Inline table extended by dotted key",
+
+			input: "a = { b = 1 }\na.c = 2",
+			line:  2,
+		},
+		{
+			desc: "Dotted key table redefined as table",
+
+			input: "a.b = 1\n[a]",
+			line:  2,
+		},
+		{
+			desc: "Table extended by dotted key",
+
+			input: "[a.b]\n[a]\nb.c = 1",
+			line:  3,
+		},
+		{
+			desc: "Array extended as array of tables",
+
+			input: "a = [{ b = 1 }]\n[[a]]",
+			line:  2,
+		},
+		{
+			desc: "Infinity",
+
+			input: "a = -inf",
+			line:  1,
+		},
+		{
+			desc: "NaN",
+
+			input: "a = nan",
+			line:  1,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := toml.Unmarshal([]byte(tC.input))
+			var syntaxErr toml.SyntaxError
+			if assert.ErrorAs(t, err, &syntaxErr) {
+				assert.Equal(t, tC.line, syntaxErr.Line)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add([]byte("a = 1\n[b]\nc = \"d\"\n[[e]]\nf = [1, 2.5, true, 'g', {h = 0x10}]\n"))
+	f.Add([]byte("s = \"\"\"\nmulti\\\n  line\"\"\"\nt = 1979-05-27 07:32:00Z\n"))
+	f.Add([]byte("a.\"b c\".d = 1_000\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = toml.Unmarshal(data)
+	})
+}